@@ -0,0 +1,237 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TokenSource supplies the bearer token sent with every call as
+// Authorization: Bearer, see Config.Token. Token is called for each
+// request, so it must be cheap when the token it has is still good.
+type TokenSource interface {
+	Token(ctx context.Context) (string, error)
+}
+
+// StaticToken is a TokenSource that always returns the same token, e.g. an
+// API key, for servers accepting keys as bearer tokens.
+type StaticToken string
+
+// Token implements TokenSource.
+func (t StaticToken) Token(context.Context) (string, error) {
+	if t == "" {
+		return "", errors.New("empty token")
+	}
+	return string(t), nil
+}
+
+// ClientCredentialsConfig configures NewClientCredentials.
+type ClientCredentialsConfig struct {
+	// TokenURL is the token endpoint of the authorization server.
+	TokenURL string
+	// ClientID and ClientSecret authenticate the client, with HTTP Basic
+	// authentication.
+	ClientID     string
+	ClientSecret string
+	// Scopes, if set, are requested for the token.
+	Scopes []string
+	// RefreshBefore is how long before it expires a token is replaced, so
+	// that calls never carry one about to expire, and a token endpoint
+	// that's briefly down goes unnoticed. Default 1m.
+	RefreshBefore time.Duration
+	// HTTPClient is used to call TokenURL. Default one with a 10s timeout.
+	HTTPClient *http.Client
+}
+
+// NewClientCredentials returns a TokenSource fetching tokens from an OAuth2
+// authorization server with the client credentials grant (RFC 6749, 4.4).
+// A token is kept until RefreshBefore its expiry, then refreshed by the
+// first call needing it while the others wait. Should refreshing fail, the
+// old token is used until it actually expires. Tokens returned without an
+// expires_in are refreshed after 5 minutes.
+func NewClientCredentials(cfg ClientCredentialsConfig) TokenSource {
+	if cfg.RefreshBefore <= 0 {
+		cfg.RefreshBefore = time.Minute
+	}
+	if cfg.HTTPClient == nil {
+		cfg.HTTPClient = &http.Client{Timeout: 10 * time.Second}
+	}
+	return &clientCredentials{cfg: cfg, sem: make(chan struct{}, 1)}
+}
+
+type clientCredentials struct {
+	cfg ClientCredentialsConfig
+	sem chan struct{} // held while refreshing
+
+	mtx     sync.Mutex
+	token   string
+	expires time.Time
+}
+
+func (c *clientCredentials) cached(now time.Time) (token string, fresh, valid bool) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.token == "" || !now.Before(c.expires) {
+		return "", false, false
+	}
+	return c.token, now.Before(c.expires.Add(-c.cfg.RefreshBefore)), true
+}
+
+func (c *clientCredentials) Token(ctx context.Context) (string, error) {
+	if token, fresh, _ := c.cached(time.Now()); fresh {
+		return token, nil
+	}
+	select {
+	case c.sem <- struct{}{}:
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+	defer func() { <-c.sem }()
+	// Another call may have refreshed it while this one waited.
+	token, fresh, valid := c.cached(time.Now())
+	if fresh {
+		return token, nil
+	}
+	next, ttl, err := c.fetch(ctx)
+	if err != nil {
+		if valid {
+			return token, nil
+		}
+		return "", err
+	}
+	c.mtx.Lock()
+	c.token, c.expires = next, time.Now().Add(ttl)
+	c.mtx.Unlock()
+	return next, nil
+}
+
+// fetch asks the authorization server for a new token.
+func (c *clientCredentials) fetch(ctx context.Context) (token string, ttl time.Duration, err error) {
+	form := url.Values{"grant_type": {"client_credentials"}}
+	if len(c.cfg.Scopes) > 0 {
+		form.Set("scope", strings.Join(c.cfg.Scopes, " "))
+	}
+	req, err := http.NewRequest("POST", c.cfg.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", 0, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	// Credentials are form-encoded before being used for Basic
+	// authentication, as RFC 6749, 2.3.1 requires.
+	req.SetBasicAuth(url.QueryEscape(c.cfg.ClientID), url.QueryEscape(c.cfg.ClientSecret))
+	resp, err := c.cfg.HTTPClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", 0, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", 0, err
+	}
+	var result struct {
+		AccessToken string `json:"access_token"`
+		TokenType   string `json:"token_type"`
+		ExpiresIn   int64  `json:"expires_in"`
+		Error       string `json:"error"`
+		Description string `json:"error_description"`
+	}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return "", 0, fmt.Errorf("token endpoint: %s: %v", resp.Status, err)
+	}
+	switch {
+	case resp.StatusCode != http.StatusOK || result.Error != "":
+		return "", 0, fmt.Errorf("token endpoint: %s: %s", resp.Status, strings.TrimSpace(result.Error+" "+result.Description))
+	case result.AccessToken == "":
+		return "", 0, errors.New("token endpoint: no access_token")
+	case result.TokenType != "" && !strings.EqualFold(result.TokenType, "bearer"):
+		return "", 0, fmt.Errorf("token endpoint: unsupported token type %q", result.TokenType)
+	}
+	ttl = 5 * time.Minute
+	if result.ExpiresIn > 0 {
+		ttl = time.Duration(result.ExpiresIn) * time.Second
+	}
+	return result.AccessToken, ttl, nil
+}
+
+// NewFileToken returns a TokenSource reading the token from the file at
+// path, such as one a sidecar or a Kubernetes projected volume keeps
+// rotated. The file is read again whenever its modification time or size
+// changes, so a rotated token is used from the next call on. Should the
+// file be missing or empty mid-rotation, the last token read is used.
+func NewFileToken(path string) TokenSource {
+	return &fileToken{path: path}
+}
+
+type fileToken struct {
+	path string
+
+	mtx     sync.Mutex
+	token   string
+	modTime time.Time
+	size    int64
+}
+
+func (f *fileToken) Token(context.Context) (string, error) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	fi, err := os.Stat(f.path)
+	if err != nil {
+		return f.last(err)
+	}
+	if f.token != "" && fi.ModTime().Equal(f.modTime) && fi.Size() == f.size {
+		return f.token, nil
+	}
+	data, err := ioutil.ReadFile(f.path)
+	if err != nil {
+		return f.last(err)
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return f.last(fmt.Errorf("%s: empty token", f.path))
+	}
+	f.token, f.modTime, f.size = token, fi.ModTime(), fi.Size()
+	return token, nil
+}
+
+// last returns the last token read, or err if none was.
+func (f *fileToken) last(err error) (string, error) {
+	if f.token != "" {
+		return f.token, nil
+	}
+	return "", err
+}
+
+// tokenTransport is an http.RoundTripper setting the Authorization header
+// of every request to a token from source. A request for which no token
+// can be had fails without being sent.
+type tokenTransport struct {
+	next   http.RoundTripper
+	source TokenSource
+}
+
+func (t *tokenTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	token, err := t.source.Token(req.Context())
+	if err != nil {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, fmt.Errorf("auth token: %v", err)
+	}
+	// A RoundTripper mustn't modify the request it's given.
+	r := *req
+	r.Header = make(http.Header, len(req.Header)+1)
+	for k, v := range req.Header {
+		r.Header[k] = v
+	}
+	r.Header.Set("Authorization", "Bearer "+token)
+	return t.next.RoundTrip(&r)
+}
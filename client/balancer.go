@@ -0,0 +1,366 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/endpoint"
+	"github.com/go-kit/kit/metrics/discard"
+	"github.com/go-kit/kit/sd"
+	"github.com/go-kit/kit/sd/lb"
+	"github.com/praveensastry/customersvc/pkg/customersvc"
+)
+
+// Balancing strategies accepted in Config.Balancer.
+const (
+	// PowerOfTwoChoices picks two instances at random and uses the less
+	// loaded one, load being in-flight requests weighted by latency.
+	PowerOfTwoChoices = "p2c"
+	// LeastLoaded uses the instance with the fewest in-flight requests.
+	LeastLoaded = "least-loaded"
+	// RoundRobin cycles through instances, ignoring load.
+	RoundRobin = "round-robin"
+)
+
+// Config tunes the client. Zero values take the defaults noted below.
+type Config struct {
+	// RetryMax is the number of attempts per call. Default 3.
+	RetryMax int
+	// RetryTimeout bounds a call including all its attempts. Default 500ms.
+	// Attempts turned away with a Retry-After hint are retried after the
+	// hinted wait if it fits; otherwise the call fails at once with a
+	// *customersvc.BackoffError.
+	RetryTimeout time.Duration
+	// RetryBackoff is the longest wait before the second attempt of a call
+	// failing without a hint; it doubles with each further attempt. Waits
+	// are random up to that, so that clients failing together don't retry
+	// together. Default 25ms.
+	RetryBackoff time.Duration
+	// RetryBudget is the largest fraction of calls, over RetryBudgetWindow,
+	// that may be retried, so that retries don't amplify an outage. Beyond
+	// it, calls fail with the error of their last attempt, and stop being
+	// retried until retries are down to half the budget. Negative disables
+	// the budget. Default 0.2.
+	RetryBudget float64
+	// RetryBudgetMin is the number of retries within RetryBudgetWindow
+	// allowed whatever the budget, for clients making few calls. Default
+	// 10.
+	RetryBudgetMin int
+	// RetryBudgetWindow is the period over which RetryBudget is measured.
+	// Default 10s.
+	RetryBudgetWindow time.Duration
+	// RetryMetrics, if set, count retries and report the retry budget.
+	RetryMetrics RetryMetrics
+	// Balancer is one of PowerOfTwoChoices (the default), LeastLoaded or
+	// RoundRobin.
+	Balancer string
+	// EjectErrorRate is the fraction of failed calls to an instance, within
+	// ErrorWindow, above which it's taken out of rotation. Default 0.5.
+	EjectErrorRate float64
+	// EjectMinRequests is the number of calls within ErrorWindow needed
+	// before an instance can be ejected. Default 5.
+	EjectMinRequests int
+	// EjectDuration is how long an ejected instance stays out of rotation.
+	// Default 30s.
+	EjectDuration time.Duration
+	// ErrorWindow is the period over which error rates are measured.
+	// Default 10s.
+	ErrorWindow time.Duration
+	// APIKey, if set, is sent with every call, for servers requiring API
+	// keys.
+	APIKey string
+	// Token, if set, supplies the bearer token sent with every call as
+	// Authorization: Bearer, fetched afresh as it expires or rotates, see
+	// StaticToken, NewClientCredentials and NewFileToken. Calls for which
+	// no token can be had fail without being sent.
+	Token TokenSource
+	// PrewarmConns is the number of connections opened to each instance as
+	// soon as it's discovered, so that the first calls after startup or
+	// failover don't pay for connection setup. Default 0: connect lazily.
+	PrewarmConns int
+	// DNSCacheTTL is how long resolved instance addresses are reused.
+	// Default 0: resolve on every new connection.
+	DNSCacheTTL time.Duration
+	// KeepAlive is the TCP keep-alive period. Default 30s.
+	KeepAlive time.Duration
+	// IdleConnTimeout is how long an idle connection is kept. Default 90s.
+	IdleConnTimeout time.Duration
+	// MaxIdleConnsPerHost is the number of idle connections kept to each
+	// instance. Default PrewarmConns, and at least 2.
+	MaxIdleConnsPerHost int
+	// CacheSize is the number of GET responses kept to be revalidated with
+	// If-None-Match, for read-heavy consumers: unchanged ones are served
+	// from the cache on 304 Not Modified. Default 0: no cache.
+	CacheSize int
+	// SRVRefresh is how often NewDNS resolves its SRV record again.
+	// Default 30s.
+	SRVRefresh time.Duration
+}
+
+func (c Config) withDefaults() Config {
+	if c.RetryMax == 0 {
+		c.RetryMax = 3
+	}
+	if c.RetryTimeout == 0 {
+		c.RetryTimeout = 500 * time.Millisecond
+	}
+	if c.RetryBackoff == 0 {
+		c.RetryBackoff = 25 * time.Millisecond
+	}
+	if c.RetryBudget == 0 {
+		c.RetryBudget = 0.2
+	}
+	if c.RetryBudgetMin == 0 {
+		c.RetryBudgetMin = 10
+	}
+	if c.RetryBudgetWindow == 0 {
+		c.RetryBudgetWindow = 10 * time.Second
+	}
+	if c.RetryMetrics.Retries == nil {
+		c.RetryMetrics.Retries = discard.NewCounter()
+	}
+	if c.RetryMetrics.Denied == nil {
+		c.RetryMetrics.Denied = discard.NewCounter()
+	}
+	if c.RetryMetrics.BudgetExhausted == nil {
+		c.RetryMetrics.BudgetExhausted = discard.NewGauge()
+	}
+	if c.Balancer == "" {
+		c.Balancer = PowerOfTwoChoices
+	}
+	if c.EjectErrorRate == 0 {
+		c.EjectErrorRate = 0.5
+	}
+	if c.EjectMinRequests == 0 {
+		c.EjectMinRequests = 5
+	}
+	if c.EjectDuration == 0 {
+		c.EjectDuration = 30 * time.Second
+	}
+	if c.ErrorWindow == 0 {
+		c.ErrorWindow = 10 * time.Second
+	}
+	if c.KeepAlive == 0 {
+		c.KeepAlive = 30 * time.Second
+	}
+	if c.IdleConnTimeout == 0 {
+		c.IdleConnTimeout = 90 * time.Second
+	}
+	if c.SRVRefresh == 0 {
+		c.SRVRefresh = 30 * time.Second
+	}
+	if c.MaxIdleConnsPerHost == 0 {
+		c.MaxIdleConnsPerHost = c.PrewarmConns
+		if c.MaxIdleConnsPerHost < 2 {
+			c.MaxIdleConnsPerHost = 2
+		}
+	}
+	return c
+}
+
+// pool tracks the instances known to an Instancer, and the health of each.
+// Health is shared by every endpoint, so an instance failing GetCustomer is
+// also avoided for PostCustomer.
+type pool struct {
+	cfg    Config
+	client *http.Client
+	logger customersvc.Logger
+
+	mtx       sync.RWMutex
+	instances []*instance
+	next      uint64 // for RoundRobin
+}
+
+type instance struct {
+	addr string
+
+	mtx          sync.Mutex
+	inflight     int
+	latency      time.Duration // moving average
+	calls, fails int
+	windowStart  time.Time
+	ejectedUntil time.Time
+}
+
+func newPool(instancer sd.Instancer, cfg Config, client *http.Client, logger customersvc.Logger) *pool {
+	p := &pool{cfg: cfg, client: client, logger: logger}
+	events := make(chan sd.Event)
+	go p.watch(events)
+	instancer.Register(events)
+	return p
+}
+
+func (p *pool) watch(events <-chan sd.Event) {
+	for event := range events {
+		if event.Err != nil {
+			p.logger.Log("err", event.Err) // keep using the instances we have
+			continue
+		}
+		p.mtx.Lock()
+		known := make(map[string]*instance, len(p.instances))
+		for _, in := range p.instances {
+			known[in.addr] = in
+		}
+		instances := make([]*instance, 0, len(event.Instances))
+		for _, addr := range event.Instances {
+			in, ok := known[addr]
+			if !ok {
+				in = &instance{addr: addr}
+				if p.cfg.PrewarmConns > 0 {
+					go prewarm(p.client, addr, p.cfg.PrewarmConns)
+				}
+			}
+			instances = append(instances, in)
+		}
+		p.instances = instances
+		p.mtx.Unlock()
+	}
+}
+
+// pick chooses an instance according to the configured strategy, skipping
+// ejected ones unless every instance is ejected.
+func (p *pool) pick() (*instance, error) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	if len(p.instances) == 0 {
+		return nil, lb.ErrNoEndpoints
+	}
+	now := time.Now()
+	healthy := make([]*instance, 0, len(p.instances))
+	for _, in := range p.instances {
+		if !in.ejected(now) {
+			healthy = append(healthy, in)
+		}
+	}
+	if len(healthy) == 0 {
+		healthy = p.instances // fail open rather than refuse every call
+	}
+
+	switch p.cfg.Balancer {
+	case RoundRobin:
+		p.next++
+		return healthy[p.next%uint64(len(healthy))], nil
+	case LeastLoaded:
+		best := healthy[0]
+		for _, in := range healthy[1:] {
+			if in.load() < best.load() {
+				best = in
+			}
+		}
+		return best, nil
+	default:
+		a := healthy[rand.Intn(len(healthy))]
+		if len(healthy) == 1 {
+			return a, nil
+		}
+		b := healthy[rand.Intn(len(healthy)-1)]
+		if b == a {
+			b = healthy[len(healthy)-1]
+		}
+		if b.load() < a.load() {
+			return b, nil
+		}
+		return a, nil
+	}
+}
+
+// balancer returns an lb.Balancer for one endpoint, creating that endpoint
+// for each instance with factory on first use.
+func (p *pool) balancer(factory sd.Factory) lb.Balancer {
+	return &balancer{pool: p, factory: factory, endpoints: map[string]endpoint.Endpoint{}}
+}
+
+type balancer struct {
+	pool    *pool
+	factory sd.Factory
+
+	mtx       sync.Mutex
+	endpoints map[string]endpoint.Endpoint
+}
+
+// Endpoint implements lb.Balancer.
+func (b *balancer) Endpoint() (endpoint.Endpoint, error) {
+	in, err := b.pool.pick()
+	if err != nil {
+		return nil, err
+	}
+	b.mtx.Lock()
+	e, ok := b.endpoints[in.addr]
+	if !ok {
+		e, _, err = b.factory(in.addr)
+		if err != nil {
+			b.mtx.Unlock()
+			return nil, err
+		}
+		b.endpoints[in.addr] = e
+	}
+	b.mtx.Unlock()
+	return b.pool.track(in, e), nil
+}
+
+// track wraps e so that every call updates the health of in.
+func (p *pool) track(in *instance, e endpoint.Endpoint) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		in.start()
+		begin := time.Now()
+		response, err := e(ctx, request)
+		// A call abandoned by the caller says nothing about the instance.
+		failed := err != nil && !errors.Is(err, context.Canceled)
+		if in.finish(time.Since(begin), failed, p.cfg) {
+			p.logger.Log("instance", in.addr, "ejected", p.cfg.EjectDuration)
+		}
+		return response, err
+	}
+}
+
+func (in *instance) ejected(now time.Time) bool {
+	in.mtx.Lock()
+	defer in.mtx.Unlock()
+	return now.Before(in.ejectedUntil)
+}
+
+// load is the expected cost of sending one more request to in.
+func (in *instance) load() float64 {
+	in.mtx.Lock()
+	defer in.mtx.Unlock()
+	// Instances without a latency sample yet look free, so they get probed.
+	return float64(in.inflight+1) * float64(in.latency)
+}
+
+func (in *instance) start() {
+	in.mtx.Lock()
+	in.inflight++
+	in.mtx.Unlock()
+}
+
+// finish records the outcome of a call, and reports whether it caused in to
+// be ejected.
+func (in *instance) finish(took time.Duration, failed bool, cfg Config) bool {
+	in.mtx.Lock()
+	defer in.mtx.Unlock()
+	in.inflight--
+	if in.latency == 0 {
+		in.latency = took
+	} else {
+		in.latency = (4*in.latency + took) / 5
+	}
+
+	now := time.Now()
+	if now.Sub(in.windowStart) > cfg.ErrorWindow {
+		in.calls, in.fails, in.windowStart = 0, 0, now
+	}
+	in.calls++
+	if failed {
+		in.fails++
+	}
+	if in.calls >= cfg.EjectMinRequests && float64(in.fails)/float64(in.calls) >= cfg.EjectErrorRate {
+		in.ejectedUntil = now.Add(cfg.EjectDuration)
+		in.calls, in.fails, in.windowStart = 0, 0, now
+		return true
+	}
+	return false
+}
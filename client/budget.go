@@ -0,0 +1,127 @@
+package client
+
+import (
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/metrics"
+)
+
+// RetryMetrics are the metrics of a client's retries. Nil ones aren't
+// reported.
+type RetryMetrics struct {
+	// Retries counts the attempts made after the first of a call.
+	Retries metrics.Counter
+	// Denied counts the retries the retry budget refused.
+	Denied metrics.Counter
+	// BudgetExhausted is 1 while the retry budget refuses retries, and 0
+	// otherwise.
+	BudgetExhausted metrics.Gauge
+}
+
+// budgetBuckets is the number of buckets the window of a retryBudget is
+// divided into; it slides a bucket at a time.
+const budgetBuckets = 10
+
+// retryBudget caps retries at a fraction of calls over a sliding window, so
+// that when instances fail together, clients retrying don't multiply the
+// load on them. It's shared by every endpoint of a client. Once exhausted,
+// it opens, refusing every retry until retries are down to half the budget,
+// so that retries don't flap back on at the edge of it. A nil retryBudget
+// allows every retry.
+type retryBudget struct {
+	ratio  float64
+	min    int
+	bucket time.Duration
+
+	retries metrics.Counter // retries allowed
+	denied  metrics.Counter // retries refused
+	open    metrics.Gauge   // 1 while open
+
+	mtx     sync.Mutex
+	buckets [budgetBuckets]budgetBucket
+	opened  bool
+}
+
+type budgetBucket struct {
+	start          time.Time
+	calls, retries int
+}
+
+// newRetryBudget returns the retry budget cfg asks for, or nil if it
+// disables it.
+func newRetryBudget(cfg Config) *retryBudget {
+	if cfg.RetryBudget < 0 {
+		return nil
+	}
+	b := &retryBudget{
+		ratio:   cfg.RetryBudget,
+		min:     cfg.RetryBudgetMin,
+		bucket:  cfg.RetryBudgetWindow / budgetBuckets,
+		retries: cfg.RetryMetrics.Retries,
+		denied:  cfg.RetryMetrics.Denied,
+		open:    cfg.RetryMetrics.BudgetExhausted,
+	}
+	b.open.Set(0)
+	return b
+}
+
+// current returns the bucket of now, emptied if it was last used a window
+// ago. The caller must hold mtx.
+func (b *retryBudget) current(now time.Time) *budgetBucket {
+	start := now.Truncate(b.bucket)
+	bk := &b.buckets[int(start.UnixNano()/int64(b.bucket))%budgetBuckets]
+	if !bk.start.Equal(start) {
+		*bk = budgetBucket{start: start}
+	}
+	return bk
+}
+
+// totals returns the calls and retries within the window. The caller must
+// hold mtx.
+func (b *retryBudget) totals(now time.Time) (calls, retries int) {
+	oldest := now.Truncate(b.bucket).Add(-(budgetBuckets - 1) * b.bucket)
+	for _, bk := range b.buckets {
+		if !bk.start.Before(oldest) {
+			calls += bk.calls
+			retries += bk.retries
+		}
+	}
+	return calls, retries
+}
+
+// call counts a call, whose first attempt is never refused.
+func (b *retryBudget) call() {
+	if b == nil {
+		return
+	}
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	b.current(time.Now()).calls++
+}
+
+// allow reports whether a call may be retried, counting the retry if so.
+func (b *retryBudget) allow() bool {
+	if b == nil {
+		return true
+	}
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	now := time.Now()
+	calls, retries := b.totals(now)
+	if b.opened && (retries < b.min || float64(retries) <= b.ratio/2*float64(calls)) {
+		b.opened = false
+		b.open.Set(0)
+	}
+	if !b.opened && retries >= b.min && float64(retries+1) > b.ratio*float64(calls) {
+		b.opened = true
+		b.open.Set(1)
+	}
+	if b.opened {
+		b.denied.Add(1)
+		return false
+	}
+	b.current(now).retries++
+	b.retries.Add(1)
+	return true
+}
@@ -0,0 +1,136 @@
+package client
+
+import (
+	"bytes"
+	"container/list"
+	"io/ioutil"
+	"net/http"
+	"sync"
+
+	"github.com/praveensastry/customersvc/pkg/customersvc"
+)
+
+// etagCache is an http.RoundTripper keeping the most recently used GET
+// responses that carry an ETag. A cached response is never served without
+// asking the server: the request is sent with If-None-Match, and the cached
+// copy is only used if the answer is 304 Not Modified. That saves encoding
+// and transferring unchanged customers, while access checks and deletions
+// take effect at once.
+type etagCache struct {
+	next http.RoundTripper
+	size int
+
+	mtx   sync.Mutex
+	byKey map[string]*list.Element
+	order *list.List // of *cacheEntry, most recently used first
+}
+
+type cacheEntry struct {
+	key    string
+	etag   string
+	header http.Header
+	body   []byte
+}
+
+func newETagCache(next http.RoundTripper, size int) *etagCache {
+	return &etagCache{next: next, size: size, byKey: map[string]*list.Element{}, order: list.New()}
+}
+
+func (c *etagCache) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != "GET" || req.Header.Get("If-None-Match") != "" {
+		return c.next.RoundTrip(req)
+	}
+	key := cacheKey(req)
+	entry, cached := c.get(key)
+	if cached {
+		// A RoundTripper mustn't modify the request it's given.
+		r := *req
+		r.Header = make(http.Header, len(req.Header)+1)
+		for k, v := range req.Header {
+			r.Header[k] = v
+		}
+		r.Header.Set("If-None-Match", entry.etag)
+		req = &r
+	}
+	resp, err := c.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case cached && resp.StatusCode == http.StatusNotModified:
+		resp.Body.Close()
+		return entry.response(req), nil
+	case resp.StatusCode == http.StatusOK && resp.Header.Get("ETag") != "":
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		c.put(&cacheEntry{key: key, etag: resp.Header.Get("ETag"), header: resp.Header, body: body})
+		resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	default:
+		c.remove(key)
+	}
+	return resp, nil
+}
+
+// cacheKey identifies a representation: the host is left out, so that every
+// instance shares it, and the headers selecting the format are put in.
+func cacheKey(req *http.Request) string {
+	return req.URL.RequestURI() + "\n" + req.Header.Get("Accept") + "\n" + req.Header.Get(customersvc.APIVersionHeader)
+}
+
+func (c *etagCache) get(key string) (*cacheEntry, bool) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	e, ok := c.byKey[key]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(e)
+	return e.Value.(*cacheEntry), true
+}
+
+func (c *etagCache) put(entry *cacheEntry) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if e, ok := c.byKey[entry.key]; ok {
+		e.Value = entry
+		c.order.MoveToFront(e)
+		return
+	}
+	c.byKey[entry.key] = c.order.PushFront(entry)
+	for c.order.Len() > c.size {
+		e := c.order.Back()
+		delete(c.byKey, e.Value.(*cacheEntry).key)
+		c.order.Remove(e)
+	}
+}
+
+func (c *etagCache) remove(key string) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if e, ok := c.byKey[key]; ok {
+		delete(c.byKey, key)
+		c.order.Remove(e)
+	}
+}
+
+// response returns the cached response, as if req had got it.
+func (e *cacheEntry) response(req *http.Request) *http.Response {
+	header := make(http.Header, len(e.header))
+	for k, v := range e.header {
+		header[k] = v
+	}
+	return &http.Response{
+		Status:        "200 OK",
+		StatusCode:    http.StatusOK,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          ioutil.NopCloser(bytes.NewReader(e.body)),
+		ContentLength: int64(len(e.body)),
+		Request:       req,
+	}
+}
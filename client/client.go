@@ -1,26 +1,32 @@
 // Package client provides a customersvc client based on a predefined Consul
 // service name and relevant tags. Users must only provide the address of a
-// Consul server.
+// Consul server, or with NewDNS, the name of a DNS SRV record, or with
+// NewStatic, the instances themselves.
 package client
 
 import (
 	"io"
-	"time"
 
 	consulapi "github.com/hashicorp/consul/api"
 
 	"github.com/go-kit/kit/endpoint"
-	"github.com/praveensastry/customersvc/pkg/customersvc"
-	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/sd"
 	"github.com/go-kit/kit/sd/consul"
-	"github.com/go-kit/kit/sd/lb"
+	httptransport "github.com/go-kit/kit/transport/http"
+	"github.com/praveensastry/customersvc/pkg/customersvc"
 )
 
 // New returns a service that's load-balanced over instances of customersvc found
 // in the provided Consul server. The mechanism of looking up customersvc
 // instances in Consul is hard-coded into the client.
-func New(consulAddr string, logger log.Logger) (customersvc.Service, error) {
+func New(consulAddr string, logger customersvc.Logger) (customersvc.Service, error) {
+	return NewWithConfig(consulAddr, Config{}, logger)
+}
+
+// NewWithConfig is like New, with control over retries and load balancing.
+// Instances that fail too often are taken out of rotation for a while, well
+// before Consul's health checks would notice.
+func NewWithConfig(consulAddr string, cfg Config, logger customersvc.Logger) (customersvc.Service, error) {
 	apiclient, err := consulapi.NewClient(&consulapi.Config{
 		Address: consulAddr,
 	})
@@ -34,85 +40,243 @@ func New(consulAddr string, logger log.Logger) (customersvc.Service, error) {
 		consulService = "customersvc"
 		consulTags    = []string{"prod"}
 		passingOnly   = true
-		retryMax      = 3
-		retryTimeout  = 500 * time.Millisecond
 	)
 
 	var (
 		sdclient  = consul.NewClient(apiclient)
 		instancer = consul.NewInstancer(sdclient, logger, consulService, consulTags, passingOnly)
-		endpoints customersvc.Endpoints
+	)
+	return makeEndpoints(instancer, cfg.withDefaults(), logger), nil
+}
+
+// makeEndpoints balances every customersvc endpoint over the instances found
+// by instancer.
+func makeEndpoints(instancer sd.Instancer, cfg Config, logger customersvc.Logger) customersvc.Endpoints {
+	client := newHTTPClient(cfg)
+	options := []httptransport.ClientOption{httptransport.SetClient(client), customersvc.ClientIdempotencyKey()}
+	if cfg.APIKey != "" {
+		options = append(options, customersvc.ClientAPIKey(cfg.APIKey))
+	}
+	var (
+		pool       = newPool(instancer, cfg, client, logger)
+		budget     = newRetryBudget(cfg)
+		endpoints  customersvc.Endpoints
+		factoryFor = func(makeEndpoint func(customersvc.Service) endpoint.Endpoint) sd.Factory {
+			return clientFactory(makeEndpoint, options)
+		}
 	)
 	{
 		factory := factoryFor(customersvc.MakePostCustomerEndpoint)
-		endpointer := sd.NewEndpointer(instancer, factory, logger)
-		balancer := lb.NewRoundRobin(endpointer)
-		retry := lb.Retry(retryMax, retryTimeout, balancer)
+		balancer := pool.balancer(factory)
+		retry := retry(cfg.RetryMax, cfg.RetryTimeout, cfg.RetryBackoff, budget, balancer)
 		endpoints.PostCustomerEndpoint = retry
 	}
 	{
 		factory := factoryFor(customersvc.MakeGetCustomerEndpoint)
-		endpointer := sd.NewEndpointer(instancer, factory, logger)
-		balancer := lb.NewRoundRobin(endpointer)
-		retry := lb.Retry(retryMax, retryTimeout, balancer)
+		balancer := pool.balancer(factory)
+		retry := retry(cfg.RetryMax, cfg.RetryTimeout, cfg.RetryBackoff, budget, balancer)
 		endpoints.GetCustomerEndpoint = retry
 	}
 	{
 		factory := factoryFor(customersvc.MakePutCustomerEndpoint)
-		endpointer := sd.NewEndpointer(instancer, factory, logger)
-		balancer := lb.NewRoundRobin(endpointer)
-		retry := lb.Retry(retryMax, retryTimeout, balancer)
+		balancer := pool.balancer(factory)
+		retry := retry(cfg.RetryMax, cfg.RetryTimeout, cfg.RetryBackoff, budget, balancer)
 		endpoints.PutCustomerEndpoint = retry
 	}
 	{
 		factory := factoryFor(customersvc.MakePatchCustomerEndpoint)
-		endpointer := sd.NewEndpointer(instancer, factory, logger)
-		balancer := lb.NewRoundRobin(endpointer)
-		retry := lb.Retry(retryMax, retryTimeout, balancer)
+		balancer := pool.balancer(factory)
+		retry := retry(cfg.RetryMax, cfg.RetryTimeout, cfg.RetryBackoff, budget, balancer)
 		endpoints.PatchCustomerEndpoint = retry
 	}
 	{
 		factory := factoryFor(customersvc.MakeDeleteCustomerEndpoint)
-		endpointer := sd.NewEndpointer(instancer, factory, logger)
-		balancer := lb.NewRoundRobin(endpointer)
-		retry := lb.Retry(retryMax, retryTimeout, balancer)
+		balancer := pool.balancer(factory)
+		retry := retry(cfg.RetryMax, cfg.RetryTimeout, cfg.RetryBackoff, budget, balancer)
 		endpoints.DeleteCustomerEndpoint = retry
 	}
 	{
 		factory := factoryFor(customersvc.MakeGetAddressesEndpoint)
-		endpointer := sd.NewEndpointer(instancer, factory, logger)
-		balancer := lb.NewRoundRobin(endpointer)
-		retry := lb.Retry(retryMax, retryTimeout, balancer)
+		balancer := pool.balancer(factory)
+		retry := retry(cfg.RetryMax, cfg.RetryTimeout, cfg.RetryBackoff, budget, balancer)
 		endpoints.GetAddressesEndpoint = retry
 	}
 	{
 		factory := factoryFor(customersvc.MakeGetAddressEndpoint)
-		endpointer := sd.NewEndpointer(instancer, factory, logger)
-		balancer := lb.NewRoundRobin(endpointer)
-		retry := lb.Retry(retryMax, retryTimeout, balancer)
+		balancer := pool.balancer(factory)
+		retry := retry(cfg.RetryMax, cfg.RetryTimeout, cfg.RetryBackoff, budget, balancer)
 		endpoints.GetAddressEndpoint = retry
 	}
 	{
 		factory := factoryFor(customersvc.MakePostAddressEndpoint)
-		endpointer := sd.NewEndpointer(instancer, factory, logger)
-		balancer := lb.NewRoundRobin(endpointer)
-		retry := lb.Retry(retryMax, retryTimeout, balancer)
+		balancer := pool.balancer(factory)
+		retry := retry(cfg.RetryMax, cfg.RetryTimeout, cfg.RetryBackoff, budget, balancer)
 		endpoints.PostAddressEndpoint = retry
 	}
 	{
 		factory := factoryFor(customersvc.MakeDeleteAddressEndpoint)
-		endpointer := sd.NewEndpointer(instancer, factory, logger)
-		balancer := lb.NewRoundRobin(endpointer)
-		retry := lb.Retry(retryMax, retryTimeout, balancer)
+		balancer := pool.balancer(factory)
+		retry := retry(cfg.RetryMax, cfg.RetryTimeout, cfg.RetryBackoff, budget, balancer)
 		endpoints.DeleteAddressEndpoint = retry
 	}
-
-	return endpoints, nil
+	{
+		factory := factoryFor(customersvc.MakeGetCustomersByRegionEndpoint)
+		balancer := pool.balancer(factory)
+		retry := retry(cfg.RetryMax, cfg.RetryTimeout, cfg.RetryBackoff, budget, balancer)
+		endpoints.GetCustomersByRegionEndpoint = retry
+	}
+	{
+		factory := factoryFor(customersvc.MakePostAddressesEndpoint)
+		balancer := pool.balancer(factory)
+		retry := retry(cfg.RetryMax, cfg.RetryTimeout, cfg.RetryBackoff, budget, balancer)
+		endpoints.PostAddressesEndpoint = retry
+	}
+	{
+		factory := factoryFor(customersvc.MakeReorderAddressesEndpoint)
+		balancer := pool.balancer(factory)
+		retry := retry(cfg.RetryMax, cfg.RetryTimeout, cfg.RetryBackoff, budget, balancer)
+		endpoints.ReorderAddressesEndpoint = retry
+	}
+	{
+		factory := factoryFor(customersvc.MakeValidateCustomerEndpoint)
+		balancer := pool.balancer(factory)
+		retry := retry(cfg.RetryMax, cfg.RetryTimeout, cfg.RetryBackoff, budget, balancer)
+		endpoints.ValidateCustomerEndpoint = retry
+	}
+	{
+		factory := factoryFor(customersvc.MakeValidateAddressEndpoint)
+		balancer := pool.balancer(factory)
+		retry := retry(cfg.RetryMax, cfg.RetryTimeout, cfg.RetryBackoff, budget, balancer)
+		endpoints.ValidateAddressEndpoint = retry
+	}
+	{
+		factory := factoryFor(customersvc.MakeArchiveCustomerEndpoint)
+		balancer := pool.balancer(factory)
+		retry := retry(cfg.RetryMax, cfg.RetryTimeout, cfg.RetryBackoff, budget, balancer)
+		endpoints.ArchiveCustomerEndpoint = retry
+	}
+	{
+		factory := factoryFor(customersvc.MakeUnarchiveCustomerEndpoint)
+		balancer := pool.balancer(factory)
+		retry := retry(cfg.RetryMax, cfg.RetryTimeout, cfg.RetryBackoff, budget, balancer)
+		endpoints.UnarchiveCustomerEndpoint = retry
+	}
+	{
+		factory := factoryFor(customersvc.MakeGetCustomersEndpoint)
+		balancer := pool.balancer(factory)
+		retry := retry(cfg.RetryMax, cfg.RetryTimeout, cfg.RetryBackoff, budget, balancer)
+		endpoints.GetCustomersEndpoint = retry
+	}
+	{
+		factory := factoryFor(customersvc.MakeGetCustomerStatsEndpoint)
+		balancer := pool.balancer(factory)
+		retry := retry(cfg.RetryMax, cfg.RetryTimeout, cfg.RetryBackoff, budget, balancer)
+		endpoints.GetCustomerStatsEndpoint = retry
+	}
+	{
+		factory := factoryFor(customersvc.MakePrepareCustomerEndpoint)
+		balancer := pool.balancer(factory)
+		retry := retry(cfg.RetryMax, cfg.RetryTimeout, cfg.RetryBackoff, budget, balancer)
+		endpoints.PrepareCustomerEndpoint = retry
+	}
+	{
+		factory := factoryFor(customersvc.MakeCommitCustomerEndpoint)
+		balancer := pool.balancer(factory)
+		retry := retry(cfg.RetryMax, cfg.RetryTimeout, cfg.RetryBackoff, budget, balancer)
+		endpoints.CommitCustomerEndpoint = retry
+	}
+	{
+		factory := factoryFor(customersvc.MakeAbortCustomerEndpoint)
+		balancer := pool.balancer(factory)
+		retry := retry(cfg.RetryMax, cfg.RetryTimeout, cfg.RetryBackoff, budget, balancer)
+		endpoints.AbortCustomerEndpoint = retry
+	}
+	{
+		factory := factoryFor(customersvc.MakeGetCustomerAsOfEndpoint)
+		balancer := pool.balancer(factory)
+		retry := retry(cfg.RetryMax, cfg.RetryTimeout, cfg.RetryBackoff, budget, balancer)
+		endpoints.GetCustomerAsOfEndpoint = retry
+	}
+	{
+		factory := factoryFor(customersvc.MakeGetCustomersPageEndpoint)
+		balancer := pool.balancer(factory)
+		retry := retry(cfg.RetryMax, cfg.RetryTimeout, cfg.RetryBackoff, budget, balancer)
+		endpoints.GetCustomersPageEndpoint = retry
+	}
+	{
+		factory := factoryFor(customersvc.MakeGetCustomerFullEndpoint)
+		balancer := pool.balancer(factory)
+		retry := retry(cfg.RetryMax, cfg.RetryTimeout, cfg.RetryBackoff, budget, balancer)
+		endpoints.GetCustomerFullEndpoint = retry
+	}
+	{
+		factory := factoryFor(customersvc.MakeGetAddressesPageEndpoint)
+		balancer := pool.balancer(factory)
+		retry := retry(cfg.RetryMax, cfg.RetryTimeout, cfg.RetryBackoff, budget, balancer)
+		endpoints.GetAddressesPageEndpoint = retry
+	}
+	{
+		factory := factoryFor(customersvc.MakeGetCustomerByExternalIDEndpoint)
+		balancer := pool.balancer(factory)
+		retry := retry(cfg.RetryMax, cfg.RetryTimeout, cfg.RetryBackoff, budget, balancer)
+		endpoints.GetCustomerByExternalIDEndpoint = retry
+	}
+	{
+		factory := factoryFor(customersvc.MakeGrantConsentEndpoint)
+		balancer := pool.balancer(factory)
+		retry := retry(cfg.RetryMax, cfg.RetryTimeout, cfg.RetryBackoff, budget, balancer)
+		endpoints.GrantConsentEndpoint = retry
+	}
+	{
+		factory := factoryFor(customersvc.MakeWithdrawConsentEndpoint)
+		balancer := pool.balancer(factory)
+		retry := retry(cfg.RetryMax, cfg.RetryTimeout, cfg.RetryBackoff, budget, balancer)
+		endpoints.WithdrawConsentEndpoint = retry
+	}
+	{
+		factory := factoryFor(customersvc.MakeGetConsentsEndpoint)
+		balancer := pool.balancer(factory)
+		retry := retry(cfg.RetryMax, cfg.RetryTimeout, cfg.RetryBackoff, budget, balancer)
+		endpoints.GetConsentsEndpoint = retry
+	}
+	{
+		factory := factoryFor(customersvc.MakeGetDuplicateAddressesEndpoint)
+		balancer := pool.balancer(factory)
+		retry := retry(cfg.RetryMax, cfg.RetryTimeout, cfg.RetryBackoff, budget, balancer)
+		endpoints.GetDuplicateAddressesEndpoint = retry
+	}
+	{
+		factory := factoryFor(customersvc.MakeRepairAddressesEndpoint)
+		balancer := pool.balancer(factory)
+		retry := retry(cfg.RetryMax, cfg.RetryTimeout, cfg.RetryBackoff, budget, balancer)
+		endpoints.RepairAddressesEndpoint = retry
+	}
+	{
+		factory := factoryFor(customersvc.MakeRebuildIndexEndpoint)
+		balancer := pool.balancer(factory)
+		retry := retry(cfg.RetryMax, cfg.RetryTimeout, cfg.RetryBackoff, budget, balancer)
+		endpoints.RebuildIndexEndpoint = retry
+	}
+	{
+		factory := factoryFor(customersvc.MakeGetIndexRebuildEndpoint)
+		balancer := pool.balancer(factory)
+		retry := retry(cfg.RetryMax, cfg.RetryTimeout, cfg.RetryBackoff, budget, balancer)
+		endpoints.GetIndexRebuildEndpoint = retry
+	}
+	{
+		factory := factoryFor(customersvc.MakeCheckConsistencyEndpoint)
+		balancer := pool.balancer(factory)
+		retry := retry(cfg.RetryMax, cfg.RetryTimeout, cfg.RetryBackoff, budget, balancer)
+		endpoints.CheckConsistencyEndpoint = retry
+	}
+	return endpoints
 }
 
-func factoryFor(makeEndpoint func(customersvc.Service) endpoint.Endpoint) sd.Factory {
+// clientFactory returns a factory for the endpoint built by makeEndpoint on
+// each instance.
+func clientFactory(makeEndpoint func(customersvc.Service) endpoint.Endpoint, options []httptransport.ClientOption) sd.Factory {
 	return func(instance string) (endpoint.Endpoint, io.Closer, error) {
-		service, err := customersvc.MakeClientEndpoints(instance)
+		service, err := customersvc.MakeClientEndpoints(instanceURL(instance), options...)
 		if err != nil {
 			return nil, nil, err
 		}
@@ -0,0 +1,162 @@
+package client
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// newHTTPClient returns the HTTP client shared by every endpoint, with the
+// keep-alive, DNS caching, response caching and token settings in cfg. It
+// dials Unix domain sockets for the hosts instanceURL makes of unix://
+// instances.
+func newHTTPClient(cfg Config) *http.Client {
+	dialer := &net.Dialer{Timeout: 5 * time.Second, KeepAlive: cfg.KeepAlive}
+	dial := dialer.DialContext
+	if cfg.DNSCacheTTL > 0 {
+		dial = (&dnsCache{ttl: cfg.DNSCacheTTL, entries: map[string]dnsEntry{}}).dialer(dialer)
+	}
+	dial = unixDialer(dialer, dial)
+	var transport http.RoundTripper = &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dial,
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   cfg.MaxIdleConnsPerHost,
+		IdleConnTimeout:       cfg.IdleConnTimeout,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: time.Second,
+	}
+	if cfg.Token != nil {
+		transport = &tokenTransport{next: transport, source: cfg.Token}
+	}
+	if cfg.CacheSize > 0 {
+		transport = newETagCache(transport, cfg.CacheSize)
+	}
+	return &http.Client{Transport: transport}
+}
+
+// prewarm opens n connections to the instance at addr, so that they're idle
+// in the pool by the time the first calls need them.
+func prewarm(client *http.Client, addr string, n int) {
+	addr = instanceURL(addr)
+	if !strings.HasPrefix(addr, "http") {
+		addr = "http://" + addr
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			req, err := http.NewRequest("HEAD", addr+"/", nil)
+			if err != nil {
+				return
+			}
+			resp, err := client.Do(req.WithContext(ctx))
+			if err != nil {
+				return // the first real call will find out
+			}
+			io.Copy(ioutil.Discard, resp.Body) // so the connection is reused
+			resp.Body.Close()
+		}()
+	}
+	wg.Wait()
+}
+
+// dnsCache caches host lookups for ttl. When a lookup fails, the expired
+// addresses are used instead, as a stale address beats none during a
+// resolver outage.
+type dnsCache struct {
+	ttl time.Duration
+
+	mtx     sync.Mutex
+	entries map[string]dnsEntry
+}
+
+type dnsEntry struct {
+	addrs   []string
+	expires time.Time
+}
+
+func (c *dnsCache) lookup(ctx context.Context, host string) ([]string, error) {
+	c.mtx.Lock()
+	e, ok := c.entries[host]
+	c.mtx.Unlock()
+	if ok && time.Now().Before(e.expires) {
+		return e.addrs, nil
+	}
+	addrs, err := net.DefaultResolver.LookupHost(ctx, host)
+	if err != nil {
+		if ok {
+			return e.addrs, nil
+		}
+		return nil, err
+	}
+	c.mtx.Lock()
+	c.entries[host] = dnsEntry{addrs: addrs, expires: time.Now().Add(c.ttl)}
+	c.mtx.Unlock()
+	return addrs, nil
+}
+
+// dialer returns a DialContext function resolving hosts through c, and
+// trying each of their addresses in turn.
+func (c *dnsCache) dialer(d *net.Dialer) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil || net.ParseIP(host) != nil {
+			return d.DialContext(ctx, network, addr)
+		}
+		addrs, err := c.lookup(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		err = errors.New("no addresses for " + host)
+		for _, ip := range addrs {
+			var conn net.Conn
+			if conn, err = d.DialContext(ctx, network, net.JoinHostPort(ip, port)); err == nil {
+				return conn, nil
+			}
+		}
+		return nil, err
+	}
+}
+
+// unixHostSuffix ends the hosts instanceURL makes of unix:// instances.
+const unixHostSuffix = ".unix-socket"
+
+// instanceURL returns the URL requests to instance are sent to. That of a
+// unix:// instance, e.g. unix:///run/customersvc.sock, is http:// with a
+// host standing for the socket path, which the client's dialer connects to
+// instead; other instances are returned as they are. Each socket gets its
+// own host, and so its own connection pool.
+func instanceURL(instance string) string {
+	path := strings.TrimPrefix(instance, "unix://")
+	if path == instance {
+		return instance
+	}
+	return "http://" + hex.EncodeToString([]byte(path)) + unixHostSuffix
+}
+
+// unixDialer returns a DialContext function connecting to the socket of
+// hosts made by instanceURL with d, and to others with next.
+func unixDialer(d *net.Dialer, next func(ctx context.Context, network, addr string) (net.Conn, error)) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil || !strings.HasSuffix(host, unixHostSuffix) {
+			return next(ctx, network, addr)
+		}
+		path, err := hex.DecodeString(strings.TrimSuffix(host, unixHostSuffix))
+		if err != nil {
+			return nil, err
+		}
+		return d.DialContext(ctx, "unix", string(path))
+	}
+}
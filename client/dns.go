@@ -0,0 +1,29 @@
+package client
+
+import (
+	"errors"
+
+	"github.com/go-kit/kit/sd/dnssrv"
+	"github.com/praveensastry/customersvc/pkg/customersvc"
+)
+
+// NewDNS returns a service that's load-balanced over the instances of
+// customersvc named by the DNS SRV record srvName, e.g.
+// "_http._tcp.customersvc.default.svc.cluster.local" for a Kubernetes
+// headless service, with no discovery system to run.
+func NewDNS(srvName string, logger customersvc.Logger) (customersvc.Service, error) {
+	return NewDNSWithConfig(srvName, Config{}, logger)
+}
+
+// NewDNSWithConfig is like NewDNS, with control over retries, load balancing
+// and how often the record is resolved again. Instances are balanced, retried
+// and ejected as with NewWithConfig. If resolving fails, the instances last
+// found are kept.
+func NewDNSWithConfig(srvName string, cfg Config, logger customersvc.Logger) (customersvc.Service, error) {
+	if srvName == "" {
+		return nil, errors.New("no SRV record name given")
+	}
+	cfg = cfg.withDefaults()
+	instancer := dnssrv.NewInstancer(srvName, cfg.SRVRefresh, logger)
+	return makeEndpoints(instancer, cfg, logger), nil
+}
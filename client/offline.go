@@ -0,0 +1,368 @@
+package client
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/go-kit/kit/sd/lb"
+
+	"github.com/praveensastry/customersvc/pkg/customersvc"
+)
+
+var (
+	queueBucket = []byte("queue") // sequence number -> Mutation
+	seenBucket  = []byte("seen")  // customer ID -> fingerprint
+)
+
+// Mutation is a write queued by Offline while the server was unreachable.
+type Mutation struct {
+	Seq        uint64                `json:"seq"`
+	Method     string                `json:"method"`
+	CustomerID string                `json:"customer_id"`
+	AddressID  string                `json:"address_id,omitempty"`
+	Customer   *customersvc.Customer `json:"customer,omitempty"`
+	Address    *customersvc.Address  `json:"address,omitempty"`
+	AddressIDs []string              `json:"address_ids,omitempty"`
+	// Base fingerprints the customer as this client last read it, if it
+	// did, for the first write queued for that customer. A different
+	// fingerprint at replay time is a conflict.
+	Base   string    `json:"base,omitempty"`
+	Queued time.Time `json:"queued"`
+}
+
+// OfflineOptions tunes Offline.
+type OfflineOptions struct {
+	// RetryInterval is how often the queue is replayed while it isn't
+	// empty. Default 10s.
+	RetryInterval time.Duration
+	// OnConflict decides what to do with a queued mutation whose customer
+	// was changed by someone else in the meantime: true replays it anyway,
+	// false drops it. By default, conflicting mutations are dropped.
+	OnConflict func(m Mutation, current customersvc.Customer) bool
+}
+
+// Offline wraps a Service, normally the Endpoints of this package, for
+// clients that must keep working through network outages, such as branch
+// offices. Writes that fail because the server is unreachable are queued in
+// a local BoltDB file instead, and replayed in order once it's reachable
+// again. Until the queue has drained, new writes are queued behind it so
+// that order is preserved. Reads always go to the server.
+//
+// A queued write returns a nil error: the caller can't learn whether the
+// server will accept it. Batch inserts, whose per-item results can't be
+// known offline, are never queued.
+type Offline struct {
+	customersvc.Service
+	db     *bolt.DB
+	opts   OfflineOptions
+	logger customersvc.Logger
+
+	mtx  sync.Mutex // serializes replays with new writes
+	done chan struct{}
+}
+
+// NewOffline opens or creates the queue file at path, and starts replaying
+// whatever it holds in the background. Call Close when done.
+func NewOffline(next customersvc.Service, path string, opts OfflineOptions, logger customersvc.Logger) (*Offline, error) {
+	if opts.RetryInterval <= 0 {
+		opts.RetryInterval = 10 * time.Second
+	}
+	if opts.OnConflict == nil {
+		opts.OnConflict = func(Mutation, customersvc.Customer) bool { return false }
+	}
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{queueBucket, seenBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	o := &Offline{Service: next, db: db, opts: opts, logger: logger, done: make(chan struct{})}
+	go o.loop()
+	return o, nil
+}
+
+// Close stops replaying and closes the queue file. Queued writes are kept
+// for the next NewOffline.
+func (o *Offline) Close() error {
+	close(o.done)
+	o.mtx.Lock()
+	defer o.mtx.Unlock()
+	return o.db.Close()
+}
+
+// Pending returns the number of queued writes.
+func (o *Offline) Pending() (int, error) {
+	var n int
+	err := o.db.View(func(tx *bolt.Tx) error {
+		n = tx.Bucket(queueBucket).Stats().KeyN
+		return nil
+	})
+	return n, err
+}
+
+func (o *Offline) loop() {
+	ticker := time.NewTicker(o.opts.RetryInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := o.Flush(context.Background()); err != nil && !unreachable(err) {
+				o.logger.Log("offline", "replay", "err", err)
+			}
+		case <-o.done:
+			return
+		}
+	}
+}
+
+// Flush replays queued writes in order, stopping at the first one that
+// can't reach the server. Writes the server rejects are logged and dropped,
+// as retrying them would fail the same way.
+func (o *Offline) Flush(ctx context.Context) error {
+	o.mtx.Lock()
+	defer o.mtx.Unlock()
+	for {
+		m, ok, err := o.head()
+		if err != nil || !ok {
+			return err
+		}
+		if err := o.replay(ctx, m); err != nil {
+			if unreachable(err) {
+				return err
+			}
+			o.logger.Log("offline", "replay", "method", m.Method, "customer", m.CustomerID, "queued", m.Queued, "err", err)
+		}
+		if err := o.db.Update(func(tx *bolt.Tx) error {
+			return tx.Bucket(queueBucket).Delete(seqKey(m.Seq))
+		}); err != nil {
+			return err
+		}
+	}
+}
+
+func (o *Offline) head() (m Mutation, ok bool, err error) {
+	err = o.db.View(func(tx *bolt.Tx) error {
+		_, v := tx.Bucket(queueBucket).Cursor().First()
+		if v == nil {
+			return nil
+		}
+		ok = true
+		return json.Unmarshal(v, &m)
+	})
+	return m, ok, err
+}
+
+func (o *Offline) replay(ctx context.Context, m Mutation) error {
+	if m.Base != "" {
+		current, err := o.Service.GetCustomer(ctx, m.CustomerID)
+		if err != nil {
+			return err
+		}
+		if fingerprint(current) != m.Base && !o.opts.OnConflict(m, current) {
+			o.logger.Log("offline", "conflict", "method", m.Method, "customer", m.CustomerID, "queued", m.Queued, "action", "dropped")
+			return nil
+		}
+	}
+	switch m.Method {
+	case "PostCustomer":
+		return o.Service.PostCustomer(ctx, *m.Customer)
+	case "PutCustomer":
+		return o.Service.PutCustomer(ctx, m.CustomerID, *m.Customer)
+	case "PatchCustomer":
+		return o.Service.PatchCustomer(ctx, m.CustomerID, *m.Customer)
+	case "DeleteCustomer":
+		return o.Service.DeleteCustomer(ctx, m.CustomerID)
+	case "PostAddress":
+		_, err := o.Service.PostAddress(ctx, m.CustomerID, *m.Address)
+		return err
+	case "DeleteAddress":
+		return o.Service.DeleteAddress(ctx, m.CustomerID, m.AddressID)
+	case "ReorderAddresses":
+		return o.Service.ReorderAddresses(ctx, m.CustomerID, m.AddressIDs)
+	case "ArchiveCustomer":
+		return o.Service.ArchiveCustomer(ctx, m.CustomerID)
+	case "UnarchiveCustomer":
+		return o.Service.UnarchiveCustomer(ctx, m.CustomerID)
+	}
+	return errors.New("unknown queued method " + m.Method)
+}
+
+// write sends m to the server with call, or queues it if the server can't
+// be reached or earlier writes are still queued.
+func (o *Offline) write(ctx context.Context, m Mutation, call func() error) error {
+	o.mtx.Lock()
+	defer o.mtx.Unlock()
+	n, err := o.Pending()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		if err := call(); !unreachable(err) {
+			o.forget(m.CustomerID) // what we last read is stale now
+			return err
+		}
+	}
+	return o.enqueue(m)
+}
+
+func (o *Offline) enqueue(m Mutation) error {
+	return o.db.Update(func(tx *bolt.Tx) error {
+		// Only the first write queued for a customer is checked: later ones
+		// would otherwise conflict with it.
+		seen := tx.Bucket(seenBucket)
+		if base := seen.Get([]byte(m.CustomerID)); base != nil {
+			m.Base = string(base)
+			if err := seen.Delete([]byte(m.CustomerID)); err != nil {
+				return err
+			}
+		}
+		queue := tx.Bucket(queueBucket)
+		seq, err := queue.NextSequence()
+		if err != nil {
+			return err
+		}
+		m.Seq, m.Queued = seq, time.Now()
+		v, err := json.Marshal(m)
+		if err != nil {
+			return err
+		}
+		return queue.Put(seqKey(seq), v)
+	})
+}
+
+// saw remembers p as the base for conflict detection of later writes.
+func (o *Offline) saw(p customersvc.Customer) {
+	err := o.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(seenBucket).Put([]byte(p.ID), []byte(fingerprint(p)))
+	})
+	if err != nil {
+		o.logger.Log("offline", "seen", "customer", p.ID, "err", err)
+	}
+}
+
+func (o *Offline) forget(id string) {
+	err := o.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(seenBucket).Delete([]byte(id))
+	})
+	if err != nil {
+		o.logger.Log("offline", "seen", "customer", id, "err", err)
+	}
+}
+
+// GetCustomer implements Service, remembering what it returns.
+func (o *Offline) GetCustomer(ctx context.Context, id string) (customersvc.Customer, error) {
+	p, err := o.Service.GetCustomer(ctx, id)
+	if err == nil {
+		o.saw(p)
+	}
+	return p, err
+}
+
+// PostCustomer implements Service.
+func (o *Offline) PostCustomer(ctx context.Context, p customersvc.Customer) error {
+	m := Mutation{Method: "PostCustomer", CustomerID: p.ID, Customer: &p}
+	return o.write(ctx, m, func() error { return o.Service.PostCustomer(ctx, p) })
+}
+
+// PutCustomer implements Service.
+func (o *Offline) PutCustomer(ctx context.Context, id string, p customersvc.Customer) error {
+	m := Mutation{Method: "PutCustomer", CustomerID: id, Customer: &p}
+	return o.write(ctx, m, func() error { return o.Service.PutCustomer(ctx, id, p) })
+}
+
+// PatchCustomer implements Service.
+func (o *Offline) PatchCustomer(ctx context.Context, id string, p customersvc.Customer) error {
+	m := Mutation{Method: "PatchCustomer", CustomerID: id, Customer: &p}
+	return o.write(ctx, m, func() error { return o.Service.PatchCustomer(ctx, id, p) })
+}
+
+// DeleteCustomer implements Service.
+func (o *Offline) DeleteCustomer(ctx context.Context, id string) error {
+	m := Mutation{Method: "DeleteCustomer", CustomerID: id}
+	return o.write(ctx, m, func() error { return o.Service.DeleteCustomer(ctx, id) })
+}
+
+// PostAddress implements Service.
+// Queued addresses are returned as given, without the ID the server may
+// generate for them.
+func (o *Offline) PostAddress(ctx context.Context, customerID string, a customersvc.Address) (customersvc.Address, error) {
+	m := Mutation{Method: "PostAddress", CustomerID: customerID, Address: &a}
+	created := a
+	err := o.write(ctx, m, func() (err error) {
+		created, err = o.Service.PostAddress(ctx, customerID, a)
+		return err
+	})
+	return created, err
+}
+
+// DeleteAddress implements Service.
+func (o *Offline) DeleteAddress(ctx context.Context, customerID string, addressID string) error {
+	m := Mutation{Method: "DeleteAddress", CustomerID: customerID, AddressID: addressID}
+	return o.write(ctx, m, func() error { return o.Service.DeleteAddress(ctx, customerID, addressID) })
+}
+
+// ReorderAddresses implements Service.
+func (o *Offline) ReorderAddresses(ctx context.Context, customerID string, addressIDs []string) error {
+	m := Mutation{Method: "ReorderAddresses", CustomerID: customerID, AddressIDs: addressIDs}
+	return o.write(ctx, m, func() error { return o.Service.ReorderAddresses(ctx, customerID, addressIDs) })
+}
+
+// ArchiveCustomer implements Service.
+func (o *Offline) ArchiveCustomer(ctx context.Context, id string) error {
+	m := Mutation{Method: "ArchiveCustomer", CustomerID: id}
+	return o.write(ctx, m, func() error { return o.Service.ArchiveCustomer(ctx, id) })
+}
+
+// UnarchiveCustomer implements Service.
+func (o *Offline) UnarchiveCustomer(ctx context.Context, id string) error {
+	m := Mutation{Method: "UnarchiveCustomer", CustomerID: id}
+	return o.write(ctx, m, func() error { return o.Service.UnarchiveCustomer(ctx, id) })
+}
+
+// unreachable reports whether err means the request never got an answer
+// from the server, as opposed to being answered with an error.
+func unreachable(err error) bool {
+	if err == nil {
+		return false
+	}
+	if re, ok := err.(lb.RetryError); ok {
+		return unreachable(re.Final)
+	}
+	if err == lb.ErrNoEndpoints || errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var ue *url.Error
+	var ne net.Error
+	return errors.As(err, &ue) || errors.As(err, &ne)
+}
+
+func fingerprint(p customersvc.Customer) string {
+	b, _ := json.Marshal(p)
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:16])
+}
+
+func seqKey(seq uint64) []byte {
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, seq) // big-endian keeps the queue in order
+	return k
+}
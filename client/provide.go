@@ -0,0 +1,30 @@
+package client
+
+import "github.com/praveensastry/customersvc/pkg/customersvc"
+
+// ProviderConfig configures ProvideClient.
+type ProviderConfig struct {
+	// ConsulAddr is the address of the Consul server instances are found in.
+	ConsulAddr string
+	// SRVName, if set, is the DNS SRV record instances are found in
+	// instead, see NewDNS.
+	SRVName string
+	// Instances, if set, are the instances to use instead of any found,
+	// see NewStatic.
+	Instances []string
+	Config
+}
+
+// ProvideClient is NewWithConfig, or NewDNSWithConfig given an SRVName, or
+// NewStaticWithConfig given Instances, taking a single config struct, for
+// registering with a dependency injection framework such as wire or fx,
+// alongside customersvc.ProvideService and ProvideHTTPHandler.
+func ProvideClient(cfg ProviderConfig, logger customersvc.Logger) (customersvc.Service, error) {
+	if len(cfg.Instances) > 0 {
+		return NewStaticWithConfig(cfg.Instances, cfg.Config, logger)
+	}
+	if cfg.SRVName != "" {
+		return NewDNSWithConfig(cfg.SRVName, cfg.Config, logger)
+	}
+	return NewWithConfig(cfg.ConsulAddr, cfg.Config, logger)
+}
@@ -0,0 +1,96 @@
+package client
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	mathrand "math/rand"
+	"time"
+
+	"github.com/go-kit/kit/endpoint"
+	"github.com/go-kit/kit/sd/lb"
+	"github.com/praveensastry/customersvc/pkg/customersvc"
+)
+
+// retry is lb.Retry, except that it waits between attempts, and honors the
+// backoff hints servers send with 429 and 503 responses: it waits as long as
+// asked before the next attempt, or gives up at once if the wait wouldn't fit
+// within timeout. Otherwise it waits a random time up to backoff, doubled
+// for each attempt after the second. Errors are returned as lb.RetryError,
+// like lb.Retry does.
+//
+// Retries are also refused when budget, which may be nil, is exhausted, see
+// Config.RetryBudget.
+//
+// Every attempt of a call sends the same Idempotency-Key, generated unless
+// the caller gave one with customersvc.WithIdempotencyKey, so that a POST
+// whose response was lost isn't applied twice.
+func retry(max int, timeout, backoff time.Duration, budget *retryBudget, b lb.Balancer) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+		if _, ok := customersvc.IdempotencyKeyFrom(ctx); !ok {
+			key, err := newIdempotencyKey()
+			if err != nil {
+				return nil, err
+			}
+			ctx = customersvc.WithIdempotencyKey(ctx, key)
+		}
+		budget.call()
+		var final lb.RetryError
+		for i := 1; ; i++ {
+			response, err := attempt(ctx, b, request)
+			if err == nil {
+				return response, nil
+			}
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			final.RawErrors = append(final.RawErrors, err)
+			final.Final = err
+			if i >= max {
+				return nil, final
+			}
+			ceiling := backoff << uint(i-1)
+			if ceiling <= 0 || ceiling > timeout {
+				ceiling = timeout // and don't overflow
+			}
+			wait := time.Duration(mathrand.Int63n(int64(ceiling) + 1))
+			var be *customersvc.BackoffError
+			if errors.As(err, &be) && be.Wait() > 0 {
+				wait = be.Wait()
+			}
+			if deadline, _ := ctx.Deadline(); time.Until(deadline) < wait {
+				return nil, final // callers find be in final.Final
+			}
+			if !budget.allow() {
+				return nil, final
+			}
+			t := time.NewTimer(wait)
+			select {
+			case <-t.C:
+			case <-ctx.Done():
+				t.Stop()
+				return nil, ctx.Err()
+			}
+		}
+	}
+}
+
+func attempt(ctx context.Context, b lb.Balancer, request interface{}) (interface{}, error) {
+	e, err := b.Endpoint()
+	if err != nil {
+		return nil, err
+	}
+	return e(ctx, request)
+}
+
+// newIdempotencyKey returns a random Idempotency-Key.
+func newIdempotencyKey() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
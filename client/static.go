@@ -0,0 +1,27 @@
+package client
+
+import (
+	"errors"
+
+	"github.com/go-kit/kit/sd"
+	"github.com/praveensastry/customersvc/pkg/customersvc"
+)
+
+// NewStatic returns a service that's load-balanced over a fixed list of
+// customersvc instances, e.g. a sidecar or co-located proxy. Each is a
+// host:port, an http:// or https:// URL, or a unix:// URL giving the path of
+// a Unix domain socket the server listens on, e.g.
+// "unix:///run/customersvc.sock".
+func NewStatic(instances []string, logger customersvc.Logger) (customersvc.Service, error) {
+	return NewStaticWithConfig(instances, Config{}, logger)
+}
+
+// NewStaticWithConfig is like NewStatic, with control over retries and load
+// balancing. Instances are balanced, retried and ejected as with
+// NewWithConfig.
+func NewStaticWithConfig(instances []string, cfg Config, logger customersvc.Logger) (customersvc.Service, error) {
+	if len(instances) == 0 {
+		return nil, errors.New("no instances given")
+	}
+	return makeEndpoints(sd.FixedInstancer(instances), cfg.withDefaults(), logger), nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// unixPrefix marks a listen address as the path of a Unix domain socket,
+// e.g. unix:///run/customersvc.sock.
+const unixPrefix = "unix://"
+
+// listenAddrs splits the comma-separated http.addr flag into the addresses
+// to listen on.
+func listenAddrs(s string) []string {
+	var addrs []string
+	for _, addr := range strings.Split(s, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
+
+// checkListenAddr checks addr the way listen would, without listening.
+func checkListenAddr(addr string) error {
+	if path := strings.TrimPrefix(addr, unixPrefix); path != addr {
+		if path == "" {
+			return fmt.Errorf("%q has no socket path", addr)
+		}
+		return nil
+	}
+	_, _, err := net.SplitHostPort(addr)
+	return err
+}
+
+// listen listens on addr: a Unix domain socket, created with mode, for one
+// given as unix://path, and otherwise a TCP host:port. An IPv4 or IPv6
+// literal host listens on that family only, so that 0.0.0.0:8080 and
+// [::]:8080 may be given together; a host name, or none, as in :8080, on
+// both.
+func listen(addr string, mode os.FileMode) (net.Listener, error) {
+	if err := checkListenAddr(addr); err != nil {
+		return nil, err
+	}
+	if path := strings.TrimPrefix(addr, unixPrefix); path != addr {
+		return listenUnix(path, mode)
+	}
+	host, _, _ := net.SplitHostPort(addr)
+	network := "tcp"
+	if ip := net.ParseIP(host); ip != nil {
+		network = "tcp6"
+		if ip.To4() != nil {
+			network = "tcp4"
+		}
+	}
+	return net.Listen(network, addr)
+}
+
+// listenUnix listens on a socket at path, replacing one left behind by a
+// server that didn't exit cleanly, but not any other kind of file.
+func listenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and isn't a socket", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// parseFileMode parses an octal permission mode, e.g. 0660.
+func parseFileMode(s string) (os.FileMode, error) {
+	mode, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || mode > 0777 {
+		return 0, fmt.Errorf("%q isn't an octal permission mode, e.g. 0660", s)
+	}
+	return os.FileMode(mode), nil
+}
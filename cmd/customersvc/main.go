@@ -1,52 +1,593 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
+	"time"
 
-	"github.com/praveensastry/customersvc/pkg/customersvc"
 	"github.com/go-kit/kit/log"
+	kitprometheus "github.com/go-kit/kit/metrics/prometheus"
+	"github.com/go-redis/redis"
+	"github.com/praveensastry/customersvc/pkg/config"
+	"github.com/praveensastry/customersvc/pkg/customersvc"
+	"github.com/praveensastry/customersvc/pkg/customersvc/redisnonce"
+	"github.com/praveensastry/customersvc/pkg/version"
+	stdprometheus "github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 func main() {
+	// "customersvc seed [flags]" loads fixtures into a running server.
+	if len(os.Args) > 1 && os.Args[1] == "seed" {
+		os.Exit(seed(os.Args[2:]))
+	}
 	var (
-		httpAddr = flag.String("http.addr", ":8080", "HTTP listen address")
+		httpAddr     = flag.String("http.addr", ":8080", "comma-separated HTTP listen addresses: host:port, [ipv6]:port, or unix:///path/to.sock")
+		socketMode   = flag.String("http.socket-mode", "0660", "permissions of Unix domain sockets listened on, in octal")
+		maxInFlight  = flag.Int("http.max-inflight", 0, "maximum requests handled at once (0 is unlimited)")
+		perEndpoint  = flag.Int("http.max-inflight-per-endpoint", 0, "maximum requests handled at once by one endpoint (0 is unlimited)")
+		queueSize    = flag.Int("http.queue-size", 0, "requests that may wait for a free slot before being rejected with 503")
+		queueWait    = flag.Duration("http.queue-timeout", time.Second, "how long a queued request waits for a free slot")
+		adaptive     = flag.Bool("http.adaptive-limit", false, "also limit requests handled at once by a bound adjusted from observed latency")
+		slashes      = flag.String("http.slashes", "rewrite", "how paths with missing, extra or duplicate slashes are treated: strict (404), redirect or rewrite")
+		harden       = flag.Bool("http.harden", false, "reject chunked or oversized requests, strip hop-by-hop headers and normalize Host, for direct internet exposure")
+		deprecated   = flag.String("http.deprecations", "", `JSON file of deprecated routes, e.g. {"GET /customers/{id}": {"sunset": "2027-01-01T00:00:00Z", "message": "..."}}`)
+		idemTTL      = flag.Duration("http.idempotency-ttl", 24*time.Hour, "how long the response to a POST with an Idempotency-Key is replayed to repeats (0 disables)")
+		idemSize     = flag.Int("http.idempotency-keys", 100000, "responses to POSTs with an Idempotency-Key kept")
+		writeLimit   = flag.Int("http.write-limit", 0, "writes each API key, or tenant, may make per http.write-period before getting 429s (0 is unlimited)")
+		writePeriod  = flag.Duration("http.write-period", time.Minute, "period of http.write-limit")
+		statusEvery  = flag.Duration("http.status-probe-interval", 0, "serve GET /status, probing the store this often for its latency (disabled if 0)")
+		hosts        = flag.String("http.allowed-hosts", "", "comma-separated Host values served when hardened (any if empty)")
+		reportStale  = flag.Duration("reports.staleness", time.Minute, "how long a cached report may be served before it is recomputed")
+		coalesce     = flag.Bool("store.coalesce-reads", false, "make concurrent reads of the same customer share one fetch from the store")
+		cacheSize    = flag.Int("store.cache-size", 0, "customers most recently read kept in memory, in front of the store (disabled if 0)")
+		cacheTTL     = flag.Duration("store.cache-ttl", 0, "how long a cached customer is served before it's read again (until evicted or changed if 0)")
+		hotKeys      = flag.String("store.cache-hot-keys", "", "file the IDs of the customers most recently read are saved to, and preloaded into the cache from at startup (none if empty)")
+		hotKeysEvery = flag.Duration("store.cache-hot-keys-interval", time.Minute, "how often the hot keys are saved, besides at exit")
+		preload      = flag.String("store.cache-preload", "", "comma-separated IDs of customers preloaded into the cache at startup, besides the hot keys")
+		signKey      = flag.String("signedurl.key", os.Getenv("CUSTOMERSVC_SIGNEDURL_KEY"), "HMAC key for signed URLs (disabled if empty)")
+		signMaxTTL   = flag.Duration("signedurl.max-ttl", time.Hour, "maximum lifetime of a signed URL")
+		signOnce     = flag.Bool("signedurl.single-use", false, "reject signed URLs that have already been used")
+		nonceSize    = flag.Int("signedurl.nonces", 100000, "nonces of single-use URLs remembered in memory")
+		nonceRedis   = flag.String("signedurl.redis", "", "Redis address for single-use URL nonces, shared by replicas (in memory if empty)")
+		portalKey    = flag.String("portal.key", os.Getenv("CUSTOMERSVC_PORTAL_KEY"), "HMAC key for customer portal tokens (disabled if empty)")
+		portalTTL    = flag.Duration("portal.max-ttl", 15*time.Minute, "maximum lifetime of a portal token")
+		captchaKey   = flag.String("captcha.secret", os.Getenv("CUSTOMERSVC_CAPTCHA_SECRET"), "secret for verifying captchas on POST /customers/, for deployments exposing it to end users (disabled if empty)")
+		captchaURL   = flag.String("captcha.verify-url", customersvc.HCaptchaVerifyURL, "siteverify URL of the captcha provider, e.g. "+customersvc.ReCaptchaVerifyURL)
+		enrichURL    = flag.String("enrich.webhook", "", "URL of a webhook that computes customer metadata after writes (disabled if empty)")
+		enrichWait   = flag.Duration("enrich.timeout", 5*time.Second, "timeout for a single enrichment call")
+		settingsFile = flag.String("config.settings", "", `JSON, or YAML if named .yaml or .yml, file of these flags by name, e.g. {"http": {"addr": ":9090"}, "store": {"dir": "/var/lib/customersvc"}}, overridden by CUSTOMERSVC_<FLAG> environment variables, e.g. CUSTOMERSVC_HTTP_ADDR, and by the command line`)
+		configFile   = flag.String("config.file", "", "JSON file of reloadable tunables (reloaded on SIGHUP)")
+		configPoll   = flag.Duration("config.poll", 0, "also reload when the config file changes, checking this often (0 disables)")
+		regionCheck  = flag.String("address.region-check", "lenient", "how address countries and states are checked against ISO 3166: lenient, strict or off")
+		dedup        = flag.String("address.dedup", "allow", "what adding an address at the same location as another of the customer does: allow, reject or merge")
+		authority    = flag.String("address.authority", "embedded", "what decides a customer's addresses: embedded (PUT and PATCH replace them) or subresource (only the address endpoints change them)")
+		storeDir     = flag.String("store.dir", "", "directory for a snapshot and write-ahead log making the store durable (in memory only if empty)")
+		storeFsync   = flag.String("store.fsync", "always", "when journaled writes are flushed to disk: always, interval (every second) or never")
+		storeCompact = flag.Int("store.snapshot-every", 10000, "journaled writes between snapshots compacting the log")
+		storeRouting = flag.String("store.routing", "", "JSON routing table giving tenants stores of their own, reloaded on SIGHUP, with tenants taken from API keys, so apikeys.admin is required (a single store if empty)")
+		routingPoll  = flag.Duration("store.routing-poll", 0, "also reload the routing table when it changes, checking this often (0 disables)")
+		migrateDir   = flag.String("migrate.to-dir", "", "directory of a new store every write is also made to, while migrating the store to it (disabled if empty)")
+		migrateRead  = flag.String("migrate.read-from", "old", "store reads are served from while migrating, old or new; the other is read too, and disagreements counted")
+		backfill     = flag.Bool("migrate.backfill", false, "copy every customer of the old store to the new one at startup, while writes go to both")
+		addrSchema   = flag.String("address.schema", "", `JSON file of custom address fields, e.g. {"apartment": {"type": "string", "max_length": 16}, "leave_at_door": {"type": "boolean"}} (none if empty)`)
+		coldDir      = flag.String("tiering.cold-dir", "", "directory customers inactive for tiering.inactive-for are moved to, and brought back from when next used (disabled if empty)")
+		inactiveFor  = flag.Duration("tiering.inactive-for", 90*24*time.Hour, "how long a customer goes unused before it's moved to the cold tier")
+		tierEvery    = flag.Duration("tiering.interval", time.Hour, "how often inactive customers are looked for")
+		repairEvery  = flag.Duration("address.repair-interval", 0, "how often addresses without an ID, or sharing one, are given new IDs (0 disables)")
+		patchAllow   = flag.String("patch.allow", "", "comma-separated customer fields PATCH may change (any if empty), e.g. name,phone,metadata")
+		patchDeny    = flag.String("patch.deny", "", "comma-separated customer fields PATCH may not change, e.g. email")
+		accessLog    = flag.String("pii.access-log", "", "file recording reads of personal data, for compliance (disabled if empty)")
+		tokenizerURL = flag.String("pii.tokenizer-url", "", "base URL of a tokenization service emails and phone numbers are swapped for tokens with before storage (disabled if empty)")
+		accessRate   = flag.Float64("pii.sample-rate", 1, "fraction of personal data reads recorded in the access log")
+		problems     = flag.Bool("errors.problem-details", false, "render errors as RFC 7807 application/problem+json")
+		problemBase  = flag.String("errors.problem-type-base", "", "URI prefix of problem types (about:blank if empty)")
+		blocking     = flag.Bool("blocklist.enabled", false, "reject customers whose email or phone is blocklisted, and serve /blocklist/ to manage entries")
+		blockFile    = flag.String("blocklist.file", "", "JSON array of blocklist entries loaded at startup")
+		adminKey     = flag.String("apikeys.admin", os.Getenv("CUSTOMERSVC_ADMIN_API_KEY"), "require API keys, with this admin key to issue others (keys not required if empty)")
+		ownership    = flag.String("apikeys.ownership", "", "record the API key creating each customer as its owner: record, or owner-only to also restrict changes to it and admins (disabled if empty)")
+		credentials  = flag.Bool("credentials.enabled", false, "store customers' passwords and PINs, and serve /customers/:id/credentials/ to set and verify them")
+		credTries    = flag.Int("credentials.max-attempts", 5, "failed verifications in a row after which a credential is locked")
+		credLockout  = flag.Duration("credentials.lockout", 15*time.Minute, "how long a credential stays locked")
+		addressRefs  = flag.Bool("address.references", false, "let other services register references to addresses, e.g. active shipments, which then can't be deleted unless forced")
+		devSeed      = flag.Bool("dev.seed", os.Getenv("CUSTOMERSVC_DEV_SEED") == "true", "serve POST /admin/seed, which overwrites customers with test fixtures, for demo and test environments only")
+		jobsKeep     = flag.Int("jobs.keep", 0, "run background jobs, such as POST /customers/bulk-patch, keeping the results of this many finished ones under /jobs/; 0 disables them")
+		recordRate   = flag.Float64("debug.record-rate", 0, "fraction of requests recorded, sanitized, for /admin/recordings (disabled if 0)")
+		tapMax       = flag.Duration("debug.tap-max-duration", 0, "longest a live request feed from /admin/tap may stream (disabled if 0)")
+		tapBuffer    = flag.Int("debug.tap-buffer", 256, "request summaries buffered for each /admin/tap watcher")
+		tapSlow      = flag.String("debug.tap-slow-policy", "drop-oldest", "what a tap watcher whose buffer is full gets: drop-oldest, or disconnect")
+		recordSize   = flag.Int("debug.record-size", 100, "recorded requests kept")
+		usageLog     = flag.String("usage.log", "", "file receiving daily per-tenant usage records, for billing (metering disabled if empty)")
 	)
-	flag.Parse()
+	// "customersvc validate-config [flags]" checks the settings and exits.
+	validateOnly := len(os.Args) > 1 && os.Args[1] == "validate-config"
+	if validateOnly {
+		flag.CommandLine.Parse(os.Args[2:])
+	} else {
+		flag.Parse()
+	}
+	if err := config.LoadSettings(flag.CommandLine, settingsFile); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if validateOnly {
+		os.Exit(validateConfig(flag.CommandLine))
+	}
+
+	// The config is loaded first, as it determines the log level. Until the
+	// main logger exists, the loader gets a plain one of its own.
+	var cfg *config.Loader
+	{
+		var err error
+		cfgLogger := log.With(log.NewLogfmtLogger(os.Stderr), "ts", log.DefaultTimestampUTC, "component", "config")
+		cfg, err = config.NewLoader(*configFile, config.Values{LogLevel: "info"}, cfgLogger)
+		if err != nil {
+			cfgLogger.Log("file", *configFile, "err", err)
+			os.Exit(1)
+		}
+
+		done := make(chan struct{})
+		go cfg.WatchSignals(done)
+		if *configPoll > 0 {
+			go cfg.WatchFile(*configPoll, done)
+		}
+	}
 
 	var logger log.Logger
 	{
 		logger = log.NewLogfmtLogger(os.Stderr)
+		logger = config.NewLevelFilter(cfg, logger)
 		logger = log.With(logger, "ts", log.DefaultTimestampUTC)
 		logger = log.With(logger, "caller", log.DefaultCaller)
 	}
 
+	var panics *kitprometheus.Counter
+	{
+		panics = kitprometheus.NewCounterFrom(stdprometheus.CounterOpts{
+			Namespace: "customersvc",
+			Name:      "panics_total",
+			Help:      "Number of panics recovered, by method.",
+		}, []string{"method"})
+	}
+
+	var enrichFailures *kitprometheus.Counter
+	{
+		enrichFailures = kitprometheus.NewCounterFrom(stdprometheus.CounterOpts{
+			Namespace: "customersvc",
+			Name:      "enrichment_failures_total",
+			Help:      "Number of customer enrichments that failed, by reason.",
+		}, []string{"reason"})
+	}
+
+	var replays *kitprometheus.Counter
+	{
+		replays = kitprometheus.NewCounterFrom(stdprometheus.CounterOpts{
+			Namespace: "customersvc",
+			Name:      "signedurl_replays_total",
+			Help:      "Number of single-use signed URLs rejected because they were already used.",
+		}, []string{})
+	}
+
+	var blocklist *customersvc.Blocklist
+	if *blocking {
+		var err error
+		if blocklist, err = loadBlocklist(*blockFile); err != nil {
+			logger.Log("blocklist.file", *blockFile, "err", err)
+			os.Exit(1)
+		}
+	}
+
+	var meter *customersvc.Meter
+	if *usageLog != "" {
+		f, err := os.OpenFile(*usageLog, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			logger.Log("usage.log", *usageLog, "err", err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		sink := customersvc.NewLogUsageSink(log.NewJSONLogger(log.NewSyncWriter(f)))
+		meter = customersvc.NewMeter(sink, log.With(logger, "component", "usage"))
+		go meter.Run(time.Minute, make(chan struct{}))
+	}
+
 	var s customersvc.Service
 	{
-		s = customersvc.NewInmemService()
-		s = customersvc.LoggingMiddleware(logger)(s)
+		check, err := customersvc.ParseRegionCheck(*regionCheck)
+		if err != nil {
+			logger.Log("err", err)
+			os.Exit(1)
+		}
+		policy, err := customersvc.ParseDedupPolicy(*dedup)
+		if err != nil {
+			logger.Log("err", err)
+			os.Exit(1)
+		}
+		patchPolicy, err := customersvc.NewPatchPolicy(splitList(*patchAllow), splitList(*patchDeny))
+		if err != nil {
+			logger.Log("err", err)
+			os.Exit(1)
+		}
+		addresses, err := customersvc.ParseAddressAuthority(*authority)
+		if err != nil {
+			logger.Log("err", err)
+			os.Exit(1)
+		}
+		var schema *customersvc.AddressSchema
+		if *addrSchema != "" {
+			schema, err = loadAddressSchema(*addrSchema)
+			if err != nil {
+				logger.Log("address.schema", *addrSchema, "err", err)
+				os.Exit(1)
+			}
+		}
+		svcCfg := customersvc.ServiceConfig{
+			RegionCheck:        check,
+			AddressDedup:       policy,
+			PatchPolicy:        patchPolicy,
+			Addresses:          addresses,
+			AddressSchema:      schema,
+			ReportStaleness:    *reportStale,
+			Blocklist:          blocklist,
+			EnrichmentFailures: enrichFailures,
+			Meter:              meter,
+			Panics:             panics,
+			SelfAccess:         *portalKey != "",
+		}
+		if *tokenizerURL != "" {
+			svcCfg.Tokenizer = customersvc.NewHTTPTokenizer(*tokenizerURL, &http.Client{Timeout: 5 * time.Second})
+		}
+		if *coalesce {
+			svcCfg.CoalesceReads = true
+			svcCfg.CoalescedReads = kitprometheus.NewCounterFrom(stdprometheus.CounterOpts{
+				Namespace: "customersvc",
+				Name:      "coalesced_reads_total",
+				Help:      "Number of customer reads answered by a concurrent read of the same customer rather than the store.",
+			}, []string{})
+		}
+		if *cacheSize > 0 {
+			lookups := kitprometheus.NewCounterFrom(stdprometheus.CounterOpts{
+				Namespace: "customersvc",
+				Name:      "cache_lookups_total",
+				Help:      "Number of customer reads looked up in the cache, by result, hit or miss.",
+			}, []string{"result"})
+			svcCfg.Cache = customersvc.NewCustomerCache(customersvc.CacheOptions{Size: *cacheSize, TTL: *cacheTTL}, lookups)
+		}
+		if *enrichURL != "" {
+			svcCfg.Enricher = customersvc.NewWebhookEnricher(*enrichURL, nil)
+			svcCfg.Enrichment = customersvc.EnrichmentOptions{Workers: 4, QueueSize: 1024, Timeout: *enrichWait}
+		}
+		if *storeDir != "" {
+			fsync, err := customersvc.ParseFsyncPolicy(*storeFsync)
+			if err != nil {
+				logger.Log("store.fsync", *storeFsync, "err", err)
+				os.Exit(1)
+			}
+			journal, err := customersvc.OpenJournal(*storeDir, customersvc.JournalOptions{
+				Fsync:         fsync,
+				SnapshotEvery: *storeCompact,
+			}, log.With(logger, "component", "journal"))
+			if err != nil {
+				logger.Log("store.dir", *storeDir, "err", err)
+				os.Exit(1)
+			}
+			defer journal.Close()
+			svcCfg.Journal = journal
+		}
+		if *accessLog != "" {
+			f, err := os.OpenFile(*accessLog, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+			if err != nil {
+				logger.Log("pii.access-log", *accessLog, "err", err)
+				os.Exit(1)
+			}
+			defer f.Close()
+			svcCfg.AccessSink = customersvc.NewLogAccessSink(log.NewJSONLogger(log.NewSyncWriter(f)))
+			svcCfg.AccessLog = customersvc.AccessLogOptions{SampleRate: *accessRate}
+		}
+		if *coldDir != "" {
+			cold, err := customersvc.NewDirColdStore(*coldDir)
+			if err != nil {
+				logger.Log("tiering.cold-dir", *coldDir, "err", err)
+				os.Exit(1)
+			}
+			hits := kitprometheus.NewCounterFrom(stdprometheus.CounterOpts{
+				Namespace: "customersvc",
+				Name:      "tier_hits_total",
+				Help:      "Number of calls about a customer, by the storage tier, hot or cold, it was found in.",
+			}, []string{"tier"})
+			svcCfg.Store = customersvc.NewInmemService(svcCfg.StoreOptions()...)
+			svcCfg.Tiering, err = customersvc.NewTiering(context.Background(), svcCfg.Store, cold, customersvc.TieringOptions{InactiveFor: *inactiveFor}, hits)
+			if err != nil {
+				logger.Log("tiering.cold-dir", *coldDir, "err", err)
+				os.Exit(1)
+			}
+		}
+		if *storeRouting != "" {
+			if *storeDir != "" || *coldDir != "" {
+				logger.Log("store.routing", *storeRouting, "err", "can't be combined with store.dir or tiering.cold-dir")
+				os.Exit(1)
+			}
+			if *adminKey == "" {
+				logger.Log("store.routing", *storeRouting, "err", "needs apikeys.admin, so that tenants can't pick each other's stores")
+				os.Exit(1)
+			}
+			table, err := customersvc.LoadRoutingTable(*storeRouting)
+			if err != nil {
+				logger.Log("store.routing", *storeRouting, "err", err)
+				os.Exit(1)
+			}
+			fsync, err := customersvc.ParseFsyncPolicy(*storeFsync)
+			if err != nil {
+				logger.Log("store.fsync", *storeFsync, "err", err)
+				os.Exit(1)
+			}
+			backends := customersvc.InmemBackends(customersvc.JournalOptions{
+				Fsync:         fsync,
+				SnapshotEvery: *storeCompact,
+			}, log.With(logger, "component", "journal"), svcCfg.StoreOptions()...)
+			routing, err := customersvc.NewRoutingService(table, backends)
+			if err != nil {
+				logger.Log("store.routing", *storeRouting, "err", err)
+				os.Exit(1)
+			}
+			defer routing.Close()
+			go customersvc.WatchRoutingTable(routing, *storeRouting, *routingPoll, log.With(logger, "component", "routing"), make(chan struct{}))
+			svcCfg.Store = routing
+		}
+		if *migrateDir != "" {
+			if *storeRouting != "" || *coldDir != "" {
+				logger.Log("migrate.to-dir", *migrateDir, "err", "can't be combined with store.routing or tiering.cold-dir")
+				os.Exit(1)
+			}
+			readFrom, err := customersvc.ParseReadSource(*migrateRead)
+			if err != nil {
+				logger.Log("migrate.read-from", *migrateRead, "err", err)
+				os.Exit(1)
+			}
+			fsync, err := customersvc.ParseFsyncPolicy(*storeFsync)
+			if err != nil {
+				logger.Log("store.fsync", *storeFsync, "err", err)
+				os.Exit(1)
+			}
+			journal, err := customersvc.OpenJournal(*migrateDir, customersvc.JournalOptions{
+				Fsync:         fsync,
+				SnapshotEvery: *storeCompact,
+			}, log.With(logger, "component", "journal", "store", "new"))
+			if err != nil {
+				logger.Log("migrate.to-dir", *migrateDir, "err", err)
+				os.Exit(1)
+			}
+			defer journal.Close()
+			divergences := kitprometheus.NewCounterFrom(stdprometheus.CounterOpts{
+				Namespace: "customersvc",
+				Name:      "migration_divergences_total",
+				Help:      "Number of calls the old and new stores disagreed on while migrating, by method.",
+			}, []string{"method"})
+			var (
+				old = customersvc.NewInmemService(svcCfg.StoreOptions()...)
+				new = customersvc.NewInmemService(append(svcCfg.StoreOptions(), customersvc.WithJournal(journal))...)
+			)
+			svcCfg.Store = customersvc.NewMigrationService(old, new, readFrom, divergences, log.With(logger, "component", "migration"))
+			if *backfill {
+				go customersvc.Backfill(context.Background(), svcCfg.Store, customersvc.BulkOptions{}, log.With(logger, "component", "migration"))
+			}
+		}
+		s = customersvc.ProvideService(svcCfg, logger)
+		if *repairEvery > 0 {
+			go customersvc.RunAddressRepair(s, *repairEvery, log.With(logger, "component", "repair"), make(chan struct{}))
+		}
+		if svcCfg.Cache != nil {
+			ids := splitList(*preload)
+			if *hotKeys != "" {
+				saved, err := customersvc.LoadHotKeys(*hotKeys)
+				if err != nil {
+					logger.Log("store.cache-hot-keys", *hotKeys, "err", err)
+					os.Exit(1)
+				}
+				ids = append(ids, saved...)
+				defer svcCfg.Cache.SaveHotKeys(*hotKeys, *cacheSize)
+				go customersvc.RunHotKeySaver(svcCfg.Cache, *hotKeys, *cacheSize, *hotKeysEvery, log.With(logger, "component", "cache"), make(chan struct{}))
+			}
+			n, err := svcCfg.Cache.Preload(context.Background(), ids)
+			logger.Log("component", "cache", "preloaded", n, "err", err)
+		}
+		if svcCfg.Tiering != nil {
+			go customersvc.RunTiering(svcCfg.Tiering, *tierEvery, log.With(logger, "component", "tiering"), make(chan struct{}))
+		}
 	}
 
 	var h http.Handler
 	{
-		h = customersvc.MakeHTTPHandler(s, log.With(logger, "component", "HTTP"))
+		slashPolicy, err := customersvc.ParseSlashPolicy(*slashes)
+		if err != nil {
+			logger.Log("http.slashes", *slashes, "err", err)
+			os.Exit(1)
+		}
+		httpCfg := customersvc.HTTPConfig{
+			Slashes: slashPolicy,
+			Headers: &customersvc.ResponseHeaders{
+				Server:  "customersvc/" + version.VERSION,
+				Version: version.VERSION,
+			},
+			Config: cfg,
+			Concurrency: customersvc.ConcurrencyLimits{
+				MaxInFlight:  *maxInFlight,
+				PerEndpoint:  *perEndpoint,
+				QueueSize:    *queueSize,
+				QueueTimeout: *queueWait,
+				RetryAfter:   time.Second,
+			},
+			Panics:          panics,
+			ProblemDetails:  *problems,
+			ProblemTypeBase: *problemBase,
+			Blocklist:       blocklist,
+			Meter:           meter,
+		}
+		if *adaptive {
+			limit := kitprometheus.NewGaugeFrom(stdprometheus.GaugeOpts{
+				Namespace: "customersvc",
+				Name:      "adaptive_concurrency_limit",
+				Help:      "Requests currently allowed in flight by the adaptive limiter.",
+			}, []string{})
+			httpCfg.Adaptive = &customersvc.AdaptiveLimits{
+				RetryAfter: time.Second,
+				Limit:      limit,
+			}
+		}
+		if *harden {
+			var hardening customersvc.HardeningOptions
+			if *hosts != "" {
+				hardening.AllowedHosts = strings.Split(*hosts, ",")
+			}
+			httpCfg.Hardening = &hardening
+		}
+		if *adminKey != "" {
+			keys := customersvc.NewAPIKeys()
+			if _, err := keys.Add(*adminKey, customersvc.APIKey{Name: "bootstrap", Scopes: []string{customersvc.ScopeAdmin}}); err != nil {
+				logger.Log("apikeys.admin", "(redacted)", "err", err)
+				os.Exit(1)
+			}
+			httpCfg.APIKeys = keys
+			if *ownership != "" {
+				policy, err := customersvc.ParseOwnershipPolicy(*ownership)
+				if err != nil {
+					logger.Log("apikeys.ownership", *ownership, "err", err)
+					os.Exit(1)
+				}
+				httpCfg.Ownership = customersvc.NewOwnership(keys, policy)
+			}
+		}
+		if *recordRate > 0 {
+			httpCfg.Recorder = customersvc.NewRecorder(customersvc.RecorderOptions{
+				Size:       *recordSize,
+				SampleRate: *recordRate,
+			})
+		}
+		if *tapMax > 0 {
+			policy, err := customersvc.ParseSlowConsumerPolicy(*tapSlow)
+			if err != nil {
+				logger.Log("debug.tap-slow-policy", *tapSlow, "err", err)
+				os.Exit(1)
+			}
+			httpCfg.Tap = customersvc.NewTap(*tapMax, customersvc.WithStreamLimits(customersvc.StreamLimits{
+				Buffer: *tapBuffer,
+				Policy: policy,
+				Dropped: kitprometheus.NewCounterFrom(stdprometheus.CounterOpts{
+					Namespace: "customersvc",
+					Name:      "stream_dropped_events_total",
+					Help:      "Number of events dropped because a stream's consumer couldn't keep up, by stream.",
+				}, []string{"stream"}),
+				Disconnects: kitprometheus.NewCounterFrom(stdprometheus.CounterOpts{
+					Namespace: "customersvc",
+					Name:      "stream_slow_disconnects_total",
+					Help:      "Number of stream consumers disconnected for not keeping up, by stream.",
+				}, []string{"stream"}),
+			}))
+		}
+		if *signKey != "" {
+			var signerOpts []customersvc.Option
+			if *signOnce {
+				var nonces customersvc.NonceStore = customersvc.NewLRUNonceStore(*nonceSize, customersvc.SystemClock)
+				if *nonceRedis != "" {
+					nonces = redisnonce.New(redis.NewClient(&redis.Options{Addr: *nonceRedis}), "customersvc:nonce:")
+				}
+				signerOpts = append(signerOpts, customersvc.WithNonceStore(nonces, replays))
+			}
+			httpCfg.URLSigner = customersvc.NewURLSigner([]byte(*signKey), *signMaxTTL, signerOpts...)
+		}
+		if *deprecated != "" {
+			routes, err := loadDeprecations(*deprecated)
+			if err != nil {
+				logger.Log("http.deprecations", *deprecated, "err", err)
+				os.Exit(1)
+			}
+			used := kitprometheus.NewCounterFrom(stdprometheus.CounterOpts{
+				Namespace: "customersvc",
+				Name:      "deprecated_requests_total",
+				Help:      "Number of requests to deprecated routes, by route and whether it was already removed.",
+			}, []string{"route", "gone"})
+			httpCfg.Deprecations = customersvc.NewDeprecations(routes, used)
+		}
+		if *portalKey != "" {
+			httpCfg.PortalTokens = customersvc.NewPortalTokens([]byte(*portalKey), *portalTTL)
+		}
+		if *credentials {
+			creds, err := customersvc.NewCredentials(customersvc.CredentialOptions{
+				MaxAttempts: *credTries,
+				Lockout:     *credLockout,
+			})
+			if err != nil {
+				logger.Log("credentials.enabled", true, "err", err)
+				os.Exit(1)
+			}
+			httpCfg.Credentials = creds
+		}
+		if *addressRefs {
+			httpCfg.AddressReferences = customersvc.NewAddressReferences()
+		}
+		if *jobsKeep > 0 {
+			httpCfg.Jobs = customersvc.NewJobs(*jobsKeep)
+		}
+		if *devSeed {
+			logger.Log("dev.seed", true, "warning", "POST /admin/seed overwrites customers; never enable it in production")
+			httpCfg.Seeding = true
+		}
+		if *idemTTL > 0 {
+			httpCfg.Idempotency = customersvc.NewIdempotencyKeys(*idemTTL, *idemSize)
+		}
+		if *writeLimit > 0 {
+			httpCfg.WriteThrottle = customersvc.NewWriteThrottle(*writeLimit, *writePeriod)
+		}
+		if *statusEvery > 0 {
+			httpCfg.StatusPage = customersvc.NewStatusPage(cfg, []customersvc.StatusProbe{customersvc.StoreProbe(s)})
+			go customersvc.RunStatusProbes(httpCfg.StatusPage, *statusEvery, make(chan struct{}))
+		}
+		if *captchaKey != "" {
+			httpCfg.Captcha = customersvc.NewSiteVerifier(*captchaURL, *captchaKey, &http.Client{Timeout: 5 * time.Second})
+		}
+		mux := http.NewServeMux()
+		mux.Handle("/", customersvc.ProvideHTTPHandler(s, log.With(logger, "component", "HTTP"), httpCfg))
+		mux.Handle("/metrics", promhttp.Handler())
+		h = mux
 	}
 
 	errs := make(chan error)
 	go func() {
-		c := make(chan os.Signal)
+		c := make(chan os.Signal, 1)
 		signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
 		errs <- fmt.Errorf("%s", <-c)
 	}()
 
-	go func() {
-		logger.Log("transport", "HTTP", "addr", *httpAddr)
-		errs <- http.ListenAndServe(*httpAddr, h)
-	}()
+	mode, err := parseFileMode(*socketMode)
+	if err != nil {
+		logger.Log("http.socket-mode", *socketMode, "err", err)
+		os.Exit(1)
+	}
+	for _, addr := range listenAddrs(*httpAddr) {
+		l, err := listen(addr, mode)
+		if err != nil {
+			logger.Log("transport", "HTTP", "addr", addr, "err", err)
+			os.Exit(1)
+		}
+		defer l.Close() // removes Unix domain sockets
+		go func(addr string) {
+			logger.Log("transport", "HTTP", "addr", addr)
+			errs <- http.Serve(l, h)
+		}(addr)
+	}
 
 	logger.Log("exit", <-errs)
 }
+
+// splitList splits a comma-separated flag value, which may be empty.
+func splitList(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, ",")
+}
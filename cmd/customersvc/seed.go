@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/praveensastry/customersvc/pkg/customersvc"
+)
+
+// seed runs "customersvc seed [flags]": it posts a fixtures file to the
+// POST /admin/seed of a running server, started with -dev.seed, and prints
+// the report. It returns the exit status, 1 if any customer was rejected.
+func seed(args []string) int {
+	fs := flag.NewFlagSet("seed", flag.ExitOnError)
+	var (
+		file    = fs.String("file", "fixtures.yaml", "fixtures to load, in JSON or YAML, see customersvc.Fixtures")
+		url     = fs.String("url", "http://localhost:8080", "base URL of the server")
+		apiKey  = fs.String("apikey", os.Getenv("CUSTOMERSVC_API_KEY"), "admin API key, if the server requires keys")
+		timeout = fs.Duration("timeout", time.Minute, "how long seeding may take")
+	)
+	fs.Parse(args)
+
+	data, err := ioutil.ReadFile(*file)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	// Checked here too, to point at the problem without a round trip.
+	if _, err := customersvc.ParseFixtures(data); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", *file, err)
+		return 1
+	}
+	req, err := http.NewRequest("POST", strings.TrimRight(*url, "/")+"/admin/seed", bytes.NewReader(data))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if strings.HasSuffix(*file, ".yaml") || strings.HasSuffix(*file, ".yml") {
+		req.Header.Set("Content-Type", "application/yaml")
+	}
+	if *apiKey != "" {
+		req.Header.Set(customersvc.APIKeyHeader, *apiKey)
+	}
+	resp, err := (&http.Client{Timeout: *timeout}).Do(req)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusMethodNotAllowed {
+		fmt.Fprintf(os.Stderr, "%s: seeding isn't enabled, start the server with -dev.seed\n", *url)
+		return 1
+	}
+	fmt.Println(strings.TrimSpace(string(body)))
+	var result struct {
+		Report customersvc.BulkReport `json:"report"`
+	}
+	if resp.StatusCode != http.StatusOK || json.Unmarshal(body, &result) != nil || result.Report.Failed > 0 {
+		return 1
+	}
+	return 0
+}
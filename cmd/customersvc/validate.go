@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/go-kit/kit/log"
+	"github.com/praveensastry/customersvc/pkg/config"
+	"github.com/praveensastry/customersvc/pkg/customersvc"
+)
+
+// validateConfig checks the flags of fs, once LoadSettings has applied the
+// settings file and environment, the way the server would at startup, but
+// without creating files, binding ports or connecting anywhere. It prints
+// every problem found and returns the exit status of validate-config.
+func validateConfig(fs *flag.FlagSet) int {
+	get := func(name string) string { return fs.Lookup(name).Value.String() }
+	var errs []error
+	check := func(name string, err error) {
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", name, err))
+		}
+	}
+
+	addrs := listenAddrs(get("http.addr"))
+	if len(addrs) == 0 {
+		check("http.addr", fmt.Errorf("no address given"))
+	}
+	for _, addr := range addrs {
+		check("http.addr", checkListenAddr(addr))
+	}
+	_, err := parseFileMode(get("http.socket-mode"))
+	check("http.socket-mode", err)
+	_, err = customersvc.ParseSlashPolicy(get("http.slashes"))
+	check("http.slashes", err)
+	_, err = customersvc.ParseRegionCheck(get("address.region-check"))
+	check("address.region-check", err)
+	_, err = customersvc.ParseDedupPolicy(get("address.dedup"))
+	check("address.dedup", err)
+	_, err = customersvc.ParseAddressAuthority(get("address.authority"))
+	check("address.authority", err)
+	_, err = customersvc.NewPatchPolicy(splitList(get("patch.allow")), splitList(get("patch.deny")))
+	check("patch.allow", err)
+	_, err = customersvc.ParseFsyncPolicy(get("store.fsync"))
+	check("store.fsync", err)
+	_, err = customersvc.ParseSlowConsumerPolicy(get("debug.tap-slow-policy"))
+	check("debug.tap-slow-policy", err)
+	if path := get("config.file"); path != "" {
+		_, err = config.NewLoader(path, config.Values{LogLevel: "info"}, log.NewNopLogger())
+		check("config.file", err)
+	}
+	if path := get("address.schema"); path != "" {
+		_, err = loadAddressSchema(path)
+		check("address.schema", err)
+	}
+	if path := get("store.routing"); path != "" {
+		_, err = customersvc.LoadRoutingTable(path)
+		check("store.routing", err)
+		if get("store.dir") != "" || get("tiering.cold-dir") != "" {
+			check("store.routing", fmt.Errorf("can't be combined with store.dir or tiering.cold-dir"))
+		}
+		if get("apikeys.admin") == "" {
+			check("store.routing", fmt.Errorf("needs apikeys.admin, so that tenants can't pick each other's stores"))
+		}
+	}
+	if get("migrate.to-dir") != "" {
+		_, err = customersvc.ParseReadSource(get("migrate.read-from"))
+		check("migrate.read-from", err)
+		if get("store.routing") != "" || get("tiering.cold-dir") != "" {
+			check("migrate.to-dir", fmt.Errorf("can't be combined with store.routing or tiering.cold-dir"))
+		}
+	}
+	if path := get("blocklist.file"); path != "" {
+		_, err = loadBlocklist(path)
+		check("blocklist.file", err)
+	}
+	if path := get("http.deprecations"); path != "" {
+		_, err = loadDeprecations(path)
+		check("http.deprecations", err)
+	}
+	if ownership := get("apikeys.ownership"); ownership != "" {
+		_, err = customersvc.ParseOwnershipPolicy(ownership)
+		check("apikeys.ownership", err)
+		if get("apikeys.admin") == "" {
+			check("apikeys.ownership", fmt.Errorf("has no effect without apikeys.admin"))
+		}
+	}
+
+	for _, err := range errs {
+		fmt.Fprintln(os.Stderr, err)
+	}
+	if len(errs) > 0 {
+		return 1
+	}
+	fmt.Println("configuration is valid")
+	return 0
+}
+
+// loadAddressSchema reads a JSON file of custom address fields.
+func loadAddressSchema(path string) (*customersvc.AddressSchema, error) {
+	var fields map[string]customersvc.CustomField
+	buf, err := ioutil.ReadFile(path)
+	if err == nil {
+		err = json.Unmarshal(buf, &fields)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return customersvc.NewAddressSchema(fields)
+}
+
+// loadBlocklist reads a JSON array of blocklist entries.
+func loadBlocklist(path string) (*customersvc.Blocklist, error) {
+	var entries []customersvc.BlockEntry
+	if path != "" {
+		buf, err := ioutil.ReadFile(path)
+		if err == nil {
+			err = json.Unmarshal(buf, &entries)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return customersvc.NewBlocklist(entries)
+}
+
+// loadDeprecations reads a JSON file of deprecated routes.
+func loadDeprecations(path string) (map[string]customersvc.Deprecation, error) {
+	var routes map[string]customersvc.Deprecation
+	buf, err := ioutil.ReadFile(path)
+	if err == nil {
+		err = json.Unmarshal(buf, &routes)
+	}
+	return routes, err
+}
@@ -3,8 +3,15 @@ module github.com/praveensastry/customersvc
 go 1.12
 
 require (
+	github.com/VividCortex/gohistogram v1.0.0 // indirect
+	github.com/boltdb/bolt v1.3.1
 	github.com/go-kit/kit v0.9.0
-	github.com/go-logfmt/logfmt v0.4.0 // indirect
+	github.com/go-redis/redis v6.14.1+incompatible
 	github.com/gorilla/mux v1.7.3
 	github.com/hashicorp/consul/api v1.3.0
+	github.com/prometheus/client_golang v1.1.0
+	go.uber.org/atomic v1.7.0 // indirect
+	go.uber.org/multierr v1.6.0 // indirect
+	go.uber.org/zap v1.11.0
+	golang.org/x/time v0.0.0-20190308202827-9d24e82272b4
 )
@@ -0,0 +1,243 @@
+// Package config provides the customersvc tunables that may change while the
+// server is running. Values are read from a JSON file, overridden by
+// environment variables, and reloaded on SIGHUP or when the file changes.
+// Settings fixed at startup are flags, which LoadSettings also reads from a
+// file and the environment.
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+// Values is a snapshot of the reloadable tunables.
+type Values struct {
+	// LogLevel is one of debug, info, warn or error.
+	LogLevel string `json:"log_level"`
+	// RateLimit is the sustained number of requests per second accepted by
+	// the server, across all endpoints. Zero means unlimited.
+	RateLimit float64 `json:"rate_limit"`
+	// RateBurst is the number of requests that may exceed RateLimit at once.
+	RateBurst int `json:"rate_burst"`
+	// RequestTimeout bounds the time spent handling a single request. Zero
+	// means no timeout.
+	RequestTimeout Duration `json:"request_timeout"`
+	// Features toggles optional behavior by name.
+	Features map[string]bool `json:"features"`
+}
+
+// Enabled reports whether the named feature flag is on.
+func (v Values) Enabled(feature string) bool {
+	return v.Features[feature]
+}
+
+// Config is consumed by components that need the current tunables. Get is
+// called on the request path, so implementations must make it cheap.
+type Config interface {
+	Get() Values
+}
+
+// Static is a Config whose values never change.
+type Static Values
+
+// Get implements Config.
+func (s Static) Get() Values { return Values(s) }
+
+// Duration is a time.Duration that reads from a JSON string like "1.5s".
+type Duration time.Duration
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// MarshalJSON implements json.Marshaler.
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// ErrInvalidLogLevel is returned when a loaded config names an unknown log
+// level.
+var ErrInvalidLogLevel = errors.New("log_level must be one of debug, info, warn, error")
+
+// Loader is a Config backed by an optional file and the environment. A
+// failed reload keeps the previous values in place.
+type Loader struct {
+	path     string
+	defaults Values
+	logger   log.Logger
+
+	mtx     sync.RWMutex
+	values  Values
+	modTime time.Time
+}
+
+// NewLoader returns a Loader that has already loaded its values once. path
+// may be empty, in which case only defaults and the environment are used.
+func NewLoader(path string, defaults Values, logger log.Logger) (*Loader, error) {
+	l := &Loader{
+		path:     path,
+		defaults: defaults,
+		logger:   logger,
+	}
+	if err := l.Reload(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Get implements Config.
+func (l *Loader) Get() Values {
+	l.mtx.RLock()
+	defer l.mtx.RUnlock()
+	return l.values
+}
+
+// Reload rereads the file and environment.
+func (l *Loader) Reload() error {
+	v := l.defaults
+	v.Features = map[string]bool{}
+	for name, on := range l.defaults.Features {
+		v.Features[name] = on
+	}
+
+	var modTime time.Time
+	if l.path != "" {
+		fi, err := os.Stat(l.path)
+		if err != nil {
+			return err
+		}
+		modTime = fi.ModTime()
+		buf, err := ioutil.ReadFile(l.path)
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(buf, &v); err != nil {
+			return err
+		}
+	}
+	if err := fromEnv(&v); err != nil {
+		return err
+	}
+	switch v.LogLevel {
+	case "debug", "info", "warn", "error":
+	default:
+		return ErrInvalidLogLevel
+	}
+
+	l.mtx.Lock()
+	l.values, l.modTime = v, modTime
+	l.mtx.Unlock()
+	return nil
+}
+
+// WatchSignals reloads on every SIGHUP until done is closed.
+func (l *Loader) WatchSignals(done <-chan struct{}) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	defer signal.Stop(c)
+	for {
+		select {
+		case <-c:
+			l.reload("SIGHUP")
+		case <-done:
+			return
+		}
+	}
+}
+
+// WatchFile reloads whenever the file's modification time changes, checking
+// every interval until done is closed. It's a no-op without a file.
+func (l *Loader) WatchFile(interval time.Duration, done <-chan struct{}) {
+	if l.path == "" {
+		return
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			fi, err := os.Stat(l.path)
+			if err != nil {
+				continue
+			}
+			l.mtx.RLock()
+			changed := !fi.ModTime().Equal(l.modTime)
+			l.mtx.RUnlock()
+			if changed {
+				l.reload("file")
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+func (l *Loader) reload(trigger string) {
+	if err := l.Reload(); err != nil {
+		l.logger.Log("config", "reload", "trigger", trigger, "err", err)
+		return
+	}
+	l.logger.Log("config", "reload", "trigger", trigger, "log_level", l.Get().LogLevel)
+}
+
+// fromEnv applies CUSTOMERSVC_* overrides to v. CUSTOMERSVC_FEATURES is a
+// comma-separated list of flag names; a leading "-" turns a flag off.
+func fromEnv(v *Values) error {
+	if s, ok := os.LookupEnv("CUSTOMERSVC_LOG_LEVEL"); ok {
+		v.LogLevel = s
+	}
+	if s, ok := os.LookupEnv("CUSTOMERSVC_RATE_LIMIT"); ok {
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return err
+		}
+		v.RateLimit = f
+	}
+	if s, ok := os.LookupEnv("CUSTOMERSVC_RATE_BURST"); ok {
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return err
+		}
+		v.RateBurst = n
+	}
+	if s, ok := os.LookupEnv("CUSTOMERSVC_REQUEST_TIMEOUT"); ok {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		v.RequestTimeout = Duration(d)
+	}
+	if s, ok := os.LookupEnv("CUSTOMERSVC_FEATURES"); ok {
+		for _, name := range strings.Split(s, ",") {
+			name = strings.TrimSpace(name)
+			switch {
+			case name == "":
+			case strings.HasPrefix(name, "-"):
+				v.Features[name[1:]] = false
+			default:
+				v.Features[name] = true
+			}
+		}
+	}
+	return nil
+}
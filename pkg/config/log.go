@@ -0,0 +1,37 @@
+package config
+
+import (
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+// NewLevelFilter returns a logger that drops entries below the log level of
+// the current config. Unlike level.NewFilter, the threshold follows reloads.
+// Entries without a level key are treated as info.
+func NewLevelFilter(cfg Config, next log.Logger) log.Logger {
+	return &levelFilter{cfg: cfg, next: next}
+}
+
+type levelFilter struct {
+	cfg  Config
+	next log.Logger
+}
+
+var severities = map[string]int{"debug": 0, "info": 1, "warn": 2, "error": 3}
+
+func (l *levelFilter) Log(keyvals ...interface{}) error {
+	severity := severities["info"]
+	for i := 0; i+1 < len(keyvals); i += 2 {
+		if keyvals[i] != level.Key() {
+			continue
+		}
+		if v, ok := keyvals[i+1].(level.Value); ok {
+			severity = severities[v.String()]
+		}
+		break
+	}
+	if severity < severities[l.cfg.Get().LogLevel] {
+		return nil
+	}
+	return l.next.Log(keyvals...)
+}
@@ -0,0 +1,137 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// EnvName returns the environment variable overriding the flag name, e.g.
+// CUSTOMERSVC_HTTP_ADDR for http.addr.
+func EnvName(name string) string {
+	return "CUSTOMERSVC_" + strings.ToUpper(strings.NewReplacer(".", "_", "-", "_").Replace(name))
+}
+
+// LoadSettings sets the flags of fs that weren't given on the command line
+// from the environment, see EnvName, and then from the settings file named by
+// *file, if it's set. file is usually bound to a flag of fs, and read once
+// the environment is applied, so that it may be set there too. Flags given
+// on the command line thus take precedence over the environment, which takes
+// precedence over the file.
+//
+// The settings file is an object of flag values by name, see ReadSettings.
+// Objects nest, joining names with dots, so that {"http": {"addr": ":8080"}}
+// and {"http.addr": ":8080"} both set http.addr. Values are strings, numbers
+// or booleans, read as the flag would read them. Names that aren't flags of
+// fs are errors, so that typos don't go unnoticed.
+func LoadSettings(fs *flag.FlagSet, file *string) error {
+	set := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		s, ok := os.LookupEnv(EnvName(f.Name))
+		if err != nil || set[f.Name] || !ok {
+			return
+		}
+		if e := fs.Set(f.Name, s); e != nil {
+			err = fmt.Errorf("%s: %v", EnvName(f.Name), e)
+		}
+		set[f.Name] = true
+	})
+	if err != nil {
+		return err
+	}
+
+	path := *file
+	if path == "" {
+		return nil
+	}
+	settings, err := ReadSettings(path)
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0, len(settings))
+	for name := range settings {
+		names = append(names, name)
+	}
+	sort.Strings(names) // report the first unknown name consistently
+	for _, name := range names {
+		if fs.Lookup(name) == nil {
+			return fmt.Errorf("%s: unknown setting %q", path, name)
+		}
+		if set[name] {
+			continue
+		}
+		if err := fs.Set(name, settings[name]); err != nil {
+			return fmt.Errorf("%s: %s: %v", path, name, err)
+		}
+	}
+	return nil
+}
+
+// ReadSettings reads the settings file at path, returning its values by
+// flag name. Files named .yaml or .yml are YAML, of the subset ParseYAML
+// reads, and others JSON. TOML isn't supported: there's no parser for it in
+// the standard library, and the YAML subset covers the same nested tables of
+// scalars.
+func ReadSettings(path string) (map[string]string, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var tree map[string]interface{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		v, err := ParseYAML(buf)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		if v != nil { // empty
+			var ok bool
+			if tree, ok = v.(map[string]interface{}); !ok {
+				return nil, fmt.Errorf("%s: must be a mapping of settings", path)
+			}
+		}
+	case ".toml":
+		return nil, fmt.Errorf("%s: TOML isn't supported, write settings in YAML or JSON", path)
+	default:
+		dec := json.NewDecoder(bytes.NewReader(buf))
+		dec.UseNumber() // keep integers integers
+		if err := dec.Decode(&tree); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+	}
+	settings := map[string]string{}
+	if err := flatten(settings, "", tree); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return settings, nil
+}
+
+func flatten(settings map[string]string, prefix string, tree map[string]interface{}) error {
+	for key, value := range tree {
+		name := prefix + key
+		switch v := value.(type) {
+		case map[string]interface{}:
+			if err := flatten(settings, name+".", v); err != nil {
+				return err
+			}
+			continue
+		case string, json.Number, bool:
+		default:
+			return fmt.Errorf("%s: must be a string, number or boolean", name)
+		}
+		if _, ok := settings[name]; ok {
+			return fmt.Errorf("%s: set twice", name)
+		}
+		settings[name] = fmt.Sprint(value)
+	}
+	return nil
+}
@@ -0,0 +1,221 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ParseYAML parses the subset of YAML settings files and fixtures are
+// written in, to the values encoding/json would decode the same document in
+// JSON to, with numbers as json.Number: block mappings and sequences, nested
+// by indentation, of plain, single- or double-quoted scalars, with comments.
+// Flow collections must be valid JSON, e.g. [1, 2] or {"a": "b"}. Block
+// scalars (| and >), anchors, tags and multiple documents aren't supported.
+func ParseYAML(data []byte) (interface{}, error) {
+	p := &yamlParser{}
+	for n, raw := range strings.Split(string(data), "\n") {
+		line := strings.TrimRight(stripYAMLComment(raw), " \t\r")
+		text := strings.TrimLeft(line, " ")
+		if text == "" || line == "---" {
+			continue
+		}
+		if strings.HasPrefix(text, "\t") {
+			return nil, fmt.Errorf("line %d: indent with spaces, not tabs", n+1)
+		}
+		p.lines = append(p.lines, yamlLine{indent: len(line) - len(text), text: text, n: n + 1})
+	}
+	if len(p.lines) == 0 {
+		return nil, nil
+	}
+	v, err := p.node(p.lines[0].indent)
+	if err != nil {
+		return nil, err
+	}
+	if p.i < len(p.lines) {
+		return nil, fmt.Errorf("line %d: unexpected indentation", p.lines[p.i].n)
+	}
+	return v, nil
+}
+
+type yamlLine struct {
+	indent int
+	text   string
+	n      int // line number, from 1
+}
+
+type yamlParser struct {
+	lines []yamlLine
+	i     int // next line
+}
+
+// node parses the value starting at the next line, indented by indent.
+func (p *yamlParser) node(indent int) (interface{}, error) {
+	l := p.lines[p.i]
+	if yamlItem(l.text) {
+		return p.sequence(indent)
+	}
+	if _, _, ok := yamlKey(l.text); ok {
+		return p.mapping(indent)
+	}
+	p.i++
+	return yamlScalar(l.text, l.n)
+}
+
+func (p *yamlParser) sequence(indent int) ([]interface{}, error) {
+	items := []interface{}{}
+	for p.i < len(p.lines) && p.lines[p.i].indent == indent && yamlItem(p.lines[p.i].text) {
+		l := p.lines[p.i]
+		rest := strings.TrimLeft(l.text[1:], " ")
+		if rest == "" {
+			p.i++
+			var v interface{}
+			if p.i < len(p.lines) && p.lines[p.i].indent > indent {
+				var err error
+				if v, err = p.node(p.lines[p.i].indent); err != nil {
+					return nil, err
+				}
+			}
+			items = append(items, v)
+			continue
+		}
+		// What follows the dash is parsed as a line of its own, indented
+		// to where it starts, so that "- a: 1" begins a mapping whose
+		// other keys are aligned with a.
+		col := indent + len(l.text) - len(rest)
+		p.lines[p.i] = yamlLine{indent: col, text: rest, n: l.n}
+		v, err := p.node(col)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, v)
+	}
+	return items, nil
+}
+
+func (p *yamlParser) mapping(indent int) (map[string]interface{}, error) {
+	m := map[string]interface{}{}
+	for p.i < len(p.lines) && p.lines[p.i].indent == indent {
+		l := p.lines[p.i]
+		key, value, ok := yamlKey(l.text)
+		if !ok {
+			return nil, fmt.Errorf("line %d: expected key: value", l.n)
+		}
+		if _, dup := m[key]; dup {
+			return nil, fmt.Errorf("line %d: duplicate key %q", l.n, key)
+		}
+		p.i++
+		if value != "" {
+			v, err := yamlScalar(value, l.n)
+			if err != nil {
+				return nil, err
+			}
+			m[key] = v
+			continue
+		}
+		// A nested block is indented further, except for a sequence,
+		// which may be aligned with its key.
+		if p.i < len(p.lines) && (p.lines[p.i].indent > indent || p.lines[p.i].indent == indent && yamlItem(p.lines[p.i].text)) {
+			v, err := p.node(p.lines[p.i].indent)
+			if err != nil {
+				return nil, err
+			}
+			m[key] = v
+		} else {
+			m[key] = nil
+		}
+	}
+	return m, nil
+}
+
+// yamlItem reports whether text is an item of a block sequence.
+func yamlItem(text string) bool {
+	return text == "-" || strings.HasPrefix(text, "- ")
+}
+
+// yamlKey splits text into the key and value of a mapping entry, if it is
+// one. The value is empty if it's on the lines that follow.
+func yamlKey(text string) (key, value string, ok bool) {
+	if strings.HasPrefix(text, `"`) || strings.HasPrefix(text, "'") {
+		end := strings.Index(text[1:], text[:1])
+		if end < 0 || !strings.HasPrefix(text[end+2:], ":") {
+			return "", "", false
+		}
+		unquoted, err := yamlScalar(text[:end+2], 0)
+		if err != nil {
+			return "", "", false
+		}
+		return unquoted.(string), strings.TrimSpace(text[end+3:]), true
+	}
+	if strings.HasPrefix(text, "[") || strings.HasPrefix(text, "{") {
+		return "", "", false
+	}
+	i := strings.Index(text, ": ")
+	if i < 0 {
+		if !strings.HasSuffix(text, ":") {
+			return "", "", false
+		}
+		i = len(text) - 1
+	}
+	return strings.TrimSpace(text[:i]), strings.TrimSpace(text[i+1:]), true
+}
+
+// yamlScalar parses a scalar, or a flow collection written in JSON, found
+// on line n.
+func yamlScalar(s string, n int) (interface{}, error) {
+	switch {
+	case strings.HasPrefix(s, `"`):
+		var v string
+		if err := json.Unmarshal([]byte(s), &v); err != nil {
+			return nil, fmt.Errorf("line %d: malformed double-quoted string", n)
+		}
+		return v, nil
+	case strings.HasPrefix(s, "'"):
+		if len(s) < 2 || !strings.HasSuffix(s, "'") {
+			return nil, fmt.Errorf("line %d: malformed single-quoted string", n)
+		}
+		return strings.Replace(s[1:len(s)-1], "''", "'", -1), nil
+	case strings.HasPrefix(s, "[") || strings.HasPrefix(s, "{"):
+		var v interface{}
+		d := json.NewDecoder(strings.NewReader(s))
+		d.UseNumber()
+		if err := d.Decode(&v); err != nil {
+			return nil, fmt.Errorf("line %d: flow collections must be written in JSON", n)
+		}
+		return v, nil
+	case s == "|" || s == ">" || strings.HasPrefix(s, "&") || strings.HasPrefix(s, "*") || strings.HasPrefix(s, "!"):
+		return nil, fmt.Errorf("line %d: block scalars, anchors and tags aren't supported", n)
+	}
+	switch s {
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	case "null", "~":
+		return nil, nil
+	}
+	if _, err := strconv.ParseFloat(s, 64); err == nil {
+		return json.Number(s), nil
+	}
+	return s, nil
+}
+
+// stripYAMLComment removes a comment from line: from a # at its start or
+// after a space, outside quotes.
+func stripYAMLComment(line string) string {
+	var quote rune
+	for i, r := range line {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '"' || r == '\'':
+			quote = r
+		case r == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t'):
+			return line[:i]
+		}
+	}
+	return line
+}
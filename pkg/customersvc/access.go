@@ -0,0 +1,235 @@
+package customersvc
+
+import (
+	"context"
+	"encoding/binary"
+	"strings"
+	"time"
+)
+
+// Headers naming who reads customer data, and why. They're recorded in the
+// PII access log, and are not authenticated.
+const (
+	ActorHeader   = "X-Actor"
+	PurposeHeader = "X-Access-Purpose"
+)
+
+// AccessRecord is one entry of the PII access log: a successful read that
+// returned personal data.
+type AccessRecord struct {
+	Time       time.Time
+	RequestID  string
+	Actor      string
+	Purpose    string
+	Method     string
+	CustomerID string
+	AddressID  string   // for GetAddress
+	Customers  int      // for GetCustomers, the number returned
+	Fields     []string // the JSON names of the non-empty fields returned
+}
+
+// AccessSink receives AccessRecords. It's kept apart from the operational
+// logs, as compliance records typically have their own retention and
+// readers.
+type AccessSink interface {
+	Record(ctx context.Context, r AccessRecord) error
+}
+
+// NewLogAccessSink returns an AccessSink writing each record as a single
+// log event to logger, which should not be the operational logger.
+func NewLogAccessSink(logger Logger) AccessSink {
+	return logAccessSink{logger}
+}
+
+type logAccessSink struct{ logger Logger }
+
+func (s logAccessSink) Record(_ context.Context, r AccessRecord) error {
+	kv := []interface{}{
+		"ts", r.Time.UTC().Format(time.RFC3339Nano),
+		"request_id", r.RequestID,
+		"actor", r.Actor,
+		"purpose", r.Purpose,
+		"method", r.Method,
+		"customer", r.CustomerID,
+	}
+	if r.AddressID != "" {
+		kv = append(kv, "address", r.AddressID)
+	}
+	if r.Method == "GetCustomers" {
+		kv = append(kv, "customers", r.Customers)
+	}
+	kv = append(kv, "fields", strings.Join(r.Fields, ","))
+	return s.logger.Log(kv...)
+}
+
+// AccessLogOptions tunes AccessLogMiddleware.
+type AccessLogOptions struct {
+	// SampleRate is the fraction of reads recorded, between 0 and 1. Zero
+	// means 1: record everything.
+	SampleRate float64
+	// Filter, if set, is asked about every sampled record, and only those
+	// it returns true for are recorded.
+	Filter func(AccessRecord) bool
+}
+
+// AccessLogMiddleware records reads of personal data (GetCustomer,
+// GetCustomerAsOf, GetCustomerByExternalID, GetCustomers, GetAddresses and
+// GetAddress) to sink. Failures to record are logged to logger; they don't
+// fail the read.
+func AccessLogMiddleware(sink AccessSink, opts AccessLogOptions, logger Logger, options ...Option) Middleware {
+	o := makeOptions(options)
+	if opts.SampleRate <= 0 || opts.SampleRate > 1 {
+		opts.SampleRate = 1
+	}
+	return func(next Service) Service {
+		return &accessLogMiddleware{
+			Service: next,
+			sink:    sink,
+			opts:    opts,
+			logger:  logger,
+			clock:   o.clock,
+			rand:    o.rand,
+		}
+	}
+}
+
+type accessLogMiddleware struct {
+	Service
+	sink   AccessSink
+	opts   AccessLogOptions
+	logger Logger
+	clock  Clock
+	rand   Rand
+}
+
+func (mw *accessLogMiddleware) GetCustomer(ctx context.Context, id string) (Customer, error) {
+	p, err := mw.Service.GetCustomer(ctx, id)
+	if err == nil {
+		mw.record(ctx, AccessRecord{Method: "GetCustomer", CustomerID: id, Fields: customerFields([]Customer{p})})
+	}
+	return p, err
+}
+
+func (mw *accessLogMiddleware) GetCustomerAsOf(ctx context.Context, id string, t time.Time) (Customer, error) {
+	p, err := mw.Service.GetCustomerAsOf(ctx, id, t)
+	if err == nil {
+		mw.record(ctx, AccessRecord{Method: "GetCustomerAsOf", CustomerID: id, Fields: customerFields([]Customer{p})})
+	}
+	return p, err
+}
+
+func (mw *accessLogMiddleware) GetCustomerByExternalID(ctx context.Context, system, externalID string) (Customer, error) {
+	p, err := mw.Service.GetCustomerByExternalID(ctx, system, externalID)
+	if err == nil {
+		mw.record(ctx, AccessRecord{Method: "GetCustomerByExternalID", CustomerID: p.ID, Fields: customerFields([]Customer{p})})
+	}
+	return p, err
+}
+
+func (mw *accessLogMiddleware) GetCustomers(ctx context.Context, f CustomerFilter) ([]Customer, error) {
+	customers, err := mw.Service.GetCustomers(ctx, f)
+	if err == nil && len(customers) > 0 {
+		mw.record(ctx, AccessRecord{Method: "GetCustomers", Customers: len(customers), Fields: customerFields(customers)})
+	}
+	return customers, err
+}
+
+func (mw *accessLogMiddleware) GetAddresses(ctx context.Context, customerID string) ([]Address, error) {
+	addresses, err := mw.Service.GetAddresses(ctx, customerID)
+	if err == nil && len(addresses) > 0 {
+		mw.record(ctx, AccessRecord{Method: "GetAddresses", CustomerID: customerID, Fields: addressFields(addresses)})
+	}
+	return addresses, err
+}
+
+func (mw *accessLogMiddleware) GetAddress(ctx context.Context, customerID string, addressID string) (Address, error) {
+	a, err := mw.Service.GetAddress(ctx, customerID, addressID)
+	if err == nil {
+		mw.record(ctx, AccessRecord{Method: "GetAddress", CustomerID: customerID, AddressID: addressID, Fields: addressFields([]Address{a})})
+	}
+	return a, err
+}
+
+func (mw *accessLogMiddleware) record(ctx context.Context, r AccessRecord) {
+	if mw.opts.SampleRate < 1 && !sampled(mw.rand, mw.opts.SampleRate) {
+		return
+	}
+	r.Time = mw.clock.Now()
+	r.RequestID = RequestID(ctx)
+	r.Actor, r.Purpose = accessorFrom(ctx)
+	if mw.opts.Filter != nil && !mw.opts.Filter(r) {
+		return
+	}
+	if err := mw.sink.Record(ctx, r); err != nil {
+		mw.logger.Log("access_log", r.Method, "customer", r.CustomerID, "err", err)
+	}
+}
+
+// sampled reports whether to keep one event of a fraction rate of them.
+func sampled(r Rand, rate float64) bool {
+	var b [8]byte
+	if _, err := r.Read(b[:]); err != nil {
+		return true // when in doubt, record
+	}
+	return float64(binary.BigEndian.Uint64(b[:])>>11)/(1<<53) < rate
+}
+
+// customerFields returns the JSON names of the fields set in any of
+// customers.
+func customerFields(customers []Customer) []string {
+	var names, phone, addresses, metadata bool
+	for _, p := range customers {
+		names = names || p.GivenName != "" || p.FamilyName != "" || len(p.NameVariants) > 0
+		phone = phone || p.Phone != ""
+		addresses = addresses || len(p.Addresses) > 0
+		metadata = metadata || len(p.Metadata) > 0
+	}
+	fields := []string{"id", "name", "email"}
+	if names {
+		fields = append(fields, "given_name", "family_name", "name_variants")
+	}
+	if phone {
+		fields = append(fields, "phone")
+	}
+	if addresses {
+		fields = append(fields, "addresses")
+	}
+	if metadata {
+		fields = append(fields, "metadata")
+	}
+	return fields
+}
+
+// addressFields returns the JSON names of the fields set in any of
+// addresses.
+func addressFields(addresses []Address) []string {
+	var location, country, state bool
+	for _, a := range addresses {
+		location = location || a.Location != ""
+		country = country || a.Country != ""
+		state = state || a.State != ""
+	}
+	fields := []string{"id"}
+	if location {
+		fields = append(fields, "location")
+	}
+	if country {
+		fields = append(fields, "country")
+	}
+	if state {
+		fields = append(fields, "state")
+	}
+	return fields
+}
+
+// accessorFrom returns the actor and purpose named in the request metadata.
+// Requests authorized by a signed URL are attributed to "signed-url" unless
+// they name an actor.
+func accessorFrom(ctx context.Context) (actor, purpose string) {
+	md := RequestMetadataFrom(ctx)
+	actor, purpose = md.Get(MetadataActor), md.Get(MetadataPurpose)
+	if actor == "" && SignedAccess(ctx) {
+		actor = "signed-url"
+	}
+	return actor, purpose
+}
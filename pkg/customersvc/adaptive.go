@@ -0,0 +1,135 @@
+package customersvc
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/endpoint"
+	"github.com/go-kit/kit/metrics"
+)
+
+// AdaptiveLimits tunes AdaptiveLimitMiddleware. Zero values take the
+// defaults noted below.
+type AdaptiveLimits struct {
+	// Initial is the limit before any request completes. Default 20.
+	Initial int
+	// Min and Max bound the limit. Defaults 1 and 1000.
+	Min, Max int
+	// Tolerance is how many times the lowest latency seen a request may
+	// take before it's taken as a sign of congestion. Default 2.
+	Tolerance float64
+	// Backoff multiplies the limit on congestion. Default 0.9.
+	Backoff float64
+	// Window is how long the lowest latency is remembered, so that the
+	// baseline follows lasting changes in the backend. Default 1 minute.
+	Window time.Duration
+	// RetryAfter is the hint sent to rejected clients.
+	RetryAfter time.Duration
+	// Limit, if set, is updated with the current limit.
+	Limit metrics.Gauge
+}
+
+// AdaptiveLimitMiddleware returns an endpoint middleware that bounds the
+// requests handled at once, like ConcurrencyLimitMiddleware, but adjusts the
+// bound from observed latency instead of having it configured: additively
+// increased as requests complete quickly while the limit is being used, and
+// multiplicatively decreased when they slow down or time out (AIMD). The
+// limit is shared by every endpoint the middleware wraps. Requests over the
+// limit fail at once with a 503 carrying a Retry-After header.
+func AdaptiveLimitMiddleware(limits AdaptiveLimits, options ...Option) func(method string) endpoint.Middleware {
+	o := makeOptions(options)
+	if limits.Min <= 0 {
+		limits.Min = 1
+	}
+	if limits.Max <= 0 {
+		limits.Max = 1000
+	}
+	if limits.Initial <= 0 {
+		limits.Initial = 20
+	}
+	if limits.Tolerance <= 1 {
+		limits.Tolerance = 2
+	}
+	if limits.Backoff <= 0 || limits.Backoff >= 1 {
+		limits.Backoff = 0.9
+	}
+	if limits.Window <= 0 {
+		limits.Window = time.Minute
+	}
+	l := &adaptiveLimiter{opts: limits, clock: o.clock, limit: float64(limits.Initial)}
+	l.clamp()
+	rejected := overloadedError{retryAfter: limits.RetryAfter}
+	return func(method string) endpoint.Middleware {
+		return func(next endpoint.Endpoint) endpoint.Endpoint {
+			return func(ctx context.Context, request interface{}) (interface{}, error) {
+				inFlight, ok := l.acquire()
+				if !ok {
+					return nil, rejected
+				}
+				begin := l.clock.Now()
+				response, err := next(ctx, request)
+				l.release(inFlight, l.clock.Now().Sub(begin), err == ErrTimeout)
+				return response, err
+			}
+		}
+	}
+}
+
+type adaptiveLimiter struct {
+	opts  AdaptiveLimits
+	clock Clock
+
+	mtx      sync.Mutex
+	limit    float64
+	inFlight int
+	minRTT   time.Duration // lowest latency since minSince
+	minSince time.Time
+}
+
+// acquire takes a slot if there's one below the limit, and returns the
+// number of requests in flight including this one.
+func (l *adaptiveLimiter) acquire() (int, bool) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	if l.inFlight >= int(l.limit) {
+		return 0, false
+	}
+	l.inFlight++
+	return l.inFlight, true
+}
+
+// release frees a slot, and adjusts the limit from the latency of the
+// request, which held it along with inFlight-1 others.
+func (l *adaptiveLimiter) release(inFlight int, latency time.Duration, timedOut bool) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	l.inFlight--
+	now := l.clock.Now()
+	if l.minRTT == 0 || latency < l.minRTT || now.Sub(l.minSince) > l.opts.Window {
+		l.minRTT, l.minSince = latency, now
+	}
+	switch {
+	case timedOut || float64(latency) > l.opts.Tolerance*float64(l.minRTT):
+		l.limit *= l.opts.Backoff
+	case float64(inFlight) >= l.limit/2:
+		// Only grow a limit that's being used; an idle service learns
+		// nothing about how much it can take.
+		l.limit += 1 / l.limit
+	default:
+		return
+	}
+	l.clamp()
+}
+
+func (l *adaptiveLimiter) clamp() {
+	if l.limit < float64(l.opts.Min) {
+		l.limit = float64(l.opts.Min)
+	}
+	if l.limit > float64(l.opts.Max) {
+		l.limit = float64(l.opts.Max)
+	}
+	if l.opts.Limit != nil {
+		l.opts.Limit.Set(l.limit)
+	}
+}
@@ -0,0 +1,335 @@
+package customersvc
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/endpoint"
+	httptransport "github.com/go-kit/kit/transport/http"
+	"github.com/gorilla/mux"
+)
+
+// ErrAddressInUse is returned when deleting an address other services have
+// registered references to, unless forced. It's served as 409 Conflict.
+var ErrAddressInUse = errors.New("address is referenced; clear its references, or delete it with ?force=true")
+
+// AddressReference records another service relying on an address, e.g. a
+// shipment on its way to it.
+type AddressReference struct {
+	// ID names the reference within the address, e.g. "shipment-1234".
+	ID string `json:"id" xml:"id"`
+	// Owner is the service holding it, e.g. "shipping".
+	Owner   string    `json:"owner,omitempty" xml:"owner,omitempty"`
+	Created time.Time `json:"created" xml:"created"`
+}
+
+// AddressReferences stores references other services register to addresses
+// of customers, and guards referenced addresses against deletion. They are
+// held in memory, apart from customers. It's safe for concurrent use.
+type AddressReferences struct {
+	clock Clock
+
+	mtx  sync.Mutex
+	refs map[addressKey]map[string]AddressReference
+}
+
+type addressKey struct{ customerID, addressID string }
+
+// NewAddressReferences returns an empty reference store. Mount it with
+// WithAddressReferences.
+func NewAddressReferences(options ...Option) *AddressReferences {
+	o := makeOptions(options)
+	return &AddressReferences{clock: o.clock, refs: map[addressKey]map[string]AddressReference{}}
+}
+
+// Set registers ref to the address, or updates its owner if registered
+// already. Created is set by the store.
+func (a *AddressReferences) Set(customerID, addressID string, ref AddressReference) AddressReference {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	key := addressKey{customerID, addressID}
+	refs, ok := a.refs[key]
+	if !ok {
+		refs = map[string]AddressReference{}
+		a.refs[key] = refs
+	}
+	if old, ok := refs[ref.ID]; ok {
+		ref.Created = old.Created
+	} else {
+		ref.Created = a.clock.Now()
+	}
+	refs[ref.ID] = ref
+	return ref
+}
+
+// List returns the references to the address, oldest first.
+func (a *AddressReferences) List(customerID, addressID string) []AddressReference {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	refs := []AddressReference{}
+	for _, ref := range a.refs[addressKey{customerID, addressID}] {
+		refs = append(refs, ref)
+	}
+	sort.Slice(refs, func(i, j int) bool {
+		if !refs[i].Created.Equal(refs[j].Created) {
+			return refs[i].Created.Before(refs[j].Created)
+		}
+		return refs[i].ID < refs[j].ID
+	})
+	return refs
+}
+
+// Clear removes the reference to the address with the given ID. It fails
+// with ErrNotFound if there's none.
+func (a *AddressReferences) Clear(customerID, addressID, refID string) error {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	key := addressKey{customerID, addressID}
+	if _, ok := a.refs[key][refID]; !ok {
+		return ErrNotFound
+	}
+	delete(a.refs[key], refID)
+	if len(a.refs[key]) == 0 {
+		delete(a.refs, key)
+	}
+	return nil
+}
+
+// ClearAll removes every reference to the address.
+func (a *AddressReferences) ClearAll(customerID, addressID string) {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	delete(a.refs, addressKey{customerID, addressID})
+}
+
+func (a *AddressReferences) inUse(customerID, addressID string) bool {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	return len(a.refs[addressKey{customerID, addressID}]) > 0
+}
+
+func (a *AddressReferences) forget(customerID string) {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	for key := range a.refs {
+		if key.customerID == customerID {
+			delete(a.refs, key)
+		}
+	}
+}
+
+// middleware fails deletions of referenced addresses with ErrAddressInUse,
+// unless forced, and drops the references of deleted addresses and
+// customers.
+func (a *AddressReferences) middleware(method string) endpoint.Middleware {
+	if method != "DeleteAddress" && method != "DeleteCustomer" {
+		return func(next endpoint.Endpoint) endpoint.Endpoint { return next }
+	}
+	return func(next endpoint.Endpoint) endpoint.Endpoint {
+		return func(ctx context.Context, request interface{}) (interface{}, error) {
+			if req, ok := request.(deleteAddressRequest); ok && !req.Force && a.inUse(req.CustomerID, req.AddressID) {
+				return deleteAddressResponse{Err: ErrAddressInUse}, nil
+			}
+			response, err := next(ctx, request)
+			if err != nil {
+				return response, err
+			}
+			if e, ok := response.(errorer); ok && e.error() != nil {
+				return response, err
+			}
+			switch req := request.(type) {
+			case deleteAddressRequest:
+				a.ClearAll(req.CustomerID, req.AddressID)
+			case deleteCustomerRequest:
+				a.forget(req.ID)
+			}
+			return response, err
+		}
+	}
+}
+
+// WithAddressReferences lets other services register references to
+// addresses in a, such as active shipments, and mounts:
+//
+//	GET     /customers/:id/addresses/:addressID/references/       list the references to the address
+//	PUT     /customers/:id/addresses/:addressID/references/:ref   register one: {"owner": "shipping"}
+//	DELETE  /customers/:id/addresses/:addressID/references/:ref   clear one
+//	DELETE  /customers/:id/addresses/:addressID/references/       clear them all
+//
+// DELETE /customers/:id/addresses/:addressID then fails with ErrAddressInUse
+// while the address has references, unless given ?force=true, which clears
+// them too. Only that route is guarded: PUT replacing a customer's addresses
+// isn't.
+func WithAddressReferences(a *AddressReferences) HandlerOption {
+	return func(c *handlerConfig) { c.addressRefs = a }
+}
+
+func mountAddressReferences(r *mux.Router, s Service, a *AddressReferences, wrap func(string, endpoint.Endpoint) endpoint.Endpoint, options []httptransport.ServerOption) {
+	r.Methods("GET").Path("/customers/{id}/addresses/{addressID}/references/").Handler(httptransport.NewServer(
+		wrap("GetAddressReferences", makeGetAddressReferencesEndpoint(s, a)),
+		decodeGetAddressReferencesRequest,
+		encodeResponse,
+		options...,
+	))
+	r.Methods("PUT").Path("/customers/{id}/addresses/{addressID}/references/{ref}").Handler(httptransport.NewServer(
+		wrap("SetAddressReference", makeSetAddressReferenceEndpoint(s, a)),
+		decodeSetAddressReferenceRequest,
+		encodeResponse,
+		options...,
+	))
+	r.Methods("DELETE").Path("/customers/{id}/addresses/{addressID}/references/{ref}").Handler(httptransport.NewServer(
+		wrap("ClearAddressReference", makeClearAddressReferenceEndpoint(a)),
+		decodeClearAddressReferenceRequest,
+		encodeResponse,
+		options...,
+	))
+	r.Methods("DELETE").Path("/customers/{id}/addresses/{addressID}/references/").Handler(httptransport.NewServer(
+		wrap("ClearAddressReferences", makeClearAddressReferencesEndpoint(a)),
+		decodeClearAddressReferencesRequest,
+		encodeResponse,
+		options...,
+	))
+}
+
+func makeGetAddressReferencesEndpoint(s Service, a *AddressReferences) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(getAddressReferencesRequest)
+		if _, e := s.GetAddress(ctx, req.CustomerID, req.AddressID); e != nil {
+			return getAddressReferencesResponse{Err: e}, nil
+		}
+		return getAddressReferencesResponse{References: a.List(req.CustomerID, req.AddressID)}, nil
+	}
+}
+
+func makeSetAddressReferenceEndpoint(s Service, a *AddressReferences) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(setAddressReferenceRequest)
+		if _, e := s.GetAddress(ctx, req.CustomerID, req.AddressID); e != nil {
+			return setAddressReferenceResponse{Err: e}, nil
+		}
+		ref := a.Set(req.CustomerID, req.AddressID, req.Reference)
+		return setAddressReferenceResponse{Reference: &ref}, nil
+	}
+}
+
+func makeClearAddressReferenceEndpoint(a *AddressReferences) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(clearAddressReferenceRequest)
+		return clearAddressReferencesResponse{Err: a.Clear(req.CustomerID, req.AddressID, req.ID)}, nil
+	}
+}
+
+func makeClearAddressReferencesEndpoint(a *AddressReferences) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(clearAddressReferencesRequest)
+		a.ClearAll(req.CustomerID, req.AddressID)
+		return clearAddressReferencesResponse{}, nil
+	}
+}
+
+type getAddressReferencesRequest struct {
+	CustomerID, AddressID string
+}
+
+type getAddressReferencesResponse struct {
+	References []AddressReference `json:"references,omitempty" xml:"references>reference,omitempty"`
+	Err        error              `json:"err,omitempty" xml:"-"`
+}
+
+func (r getAddressReferencesResponse) error() error { return r.Err }
+
+type setAddressReferenceRequest struct {
+	CustomerID, AddressID string
+	Reference             AddressReference
+}
+
+type setAddressReferenceResponse struct {
+	Reference *AddressReference `json:"reference,omitempty" xml:"reference,omitempty"`
+	Err       error             `json:"err,omitempty" xml:"-"`
+}
+
+func (r setAddressReferenceResponse) error() error { return r.Err }
+
+type clearAddressReferenceRequest struct {
+	CustomerID, AddressID, ID string
+}
+
+type clearAddressReferencesRequest struct {
+	CustomerID, AddressID string
+}
+
+type clearAddressReferencesResponse struct {
+	Err error `json:"err,omitempty" xml:"-"`
+}
+
+func (r clearAddressReferencesResponse) error() error { return r.Err }
+
+// decodeAddressReferenceRequest decodes the customer and address IDs from
+// the path, and the reference ID too if ref is set.
+func decodeAddressReferenceRequest(r *http.Request, ref *string) (customerID, addressID string, err error) {
+	vars := mux.Vars(r)
+	customerID, ok := vars["id"]
+	if !ok {
+		return "", "", ErrBadRouting
+	}
+	addressID, ok = vars["addressID"]
+	if !ok {
+		return "", "", ErrBadRouting
+	}
+	if ref != nil {
+		if *ref, ok = vars["ref"]; !ok {
+			return "", "", ErrBadRouting
+		}
+	}
+	return customerID, addressID, nil
+}
+
+func decodeGetAddressReferencesRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	customerID, addressID, err := decodeAddressReferenceRequest(r, nil)
+	if err != nil {
+		return nil, err
+	}
+	return getAddressReferencesRequest{CustomerID: customerID, AddressID: addressID}, nil
+}
+
+func decodeSetAddressReferenceRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	var refID string
+	customerID, addressID, err := decodeAddressReferenceRequest(r, &refID)
+	if err != nil {
+		return nil, err
+	}
+	var body struct {
+		Owner string `json:"owner" xml:"owner"`
+	}
+	if r.ContentLength != 0 {
+		if err := decodeBody(r, &body); err != nil {
+			return nil, err
+		}
+	}
+	return setAddressReferenceRequest{
+		CustomerID: customerID,
+		AddressID:  addressID,
+		Reference:  AddressReference{ID: refID, Owner: body.Owner},
+	}, nil
+}
+
+func decodeClearAddressReferenceRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	var refID string
+	customerID, addressID, err := decodeAddressReferenceRequest(r, &refID)
+	if err != nil {
+		return nil, err
+	}
+	return clearAddressReferenceRequest{CustomerID: customerID, AddressID: addressID, ID: refID}, nil
+}
+
+func decodeClearAddressReferencesRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	customerID, addressID, err := decodeAddressReferenceRequest(r, nil)
+	if err != nil {
+		return nil, err
+	}
+	return clearAddressReferencesRequest{CustomerID: customerID, AddressID: addressID}, nil
+}
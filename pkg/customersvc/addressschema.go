@@ -0,0 +1,224 @@
+package customersvc
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+var (
+	// ErrUnknownCustomField is returned for a custom address field the
+	// AddressSchema doesn't define.
+	ErrUnknownCustomField = errors.New("not a custom field of the address schema")
+	// ErrCustomFieldType is returned for a custom address field whose value
+	// isn't of the type the AddressSchema gives it.
+	ErrCustomFieldType = errors.New("has the wrong type for the address schema")
+	// ErrCustomFieldValue is returned for a custom address field whose value
+	// the AddressSchema doesn't allow: too long, or not one of its values.
+	ErrCustomFieldValue = errors.New("is not allowed by the address schema")
+	// ErrMissingCustomField is returned for an address lacking a custom field
+	// the AddressSchema requires.
+	ErrMissingCustomField = errors.New("is required by the address schema")
+)
+
+// Types of custom address fields, as their values are in JSON.
+const (
+	FieldString  = "string"
+	FieldNumber  = "number"
+	FieldBoolean = "boolean"
+)
+
+// CustomFields are the fields of an address beyond those every deployment
+// has, e.g. an apartment number, delivery notes or a contact person, by
+// name. Values are strings, float64 numbers or bools, as decoded from JSON,
+// and are checked against the AddressSchema of the deployment.
+type CustomFields map[string]interface{}
+
+// MarshalXML implements xml.Marshaler. Fields are written as
+// <field name="..." type="...">value</field>, sorted by name.
+func (f CustomFields) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	if err := e.EncodeToken(start); err != nil {
+		return err
+	}
+	names := make([]string, 0, len(f))
+	for name := range f {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		typ, value := fieldType(f[name]), fmt.Sprint(f[name])
+		if typ == "" {
+			return fmt.Errorf("custom field %s: unsupported value %#v", name, f[name])
+		}
+		field := xml.StartElement{Name: xml.Name{Local: "field"}, Attr: []xml.Attr{
+			{Name: xml.Name{Local: "name"}, Value: name},
+			{Name: xml.Name{Local: "type"}, Value: typ},
+		}}
+		if typ == FieldNumber {
+			value = strconv.FormatFloat(f[name].(float64), 'f', -1, 64)
+		}
+		if err := e.EncodeElement(value, field); err != nil {
+			return err
+		}
+	}
+	return e.EncodeToken(start.End())
+}
+
+// UnmarshalXML implements xml.Unmarshaler, reading the format written by
+// MarshalXML. Fields without a type are strings.
+func (f *CustomFields) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	var body struct {
+		Fields []struct {
+			Name  string `xml:"name,attr"`
+			Type  string `xml:"type,attr"`
+			Value string `xml:",chardata"`
+		} `xml:"field"`
+	}
+	if err := d.DecodeElement(&body, &start); err != nil {
+		return err
+	}
+	*f = make(CustomFields, len(body.Fields))
+	for _, field := range body.Fields {
+		var value interface{}
+		var err error
+		switch field.Type {
+		case "", FieldString:
+			value = field.Value
+		case FieldNumber:
+			value, err = strconv.ParseFloat(field.Value, 64)
+		case FieldBoolean:
+			value, err = strconv.ParseBool(field.Value)
+		default:
+			err = fmt.Errorf("unknown type %q", field.Type)
+		}
+		if err != nil {
+			return fmt.Errorf("custom field %s: %v", field.Name, err)
+		}
+		(*f)[field.Name] = value
+	}
+	return nil
+}
+
+// fieldType returns the type of a custom field value, or "" if it isn't a
+// string, number or boolean.
+func fieldType(v interface{}) string {
+	switch v.(type) {
+	case string:
+		return FieldString
+	case float64:
+		return FieldNumber
+	case bool:
+		return FieldBoolean
+	}
+	return ""
+}
+
+// CustomField defines a custom address field of an AddressSchema.
+type CustomField struct {
+	Type     string `json:"type"` // FieldString, FieldNumber or FieldBoolean
+	Required bool   `json:"required,omitempty"`
+	// MaxLength limits strings, in bytes. Zero is no limit.
+	MaxLength int `json:"max_length,omitempty"`
+	// Values, if set, are those a string may take.
+	Values []string `json:"values,omitempty"`
+}
+
+// AddressSchema defines the custom fields addresses may have in a
+// deployment. Addresses with fields it doesn't define, or with values it
+// doesn't allow, fail validation like those with an unknown country. A nil
+// AddressSchema defines none.
+type AddressSchema struct {
+	fields map[string]CustomField
+}
+
+// NewAddressSchema returns an AddressSchema defining fields, by name.
+func NewAddressSchema(fields map[string]CustomField) (*AddressSchema, error) {
+	schema := &AddressSchema{fields: make(map[string]CustomField, len(fields))}
+	for name, field := range fields {
+		if name == "" {
+			return nil, errors.New("custom fields need a name")
+		}
+		switch field.Type {
+		case FieldString, FieldNumber, FieldBoolean:
+		default:
+			return nil, fmt.Errorf("custom field %s: unknown type %q", name, field.Type)
+		}
+		if field.Type != FieldString && (field.MaxLength > 0 || len(field.Values) > 0) {
+			return nil, fmt.Errorf("custom field %s: only strings take max_length or values", name)
+		}
+		schema.fields[name] = field
+	}
+	return schema, nil
+}
+
+// WithAddressSchema makes the inmem store accept the custom address fields
+// schema defines.
+func WithAddressSchema(schema *AddressSchema) Option {
+	return func(o *options) { o.schema = schema }
+}
+
+// validate returns the problems with the custom fields of a, whose field
+// names are given prefix.
+func (schema *AddressSchema) validate(prefix string, a Address) []FieldError {
+	var errs []FieldError
+	names := make([]string, 0, len(a.CustomFields))
+	for name := range a.CustomFields {
+		names = append(names, name)
+	}
+	sort.Strings(names) // for stable error lists
+	for _, name := range names {
+		field := prefix + "custom_fields." + name
+		def, ok := schema.field(name)
+		if !ok {
+			errs = append(errs, fieldError(field, ErrUnknownCustomField))
+			continue
+		}
+		value := a.CustomFields[name]
+		if fieldType(value) != def.Type {
+			errs = append(errs, fieldError(field, ErrCustomFieldType))
+			continue
+		}
+		if s, ok := value.(string); ok && !def.allows(s) {
+			errs = append(errs, fieldError(field, ErrCustomFieldValue))
+		}
+	}
+	if schema == nil {
+		return errs
+	}
+	required := make([]string, 0, len(schema.fields))
+	for name, def := range schema.fields {
+		if _, ok := a.CustomFields[name]; def.Required && !ok {
+			required = append(required, name)
+		}
+	}
+	sort.Strings(required)
+	for _, name := range required {
+		errs = append(errs, fieldError(prefix+"custom_fields."+name, ErrMissingCustomField))
+	}
+	return errs
+}
+
+func (schema *AddressSchema) field(name string) (CustomField, bool) {
+	if schema == nil {
+		return CustomField{}, false
+	}
+	field, ok := schema.fields[name]
+	return field, ok
+}
+
+func (field CustomField) allows(s string) bool {
+	if field.MaxLength > 0 && len(s) > field.MaxLength {
+		return false
+	}
+	if len(field.Values) == 0 {
+		return true
+	}
+	for _, v := range field.Values {
+		if s == v {
+			return true
+		}
+	}
+	return false
+}
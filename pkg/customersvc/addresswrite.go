@@ -0,0 +1,145 @@
+package customersvc
+
+import (
+	"context"
+	"errors"
+)
+
+var (
+	// ErrInvalidAddressWrite is returned for an addresses mode PUT doesn't
+	// know.
+	ErrInvalidAddressWrite = errors.New("addresses must be replace, merge or ignore")
+	// ErrAddressesSubresource is returned for a PUT asking to replace or
+	// merge the addresses of an existing customer, when only the address
+	// endpoints may change them.
+	ErrAddressesSubresource = errors.New("addresses of an existing customer can only be changed through the address endpoints")
+)
+
+// AddressWrite says what PutCustomer does with the addresses embedded in the
+// customer it's given. A PUT is all or nothing whatever the mode: if any
+// address is invalid, or two share an ID, nothing is written.
+type AddressWrite int
+
+const (
+	// AddressesByAuthority does what the AddressAuthority of the store
+	// says: AddressesReplace if it's AddressesEmbedded, AddressesIgnore if
+	// it's AddressesSubresource. It's the default.
+	AddressesByAuthority AddressWrite = iota
+	// AddressesReplace makes the addresses given those of the customer,
+	// dropping the others.
+	AddressesReplace
+	// AddressesMerge replaces the addresses of the customer with the IDs of
+	// those given, and adds those without an ID, or with one it doesn't
+	// have. The others are kept.
+	AddressesMerge
+	// AddressesIgnore keeps the addresses of an existing customer, whatever
+	// those given. A customer created is given them, as with
+	// AddressesSubresource.
+	AddressesIgnore
+)
+
+// ParseAddressWrite parses "replace", "merge" or "ignore". The empty string
+// is AddressesByAuthority.
+func ParseAddressWrite(s string) (AddressWrite, error) {
+	switch s {
+	case "":
+		return AddressesByAuthority, nil
+	case "replace":
+		return AddressesReplace, nil
+	case "merge":
+		return AddressesMerge, nil
+	case "ignore":
+		return AddressesIgnore, nil
+	}
+	return AddressesByAuthority, ErrInvalidAddressWrite
+}
+
+// String returns the name ParseAddressWrite parses, or "" for
+// AddressesByAuthority.
+func (w AddressWrite) String() string {
+	switch w {
+	case AddressesReplace:
+		return "replace"
+	case AddressesMerge:
+		return "merge"
+	case AddressesIgnore:
+		return "ignore"
+	}
+	return ""
+}
+
+type addressWriteKey struct{}
+
+// WithAddressWrite returns a copy of ctx making the PutCustomer calls made
+// with it treat addresses according to w. Over HTTP, it's the addresses
+// query parameter of PUT /customers/:id.
+func WithAddressWrite(ctx context.Context, w AddressWrite) context.Context {
+	return context.WithValue(ctx, addressWriteKey{}, w)
+}
+
+// AddressWriteFrom returns the AddressWrite ctx was given by WithAddressWrite,
+// or AddressesByAuthority.
+func AddressWriteFrom(ctx context.Context) AddressWrite {
+	w, _ := ctx.Value(addressWriteKey{}).(AddressWrite)
+	return w
+}
+
+// putAddresses returns the addresses of a customer written by PUT with the
+// addresses given, according to w. existing is the stored customer, if
+// exists. It must be called with s.mtx held.
+func (s *inmemService) putAddresses(w AddressWrite, existing Customer, exists bool, addresses []Address) ([]Address, error) {
+	if w == AddressesByAuthority {
+		w = AddressesReplace
+		if s.addresses == AddressesSubresource {
+			w = AddressesIgnore
+		}
+	} else if exists && s.addresses == AddressesSubresource && w != AddressesIgnore {
+		return nil, ErrAddressesSubresource
+	}
+	if !exists {
+		return s.embedAddresses(addresses)
+	}
+	switch w {
+	case AddressesIgnore:
+		return existing.Addresses, nil
+	case AddressesMerge:
+		merged, err := mergeAddresses(existing.Addresses, addresses)
+		if err != nil {
+			return nil, err
+		}
+		return s.embedAddresses(merged)
+	}
+	return s.embedAddresses(addresses)
+}
+
+// mergeAddresses returns existing with the addresses sharing an ID with one
+// of addresses replaced by it, in its place unless it has a position of its
+// own, and the rest of addresses added after them.
+func mergeAddresses(existing, addresses []Address) ([]Address, error) {
+	merged := append([]Address(nil), existing...) // revisions share the old slice
+	index := make(map[string]int, len(merged))
+	for i, a := range merged {
+		index[a.ID] = i
+	}
+	given := make(map[string]bool, len(addresses))
+	for _, a := range addresses {
+		if a.ID == "" {
+			merged = append(merged, a)
+			continue
+		}
+		if given[a.ID] {
+			return nil, ErrDuplicateAddressID
+		}
+		given[a.ID] = true
+		i, ok := index[a.ID]
+		if !ok {
+			merged = append(merged, a)
+			continue
+		}
+		if a.Position == 0 {
+			a.Position = merged[i].Position
+		}
+		merged[i] = a
+	}
+	return merged, nil
+}
@@ -0,0 +1,132 @@
+package customersvc
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// addressWriteCase is a PUT of a customer with addresses, made to a store
+// holding customer c1 with addresses a1 and a2, or to an empty one if
+// create.
+type addressWriteCase struct {
+	name      string
+	create    bool
+	addresses []Address
+	want      []string // summaries of the customer's addresses afterwards, see summarizeAddresses
+	err       error
+}
+
+func testAddressWrite(t *testing.T, w AddressWrite, authority AddressAuthority, cases []addressWriteCase) {
+	t.Helper()
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			s := NewInmemService(WithAddressAuthority(authority))
+			before := []string{"a1:1 Main St@1", "a2:2 Oak Ave@2"}
+			if !tc.create {
+				if err := s.PostCustomer(ctx, Customer{ID: "c1", Name: "A", Email: "a@example.com", Addresses: []Address{
+					{ID: "a1", Location: "1 Main St", Country: "US", Position: 1},
+					{ID: "a2", Location: "2 Oak Ave", Country: "US", Position: 2},
+				}}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			err := s.PutCustomer(WithAddressWrite(ctx, w), "c1", Customer{ID: "c1", Name: "A", Email: "a@example.com", Addresses: tc.addresses})
+			if err != tc.err {
+				t.Fatalf("want error %v, have %v", tc.err, err)
+			}
+			p, err := s.GetCustomer(ctx, "c1")
+			if err == ErrNotFound && tc.create && tc.err != nil {
+				return // nothing created
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := tc.want
+			if tc.err != nil {
+				want = before // all or nothing
+			}
+			if have := summarizeAddresses(p.Addresses); !reflect.DeepEqual(want, have) {
+				t.Errorf("want %v, have %v", want, have)
+			}
+		})
+	}
+}
+
+// summarizeAddresses returns id:location@position for each address, with ?
+// for generated IDs.
+func summarizeAddresses(addresses []Address) []string {
+	summaries := []string{}
+	for _, a := range addresses {
+		id := a.ID
+		if len(id) == 26 && strings.ToUpper(id) == id { // a ULID
+			id = "?"
+		}
+		summaries = append(summaries, fmt.Sprintf("%s:%s@%d", id, a.Location, a.Position))
+	}
+	return summaries
+}
+
+func TestPutAddressesReplace(t *testing.T) {
+	testAddressWrite(t, AddressesReplace, AddressesEmbedded, []addressWriteCase{
+		{name: "drops those missing", addresses: []Address{{ID: "a2", Location: "2 Oak Ave", Country: "US"}}, want: []string{"a2:2 Oak Ave@1"}},
+		{name: "replaces those given", addresses: []Address{{ID: "a1", Location: "1 New St", Country: "US"}, {ID: "a2", Location: "2 Oak Ave", Country: "US"}}, want: []string{"a1:1 New St@1", "a2:2 Oak Ave@2"}},
+		{name: "gives IDs to new ones", addresses: []Address{{Location: "3 Elm St", Country: "US"}}, want: []string{"?:3 Elm St@1"}},
+		{name: "none", addresses: []Address{}, want: []string{}},
+		{name: "follows positions given", addresses: []Address{{ID: "a1", Location: "1 Main St", Country: "US", Position: 2}, {ID: "a2", Location: "2 Oak Ave", Country: "US", Position: 1}}, want: []string{"a2:2 Oak Ave@1", "a1:1 Main St@2"}},
+		{name: "conflicting IDs", addresses: []Address{{ID: "a1", Location: "x", Country: "US"}, {ID: "a1", Location: "y", Country: "US"}}, err: ErrDuplicateAddressID},
+		{name: "create", create: true, addresses: []Address{{ID: "a9", Location: "9 Pine Rd", Country: "US"}}, want: []string{"a9:9 Pine Rd@1"}},
+	})
+}
+
+func TestPutAddressesMerge(t *testing.T) {
+	testAddressWrite(t, AddressesMerge, AddressesEmbedded, []addressWriteCase{
+		{name: "keeps those missing", addresses: []Address{{ID: "a2", Location: "2 New Ave", Country: "US"}}, want: []string{"a1:1 Main St@1", "a2:2 New Ave@2"}},
+		{name: "adds unknown IDs", addresses: []Address{{ID: "a3", Location: "3 Elm St", Country: "US"}}, want: []string{"a1:1 Main St@1", "a2:2 Oak Ave@2", "a3:3 Elm St@3"}},
+		{name: "adds and gives IDs to new ones", addresses: []Address{{Location: "3 Elm St", Country: "US"}}, want: []string{"a1:1 Main St@1", "a2:2 Oak Ave@2", "?:3 Elm St@3"}},
+		{name: "none", addresses: []Address{}, want: []string{"a1:1 Main St@1", "a2:2 Oak Ave@2"}},
+		{name: "moves those given a position", addresses: []Address{{ID: "a2", Location: "2 Oak Ave", Country: "US", Position: 1}, {ID: "a1", Location: "1 Main St", Country: "US", Position: 2}}, want: []string{"a2:2 Oak Ave@1", "a1:1 Main St@2"}},
+		{name: "conflicting IDs", addresses: []Address{{ID: "a2", Location: "x", Country: "US"}, {ID: "a2", Location: "y", Country: "US"}}, err: ErrDuplicateAddressID},
+		{name: "create", create: true, addresses: []Address{{ID: "a9", Location: "9 Pine Rd", Country: "US"}}, want: []string{"a9:9 Pine Rd@1"}},
+	})
+}
+
+func TestPutAddressesIgnore(t *testing.T) {
+	testAddressWrite(t, AddressesIgnore, AddressesEmbedded, []addressWriteCase{
+		{name: "keeps all", addresses: []Address{{ID: "a2", Location: "2 New Ave", Country: "US"}}, want: []string{"a1:1 Main St@1", "a2:2 Oak Ave@2"}},
+		{name: "adds none", addresses: []Address{{Location: "3 Elm St", Country: "US"}}, want: []string{"a1:1 Main St@1", "a2:2 Oak Ave@2"}},
+		{name: "none", addresses: []Address{}, want: []string{"a1:1 Main St@1", "a2:2 Oak Ave@2"}},
+		{name: "conflicting IDs ignored", addresses: []Address{{ID: "a2", Location: "x", Country: "US"}, {ID: "a2", Location: "y", Country: "US"}}, want: []string{"a1:1 Main St@1", "a2:2 Oak Ave@2"}},
+		{name: "create", create: true, addresses: []Address{{ID: "a9", Location: "9 Pine Rd", Country: "US"}}, want: []string{"a9:9 Pine Rd@1"}},
+		{name: "create with conflicting IDs", create: true, addresses: []Address{{ID: "a9", Location: "x", Country: "US"}, {ID: "a9", Location: "y", Country: "US"}}, err: ErrDuplicateAddressID},
+	})
+}
+
+func TestPutAddressesSubresource(t *testing.T) {
+	testAddressWrite(t, AddressesByAuthority, AddressesSubresource, []addressWriteCase{
+		{name: "ignored by default", addresses: []Address{{ID: "a2", Location: "2 New Ave", Country: "US"}}, want: []string{"a1:1 Main St@1", "a2:2 Oak Ave@2"}},
+		{name: "create", create: true, addresses: []Address{{ID: "a9", Location: "9 Pine Rd", Country: "US"}}, want: []string{"a9:9 Pine Rd@1"}},
+	})
+	for _, w := range []AddressWrite{AddressesReplace, AddressesMerge} {
+		t.Run(w.String(), func(t *testing.T) {
+			testAddressWrite(t, w, AddressesSubresource, []addressWriteCase{
+				{name: "refused", addresses: []Address{{ID: "a2", Location: "2 New Ave", Country: "US"}}, err: ErrAddressesSubresource},
+				{name: "create", create: true, addresses: []Address{{ID: "a9", Location: "9 Pine Rd", Country: "US"}}, want: []string{"a9:9 Pine Rd@1"}},
+			})
+		})
+	}
+}
+
+func TestParseAddressWrite(t *testing.T) {
+	for _, w := range []AddressWrite{AddressesByAuthority, AddressesReplace, AddressesMerge, AddressesIgnore} {
+		if have, err := ParseAddressWrite(w.String()); err != nil || have != w {
+			t.Errorf("%q: want %v, have %v, %v", w.String(), w, have, err)
+		}
+	}
+	if _, err := ParseAddressWrite("append"); err != ErrInvalidAddressWrite {
+		t.Errorf("want %v, have %v", ErrInvalidAddressWrite, err)
+	}
+}
@@ -0,0 +1,425 @@
+package customersvc
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/endpoint"
+	httptransport "github.com/go-kit/kit/transport/http"
+	"github.com/gorilla/mux"
+)
+
+var (
+	// ErrUnauthenticated is returned when a request carries no API key, or
+	// one that's unknown, expired or revoked.
+	ErrUnauthenticated = errors.New("missing or invalid API key")
+	// ErrInsufficientScope is returned when a request's API key lacks the
+	// scope the endpoint requires.
+	ErrInsufficientScope = errors.New("API key lacks the scope required")
+	// ErrInvalidScope is returned when issuing a key with an unknown scope,
+	// or none.
+	ErrInvalidScope = errors.New("scopes must be among read, write and admin")
+	// ErrTenantMismatch is returned when a request names a tenant other
+	// than the one its credentials act for.
+	ErrTenantMismatch = errors.New("credentials act for another tenant")
+)
+
+// APIKeyHeader carries an API key, as an alternative to an Authorization
+// header of the form "Bearer <key>".
+const APIKeyHeader = "X-API-Key"
+
+// API key scopes. Each implies the ones before it: write keys may read, and
+// admin keys may do anything.
+const (
+	ScopeRead  = "read"
+	ScopeWrite = "write"
+	ScopeAdmin = "admin"
+)
+
+var scopeRanks = map[string]int{ScopeRead: 1, ScopeWrite: 2, ScopeAdmin: 3}
+
+// Endpoints needing less than ScopeWrite, or more. Every other endpoint
+// needs ScopeWrite.
+var methodScopes = map[string]string{
+	"GetCustomer":             ScopeRead,
+	"GetCustomerAsOf":         ScopeRead,
+	"GetCustomerByExternalID": ScopeRead,
+	"GetConsents":             ScopeRead,
+	"GetCustomers":            ScopeRead,
+	"GetCustomersPage":        ScopeRead,
+	"GetCustomerFull":         ScopeRead,
+	"GetCustomersByRegion":    ScopeRead,
+	"GetDuplicateAddresses":   ScopeRead,
+	"GetOwner":                ScopeRead,
+	"GetCustomerStats":        ScopeRead,
+	"GetAddresses":            ScopeRead,
+	"GetAddressesPage":        ScopeRead,
+	"GetAddress":              ScopeRead,
+	"GetAddressReferences":    ScopeRead,
+	"ValidateCustomer":        ScopeRead,
+	"ValidateAddress":         ScopeRead,
+	"GetBlocklist":            ScopeAdmin,
+	"AddBlockEntry":           ScopeAdmin,
+	"RemoveBlockEntry":        ScopeAdmin,
+	"IssueAPIKey":             ScopeAdmin,
+	"ListAPIKeys":             ScopeAdmin,
+	"RevokeAPIKey":            ScopeAdmin,
+	"GetRecordings":           ScopeAdmin,
+	"ResetRecordings":         ScopeAdmin,
+	"Tap":                     ScopeAdmin,
+	"GetTenantUsage":          ScopeAdmin,
+	"RepairAddresses":         ScopeAdmin,
+	"RebuildIndex":            ScopeAdmin,
+	"GetIndexRebuild":         ScopeAdmin,
+	"CheckConsistency":        ScopeAdmin,
+	"BulkPatchCustomers":      ScopeAdmin,
+	"ListJobs":                ScopeAdmin,
+	"GetJob":                  ScopeAdmin,
+	"Seed":                    ScopeAdmin,
+}
+
+// APIKey describes an API key. The key itself is only known to its holder:
+// the store keeps a hash of it.
+type APIKey struct {
+	ID     string   `json:"id" xml:"id"`
+	Name   string   `json:"name,omitempty" xml:"name,omitempty"`
+	Scopes []string `json:"scopes" xml:"scopes>scope"`
+	// Tenant is the only tenant the key acts for, see TenantFrom. Keys
+	// without one act for DefaultTenant, except admin keys, which act for
+	// whichever tenant a request names.
+	Tenant  string     `json:"tenant,omitempty" xml:"tenant,omitempty"`
+	Created time.Time  `json:"created" xml:"created"`
+	Expires *time.Time `json:"expires,omitempty" xml:"expires,omitempty"` // nil if it never expires
+	Revoked bool       `json:"revoked,omitempty" xml:"revoked,omitempty"`
+}
+
+// tenant returns the tenant k acts for in a request naming asked, failing
+// with ErrTenantMismatch if k may not act for it.
+func (k APIKey) tenant(asked string) (string, error) {
+	switch {
+	case k.Tenant != "":
+	case k.allows(ScopeAdmin):
+		return asked, nil
+	default:
+		k.Tenant = DefaultTenant
+	}
+	if asked != "" && asked != k.Tenant {
+		return "", ErrTenantMismatch
+	}
+	return k.Tenant, nil
+}
+
+// allows reports whether k grants scope.
+func (k APIKey) allows(scope string) bool {
+	for _, s := range k.Scopes {
+		if scopeRanks[s] >= scopeRanks[scope] {
+			return true
+		}
+	}
+	return false
+}
+
+// APIKeys issues, verifies and revokes API keys, for machine clients that
+// don't warrant a full token issuer. Keys are held in memory, by the SHA-256
+// of their value. It's safe for concurrent use.
+type APIKeys struct {
+	clock Clock
+	rand  Rand
+
+	mtx    sync.RWMutex
+	byHash map[[sha256.Size]byte]*APIKey
+	byID   map[string]*APIKey
+}
+
+// NewAPIKeys returns an empty APIKeys.
+func NewAPIKeys(options ...Option) *APIKeys {
+	o := makeOptions(options)
+	return &APIKeys{
+		clock:  o.clock,
+		rand:   o.rand,
+		byHash: map[[sha256.Size]byte]*APIKey{},
+		byID:   map[string]*APIKey{},
+	}
+}
+
+// Issue creates a key with the given scopes, acting for tenant, valid for
+// ttl, or forever if ttl is zero. It returns the key's description, and the
+// key itself, which can't be retrieved later.
+func (k *APIKeys) Issue(name, tenant string, scopes []string, ttl time.Duration) (APIKey, string, error) {
+	b := make([]byte, 32)
+	if _, err := k.rand.Read(b); err != nil {
+		return APIKey{}, "", err
+	}
+	token := "csk_" + base64.RawURLEncoding.EncodeToString(b)
+	key := APIKey{Name: name, Scopes: scopes, Tenant: tenant}
+	if ttl > 0 {
+		expires := k.clock.Now().Add(ttl)
+		key.Expires = &expires
+	}
+	key, err := k.Add(token, key)
+	return key, token, err
+}
+
+// Add registers token as a key described by key, e.g. to bootstrap an admin
+// key from configuration. Its ID and creation time are assigned.
+func (k *APIKeys) Add(token string, key APIKey) (APIKey, error) {
+	if len(key.Scopes) == 0 {
+		return APIKey{}, ErrInvalidScope
+	}
+	for _, s := range key.Scopes {
+		if _, ok := scopeRanks[s]; !ok {
+			return APIKey{}, ErrInvalidScope
+		}
+	}
+	hash := sha256.Sum256([]byte(token))
+	key.ID = hex.EncodeToString(hash[:6])
+	key.Created = k.clock.Now()
+	key.Revoked = false
+
+	k.mtx.Lock()
+	defer k.mtx.Unlock()
+	if _, ok := k.byHash[hash]; ok {
+		return APIKey{}, ErrAlreadyExists
+	}
+	if _, ok := k.byID[key.ID]; ok {
+		return APIKey{}, ErrAlreadyExists // an ID collision; try again
+	}
+	stored := key
+	k.byHash[hash] = &stored
+	k.byID[key.ID] = &stored
+	return key, nil
+}
+
+// Revoke makes key id unusable. It stays listed, marked as revoked.
+func (k *APIKeys) Revoke(id string) error {
+	k.mtx.Lock()
+	defer k.mtx.Unlock()
+	key, ok := k.byID[id]
+	if !ok {
+		return ErrNotFound
+	}
+	key.Revoked = true
+	return nil
+}
+
+// List returns every key, oldest first.
+func (k *APIKeys) List() []APIKey {
+	k.mtx.RLock()
+	keys := make([]APIKey, 0, len(k.byID))
+	for _, key := range k.byID {
+		keys = append(keys, *key)
+	}
+	k.mtx.RUnlock()
+	sort.Slice(keys, func(i, j int) bool {
+		if !keys[i].Created.Equal(keys[j].Created) {
+			return keys[i].Created.Before(keys[j].Created)
+		}
+		return keys[i].ID < keys[j].ID
+	})
+	return keys
+}
+
+// Verify returns the key token stands for, failing with ErrUnauthenticated
+// if it's unknown, expired or revoked.
+func (k *APIKeys) Verify(token string) (APIKey, error) {
+	hash := sha256.Sum256([]byte(token))
+	k.mtx.RLock()
+	defer k.mtx.RUnlock()
+	key, ok := k.byHash[hash]
+	if !ok || key.Revoked || (key.Expires != nil && !k.clock.Now().Before(*key.Expires)) {
+		return APIKey{}, ErrUnauthenticated
+	}
+	return *key, nil
+}
+
+// lookup returns key id, if it's neither expired nor revoked.
+func (k *APIKeys) lookup(id string) (APIKey, bool) {
+	k.mtx.RLock()
+	defer k.mtx.RUnlock()
+	key, ok := k.byID[id]
+	if !ok || key.Revoked || (key.Expires != nil && !k.clock.Now().Before(*key.Expires)) {
+		return APIKey{}, false
+	}
+	return *key, true
+}
+
+type apiKeyKey struct{}
+
+// APIKeyFrom returns the API key the request carrying ctx was authorized by.
+func APIKeyFrom(ctx context.Context) (APIKey, bool) {
+	key, ok := ctx.Value(apiKeyKey{}).(APIKey)
+	return key, ok
+}
+
+// APIKeyMiddleware returns an endpoint middleware that requires a key from
+// keys with the scope each endpoint needs: read for reads, admin for
+// managing keys and the blocklist, and write for everything else. The
+// request's tenant is set to the key's, see APIKey.Tenant, so that no key
+// reaches another tenant's store by naming it. Requests authorized by a
+// signed URL or a portal token need no key: their tenant is set by those.
+func APIKeyMiddleware(keys *APIKeys) func(method string) endpoint.Middleware {
+	return func(method string) endpoint.Middleware {
+		scope, ok := methodScopes[method]
+		if !ok {
+			scope = ScopeWrite
+		}
+		return func(next endpoint.Endpoint) endpoint.Endpoint {
+			return func(ctx context.Context, request interface{}) (interface{}, error) {
+				if _, ok := PortalAccess(ctx); ok || SignedAccess(ctx) {
+					return next(ctx, request)
+				}
+				token := apiKeyFromMetadata(RequestMetadataFrom(ctx))
+				if token == "" {
+					return nil, ErrUnauthenticated
+				}
+				key, err := keys.Verify(token)
+				if err != nil {
+					return nil, err
+				}
+				if !key.allows(scope) {
+					return nil, ErrInsufficientScope
+				}
+				tenant, err := key.tenant(RequestMetadataFrom(ctx).Get(MetadataTenant))
+				if err != nil {
+					return nil, err
+				}
+				return next(context.WithValue(withTenant(ctx, tenant), apiKeyKey{}, key), request)
+			}
+		}
+	}
+}
+
+func apiKeyFromMetadata(md RequestMetadata) string {
+	if token := md.Get(APIKeyHeader); token != "" {
+		return token
+	}
+	auth := md.Get(MetadataAuthorization)
+	if len(auth) > 7 && strings.EqualFold(auth[:7], "bearer ") {
+		return strings.TrimSpace(auth[7:])
+	}
+	return ""
+}
+
+// ClientAPIKey is a client option sending token with every request.
+func ClientAPIKey(token string) httptransport.ClientOption {
+	return httptransport.ClientBefore(func(ctx context.Context, r *http.Request) context.Context {
+		r.Header.Set(APIKeyHeader, token)
+		return ctx
+	})
+}
+
+// WithAPIKeys requires an API key from keys on every endpoint, see
+// APIKeyMiddleware, and mounts endpoints managing them:
+//
+//	GET     /admin/apikeys       list keys, without their values
+//	POST    /admin/apikeys       issue a key: {"name": "...", "scopes": ["read"], "tenant": "acme", "ttl": "720h"}
+//	DELETE  /admin/apikeys/:id   revoke a key
+func WithAPIKeys(keys *APIKeys) HandlerOption {
+	return func(c *handlerConfig) { c.apiKeys = keys }
+}
+
+func mountAPIKeys(r *mux.Router, keys *APIKeys, wrap func(string, endpoint.Endpoint) endpoint.Endpoint, options []httptransport.ServerOption) {
+	r.Methods("GET").Path("/admin/apikeys").Handler(httptransport.NewServer(
+		wrap("ListAPIKeys", makeListAPIKeysEndpoint(keys)),
+		func(context.Context, *http.Request) (interface{}, error) { return nil, nil },
+		encodeResponse,
+		options...,
+	))
+	r.Methods("POST").Path("/admin/apikeys").Handler(httptransport.NewServer(
+		wrap("IssueAPIKey", makeIssueAPIKeyEndpoint(keys)),
+		decodeIssueAPIKeyRequest,
+		encodeResponse,
+		options...,
+	))
+	r.Methods("DELETE").Path("/admin/apikeys/{id}").Handler(httptransport.NewServer(
+		wrap("RevokeAPIKey", makeRevokeAPIKeyEndpoint(keys)),
+		decodeRevokeAPIKeyRequest,
+		encodeResponse,
+		options...,
+	))
+}
+
+func makeListAPIKeysEndpoint(keys *APIKeys) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		return listAPIKeysResponse{Keys: keys.List()}, nil
+	}
+}
+
+func makeIssueAPIKeyEndpoint(keys *APIKeys) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(issueAPIKeyRequest)
+		key, token, e := keys.Issue(req.Name, req.Tenant, req.Scopes, req.TTL)
+		return issueAPIKeyResponse{Key: key, Token: token, Err: e}, nil
+	}
+}
+
+func makeRevokeAPIKeyEndpoint(keys *APIKeys) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		return revokeAPIKeyResponse{Err: keys.Revoke(request.(revokeAPIKeyRequest).ID)}, nil
+	}
+}
+
+type listAPIKeysResponse struct {
+	Keys []APIKey `json:"keys" xml:"keys>key"`
+}
+
+type issueAPIKeyRequest struct {
+	Name   string
+	Tenant string
+	Scopes []string
+	TTL    time.Duration
+}
+
+type issueAPIKeyResponse struct {
+	Key   APIKey `json:"key,omitempty" xml:"key,omitempty"`
+	Token string `json:"token,omitempty" xml:"token,omitempty"` // only ever sent here
+	Err   error  `json:"err,omitempty" xml:"-"`
+}
+
+func (r issueAPIKeyResponse) error() error { return r.Err }
+
+type revokeAPIKeyRequest struct {
+	ID string
+}
+
+type revokeAPIKeyResponse struct {
+	Err error `json:"err,omitempty" xml:"-"`
+}
+
+func (r revokeAPIKeyResponse) error() error { return r.Err }
+
+func decodeIssueAPIKeyRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	var body struct {
+		Name   string   `json:"name" xml:"name"`
+		Scopes []string `json:"scopes" xml:"scopes>scope"`
+		Tenant string   `json:"tenant" xml:"tenant"`
+		TTL    string   `json:"ttl" xml:"ttl"`
+	}
+	if err := decodeBody(r, &body); err != nil {
+		return nil, err
+	}
+	req := issueAPIKeyRequest{Name: body.Name, Tenant: body.Tenant, Scopes: body.Scopes}
+	if body.TTL != "" {
+		if req.TTL, err = time.ParseDuration(body.TTL); err != nil || req.TTL <= 0 {
+			return nil, ErrInvalidTTL
+		}
+	}
+	return req, nil
+}
+
+func decodeRevokeAPIKeyRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	vars := mux.Vars(r)
+	id, ok := vars["id"]
+	if !ok {
+		return nil, ErrBadRouting
+	}
+	return revokeAPIKeyRequest{ID: id}, nil
+}
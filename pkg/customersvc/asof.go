@@ -0,0 +1,78 @@
+package customersvc
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"time"
+)
+
+var (
+	// ErrInvalidAsOf is returned for an as_of parameter that isn't an RFC
+	// 3339 time.
+	ErrInvalidAsOf = errors.New("as_of must be an RFC 3339 time")
+	// ErrHistoryTruncated is returned by GetCustomerAsOf for a time earlier
+	// than the oldest revision still kept of the customer.
+	ErrHistoryTruncated = errors.New("as_of is earlier than the retained history of the customer")
+)
+
+// maxRevisions is the number of revisions the inmem store keeps of each
+// customer for GetCustomerAsOf. Older ones are dropped.
+const maxRevisions = 100
+
+// revision is the state of a customer from a point in time until the next
+// revision. A deleted revision marks the customer's deletion.
+type revision struct {
+	at       time.Time
+	customer Customer
+	deleted  bool
+}
+
+// revisions are the kept revisions of a customer, oldest first.
+type revisions struct {
+	list      []revision
+	truncated bool // older revisions were dropped
+}
+
+// snapshot keeps the current state of customer id, or its deletion, as a
+// revision made at the given time. The caller must hold the write lock.
+func (s *inmemService) snapshot(id string, at time.Time) {
+	p, exists := s.customers[id]
+	r, ok := s.revisions[id]
+	if !ok {
+		r = &revisions{}
+		s.revisions[id] = r
+	}
+	r.list = append(r.list, revision{at: at, customer: p, deleted: !exists})
+	if len(r.list) > maxRevisions {
+		r.list = append(r.list[:0], r.list[len(r.list)-maxRevisions:]...)
+		r.truncated = true
+	}
+}
+
+// GetCustomerAsOf returns customer id as it was at t, for dispute
+// resolution. It fails with ErrNotFound if the customer didn't exist at t,
+// including when it had been deleted by then, and ErrHistoryTruncated if t
+// is earlier than the revisions kept.
+func (s *inmemService) GetCustomerAsOf(ctx context.Context, id string, t time.Time) (Customer, error) {
+	if err := s.rlock(ctx); err != nil {
+		return Customer{}, err
+	}
+	defer s.mtx.RUnlock()
+	r, ok := s.revisions[id]
+	if !ok {
+		return Customer{}, ErrNotFound
+	}
+	// The first revision after t; the one before it was current at t.
+	i := sort.Search(len(r.list), func(i int) bool { return r.list[i].at.After(t) })
+	if i == 0 {
+		if r.truncated {
+			return Customer{}, ErrHistoryTruncated
+		}
+		return Customer{}, ErrNotFound
+	}
+	if r.list[i-1].deleted {
+		return Customer{}, ErrNotFound
+	}
+	return r.list[i-1].customer, nil
+}
@@ -0,0 +1,98 @@
+package customersvc
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	httptransport "github.com/go-kit/kit/transport/http"
+)
+
+// Headers carrying backoff hints on 429 and 503 responses. Retry-After and
+// X-RateLimit-Reset are in seconds from now.
+const (
+	RetryAfterHeader         = "Retry-After"
+	RateLimitLimitHeader     = "X-RateLimit-Limit"
+	RateLimitRemainingHeader = "X-RateLimit-Remaining"
+	RateLimitResetHeader     = "X-RateLimit-Reset"
+)
+
+// BackoffError is returned by client endpoints when the server turned a call
+// away as rate limited (ErrRateLimited) or overloaded (ErrOverloaded), with
+// the hints it gave on when to try again.
+type BackoffError struct {
+	// Err is ErrRateLimited or ErrOverloaded.
+	Err error
+	// RetryAfter is how long the server asked callers to wait, or zero if it
+	// didn't say.
+	RetryAfter time.Duration
+	// Remaining is the number of calls left in the current window, or -1 if
+	// the server didn't say.
+	Remaining int
+	// Reset is how long until the window is replenished, or zero if the
+	// server didn't say.
+	Reset time.Duration
+}
+
+func (e *BackoffError) Error() string {
+	if e.RetryAfter > 0 {
+		return fmt.Sprintf("%v (retry after %v)", e.Err, e.RetryAfter)
+	}
+	return e.Err.Error()
+}
+
+func (e *BackoffError) Unwrap() error { return e.Err }
+
+// Wait is how long to wait before the next call: RetryAfter, or Reset when
+// no calls remain and the server gave no RetryAfter.
+func (e *BackoffError) Wait() time.Duration {
+	if e.RetryAfter == 0 && e.Remaining == 0 {
+		return e.Reset
+	}
+	return e.RetryAfter
+}
+
+// decodeBackoff wraps a client response decoder, turning 429 and 503
+// responses into a *BackoffError instead of an empty response.
+func decodeBackoff(dec httptransport.DecodeResponseFunc) httptransport.DecodeResponseFunc {
+	return func(ctx context.Context, resp *http.Response) (interface{}, error) {
+		var err error
+		switch resp.StatusCode {
+		case http.StatusTooManyRequests:
+			err = ErrRateLimited
+		case http.StatusServiceUnavailable:
+			err = ErrOverloaded
+		default:
+			return dec(ctx, resp)
+		}
+		be := &BackoffError{Err: err, Remaining: -1}
+		be.RetryAfter = parseRetryAfter(resp.Header.Get(RetryAfterHeader), time.Now())
+		if n, err := strconv.Atoi(resp.Header.Get(RateLimitRemainingHeader)); err == nil && n >= 0 {
+			be.Remaining = n
+		}
+		if n, err := strconv.Atoi(resp.Header.Get(RateLimitResetHeader)); err == nil && n > 0 {
+			be.Reset = time.Duration(n) * time.Second
+		}
+		return nil, be
+	}
+}
+
+// parseRetryAfter reads a Retry-After value, which is either a number of
+// seconds or an HTTP date. It returns zero if v is neither, or in the past.
+func parseRetryAfter(v string, now time.Time) time.Duration {
+	if v == "" {
+		return 0
+	}
+	if n, err := strconv.Atoi(v); err == nil {
+		if n < 0 {
+			return 0
+		}
+		return time.Duration(n) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil && t.After(now) {
+		return t.Sub(now)
+	}
+	return 0
+}
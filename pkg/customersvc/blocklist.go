@@ -0,0 +1,301 @@
+package customersvc
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/endpoint"
+	httptransport "github.com/go-kit/kit/transport/http"
+	"github.com/gorilla/mux"
+)
+
+// ErrBlocked is returned when a customer's email or phone is on the
+// blocklist. It deliberately doesn't say which entry matched.
+var ErrBlocked = errors.New("customer rejected by policy")
+
+// ErrInvalidBlockEntry is returned when adding an entry of unknown kind, or
+// without a value.
+var ErrInvalidBlockEntry = errors.New("block entry needs a kind of email, email-domain or phone-prefix, and a value")
+
+// Kinds of blocklist entries.
+const (
+	// BlockEmail blocks one email address, case-insensitively.
+	BlockEmail = "email"
+	// BlockEmailDomain blocks every email address at a domain or any of its
+	// subdomains.
+	BlockEmailDomain = "email-domain"
+	// BlockPhonePrefix blocks phone numbers starting with a prefix, ignoring
+	// spaces and punctuation, e.g. "+1 900".
+	BlockPhonePrefix = "phone-prefix"
+)
+
+// BlockEntry is one entry of a Blocklist.
+type BlockEntry struct {
+	Kind   string    `json:"kind" xml:"kind"`
+	Value  string    `json:"value" xml:"value"`
+	Reason string    `json:"reason,omitempty" xml:"reason,omitempty"`
+	Added  time.Time `json:"added" xml:"added"`
+}
+
+// Blocklist holds email addresses, email domains and phone prefixes that
+// may not be used to create or replace customers, for fraud and abuse
+// prevention. It's safe for concurrent use.
+type Blocklist struct {
+	clock Clock
+
+	mtx     sync.RWMutex
+	entries map[blockKey]BlockEntry
+}
+
+type blockKey struct{ kind, value string }
+
+// NewBlocklist returns a Blocklist holding entries.
+func NewBlocklist(entries []BlockEntry, options ...Option) (*Blocklist, error) {
+	b := &Blocklist{clock: makeOptions(options).clock, entries: map[blockKey]BlockEntry{}}
+	for _, e := range entries {
+		if _, err := b.Add(e); err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+// Add adds e, or replaces the entry of the same kind and value. Values are
+// normalized, and Added is set if zero. It returns the entry as stored.
+func (b *Blocklist) Add(e BlockEntry) (BlockEntry, error) {
+	value, ok := normalizeBlockValue(e.Kind, e.Value)
+	if !ok {
+		return BlockEntry{}, ErrInvalidBlockEntry
+	}
+	e.Value = value
+	if e.Added.IsZero() {
+		e.Added = b.clock.Now()
+	}
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	b.entries[blockKey{e.Kind, e.Value}] = e
+	return e, nil
+}
+
+// Remove removes the entry of the given kind and value. It fails with
+// ErrNotFound if there's no such entry.
+func (b *Blocklist) Remove(kind, value string) error {
+	value, ok := normalizeBlockValue(kind, value)
+	if !ok {
+		return ErrInvalidBlockEntry
+	}
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	if _, ok := b.entries[blockKey{kind, value}]; !ok {
+		return ErrNotFound
+	}
+	delete(b.entries, blockKey{kind, value})
+	return nil
+}
+
+// Entries returns every entry, ordered by kind and value.
+func (b *Blocklist) Entries() []BlockEntry {
+	b.mtx.RLock()
+	entries := make([]BlockEntry, 0, len(b.entries))
+	for _, e := range b.entries {
+		entries = append(entries, e)
+	}
+	b.mtx.RUnlock()
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Kind != entries[j].Kind {
+			return entries[i].Kind < entries[j].Kind
+		}
+		return entries[i].Value < entries[j].Value
+	})
+	return entries
+}
+
+// Match returns the entry blocking p, if any.
+func (b *Blocklist) Match(p Customer) (BlockEntry, bool) {
+	b.mtx.RLock()
+	defer b.mtx.RUnlock()
+	if email, ok := normalizeBlockValue(BlockEmail, p.Email); ok {
+		if e, ok := b.entries[blockKey{BlockEmail, email}]; ok {
+			return e, true
+		}
+		// Try the domain, then each parent domain: a.b.example.com,
+		// b.example.com, example.com, com.
+		for domain := email[strings.LastIndexByte(email, '@')+1:]; domain != ""; {
+			if e, ok := b.entries[blockKey{BlockEmailDomain, domain}]; ok {
+				return e, true
+			}
+			i := strings.IndexByte(domain, '.')
+			if i < 0 {
+				break
+			}
+			domain = domain[i+1:]
+		}
+	}
+	if phone, ok := normalizeBlockValue(BlockPhonePrefix, p.Phone); ok {
+		for prefix := phone; prefix != ""; prefix = prefix[:len(prefix)-1] {
+			if e, ok := b.entries[blockKey{BlockPhonePrefix, prefix}]; ok {
+				return e, true
+			}
+		}
+	}
+	return BlockEntry{}, false
+}
+
+// normalizeBlockValue returns the canonical form of a value of the given
+// kind, and false if it's empty or the kind is unknown.
+func normalizeBlockValue(kind, value string) (string, bool) {
+	switch kind {
+	case BlockEmail:
+		value = strings.ToLower(strings.TrimSpace(value))
+		if strings.IndexByte(value, '@') < 0 {
+			return "", false
+		}
+	case BlockEmailDomain:
+		value = strings.Trim(strings.ToLower(strings.TrimSpace(value)), "@.")
+	case BlockPhonePrefix:
+		value = strings.Map(func(r rune) rune {
+			if r >= '0' && r <= '9' || r == '+' {
+				return r
+			}
+			return -1
+		}, value)
+	default:
+		return "", false
+	}
+	return value, value != ""
+}
+
+// BlocklistMiddleware rejects PostCustomer, PutCustomer and PrepareCustomer
+// with ErrBlocked when the customer matches an entry of b.
+func BlocklistMiddleware(b *Blocklist) Middleware {
+	return func(next Service) Service {
+		return &blocklistMiddleware{Service: next, blocklist: b}
+	}
+}
+
+type blocklistMiddleware struct {
+	Service
+	blocklist *Blocklist
+}
+
+func (mw *blocklistMiddleware) PostCustomer(ctx context.Context, p Customer) error {
+	if _, blocked := mw.blocklist.Match(p); blocked {
+		return ErrBlocked
+	}
+	return mw.Service.PostCustomer(ctx, p)
+}
+
+func (mw *blocklistMiddleware) PutCustomer(ctx context.Context, id string, p Customer) error {
+	if _, blocked := mw.blocklist.Match(p); blocked {
+		return ErrBlocked
+	}
+	return mw.Service.PutCustomer(ctx, id, p)
+}
+
+func (mw *blocklistMiddleware) PrepareCustomer(ctx context.Context, p Customer, ttl time.Duration) (PendingCustomer, error) {
+	if _, blocked := mw.blocklist.Match(p); blocked {
+		return PendingCustomer{}, ErrBlocked
+	}
+	return mw.Service.PrepareCustomer(ctx, p, ttl)
+}
+
+// WithBlocklist mounts endpoints managing b:
+//
+//	GET     /blocklist/              list every entry
+//	POST    /blocklist/              add an entry: {"kind": "email-domain", "value": "example.com", "reason": "..."}
+//	DELETE  /blocklist/:kind/:value  remove an entry
+//
+// These aren't authenticated by customersvc, so they should only be
+// reachable by operators. Rejecting customers is up to BlocklistMiddleware.
+func WithBlocklist(b *Blocklist) HandlerOption {
+	return func(c *handlerConfig) { c.blocklist = b }
+}
+
+func mountBlocklist(r *mux.Router, b *Blocklist, wrap func(string, endpoint.Endpoint) endpoint.Endpoint, options []httptransport.ServerOption) {
+	r.Methods("GET").Path("/blocklist/").Handler(httptransport.NewServer(
+		wrap("GetBlocklist", makeGetBlocklistEndpoint(b)),
+		func(context.Context, *http.Request) (interface{}, error) { return nil, nil },
+		encodeResponse,
+		options...,
+	))
+	r.Methods("POST").Path("/blocklist/").Handler(httptransport.NewServer(
+		wrap("AddBlockEntry", makeAddBlockEntryEndpoint(b)),
+		decodeAddBlockEntryRequest,
+		encodeResponse,
+		options...,
+	))
+	r.Methods("DELETE").Path("/blocklist/{kind}/{value}").Handler(httptransport.NewServer(
+		wrap("RemoveBlockEntry", makeRemoveBlockEntryEndpoint(b)),
+		decodeRemoveBlockEntryRequest,
+		encodeResponse,
+		options...,
+	))
+}
+
+func makeGetBlocklistEndpoint(b *Blocklist) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		return getBlocklistResponse{Entries: b.Entries()}, nil
+	}
+}
+
+func makeAddBlockEntryEndpoint(b *Blocklist) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		e, err := b.Add(request.(BlockEntry))
+		return addBlockEntryResponse{Entry: e, Err: err}, nil
+	}
+}
+
+func makeRemoveBlockEntryEndpoint(b *Blocklist) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(removeBlockEntryRequest)
+		return removeBlockEntryResponse{Err: b.Remove(req.Kind, req.Value)}, nil
+	}
+}
+
+type getBlocklistResponse struct {
+	Entries []BlockEntry `json:"entries" xml:"entries>entry"`
+}
+
+type addBlockEntryResponse struct {
+	Entry BlockEntry `json:"entry,omitempty" xml:"entry,omitempty"`
+	Err   error      `json:"err,omitempty" xml:"-"`
+}
+
+func (r addBlockEntryResponse) error() error { return r.Err }
+
+type removeBlockEntryRequest struct {
+	Kind, Value string
+}
+
+type removeBlockEntryResponse struct {
+	Err error `json:"err,omitempty" xml:"-"`
+}
+
+func (r removeBlockEntryResponse) error() error { return r.Err }
+
+func decodeAddBlockEntryRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	var e BlockEntry
+	if err := decodeBody(r, &e); err != nil {
+		return nil, err
+	}
+	e.Added = time.Time{} // set by the server
+	return e, nil
+}
+
+func decodeRemoveBlockEntryRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	vars := mux.Vars(r)
+	kind, ok := vars["kind"]
+	if !ok {
+		return nil, ErrBadRouting
+	}
+	value, ok := vars["value"]
+	if !ok {
+		return nil, ErrBadRouting
+	}
+	return removeBlockEntryRequest{Kind: kind, Value: value}, nil
+}
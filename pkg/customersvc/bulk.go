@@ -0,0 +1,190 @@
+package customersvc
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"sort"
+	"sync"
+
+	"golang.org/x/time/rate"
+)
+
+// BulkOptions tunes bulk operations such as Import and Backfill.
+type BulkOptions struct {
+	// Workers is the number of items processed concurrently. Default 1.
+	Workers int
+	// RatePerWorker caps the items each worker processes per second, to
+	// spare the destination. Zero means no cap.
+	RatePerWorker float64
+	// Ordered makes items for the same customer take effect in the order
+	// given, by handing them all to the same worker. Items for different
+	// customers are still processed concurrently. Without it, a later row
+	// for a customer may overtake an earlier one.
+	Ordered bool
+	// MaxFailures is the number of failures detailed in the report. More
+	// are counted but not detailed. Default 100.
+	MaxFailures int
+}
+
+// BulkReport accounts for a bulk operation that may have partially failed.
+// Failed items don't stop the operation; cancelling its context does.
+type BulkReport struct {
+	Succeeded int           `json:"succeeded"`
+	Failed    int           `json:"failed"`
+	Failures  []BulkFailure `json:"failures,omitempty"`
+}
+
+// BulkFailure details one failed item. Index is its position in the input,
+// counting from 0.
+type BulkFailure struct {
+	Index int    `json:"index"`
+	ID    string `json:"id"`
+	Error string `json:"error"`
+}
+
+func (o BulkOptions) withDefaults() BulkOptions {
+	if o.Workers < 1 {
+		o.Workers = 1
+	}
+	if o.MaxFailures <= 0 {
+		o.MaxFailures = 100
+	}
+	return o
+}
+
+// fail counts a failure, detailing it if there's room left.
+func (r *BulkReport) fail(f BulkFailure, max int) {
+	r.Failed++
+	if len(r.Failures) < max {
+		r.Failures = append(r.Failures, f)
+	}
+}
+
+type bulkItem struct {
+	index int
+	id    string
+	apply func(ctx context.Context) error
+}
+
+// runBulk applies every item received from items with a pool of workers,
+// until items is closed or ctx is done.
+func runBulk(ctx context.Context, opts BulkOptions, items <-chan bulkItem) BulkReport {
+	var (
+		mtx    sync.Mutex
+		report BulkReport
+		wg     sync.WaitGroup
+	)
+	queues := make([]chan bulkItem, opts.Workers)
+	for i := range queues {
+		queues[i] = make(chan bulkItem, 16)
+		limit := rate.Inf
+		if opts.RatePerWorker > 0 {
+			limit = rate.Limit(opts.RatePerWorker)
+		}
+		limiter := rate.NewLimiter(limit, 1)
+		wg.Add(1)
+		go func(queue <-chan bulkItem) {
+			defer wg.Done()
+			for item := range queue {
+				if limiter.Wait(ctx) != nil {
+					continue // cancelled: drain without applying
+				}
+				err := item.apply(ctx)
+				mtx.Lock()
+				if err == nil {
+					report.Succeeded++
+				} else {
+					report.fail(BulkFailure{Index: item.index, ID: item.id, Error: err.Error()}, opts.MaxFailures)
+				}
+				mtx.Unlock()
+			}
+		}(queues[i])
+	}
+
+	next := 0
+dispatch:
+	for {
+		select {
+		case item, ok := <-items:
+			if !ok {
+				break dispatch
+			}
+			worker := next % len(queues)
+			if opts.Ordered {
+				h := fnv.New32a()
+				h.Write([]byte(item.id))
+				worker = int(h.Sum32() % uint32(len(queues)))
+			}
+			next++
+			select {
+			case queues[worker] <- item:
+			case <-ctx.Done():
+				break dispatch
+			}
+		case <-ctx.Done():
+			break dispatch
+		}
+	}
+	for _, queue := range queues {
+		close(queue)
+	}
+	wg.Wait()
+	return report
+}
+
+// Import reads customers from r, one JSON object per line, and PUTs each
+// into dst, so that re-running an import is safe. Malformed lines and
+// rejected customers are reported as failures without stopping the import.
+// The returned error is only non-nil if reading r failed or ctx was done.
+func Import(ctx context.Context, r io.Reader, dst Service, opts BulkOptions, logger Logger) (BulkReport, error) {
+	opts = opts.withDefaults()
+	readCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		items     = make(chan bulkItem)
+		done      = make(chan struct{})
+		readErr   error
+		malformed BulkReport
+	)
+	go func() {
+		defer close(done)
+		defer close(items)
+		scanner := bufio.NewScanner(r)
+		scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+		for index := 0; scanner.Scan(); index++ {
+			var p Customer
+			if err := json.Unmarshal(scanner.Bytes(), &p); err != nil {
+				malformed.fail(BulkFailure{Index: index, Error: fmt.Sprintf("line %d: %v", index+1, err)}, opts.MaxFailures)
+				continue
+			}
+			item := bulkItem{index: index, id: p.ID, apply: func(ctx context.Context) error {
+				return dst.PutCustomer(ctx, p.ID, p)
+			}}
+			select {
+			case items <- item:
+			case <-readCtx.Done():
+				return
+			}
+		}
+		readErr = scanner.Err()
+	}()
+
+	report := runBulk(ctx, opts, items)
+	cancel()
+	<-done
+	for _, f := range malformed.Failures {
+		report.fail(f, opts.MaxFailures)
+	}
+	report.Failed += malformed.Failed - len(malformed.Failures)
+	sort.Slice(report.Failures, func(i, j int) bool { return report.Failures[i].Index < report.Failures[j].Index })
+	logger.Log("import", "done", "succeeded", report.Succeeded, "failed", report.Failed)
+	if readErr != nil {
+		return report, readErr
+	}
+	return report, ctx.Err()
+}
@@ -0,0 +1,217 @@
+package customersvc
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"net/http"
+	"reflect"
+	"strings"
+
+	"github.com/go-kit/kit/endpoint"
+)
+
+// ErrInvalidBulkPatch is returned for a bulk patch that selects customers by
+// nothing but whether they're archived, which would patch them all, or that
+// changes nothing.
+var ErrInvalidBulkPatch = errors.New("bulk patch needs a filter by email_domain, metadata or ids, and a patch without an id")
+
+// bulkPatchPage is the number of customers read per query when selecting
+// those to patch.
+const bulkPatchPage = 500
+
+// BulkPatchFilter selects the customers a bulk patch applies to: those
+// matching every criterion given.
+type BulkPatchFilter struct {
+	// Archived says what to do with archived customers, as in
+	// CustomerFilter. Empty means ArchivedExclude.
+	Archived string `json:"archived,omitempty" xml:"archived,omitempty"`
+	// EmailDomain selects customers with an email address at the domain
+	// or any of its subdomains, compared case-insensitively.
+	EmailDomain string `json:"email_domain,omitempty" xml:"email_domain,omitempty"`
+	// Metadata selects customers with each of its keys set to its value.
+	Metadata Metadata `json:"metadata,omitempty" xml:"metadata,omitempty"`
+	// IDs selects customers by ID.
+	IDs []string `json:"ids,omitempty" xml:"ids>id,omitempty"`
+}
+
+func (f BulkPatchFilter) valid() bool {
+	return f.EmailDomain != "" || len(f.Metadata) > 0 || len(f.IDs) > 0
+}
+
+func (f BulkPatchFilter) matches(p Customer) bool {
+	if !(CustomerFilter{Archived: f.Archived}).matches(p) {
+		return false
+	}
+	if f.EmailDomain != "" {
+		domain := strings.ToLower(strings.TrimPrefix(f.EmailDomain, "@"))
+		email := strings.ToLower(p.Email)
+		at := email[strings.LastIndexByte(email, '@')+1:]
+		if at != domain && !strings.HasSuffix(at, "."+domain) {
+			return false
+		}
+	}
+	for k, v := range f.Metadata {
+		if got, ok := p.Metadata[k]; !ok || got != v {
+			return false
+		}
+	}
+	if len(f.IDs) > 0 {
+		var listed bool
+		for _, id := range f.IDs {
+			if id == p.ID {
+				listed = true
+				break
+			}
+		}
+		if !listed {
+			return false
+		}
+	}
+	return true
+}
+
+// MatchBulkPatch returns the IDs of the customers in s that f selects, in ID
+// order.
+func MatchBulkPatch(ctx context.Context, s Service, f BulkPatchFilter) ([]string, error) {
+	if !f.valid() {
+		return nil, ErrInvalidBulkPatch
+	}
+	q := CustomerQuery{Filter: CustomerFilter{Archived: f.Archived}, Page: PageRequest{Limit: bulkPatchPage}}
+	var ids []string
+	for {
+		page, err := QueryCustomers(ctx, s, q)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range page.Items {
+			if f.matches(p) {
+				ids = append(ids, p.ID)
+			}
+		}
+		if page.NextCursor == "" {
+			return ids, nil
+		}
+		q.Page.Cursor = page.NextCursor
+	}
+}
+
+// BulkPatch selects the customers in s matching f and starts a job in jobs
+// patching each of them with patch, as PatchCustomer would one: only the
+// fields set in patch change, and its metadata is merged, so that e.g.
+// {"metadata": {"status": "suspended"}} suspends every customer selected.
+// Customers are selected when the job starts; each one's result is recorded
+// in the job, and a failed patch doesn't stop the others.
+func BulkPatch(ctx context.Context, s Service, jobs *Jobs, f BulkPatchFilter, patch Customer, opts BulkOptions) (Job, error) {
+	if !validBulkPatch(patch) {
+		return Job{}, ErrInvalidBulkPatch
+	}
+	ids, err := MatchBulkPatch(ctx, s, f)
+	if err != nil {
+		return Job{}, err
+	}
+	opts = opts.withDefaults()
+	return jobs.start(ctx, "bulk-patch", len(ids), func(ctx context.Context, record func(string, error)) error {
+		items := make(chan bulkItem)
+		go func() {
+			defer close(items)
+			for i, id := range ids {
+				id := id
+				items <- bulkItem{index: i, id: id, apply: func(ctx context.Context) error {
+					err := s.PatchCustomer(ctx, id, patch)
+					record(id, err)
+					return err
+				}}
+			}
+		}()
+		runBulk(ctx, opts, items)
+		return nil
+	})
+}
+
+// validBulkPatch reports whether patch changes something, and not the ID,
+// which every customer selected can't take.
+func validBulkPatch(patch Customer) bool {
+	return patch.ID == "" && !reflect.DeepEqual(patch, Customer{})
+}
+
+func makeBulkPatchEndpoint(s Service, jobs *Jobs) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(bulkPatchRequest)
+		if req.DryRun {
+			if !validBulkPatch(req.Patch) {
+				return bulkPatchResponse{Err: ErrInvalidBulkPatch}, nil
+			}
+			ids, e := MatchBulkPatch(ctx, s, req.Filter)
+			if e != nil {
+				return bulkPatchResponse{Err: e}, nil
+			}
+			n := len(ids)
+			return bulkPatchResponse{Matched: &n}, nil
+		}
+		job, e := BulkPatch(ctx, s, jobs, req.Filter, req.Patch, BulkOptions{})
+		if e != nil {
+			return bulkPatchResponse{Err: e}, nil
+		}
+		return bulkPatchResponse{Job: &job}, nil
+	}
+}
+
+type bulkPatchRequest struct {
+	Filter BulkPatchFilter
+	Patch  Customer
+	DryRun bool
+}
+
+type bulkPatchResponse struct {
+	// Matched is the number of customers a dry run would patch.
+	Matched *int  `json:"matched,omitempty" xml:"matched,omitempty"`
+	Job     *Job  `json:"job,omitempty" xml:"job,omitempty"`
+	Err     error `json:"err,omitempty" xml:"-"`
+}
+
+func (r bulkPatchResponse) error() error { return r.Err }
+
+// decodeBulkPatchRequest decodes {"filter": {...}, "patch": {...},
+// "dry_run": true}, the patch being a customer in the wire format the
+// request asks for.
+func decodeBulkPatchRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	if isXML(r.Header.Get("Content-Type")) {
+		var body struct {
+			Filter BulkPatchFilter `xml:"filter"`
+			Patch  Customer        `xml:"patch"`
+			DryRun bool            `xml:"dry_run"`
+		}
+		if err := xml.NewDecoder(r.Body).Decode(&body); err != nil {
+			return nil, err
+		}
+		return bulkPatchRequest{Filter: body.Filter, Patch: body.Patch, DryRun: body.DryRun}, nil
+	}
+	var body struct {
+		Filter BulkPatchFilter `json:"filter"`
+		Patch  json.RawMessage `json:"patch"`
+		DryRun bool            `json:"dry_run"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		return nil, err
+	}
+	req := bulkPatchRequest{Filter: body.Filter, DryRun: body.DryRun}
+	if len(body.Patch) == 0 {
+		return req, nil
+	}
+	if requestsV2(r) {
+		var v2 CustomerV2
+		if err := json.Unmarshal(body.Patch, &v2); err != nil {
+			return nil, err
+		}
+		req.Patch = v2.Customer()
+	} else {
+		var v1 CustomerV1
+		if err := json.Unmarshal(body.Patch, &v1); err != nil {
+			return nil, err
+		}
+		req.Patch = v1.Customer()
+	}
+	return req, nil
+}
@@ -0,0 +1,356 @@
+package customersvc
+
+import (
+	"bufio"
+	"container/list"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/metrics"
+)
+
+// CacheOptions configures a CustomerCache.
+type CacheOptions struct {
+	// Size is the number of customers kept, the least recently read being
+	// evicted first.
+	Size int
+	// TTL is how long a customer is served from the cache before it's
+	// fetched again, which bounds how stale a customer changed other than
+	// through the cache, e.g. by another instance sharing the store, may
+	// be. Zero is until evicted or changed.
+	TTL time.Duration
+}
+
+// CustomerCache keeps the customers most recently read with GetCustomer in
+// memory, in front of a store that's slow to read from, such as one on
+// another server. Writes through it drop the customers they change, so that
+// a read never returns one older than the last write through it.
+//
+// Customers are cached by tenant, see TenantFrom, as well as ID, so that
+// tenants whose stores are apart, see RoutingService, may use the same IDs.
+//
+// So that an instance doesn't start with an empty cache, and every read
+// after a deploy hit the store, the IDs of the customers most recently read
+// can be saved with SaveHotKeys and loaded again at startup with Preload.
+type CustomerCache struct {
+	opts    CacheOptions
+	lookups metrics.Counter
+	clock   Clock
+	next    Service
+	onHit   func(id string) // if set, told of each customer read from the cache
+
+	mtx   sync.Mutex
+	byKey map[cacheKey]*list.Element
+	order *list.List // of *cachedCustomer, most recently read first
+	gen   uint64     // incremented by every write, so fetches overtaken by one aren't kept
+}
+
+// cacheKey identifies a cached customer. Tenants never share.
+type cacheKey struct {
+	tenant, id string
+}
+
+func cacheKeyFrom(ctx context.Context, id string) cacheKey {
+	return cacheKey{TenantFrom(ctx), id}
+}
+
+type cachedCustomer struct {
+	key      cacheKey
+	customer Customer
+	fetched  time.Time
+}
+
+// NewCustomerCache returns an empty cache, counting GetCustomer calls in
+// lookups, labeled by their result, hit or miss. Mount it with its
+// Middleware.
+func NewCustomerCache(opts CacheOptions, lookups metrics.Counter, options ...Option) *CustomerCache {
+	o := makeOptions(options)
+	if opts.Size <= 0 {
+		opts.Size = 1
+	}
+	return &CustomerCache{
+		opts:    opts,
+		lookups: lookups,
+		clock:   o.clock,
+		byKey:   map[cacheKey]*list.Element{},
+		order:   list.New(),
+	}
+}
+
+// Middleware returns the Middleware serving GetCustomer from the cache. It
+// must be mounted only once.
+func (c *CustomerCache) Middleware() Middleware {
+	return func(next Service) Service {
+		c.next = next
+		return &cachingMiddleware{Service: next, c: c}
+	}
+}
+
+// get returns the customer under k if it's cached and fresh.
+func (c *CustomerCache) get(k cacheKey) (Customer, bool) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	e, ok := c.byKey[k]
+	if !ok {
+		return Customer{}, false
+	}
+	cc := e.Value.(*cachedCustomer)
+	if c.opts.TTL > 0 && c.clock.Now().Sub(cc.fetched) >= c.opts.TTL {
+		delete(c.byKey, k)
+		c.order.Remove(e)
+		return Customer{}, false
+	}
+	c.order.MoveToFront(e)
+	return cc.customer, true
+}
+
+// fetch reads customer id of the tenant of ctx from the store, keeping it
+// unless a write went through meanwhile, which may have changed it.
+func (c *CustomerCache) fetch(ctx context.Context, id string) (Customer, error) {
+	k := cacheKeyFrom(ctx, id)
+	c.mtx.Lock()
+	gen := c.gen
+	c.mtx.Unlock()
+	p, err := c.next.GetCustomer(ctx, id)
+	if err != nil {
+		return p, err
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.gen != gen {
+		return p, nil
+	}
+	cc := &cachedCustomer{key: k, customer: p, fetched: c.clock.Now()}
+	if e, ok := c.byKey[k]; ok {
+		e.Value = cc
+		c.order.MoveToFront(e)
+		return p, nil
+	}
+	c.byKey[k] = c.order.PushFront(cc)
+	for c.order.Len() > c.opts.Size {
+		e := c.order.Back()
+		delete(c.byKey, e.Value.(*cachedCustomer).key)
+		c.order.Remove(e)
+	}
+	return p, nil
+}
+
+// invalidate drops customer id of the tenant of ctx.
+func (c *CustomerCache) invalidate(ctx context.Context, id string) {
+	k := cacheKeyFrom(ctx, id)
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.gen++
+	if e, ok := c.byKey[k]; ok {
+		delete(c.byKey, k)
+		c.order.Remove(e)
+	}
+}
+
+// purge drops every customer, after writes that may change any.
+func (c *CustomerCache) purge() {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.gen++
+	c.byKey = map[cacheKey]*list.Element{}
+	c.order.Init()
+}
+
+// HotKeys returns the IDs of up to n of the customers in the cache, most
+// recently read first. Those of tenants other than DefaultTenant are
+// prefixed with their tenant and a tab.
+func (c *CustomerCache) HotKeys(n int) []string {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	var ids []string
+	for e := c.order.Front(); e != nil && len(ids) < n; e = e.Next() {
+		k := e.Value.(*cachedCustomer).key
+		if k.tenant != DefaultTenant {
+			ids = append(ids, k.tenant+"\t"+k.id)
+			continue
+		}
+		ids = append(ids, k.id)
+	}
+	return ids
+}
+
+// Preload reads the customers listed in ids, as HotKeys lists them, from the
+// store into the cache, skipping those that don't exist, and stopping at the
+// first other error. It returns the number of customers loaded. Reads go
+// straight to the store, so that they aren't logged, metered or recorded as
+// reads of personal data.
+func (c *CustomerCache) Preload(ctx context.Context, ids []string) (int, error) {
+	var n int
+	for _, id := range ids {
+		ctx := ctx
+		if i := strings.Index(id, "\t"); i >= 0 {
+			ctx = WithRequestMetadata(ctx, RequestMetadata{MetadataTenant: {id[:i]}})
+			id = id[i+1:]
+		}
+		if _, err := c.fetch(ctx, id); err == ErrNotFound {
+			continue
+		} else if err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// SaveHotKeys writes the IDs of up to n of the customers most recently read,
+// one per line, to the file at path, replacing it atomically.
+func (c *CustomerCache) SaveHotKeys(path string, n int) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name()) // once renamed, there's nothing to remove
+	w := bufio.NewWriter(f)
+	for _, id := range c.HotKeys(n) {
+		w.WriteString(id + "\n")
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// LoadHotKeys reads the IDs in the file at path, one per line, as written by
+// SaveHotKeys or by hand. Blank lines are skipped. A missing file lists none.
+func LoadHotKeys(path string) ([]string, error) {
+	buf, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, line := range strings.Split(string(buf), "\n") {
+		if id := strings.TrimSpace(line); id != "" {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+// RunHotKeySaver calls SaveHotKeys on c every interval until done is
+// closed, logging failures, so that the hot keys survive a crash too.
+func RunHotKeySaver(c *CustomerCache, path string, n int, interval time.Duration, logger Logger, done <-chan struct{}) {
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-tick.C:
+			if err := c.SaveHotKeys(path, n); err != nil {
+				logger.Log("job", "SaveHotKeys", "err", err)
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+// cachingMiddleware serves GetCustomer from a CustomerCache, and drops the
+// customers other calls may change from it.
+type cachingMiddleware struct {
+	Service
+	c *CustomerCache
+}
+
+func (mw *cachingMiddleware) GetCustomer(ctx context.Context, id string) (Customer, error) {
+	if p, ok := mw.c.get(cacheKeyFrom(ctx, id)); ok {
+		mw.c.lookups.With("result", "hit").Add(1)
+		if mw.c.onHit != nil {
+			mw.c.onHit(id)
+		}
+		if AddressesOmitted(ctx) {
+			p.Addresses = nil
+		}
+		return p, nil
+	}
+	mw.c.lookups.With("result", "miss").Add(1)
+	if AddressesOmitted(ctx) {
+		// The store leaves the addresses out: not one to keep.
+		return mw.Service.GetCustomer(ctx, id)
+	}
+	return mw.c.fetch(ctx, id)
+}
+
+func (mw *cachingMiddleware) PostCustomer(ctx context.Context, p Customer) error {
+	defer mw.c.invalidate(ctx, p.ID)
+	return mw.Service.PostCustomer(ctx, p)
+}
+
+func (mw *cachingMiddleware) PutCustomer(ctx context.Context, id string, p Customer) error {
+	defer mw.c.invalidate(ctx, id)
+	return mw.Service.PutCustomer(ctx, id, p)
+}
+
+func (mw *cachingMiddleware) PatchCustomer(ctx context.Context, id string, p Customer) error {
+	defer mw.c.invalidate(ctx, id)
+	return mw.Service.PatchCustomer(ctx, id, p)
+}
+
+func (mw *cachingMiddleware) DeleteCustomer(ctx context.Context, id string) error {
+	defer mw.c.invalidate(ctx, id)
+	return mw.Service.DeleteCustomer(ctx, id)
+}
+
+func (mw *cachingMiddleware) PostAddress(ctx context.Context, customerID string, a Address) (Address, error) {
+	defer mw.c.invalidate(ctx, customerID)
+	return mw.Service.PostAddress(ctx, customerID, a)
+}
+
+func (mw *cachingMiddleware) DeleteAddress(ctx context.Context, customerID string, addressID string) error {
+	defer mw.c.invalidate(ctx, customerID)
+	return mw.Service.DeleteAddress(ctx, customerID, addressID)
+}
+
+func (mw *cachingMiddleware) PostAddresses(ctx context.Context, customerID string, as []Address) ([]AddressResult, error) {
+	defer mw.c.invalidate(ctx, customerID)
+	return mw.Service.PostAddresses(ctx, customerID, as)
+}
+
+func (mw *cachingMiddleware) ReorderAddresses(ctx context.Context, customerID string, addressIDs []string) error {
+	defer mw.c.invalidate(ctx, customerID)
+	return mw.Service.ReorderAddresses(ctx, customerID, addressIDs)
+}
+
+func (mw *cachingMiddleware) ArchiveCustomer(ctx context.Context, id string) error {
+	defer mw.c.invalidate(ctx, id)
+	return mw.Service.ArchiveCustomer(ctx, id)
+}
+
+func (mw *cachingMiddleware) UnarchiveCustomer(ctx context.Context, id string) error {
+	defer mw.c.invalidate(ctx, id)
+	return mw.Service.UnarchiveCustomer(ctx, id)
+}
+
+func (mw *cachingMiddleware) CommitCustomer(ctx context.Context, id string) error {
+	defer mw.c.invalidate(ctx, id)
+	return mw.Service.CommitCustomer(ctx, id)
+}
+
+func (mw *cachingMiddleware) RepairAddresses(ctx context.Context, dryRun bool) ([]AddressRepair, error) {
+	if !dryRun {
+		defer mw.c.purge()
+	}
+	return mw.Service.RepairAddresses(ctx, dryRun)
+}
+
+func (mw *cachingMiddleware) CheckConsistency(ctx context.Context, repair bool) (ConsistencyReport, error) {
+	if repair {
+		defer mw.c.purge()
+	}
+	return mw.Service.CheckConsistency(ctx, repair)
+}
@@ -0,0 +1,156 @@
+package customersvc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/go-kit/kit/endpoint"
+	httptransport "github.com/go-kit/kit/transport/http"
+)
+
+var (
+	// ErrCaptchaRequired is returned when a request that needs a captcha
+	// carries none, or one that fails verification.
+	ErrCaptchaRequired = errors.New("missing or invalid captcha token")
+	// ErrCaptchaUnavailable is returned when a captcha couldn't be verified,
+	// e.g. because the provider is down. Requests are refused rather than
+	// let through unverified.
+	ErrCaptchaUnavailable = errors.New("captcha verification unavailable")
+)
+
+// CaptchaHeader carries the token a captcha widget gave the end user.
+const CaptchaHeader = "X-Captcha-Token"
+
+// Site verification endpoints of common captcha providers, for
+// NewSiteVerifier.
+const (
+	HCaptchaVerifyURL  = "https://api.hcaptcha.com/siteverify"
+	ReCaptchaVerifyURL = "https://www.google.com/recaptcha/api/siteverify"
+)
+
+// Endpoints requiring a captcha: those that may be exposed to end users.
+var captchaMethods = map[string]bool{
+	"PostCustomer": true,
+}
+
+// CaptchaVerifier checks a captcha token, optionally together with the
+// address of the end user it was issued to.
+type CaptchaVerifier interface {
+	VerifyCaptcha(ctx context.Context, token, remoteIP string) (bool, error)
+}
+
+// CaptchaVerifierFunc is an adapter to allow the use of ordinary functions
+// as CaptchaVerifiers.
+type CaptchaVerifierFunc func(ctx context.Context, token, remoteIP string) (bool, error)
+
+// VerifyCaptcha implements CaptchaVerifier.
+func (f CaptchaVerifierFunc) VerifyCaptcha(ctx context.Context, token, remoteIP string) (bool, error) {
+	return f(ctx, token, remoteIP)
+}
+
+// NewSiteVerifier returns a CaptchaVerifier using the siteverify protocol
+// shared by hCaptcha and reCAPTCHA: the secret and token are POSTed as a
+// form to url, which answers with a JSON object whose success field is the
+// verdict. A nil client means http.DefaultClient.
+func NewSiteVerifier(url, secret string, client *http.Client) CaptchaVerifier {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &siteVerifier{url: url, secret: secret, client: client}
+}
+
+type siteVerifier struct {
+	url    string
+	secret string
+	client *http.Client
+}
+
+func (v *siteVerifier) VerifyCaptcha(ctx context.Context, token, remoteIP string) (bool, error) {
+	form := url.Values{"secret": {v.secret}, "response": {token}}
+	if remoteIP != "" {
+		form.Set("remoteip", remoteIP)
+	}
+	req, err := http.NewRequest("POST", v.url, strings.NewReader(form.Encode()))
+	if err != nil {
+		return false, err
+	}
+	PropagateHeaders(ctx, req.Header)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := v.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("captcha siteverify: %s", resp.Status)
+	}
+	var result struct {
+		Success bool `json:"success"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return false, err
+	}
+	return result.Success, nil
+}
+
+// CaptchaMiddleware returns an endpoint middleware that requires requests to
+// the endpoints in captchaMethods to carry a captcha token verified by v,
+// before the service is invoked. Requests authorized by APIKeyMiddleware,
+// or carrying a key valid in trusted if it's set, are made by integrations
+// rather than end users, and skip the captcha.
+func CaptchaMiddleware(v CaptchaVerifier, trusted *APIKeys) func(method string) endpoint.Middleware {
+	return func(method string) endpoint.Middleware {
+		if !captchaMethods[method] {
+			return func(next endpoint.Endpoint) endpoint.Endpoint { return next }
+		}
+		return func(next endpoint.Endpoint) endpoint.Endpoint {
+			return func(ctx context.Context, request interface{}) (interface{}, error) {
+				if _, ok := APIKeyFrom(ctx); ok {
+					return next(ctx, request)
+				}
+				md := RequestMetadataFrom(ctx)
+				if trusted != nil {
+					if token := apiKeyFromMetadata(md); token != "" {
+						if _, err := trusted.Verify(token); err == nil {
+							return next(ctx, request)
+						}
+					}
+				}
+				token := md.Get(CaptchaHeader)
+				if token == "" {
+					return nil, ErrCaptchaRequired
+				}
+				ok, err := v.VerifyCaptcha(ctx, token, remoteIP(ctx))
+				if err != nil {
+					return nil, ErrCaptchaUnavailable
+				}
+				if !ok {
+					return nil, ErrCaptchaRequired
+				}
+				return next(ctx, request)
+			}
+		}
+	}
+}
+
+// remoteIP returns the address of the client the request carrying ctx came
+// from, if known.
+func remoteIP(ctx context.Context) string {
+	addr, _ := ctx.Value(httptransport.ContextKeyRequestRemoteAddr).(string)
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+// WithCaptcha requires a captcha verified by v on the endpoints that may be
+// exposed to end users, see CaptchaMiddleware.
+func WithCaptcha(v CaptchaVerifier, trusted *APIKeys) HandlerOption {
+	return func(c *handlerConfig) { c.captcha = CaptchaMiddleware(v, trusted) }
+}
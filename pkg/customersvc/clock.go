@@ -0,0 +1,73 @@
+package customersvc
+
+import (
+	"crypto/rand"
+	"time"
+
+	"github.com/go-kit/kit/metrics"
+)
+
+// Clock tells the time. Everything in this package that depends on the
+// current time, like signed URL expiry and report staleness, asks a Clock, so
+// that tests can control it; see package servicetest.
+type Clock interface {
+	Now() time.Time
+}
+
+// Rand is a source of random bytes, for IDs and tokens. It has the signature
+// of io.Reader, and like crypto/rand.Reader it never returns short reads
+// without an error.
+type Rand interface {
+	Read(p []byte) (n int, err error)
+}
+
+// SystemClock is the wall clock.
+var SystemClock Clock = systemClock{}
+
+// SystemRand is crypto/rand.Reader.
+var SystemRand Rand = rand.Reader
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+// Option configures the constructors that accept it. By default they use
+// SystemClock and SystemRand, and RegionLenient.
+type Option func(*options)
+
+type options struct {
+	clock     Clock
+	rand      Rand
+	regions   RegionCheck
+	dedup     DedupPolicy
+	patch     PatchPolicy
+	addresses AddressAuthority
+	nonces    NonceStore
+	replays   metrics.Counter
+	journal   *Journal
+	schema    *AddressSchema
+	streams   StreamLimits
+}
+
+// WithClock makes the constructor use c for the current time.
+func WithClock(c Clock) Option {
+	return func(o *options) { o.clock = c }
+}
+
+// WithRand makes the constructor use r for randomness.
+func WithRand(r Rand) Option {
+	return func(o *options) { o.rand = r }
+}
+
+// WithRegionCheck sets how address countries and states are checked.
+func WithRegionCheck(check RegionCheck) Option {
+	return func(o *options) { o.regions = check }
+}
+
+func makeOptions(opts []Option) options {
+	o := options{clock: SystemClock, rand: SystemRand}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
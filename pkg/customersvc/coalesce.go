@@ -0,0 +1,85 @@
+package customersvc
+
+import (
+	"context"
+	"sync"
+
+	"github.com/go-kit/kit/metrics"
+)
+
+// CoalescingMiddleware makes concurrent GetCustomer calls for the same
+// customer share a single call to next, so that a burst of reads of a hot
+// customer, e.g. one just featured somewhere, costs the backend one fetch
+// rather than one per caller. Calls are only shared while in flight; nothing
+// is cached. coalesced counts the calls answered by another's fetch. All
+// other methods pass straight through.
+func CoalescingMiddleware(coalesced metrics.Counter) Middleware {
+	return func(next Service) Service {
+		return &coalescingMiddleware{
+			Service:   next,
+			coalesced: coalesced,
+			flights:   map[flightKey]*flight{},
+		}
+	}
+}
+
+type coalescingMiddleware struct {
+	Service
+	coalesced metrics.Counter
+
+	mtx     sync.Mutex
+	flights map[flightKey]*flight
+}
+
+// flightKey identifies the fetches that can be shared. Tenants never share.
+type flightKey struct {
+	tenant, id    string
+	omitAddresses bool
+}
+
+// flight is a fetch in progress. customer and err are set before done is
+// closed, unless the fetch panicked, which leaves abandoned set.
+type flight struct {
+	done      chan struct{}
+	customer  Customer
+	err       error
+	abandoned bool
+}
+
+func (mw *coalescingMiddleware) GetCustomer(ctx context.Context, id string) (Customer, error) {
+	k := flightKey{TenantFrom(ctx), id, AddressesOmitted(ctx)}
+	mw.mtx.Lock()
+	if f, ok := mw.flights[k]; ok {
+		mw.mtx.Unlock()
+		mw.coalesced.Add(1)
+		select {
+		case <-f.done:
+		case <-ctx.Done():
+			return Customer{}, ctx.Err()
+		}
+		if f.abandoned || isContextErr(f.err) && ctx.Err() == nil {
+			// The fetch was given up by the caller that made it,
+			// or panicked, through no fault of ours: fetch on our
+			// own.
+			return mw.Service.GetCustomer(ctx, id)
+		}
+		return f.customer, f.err
+	}
+	f := &flight{done: make(chan struct{}), abandoned: true}
+	mw.flights[k] = f
+	mw.mtx.Unlock()
+
+	defer func() {
+		mw.mtx.Lock()
+		delete(mw.flights, k)
+		mw.mtx.Unlock()
+		close(f.done)
+	}()
+	f.customer, f.err = mw.Service.GetCustomer(ctx, id)
+	f.abandoned = false
+	return f.customer, f.err
+}
+
+func isContextErr(err error) bool {
+	return err == context.Canceled || err == context.DeadlineExceeded
+}
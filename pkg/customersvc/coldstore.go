@@ -0,0 +1,102 @@
+package customersvc
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// DirColdStore is a ColdStore keeping each customer as a JSON file in a
+// directory, e.g. one synced to object storage, or on a cheaper volume.
+type DirColdStore struct {
+	dir string
+}
+
+// NewDirColdStore returns a DirColdStore keeping customers in dir, which is
+// created if need be.
+func NewDirColdStore(dir string) (*DirColdStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &DirColdStore{dir: dir}, nil
+}
+
+const coldSuffix = ".json"
+
+// path returns the file of customer id. IDs are escaped, so that they can't
+// name a file outside the directory.
+func (s *DirColdStore) path(id string) string {
+	return filepath.Join(s.dir, url.PathEscape(id)+coldSuffix)
+}
+
+// Put implements ColdStore, replacing the file of the customer atomically.
+func (s *DirColdStore) Put(ctx context.Context, c ColdCustomer) error {
+	buf, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(s.dir, ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name()) // once renamed, there's nothing to remove
+	if _, err := f.Write(buf); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), s.path(c.Customer.ID))
+}
+
+// Get implements ColdStore.
+func (s *DirColdStore) Get(ctx context.Context, id string) (ColdCustomer, error) {
+	var c ColdCustomer
+	buf, err := ioutil.ReadFile(s.path(id))
+	if os.IsNotExist(err) {
+		return c, ErrNotFound
+	}
+	if err != nil {
+		return c, err
+	}
+	err = json.Unmarshal(buf, &c)
+	return c, err
+}
+
+// Delete implements ColdStore.
+func (s *DirColdStore) Delete(ctx context.Context, id string) error {
+	if err := os.Remove(s.path(id)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// List implements ColdStore.
+func (s *DirColdStore) List(ctx context.Context) ([]string, error) {
+	infos, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, info := range infos {
+		name := info.Name()
+		if strings.HasPrefix(name, ".") || !strings.HasSuffix(name, coldSuffix) {
+			continue
+		}
+		id, err := url.PathUnescape(strings.TrimSuffix(name, coldSuffix))
+		if err != nil {
+			continue // not one of ours
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
@@ -0,0 +1,143 @@
+package customersvc
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/go-kit/kit/endpoint"
+)
+
+var (
+	// ErrInvalidConsent is returned when a consent is granted without a
+	// type or a version.
+	ErrInvalidConsent = errors.New("consents need a type and a version")
+	// ErrConsentRequired is returned by CheckConsent and RequireConsent when
+	// the customer hasn't given, or has withdrawn, the consent needed.
+	ErrConsentRequired = errors.New("customer has not consented")
+)
+
+// Well-known consent types. Any other type may be recorded too.
+const (
+	ConsentMarketingEmail = "marketing_email"
+	ConsentMarketingSMS   = "marketing_sms"
+	ConsentProfiling      = "profiling"
+	ConsentDataSharing    = "data_sharing"
+)
+
+// Consent records a customer agreeing to one kind of processing of their
+// data, as GDPR and CCPA require. Records are never changed except to note
+// their withdrawal; granting the same type again adds a record, so the
+// consents of a customer are a history, and the latest record of each type
+// is the one in force.
+type Consent struct {
+	Type    string `json:"type" xml:"type"`       // e.g. ConsentMarketingEmail
+	Version string `json:"version" xml:"version"` // of the terms agreed to
+	// Granted is set by the service unless given, e.g. when importing
+	// consents collected elsewhere.
+	Granted   time.Time  `json:"granted" xml:"granted"`
+	Source    string     `json:"source,omitempty" xml:"source,omitempty"` // where it was collected, e.g. "signup_form"
+	Withdrawn *time.Time `json:"withdrawn,omitempty" xml:"withdrawn,omitempty"`
+}
+
+// Active reports whether c hasn't been withdrawn.
+func (c Consent) Active() bool { return c.Withdrawn == nil }
+
+// latestConsent returns the index of the latest record of consentType in
+// consents, or -1.
+func latestConsent(consents []Consent, consentType string) int {
+	for i := len(consents) - 1; i >= 0; i-- {
+		if consents[i].Type == consentType {
+			return i
+		}
+	}
+	return -1
+}
+
+// CheckConsent returns nil if the customer has consented to consentType and
+// not withdrawn it since, and ErrConsentRequired otherwise. Operations that
+// need consent, like sending marketing email, call it before proceeding.
+func CheckConsent(ctx context.Context, s Service, customerID, consentType string) error {
+	consents, err := s.GetConsents(ctx, customerID)
+	if err != nil {
+		return err
+	}
+	if i := latestConsent(consents, consentType); i >= 0 && consents[i].Active() {
+		return nil
+	}
+	return ErrConsentRequired
+}
+
+// RequireConsent returns an endpoint middleware that fails requests with
+// ErrConsentRequired unless the customer they're about, as given by
+// customerID, has consented to consentType. It's for endpoints outside this
+// package, such as campaign triggers, that act on a single customer.
+func RequireConsent(s Service, consentType string, customerID func(request interface{}) string) endpoint.Middleware {
+	return func(next endpoint.Endpoint) endpoint.Endpoint {
+		return func(ctx context.Context, request interface{}) (interface{}, error) {
+			if err := CheckConsent(ctx, s, customerID(request), consentType); err != nil {
+				return nil, err
+			}
+			return next(ctx, request)
+		}
+	}
+}
+
+// GrantConsent records c for the customer, timestamped now unless c says
+// otherwise.
+func (s *inmemService) GrantConsent(ctx context.Context, customerID string, c Consent) (Consent, error) {
+	if c.Type == "" || c.Version == "" {
+		return Consent{}, ErrInvalidConsent
+	}
+	if err := s.lock(ctx); err != nil {
+		return Consent{}, err
+	}
+	defer s.mtx.Unlock()
+	if _, ok := s.customers[customerID]; !ok {
+		return Consent{}, ErrNotFound
+	}
+	if c.Granted.IsZero() {
+		c.Granted = s.clock.Now()
+	}
+	consents := append(append([]Consent(nil), s.consents[customerID]...), c)
+	if err := s.persist(journalRecord{At: s.clock.Now(), Op: opConsents, ID: customerID, Consents: consents}, func() {
+		s.consents[customerID] = consents
+	}); err != nil {
+		return Consent{}, err
+	}
+	return c, nil
+}
+
+// WithdrawConsent marks the consent of the given type in force as withdrawn.
+// It fails with ErrNotFound if there's none.
+func (s *inmemService) WithdrawConsent(ctx context.Context, customerID string, consentType string) error {
+	if err := s.lock(ctx); err != nil {
+		return err
+	}
+	defer s.mtx.Unlock()
+	consents := s.consents[customerID]
+	i := latestConsent(consents, consentType)
+	if i < 0 || !consents[i].Active() {
+		return ErrNotFound
+	}
+	now := s.clock.Now()
+	consents = append([]Consent(nil), consents...)
+	consents[i].Withdrawn = &now
+	return s.persist(journalRecord{At: now, Op: opConsents, ID: customerID, Consents: consents}, func() {
+		s.consents[customerID] = consents
+	})
+}
+
+// GetConsents returns every consent record of the customer, oldest first.
+func (s *inmemService) GetConsents(ctx context.Context, customerID string) ([]Consent, error) {
+	if err := s.rlock(ctx); err != nil {
+		return nil, err
+	}
+	defer s.mtx.RUnlock()
+	if _, ok := s.customers[customerID]; !ok {
+		return nil, ErrNotFound
+	}
+	consents := make([]Consent, len(s.consents[customerID]))
+	copy(consents, s.consents[customerID])
+	return consents, nil
+}
@@ -0,0 +1,150 @@
+package customersvc
+
+import (
+	"context"
+	"sort"
+	"time"
+)
+
+// Problems CheckConsistency finds besides those RepairAddresses finds in
+// embedded address lists, AddressMissingID, AddressDuplicateID and
+// AddressMisnumbered, which it reports too.
+const (
+	CustomerInvalid     = "invalid"               // the customer breaks a current validation rule; it must be fixed by hand
+	ExternalIDOrphan    = "orphan-external-id"    // the index entry, of a customer gone or no longer claiming it, is dropped
+	ExternalIDUnindexed = "unindexed-external-id" // the external ID is indexed
+	ExternalIDClaimed   = "claimed-external-id"   // another customer has it; it must be fixed by hand
+)
+
+// ConsistencyReport is what CheckConsistency found in the store, and what it
+// did about it.
+type ConsistencyReport struct {
+	Checked   time.Time `json:"checked" xml:"checked"`
+	Customers int       `json:"customers" xml:"customers"`
+	// Repair is set if the anomalies that can be were repaired.
+	Repair    bool      `json:"repair" xml:"repair"`
+	Anomalies []Anomaly `json:"anomalies,omitempty" xml:"anomalies>anomaly,omitempty"`
+}
+
+// Anomaly is a problem CheckConsistency found with a customer. The fields
+// set besides CustomerID and Problem depend on the problem.
+type Anomaly struct {
+	CustomerID string `json:"customer_id" xml:"customer_id"`
+	Problem    string `json:"problem" xml:"problem"`
+	// Field and Message are the rule broken by a CustomerInvalid customer,
+	// as ValidateCustomer would report it.
+	Field   string `json:"field,omitempty" xml:"field,omitempty"`
+	Message string `json:"message,omitempty" xml:"message,omitempty"`
+	// Position and AddressID are those of the address concerned, as in an
+	// AddressRepair.
+	Position  int    `json:"position,omitempty" xml:"position,omitempty"`
+	AddressID string `json:"address_id,omitempty" xml:"address_id,omitempty"`
+	// ExternalID is the external ID concerned, as system:id.
+	ExternalID string `json:"external_id,omitempty" xml:"external_id,omitempty"`
+	// Repaired is set if the anomaly was repaired.
+	Repaired bool `json:"repaired,omitempty" xml:"repaired,omitempty"`
+}
+
+// CheckConsistency scans the store for anomalies: the address problems
+// RepairAddresses fixes, customers breaking validation rules added or
+// tightened since they were written, and external ID index entries out of
+// step with the customers. Given repair, it fixes those it can, as listed
+// with each problem, holding writes up while it does; otherwise it only
+// reports them. It fails with ErrRebuildInProgress if asked to repair while
+// the external ID index is being rebuilt. Customers moved to a cold tier
+// aren't checked.
+func (s *inmemService) CheckConsistency(ctx context.Context, repair bool) (ConsistencyReport, error) {
+	if repair {
+		if err := s.lock(ctx); err != nil {
+			return ConsistencyReport{}, err
+		}
+		defer s.mtx.Unlock()
+		if s.rebuild.touched != nil {
+			return ConsistencyReport{}, ErrRebuildInProgress
+		}
+	} else {
+		if err := s.rlock(ctx); err != nil {
+			return ConsistencyReport{}, err
+		}
+		defer s.mtx.RUnlock()
+	}
+	report := ConsistencyReport{Checked: s.clock.Now(), Customers: len(s.customers), Repair: repair}
+
+	repairs, err := s.repairAddresses(!repair)
+	if err != nil {
+		return ConsistencyReport{}, err
+	}
+	for _, r := range repairs {
+		report.Anomalies = append(report.Anomalies, Anomaly{
+			CustomerID: r.CustomerID,
+			Problem:    r.Problem,
+			Position:   r.Position,
+			AddressID:  r.AddressID,
+			Repaired:   repair,
+		})
+	}
+
+	sc := scan{ctx: ctx}
+	for id, p := range s.customers {
+		// A check gives up once cancelled, but a repair, once begun, is
+		// seen through.
+		if err := sc.next(); err != nil && !repair {
+			return ConsistencyReport{}, err
+		}
+		p.Addresses = normalizeRegions(p.Addresses, s.regions)
+		for _, e := range validateCustomer(p, s.regions, s.schema) {
+			report.Anomalies = append(report.Anomalies, Anomaly{CustomerID: id, Problem: CustomerInvalid, Field: e.Field, Message: e.Message})
+		}
+	}
+
+	// An entry is an orphan unless its customer still claims it. Orphans
+	// are dropped before indexing the external IDs missing, which may be
+	// theirs.
+	claimed := func(k externalKey, id string) bool {
+		p, ok := s.customers[id]
+		return ok && p.ExternalIDs[k.system] == k.id
+	}
+	for k, id := range s.external {
+		if claimed(k, id) {
+			continue
+		}
+		report.Anomalies = append(report.Anomalies, Anomaly{CustomerID: id, Problem: ExternalIDOrphan, ExternalID: k.system + ":" + k.id, Repaired: repair})
+		if repair {
+			delete(s.external, k)
+		}
+	}
+	ids := make([]string, 0, len(s.customers))
+	for id := range s.customers {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids) // of customers claiming the same external ID, the first gets it
+	for _, id := range ids {
+		for system, ext := range s.customers[id].ExternalIDs {
+			k := externalKey{system, ext}
+			owner, ok := s.external[k]
+			switch {
+			case ok && owner == id:
+				continue
+			case ok && claimed(k, owner):
+				report.Anomalies = append(report.Anomalies, Anomaly{CustomerID: id, Problem: ExternalIDClaimed, ExternalID: system + ":" + ext})
+				continue
+			}
+			report.Anomalies = append(report.Anomalies, Anomaly{CustomerID: id, Problem: ExternalIDUnindexed, ExternalID: system + ":" + ext, Repaired: repair})
+			if repair {
+				s.external[k] = id
+			}
+		}
+	}
+
+	sort.SliceStable(report.Anomalies, func(i, j int) bool {
+		a, b := report.Anomalies[i], report.Anomalies[j]
+		if a.CustomerID != b.CustomerID {
+			return a.CustomerID < b.CustomerID
+		}
+		if a.Problem != b.Problem {
+			return a.Problem < b.Problem
+		}
+		return a.Field+a.ExternalID < b.Field+b.ExternalID
+	})
+	return report, nil
+}
@@ -0,0 +1,443 @@
+package customersvc
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/endpoint"
+	httptransport "github.com/go-kit/kit/transport/http"
+	"github.com/gorilla/mux"
+)
+
+var (
+	// ErrInvalidCredentialKind is returned for a credential kind other than
+	// CredentialPassword and CredentialPIN.
+	ErrInvalidCredentialKind = errors.New("credential kind must be password or pin")
+	// ErrWeakSecret is returned when setting a password or PIN that's too
+	// short or too long, or a PIN that isn't all digits.
+	ErrWeakSecret = errors.New("passwords must have 8 to 1024 characters, and PINs 4 to 12 digits")
+	// ErrCredentialLocked is returned when verifying a credential locked
+	// after too many failed attempts. It's served as 423 Locked.
+	ErrCredentialLocked = errors.New("too many failed attempts, try again later")
+)
+
+// Kinds of credential a customer may have, one of each.
+const (
+	CredentialPassword = "password"
+	CredentialPIN      = "pin"
+)
+
+// PasswordHasher hashes secrets for storage, and verifies secrets against
+// what it hashed. Hashes must encode their own salt and parameters. The
+// default is NewPBKDF2Hasher; bcrypt or argon2 can be plugged in by
+// wrapping golang.org/x/crypto.
+type PasswordHasher interface {
+	Hash(secret string) (string, error)
+	Verify(hash, secret string) (bool, error)
+}
+
+// DefaultPBKDF2Iterations is the PBKDF2-HMAC-SHA256 work factor OWASP
+// recommends.
+const DefaultPBKDF2Iterations = 600000
+
+// NewPBKDF2Hasher returns a PasswordHasher using PBKDF2-HMAC-SHA256 with the
+// given number of iterations, or DefaultPBKDF2Iterations if zero, and a
+// random 16-byte salt per hash. Hashes are of the form
+// pbkdf2-sha256$<iterations>$<salt>$<key>, and verify whatever iterations
+// they were made with.
+func NewPBKDF2Hasher(iterations int, options ...Option) PasswordHasher {
+	o := makeOptions(options)
+	if iterations <= 0 {
+		iterations = DefaultPBKDF2Iterations
+	}
+	return pbkdf2Hasher{iterations: iterations, rand: o.rand}
+}
+
+type pbkdf2Hasher struct {
+	iterations int
+	rand       Rand
+}
+
+const pbkdf2Prefix = "pbkdf2-sha256"
+
+func (h pbkdf2Hasher) Hash(secret string) (string, error) {
+	salt := make([]byte, 16)
+	if _, err := h.rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := pbkdf2SHA256([]byte(secret), salt, h.iterations, sha256.Size)
+	enc := base64.RawStdEncoding
+	return fmt.Sprintf("%s$%d$%s$%s", pbkdf2Prefix, h.iterations, enc.EncodeToString(salt), enc.EncodeToString(key)), nil
+}
+
+func (h pbkdf2Hasher) Verify(hash, secret string) (bool, error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 4 || parts[0] != pbkdf2Prefix {
+		return false, errors.New("not a PBKDF2 hash")
+	}
+	iterations, err := strconv.Atoi(parts[1])
+	if err != nil || iterations <= 0 {
+		return false, errors.New("malformed PBKDF2 hash")
+	}
+	enc := base64.RawStdEncoding
+	salt, err := enc.DecodeString(parts[2])
+	if err != nil {
+		return false, errors.New("malformed PBKDF2 hash")
+	}
+	want, err := enc.DecodeString(parts[3])
+	if err != nil {
+		return false, errors.New("malformed PBKDF2 hash")
+	}
+	got := pbkdf2SHA256([]byte(secret), salt, iterations, len(want))
+	return subtle.ConstantTimeCompare(got, want) == 1, nil
+}
+
+// pbkdf2SHA256 is PBKDF2 as in RFC 8018, with HMAC-SHA256.
+func pbkdf2SHA256(password, salt []byte, iterations, keyLen int) []byte {
+	prf := hmac.New(sha256.New, password)
+	var key []byte
+	u := make([]byte, sha256.Size)
+	t := make([]byte, sha256.Size)
+	var block [4]byte
+	for i := uint32(1); len(key) < keyLen; i++ {
+		prf.Reset()
+		prf.Write(salt)
+		binary.BigEndian.PutUint32(block[:], i)
+		prf.Write(block[:])
+		u = prf.Sum(u[:0])
+		copy(t, u)
+		for n := 1; n < iterations; n++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+		key = append(key, t...)
+	}
+	return key[:keyLen]
+}
+
+// CredentialOptions tunes Credentials.
+type CredentialOptions struct {
+	// Hasher hashes secrets. Nil means NewPBKDF2Hasher(0).
+	Hasher PasswordHasher
+	// MaxAttempts is the number of consecutive failed verifications after
+	// which a credential is locked. Default 5.
+	MaxAttempts int
+	// Lockout is how long a credential stays locked. Default 15 minutes.
+	Lockout time.Duration
+}
+
+// Credentials stores a password and a PIN per customer, for deployments
+// where customersvc is the system of record for end-user login. Only hashes
+// are kept, apart from customers, so that no read of a customer, list or
+// export can return them. They are held in memory. It's safe for concurrent
+// use.
+type Credentials struct {
+	opts  CredentialOptions
+	clock Clock
+	dummy string // verified against for missing credentials, so that they take as long
+
+	mtx   sync.Mutex
+	creds map[credentialKey]*credential
+}
+
+type credentialKey struct{ customerID, kind string }
+
+type credential struct {
+	hash        string
+	failures    int // consecutive, including verifications in progress
+	lockedUntil time.Time
+}
+
+// NewCredentials returns an empty credential store. Mount it with
+// WithCredentials.
+func NewCredentials(opts CredentialOptions, options ...Option) (*Credentials, error) {
+	o := makeOptions(options)
+	if opts.Hasher == nil {
+		opts.Hasher = NewPBKDF2Hasher(0, options...)
+	}
+	if opts.MaxAttempts <= 0 {
+		opts.MaxAttempts = 5
+	}
+	if opts.Lockout <= 0 {
+		opts.Lockout = 15 * time.Minute
+	}
+	dummy, err := opts.Hasher.Hash("not a credential")
+	if err != nil {
+		return nil, err
+	}
+	return &Credentials{opts: opts, clock: o.clock, dummy: dummy, creds: map[credentialKey]*credential{}}, nil
+}
+
+func checkSecret(kind, secret string) error {
+	switch kind {
+	case CredentialPassword:
+		if len(secret) < 8 || len(secret) > 1024 {
+			return ErrWeakSecret
+		}
+	case CredentialPIN:
+		if len(secret) < 4 || len(secret) > 12 || strings.Trim(secret, "0123456789") != "" {
+			return ErrWeakSecret
+		}
+	default:
+		return ErrInvalidCredentialKind
+	}
+	return nil
+}
+
+// Set sets the credential of the given kind of customerID to secret,
+// unlocking it.
+func (c *Credentials) Set(customerID, kind, secret string) error {
+	if err := checkSecret(kind, secret); err != nil {
+		return err
+	}
+	hash, err := c.opts.Hasher.Hash(secret)
+	if err != nil {
+		return err
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.creds[credentialKey{customerID, kind}] = &credential{hash: hash}
+	return nil
+}
+
+// Verify reports whether secret is the credential of the given kind of
+// customerID. A customer without one never verifies. After MaxAttempts
+// failures in a row, it fails with ErrCredentialLocked until Lockout has
+// passed, whatever the secret.
+func (c *Credentials) Verify(customerID, kind, secret string) (bool, error) {
+	if kind != CredentialPassword && kind != CredentialPIN {
+		return false, ErrInvalidCredentialKind
+	}
+	key := credentialKey{customerID, kind}
+	c.mtx.Lock()
+	cred, ok := c.creds[key]
+	if !ok {
+		c.mtx.Unlock()
+		c.opts.Hasher.Verify(c.dummy, secret)
+		return false, nil
+	}
+	now := c.clock.Now()
+	if now.Before(cred.lockedUntil) {
+		c.mtx.Unlock()
+		return false, ErrCredentialLocked
+	}
+	if !cred.lockedUntil.IsZero() {
+		cred.failures, cred.lockedUntil = 0, time.Time{} // the lockout is over
+	}
+	if cred.failures >= c.opts.MaxAttempts {
+		c.mtx.Unlock()
+		return false, ErrCredentialLocked // the last attempts are in progress
+	}
+	// Counted before hashing, so that concurrent attempts can't exceed
+	// MaxAttempts.
+	cred.failures++
+	hash := cred.hash
+	c.mtx.Unlock()
+
+	verified, err := c.opts.Hasher.Verify(hash, secret)
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.creds[key] != cred {
+		return false, nil // changed or deleted meanwhile
+	}
+	if verified && err == nil {
+		cred.failures = 0
+		return true, nil
+	}
+	if cred.failures >= c.opts.MaxAttempts && cred.lockedUntil.IsZero() {
+		cred.lockedUntil = c.clock.Now().Add(c.opts.Lockout)
+	}
+	return false, err
+}
+
+// Delete removes the credential of the given kind of customerID. It fails
+// with ErrNotFound if there's none.
+func (c *Credentials) Delete(customerID, kind string) error {
+	if kind != CredentialPassword && kind != CredentialPIN {
+		return ErrInvalidCredentialKind
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	key := credentialKey{customerID, kind}
+	if _, ok := c.creds[key]; !ok {
+		return ErrNotFound
+	}
+	delete(c.creds, key)
+	return nil
+}
+
+func (c *Credentials) forget(customerID string) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	delete(c.creds, credentialKey{customerID, CredentialPassword})
+	delete(c.creds, credentialKey{customerID, CredentialPIN})
+}
+
+// middleware drops the credentials of deleted customers.
+func (c *Credentials) middleware(method string) endpoint.Middleware {
+	if method != "DeleteCustomer" {
+		return func(next endpoint.Endpoint) endpoint.Endpoint { return next }
+	}
+	return func(next endpoint.Endpoint) endpoint.Endpoint {
+		return func(ctx context.Context, request interface{}) (interface{}, error) {
+			response, err := next(ctx, request)
+			if err != nil {
+				return response, err
+			}
+			if e, ok := response.(errorer); ok && e.error() != nil {
+				return response, err
+			}
+			c.forget(request.(deleteCustomerRequest).ID)
+			return response, err
+		}
+	}
+}
+
+// WithCredentials mounts endpoints managing the passwords and PINs of
+// customers in c, and drops them when customers are deleted:
+//
+//	PUT     /customers/:id/credentials/:kind          set a password or PIN: {"secret": "..."}
+//	POST    /customers/:id/credentials/:kind/verify   check one: {"secret": "..."}, answering {"verified": true} or false
+//	DELETE  /customers/:id/credentials/:kind          remove one
+//
+// The kind is password or pin. Secrets are never returned.
+func WithCredentials(c *Credentials) HandlerOption {
+	return func(cfg *handlerConfig) { cfg.credentials = c }
+}
+
+func mountCredentials(r *mux.Router, s Service, c *Credentials, wrap func(string, endpoint.Endpoint) endpoint.Endpoint, options []httptransport.ServerOption) {
+	r.Methods("PUT").Path("/customers/{id}/credentials/{kind}").Handler(httptransport.NewServer(
+		wrap("SetCredential", makeSetCredentialEndpoint(s, c)),
+		decodeSetCredentialRequest,
+		encodeResponse,
+		options...,
+	))
+	r.Methods("POST").Path("/customers/{id}/credentials/{kind}/verify").Handler(httptransport.NewServer(
+		wrap("VerifyCredential", makeVerifyCredentialEndpoint(c)),
+		decodeVerifyCredentialRequest,
+		encodeResponse,
+		options...,
+	))
+	r.Methods("DELETE").Path("/customers/{id}/credentials/{kind}").Handler(httptransport.NewServer(
+		wrap("DeleteCredential", makeDeleteCredentialEndpoint(c)),
+		decodeDeleteCredentialRequest,
+		encodeResponse,
+		options...,
+	))
+}
+
+func makeSetCredentialEndpoint(s Service, c *Credentials) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(setCredentialRequest)
+		if _, e := s.GetCustomer(ctx, req.ID); e != nil {
+			return credentialResponse{Err: e}, nil
+		}
+		return credentialResponse{Err: c.Set(req.ID, req.Kind, req.Secret)}, nil
+	}
+}
+
+func makeVerifyCredentialEndpoint(c *Credentials) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(verifyCredentialRequest)
+		verified, e := c.Verify(req.ID, req.Kind, req.Secret)
+		return verifyCredentialResponse{Verified: verified, Err: e}, nil
+	}
+}
+
+func makeDeleteCredentialEndpoint(c *Credentials) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(deleteCredentialRequest)
+		return credentialResponse{Err: c.Delete(req.ID, req.Kind)}, nil
+	}
+}
+
+type setCredentialRequest struct {
+	ID, Kind, Secret string
+}
+
+type verifyCredentialRequest struct {
+	ID, Kind, Secret string
+}
+
+type deleteCredentialRequest struct {
+	ID, Kind string
+}
+
+type credentialResponse struct {
+	Err error `json:"err,omitempty" xml:"-"`
+}
+
+func (r credentialResponse) error() error { return r.Err }
+
+type verifyCredentialResponse struct {
+	Verified bool  `json:"verified" xml:"verified"`
+	Err      error `json:"err,omitempty" xml:"-"`
+}
+
+func (r verifyCredentialResponse) error() error { return r.Err }
+
+// decodeCredentialRequest decodes the customer ID and kind from the path,
+// and the secret from the body if secret is set.
+func decodeCredentialRequest(r *http.Request, secret *string) (id, kind string, err error) {
+	vars := mux.Vars(r)
+	id, ok := vars["id"]
+	if !ok {
+		return "", "", ErrBadRouting
+	}
+	kind, ok = vars["kind"]
+	if !ok {
+		return "", "", ErrBadRouting
+	}
+	if secret != nil {
+		var body struct {
+			Secret string `json:"secret" xml:"secret"`
+		}
+		if err := decodeBody(r, &body); err != nil {
+			return "", "", err
+		}
+		*secret = body.Secret
+	}
+	return id, kind, nil
+}
+
+func decodeSetCredentialRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	var secret string
+	id, kind, err := decodeCredentialRequest(r, &secret)
+	if err != nil {
+		return nil, err
+	}
+	return setCredentialRequest{ID: id, Kind: kind, Secret: secret}, nil
+}
+
+func decodeVerifyCredentialRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	var secret string
+	id, kind, err := decodeCredentialRequest(r, &secret)
+	if err != nil {
+		return nil, err
+	}
+	return verifyCredentialRequest{ID: id, Kind: kind, Secret: secret}, nil
+}
+
+func decodeDeleteCredentialRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	id, kind, err := decodeCredentialRequest(r, nil)
+	if err != nil {
+		return nil, err
+	}
+	return deleteCredentialRequest{ID: id, Kind: kind}, nil
+}
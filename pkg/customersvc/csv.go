@@ -0,0 +1,145 @@
+package customersvc
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	httptransport "github.com/go-kit/kit/transport/http"
+)
+
+// DefaultCSVColumns are the columns of customer lists served as CSV, unless
+// the request picks others with ?columns=.
+var DefaultCSVColumns = []string{"id", "name", "email", "phone", "archived"}
+
+// ErrInvalidColumns is returned for a ?columns= listing a column customer
+// lists served as CSV can't have.
+var ErrInvalidColumns = errors.New("columns must list id, name, given_name, family_name, locale, email, phone, archived, metadata.<key> or external_ids.<system>")
+
+// csvFlushRows is the number of rows written between flushes, so that large
+// lists reach the client as they're encoded.
+const csvFlushRows = 500
+
+// csvLister is implemented by responses that can be served as CSV, one row
+// per customer. For a page, it also returns the cursor of the next one.
+type csvLister interface {
+	csvCustomers() (customers []Customer, nextCursor string)
+}
+
+func (r getCustomersResponse) csvCustomers() ([]Customer, string) { return r.Customers, "" }
+
+func (r customerPageResponse) csvCustomers() ([]Customer, string) { return r.Items, r.NextCursor }
+
+// acceptsCSV reports whether the Accept header, as populated in ctx by
+// httptransport.PopulateRequestContext, prefers CSV over JSON and XML. Like
+// acceptsXML, it takes media ranges in the order given.
+func acceptsCSV(ctx context.Context) bool {
+	accept, _ := ctx.Value(httptransport.ContextKeyRequestAccept).(string)
+	for _, mediaRange := range strings.Split(accept, ",") {
+		switch mediaType := strings.TrimSpace(strings.SplitN(mediaRange, ";", 2)[0]); {
+		case mediaType == "text/csv":
+			return true
+		case isXML(mediaType), strings.Contains(mediaType, "json"):
+			return false
+		}
+	}
+	return false
+}
+
+// csvColumns returns the columns picked with ?columns=, a comma-separated
+// list, in query, or DefaultCSVColumns.
+func csvColumns(query url.Values) ([]string, error) {
+	list := query.Get("columns")
+	if list == "" {
+		return DefaultCSVColumns, nil
+	}
+	columns := strings.Split(list, ",")
+	for _, column := range columns {
+		switch {
+		case column == "id", column == "name", column == "given_name", column == "family_name", column == "locale",
+			column == "email", column == "phone", column == "archived":
+		case strings.HasPrefix(column, "metadata.") && len(column) > len("metadata."):
+		case strings.HasPrefix(column, "external_ids.") && len(column) > len("external_ids."):
+		default:
+			return nil, ErrInvalidColumns
+		}
+	}
+	return columns, nil
+}
+
+// csvCell returns column of p.
+func csvCell(p Customer, column string) string {
+	switch column {
+	case "id":
+		return p.ID
+	case "name":
+		return p.Name
+	case "given_name":
+		return p.GivenName
+	case "family_name":
+		return p.FamilyName
+	case "locale":
+		return p.Locale
+	case "email":
+		return p.Email
+	case "phone":
+		return p.Phone
+	case "archived":
+		return strconv.FormatBool(p.Archived)
+	}
+	if key := strings.TrimPrefix(column, "metadata."); key != column {
+		return p.Metadata[key]
+	}
+	return p.ExternalIDs[strings.TrimPrefix(column, "external_ids.")]
+}
+
+// encodeCSV streams customers to w as CSV, a header row naming the columns
+// first, flushing every csvFlushRows rows. Unlike other GET responses, it
+// carries no ETag: that would need the whole body first. For a page, the
+// next one is linked to in a Link header.
+func encodeCSV(ctx context.Context, w http.ResponseWriter, customers []Customer, nextCursor string) error {
+	uri, _ := ctx.Value(httptransport.ContextKeyRequestURI).(string)
+	u, err := url.ParseRequestURI(uri)
+	if err != nil {
+		u = &url.URL{}
+	}
+	query := u.Query()
+	columns, err := csvColumns(query)
+	if err != nil {
+		encodeError(ctx, err, w)
+		return nil
+	}
+	if nextCursor != "" {
+		query.Set("cursor", nextCursor)
+		next := url.URL{Path: u.Path, RawQuery: query.Encode()}
+		w.Header().Add("Link", "<"+next.String()+`>; rel="next"`)
+	}
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+
+	flusher, _ := w.(http.Flusher)
+	cw := csv.NewWriter(w)
+	if err := cw.Write(columns); err != nil {
+		return err
+	}
+	row := make([]string, len(columns))
+	for i, p := range customers {
+		for j, column := range columns {
+			row[j] = csvCell(p, column)
+		}
+		if err := cw.Write(row); err != nil {
+			return err
+		}
+		if (i+1)%csvFlushRows == 0 {
+			cw.Flush()
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
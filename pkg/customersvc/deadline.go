@@ -0,0 +1,142 @@
+package customersvc
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-kit/kit/endpoint"
+)
+
+// Headers with which callers bound how long they'll wait for a response.
+// RequestTimeoutHeader takes a Go duration such as "250ms", or a number of
+// seconds. GRPCTimeoutHeader takes the gRPC wire format, such as "250m", for
+// callers behind gRPC gateways. The server gives up on the request once the
+// budget is spent, and the client sends what's left of its context deadline
+// on every call, so that a budget carries through chains of services.
+const (
+	RequestTimeoutHeader = "X-Request-Timeout"
+	GRPCTimeoutHeader    = "Grpc-Timeout"
+)
+
+// budgetExceededError is ErrTimeout for a request that outlived the budget
+// its caller set. It implements the Go kit httptransport StatusCoder
+// interface.
+type budgetExceededError struct {
+	elapsed, budget time.Duration
+}
+
+func (e budgetExceededError) Error() string {
+	return fmt.Sprintf("%v: %v elapsed of a %v budget", ErrTimeout, e.elapsed.Round(time.Millisecond), e.budget)
+}
+
+func (e budgetExceededError) StatusCode() int { return http.StatusGatewayTimeout }
+
+func (e budgetExceededError) Unwrap() error { return ErrTimeout }
+
+type budgetKey struct{}
+
+type requestBudget struct {
+	start  time.Time
+	budget time.Duration
+}
+
+// deadlineMiddleware bounds each request by the budget in its timeout
+// headers, if any. Unparseable budgets are ignored.
+func deadlineMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		budget, ok := requestTimeout(r.Header)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		b := requestBudget{start: time.Now(), budget: budget}
+		ctx, cancel := context.WithDeadline(r.Context(), b.start.Add(budget))
+		defer cancel()
+		ctx = context.WithValue(ctx, budgetKey{}, b)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// budgetMiddleware fails requests whose budget is spent with a
+// budgetExceededError, whether it ran out before or during next.
+func budgetMiddleware(method string) endpoint.Middleware {
+	return func(next endpoint.Endpoint) endpoint.Endpoint {
+		return func(ctx context.Context, request interface{}) (interface{}, error) {
+			b, ok := ctx.Value(budgetKey{}).(requestBudget)
+			if !ok {
+				return next(ctx, request)
+			}
+			if ctx.Err() == context.DeadlineExceeded {
+				return nil, budgetExceededError{elapsed: time.Since(b.start), budget: b.budget}
+			}
+			response, err := next(ctx, request)
+			if ctx.Err() == context.DeadlineExceeded {
+				return nil, budgetExceededError{elapsed: time.Since(b.start), budget: b.budget}
+			}
+			return response, err
+		}
+	}
+}
+
+// requestTimeout returns the budget set in h, preferring
+// RequestTimeoutHeader.
+func requestTimeout(h http.Header) (time.Duration, bool) {
+	if v := h.Get(RequestTimeoutHeader); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			seconds, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				return 0, false
+			}
+			d = time.Duration(seconds * float64(time.Second))
+		}
+		return d, d > 0
+	}
+	if v := h.Get(GRPCTimeoutHeader); v != "" {
+		return parseGRPCTimeout(v)
+	}
+	return 0, false
+}
+
+var grpcTimeoutUnits = map[byte]time.Duration{
+	'H': time.Hour,
+	'M': time.Minute,
+	'S': time.Second,
+	'm': time.Millisecond,
+	'u': time.Microsecond,
+	'n': time.Nanosecond,
+}
+
+// parseGRPCTimeout parses the gRPC timeout format: at most 8 digits followed
+// by a unit.
+func parseGRPCTimeout(v string) (time.Duration, bool) {
+	if len(v) < 2 || len(v) > 9 {
+		return 0, false
+	}
+	unit, ok := grpcTimeoutUnits[v[len(v)-1]]
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(v[:len(v)-1], 10, 64)
+	if err != nil || n <= 0 {
+		return 0, false
+	}
+	return time.Duration(n) * unit, true
+}
+
+// setRequestTimeout passes what's left of ctx's deadline, if any, on to the
+// server in RequestTimeoutHeader.
+func setRequestTimeout(ctx context.Context, req *http.Request) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return
+	}
+	remaining := time.Until(deadline).Truncate(time.Millisecond)
+	if remaining < time.Millisecond {
+		remaining = time.Millisecond // let the server fail it, consistently
+	}
+	req.Header.Set(RequestTimeoutHeader, remaining.String())
+}
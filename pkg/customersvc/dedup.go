@@ -0,0 +1,141 @@
+package customersvc
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// ErrDuplicateAddress is returned under DedupReject when an address being
+// added has the same location as one the customer already has.
+var ErrDuplicateAddress = errors.New("customer already has an address at that location")
+
+// DedupPolicy says what the inmem store does when an address being added to
+// a customer has the same location as one of its existing addresses, under
+// another ID. Locations are compared after normalization: case, punctuation
+// and spacing don't matter.
+type DedupPolicy int
+
+const (
+	// DedupAllow adds the address anyway. It's the default.
+	DedupAllow DedupPolicy = iota
+	// DedupReject fails with ErrDuplicateAddress.
+	DedupReject
+	// DedupMerge doesn't add the address, but fills in the country and
+	// state of the existing one from it where those are missing.
+	DedupMerge
+)
+
+// ParseDedupPolicy parses "allow", "reject" or "merge".
+func ParseDedupPolicy(s string) (DedupPolicy, error) {
+	switch s {
+	case "allow":
+		return DedupAllow, nil
+	case "reject":
+		return DedupReject, nil
+	case "merge":
+		return DedupMerge, nil
+	}
+	return DedupAllow, fmt.Errorf("unknown dedup policy %q", s)
+}
+
+// WithAddressDedup makes the inmem store apply p to addresses added by
+// PostAddress and PostAddresses.
+func WithAddressDedup(p DedupPolicy) Option {
+	return func(o *options) { o.dedup = p }
+}
+
+// DuplicateAddresses are addresses of a customer at the same location.
+type DuplicateAddresses struct {
+	CustomerID  string   `json:"customer_id" xml:"customer_id"`
+	Fingerprint string   `json:"fingerprint" xml:"fingerprint"` // of the normalized location
+	AddressIDs  []string `json:"address_ids" xml:"address_ids>id"`
+}
+
+// addressFingerprint hashes the normalized location, or returns "" for
+// addresses without one, which are never duplicates.
+func addressFingerprint(location string) string {
+	words := strings.FieldsFunc(strings.ToLower(location), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	if len(words) == 0 {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(strings.Join(words, " ")))
+	return hex.EncodeToString(sum[:8])
+}
+
+// findDuplicate returns the index of the address in addresses at the same
+// location as a, or -1.
+func findDuplicate(addresses []Address, a Address) int {
+	fp := addressFingerprint(a.Location)
+	if fp == "" {
+		return -1
+	}
+	for i, address := range addresses {
+		if addressFingerprint(address.Location) == fp {
+			return i
+		}
+	}
+	return -1
+}
+
+// mergeAddress fills in the fields existing lacks from a.
+func mergeAddress(existing, a Address) Address {
+	if existing.Country == "" {
+		existing.Country, existing.State = a.Country, a.State
+	} else if existing.State == "" && existing.Country == a.Country {
+		existing.State = a.State
+	}
+	for name, value := range a.CustomFields {
+		if _, ok := existing.CustomFields[name]; ok {
+			continue
+		}
+		fields := make(CustomFields, len(existing.CustomFields)+1) // revisions share the old map
+		for k, v := range existing.CustomFields {
+			fields[k] = v
+		}
+		fields[name] = value
+		existing.CustomFields = fields
+	}
+	return existing
+}
+
+// GetDuplicateAddresses lists the addresses at the same location, whatever
+// the dedup policy, by customer and then fingerprint.
+func (s *inmemService) GetDuplicateAddresses(ctx context.Context) ([]DuplicateAddresses, error) {
+	if err := s.rlock(ctx); err != nil {
+		return nil, err
+	}
+	defer s.mtx.RUnlock()
+	var duplicates []DuplicateAddresses
+	sc := scan{ctx: ctx}
+	for id, p := range s.customers {
+		if err := sc.next(); err != nil {
+			return nil, err
+		}
+		groups := map[string][]string{}
+		for _, address := range p.Addresses {
+			if fp := addressFingerprint(address.Location); fp != "" {
+				groups[fp] = append(groups[fp], address.ID)
+			}
+		}
+		for fp, ids := range groups {
+			if len(ids) > 1 {
+				duplicates = append(duplicates, DuplicateAddresses{CustomerID: id, Fingerprint: fp, AddressIDs: ids})
+			}
+		}
+	}
+	sort.Slice(duplicates, func(i, j int) bool {
+		if duplicates[i].CustomerID != duplicates[j].CustomerID {
+			return duplicates[i].CustomerID < duplicates[j].CustomerID
+		}
+		return duplicates[i].Fingerprint < duplicates[j].Fingerprint
+	})
+	return duplicates, nil
+}
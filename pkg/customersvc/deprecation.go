@@ -0,0 +1,102 @@
+package customersvc
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-kit/kit/metrics"
+	"github.com/gorilla/mux"
+)
+
+// ErrGone is returned for requests to a deprecated route past its removal
+// date.
+var ErrGone = errors.New("this endpoint has been removed")
+
+// Deprecation describes a deprecated route. Until Removed, its responses
+// carry a Deprecation header, and Sunset, Link and Warning headers for the
+// fields that are set; after, it fails with ErrGone.
+type Deprecation struct {
+	// Sunset is when the route is expected to stop working, if known.
+	Sunset time.Time `json:"sunset,omitempty"`
+	// Removed, if set, is when the route stops working: requests fail
+	// with 410 Gone from then on. Usually the same as Sunset.
+	Removed time.Time `json:"removed,omitempty"`
+	// Message is sent as a Warning, e.g. "use /v2/customers/ instead".
+	Message string `json:"message,omitempty"`
+	// Successor is the URL of what replaces the route, sent as a Link with
+	// rel="successor-version".
+	Successor string `json:"successor,omitempty"`
+}
+
+// Deprecations tracks the deprecated routes of the HTTP handler, and counts
+// their use, so that they can be removed once their clients have moved off.
+type Deprecations struct {
+	routes map[string]Deprecation
+	used   metrics.Counter
+	clock  Clock
+}
+
+// NewDeprecations returns Deprecations of routes, which are keyed by method
+// and path template as mounted, e.g. "GET /customers/{id}/addresses/".
+// Requests to them are counted in used, labeled by route and by whether they
+// were served or already gone.
+func NewDeprecations(routes map[string]Deprecation, used metrics.Counter, opts ...Option) *Deprecations {
+	o := makeOptions(opts)
+	return &Deprecations{routes: routes, used: used, clock: o.clock}
+}
+
+// WithDeprecations marks the routes in d as deprecated.
+func WithDeprecations(d *Deprecations) HandlerOption {
+	return func(c *handlerConfig) { c.deprecations = d }
+}
+
+// middleware sets the deprecation headers of the route of r each request
+// matches, and rejects requests to removed routes.
+func (d *Deprecations) middleware(r *mux.Router) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			route, dep, ok := d.lookup(r, req)
+			if !ok {
+				next.ServeHTTP(w, req)
+				return
+			}
+			w.Header().Set("Deprecation", "true")
+			if !dep.Sunset.IsZero() {
+				w.Header().Set("Sunset", dep.Sunset.UTC().Format(http.TimeFormat))
+			}
+			if dep.Successor != "" {
+				w.Header().Add("Link", "<"+dep.Successor+`>; rel="successor-version"`)
+			}
+			if dep.Message != "" {
+				w.Header().Set("Warning", "299 - "+strconv.Quote(dep.Message))
+			}
+			if !dep.Removed.IsZero() && !d.clock.Now().Before(dep.Removed) {
+				d.used.With("route", route, "gone", "true").Add(1)
+				encodeError(req.Context(), ErrGone, w)
+				return
+			}
+			d.used.With("route", route, "gone", "false").Add(1)
+			next.ServeHTTP(w, req)
+		})
+	}
+}
+
+// lookup returns the route of r req matches, if it's deprecated.
+func (d *Deprecations) lookup(r *mux.Router, req *http.Request) (string, Deprecation, bool) {
+	if len(d.routes) == 0 {
+		return "", Deprecation{}, false
+	}
+	var match mux.RouteMatch
+	if !r.Match(req, &match) || match.Route == nil {
+		return "", Deprecation{}, false
+	}
+	tpl, err := match.Route.GetPathTemplate()
+	if err != nil {
+		return "", Deprecation{}, false
+	}
+	route := req.Method + " " + tpl
+	dep, ok := d.routes[route]
+	return route, dep, ok
+}
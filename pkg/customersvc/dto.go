@@ -0,0 +1,383 @@
+package customersvc
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// Customer and Address are the domain types: the store and every Service
+// deal in them. What goes over the wire, or into files such as exports and
+// the offline client's queue, is one of the versioned DTOs below, converted
+// to and from explicitly. Fields can be added to or renamed in the domain
+// types without changing any wire format; a change to a wire format is a new
+// version.
+//
+// Version 1 is the format the service has always spoken, and the one
+// Customer and Address marshal to as JSON. Version 2 is served to requests
+// carrying "X-API-Version: 2": it renames name to display_name and metadata
+// to attributes, and groups the country and state of addresses as a region.
+
+// APIVersionHeader selects the wire format of a request and its response.
+// Requests without it get version 1. Responses say which version they're in.
+const APIVersionHeader = "X-API-Version"
+
+// CustomerV1 is the version 1 wire format of a Customer.
+type CustomerV1 struct {
+	ID           string        `json:"id"`
+	Name         string        `json:"name"`
+	GivenName    string        `json:"given_name,omitempty"`
+	FamilyName   string        `json:"family_name,omitempty"`
+	Locale       string        `json:"locale,omitempty"`
+	NameVariants []NameVariant `json:"name_variants,omitempty"`
+	Email        string        `json:"email"`
+	Phone        string        `json:"phone,omitempty"`
+	Addresses    []AddressV1   `json:"addresses,omitempty"`
+	Metadata     Metadata      `json:"metadata,omitempty"`
+	Archived     bool          `json:"archived,omitempty"`
+	ExternalIDs  Metadata      `json:"external_ids,omitempty"`
+}
+
+// AddressV1 is the version 1 wire format of an Address.
+type AddressV1 struct {
+	ID            string       `json:"id"`
+	Location      string       `json:"location,omitempty"`
+	Country       string       `json:"country,omitempty"`
+	State         string       `json:"state,omitempty"`
+	Position      int          `json:"position,omitempty"`
+	CustomFields  CustomFields `json:"custom_fields,omitempty"`
+	EffectiveFrom *time.Time   `json:"effective_from,omitempty"`
+	EffectiveTo   *time.Time   `json:"effective_to,omitempty"`
+	Supersedes    string       `json:"supersedes,omitempty"`
+}
+
+// CustomerV2 is the version 2 wire format of a Customer.
+type CustomerV2 struct {
+	ID           string        `json:"id"`
+	DisplayName  string        `json:"display_name"`
+	GivenName    string        `json:"given_name,omitempty"`
+	FamilyName   string        `json:"family_name,omitempty"`
+	Locale       string        `json:"locale,omitempty"`
+	NameVariants []NameVariant `json:"name_variants,omitempty"`
+	Email        string        `json:"email"`
+	Phone        string        `json:"phone,omitempty"`
+	Addresses    []AddressV2   `json:"addresses,omitempty"`
+	Attributes   Metadata      `json:"attributes,omitempty"`
+	Archived     bool          `json:"archived,omitempty"`
+	ExternalIDs  Metadata      `json:"external_ids,omitempty"`
+}
+
+// AddressV2 is the version 2 wire format of an Address.
+type AddressV2 struct {
+	ID            string       `json:"id"`
+	Location      string       `json:"location,omitempty"`
+	Region        *RegionV2    `json:"region,omitempty"`
+	Position      int          `json:"position,omitempty"`
+	CustomFields  CustomFields `json:"custom_fields,omitempty"`
+	EffectiveFrom *time.Time   `json:"effective_from,omitempty"`
+	EffectiveTo   *time.Time   `json:"effective_to,omitempty"`
+	Supersedes    string       `json:"supersedes,omitempty"`
+}
+
+// RegionV2 is the country and state of an AddressV2.
+type RegionV2 struct {
+	Country string `json:"country,omitempty"`
+	State   string `json:"state,omitempty"`
+}
+
+// CustomerToV1 converts p to the version 1 wire format.
+func CustomerToV1(p Customer) CustomerV1 {
+	return CustomerV1{
+		ID:           p.ID,
+		Name:         p.Name,
+		GivenName:    p.GivenName,
+		FamilyName:   p.FamilyName,
+		Locale:       p.Locale,
+		NameVariants: p.NameVariants,
+		Email:        p.Email,
+		Phone:        p.Phone,
+		Addresses:    addressesToV1(p.Addresses),
+		Metadata:     p.Metadata,
+		Archived:     p.Archived,
+		ExternalIDs:  p.ExternalIDs,
+	}
+}
+
+// Customer converts c to the domain type.
+func (c CustomerV1) Customer() Customer {
+	var addresses []Address
+	if c.Addresses != nil {
+		addresses = make([]Address, len(c.Addresses))
+		for i, a := range c.Addresses {
+			addresses[i] = a.Address()
+		}
+	}
+	return Customer{
+		ID:           c.ID,
+		Name:         c.Name,
+		GivenName:    c.GivenName,
+		FamilyName:   c.FamilyName,
+		Locale:       c.Locale,
+		NameVariants: c.NameVariants,
+		Email:        c.Email,
+		Phone:        c.Phone,
+		Addresses:    addresses,
+		Metadata:     c.Metadata,
+		Archived:     c.Archived,
+		ExternalIDs:  c.ExternalIDs,
+	}
+}
+
+// AddressToV1 converts a to the version 1 wire format.
+func AddressToV1(a Address) AddressV1 {
+	return AddressV1{ID: a.ID, Location: a.Location, Country: a.Country, State: a.State, Position: a.Position, CustomFields: a.CustomFields, EffectiveFrom: a.EffectiveFrom, EffectiveTo: a.EffectiveTo, Supersedes: a.Supersedes}
+}
+
+// Address converts a to the domain type.
+func (a AddressV1) Address() Address {
+	return Address{ID: a.ID, Location: a.Location, Country: a.Country, State: a.State, Position: a.Position, CustomFields: a.CustomFields, EffectiveFrom: a.EffectiveFrom, EffectiveTo: a.EffectiveTo, Supersedes: a.Supersedes}
+}
+
+func addressesToV1(addresses []Address) []AddressV1 {
+	if addresses == nil {
+		return nil
+	}
+	v1 := make([]AddressV1, len(addresses))
+	for i, a := range addresses {
+		v1[i] = AddressToV1(a)
+	}
+	return v1
+}
+
+// CustomerToV2 converts p to the version 2 wire format.
+func CustomerToV2(p Customer) CustomerV2 {
+	return CustomerV2{
+		ID:           p.ID,
+		DisplayName:  p.Name,
+		GivenName:    p.GivenName,
+		FamilyName:   p.FamilyName,
+		Locale:       p.Locale,
+		NameVariants: p.NameVariants,
+		Email:        p.Email,
+		Phone:        p.Phone,
+		Addresses:    addressesToV2(p.Addresses),
+		Attributes:   p.Metadata,
+		Archived:     p.Archived,
+		ExternalIDs:  p.ExternalIDs,
+	}
+}
+
+// Customer converts c to the domain type.
+func (c CustomerV2) Customer() Customer {
+	var addresses []Address
+	if c.Addresses != nil {
+		addresses = make([]Address, len(c.Addresses))
+		for i, a := range c.Addresses {
+			addresses[i] = a.Address()
+		}
+	}
+	return Customer{
+		ID:           c.ID,
+		Name:         c.DisplayName,
+		GivenName:    c.GivenName,
+		FamilyName:   c.FamilyName,
+		Locale:       c.Locale,
+		NameVariants: c.NameVariants,
+		Email:        c.Email,
+		Phone:        c.Phone,
+		Addresses:    addresses,
+		Metadata:     c.Attributes,
+		Archived:     c.Archived,
+		ExternalIDs:  c.ExternalIDs,
+	}
+}
+
+// AddressToV2 converts a to the version 2 wire format.
+func AddressToV2(a Address) AddressV2 {
+	v2 := AddressV2{ID: a.ID, Location: a.Location, Position: a.Position, CustomFields: a.CustomFields, EffectiveFrom: a.EffectiveFrom, EffectiveTo: a.EffectiveTo, Supersedes: a.Supersedes}
+	if a.Country != "" || a.State != "" {
+		v2.Region = &RegionV2{Country: a.Country, State: a.State}
+	}
+	return v2
+}
+
+// Address converts a to the domain type.
+func (a AddressV2) Address() Address {
+	address := Address{ID: a.ID, Location: a.Location, Position: a.Position, CustomFields: a.CustomFields, EffectiveFrom: a.EffectiveFrom, EffectiveTo: a.EffectiveTo, Supersedes: a.Supersedes}
+	if a.Region != nil {
+		address.Country, address.State = a.Region.Country, a.Region.State
+	}
+	return address
+}
+
+func addressesToV2(addresses []Address) []AddressV2 {
+	if addresses == nil {
+		return nil
+	}
+	v2 := make([]AddressV2, len(addresses))
+	for i, a := range addresses {
+		v2[i] = AddressToV2(a)
+	}
+	return v2
+}
+
+func customersToV2(customers []Customer) []CustomerV2 {
+	if customers == nil {
+		return nil
+	}
+	v2 := make([]CustomerV2, len(customers))
+	for i, p := range customers {
+		v2[i] = CustomerToV2(p)
+	}
+	return v2
+}
+
+// MarshalJSON implements json.Marshaler, in the version 1 format.
+func (p Customer) MarshalJSON() ([]byte, error) {
+	return json.Marshal(CustomerToV1(p))
+}
+
+// UnmarshalJSON implements json.Unmarshaler, from the version 1 format.
+func (p *Customer) UnmarshalJSON(data []byte) error {
+	var v1 CustomerV1
+	if err := json.Unmarshal(data, &v1); err != nil {
+		return err
+	}
+	*p = v1.Customer()
+	return nil
+}
+
+// MarshalJSON implements json.Marshaler, in the version 1 format.
+func (a Address) MarshalJSON() ([]byte, error) {
+	return json.Marshal(AddressToV1(a))
+}
+
+// UnmarshalJSON implements json.Unmarshaler, from the version 1 format.
+func (a *Address) UnmarshalJSON(data []byte) error {
+	var v1 AddressV1
+	if err := json.Unmarshal(data, &v1); err != nil {
+		return err
+	}
+	*a = v1.Address()
+	return nil
+}
+
+// requestsV2 reports whether r asks for version 2.
+func requestsV2(r *http.Request) bool {
+	return r.Header.Get(APIVersionHeader) == "2"
+}
+
+// respondsV2 reports whether the request carrying ctx asked for version 2.
+func respondsV2(ctx context.Context) bool {
+	return RequestMetadataFrom(ctx).Get(APIVersionHeader) == "2"
+}
+
+// decodeCustomerBody is decodeBody for a customer, in the version r asks for.
+// XML has a single version.
+func decodeCustomerBody(r *http.Request, p *Customer) error {
+	if !requestsV2(r) || isXML(r.Header.Get("Content-Type")) {
+		return decodeBody(r, p)
+	}
+	var v2 CustomerV2
+	if err := json.NewDecoder(r.Body).Decode(&v2); err != nil {
+		return err
+	}
+	*p = v2.Customer()
+	return nil
+}
+
+// decodeAddressBody is decodeBody for an address, in the version r asks for.
+func decodeAddressBody(r *http.Request, a *Address) error {
+	if !requestsV2(r) || isXML(r.Header.Get("Content-Type")) {
+		return decodeBody(r, a)
+	}
+	var v2 AddressV2
+	if err := json.NewDecoder(r.Body).Decode(&v2); err != nil {
+		return err
+	}
+	*a = v2.Address()
+	return nil
+}
+
+// versioned is implemented by responses that hold customers or addresses,
+// returning themselves in the version 2 format. Only successful responses
+// are encoded, so errors are left out.
+type versioned interface {
+	v2() interface{}
+}
+
+func (r getCustomerResponse) v2() interface{} {
+	return struct {
+		Customer CustomerV2 `json:"customer,omitempty"`
+	}{CustomerToV2(r.Customer)}
+}
+
+func (r getCustomerAsOfResponse) v2() interface{} {
+	return getCustomerResponse{Customer: r.Customer}.v2()
+}
+
+func (r getCustomerByExternalIDResponse) v2() interface{} {
+	return getCustomerResponse{Customer: r.Customer}.v2()
+}
+
+func (r putCustomerResponse) v2() interface{} {
+	return optionalCustomerV2(r.Customer)
+}
+
+func (r patchCustomerResponse) v2() interface{} {
+	return optionalCustomerV2(r.Customer)
+}
+
+func optionalCustomerV2(p *Customer) interface{} {
+	var v2 *CustomerV2
+	if p != nil {
+		c := CustomerToV2(*p)
+		v2 = &c
+	}
+	return struct {
+		Customer *CustomerV2 `json:"customer,omitempty"`
+	}{v2}
+}
+
+func (r getCustomersResponse) v2() interface{} {
+	return struct {
+		Customers []CustomerV2 `json:"customers,omitempty"`
+	}{customersToV2(r.Customers)}
+}
+
+func (r customerPageResponse) v2() interface{} {
+	return struct {
+		Items      []CustomerV2 `json:"items"`
+		NextCursor string       `json:"next_cursor,omitempty"`
+		Total      *int         `json:"total,omitempty"`
+		Limit      int          `json:"limit"`
+	}{customersToV2(r.Items), r.NextCursor, r.Total, r.Limit}
+}
+
+func (r getAddressesResponse) v2() interface{} {
+	return struct {
+		Addresses []AddressV2 `json:"addresses,omitempty"`
+	}{addressesToV2(r.Addresses)}
+}
+
+func (r getAddressResponse) v2() interface{} {
+	return struct {
+		Address AddressV2 `json:"address,omitempty"`
+	}{AddressToV2(r.Address)}
+}
+
+func (r postAddressResponse) v2() interface{} {
+	return struct {
+		Address AddressV2 `json:"address,omitempty"`
+	}{AddressToV2(r.Address)}
+}
+
+func (r addressPageResponse) v2() interface{} {
+	return struct {
+		Items      []AddressV2 `json:"items"`
+		NextCursor string      `json:"next_cursor,omitempty"`
+		Total      *int        `json:"total,omitempty"`
+		Limit      int         `json:"limit"`
+	}{addressesToV2(r.Items), r.NextCursor, r.Total, r.Limit}
+}
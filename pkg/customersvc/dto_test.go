@@ -0,0 +1,209 @@
+package customersvc
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// testCustomer returns a customer with every field set, so that a field the
+// converters forget is noticed.
+func testCustomer() Customer {
+	from := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	return Customer{
+		ID:           "c1",
+		Name:         "山田 太郎",
+		GivenName:    "太郎",
+		FamilyName:   "山田",
+		Locale:       "ja-JP",
+		NameVariants: []NameVariant{{Script: "Latn", GivenName: "Taro", FamilyName: "Yamada", DisplayName: "Taro Yamada"}},
+		Email:        "taro@example.com",
+		Phone:        "+81355501234",
+		Addresses: []Address{
+			{
+				ID:            "a1",
+				Location:      "1-1 Chiyoda",
+				Country:       "JP",
+				State:         "JP-13",
+				Position:      1,
+				CustomFields:  CustomFields{"building": "North", "leave_at_door": true},
+				EffectiveFrom: &from,
+				EffectiveTo:   &to,
+				Supersedes:    "a0",
+			},
+		},
+		Metadata:    Metadata{"tier": "gold"},
+		Archived:    true,
+		ExternalIDs: Metadata{"stripe": "cus_123"},
+	}
+}
+
+func TestTestCustomerSetsEveryField(t *testing.T) {
+	p := testCustomer()
+	for _, v := range []reflect.Value{reflect.ValueOf(p), reflect.ValueOf(p.Addresses[0])} {
+		for i := 0; i < v.NumField(); i++ {
+			if isZero(v.Field(i)) {
+				t.Errorf("%s.%s isn't set: add it to testCustomer", v.Type().Name(), v.Type().Field(i).Name)
+			}
+		}
+	}
+}
+
+func isZero(v reflect.Value) bool {
+	return reflect.DeepEqual(v.Interface(), reflect.Zero(v.Type()).Interface())
+}
+
+func TestCustomerConversionRoundTrips(t *testing.T) {
+	p := testCustomer()
+	if have := CustomerToV1(p).Customer(); !reflect.DeepEqual(p, have) {
+		t.Errorf("v1: want %+v, have %+v", p, have)
+	}
+	if have := CustomerToV2(p).Customer(); !reflect.DeepEqual(p, have) {
+		t.Errorf("v2: want %+v, have %+v", p, have)
+	}
+}
+
+func TestCustomerJSONRoundTrips(t *testing.T) {
+	p := testCustomer()
+	for _, tc := range []struct {
+		name string
+		dto  interface{ Customer() Customer }
+		from interface{}
+	}{
+		{"v1", &CustomerV1{}, CustomerToV1(p)},
+		{"v2", &CustomerV2{}, CustomerToV2(p)},
+		{"domain", &CustomerV1{}, p},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			data, err := json.Marshal(tc.from)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := json.Unmarshal(data, tc.dto); err != nil {
+				t.Fatal(err)
+			}
+			if have := tc.dto.Customer(); !reflect.DeepEqual(p, have) {
+				t.Errorf("want %+v, have %+v", p, have)
+			}
+		})
+	}
+}
+
+func TestCustomerV2RenamesFields(t *testing.T) {
+	data, err := json.Marshal(CustomerToV2(testCustomer()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"display_name", "attributes"} {
+		if _, ok := fields[name]; !ok {
+			t.Errorf("%s missing from %s", name, data)
+		}
+	}
+	for _, name := range []string{"name", "metadata"} {
+		if _, ok := fields[name]; ok {
+			t.Errorf("%s, of version 1, found in %s", name, data)
+		}
+	}
+	var addresses []map[string]json.RawMessage
+	if err := json.Unmarshal(fields["addresses"], &addresses); err != nil {
+		t.Fatal(err)
+	}
+	if want, have := `{"country":"JP","state":"JP-13"}`, string(addresses[0]["region"]); want != have {
+		t.Errorf("region: want %s, have %s", want, have)
+	}
+	for _, name := range []string{"country", "state"} {
+		if _, ok := addresses[0][name]; ok {
+			t.Errorf("address %s, of version 1, found in %s", name, data)
+		}
+	}
+}
+
+func TestCustomerV1IsTheDefaultJSON(t *testing.T) {
+	p := testCustomer()
+	domain, err := json.Marshal(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v1, err := json.Marshal(CustomerToV1(p))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(domain) != string(v1) {
+		t.Errorf("want %s, have %s", v1, domain)
+	}
+	var have Customer
+	if err := json.Unmarshal(v1, &have); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(p, have) {
+		t.Errorf("want %+v, have %+v", p, have)
+	}
+}
+
+func TestAddressV2Region(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		address Address
+		region  *RegionV2
+	}{
+		{"none", Address{ID: "a"}, nil},
+		{"country", Address{ID: "a", Country: "US"}, &RegionV2{Country: "US"}},
+		{"state only", Address{ID: "a", State: "US-IL"}, &RegionV2{State: "US-IL"}},
+		{"both", Address{ID: "a", Country: "US", State: "US-IL"}, &RegionV2{Country: "US", State: "US-IL"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			v2 := AddressToV2(tc.address)
+			if !reflect.DeepEqual(tc.region, v2.Region) {
+				t.Errorf("region: want %+v, have %+v", tc.region, v2.Region)
+			}
+			if have := v2.Address(); !reflect.DeepEqual(tc.address, have) {
+				t.Errorf("want %+v, have %+v", tc.address, have)
+			}
+		})
+	}
+}
+
+func TestCustomerConversionDefaults(t *testing.T) {
+	// Absent collections stay absent, and present but empty ones empty,
+	// so that PATCH can tell "leave the addresses alone" from "remove
+	// them all".
+	for _, tc := range []struct {
+		name string
+		json string
+		v2   bool
+		want Customer
+	}{
+		{"v1 minimal", `{"id":"c1","name":"A","email":"a@example.com"}`, false, Customer{ID: "c1", Name: "A", Email: "a@example.com"}},
+		{"v2 minimal", `{"id":"c1","display_name":"A","email":"a@example.com"}`, true, Customer{ID: "c1", Name: "A", Email: "a@example.com"}},
+		{"v1 no addresses", `{"id":"c1","addresses":[]}`, false, Customer{ID: "c1", Addresses: []Address{}}},
+		{"v2 no addresses", `{"id":"c1","addresses":[]}`, true, Customer{ID: "c1", Addresses: []Address{}}},
+		{"v2 address without region", `{"id":"c1","addresses":[{"id":"a1","location":"x"}]}`, true, Customer{ID: "c1", Addresses: []Address{{ID: "a1", Location: "x"}}}},
+		{"v2 ignores v1 names", `{"id":"c1","name":"A","metadata":{"k":"v"}}`, true, Customer{ID: "c1"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var have Customer
+			var err error
+			if tc.v2 {
+				var c CustomerV2
+				err = json.Unmarshal([]byte(tc.json), &c)
+				have = c.Customer()
+			} else {
+				var c CustomerV1
+				err = json.Unmarshal([]byte(tc.json), &c)
+				have = c.Customer()
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(tc.want, have) {
+				t.Errorf("want %+v, have %+v", tc.want, have)
+			}
+		})
+	}
+}
@@ -0,0 +1,101 @@
+package customersvc
+
+import (
+	"errors"
+	"net/url"
+	"time"
+)
+
+var (
+	// ErrInvalidEffectiveDate is returned for an at parameter that's
+	// neither a date nor an RFC 3339 time.
+	ErrInvalidEffectiveDate = errors.New("at must be a date, e.g. 2023-01-01, or an RFC 3339 time")
+	// ErrInvalidEffectivePeriod is returned for an address effective until
+	// a time that isn't after the one it's effective from.
+	ErrInvalidEffectivePeriod = errors.New("effective_to must be after effective_from")
+	// ErrInvalidSupersedes is returned for an address superseding one the
+	// customer doesn't have, or one that isn't effective when it starts.
+	ErrInvalidSupersedes = errors.New("supersedes must name an address of the customer effective when the new one starts")
+)
+
+// EffectiveAt reports whether a is effective at t: from its EffectiveFrom,
+// inclusive, to its EffectiveTo, exclusive. Either bound may be open.
+func (a Address) EffectiveAt(t time.Time) bool {
+	return (a.EffectiveFrom == nil || !t.Before(*a.EffectiveFrom)) &&
+		(a.EffectiveTo == nil || t.Before(*a.EffectiveTo))
+}
+
+// AddressesAt returns the addresses effective at t, in order.
+func AddressesAt(addresses []Address, t time.Time) []Address {
+	effective := []Address{}
+	for _, a := range addresses {
+		if a.EffectiveAt(t) {
+			effective = append(effective, a)
+		}
+	}
+	return effective
+}
+
+// parseEffectiveAt parses the at parameter: a date, meaning its start in
+// UTC, or an RFC 3339 time.
+func parseEffectiveAt(s string) (time.Time, error) {
+	if t, err := time.Parse("2006-01-02", s); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		return time.Time{}, ErrInvalidEffectiveDate
+	}
+	return t, nil
+}
+
+// effectiveAtFrom returns the at parameter in q, or nil if there's none.
+func effectiveAtFrom(q url.Values) (*time.Time, error) {
+	s := q.Get("at")
+	if s == "" {
+		return nil, nil
+	}
+	t, err := parseEffectiveAt(s)
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// setEffectiveAt sets the at parameter in q to at, if given.
+func setEffectiveAt(q url.Values, at *time.Time) {
+	if at != nil {
+		q.Set("at", at.Format(time.RFC3339Nano))
+	}
+}
+
+// validatePeriod returns the problem of a's validity period, if any.
+func validatePeriod(prefix string, a Address) []FieldError {
+	if a.EffectiveFrom != nil && a.EffectiveTo != nil && !a.EffectiveTo.After(*a.EffectiveFrom) {
+		return []FieldError{fieldError(prefix+"effective_to", ErrInvalidEffectivePeriod)}
+	}
+	return nil
+}
+
+// supersede ends the address among addresses that a supersedes when a
+// starts, which is now unless a says otherwise. Addresses are never
+// overwritten by a new version: the old one stays, effective until then, so
+// that bills and tax computed for earlier dates can be reproduced. It
+// modifies addresses in place.
+func supersede(addresses []Address, a *Address, now time.Time) error {
+	if a.EffectiveFrom == nil {
+		a.EffectiveFrom = &now
+	}
+	for i := range addresses {
+		if addresses[i].ID != a.Supersedes {
+			continue
+		}
+		if !addresses[i].EffectiveAt(*a.EffectiveFrom) {
+			return ErrInvalidSupersedes
+		}
+		end := *a.EffectiveFrom
+		addresses[i].EffectiveTo = &end
+		return nil
+	}
+	return ErrInvalidSupersedes
+}
@@ -2,8 +2,10 @@ package customersvc
 
 import (
 	"context"
+	"net/http"
 	"net/url"
 	"strings"
+	"time"
 
 	"github.com/go-kit/kit/endpoint"
 	httptransport "github.com/go-kit/kit/transport/http"
@@ -33,6 +35,32 @@ type Endpoints struct {
 	GetAddressEndpoint     endpoint.Endpoint
 	PostAddressEndpoint    endpoint.Endpoint
 	DeleteAddressEndpoint  endpoint.Endpoint
+
+	GetCustomersByRegionEndpoint    endpoint.Endpoint
+	PostAddressesEndpoint           endpoint.Endpoint
+	ReorderAddressesEndpoint        endpoint.Endpoint
+	ValidateCustomerEndpoint        endpoint.Endpoint
+	ValidateAddressEndpoint         endpoint.Endpoint
+	ArchiveCustomerEndpoint         endpoint.Endpoint
+	UnarchiveCustomerEndpoint       endpoint.Endpoint
+	GetCustomersEndpoint            endpoint.Endpoint
+	GetCustomerStatsEndpoint        endpoint.Endpoint
+	PrepareCustomerEndpoint         endpoint.Endpoint
+	CommitCustomerEndpoint          endpoint.Endpoint
+	AbortCustomerEndpoint           endpoint.Endpoint
+	GetCustomerAsOfEndpoint         endpoint.Endpoint
+	GetCustomersPageEndpoint        endpoint.Endpoint
+	GetCustomerFullEndpoint         endpoint.Endpoint
+	GetAddressesPageEndpoint        endpoint.Endpoint
+	GetCustomerByExternalIDEndpoint endpoint.Endpoint
+	GrantConsentEndpoint            endpoint.Endpoint
+	WithdrawConsentEndpoint         endpoint.Endpoint
+	GetConsentsEndpoint             endpoint.Endpoint
+	GetDuplicateAddressesEndpoint   endpoint.Endpoint
+	RepairAddressesEndpoint         endpoint.Endpoint
+	RebuildIndexEndpoint            endpoint.Endpoint
+	GetIndexRebuildEndpoint         endpoint.Endpoint
+	CheckConsistencyEndpoint        endpoint.Endpoint
 }
 
 // MakeServerEndpoints returns an Endpoints struct where each endpoint invokes
@@ -49,13 +77,82 @@ func MakeServerEndpoints(s Service) Endpoints {
 		GetAddressEndpoint:     MakeGetAddressEndpoint(s),
 		PostAddressEndpoint:    MakePostAddressEndpoint(s),
 		DeleteAddressEndpoint:  MakeDeleteAddressEndpoint(s),
+
+		GetCustomersByRegionEndpoint:    MakeGetCustomersByRegionEndpoint(s),
+		PostAddressesEndpoint:           MakePostAddressesEndpoint(s),
+		ReorderAddressesEndpoint:        MakeReorderAddressesEndpoint(s),
+		ValidateCustomerEndpoint:        MakeValidateCustomerEndpoint(s),
+		ValidateAddressEndpoint:         MakeValidateAddressEndpoint(s),
+		ArchiveCustomerEndpoint:         MakeArchiveCustomerEndpoint(s),
+		UnarchiveCustomerEndpoint:       MakeUnarchiveCustomerEndpoint(s),
+		GetCustomersEndpoint:            MakeGetCustomersEndpoint(s),
+		GetCustomerStatsEndpoint:        MakeGetCustomerStatsEndpoint(s),
+		PrepareCustomerEndpoint:         MakePrepareCustomerEndpoint(s),
+		CommitCustomerEndpoint:          MakeCommitCustomerEndpoint(s),
+		AbortCustomerEndpoint:           MakeAbortCustomerEndpoint(s),
+		GetCustomerAsOfEndpoint:         MakeGetCustomerAsOfEndpoint(s),
+		GetCustomersPageEndpoint:        MakeGetCustomersPageEndpoint(s),
+		GetCustomerFullEndpoint:         MakeGetCustomerFullEndpoint(s),
+		GetAddressesPageEndpoint:        MakeGetAddressesPageEndpoint(s),
+		GetCustomerByExternalIDEndpoint: MakeGetCustomerByExternalIDEndpoint(s),
+		GrantConsentEndpoint:            MakeGrantConsentEndpoint(s),
+		WithdrawConsentEndpoint:         MakeWithdrawConsentEndpoint(s),
+		GetConsentsEndpoint:             MakeGetConsentsEndpoint(s),
+		GetDuplicateAddressesEndpoint:   MakeGetDuplicateAddressesEndpoint(s),
+		RepairAddressesEndpoint:         MakeRepairAddressesEndpoint(s),
+		RebuildIndexEndpoint:            MakeRebuildIndexEndpoint(s),
+		GetIndexRebuildEndpoint:         MakeGetIndexRebuildEndpoint(s),
+		CheckConsistencyEndpoint:        MakeCheckConsistencyEndpoint(s),
+	}
+}
+
+// Wrap returns a copy of e with every endpoint wrapped in the middleware
+// returned by mw for that endpoint's method name.
+func (e Endpoints) Wrap(mw func(method string) endpoint.Middleware) Endpoints {
+	return Endpoints{
+		PostCustomerEndpoint:   mw("PostCustomer")(e.PostCustomerEndpoint),
+		GetCustomerEndpoint:    mw("GetCustomer")(e.GetCustomerEndpoint),
+		PutCustomerEndpoint:    mw("PutCustomer")(e.PutCustomerEndpoint),
+		PatchCustomerEndpoint:  mw("PatchCustomer")(e.PatchCustomerEndpoint),
+		DeleteCustomerEndpoint: mw("DeleteCustomer")(e.DeleteCustomerEndpoint),
+		GetAddressesEndpoint:   mw("GetAddresses")(e.GetAddressesEndpoint),
+		GetAddressEndpoint:     mw("GetAddress")(e.GetAddressEndpoint),
+		PostAddressEndpoint:    mw("PostAddress")(e.PostAddressEndpoint),
+		DeleteAddressEndpoint:  mw("DeleteAddress")(e.DeleteAddressEndpoint),
+
+		GetCustomersByRegionEndpoint:    mw("GetCustomersByRegion")(e.GetCustomersByRegionEndpoint),
+		PostAddressesEndpoint:           mw("PostAddresses")(e.PostAddressesEndpoint),
+		ReorderAddressesEndpoint:        mw("ReorderAddresses")(e.ReorderAddressesEndpoint),
+		ValidateCustomerEndpoint:        mw("ValidateCustomer")(e.ValidateCustomerEndpoint),
+		ValidateAddressEndpoint:         mw("ValidateAddress")(e.ValidateAddressEndpoint),
+		ArchiveCustomerEndpoint:         mw("ArchiveCustomer")(e.ArchiveCustomerEndpoint),
+		UnarchiveCustomerEndpoint:       mw("UnarchiveCustomer")(e.UnarchiveCustomerEndpoint),
+		GetCustomersEndpoint:            mw("GetCustomers")(e.GetCustomersEndpoint),
+		GetCustomerStatsEndpoint:        mw("GetCustomerStats")(e.GetCustomerStatsEndpoint),
+		PrepareCustomerEndpoint:         mw("PrepareCustomer")(e.PrepareCustomerEndpoint),
+		CommitCustomerEndpoint:          mw("CommitCustomer")(e.CommitCustomerEndpoint),
+		AbortCustomerEndpoint:           mw("AbortCustomer")(e.AbortCustomerEndpoint),
+		GetCustomerAsOfEndpoint:         mw("GetCustomerAsOf")(e.GetCustomerAsOfEndpoint),
+		GetCustomersPageEndpoint:        mw("GetCustomersPage")(e.GetCustomersPageEndpoint),
+		GetCustomerFullEndpoint:         mw("GetCustomerFull")(e.GetCustomerFullEndpoint),
+		GetAddressesPageEndpoint:        mw("GetAddressesPage")(e.GetAddressesPageEndpoint),
+		GetCustomerByExternalIDEndpoint: mw("GetCustomerByExternalID")(e.GetCustomerByExternalIDEndpoint),
+		GrantConsentEndpoint:            mw("GrantConsent")(e.GrantConsentEndpoint),
+		WithdrawConsentEndpoint:         mw("WithdrawConsent")(e.WithdrawConsentEndpoint),
+		GetConsentsEndpoint:             mw("GetConsents")(e.GetConsentsEndpoint),
+		GetDuplicateAddressesEndpoint:   mw("GetDuplicateAddresses")(e.GetDuplicateAddressesEndpoint),
+		RepairAddressesEndpoint:         mw("RepairAddresses")(e.RepairAddressesEndpoint),
+		RebuildIndexEndpoint:            mw("RebuildIndex")(e.RebuildIndexEndpoint),
+		GetIndexRebuildEndpoint:         mw("GetIndexRebuild")(e.GetIndexRebuildEndpoint),
+		CheckConsistencyEndpoint:        mw("CheckConsistency")(e.CheckConsistencyEndpoint),
 	}
 }
 
 // MakeClientEndpoints returns an Endpoints struct where each endpoint invokes
 // the corresponding method on the remote instance, via a transport/http.Client.
-// Useful in a customersvc client.
-func MakeClientEndpoints(instance string) (Endpoints, error) {
+// Useful in a customersvc client. Options such as ClientAPIKey apply to every
+// endpoint.
+func MakeClientEndpoints(instance string, options ...httptransport.ClientOption) (Endpoints, error) {
 	if !strings.HasPrefix(instance, "http") {
 		instance = "http://" + instance
 	}
@@ -65,22 +162,46 @@ func MakeClientEndpoints(instance string) (Endpoints, error) {
 	}
 	tgt.Path = ""
 
-	options := []httptransport.ClientOption{}
-
 	// Note that the request encoders need to modify the request URL, changing
 	// the path. That's fine: we simply need to provide specific encoders for
 	// each endpoint.
 
 	return Endpoints{
-		PostCustomerEndpoint:   httptransport.NewClient("POST", tgt, encodePostCustomerRequest, decodePostCustomerResponse, options...).Endpoint(),
-		GetCustomerEndpoint:    httptransport.NewClient("GET", tgt, encodeGetCustomerRequest, decodeGetCustomerResponse, options...).Endpoint(),
-		PutCustomerEndpoint:    httptransport.NewClient("PUT", tgt, encodePutCustomerRequest, decodePutCustomerResponse, options...).Endpoint(),
-		PatchCustomerEndpoint:  httptransport.NewClient("PATCH", tgt, encodePatchCustomerRequest, decodePatchCustomerResponse, options...).Endpoint(),
-		DeleteCustomerEndpoint: httptransport.NewClient("DELETE", tgt, encodeDeleteCustomerRequest, decodeDeleteCustomerResponse, options...).Endpoint(),
-		GetAddressesEndpoint:   httptransport.NewClient("GET", tgt, encodeGetAddressesRequest, decodeGetAddressesResponse, options...).Endpoint(),
-		GetAddressEndpoint:     httptransport.NewClient("GET", tgt, encodeGetAddressRequest, decodeGetAddressResponse, options...).Endpoint(),
-		PostAddressEndpoint:    httptransport.NewClient("POST", tgt, encodePostAddressRequest, decodePostAddressResponse, options...).Endpoint(),
-		DeleteAddressEndpoint:  httptransport.NewClient("DELETE", tgt, encodeDeleteAddressRequest, decodeDeleteAddressResponse, options...).Endpoint(),
+		PostCustomerEndpoint:   httptransport.NewClient("POST", tgt, encodePostCustomerRequest, decodeBackoff(decodePostCustomerResponse), options...).Endpoint(),
+		GetCustomerEndpoint:    httptransport.NewClient("GET", tgt, encodeGetCustomerRequest, decodeBackoff(decodeGetCustomerResponse), options...).Endpoint(),
+		PutCustomerEndpoint:    httptransport.NewClient("PUT", tgt, encodePutCustomerRequest, decodeBackoff(decodePutCustomerResponse), options...).Endpoint(),
+		PatchCustomerEndpoint:  httptransport.NewClient("PATCH", tgt, encodePatchCustomerRequest, decodeBackoff(decodePatchCustomerResponse), options...).Endpoint(),
+		DeleteCustomerEndpoint: httptransport.NewClient("DELETE", tgt, encodeDeleteCustomerRequest, decodeBackoff(decodeDeleteCustomerResponse), options...).Endpoint(),
+		GetAddressesEndpoint:   httptransport.NewClient("GET", tgt, encodeGetAddressesRequest, decodeBackoff(decodeGetAddressesResponse), options...).Endpoint(),
+		GetAddressEndpoint:     httptransport.NewClient("GET", tgt, encodeGetAddressRequest, decodeBackoff(decodeGetAddressResponse), options...).Endpoint(),
+		PostAddressEndpoint:    httptransport.NewClient("POST", tgt, encodePostAddressRequest, decodeBackoff(decodePostAddressResponse), options...).Endpoint(),
+		DeleteAddressEndpoint:  httptransport.NewClient("DELETE", tgt, encodeDeleteAddressRequest, decodeBackoff(decodeDeleteAddressResponse), options...).Endpoint(),
+
+		GetCustomersByRegionEndpoint:    httptransport.NewClient("GET", tgt, encodeGetCustomersByRegionRequest, decodeBackoff(decodeGetCustomersByRegionResponse), options...).Endpoint(),
+		PostAddressesEndpoint:           httptransport.NewClient("POST", tgt, encodePostAddressesRequest, decodeBackoff(decodePostAddressesResponse), options...).Endpoint(),
+		ReorderAddressesEndpoint:        httptransport.NewClient("PUT", tgt, encodeReorderAddressesRequest, decodeBackoff(decodeReorderAddressesResponse), options...).Endpoint(),
+		ValidateCustomerEndpoint:        httptransport.NewClient("POST", tgt, encodeValidateCustomerRequest, decodeBackoff(decodeValidateCustomerResponse), options...).Endpoint(),
+		ValidateAddressEndpoint:         httptransport.NewClient("POST", tgt, encodeValidateAddressRequest, decodeBackoff(decodeValidateAddressResponse), options...).Endpoint(),
+		ArchiveCustomerEndpoint:         httptransport.NewClient("POST", tgt, encodeArchiveCustomerRequest, decodeBackoff(decodeArchiveCustomerResponse), options...).Endpoint(),
+		UnarchiveCustomerEndpoint:       httptransport.NewClient("POST", tgt, encodeUnarchiveCustomerRequest, decodeBackoff(decodeUnarchiveCustomerResponse), options...).Endpoint(),
+		GetCustomersEndpoint:            httptransport.NewClient("GET", tgt, encodeGetCustomersRequest, decodeBackoff(decodeGetCustomersResponse), options...).Endpoint(),
+		GetCustomerStatsEndpoint:        httptransport.NewClient("GET", tgt, encodeGetCustomerStatsRequest, decodeBackoff(decodeGetCustomerStatsResponse), options...).Endpoint(),
+		PrepareCustomerEndpoint:         httptransport.NewClient("POST", tgt, encodePrepareCustomerRequest, decodeBackoff(decodePrepareCustomerResponse), options...).Endpoint(),
+		CommitCustomerEndpoint:          httptransport.NewClient("POST", tgt, encodeCommitCustomerRequest, decodeBackoff(decodeCommitCustomerResponse), options...).Endpoint(),
+		AbortCustomerEndpoint:           httptransport.NewClient("POST", tgt, encodeAbortCustomerRequest, decodeBackoff(decodeAbortCustomerResponse), options...).Endpoint(),
+		GetCustomerAsOfEndpoint:         httptransport.NewClient("GET", tgt, encodeGetCustomerAsOfRequest, decodeBackoff(decodeGetCustomerAsOfResponse), options...).Endpoint(),
+		GetCustomersPageEndpoint:        httptransport.NewClient("GET", tgt, encodeGetCustomersPageRequest, decodeBackoff(decodeCustomerPageResponse), options...).Endpoint(),
+		GetCustomerFullEndpoint:         httptransport.NewClient("GET", tgt, encodeGetCustomerFullRequest, decodeBackoff(decodeGetCustomerFullResponse), options...).Endpoint(),
+		GetAddressesPageEndpoint:        httptransport.NewClient("GET", tgt, encodeGetAddressesPageRequest, decodeBackoff(decodeAddressPageResponse), options...).Endpoint(),
+		GetCustomerByExternalIDEndpoint: httptransport.NewClient("GET", tgt, encodeGetCustomerByExternalIDRequest, decodeBackoff(decodeGetCustomerByExternalIDResponse), options...).Endpoint(),
+		GrantConsentEndpoint:            httptransport.NewClient("POST", tgt, encodeGrantConsentRequest, decodeBackoff(decodeGrantConsentResponse), options...).Endpoint(),
+		WithdrawConsentEndpoint:         httptransport.NewClient("DELETE", tgt, encodeWithdrawConsentRequest, decodeBackoff(decodeWithdrawConsentResponse), options...).Endpoint(),
+		GetConsentsEndpoint:             httptransport.NewClient("GET", tgt, encodeGetConsentsRequest, decodeBackoff(decodeGetConsentsResponse), options...).Endpoint(),
+		GetDuplicateAddressesEndpoint:   httptransport.NewClient("GET", tgt, encodeGetDuplicateAddressesRequest, decodeBackoff(decodeGetDuplicateAddressesResponse), options...).Endpoint(),
+		RepairAddressesEndpoint:         httptransport.NewClient("POST", tgt, encodeRepairAddressesRequest, decodeBackoff(decodeRepairAddressesResponse), options...).Endpoint(),
+		RebuildIndexEndpoint:            httptransport.NewClient("POST", tgt, encodeRebuildIndexRequest, decodeBackoff(decodeRebuildIndexResponse), options...).Endpoint(),
+		GetIndexRebuildEndpoint:         httptransport.NewClient("GET", tgt, encodeGetIndexRebuildRequest, decodeBackoff(decodeRebuildIndexResponse), options...).Endpoint(),
+		CheckConsistencyEndpoint:        httptransport.NewClient("POST", tgt, encodeCheckConsistencyRequest, decodeBackoff(decodeCheckConsistencyResponse), options...).Endpoint(),
 	}, nil
 }
 
@@ -97,7 +218,7 @@ func (e Endpoints) PostCustomer(ctx context.Context, p Customer) error {
 
 // GetCustomer implements Service. Primarily useful in a client.
 func (e Endpoints) GetCustomer(ctx context.Context, id string) (Customer, error) {
-	request := getCustomerRequest{ID: id}
+	request := getCustomerRequest{ID: id, OmitAddresses: AddressesOmitted(ctx)}
 	response, err := e.GetCustomerEndpoint(ctx, request)
 	if err != nil {
 		return Customer{}, err
@@ -108,7 +229,7 @@ func (e Endpoints) GetCustomer(ctx context.Context, id string) (Customer, error)
 
 // PutCustomer implements Service. Primarily useful in a client.
 func (e Endpoints) PutCustomer(ctx context.Context, id string, p Customer) error {
-	request := putCustomerRequest{ID: id, Customer: p}
+	request := putCustomerRequest{ID: id, Customer: p, Addresses: AddressWriteFrom(ctx)}
 	response, err := e.PutCustomerEndpoint(ctx, request)
 	if err != nil {
 		return err
@@ -128,6 +249,42 @@ func (e Endpoints) PatchCustomer(ctx context.Context, id string, p Customer) err
 	return resp.Err
 }
 
+// PutCustomerAndGet is PutCustomer, returning the customer as stored, which
+// may differ from p after normalization, without a follow-up GetCustomer.
+func (e Endpoints) PutCustomerAndGet(ctx context.Context, id string, p Customer) (Customer, error) {
+	request := putCustomerRequest{ID: id, Customer: p, Return: true, Addresses: AddressWriteFrom(ctx)}
+	response, err := e.PutCustomerEndpoint(ctx, request)
+	if err != nil {
+		return Customer{}, err
+	}
+	resp := response.(putCustomerResponse)
+	if resp.Err != nil {
+		return Customer{}, resp.Err
+	}
+	if resp.Customer == nil {
+		return Customer{}, ErrNoRepresentation
+	}
+	return *resp.Customer, nil
+}
+
+// PatchCustomerAndGet is PatchCustomer, returning the customer with the patch
+// applied, without a follow-up GetCustomer.
+func (e Endpoints) PatchCustomerAndGet(ctx context.Context, id string, p Customer) (Customer, error) {
+	request := patchCustomerRequest{ID: id, Customer: p, Return: true}
+	response, err := e.PatchCustomerEndpoint(ctx, request)
+	if err != nil {
+		return Customer{}, err
+	}
+	resp := response.(patchCustomerResponse)
+	if resp.Err != nil {
+		return Customer{}, resp.Err
+	}
+	if resp.Customer == nil {
+		return Customer{}, ErrNoRepresentation
+	}
+	return *resp.Customer, nil
+}
+
 // DeleteCustomer implements Service. Primarily useful in a client.
 func (e Endpoints) DeleteCustomer(ctx context.Context, id string) error {
 	request := deleteCustomerRequest{ID: id}
@@ -150,6 +307,18 @@ func (e Endpoints) GetAddresses(ctx context.Context, customerID string) ([]Addre
 	return resp.Addresses, resp.Err
 }
 
+// GetAddressesAt returns the customer's addresses effective at t, see
+// Address.EffectiveAt. Primarily useful in a client.
+func (e Endpoints) GetAddressesAt(ctx context.Context, customerID string, t time.Time) ([]Address, error) {
+	request := getAddressesRequest{CustomerID: customerID, At: &t}
+	response, err := e.GetAddressesEndpoint(ctx, request)
+	if err != nil {
+		return nil, err
+	}
+	resp := response.(getAddressesResponse)
+	return resp.Addresses, resp.Err
+}
+
 // GetAddress implements Service. Primarily useful in a client.
 func (e Endpoints) GetAddress(ctx context.Context, customerID string, addressID string) (Address, error) {
 	request := getAddressRequest{CustomerID: customerID, AddressID: addressID}
@@ -162,14 +331,14 @@ func (e Endpoints) GetAddress(ctx context.Context, customerID string, addressID
 }
 
 // PostAddress implements Service. Primarily useful in a client.
-func (e Endpoints) PostAddress(ctx context.Context, customerID string, a Address) error {
+func (e Endpoints) PostAddress(ctx context.Context, customerID string, a Address) (Address, error) {
 	request := postAddressRequest{CustomerID: customerID, Address: a}
 	response, err := e.PostAddressEndpoint(ctx, request)
 	if err != nil {
-		return err
+		return Address{}, err
 	}
 	resp := response.(postAddressResponse)
-	return resp.Err
+	return resp.Address, resp.Err
 }
 
 // DeleteAddress implements Service. Primarily useful in a client.
@@ -183,6 +352,248 @@ func (e Endpoints) DeleteAddress(ctx context.Context, customerID string, address
 	return resp.Err
 }
 
+// GetCustomersByRegion implements Service. Primarily useful in a client.
+func (e Endpoints) GetCustomersByRegion(ctx context.Context) ([]RegionCount, error) {
+	request := getCustomersByRegionRequest{}
+	response, err := e.GetCustomersByRegionEndpoint(ctx, request)
+	if err != nil {
+		return nil, err
+	}
+	resp := response.(getCustomersByRegionResponse)
+	return resp.Regions, resp.Err
+}
+
+// PostAddresses implements Service. Primarily useful in a client.
+func (e Endpoints) PostAddresses(ctx context.Context, customerID string, as []Address) ([]AddressResult, error) {
+	request := postAddressesRequest{CustomerID: customerID, Addresses: as}
+	response, err := e.PostAddressesEndpoint(ctx, request)
+	if err != nil {
+		return nil, err
+	}
+	resp := response.(postAddressesResponse)
+	return resp.Results, resp.Err
+}
+
+// ReorderAddresses implements Service. Primarily useful in a client.
+func (e Endpoints) ReorderAddresses(ctx context.Context, customerID string, addressIDs []string) error {
+	request := reorderAddressesRequest{CustomerID: customerID, AddressIDs: addressIDs}
+	response, err := e.ReorderAddressesEndpoint(ctx, request)
+	if err != nil {
+		return err
+	}
+	resp := response.(reorderAddressesResponse)
+	return resp.Err
+}
+
+// ValidateCustomer implements Service. Primarily useful in a client.
+func (e Endpoints) ValidateCustomer(ctx context.Context, p Customer) ([]FieldError, error) {
+	request := validateCustomerRequest{Customer: p}
+	response, err := e.ValidateCustomerEndpoint(ctx, request)
+	if err != nil {
+		return nil, err
+	}
+	resp := response.(validateCustomerResponse)
+	return resp.Errors, resp.Err
+}
+
+// ValidateAddress implements Service. Primarily useful in a client.
+func (e Endpoints) ValidateAddress(ctx context.Context, customerID string, a Address) ([]FieldError, error) {
+	request := validateAddressRequest{CustomerID: customerID, Address: a}
+	response, err := e.ValidateAddressEndpoint(ctx, request)
+	if err != nil {
+		return nil, err
+	}
+	resp := response.(validateAddressResponse)
+	return resp.Errors, resp.Err
+}
+
+// ArchiveCustomer implements Service. Primarily useful in a client.
+func (e Endpoints) ArchiveCustomer(ctx context.Context, id string) error {
+	request := archiveCustomerRequest{ID: id}
+	response, err := e.ArchiveCustomerEndpoint(ctx, request)
+	if err != nil {
+		return err
+	}
+	resp := response.(archiveCustomerResponse)
+	return resp.Err
+}
+
+// UnarchiveCustomer implements Service. Primarily useful in a client.
+func (e Endpoints) UnarchiveCustomer(ctx context.Context, id string) error {
+	request := unarchiveCustomerRequest{ID: id}
+	response, err := e.UnarchiveCustomerEndpoint(ctx, request)
+	if err != nil {
+		return err
+	}
+	resp := response.(unarchiveCustomerResponse)
+	return resp.Err
+}
+
+// GetCustomers implements Service. Primarily useful in a client.
+func (e Endpoints) GetCustomers(ctx context.Context, f CustomerFilter) ([]Customer, error) {
+	request := getCustomersRequest{Filter: f, OmitAddresses: AddressesOmitted(ctx)}
+	response, err := e.GetCustomersEndpoint(ctx, request)
+	if err != nil {
+		return nil, err
+	}
+	resp := response.(getCustomersResponse)
+	return resp.Customers, resp.Err
+}
+
+// GetCustomerStats implements Service. Primarily useful in a client.
+func (e Endpoints) GetCustomerStats(ctx context.Context, id string) (CustomerStats, error) {
+	request := getCustomerStatsRequest{ID: id}
+	response, err := e.GetCustomerStatsEndpoint(ctx, request)
+	if err != nil {
+		return CustomerStats{}, err
+	}
+	resp := response.(getCustomerStatsResponse)
+	return resp.Stats, resp.Err
+}
+
+// PrepareCustomer implements Service. Primarily useful in a client.
+func (e Endpoints) PrepareCustomer(ctx context.Context, p Customer, ttl time.Duration) (PendingCustomer, error) {
+	request := prepareCustomerRequest{Customer: p, TTL: ttl}
+	response, err := e.PrepareCustomerEndpoint(ctx, request)
+	if err != nil {
+		return PendingCustomer{}, err
+	}
+	resp := response.(prepareCustomerResponse)
+	return resp.Pending, resp.Err
+}
+
+// CommitCustomer implements Service. Primarily useful in a client.
+func (e Endpoints) CommitCustomer(ctx context.Context, id string) error {
+	request := commitCustomerRequest{ID: id}
+	response, err := e.CommitCustomerEndpoint(ctx, request)
+	if err != nil {
+		return err
+	}
+	resp := response.(commitCustomerResponse)
+	return resp.Err
+}
+
+// AbortCustomer implements Service. Primarily useful in a client.
+func (e Endpoints) AbortCustomer(ctx context.Context, id string) error {
+	request := abortCustomerRequest{ID: id}
+	response, err := e.AbortCustomerEndpoint(ctx, request)
+	if err != nil {
+		return err
+	}
+	resp := response.(abortCustomerResponse)
+	return resp.Err
+}
+
+// GetCustomerAsOf implements Service. Primarily useful in a client.
+func (e Endpoints) GetCustomerAsOf(ctx context.Context, id string, t time.Time) (Customer, error) {
+	request := getCustomerAsOfRequest{ID: id, AsOf: t}
+	response, err := e.GetCustomerAsOfEndpoint(ctx, request)
+	if err != nil {
+		return Customer{}, err
+	}
+	resp := response.(getCustomerAsOfResponse)
+	return resp.Customer, resp.Err
+}
+
+// GetCustomerByExternalID implements Service. Primarily useful in a client.
+func (e Endpoints) GetCustomerByExternalID(ctx context.Context, system string, externalID string) (Customer, error) {
+	request := getCustomerByExternalIDRequest{System: system, ExternalID: externalID}
+	response, err := e.GetCustomerByExternalIDEndpoint(ctx, request)
+	if err != nil {
+		return Customer{}, err
+	}
+	resp := response.(getCustomerByExternalIDResponse)
+	return resp.Customer, resp.Err
+}
+
+// GrantConsent implements Service. Primarily useful in a client.
+func (e Endpoints) GrantConsent(ctx context.Context, customerID string, c Consent) (Consent, error) {
+	request := grantConsentRequest{CustomerID: customerID, Consent: c}
+	response, err := e.GrantConsentEndpoint(ctx, request)
+	if err != nil {
+		return Consent{}, err
+	}
+	resp := response.(grantConsentResponse)
+	return resp.Consent, resp.Err
+}
+
+// WithdrawConsent implements Service. Primarily useful in a client.
+func (e Endpoints) WithdrawConsent(ctx context.Context, customerID string, consentType string) error {
+	request := withdrawConsentRequest{CustomerID: customerID, Type: consentType}
+	response, err := e.WithdrawConsentEndpoint(ctx, request)
+	if err != nil {
+		return err
+	}
+	resp := response.(withdrawConsentResponse)
+	return resp.Err
+}
+
+// GetConsents implements Service. Primarily useful in a client.
+func (e Endpoints) GetConsents(ctx context.Context, customerID string) ([]Consent, error) {
+	request := getConsentsRequest{CustomerID: customerID}
+	response, err := e.GetConsentsEndpoint(ctx, request)
+	if err != nil {
+		return nil, err
+	}
+	resp := response.(getConsentsResponse)
+	return resp.Consents, resp.Err
+}
+
+// GetDuplicateAddresses implements Service. Primarily useful in a client.
+func (e Endpoints) GetDuplicateAddresses(ctx context.Context) ([]DuplicateAddresses, error) {
+	request := getDuplicateAddressesRequest{}
+	response, err := e.GetDuplicateAddressesEndpoint(ctx, request)
+	if err != nil {
+		return nil, err
+	}
+	resp := response.(getDuplicateAddressesResponse)
+	return resp.Duplicates, resp.Err
+}
+
+// RepairAddresses implements Service. Primarily useful in a client.
+func (e Endpoints) RepairAddresses(ctx context.Context, dryRun bool) ([]AddressRepair, error) {
+	request := repairAddressesRequest{DryRun: dryRun}
+	response, err := e.RepairAddressesEndpoint(ctx, request)
+	if err != nil {
+		return nil, err
+	}
+	resp := response.(repairAddressesResponse)
+	return resp.Repairs, resp.Err
+}
+
+// RebuildIndex implements Service. Primarily useful in a client.
+func (e Endpoints) RebuildIndex(ctx context.Context, index string) (IndexRebuild, error) {
+	request := rebuildIndexRequest{Index: index}
+	response, err := e.RebuildIndexEndpoint(ctx, request)
+	if err != nil {
+		return IndexRebuild{}, err
+	}
+	resp := response.(rebuildIndexResponse)
+	return resp.Rebuild, resp.Err
+}
+
+// GetIndexRebuild implements Service. Primarily useful in a client.
+func (e Endpoints) GetIndexRebuild(ctx context.Context, index string) (IndexRebuild, error) {
+	request := getIndexRebuildRequest{Index: index}
+	response, err := e.GetIndexRebuildEndpoint(ctx, request)
+	if err != nil {
+		return IndexRebuild{}, err
+	}
+	resp := response.(rebuildIndexResponse)
+	return resp.Rebuild, resp.Err
+}
+
+// CheckConsistency implements Service. Primarily useful in a client.
+func (e Endpoints) CheckConsistency(ctx context.Context, repair bool) (ConsistencyReport, error) {
+	request := checkConsistencyRequest{Repair: repair}
+	response, err := e.CheckConsistencyEndpoint(ctx, request)
+	if err != nil {
+		return ConsistencyReport{}, err
+	}
+	resp := response.(checkConsistencyResponse)
+	return resp.Report, resp.Err
+}
+
 // MakePostCustomerEndpoint returns an endpoint via the passed service.
 // Primarily useful in a server.
 func MakePostCustomerEndpoint(s Service) endpoint.Endpoint {
@@ -198,7 +609,13 @@ func MakePostCustomerEndpoint(s Service) endpoint.Endpoint {
 func MakeGetCustomerEndpoint(s Service) endpoint.Endpoint {
 	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
 		req := request.(getCustomerRequest)
+		if req.OmitAddresses {
+			ctx = WithoutAddresses(ctx)
+		}
 		p, e := s.GetCustomer(ctx, req.ID)
+		if req.OmitAddresses {
+			p.Addresses = nil
+		}
 		return getCustomerResponse{Customer: p, Err: e}, nil
 	}
 }
@@ -208,8 +625,15 @@ func MakeGetCustomerEndpoint(s Service) endpoint.Endpoint {
 func MakePutCustomerEndpoint(s Service) endpoint.Endpoint {
 	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
 		req := request.(putCustomerRequest)
+		if req.Addresses != AddressesByAuthority {
+			ctx = WithAddressWrite(ctx, req.Addresses)
+		}
 		e := s.PutCustomer(ctx, req.ID, req.Customer)
-		return putCustomerResponse{Err: e}, nil
+		if e != nil || !req.Return {
+			return putCustomerResponse{Err: e}, nil
+		}
+		p, e := s.GetCustomer(ctx, req.ID)
+		return putCustomerResponse{Customer: &p, Err: e}, nil
 	}
 }
 
@@ -219,7 +643,11 @@ func MakePatchCustomerEndpoint(s Service) endpoint.Endpoint {
 	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
 		req := request.(patchCustomerRequest)
 		e := s.PatchCustomer(ctx, req.ID, req.Customer)
-		return patchCustomerResponse{Err: e}, nil
+		if e != nil || !req.Return {
+			return patchCustomerResponse{Err: e}, nil
+		}
+		p, e := s.GetCustomer(ctx, req.ID)
+		return patchCustomerResponse{Customer: &p, Err: e}, nil
 	}
 }
 
@@ -239,6 +667,9 @@ func MakeGetAddressesEndpoint(s Service) endpoint.Endpoint {
 	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
 		req := request.(getAddressesRequest)
 		a, e := s.GetAddresses(ctx, req.CustomerID)
+		if e == nil && req.At != nil {
+			a = AddressesAt(a, *req.At)
+		}
 		return getAddressesResponse{Addresses: a, Err: e}, nil
 	}
 }
@@ -258,8 +689,8 @@ func MakeGetAddressEndpoint(s Service) endpoint.Endpoint {
 func MakePostAddressEndpoint(s Service) endpoint.Endpoint {
 	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
 		req := request.(postAddressRequest)
-		e := s.PostAddress(ctx, req.CustomerID, req.Address)
-		return postAddressResponse{Err: e}, nil
+		a, e := s.PostAddress(ctx, req.CustomerID, req.Address)
+		return postAddressResponse{Address: a, Err: e}, nil
 	}
 }
 
@@ -273,6 +704,230 @@ func MakeDeleteAddressEndpoint(s Service) endpoint.Endpoint {
 	}
 }
 
+// MakeGetCustomersByRegionEndpoint returns an endpoint via the passed service.
+// Primarily useful in a server.
+func MakeGetCustomersByRegionEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		r, e := s.GetCustomersByRegion(ctx)
+		return getCustomersByRegionResponse{Regions: r, Err: e}, nil
+	}
+}
+
+// MakePostAddressesEndpoint returns an endpoint via the passed service.
+// Primarily useful in a server.
+func MakePostAddressesEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(postAddressesRequest)
+		r, e := s.PostAddresses(ctx, req.CustomerID, req.Addresses)
+		return postAddressesResponse{Results: r, Err: e}, nil
+	}
+}
+
+// MakeReorderAddressesEndpoint returns an endpoint via the passed service.
+// Primarily useful in a server.
+func MakeReorderAddressesEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(reorderAddressesRequest)
+		e := s.ReorderAddresses(ctx, req.CustomerID, req.AddressIDs)
+		return reorderAddressesResponse{Err: e}, nil
+	}
+}
+
+// MakeValidateCustomerEndpoint returns an endpoint via the passed service.
+// Primarily useful in a server.
+func MakeValidateCustomerEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(validateCustomerRequest)
+		r, e := s.ValidateCustomer(ctx, req.Customer)
+		return validateCustomerResponse{Valid: e == nil && len(r) == 0, Errors: r, Err: e}, nil
+	}
+}
+
+// MakeValidateAddressEndpoint returns an endpoint via the passed service.
+// Primarily useful in a server.
+func MakeValidateAddressEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(validateAddressRequest)
+		r, e := s.ValidateAddress(ctx, req.CustomerID, req.Address)
+		return validateAddressResponse{Valid: e == nil && len(r) == 0, Errors: r, Err: e}, nil
+	}
+}
+
+// MakeArchiveCustomerEndpoint returns an endpoint via the passed service.
+// Primarily useful in a server.
+func MakeArchiveCustomerEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(archiveCustomerRequest)
+		e := s.ArchiveCustomer(ctx, req.ID)
+		return archiveCustomerResponse{Err: e}, nil
+	}
+}
+
+// MakeUnarchiveCustomerEndpoint returns an endpoint via the passed service.
+// Primarily useful in a server.
+func MakeUnarchiveCustomerEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(unarchiveCustomerRequest)
+		e := s.UnarchiveCustomer(ctx, req.ID)
+		return unarchiveCustomerResponse{Err: e}, nil
+	}
+}
+
+// MakeGetCustomersEndpoint returns an endpoint via the passed service.
+// Primarily useful in a server.
+func MakeGetCustomersEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(getCustomersRequest)
+		if req.OmitAddresses {
+			ctx = WithoutAddresses(ctx)
+		}
+		r, e := s.GetCustomers(ctx, req.Filter)
+		if req.OmitAddresses {
+			r = withoutAddresses(r)
+		}
+		return getCustomersResponse{Customers: r, Err: e}, nil
+	}
+}
+
+// MakeGetCustomerStatsEndpoint returns an endpoint via the passed service.
+// Primarily useful in a server.
+func MakeGetCustomerStatsEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(getCustomerStatsRequest)
+		r, e := s.GetCustomerStats(ctx, req.ID)
+		return getCustomerStatsResponse{Stats: r, Err: e}, nil
+	}
+}
+
+// MakePrepareCustomerEndpoint returns an endpoint via the passed service.
+// Primarily useful in a server.
+func MakePrepareCustomerEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(prepareCustomerRequest)
+		r, e := s.PrepareCustomer(ctx, req.Customer, req.TTL)
+		return prepareCustomerResponse{Pending: r, Err: e}, nil
+	}
+}
+
+// MakeCommitCustomerEndpoint returns an endpoint via the passed service.
+// Primarily useful in a server.
+func MakeCommitCustomerEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(commitCustomerRequest)
+		e := s.CommitCustomer(ctx, req.ID)
+		return commitCustomerResponse{Err: e}, nil
+	}
+}
+
+// MakeAbortCustomerEndpoint returns an endpoint via the passed service.
+// Primarily useful in a server.
+func MakeAbortCustomerEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(abortCustomerRequest)
+		e := s.AbortCustomer(ctx, req.ID)
+		return abortCustomerResponse{Err: e}, nil
+	}
+}
+
+// MakeGetCustomerAsOfEndpoint returns an endpoint via the passed service.
+// Primarily useful in a server.
+func MakeGetCustomerAsOfEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(getCustomerAsOfRequest)
+		r, e := s.GetCustomerAsOf(ctx, req.ID, req.AsOf)
+		return getCustomerAsOfResponse{Customer: r, Err: e}, nil
+	}
+}
+
+// MakeGetCustomerByExternalIDEndpoint returns an endpoint via the passed service.
+// Primarily useful in a server.
+func MakeGetCustomerByExternalIDEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(getCustomerByExternalIDRequest)
+		r, e := s.GetCustomerByExternalID(ctx, req.System, req.ExternalID)
+		return getCustomerByExternalIDResponse{Customer: r, Err: e}, nil
+	}
+}
+
+// MakeGrantConsentEndpoint returns an endpoint via the passed service.
+// Primarily useful in a server.
+func MakeGrantConsentEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(grantConsentRequest)
+		r, e := s.GrantConsent(ctx, req.CustomerID, req.Consent)
+		return grantConsentResponse{Consent: r, Err: e}, nil
+	}
+}
+
+// MakeWithdrawConsentEndpoint returns an endpoint via the passed service.
+// Primarily useful in a server.
+func MakeWithdrawConsentEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(withdrawConsentRequest)
+		e := s.WithdrawConsent(ctx, req.CustomerID, req.Type)
+		return withdrawConsentResponse{Err: e}, nil
+	}
+}
+
+// MakeGetConsentsEndpoint returns an endpoint via the passed service.
+// Primarily useful in a server.
+func MakeGetConsentsEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(getConsentsRequest)
+		r, e := s.GetConsents(ctx, req.CustomerID)
+		return getConsentsResponse{Consents: r, Err: e}, nil
+	}
+}
+
+// MakeGetDuplicateAddressesEndpoint returns an endpoint via the passed service.
+// Primarily useful in a server.
+func MakeGetDuplicateAddressesEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		r, e := s.GetDuplicateAddresses(ctx)
+		return getDuplicateAddressesResponse{Duplicates: r, Err: e}, nil
+	}
+}
+
+// MakeRepairAddressesEndpoint returns an endpoint via the passed service.
+// Primarily useful in a server.
+func MakeRepairAddressesEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(repairAddressesRequest)
+		r, e := s.RepairAddresses(ctx, req.DryRun)
+		return repairAddressesResponse{Repairs: r, Err: e}, nil
+	}
+}
+
+// MakeRebuildIndexEndpoint returns an endpoint via the passed service.
+// Primarily useful in a server.
+func MakeRebuildIndexEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(rebuildIndexRequest)
+		r, e := s.RebuildIndex(ctx, req.Index)
+		return rebuildIndexResponse{Rebuild: r, Err: e}, nil
+	}
+}
+
+// MakeGetIndexRebuildEndpoint returns an endpoint via the passed service.
+// Primarily useful in a server.
+func MakeGetIndexRebuildEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(getIndexRebuildRequest)
+		r, e := s.GetIndexRebuild(ctx, req.Index)
+		return rebuildIndexResponse{Rebuild: r, Err: e}, nil
+	}
+}
+
+// MakeCheckConsistencyEndpoint returns an endpoint via the passed service.
+// Primarily useful in a server.
+func MakeCheckConsistencyEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(checkConsistencyRequest)
+		r, e := s.CheckConsistency(ctx, req.Repair)
+		return checkConsistencyResponse{Report: r, Err: e}, nil
+	}
+}
+
 // We have two options to return errors from the business logic.
 //
 // We could return the error via the endpoint itself. That makes certain things
@@ -293,61 +948,72 @@ type postCustomerRequest struct {
 }
 
 type postCustomerResponse struct {
-	Err error `json:"err,omitempty"`
+	Err error `json:"err,omitempty" xml:"-"`
 }
 
 func (r postCustomerResponse) error() error { return r.Err }
 
 type getCustomerRequest struct {
-	ID string
+	ID            string
+	OmitAddresses bool
 }
 
 type getCustomerResponse struct {
-	Customer Customer `json:"customer,omitempty"`
-	Err      error    `json:"err,omitempty"`
+	Customer Customer `json:"customer,omitempty" xml:"customer,omitempty"`
+	Err      error    `json:"err,omitempty" xml:"-"`
 }
 
 func (r getCustomerResponse) error() error { return r.Err }
 
 type putCustomerRequest struct {
-	ID       string
-	Customer Customer
+	ID        string
+	Customer  Customer
+	Return    bool         // Prefer: return=representation
+	Addresses AddressWrite // ?addresses=
 }
 
 type putCustomerResponse struct {
-	Err error `json:"err,omitempty"`
+	Customer *Customer `json:"customer,omitempty" xml:"customer,omitempty"`
+	Err      error     `json:"err,omitempty" xml:"-"`
 }
 
-func (r putCustomerResponse) error() error { return nil }
+func (r putCustomerResponse) error() error { return r.Err }
+
+func (r putCustomerResponse) Headers() http.Header { return representationApplied(r.Customer != nil) }
 
 type patchCustomerRequest struct {
 	ID       string
 	Customer Customer
+	Return   bool // Prefer: return=representation
 }
 
 type patchCustomerResponse struct {
-	Err error `json:"err,omitempty"`
+	Customer *Customer `json:"customer,omitempty" xml:"customer,omitempty"`
+	Err      error     `json:"err,omitempty" xml:"-"`
 }
 
 func (r patchCustomerResponse) error() error { return r.Err }
 
+func (r patchCustomerResponse) Headers() http.Header { return representationApplied(r.Customer != nil) }
+
 type deleteCustomerRequest struct {
 	ID string
 }
 
 type deleteCustomerResponse struct {
-	Err error `json:"err,omitempty"`
+	Err error `json:"err,omitempty" xml:"-"`
 }
 
 func (r deleteCustomerResponse) error() error { return r.Err }
 
 type getAddressesRequest struct {
 	CustomerID string
+	At         *time.Time // ?at=, only the addresses effective then
 }
 
 type getAddressesResponse struct {
-	Addresses []Address `json:"addresses,omitempty"`
-	Err       error     `json:"err,omitempty"`
+	Addresses []Address `json:"addresses,omitempty" xml:"addresses>address,omitempty"`
+	Err       error     `json:"err,omitempty" xml:"-"`
 }
 
 func (r getAddressesResponse) error() error { return r.Err }
@@ -358,8 +1024,8 @@ type getAddressRequest struct {
 }
 
 type getAddressResponse struct {
-	Address Address `json:"address,omitempty"`
-	Err     error   `json:"err,omitempty"`
+	Address Address `json:"address,omitempty" xml:"address,omitempty"`
+	Err     error   `json:"err,omitempty" xml:"-"`
 }
 
 func (r getAddressResponse) error() error { return r.Err }
@@ -370,7 +1036,8 @@ type postAddressRequest struct {
 }
 
 type postAddressResponse struct {
-	Err error `json:"err,omitempty"`
+	Address Address `json:"address,omitempty" xml:"address,omitempty"`
+	Err     error   `json:"err,omitempty" xml:"-"`
 }
 
 func (r postAddressResponse) error() error { return r.Err }
@@ -378,10 +1045,248 @@ func (r postAddressResponse) error() error { return r.Err }
 type deleteAddressRequest struct {
 	CustomerID string
 	AddressID  string
+	Force      bool // ?force=true, deleting it even if referenced
 }
 
 type deleteAddressResponse struct {
-	Err error `json:"err,omitempty"`
+	Err error `json:"err,omitempty" xml:"-"`
 }
 
 func (r deleteAddressResponse) error() error { return r.Err }
+
+type getCustomersByRegionRequest struct{}
+
+type getCustomersByRegionResponse struct {
+	Regions []RegionCount `json:"regions,omitempty" xml:"regions>region,omitempty"`
+	Err     error         `json:"err,omitempty" xml:"-"`
+}
+
+func (r getCustomersByRegionResponse) error() error { return r.Err }
+
+type postAddressesRequest struct {
+	CustomerID string
+	Addresses  []Address
+}
+
+type postAddressesResponse struct {
+	Results []AddressResult `json:"results,omitempty" xml:"results>result,omitempty"`
+	Err     error           `json:"err,omitempty" xml:"-"`
+}
+
+func (r postAddressesResponse) error() error { return r.Err }
+
+type reorderAddressesRequest struct {
+	CustomerID string
+	AddressIDs []string
+}
+
+type reorderAddressesResponse struct {
+	Err error `json:"err,omitempty" xml:"-"`
+}
+
+func (r reorderAddressesResponse) error() error { return r.Err }
+
+type validateCustomerRequest struct {
+	Customer Customer
+}
+
+type validateCustomerResponse struct {
+	Valid  bool         `json:"valid" xml:"valid"`
+	Errors []FieldError `json:"errors,omitempty" xml:"errors>error,omitempty"`
+	Err    error        `json:"err,omitempty" xml:"-"`
+}
+
+func (r validateCustomerResponse) error() error { return r.Err }
+
+type validateAddressRequest struct {
+	CustomerID string
+	Address    Address
+}
+
+type validateAddressResponse struct {
+	Valid  bool         `json:"valid" xml:"valid"`
+	Errors []FieldError `json:"errors,omitempty" xml:"errors>error,omitempty"`
+	Err    error        `json:"err,omitempty" xml:"-"`
+}
+
+func (r validateAddressResponse) error() error { return r.Err }
+
+type archiveCustomerRequest struct {
+	ID string
+}
+
+type archiveCustomerResponse struct {
+	Err error `json:"err,omitempty" xml:"-"`
+}
+
+func (r archiveCustomerResponse) error() error { return r.Err }
+
+type unarchiveCustomerRequest struct {
+	ID string
+}
+
+type unarchiveCustomerResponse struct {
+	Err error `json:"err,omitempty" xml:"-"`
+}
+
+func (r unarchiveCustomerResponse) error() error { return r.Err }
+
+type getCustomersRequest struct {
+	Filter        CustomerFilter
+	OmitAddresses bool
+}
+
+type getCustomersResponse struct {
+	Customers []Customer `json:"customers,omitempty" xml:"customers>customer,omitempty"`
+	Err       error      `json:"err,omitempty" xml:"-"`
+}
+
+func (r getCustomersResponse) error() error { return r.Err }
+
+type getCustomerStatsRequest struct {
+	ID string
+}
+
+type getCustomerStatsResponse struct {
+	Stats CustomerStats `json:"stats,omitempty" xml:"stats,omitempty"`
+	Err   error         `json:"err,omitempty" xml:"-"`
+}
+
+func (r getCustomerStatsResponse) error() error { return r.Err }
+
+type prepareCustomerRequest struct {
+	Customer Customer
+	TTL      time.Duration
+}
+
+type prepareCustomerResponse struct {
+	Pending PendingCustomer `json:"pending,omitempty" xml:"pending,omitempty"`
+	Err     error           `json:"err,omitempty" xml:"-"`
+}
+
+func (r prepareCustomerResponse) error() error { return r.Err }
+
+type commitCustomerRequest struct {
+	ID string
+}
+
+type commitCustomerResponse struct {
+	Err error `json:"err,omitempty" xml:"-"`
+}
+
+func (r commitCustomerResponse) error() error { return r.Err }
+
+type abortCustomerRequest struct {
+	ID string
+}
+
+type abortCustomerResponse struct {
+	Err error `json:"err,omitempty" xml:"-"`
+}
+
+func (r abortCustomerResponse) error() error { return r.Err }
+
+type getCustomerAsOfRequest struct {
+	ID   string
+	AsOf time.Time
+}
+
+type getCustomerAsOfResponse struct {
+	Customer Customer `json:"customer,omitempty" xml:"customer,omitempty"`
+	Err      error    `json:"err,omitempty" xml:"-"`
+}
+
+func (r getCustomerAsOfResponse) error() error { return r.Err }
+
+type getCustomerByExternalIDRequest struct {
+	System     string
+	ExternalID string
+}
+
+type getCustomerByExternalIDResponse struct {
+	Customer Customer `json:"customer,omitempty" xml:"customer,omitempty"`
+	Err      error    `json:"err,omitempty" xml:"-"`
+}
+
+func (r getCustomerByExternalIDResponse) error() error { return r.Err }
+
+type grantConsentRequest struct {
+	CustomerID string
+	Consent    Consent
+}
+
+type grantConsentResponse struct {
+	Consent Consent `json:"consent,omitempty" xml:"consent,omitempty"`
+	Err     error   `json:"err,omitempty" xml:"-"`
+}
+
+func (r grantConsentResponse) error() error { return r.Err }
+
+type withdrawConsentRequest struct {
+	CustomerID string
+	Type       string
+}
+
+type withdrawConsentResponse struct {
+	Err error `json:"err,omitempty" xml:"-"`
+}
+
+func (r withdrawConsentResponse) error() error { return r.Err }
+
+type getConsentsRequest struct {
+	CustomerID string
+}
+
+type getConsentsResponse struct {
+	Consents []Consent `json:"consents,omitempty" xml:"consents>consent,omitempty"`
+	Err      error     `json:"err,omitempty" xml:"-"`
+}
+
+func (r getConsentsResponse) error() error { return r.Err }
+
+type getDuplicateAddressesRequest struct{}
+
+type getDuplicateAddressesResponse struct {
+	Duplicates []DuplicateAddresses `json:"duplicates,omitempty" xml:"duplicates>duplicate,omitempty"`
+	Err        error                `json:"err,omitempty" xml:"-"`
+}
+
+func (r getDuplicateAddressesResponse) error() error { return r.Err }
+
+type repairAddressesRequest struct {
+	DryRun bool
+}
+
+type repairAddressesResponse struct {
+	Repairs []AddressRepair `json:"repairs,omitempty" xml:"repairs>repair,omitempty"`
+	Err     error           `json:"err,omitempty" xml:"-"`
+}
+
+func (r repairAddressesResponse) error() error { return r.Err }
+
+type rebuildIndexRequest struct {
+	Index string
+}
+
+type getIndexRebuildRequest struct {
+	Index string
+}
+
+// rebuildIndexResponse answers both RebuildIndex and GetIndexRebuild.
+type rebuildIndexResponse struct {
+	Rebuild IndexRebuild `json:"rebuild,omitempty" xml:"rebuild"`
+	Err     error        `json:"err,omitempty" xml:"-"`
+}
+
+func (r rebuildIndexResponse) error() error { return r.Err }
+
+type checkConsistencyRequest struct {
+	Repair bool
+}
+
+type checkConsistencyResponse struct {
+	Report ConsistencyReport `json:"report" xml:"report"`
+	Err    error             `json:"err,omitempty" xml:"-"`
+}
+
+func (r checkConsistencyResponse) error() error { return r.Err }
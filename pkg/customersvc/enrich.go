@@ -0,0 +1,206 @@
+package customersvc
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/go-kit/kit/metrics"
+)
+
+// Enricher computes derived attributes of a customer, such as a lead score
+// or lifetime value. The returned attributes are merged into the customer's
+// Metadata.
+type Enricher interface {
+	Enrich(ctx context.Context, c Customer) (Metadata, error)
+}
+
+// EnricherFunc is an adapter to allow the use of ordinary functions as
+// Enrichers.
+type EnricherFunc func(ctx context.Context, c Customer) (Metadata, error)
+
+// Enrich implements Enricher.
+func (f EnricherFunc) Enrich(ctx context.Context, c Customer) (Metadata, error) {
+	return f(ctx, c)
+}
+
+// NopEnricher never attaches any attributes.
+var NopEnricher Enricher = EnricherFunc(func(context.Context, Customer) (Metadata, error) {
+	return nil, nil
+})
+
+// NewWebhookEnricher returns an Enricher that POSTs the customer as JSON to
+// url and expects a JSON object of string attributes in return. A nil client
+// means http.DefaultClient.
+func NewWebhookEnricher(url string, client *http.Client) Enricher {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &webhookEnricher{url: url, client: client}
+}
+
+type webhookEnricher struct {
+	url    string
+	client *http.Client
+}
+
+func (e *webhookEnricher) Enrich(ctx context.Context, c Customer) (Metadata, error) {
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(c); err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("POST", e.url, &buf)
+	if err != nil {
+		return nil, err
+	}
+	PropagateHeaders(ctx, req.Header)
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	resp, err := e.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("enrichment webhook: %s", resp.Status)
+	}
+	var attrs Metadata
+	if err := json.NewDecoder(resp.Body).Decode(&attrs); err != nil {
+		return nil, err
+	}
+	return attrs, nil
+}
+
+// EnrichmentOptions tunes EnrichmentMiddleware.
+type EnrichmentOptions struct {
+	// Workers is the number of enrichments run concurrently. Defaults to 1.
+	Workers int
+	// QueueSize is the number of pending enrichments. When the queue is
+	// full, new ones are dropped rather than slowing down writes.
+	QueueSize int
+	// Timeout bounds a single Enrich call. Zero means no timeout.
+	Timeout time.Duration
+}
+
+// EnrichmentMiddleware runs enricher in the background after every
+// successful create or update, and merges its result into the customer's
+// Metadata. Enrichment never affects the outcome of the write that triggered
+// it: errors, timeouts and panics in the enricher are logged and counted in
+// failures, labeled by reason.
+func EnrichmentMiddleware(enricher Enricher, opts EnrichmentOptions, logger Logger, failures metrics.Counter) Middleware {
+	if opts.Workers < 1 {
+		opts.Workers = 1
+	}
+	return func(next Service) Service {
+		mw := &enrichmentMiddleware{
+			Service:  next,
+			enricher: enricher,
+			timeout:  opts.Timeout,
+			logger:   logger,
+			failures: failures,
+			queue:    make(chan enrichTask, opts.QueueSize),
+		}
+		for i := 0; i < opts.Workers; i++ {
+			go mw.work()
+		}
+		return mw
+	}
+}
+
+type enrichmentMiddleware struct {
+	Service
+	enricher Enricher
+	timeout  time.Duration
+	logger   Logger
+	failures metrics.Counter
+	queue    chan enrichTask
+}
+
+// enrichTask is a customer to enrich, with a context detached from the
+// request that changed it, which propagates its headers.
+type enrichTask struct {
+	id  string
+	ctx context.Context
+}
+
+func (mw *enrichmentMiddleware) PostCustomer(ctx context.Context, p Customer) error {
+	err := mw.Service.PostCustomer(ctx, p)
+	if err == nil {
+		mw.enqueue(ctx, p.ID)
+	}
+	return err
+}
+
+func (mw *enrichmentMiddleware) PutCustomer(ctx context.Context, id string, p Customer) error {
+	err := mw.Service.PutCustomer(ctx, id, p)
+	if err == nil {
+		mw.enqueue(ctx, id)
+	}
+	return err
+}
+
+func (mw *enrichmentMiddleware) PatchCustomer(ctx context.Context, id string, p Customer) error {
+	err := mw.Service.PatchCustomer(ctx, id, p)
+	if err == nil {
+		mw.enqueue(ctx, id)
+	}
+	return err
+}
+
+func (mw *enrichmentMiddleware) CommitCustomer(ctx context.Context, id string) error {
+	err := mw.Service.CommitCustomer(ctx, id)
+	if err == nil {
+		mw.enqueue(ctx, id)
+	}
+	return err
+}
+
+func (mw *enrichmentMiddleware) enqueue(ctx context.Context, id string) {
+	select {
+	case mw.queue <- enrichTask{id: id, ctx: detachPropagation(ctx)}:
+	default:
+		mw.failures.With("reason", "queue_full").Add(1)
+		mw.logger.Log("enrich", id, "err", "queue full, dropped")
+	}
+}
+
+func (mw *enrichmentMiddleware) work() {
+	for task := range mw.queue {
+		mw.enrich(task.ctx, task.id)
+	}
+}
+
+func (mw *enrichmentMiddleware) enrich(ctx context.Context, id string) {
+	defer func() {
+		if v := recover(); v != nil {
+			mw.failures.With("reason", "panic").Add(1)
+			mw.logger.Log("enrich", id, "panic", v)
+		}
+	}()
+
+	if mw.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, mw.timeout)
+		defer cancel()
+	}
+	c, err := mw.Service.GetCustomer(ctx, id)
+	if err != nil {
+		return // deleted in the meantime
+	}
+	attrs, err := mw.enricher.Enrich(ctx, c)
+	if err != nil {
+		mw.failures.With("reason", "enricher").Add(1)
+		mw.logger.Log("enrich", id, "err", err)
+		return
+	}
+	if len(attrs) == 0 {
+		return
+	}
+	// Write through the next Service, not mw, so as not to enrich again.
+	if err := mw.Service.PatchCustomer(ctx, id, Customer{Metadata: attrs}); err != nil {
+		mw.failures.With("reason", "store").Add(1)
+		mw.logger.Log("enrich", id, "err", err)
+	}
+}
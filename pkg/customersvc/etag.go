@@ -0,0 +1,42 @@
+package customersvc
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+
+	httptransport "github.com/go-kit/kit/transport/http"
+)
+
+// writeBody writes the encoded response body. Successful GETs carry a strong
+// ETag, a hash of the body, so that clients can revalidate what they cached
+// with If-None-Match, and get a 304 with no body if it hasn't changed. As
+// the body is encoded first, the response format and version are part of
+// the ETag.
+func writeBody(ctx context.Context, w http.ResponseWriter, body []byte) error {
+	if method, _ := ctx.Value(httptransport.ContextKeyRequestMethod).(string); method == "GET" {
+		sum := sha256.Sum256(body)
+		etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+		w.Header().Set("ETag", etag)
+		if etagMatches(RequestMetadataFrom(ctx).Get("If-None-Match"), etag) {
+			w.WriteHeader(http.StatusNotModified)
+			return nil
+		}
+	}
+	_, err := w.Write(body)
+	return err
+}
+
+// etagMatches reports whether the If-None-Match header ifNoneMatch lists
+// etag, by the weak comparison RFC 7232 specifies for it.
+func etagMatches(ifNoneMatch, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
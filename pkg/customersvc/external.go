@@ -0,0 +1,74 @@
+package customersvc
+
+import (
+	"context"
+	"errors"
+)
+
+var (
+	// ErrExternalIDConflict is returned when a customer is given an
+	// external ID that already belongs to another customer.
+	ErrExternalIDConflict = errors.New("external ID already belongs to another customer")
+	// ErrInvalidExternalID is returned for an external ID without a system
+	// or an ID.
+	ErrInvalidExternalID = errors.New("external IDs need a system and an ID")
+)
+
+// externalKey is an ID in another system.
+type externalKey struct{ system, id string }
+
+func validateExternalIDs(ids Metadata) error {
+	for system, id := range ids {
+		if system == "" || id == "" {
+			return ErrInvalidExternalID
+		}
+	}
+	return nil
+}
+
+// indexExternalIDs moves customer id's external IDs in the index from old to
+// new. If one of new belongs to another customer, it fails with
+// ErrExternalIDConflict and changes nothing. The caller must hold the write
+// lock.
+func (s *inmemService) indexExternalIDs(id string, old, new Metadata) error {
+	if err := s.checkExternalIDs(id, new); err != nil {
+		return err
+	}
+	if s.rebuild.touched != nil {
+		s.rebuild.touched[id] = true // the index being rebuilt may have missed it
+	}
+	for system, ext := range old {
+		if k := (externalKey{system, ext}); s.external[k] == id {
+			delete(s.external, k)
+		}
+	}
+	for system, ext := range new {
+		s.external[externalKey{system, ext}] = id
+	}
+	return nil
+}
+
+// checkExternalIDs fails with ErrExternalIDConflict if one of ids belongs to
+// a customer other than id. The caller must hold the lock.
+func (s *inmemService) checkExternalIDs(id string, ids Metadata) error {
+	for system, ext := range ids {
+		if owner, ok := s.external[externalKey{system, ext}]; ok && owner != id {
+			return ErrExternalIDConflict
+		}
+	}
+	return nil
+}
+
+// GetCustomerByExternalID returns the customer known as externalID in
+// system, e.g. "stripe", archived or not.
+func (s *inmemService) GetCustomerByExternalID(ctx context.Context, system, externalID string) (Customer, error) {
+	if err := s.rlock(ctx); err != nil {
+		return Customer{}, err
+	}
+	defer s.mtx.RUnlock()
+	id, ok := s.external[externalKey{system, externalID}]
+	if !ok {
+		return Customer{}, ErrNotFound
+	}
+	return s.customers[id], nil
+}
@@ -0,0 +1,191 @@
+package customersvc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/go-kit/kit/endpoint"
+	"github.com/gorilla/mux"
+)
+
+// Parts of a customer GetCustomerFull can expand, fetched alongside it.
+const (
+	ExpandAddresses = "addresses" // from GetAddresses
+	ExpandStats     = "stats"     // from GetCustomerStats
+)
+
+// ErrInvalidExpand is returned for an expansion GetCustomerFull doesn't
+// know.
+var ErrInvalidExpand = errors.New("expand must list addresses or stats")
+
+// FullOptions says what GetCustomerFull fetches alongside a customer.
+type FullOptions struct {
+	// Expand lists the parts to fetch, e.g. ExpandAddresses.
+	Expand []string
+	// Partial returns the customer even if some of the parts couldn't be
+	// fetched, reporting why in CustomerFull.Errors, rather than failing
+	// with the first error.
+	Partial bool
+}
+
+// CustomerFull is a customer with the parts GetCustomerFull was asked to
+// expand. Those that weren't asked for, or couldn't be fetched, are left
+// out.
+type CustomerFull struct {
+	Customer  Customer       `json:"customer" xml:"customer"`
+	Addresses []Address      `json:"addresses,omitempty" xml:"addresses>address,omitempty"`
+	Stats     *CustomerStats `json:"stats,omitempty" xml:"stats,omitempty"`
+	// Errors are the errors fetching parts, by part, given
+	// FullOptions.Partial.
+	Errors map[string]string `json:"errors,omitempty" xml:"-"`
+}
+
+// GetCustomerFull returns customer id along with the parts opts expands,
+// fetching them from s concurrently. It fails if the customer can't be
+// fetched, cancelling the fetches of its parts, and unless opts.Partial, if
+// any of them fails, cancelling the others.
+func GetCustomerFull(ctx context.Context, s Service, id string, opts FullOptions) (CustomerFull, error) {
+	expand := map[string]bool{}
+	for _, part := range opts.Expand {
+		if part != ExpandAddresses && part != ExpandStats {
+			return CustomerFull{}, ErrInvalidExpand
+		}
+		expand[part] = true
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var (
+		full     CustomerFull
+		wg       sync.WaitGroup
+		mtx      sync.Mutex // guards full.Errors and failed
+		failed   error
+		fetching = func(part string, fetch func() error) {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				err := fetch()
+				if err == nil {
+					return
+				}
+				mtx.Lock()
+				defer mtx.Unlock()
+				if part != "" && opts.Partial {
+					if full.Errors == nil {
+						full.Errors = map[string]string{}
+					}
+					full.Errors[part] = err.Error()
+					return
+				}
+				if failed == nil {
+					failed = err
+					cancel()
+				}
+			}()
+		}
+	)
+	fetching("", func() (err error) {
+		full.Customer, err = s.GetCustomer(ctx, id)
+		return err
+	})
+	if expand[ExpandAddresses] {
+		fetching(ExpandAddresses, func() (err error) {
+			full.Addresses, err = s.GetAddresses(ctx, id)
+			return err
+		})
+	}
+	if expand[ExpandStats] {
+		fetching(ExpandStats, func() error {
+			stats, err := s.GetCustomerStats(ctx, id)
+			if err == nil {
+				full.Stats = &stats
+			}
+			return err
+		})
+	}
+	wg.Wait()
+	if failed != nil {
+		return CustomerFull{}, failed
+	}
+	return full, nil
+}
+
+// MakeGetCustomerFullEndpoint returns an endpoint serving GetCustomerFull via
+// the passed service. Primarily useful in a server.
+func MakeGetCustomerFullEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(getCustomerFullRequest)
+		full, e := GetCustomerFull(ctx, s, req.ID, req.Options)
+		return getCustomerFullResponse{CustomerFull: full, Err: e}, nil
+	}
+}
+
+// GetCustomerFull returns a customer along with the parts opts expands, in a
+// single request. Primarily useful in a client.
+func (e Endpoints) GetCustomerFull(ctx context.Context, id string, opts FullOptions) (CustomerFull, error) {
+	request := getCustomerFullRequest{ID: id, Options: opts}
+	response, err := e.GetCustomerFullEndpoint(ctx, request)
+	if err != nil {
+		return CustomerFull{}, err
+	}
+	resp := response.(getCustomerFullResponse)
+	return resp.CustomerFull, resp.Err
+}
+
+type getCustomerFullRequest struct {
+	ID      string
+	Options FullOptions
+}
+
+type getCustomerFullResponse struct {
+	CustomerFull
+	Err error `json:"err,omitempty" xml:"-"`
+}
+
+func (r getCustomerFullResponse) error() error { return r.Err }
+
+func (r getCustomerFullResponse) v2() interface{} {
+	return struct {
+		Customer  CustomerV2        `json:"customer"`
+		Addresses []AddressV2       `json:"addresses,omitempty"`
+		Stats     *CustomerStats    `json:"stats,omitempty"`
+		Errors    map[string]string `json:"errors,omitempty"`
+	}{CustomerToV2(r.Customer), addressesToV2(r.Addresses), r.Stats, r.Errors}
+}
+
+func decodeGetCustomerFullRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	vars := mux.Vars(r)
+	id, ok := vars["id"]
+	if !ok {
+		return nil, ErrBadRouting
+	}
+	var opts FullOptions
+	if expand := vars["expand"]; expand != "" {
+		opts.Expand = strings.Split(expand, ",")
+	}
+	opts.Partial = r.URL.Query().Get("partial") == "true"
+	return getCustomerFullRequest{ID: id, Options: opts}, nil
+}
+
+func encodeGetCustomerFullRequest(ctx context.Context, req *http.Request, request interface{}) error {
+	// r.Methods("GET").Path("/customers/{id}").Queries("expand", "{expand}")
+	r := request.(getCustomerFullRequest)
+	req.URL.Path = "/customers/" + url.QueryEscape(r.ID)
+	q := url.Values{"expand": {strings.Join(r.Options.Expand, ",")}}
+	if r.Options.Partial {
+		q.Set("partial", "true")
+	}
+	req.URL.RawQuery = q.Encode()
+	return encodeRequest(ctx, req, request)
+}
+
+func decodeGetCustomerFullResponse(_ context.Context, resp *http.Response) (interface{}, error) {
+	var response getCustomerFullResponse
+	err := json.NewDecoder(resp.Body).Decode(&response)
+	return response, err
+}
@@ -0,0 +1,135 @@
+package customersvc
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+)
+
+var (
+	// ErrAmbiguousFraming is returned for requests whose body length isn't
+	// given by Content-Length alone.
+	ErrAmbiguousFraming = errors.New("request bodies must be framed by Content-Length alone")
+	// ErrHeadersTooLarge is returned for requests with too many, or too
+	// large, header fields.
+	ErrHeadersTooLarge = errors.New("request header fields too large")
+	// ErrMisdirected is returned for requests for a host this server
+	// doesn't serve.
+	ErrMisdirected = errors.New("unknown host")
+)
+
+// HardeningOptions tunes WithHardening. Zero values take the defaults noted
+// below.
+type HardeningOptions struct {
+	// AllowChunked accepts request bodies sent with Transfer-Encoding.
+	// net/http already rejects conflicting Content-Length headers, but it
+	// silently prefers Transfer-Encoding over Content-Length, which is
+	// what request smuggling through a proxy that disagrees relies on; so
+	// by default such requests are rejected, and every body is framed by
+	// Content-Length.
+	AllowChunked bool
+	// MaxHeaders is the number of header fields accepted. Default 100.
+	MaxHeaders int
+	// MaxHeaderBytes is the total size of header names and values
+	// accepted. Default 16 KiB.
+	MaxHeaderBytes int
+	// AllowedHosts, if set, are the only Host values served. Others get
+	// 421 Misdirected Request. They're compared after normalization, e.g.
+	// "api.example.com", or "localhost:8080".
+	AllowedHosts []string
+}
+
+// Hop-by-hop headers, which describe a single connection and must not be
+// acted on beyond it. See RFC 7230, section 6.1.
+var hopByHopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// WithHardening enables checks for deployments exposed directly to the
+// internet: requests with ambiguous framing or oversized headers are
+// rejected, hop-by-hop headers are stripped before anything sees them, and
+// the Host is normalized, and checked against opts.AllowedHosts.
+func WithHardening(opts HardeningOptions) HandlerOption {
+	if opts.MaxHeaders <= 0 {
+		opts.MaxHeaders = 100
+	}
+	if opts.MaxHeaderBytes <= 0 {
+		opts.MaxHeaderBytes = 16 << 10
+	}
+	return func(c *handlerConfig) { c.hardening = &opts }
+}
+
+func hardeningMiddleware(opts HardeningOptions) func(http.Handler) http.Handler {
+	allowed := make(map[string]bool, len(opts.AllowedHosts))
+	for _, h := range opts.AllowedHosts {
+		allowed[normalizeHost(h, false)] = true
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if len(r.TransferEncoding) > 0 && !opts.AllowChunked {
+				encodeError(r.Context(), ErrAmbiguousFraming, w)
+				return
+			}
+			n, size := 0, 0
+			for k, values := range r.Header {
+				for _, v := range values {
+					n++
+					size += len(k) + len(v)
+				}
+			}
+			if n > opts.MaxHeaders || size > opts.MaxHeaderBytes {
+				encodeError(r.Context(), ErrHeadersTooLarge, w)
+				return
+			}
+			stripHopByHop(r.Header)
+			r.Host = normalizeHost(r.Host, r.TLS != nil)
+			if len(allowed) > 0 && !allowed[r.Host] {
+				encodeError(r.Context(), ErrMisdirected, w)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// stripHopByHop removes the hop-by-hop headers from h, including those named
+// in its Connection header.
+func stripHopByHop(h http.Header) {
+	for _, v := range h["Connection"] {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	for _, name := range hopByHopHeaders {
+		h.Del(name)
+	}
+}
+
+// normalizeHost lower-cases host, and drops a trailing dot and the default
+// port for the scheme.
+func normalizeHost(host string, tls bool) string {
+	host = strings.ToLower(host)
+	name, port, err := net.SplitHostPort(host)
+	if err != nil {
+		name, port = host, ""
+	}
+	name = strings.TrimSuffix(name, ".")
+	if port == "" || (port == "80" && !tls) || (port == "443" && tls) {
+		if strings.Contains(name, ":") {
+			return "[" + name + "]" // IPv6
+		}
+		return name
+	}
+	return net.JoinHostPort(name, port)
+}
@@ -0,0 +1,65 @@
+package customersvc
+
+import (
+	"context"
+	"net/http"
+
+	httptransport "github.com/go-kit/kit/transport/http"
+	"github.com/gorilla/mux"
+
+	"github.com/praveensastry/customersvc/pkg/version"
+)
+
+// ServiceVersionHeader is the response header carrying
+// ResponseHeaders.Version.
+const ServiceVersionHeader = "X-Service-Version"
+
+// ResponseHeaders tunes WithResponseHeaders.
+type ResponseHeaders struct {
+	// Server is the Server header of every response, e.g.
+	// "customersvc/1.2.0". Omitted if empty.
+	Server string
+	// Version is the X-Service-Version header of every response. Omitted
+	// if empty.
+	Version string
+}
+
+// WithResponseHeaders sets the headers in h on responses, successful or not,
+// so that clients can tell which server and version answered.
+func WithResponseHeaders(h ResponseHeaders) HandlerOption {
+	return func(c *handlerConfig) { c.headers = &h }
+}
+
+// responseHeadersMiddleware sets h on every response.
+func responseHeadersMiddleware(h ResponseHeaders) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if h.Server != "" {
+				w.Header().Set("Server", h.Server)
+			}
+			if h.Version != "" {
+				w.Header().Set(ServiceVersionHeader, h.Version)
+			}
+			next.ServeHTTP(w, req)
+		})
+	}
+}
+
+// VersionInfo is the response of GET /version.
+type VersionInfo struct {
+	Version  string `json:"version" xml:"version"`
+	Revision string `json:"revision" xml:"revision"`
+}
+
+// mountVersion serves GET /version. It's deliberately left out of the
+// endpoint middlewares, so that it needs no API key and isn't rate limited.
+func mountVersion(r *mux.Router, options []httptransport.ServerOption) {
+	r.Methods("GET").Path("/version").Handler(httptransport.NewServer(
+		func(ctx context.Context, request interface{}) (interface{}, error) {
+			return VersionInfo{Version: version.VERSION, Revision: version.REVISION}, nil
+		},
+		func(context.Context, *http.Request) (interface{}, error) { return nil, nil },
+		encodeResponse,
+		options...,
+	))
+}
@@ -0,0 +1,198 @@
+package customersvc
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/endpoint"
+	httptransport "github.com/go-kit/kit/transport/http"
+)
+
+// IdempotencyKeyHeader carries a key making a POST safe to retry: repeated
+// with the same key, it's answered with the response to the first attempt
+// rather than applied again.
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// ErrIdempotencyKeyReused is returned when an idempotency key is sent again
+// with a different request than it was first used for.
+var ErrIdempotencyKeyReused = errors.New("idempotency key was already used for a different request")
+
+// IdempotencyKeys remembers the responses to POSTs sent with an
+// Idempotency-Key, so that a client retrying a create whose response it lost
+// doesn't create twice. Keys are scoped to the API key or portal token
+// sending them. Responses are kept for a TTL; failures the client should
+// retry, with a 5xx status, aren't kept at all. It doesn't share state
+// between replicas.
+type IdempotencyKeys struct {
+	ttl   time.Duration
+	size  int
+	clock Clock
+
+	mtx   sync.Mutex
+	byKey map[string]*list.Element
+	order *list.List // of *idempotentCall, by expiry, soonest first
+}
+
+type idempotentCall struct {
+	key         string
+	fingerprint [sha256.Size]byte
+	expires     time.Time
+	done        chan struct{} // closed once the response is stored, or the call is forgotten
+	stored      bool
+	response    interface{}
+}
+
+// NewIdempotencyKeys returns IdempotencyKeys keeping responses for ttl, and
+// at most size of them: when full, those closest to expiry are forgotten
+// early. Mount it with WithIdempotencyKeys.
+func NewIdempotencyKeys(ttl time.Duration, size int, options ...Option) *IdempotencyKeys {
+	o := makeOptions(options)
+	return &IdempotencyKeys{
+		ttl:   ttl,
+		size:  size,
+		clock: o.clock,
+		byKey: map[string]*list.Element{},
+		order: list.New(),
+	}
+}
+
+// WithIdempotencyKeys answers POSTs repeated with the same Idempotency-Key
+// from keys, see IdempotencyKeys.
+func WithIdempotencyKeys(keys *IdempotencyKeys) HandlerOption {
+	return func(c *handlerConfig) { c.idempotency = keys }
+}
+
+// middleware answers a repeated POST with the response to the first, once
+// it's known. It must run inside the API key and portal token middlewares,
+// whose identities scope keys.
+func (k *IdempotencyKeys) middleware(method string) endpoint.Middleware {
+	return func(next endpoint.Endpoint) endpoint.Endpoint {
+		return func(ctx context.Context, request interface{}) (interface{}, error) {
+			token := RequestMetadataFrom(ctx).Get(IdempotencyKeyHeader)
+			if httpMethod, _ := ctx.Value(httptransport.ContextKeyRequestMethod).(string); token == "" || httpMethod != "POST" {
+				return next(ctx, request)
+			}
+			key := idempotencyScope(ctx) + "\n" + token
+			fingerprint := sha256.Sum256([]byte(fmt.Sprintf("%s\n%#v", method, request)))
+			var call *idempotentCall
+			for {
+				var first bool
+				call, first = k.claim(key, fingerprint)
+				if first {
+					break
+				}
+				if call.fingerprint != fingerprint {
+					return nil, ErrIdempotencyKeyReused
+				}
+				select {
+				case <-call.done:
+				case <-ctx.Done():
+					return nil, ctx.Err()
+				}
+				if call.stored {
+					return call.response, nil
+				}
+				// The first attempt failed and was forgotten: try again.
+			}
+			response, err := next(ctx, request)
+			retryable := err != nil
+			if e, ok := response.(errorer); ok && e.error() != nil && codeFrom(e.error()) >= http.StatusInternalServerError {
+				retryable = true
+			}
+			k.finish(call, response, retryable)
+			return response, err
+		}
+	}
+}
+
+// idempotencyScope returns who a request's idempotency key belongs to.
+func idempotencyScope(ctx context.Context) string {
+	if key, ok := APIKeyFrom(ctx); ok {
+		return "apikey:" + key.ID
+	}
+	if customerID, ok := PortalAccess(ctx); ok {
+		return "portal:" + customerID
+	}
+	return ""
+}
+
+// claim returns the call made with key, and whether it's new, in which case
+// the caller must finish it.
+func (k *IdempotencyKeys) claim(key string, fingerprint [sha256.Size]byte) (*idempotentCall, bool) {
+	k.mtx.Lock()
+	defer k.mtx.Unlock()
+	now := k.clock.Now()
+	for e := k.order.Front(); e != nil && !now.Before(e.Value.(*idempotentCall).expires); e = k.order.Front() {
+		k.remove(e)
+	}
+	if e, ok := k.byKey[key]; ok {
+		return e.Value.(*idempotentCall), false
+	}
+	for k.order.Len() >= k.size && k.order.Len() > 0 {
+		k.remove(k.order.Front())
+	}
+	call := &idempotentCall{key: key, fingerprint: fingerprint, expires: now.Add(k.ttl), done: make(chan struct{})}
+	k.byKey[key] = k.order.PushBack(call) // the TTL is shared, so the latest expires last
+	return call, true
+}
+
+// finish records the response to call, or forgets call if the client should
+// retry it, and wakes the repeats waiting for it.
+func (k *IdempotencyKeys) finish(call *idempotentCall, response interface{}, retryable bool) {
+	k.mtx.Lock()
+	defer k.mtx.Unlock()
+	e, ok := k.byKey[call.key]
+	if !ok || e.Value != call {
+		return // forgotten early, and its repeats with it
+	}
+	if retryable {
+		k.remove(e)
+		return
+	}
+	call.response, call.stored = response, true
+	close(call.done)
+}
+
+// remove forgets the call in e, waking its repeats if it hadn't finished.
+// They find no response, and try again.
+func (k *IdempotencyKeys) remove(e *list.Element) {
+	call := e.Value.(*idempotentCall)
+	delete(k.byKey, call.key)
+	k.order.Remove(e)
+	if !call.stored {
+		close(call.done)
+	}
+}
+
+type idempotencyKeyKey struct{}
+
+// WithIdempotencyKey returns a copy of ctx sending key as the
+// Idempotency-Key of the POSTs made with it by clients using
+// ClientIdempotencyKey.
+func WithIdempotencyKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, idempotencyKeyKey{}, key)
+}
+
+// IdempotencyKeyFrom returns the key ctx was given by WithIdempotencyKey, if
+// any.
+func IdempotencyKeyFrom(ctx context.Context) (string, bool) {
+	key, ok := ctx.Value(idempotencyKeyKey{}).(string)
+	return key, ok
+}
+
+// ClientIdempotencyKey is a client option sending the key given by
+// WithIdempotencyKey with every POST.
+func ClientIdempotencyKey() httptransport.ClientOption {
+	return httptransport.ClientBefore(func(ctx context.Context, r *http.Request) context.Context {
+		if key, ok := IdempotencyKeyFrom(ctx); ok && r.Method == "POST" {
+			r.Header.Set(IdempotencyKeyHeader, key)
+		}
+		return ctx
+	})
+}
@@ -0,0 +1,186 @@
+package customersvc
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"time"
+)
+
+// IndexExternalIDs is the index of customers by external ID, through which
+// GetCustomerByExternalID finds them and external IDs are kept unique.
+const IndexExternalIDs = "external_ids"
+
+var (
+	// ErrUnknownIndex is returned for an index the store doesn't have.
+	ErrUnknownIndex = errors.New("unknown index")
+	// ErrRebuildInProgress is returned when an index is asked to be
+	// rebuilt while it's being rebuilt.
+	ErrRebuildInProgress = errors.New("index is already being rebuilt")
+)
+
+// States of an IndexRebuild.
+const (
+	RebuildRunning = "running"
+	RebuildDone    = "done"
+)
+
+// rebuildBatch is the number of customers read per lock taken by a rebuild,
+// so that writes aren't held up for the whole of it.
+const rebuildBatch = 1000
+
+// IndexRebuild is the progress of rebuilding an index from the customers
+// stored, or its outcome once it's finished.
+type IndexRebuild struct {
+	Index    string     `json:"index" xml:"index"`
+	State    string     `json:"state" xml:"state"`
+	Started  time.Time  `json:"started" xml:"started"`
+	Finished *time.Time `json:"finished,omitempty" xml:"finished,omitempty"`
+	// Customers is the number of customers to read, and Processed the
+	// number read so far.
+	Customers int `json:"customers" xml:"customers"`
+	Processed int `json:"processed" xml:"processed"`
+	// Entries is the number of entries in the rebuilt index.
+	Entries int `json:"entries" xml:"entries"`
+	// Conflicts are the keys claimed by several customers. The index gives
+	// each to the first of them; the others must be fixed by hand.
+	Conflicts []IndexConflict `json:"conflicts,omitempty" xml:"conflicts>conflict,omitempty"`
+}
+
+// IndexConflict is a key of an index claimed by several customers.
+type IndexConflict struct {
+	Key         string   `json:"key" xml:"key"`
+	CustomerIDs []string `json:"customer_ids" xml:"customer_ids>id"`
+}
+
+// indexRebuild is the state of a rebuild of the external ID index. It's
+// guarded by the store's mtx.
+type indexRebuild struct {
+	status IndexRebuild
+	// touched are the customers whose external IDs were written since the
+	// rebuild started, whose entries it re-reads before swapping the index
+	// in. It's nil unless the rebuild is running.
+	touched map[string]bool
+}
+
+// RebuildIndex starts rebuilding index from the customers stored, replacing
+// it once done, to recover from an index gone out of step with them. It
+// returns at once; GetIndexRebuild reports the progress. Customers are read
+// in batches, and the store stays available meanwhile, the old index
+// serving until the new one is complete.
+func (s *inmemService) RebuildIndex(ctx context.Context, index string) (IndexRebuild, error) {
+	if index != IndexExternalIDs {
+		return IndexRebuild{}, ErrUnknownIndex
+	}
+	if err := s.lock(ctx); err != nil {
+		return IndexRebuild{}, err
+	}
+	defer s.mtx.Unlock()
+	if s.rebuild.touched != nil {
+		return IndexRebuild{}, ErrRebuildInProgress
+	}
+	ids := make([]string, 0, len(s.customers))
+	for id := range s.customers {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids) // the first customer claiming a key keeps it
+	s.rebuild = indexRebuild{
+		status: IndexRebuild{
+			Index:     index,
+			State:     RebuildRunning,
+			Started:   s.clock.Now(),
+			Customers: len(ids),
+		},
+		touched: map[string]bool{},
+	}
+	go s.rebuildExternalIDs(ids)
+	return s.rebuild.status, nil
+}
+
+// GetIndexRebuild returns the progress of the last rebuild of index, or
+// ErrNotFound if it was never rebuilt.
+func (s *inmemService) GetIndexRebuild(ctx context.Context, index string) (IndexRebuild, error) {
+	if index != IndexExternalIDs {
+		return IndexRebuild{}, ErrUnknownIndex
+	}
+	if err := s.rlock(ctx); err != nil {
+		return IndexRebuild{}, err
+	}
+	defer s.mtx.RUnlock()
+	if s.rebuild.status.Index == "" {
+		return IndexRebuild{}, ErrNotFound
+	}
+	status := s.rebuild.status
+	status.Conflicts = append([]IndexConflict(nil), status.Conflicts...)
+	return status, nil
+}
+
+// rebuildExternalIDs derives the external ID index from the customers ids,
+// a batch at a time, and swaps it in.
+func (s *inmemService) rebuildExternalIDs(ids []string) {
+	claims := map[externalKey][]string{} // customers claiming each key, the owner first
+	claim := func(id string, ids Metadata) {
+		for system, ext := range ids {
+			k := externalKey{system, ext}
+			claims[k] = append(claims[k], id)
+		}
+	}
+	for len(ids) > 0 {
+		n := rebuildBatch
+		if n > len(ids) {
+			n = len(ids)
+		}
+		s.mtx.RLock()
+		for _, id := range ids[:n] {
+			if p, ok := s.customers[id]; ok {
+				claim(id, p.ExternalIDs)
+			}
+		}
+		s.mtx.RUnlock()
+		ids = ids[n:]
+		s.mtx.Lock()
+		s.rebuild.status.Processed += n
+		s.mtx.Unlock()
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	// Customers written meanwhile, or created, are read again as they are
+	// now, after the others.
+	touched := make([]string, 0, len(s.rebuild.touched))
+	for id := range s.rebuild.touched {
+		touched = append(touched, id)
+	}
+	sort.Strings(touched)
+	for k, ids := range claims {
+		kept := ids[:0]
+		for _, id := range ids {
+			if !s.rebuild.touched[id] {
+				kept = append(kept, id)
+			}
+		}
+		claims[k] = kept
+	}
+	for _, id := range touched {
+		if p, ok := s.customers[id]; ok {
+			claim(id, p.ExternalIDs)
+		}
+	}
+
+	external := make(map[externalKey]string, len(claims))
+	status := &s.rebuild.status
+	for k, ids := range claims {
+		if len(ids) == 0 {
+			continue
+		}
+		external[k] = ids[0]
+		if len(ids) > 1 {
+			status.Conflicts = append(status.Conflicts, IndexConflict{Key: k.system + ":" + k.id, CustomerIDs: ids})
+		}
+	}
+	s.external = external
+	sort.Slice(status.Conflicts, func(i, j int) bool { return status.Conflicts[i].Key < status.Conflicts[j].Key })
+	finished := s.clock.Now()
+	status.State, status.Finished, status.Entries = RebuildDone, &finished, len(external)
+	s.rebuild.touched = nil
+}
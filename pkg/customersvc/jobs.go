@@ -0,0 +1,232 @@
+package customersvc
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/endpoint"
+	httptransport "github.com/go-kit/kit/transport/http"
+	"github.com/gorilla/mux"
+)
+
+// States of a Job.
+const (
+	JobRunning = "running"
+	JobDone    = "done"
+)
+
+// Job is the progress of an operation run in the background, such as a bulk
+// patch, or its outcome once it's finished.
+type Job struct {
+	ID       string     `json:"id" xml:"id"`
+	Kind     string     `json:"kind" xml:"kind"`
+	State    string     `json:"state" xml:"state"`
+	Started  time.Time  `json:"started" xml:"started"`
+	Finished *time.Time `json:"finished,omitempty" xml:"finished,omitempty"`
+	// Total is the number of records to process, and Succeeded and Failed
+	// the number processed so far.
+	Total     int `json:"total" xml:"total"`
+	Succeeded int `json:"succeeded" xml:"succeeded"`
+	Failed    int `json:"failed" xml:"failed"`
+	// Results has the outcome for each record processed, in the order
+	// processed.
+	Results []JobResult `json:"results,omitempty" xml:"results>result,omitempty"`
+	// Error is why the job stopped short of processing every record, if
+	// it did.
+	Error string `json:"error,omitempty" xml:"error,omitempty"`
+}
+
+// JobResult is the outcome of a job for one record: Error is empty if it
+// succeeded.
+type JobResult struct {
+	ID    string `json:"id" xml:"id"`
+	Error string `json:"error,omitempty" xml:"error,omitempty"`
+}
+
+// Jobs runs operations in the background and keeps their progress, so that
+// requests starting them can return at once and be polled. The last Keep
+// finished jobs are kept, in memory. It's safe for concurrent use.
+type Jobs struct {
+	keep int
+
+	mtx   sync.Mutex
+	ids   ulidSource
+	jobs  map[string]*Job
+	order []string // of finished jobs, oldest first
+}
+
+// NewJobs returns an empty job store keeping the last keep finished jobs,
+// at least one. Mount it with WithJobs.
+func NewJobs(keep int, options ...Option) *Jobs {
+	o := makeOptions(options)
+	if keep < 1 {
+		keep = 1
+	}
+	return &Jobs{
+		keep: keep,
+		ids:  ulidSource{clock: o.clock, rand: o.rand},
+		jobs: map[string]*Job{},
+	}
+}
+
+// Get returns job id, or ErrNotFound if there's none.
+func (j *Jobs) Get(id string) (Job, error) {
+	j.mtx.Lock()
+	defer j.mtx.Unlock()
+	job, ok := j.jobs[id]
+	if !ok {
+		return Job{}, ErrNotFound
+	}
+	return job.copy(), nil
+}
+
+// List returns the jobs kept, most recently started first, without their
+// results.
+func (j *Jobs) List() []Job {
+	j.mtx.Lock()
+	defer j.mtx.Unlock()
+	jobs := make([]Job, 0, len(j.jobs))
+	for _, job := range j.jobs {
+		summary := *job
+		summary.Results = nil
+		jobs = append(jobs, summary)
+	}
+	sort.Slice(jobs, func(i, k int) bool { return jobs[i].ID > jobs[k].ID }) // ULIDs sort by time
+	return jobs
+}
+
+func (job *Job) copy() Job {
+	c := *job
+	c.Results = append([]JobResult(nil), job.Results...)
+	return c
+}
+
+// start records a job of kind over total records and runs it with run in
+// the background, which reports each record's outcome with record. The job
+// outlives the request starting it, from ctx, so run gets a context of its
+// own, which still propagates the request's headers.
+func (j *Jobs) start(ctx context.Context, kind string, total int, run func(ctx context.Context, record func(id string, err error)) error) (Job, error) {
+	j.mtx.Lock()
+	id, err := j.ids.next()
+	if err != nil {
+		j.mtx.Unlock()
+		return Job{}, err
+	}
+	job := &Job{ID: id, Kind: kind, State: JobRunning, Started: j.ids.clock.Now(), Total: total}
+	j.jobs[id] = job
+	started := job.copy()
+	j.mtx.Unlock()
+
+	record := func(id string, err error) {
+		r := JobResult{ID: id}
+		j.mtx.Lock()
+		defer j.mtx.Unlock()
+		if err != nil {
+			r.Error = err.Error()
+			job.Failed++
+		} else {
+			job.Succeeded++
+		}
+		job.Results = append(job.Results, r)
+	}
+	go func() {
+		err := run(detachPropagation(ctx), record)
+		j.mtx.Lock()
+		defer j.mtx.Unlock()
+		if err != nil {
+			job.Error = err.Error()
+		}
+		finished := j.ids.clock.Now()
+		job.State, job.Finished = JobDone, &finished
+		j.order = append(j.order, job.ID)
+		for len(j.order) > j.keep {
+			delete(j.jobs, j.order[0])
+			j.order = j.order[1:]
+		}
+	}()
+	return started, nil
+}
+
+// WithJobs runs background operations with jobs, enabling those that need
+// it, and mounts:
+//
+//	GET     /jobs/       list the jobs kept, without their results
+//	GET     /jobs/:id    a job's progress, or outcome, with per-record results
+//	POST    /customers/bulk-patch
+//	                     patch every customer matching a filter, see BulkPatch
+func WithJobs(jobs *Jobs) HandlerOption {
+	return func(c *handlerConfig) { c.jobs = jobs }
+}
+
+func mountJobs(r *mux.Router, s Service, jobs *Jobs, wrap func(string, endpoint.Endpoint) endpoint.Endpoint, options []httptransport.ServerOption) {
+	r.Methods("GET").Path("/jobs/").Handler(httptransport.NewServer(
+		wrap("ListJobs", makeListJobsEndpoint(jobs)),
+		decodeListJobsRequest,
+		encodeResponse,
+		options...,
+	))
+	r.Methods("GET").Path("/jobs/{id}").Handler(httptransport.NewServer(
+		wrap("GetJob", makeGetJobEndpoint(jobs)),
+		decodeGetJobRequest,
+		encodeResponse,
+		options...,
+	))
+	r.Methods("POST").Path("/customers/bulk-patch").Handler(httptransport.NewServer(
+		wrap("BulkPatchCustomers", makeBulkPatchEndpoint(s, jobs)),
+		decodeBulkPatchRequest,
+		encodeResponse,
+		options...,
+	))
+}
+
+func makeListJobsEndpoint(jobs *Jobs) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		return listJobsResponse{Jobs: jobs.List()}, nil
+	}
+}
+
+func makeGetJobEndpoint(jobs *Jobs) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(getJobRequest)
+		job, e := jobs.Get(req.ID)
+		if e != nil {
+			return getJobResponse{Err: e}, nil
+		}
+		return getJobResponse{Job: &job}, nil
+	}
+}
+
+type listJobsRequest struct{}
+
+type listJobsResponse struct {
+	Jobs []Job `json:"jobs" xml:"jobs>job"`
+	Err  error `json:"err,omitempty" xml:"-"`
+}
+
+func (r listJobsResponse) error() error { return r.Err }
+
+type getJobRequest struct {
+	ID string
+}
+
+type getJobResponse struct {
+	Job *Job  `json:"job,omitempty" xml:"job,omitempty"`
+	Err error `json:"err,omitempty" xml:"-"`
+}
+
+func (r getJobResponse) error() error { return r.Err }
+
+func decodeListJobsRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	return listJobsRequest{}, nil
+}
+
+func decodeGetJobRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	id, ok := mux.Vars(r)["id"]
+	if !ok {
+		return nil, ErrBadRouting
+	}
+	return getJobRequest{ID: id}, nil
+}
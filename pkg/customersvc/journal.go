@@ -0,0 +1,523 @@
+package customersvc
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// ErrCorruptSnapshot is returned by OpenJournal for a snapshot that fails its
+// checksum. Snapshots are replaced atomically, so unlike a torn record at the
+// end of the log, it isn't the result of a crash, and isn't ignored.
+var ErrCorruptSnapshot = errors.New("journal snapshot is corrupt")
+
+// FsyncPolicy says when a Journal flushes what it writes to stable storage.
+// Whatever it is, a crash of the process alone loses nothing written.
+type FsyncPolicy int
+
+const (
+	// FsyncAlways flushes each write before the call making it returns, so
+	// that no acknowledged write is lost when the machine fails. It's the
+	// default.
+	FsyncAlways FsyncPolicy = iota
+	// FsyncInterval flushes every JournalOptions.FsyncInterval. Writes
+	// acknowledged in the last interval may be lost when the machine fails.
+	FsyncInterval
+	// FsyncNever leaves flushing to the operating system.
+	FsyncNever
+)
+
+// ParseFsyncPolicy parses "always", "interval" or "never".
+func ParseFsyncPolicy(s string) (FsyncPolicy, error) {
+	switch s {
+	case "always":
+		return FsyncAlways, nil
+	case "interval":
+		return FsyncInterval, nil
+	case "never":
+		return FsyncNever, nil
+	}
+	return FsyncAlways, fmt.Errorf("unknown fsync policy %q", s)
+}
+
+// JournalOptions configure OpenJournal.
+type JournalOptions struct {
+	Fsync FsyncPolicy
+	// FsyncInterval is how often writes are flushed under FsyncInterval.
+	// Zero means a second.
+	FsyncInterval time.Duration
+	// SnapshotEvery is the number of records appended to the log before it's
+	// compacted into a new snapshot. Zero means 10000.
+	SnapshotEvery int
+}
+
+// Journal makes the inmem store durable, see WithJournal. It keeps two files
+// in its directory: a snapshot of every customer, with the history and
+// revisions the store keeps of it, and an append-only log of the writes made
+// since. Each write appends the new state of the customer it changed, and
+// every SnapshotEvery records, the log is compacted into a new snapshot.
+//
+// On opening, the snapshot is loaded and the log replayed. A record torn by
+// a crash while it was being appended is the last one, and is cut off. Once
+// appending fails, e.g. on a full disk, the log can't be trusted to be
+// appended to, and every later write fails with the same error.
+//
+// Reservations made by PrepareCustomer aren't journaled, and lapse when the
+// process exits.
+type Journal struct {
+	dir    string
+	opts   JournalOptions
+	logger Logger
+
+	mtx   sync.Mutex
+	wal   *os.File
+	seq   uint64 // of the last record appended
+	since int    // records appended since the last snapshot
+	err   error  // the first append error, failing every later one
+	state *journalState
+	done  chan struct{}
+}
+
+const (
+	snapshotFile  = "snapshot"
+	walFile       = "wal"
+	snapshotMagic = "CSVCSNP1"
+	walMagic      = "CSVCWAL1"
+)
+
+// journalOp is the kind of a journalRecord.
+type journalOp uint8
+
+const (
+	opWrite    journalOp = iota + 1 // Customer is the new state of customer ID
+	opDelete                        // customer ID was deleted
+	opConsents                      // Consents are those of customer ID
+	opEvict                         // customer ID was moved to the cold tier
+	opImport                        // Cold was brought back from the cold tier
+)
+
+// journalRecord is a write, as appended to the log. Records are gob-encoded
+// and framed by their length and CRC-32C.
+type journalRecord struct {
+	Seq      uint64
+	At       time.Time
+	Op       journalOp
+	ID       string
+	Event    string // of opWrite, with N, for CustomerStats
+	N        int
+	Customer Customer
+	Consents []Consent
+	Cold     *ColdCustomer // of opImport
+}
+
+// journalSnapshot is the state of the inmem store after record Seq.
+type journalSnapshot struct {
+	Seq       uint64
+	Customers []snapshotCustomer
+}
+
+// snapshotCustomer is everything the inmem store keeps about a customer ID,
+// including, for a deleted customer, its revisions.
+type snapshotCustomer struct {
+	ID               string
+	Exists           bool
+	Customer         Customer
+	Created, Updated time.Time
+	Events           map[string]int
+	Revisions        []snapshotRevision
+	Truncated        bool
+	Consents         []Consent
+}
+
+type snapshotRevision struct {
+	At       time.Time
+	Customer Customer
+	Deleted  bool
+}
+
+// journalState is what OpenJournal recovered, for the store to load.
+type journalState struct {
+	snapshot journalSnapshot
+	records  []journalRecord
+}
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// OpenJournal opens the journal in dir, creating it if need be, and
+// recovers its state for the store given it with WithJournal.
+func OpenJournal(dir string, opts JournalOptions, logger Logger) (*Journal, error) {
+	if opts.FsyncInterval <= 0 {
+		opts.FsyncInterval = time.Second
+	}
+	if opts.SnapshotEvery <= 0 {
+		opts.SnapshotEvery = 10000
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	j := &Journal{dir: dir, opts: opts, logger: logger, state: &journalState{}, done: make(chan struct{})}
+	if err := j.loadSnapshot(); err != nil {
+		return nil, err
+	}
+	if err := j.openWAL(); err != nil {
+		return nil, err
+	}
+	logger.Log("journal", dir, "snapshot", j.state.snapshot.Seq, "replayed", len(j.state.records))
+	if opts.Fsync == FsyncInterval {
+		go j.syncEvery(opts.FsyncInterval)
+	}
+	return j, nil
+}
+
+func (j *Journal) loadSnapshot() error {
+	buf, err := ioutil.ReadFile(filepath.Join(j.dir, snapshotFile))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !bytes.HasPrefix(buf, []byte(snapshotMagic)) {
+		return ErrCorruptSnapshot
+	}
+	payload, _, err := readFrame(bufio.NewReader(bytes.NewReader(buf[len(snapshotMagic):])))
+	if err != nil {
+		return ErrCorruptSnapshot
+	}
+	if err := gob.NewDecoder(bytes.NewReader(payload)).Decode(&j.state.snapshot); err != nil {
+		return ErrCorruptSnapshot
+	}
+	j.seq = j.state.snapshot.Seq
+	return nil
+}
+
+// openWAL reads the records of the log not in the snapshot, cutting off a
+// torn one at the end, and leaves it open for appending.
+func (j *Journal) openWAL() error {
+	f, err := os.OpenFile(filepath.Join(j.dir, walFile), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	magic := make([]byte, len(walMagic))
+	switch _, err := io.ReadFull(f, magic); {
+	case err == io.EOF || err == io.ErrUnexpectedEOF:
+		// A new log, or one whose header was being written when the
+		// process died.
+		if err := f.Truncate(0); err != nil {
+			f.Close()
+			return err
+		}
+		if _, err := f.Write([]byte(walMagic)); err != nil {
+			f.Close()
+			return err
+		}
+	case err != nil:
+		f.Close()
+		return err
+	case string(magic) != walMagic:
+		f.Close()
+		return fmt.Errorf("%s is not a customersvc journal", f.Name())
+	default:
+		if err := j.readRecords(f); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	j.wal = f
+	return j.wal.Sync()
+}
+
+func (j *Journal) readRecords(f *os.File) error {
+	r := bufio.NewReader(f)
+	offset := int64(len(walMagic))
+	for {
+		payload, n, err := readFrame(r)
+		if err == io.EOF {
+			return nil
+		}
+		var rec journalRecord
+		if err == nil {
+			err = gob.NewDecoder(bytes.NewReader(payload)).Decode(&rec)
+		}
+		if err != nil {
+			// The write of this record was cut short; nothing after it was
+			// acknowledged.
+			j.logger.Log("journal", j.dir, "torn_record_at", offset, "err", err)
+			return f.Truncate(offset)
+		}
+		offset += n
+		if rec.Seq <= j.state.snapshot.Seq {
+			continue // appended before a compaction interrupted by a crash
+		}
+		j.state.records = append(j.state.records, rec)
+		j.seq = rec.Seq
+	}
+}
+
+// readFrame reads a length- and checksum-prefixed payload, returning the
+// bytes it took. It returns io.EOF only if r is at its end.
+func readFrame(r io.Reader) ([]byte, int64, error) {
+	var header [8]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, 0, err
+	}
+	size := int64(binary.BigEndian.Uint32(header[:4]))
+	// The size may be garbage, so the payload isn't allocated up front.
+	var payload bytes.Buffer
+	if _, err := io.CopyN(&payload, r, size); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, 0, err
+	}
+	if crc32.Checksum(payload.Bytes(), crcTable) != binary.BigEndian.Uint32(header[4:]) {
+		return nil, 0, errors.New("checksum mismatch")
+	}
+	return payload.Bytes(), int64(len(header)) + size, nil
+}
+
+// frame gob-encodes v behind its length and checksum.
+func frame(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.Write(make([]byte, 8))
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	b := buf.Bytes()
+	binary.BigEndian.PutUint32(b[:4], uint32(len(b)-8))
+	binary.BigEndian.PutUint32(b[4:8], crc32.Checksum(b[8:], crcTable))
+	return b, nil
+}
+
+// take returns the recovered state, once.
+func (j *Journal) take() *journalState {
+	j.mtx.Lock()
+	defer j.mtx.Unlock()
+	state := j.state
+	j.state = nil
+	return state
+}
+
+// append writes rec to the log, reporting whether it's due for compaction.
+func (j *Journal) append(rec journalRecord) (bool, error) {
+	j.mtx.Lock()
+	defer j.mtx.Unlock()
+	if j.err != nil {
+		return false, j.err
+	}
+	rec.Seq = j.seq + 1
+	b, err := frame(rec)
+	if err != nil {
+		return false, err // nothing was written
+	}
+	if _, err := j.wal.Write(b); err != nil {
+		j.err = fmt.Errorf("journal: %v", err)
+		return false, j.err
+	}
+	if j.opts.Fsync == FsyncAlways {
+		if err := j.wal.Sync(); err != nil {
+			j.err = fmt.Errorf("journal: %v", err)
+			return false, j.err
+		}
+	}
+	j.seq = rec.Seq
+	j.since++
+	return j.since >= j.opts.SnapshotEvery, nil
+}
+
+// compact replaces the snapshot with snap, the state after the last record
+// appended, and empties the log. The caller must keep the store from being
+// written meanwhile. A failure is logged, and compaction retried after the
+// next record, the log meanwhile growing.
+func (j *Journal) compact(snap journalSnapshot) {
+	j.mtx.Lock()
+	defer j.mtx.Unlock()
+	snap.Seq = j.seq
+	if err := j.writeSnapshot(snap); err != nil {
+		j.logger.Log("journal", j.dir, "during", "compaction", "err", err)
+		return
+	}
+	// If the process dies before the log is emptied, the records it still
+	// holds are skipped on recovery, as the snapshot's Seq covers them.
+	if err := j.wal.Truncate(int64(len(walMagic))); err != nil {
+		j.logger.Log("journal", j.dir, "during", "compaction", "err", err)
+		return
+	}
+	if err := j.wal.Sync(); err != nil {
+		j.logger.Log("journal", j.dir, "during", "compaction", "err", err)
+		return
+	}
+	j.since = 0
+}
+
+// writeSnapshot writes snap to a temporary file and renames it over the
+// snapshot, so that there's always a whole one.
+func (j *Journal) writeSnapshot(snap journalSnapshot) error {
+	b, err := frame(snap)
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(j.dir, snapshotFile+".tmp")
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append([]byte(snapshotMagic), b...)); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(j.dir, snapshotFile)); err != nil {
+		return err
+	}
+	// Make the rename itself durable.
+	d, err := os.Open(j.dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+func (j *Journal) syncEvery(interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			j.mtx.Lock()
+			if j.err == nil {
+				if err := j.wal.Sync(); err != nil {
+					j.err = fmt.Errorf("journal: %v", err)
+				}
+			}
+			j.mtx.Unlock()
+		case <-j.done:
+			return
+		}
+	}
+}
+
+// Close flushes the log and closes it. The store using the journal mustn't
+// be written afterwards.
+func (j *Journal) Close() error {
+	close(j.done)
+	j.mtx.Lock()
+	defer j.mtx.Unlock()
+	if err := j.wal.Sync(); err != nil {
+		j.wal.Close()
+		return err
+	}
+	return j.wal.Close()
+}
+
+// WithJournal makes the inmem store durable: it starts from the state j
+// recovered, and journals every write to j before acknowledging it. A
+// Journal serves a single store.
+func WithJournal(j *Journal) Option {
+	return func(o *options) { o.journal = j }
+}
+
+// restore loads the state recovered by a journal into the empty store.
+func (s *inmemService) restore(state *journalState) {
+	for _, c := range state.snapshot.Customers {
+		if c.Exists {
+			s.customers[c.ID] = c.Customer
+			s.indexExternalIDs(c.ID, nil, c.Customer.ExternalIDs)
+			s.history[c.ID] = &customerHistory{created: c.Created, updated: c.Updated, events: c.Events}
+		}
+		if len(c.Revisions) > 0 {
+			r := &revisions{truncated: c.Truncated}
+			for _, rev := range c.Revisions {
+				r.list = append(r.list, revision{at: rev.At, customer: rev.Customer, deleted: rev.Deleted})
+			}
+			s.revisions[c.ID] = r
+		}
+		if len(c.Consents) > 0 {
+			s.consents[c.ID] = c.Consents
+		}
+	}
+	for _, rec := range state.records {
+		switch rec.Op {
+		case opWrite:
+			old := s.customers[rec.ID]
+			// The journaled store kept the index consistent, so this can't
+			// conflict.
+			s.indexExternalIDs(rec.ID, old.ExternalIDs, rec.Customer.ExternalIDs)
+			s.customers[rec.ID] = rec.Customer
+			s.track(rec.ID, rec.Event, rec.N, rec.At)
+		case opDelete:
+			s.forget(rec.ID, rec.At)
+		case opConsents:
+			s.consents[rec.ID] = rec.Consents
+		case opEvict:
+			s.evict(rec.ID)
+		case opImport:
+			s.install(*rec.Cold)
+		}
+	}
+}
+
+// persist appends rec to the store's journal, if it has one, then makes the
+// write it records with apply, and compacts the journal when due. A write
+// the journal fails to take is never made, so that readers never see what
+// a restart would lose. The caller must hold the write lock.
+func (s *inmemService) persist(rec journalRecord, apply func()) error {
+	if s.journal == nil {
+		apply()
+		return nil
+	}
+	due, err := s.journal.append(rec)
+	if err != nil {
+		return err
+	}
+	apply()
+	if due {
+		s.journal.compact(s.dump())
+	}
+	return nil
+}
+
+// dump returns the state of the store as a snapshot. The caller must hold
+// the lock.
+func (s *inmemService) dump() journalSnapshot {
+	ids := make(map[string]bool, len(s.revisions))
+	for id := range s.customers {
+		ids[id] = true
+	}
+	for id := range s.revisions {
+		ids[id] = true
+	}
+	var snap journalSnapshot
+	for id := range ids {
+		c := snapshotCustomer{ID: id, Consents: s.consents[id]}
+		c.Customer, c.Exists = s.customers[id]
+		if h, ok := s.history[id]; ok {
+			c.Created, c.Updated, c.Events = h.created, h.updated, h.events
+		}
+		if r, ok := s.revisions[id]; ok {
+			c.Truncated = r.truncated
+			for _, rev := range r.list {
+				c.Revisions = append(c.Revisions, snapshotRevision{At: rev.at, Customer: rev.customer, Deleted: rev.deleted})
+			}
+		}
+		snap.Customers = append(snap.Customers, c)
+	}
+	return snap
+}
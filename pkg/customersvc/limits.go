@@ -0,0 +1,273 @@
+package customersvc
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/endpoint"
+	"golang.org/x/time/rate"
+
+	"github.com/praveensastry/customersvc/pkg/config"
+)
+
+var (
+	// ErrRateLimited is returned when a request exceeds the configured rate.
+	ErrRateLimited = errors.New("rate limit exceeded")
+	// ErrTimeout is returned when a request outlives the configured timeout.
+	ErrTimeout = errors.New("request timed out")
+	// ErrOverloaded is the message of errors returned when a request can't
+	// get a concurrency slot. Those errors carry a Retry-After header.
+	ErrOverloaded = errors.New("server overloaded, retry later")
+)
+
+// RateLimitMiddleware returns an endpoint middleware that rejects requests
+// above the rate limit in cfg with ErrRateLimited, carrying Retry-After and
+// X-RateLimit-* headers that tell clients when to come back. The returned
+// middleware shares one limiter between every endpoint it wraps, and picks up
+// changes to the limit on reload.
+func RateLimitMiddleware(cfg config.Config) func(method string) endpoint.Middleware {
+	l := &dynamicLimiter{cfg: cfg}
+	return func(method string) endpoint.Middleware {
+		return func(next endpoint.Endpoint) endpoint.Endpoint {
+			return func(ctx context.Context, request interface{}) (interface{}, error) {
+				if err := l.allow(); err != nil {
+					return nil, err
+				}
+				return next(ctx, request)
+			}
+		}
+	}
+}
+
+type dynamicLimiter struct {
+	cfg config.Config
+
+	mtx     sync.Mutex
+	limiter *rate.Limiter
+	limit   float64
+	burst   int
+}
+
+// allow takes a token, or returns the rateLimitedError to reject the request
+// with if there is none.
+func (l *dynamicLimiter) allow() error {
+	v := l.cfg.Get()
+	if v.RateLimit <= 0 {
+		return nil
+	}
+	l.mtx.Lock()
+	if l.limiter == nil || l.limit != v.RateLimit || l.burst != v.RateBurst {
+		burst := v.RateBurst
+		if burst < 1 {
+			burst = 1
+		}
+		l.limiter = rate.NewLimiter(rate.Limit(v.RateLimit), burst)
+		l.limit, l.burst = v.RateLimit, v.RateBurst
+	}
+	limiter := l.limiter
+	l.mtx.Unlock()
+
+	now := time.Now()
+	r := limiter.ReserveN(now, 1)
+	delay := r.DelayFrom(now)
+	if delay == 0 {
+		return nil
+	}
+	r.CancelAt(now) // rejected requests don't use up tokens
+	// Less than one token is left, and the bucket refills at RateLimit.
+	refill := time.Duration(float64(limiter.Burst()-1) / v.RateLimit * float64(time.Second))
+	return rateLimitedError{
+		limit:      limiter.Burst(),
+		retryAfter: delay,
+		reset:      delay + refill,
+	}
+}
+
+// TimeoutMiddleware returns an endpoint middleware that bounds each request
+// by the request timeout in cfg. Requests still running when it expires
+// fail with ErrTimeout.
+func TimeoutMiddleware(cfg config.Config) func(method string) endpoint.Middleware {
+	return func(method string) endpoint.Middleware {
+		return func(next endpoint.Endpoint) endpoint.Endpoint {
+			return func(ctx context.Context, request interface{}) (interface{}, error) {
+				timeout := cfg.Get().RequestTimeout
+				if timeout <= 0 {
+					return next(ctx, request)
+				}
+				ctx, cancel := context.WithTimeout(ctx, time.Duration(timeout))
+				defer cancel()
+				response, err := next(ctx, request)
+				if ctx.Err() == context.DeadlineExceeded {
+					return nil, ErrTimeout
+				}
+				return response, err
+			}
+		}
+	}
+}
+
+// ConcurrencyLimits bounds the number of requests handled at once. Zero
+// values mean unlimited, or no queueing.
+type ConcurrencyLimits struct {
+	// MaxInFlight is the number of requests handled at once across every
+	// endpoint.
+	MaxInFlight int
+	// PerEndpoint is the number of requests handled at once by any single
+	// endpoint.
+	PerEndpoint int
+	// QueueSize is the number of requests that may wait for a free slot.
+	// Requests beyond that are rejected immediately.
+	QueueSize int
+	// QueueTimeout is how long a queued request waits before it's rejected.
+	QueueTimeout time.Duration
+	// RetryAfter is the hint sent to rejected clients.
+	RetryAfter time.Duration
+}
+
+// ConcurrencyLimitMiddleware returns an endpoint middleware that applies
+// limits. Requests that can't get a slot, or whose wait times out, fail with
+// a 503 carrying a Retry-After header, so that a slow backend is shielded
+// from spikes instead of accumulating an unbounded backlog.
+func ConcurrencyLimitMiddleware(limits ConcurrencyLimits) func(method string) endpoint.Middleware {
+	global := newSemaphore(limits.MaxInFlight)
+	queue := newSemaphore(limits.QueueSize)
+	rejected := overloadedError{retryAfter: limits.RetryAfter}
+	return func(method string) endpoint.Middleware {
+		local := newSemaphore(limits.PerEndpoint)
+		return func(next endpoint.Endpoint) endpoint.Endpoint {
+			return func(ctx context.Context, request interface{}) (interface{}, error) {
+				gotGlobal := global.tryAcquire()
+				if !gotGlobal || !local.tryAcquire() {
+					if gotGlobal {
+						global.release() // wait for both together instead
+					}
+					if !queue.tryAcquire() {
+						return nil, rejected
+					}
+					acquired := acquireBoth(ctx, global, local, limits.QueueTimeout)
+					queue.release()
+					if !acquired {
+						return nil, rejected
+					}
+				}
+				defer global.release()
+				defer local.release()
+				return next(ctx, request)
+			}
+		}
+	}
+}
+
+// acquireBoth waits up to timeout for a slot in both semaphores.
+func acquireBoth(ctx context.Context, a, b semaphore, timeout time.Duration) bool {
+	if timeout <= 0 {
+		return false
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	if !a.acquire(ctx) {
+		return false
+	}
+	if !b.acquire(ctx) {
+		a.release()
+		return false
+	}
+	return true
+}
+
+// semaphore is a counting semaphore. A nil semaphore has no limit.
+type semaphore chan struct{}
+
+func newSemaphore(n int) semaphore {
+	if n <= 0 {
+		return nil
+	}
+	return make(semaphore, n)
+}
+
+func (s semaphore) tryAcquire() bool {
+	if s == nil {
+		return true
+	}
+	select {
+	case s <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s semaphore) acquire(ctx context.Context) bool {
+	if s == nil {
+		return true
+	}
+	select {
+	case s <- struct{}{}:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (s semaphore) release() {
+	if s == nil {
+		return
+	}
+	select {
+	case <-s:
+	default:
+	}
+}
+
+// rateLimitedError is ErrRateLimited with backoff hints. It implements the
+// Go kit httptransport StatusCoder and Headerer interfaces.
+type rateLimitedError struct {
+	limit      int           // burst size
+	retryAfter time.Duration // until the next token
+	reset      time.Duration // until the bucket is full again
+}
+
+func (e rateLimitedError) Error() string { return ErrRateLimited.Error() }
+
+func (e rateLimitedError) Unwrap() error { return ErrRateLimited }
+
+func (e rateLimitedError) StatusCode() int { return http.StatusTooManyRequests }
+
+func (e rateLimitedError) Headers() http.Header {
+	return http.Header{
+		RetryAfterHeader:         []string{strconv.Itoa(ceilSeconds(e.retryAfter))},
+		RateLimitLimitHeader:     []string{strconv.Itoa(e.limit)},
+		RateLimitRemainingHeader: []string{"0"},
+		RateLimitResetHeader:     []string{strconv.Itoa(ceilSeconds(e.reset))},
+	}
+}
+
+// overloadedError is ErrOverloaded with a Retry-After hint. It implements
+// the Go kit httptransport StatusCoder and Headerer interfaces.
+type overloadedError struct {
+	retryAfter time.Duration
+}
+
+func (e overloadedError) Error() string { return ErrOverloaded.Error() }
+
+func (e overloadedError) StatusCode() int { return http.StatusServiceUnavailable }
+
+func (e overloadedError) Unwrap() error { return ErrOverloaded }
+
+func (e overloadedError) Headers() http.Header {
+	return http.Header{RetryAfterHeader: []string{strconv.Itoa(ceilSeconds(e.retryAfter))}}
+}
+
+// ceilSeconds rounds d up to whole seconds, and to at least one, so that
+// clients honoring it never come back too early.
+func ceilSeconds(d time.Duration) int {
+	seconds := int((d + time.Second - 1) / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+	return seconds
+}
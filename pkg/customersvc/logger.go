@@ -0,0 +1,12 @@
+package customersvc
+
+// Logger is the structured logger customersvc and its client write to: an
+// event is a list of alternating keys and values.
+//
+// It has the same method as go-kit's log.Logger, so go-kit loggers are
+// Loggers as they are, and Loggers can be passed wherever go-kit expects one.
+// Packages zaplogger and sloglogger adapt zap and log/slog loggers, for
+// services built on those.
+type Logger interface {
+	Log(keyvals ...interface{}) error
+}
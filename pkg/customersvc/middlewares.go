@@ -2,15 +2,14 @@ package customersvc
 
 import (
 	"context"
+	"sync"
 	"time"
-
-	"github.com/go-kit/kit/log"
 )
 
 // Middleware describes a service (as opposed to endpoint) middleware.
 type Middleware func(Service) Service
 
-func LoggingMiddleware(logger log.Logger) Middleware {
+func LoggingMiddleware(logger Logger) Middleware {
 	return func(next Service) Service {
 		return &loggingMiddleware{
 			next:   next,
@@ -21,7 +20,7 @@ func LoggingMiddleware(logger log.Logger) Middleware {
 
 type loggingMiddleware struct {
 	next   Service
-	logger log.Logger
+	logger Logger
 }
 
 func (mw loggingMiddleware) PostCustomer(ctx context.Context, p Customer) (err error) {
@@ -73,7 +72,7 @@ func (mw loggingMiddleware) GetAddress(ctx context.Context, customerID string, a
 	return mw.next.GetAddress(ctx, customerID, addressID)
 }
 
-func (mw loggingMiddleware) PostAddress(ctx context.Context, customerID string, a Address) (err error) {
+func (mw loggingMiddleware) PostAddress(ctx context.Context, customerID string, a Address) (created Address, err error) {
 	defer func(begin time.Time) {
 		mw.logger.Log("method", "PostAddress", "customerID", customerID, "took", time.Since(begin), "err", err)
 	}(time.Now())
@@ -86,3 +85,211 @@ func (mw loggingMiddleware) DeleteAddress(ctx context.Context, customerID string
 	}(time.Now())
 	return mw.next.DeleteAddress(ctx, customerID, addressID)
 }
+
+func (mw loggingMiddleware) GetCustomersByRegion(ctx context.Context) (regions []RegionCount, err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log("method", "GetCustomersByRegion", "regions", len(regions), "took", time.Since(begin), "err", err)
+	}(time.Now())
+	return mw.next.GetCustomersByRegion(ctx)
+}
+
+func (mw loggingMiddleware) PostAddresses(ctx context.Context, customerID string, as []Address) (results []AddressResult, err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log("method", "PostAddresses", "customerID", customerID, "addresses", len(as), "took", time.Since(begin), "err", err)
+	}(time.Now())
+	return mw.next.PostAddresses(ctx, customerID, as)
+}
+
+func (mw loggingMiddleware) ReorderAddresses(ctx context.Context, customerID string, addressIDs []string) (err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log("method", "ReorderAddresses", "customerID", customerID, "took", time.Since(begin), "err", err)
+	}(time.Now())
+	return mw.next.ReorderAddresses(ctx, customerID, addressIDs)
+}
+
+func (mw loggingMiddleware) ValidateCustomer(ctx context.Context, p Customer) (errs []FieldError, err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log("method", "ValidateCustomer", "id", p.ID, "problems", len(errs), "took", time.Since(begin), "err", err)
+	}(time.Now())
+	return mw.next.ValidateCustomer(ctx, p)
+}
+
+func (mw loggingMiddleware) ValidateAddress(ctx context.Context, customerID string, a Address) (errs []FieldError, err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log("method", "ValidateAddress", "customerID", customerID, "problems", len(errs), "took", time.Since(begin), "err", err)
+	}(time.Now())
+	return mw.next.ValidateAddress(ctx, customerID, a)
+}
+
+func (mw loggingMiddleware) ArchiveCustomer(ctx context.Context, id string) (err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log("method", "ArchiveCustomer", "id", id, "took", time.Since(begin), "err", err)
+	}(time.Now())
+	return mw.next.ArchiveCustomer(ctx, id)
+}
+
+func (mw loggingMiddleware) UnarchiveCustomer(ctx context.Context, id string) (err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log("method", "UnarchiveCustomer", "id", id, "took", time.Since(begin), "err", err)
+	}(time.Now())
+	return mw.next.UnarchiveCustomer(ctx, id)
+}
+
+func (mw loggingMiddleware) GetCustomers(ctx context.Context, f CustomerFilter) (customers []Customer, err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log("method", "GetCustomers", "archived", f.Archived, "customers", len(customers), "took", time.Since(begin), "err", err)
+	}(time.Now())
+	return mw.next.GetCustomers(ctx, f)
+}
+
+func (mw loggingMiddleware) GetCustomerStats(ctx context.Context, id string) (stats CustomerStats, err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log("method", "GetCustomerStats", "id", id, "took", time.Since(begin), "err", err)
+	}(time.Now())
+	return mw.next.GetCustomerStats(ctx, id)
+}
+
+func (mw loggingMiddleware) PrepareCustomer(ctx context.Context, p Customer, ttl time.Duration) (pending PendingCustomer, err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log("method", "PrepareCustomer", "id", p.ID, "ttl", ttl, "took", time.Since(begin), "err", err)
+	}(time.Now())
+	return mw.next.PrepareCustomer(ctx, p, ttl)
+}
+
+func (mw loggingMiddleware) CommitCustomer(ctx context.Context, id string) (err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log("method", "CommitCustomer", "id", id, "took", time.Since(begin), "err", err)
+	}(time.Now())
+	return mw.next.CommitCustomer(ctx, id)
+}
+
+func (mw loggingMiddleware) AbortCustomer(ctx context.Context, id string) (err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log("method", "AbortCustomer", "id", id, "took", time.Since(begin), "err", err)
+	}(time.Now())
+	return mw.next.AbortCustomer(ctx, id)
+}
+
+func (mw loggingMiddleware) GetCustomerAsOf(ctx context.Context, id string, t time.Time) (p Customer, err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log("method", "GetCustomerAsOf", "id", id, "as_of", t, "took", time.Since(begin), "err", err)
+	}(time.Now())
+	return mw.next.GetCustomerAsOf(ctx, id, t)
+}
+
+func (mw loggingMiddleware) GetCustomerByExternalID(ctx context.Context, system string, externalID string) (p Customer, err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log("method", "GetCustomerByExternalID", "system", system, "external_id", externalID, "took", time.Since(begin), "err", err)
+	}(time.Now())
+	return mw.next.GetCustomerByExternalID(ctx, system, externalID)
+}
+
+func (mw loggingMiddleware) GrantConsent(ctx context.Context, customerID string, c Consent) (granted Consent, err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log("method", "GrantConsent", "customerID", customerID, "consent", c.Type, "took", time.Since(begin), "err", err)
+	}(time.Now())
+	return mw.next.GrantConsent(ctx, customerID, c)
+}
+
+func (mw loggingMiddleware) WithdrawConsent(ctx context.Context, customerID string, consentType string) (err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log("method", "WithdrawConsent", "customerID", customerID, "consent", consentType, "took", time.Since(begin), "err", err)
+	}(time.Now())
+	return mw.next.WithdrawConsent(ctx, customerID, consentType)
+}
+
+func (mw loggingMiddleware) GetConsents(ctx context.Context, customerID string) (consents []Consent, err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log("method", "GetConsents", "customerID", customerID, "took", time.Since(begin), "err", err)
+	}(time.Now())
+	return mw.next.GetConsents(ctx, customerID)
+}
+
+func (mw loggingMiddleware) GetDuplicateAddresses(ctx context.Context) (duplicates []DuplicateAddresses, err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log("method", "GetDuplicateAddresses", "took", time.Since(begin), "err", err)
+	}(time.Now())
+	return mw.next.GetDuplicateAddresses(ctx)
+}
+
+func (mw loggingMiddleware) RepairAddresses(ctx context.Context, dryRun bool) (repairs []AddressRepair, err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log("method", "RepairAddresses", "dryRun", dryRun, "repairs", len(repairs), "took", time.Since(begin), "err", err)
+	}(time.Now())
+	return mw.next.RepairAddresses(ctx, dryRun)
+}
+
+func (mw loggingMiddleware) RebuildIndex(ctx context.Context, index string) (r IndexRebuild, err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log("method", "RebuildIndex", "index", index, "customers", r.Customers, "took", time.Since(begin), "err", err)
+	}(time.Now())
+	return mw.next.RebuildIndex(ctx, index)
+}
+
+func (mw loggingMiddleware) GetIndexRebuild(ctx context.Context, index string) (r IndexRebuild, err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log("method", "GetIndexRebuild", "index", index, "state", r.State, "took", time.Since(begin), "err", err)
+	}(time.Now())
+	return mw.next.GetIndexRebuild(ctx, index)
+}
+
+func (mw loggingMiddleware) CheckConsistency(ctx context.Context, repair bool) (r ConsistencyReport, err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log("method", "CheckConsistency", "repair", repair, "anomalies", len(r.Anomalies), "took", time.Since(begin), "err", err)
+	}(time.Now())
+	return mw.next.CheckConsistency(ctx, repair)
+}
+
+// ReportCacheMiddleware caches the result of GetCustomersByRegion for up to
+// maxStale, so dashboards polling the report don't force an aggregation over
+// the whole store on every request. Reports are cached by tenant, see
+// TenantFrom, as tenants' stores may be apart, see RoutingService. Callers
+// get copies of the report, and don't wait for each other while it's
+// recomputed. All other methods pass straight through.
+func ReportCacheMiddleware(maxStale time.Duration, opts ...Option) Middleware {
+	o := makeOptions(opts)
+	return func(next Service) Service {
+		return &reportCacheMiddleware{
+			Service:  next,
+			maxStale: maxStale,
+			clock:    o.clock,
+			reports:  map[string]cachedReport{},
+		}
+	}
+}
+
+type reportCacheMiddleware struct {
+	Service
+	maxStale time.Duration
+	clock    Clock
+
+	mtx     sync.Mutex
+	reports map[string]cachedReport // by tenant
+}
+
+type cachedReport struct {
+	regions []RegionCount
+	updated time.Time
+}
+
+func (mw *reportCacheMiddleware) GetCustomersByRegion(ctx context.Context) ([]RegionCount, error) {
+	tenant := TenantFrom(ctx)
+	mw.mtx.Lock()
+	cached, ok := mw.reports[tenant]
+	mw.mtx.Unlock()
+	if ok && mw.clock.Now().Sub(cached.updated) < mw.maxStale {
+		return append([]RegionCount(nil), cached.regions...), nil
+	}
+	begin := mw.clock.Now()
+	regions, err := mw.Service.GetCustomersByRegion(ctx)
+	if err != nil {
+		return nil, err
+	}
+	mw.mtx.Lock()
+	// Of reports recomputed concurrently, the one begun last is kept.
+	if !begin.Before(mw.reports[tenant].updated) {
+		mw.reports[tenant] = cachedReport{regions: append([]RegionCount(nil), regions...), updated: begin}
+	}
+	mw.mtx.Unlock()
+	return regions, nil
+}
@@ -0,0 +1,444 @@
+package customersvc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/metrics"
+)
+
+// ReadSource selects which backend a MigrationService serves reads from.
+type ReadSource int
+
+const (
+	// ReadFromOld serves reads from the backend being migrated away from.
+	// This is the safe default until a backfill has completed.
+	ReadFromOld ReadSource = iota
+	// ReadFromNew serves reads from the backend being migrated to.
+	ReadFromNew
+)
+
+// ParseReadSource parses "old" or "new".
+func ParseReadSource(s string) (ReadSource, error) {
+	switch s {
+	case "old":
+		return ReadFromOld, nil
+	case "new":
+		return ReadFromNew, nil
+	}
+	return ReadFromOld, fmt.Errorf("unknown read source %q", s)
+}
+
+// Lister is implemented by backends that can enumerate every customer they
+// hold. It's only required of the old backend during a backfill.
+type Lister interface {
+	ListCustomers(ctx context.Context) ([]Customer, error)
+}
+
+// NewMigrationService returns a Service that double-writes to the old and new
+// backends, so that one can be swapped for the other without downtime.
+//
+// Writes go to the old backend first; its result is authoritative, and the
+// new backend is only written if the old one succeeded. Reads are served from
+// the backend selected by readFrom and shadowed against the other one. Any
+// disagreement between the two is counted in divergences, labeled by method,
+// and logged, but never surfaced to the caller. Addresses written without an
+// ID are given one before either backend is written, or get the one the old
+// backend generated, so that both hold them under the same IDs. Writes to
+// each customer are applied to both backends before the next starts, so
+// that Backfill can copy it between them.
+func NewMigrationService(old, new Service, readFrom ReadSource, divergences metrics.Counter, logger Logger) Service {
+	primary, secondary := old, new
+	if readFrom == ReadFromNew {
+		primary, secondary = new, old
+	}
+	return &migrationService{
+		old:         old,
+		new:         new,
+		primary:     primary,
+		secondary:   secondary,
+		divergences: divergences,
+		logger:      logger,
+		ids:         ulidSource{clock: SystemClock, rand: SystemRand},
+	}
+}
+
+type migrationService struct {
+	old, new           Service
+	primary, secondary Service
+	divergences        metrics.Counter
+	logger             Logger
+
+	mtx sync.Mutex
+	ids ulidSource // guarded by mtx
+
+	customers [64]sync.Mutex // serialize writes to a customer, by hash of its ID
+}
+
+// lock holds back other writes to customer id, and its backfill, until the
+// function it returns is called.
+func (s *migrationService) lock(id string) (unlock func()) {
+	m := &s.customers[stripe(id, len(s.customers))]
+	m.Lock()
+	return m.Unlock
+}
+
+// stripe returns which of n locks guards the customer with ID id.
+func stripe(id string, n int) int {
+	h := fnv.New32a()
+	h.Write([]byte(id))
+	return int(h.Sum32() % uint32(n))
+}
+
+// withAddressIDs returns p with IDs given to its addresses without one, so
+// that the backends don't each generate their own.
+func (s *migrationService) withAddressIDs(p Customer) (Customer, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	addresses := append([]Address(nil), p.Addresses...)
+	for i := range addresses {
+		if addresses[i].ID != "" {
+			continue
+		}
+		id, err := s.ids.next()
+		if err != nil {
+			return p, err
+		}
+		addresses[i].ID = id
+	}
+	if p.Addresses != nil {
+		p.Addresses = addresses
+	}
+	return p, nil
+}
+
+func (s *migrationService) diverged(method string, err error) {
+	s.divergences.With("method", method).Add(1)
+	s.logger.Log("method", method, "divergence", true, "err", err)
+}
+
+// write applies op, a write to customer id, to the old backend and, if that
+// succeeded, to the new one.
+func (s *migrationService) write(method, id string, op func(Service) error) error {
+	defer s.lock(id)()
+	if err := op(s.old); err != nil {
+		return err
+	}
+	if err := op(s.new); err != nil {
+		s.diverged(method, err)
+	}
+	return nil
+}
+
+// read applies op to both backends and returns the primary's result.
+func (s *migrationService) read(method string, op func(Service) (interface{}, error)) (interface{}, error) {
+	v, err := op(s.primary)
+	shadow, shadowErr := op(s.secondary)
+	if err != shadowErr || !reflect.DeepEqual(v, shadow) {
+		s.diverged(method, shadowErr)
+	}
+	return v, err
+}
+
+func (s *migrationService) PostCustomer(ctx context.Context, p Customer) error {
+	p, err := s.withAddressIDs(p)
+	if err != nil {
+		return err
+	}
+	return s.write("PostCustomer", p.ID, func(b Service) error { return b.PostCustomer(ctx, p) })
+}
+
+func (s *migrationService) GetCustomer(ctx context.Context, id string) (Customer, error) {
+	v, err := s.read("GetCustomer", func(b Service) (interface{}, error) { return b.GetCustomer(ctx, id) })
+	return v.(Customer), err
+}
+
+func (s *migrationService) PutCustomer(ctx context.Context, id string, p Customer) error {
+	p, err := s.withAddressIDs(p)
+	if err != nil {
+		return err
+	}
+	return s.write("PutCustomer", id, func(b Service) error { return b.PutCustomer(ctx, id, p) })
+}
+
+func (s *migrationService) PatchCustomer(ctx context.Context, id string, p Customer) error {
+	p, err := s.withAddressIDs(p)
+	if err != nil {
+		return err
+	}
+	return s.write("PatchCustomer", id, func(b Service) error { return b.PatchCustomer(ctx, id, p) })
+}
+
+func (s *migrationService) DeleteCustomer(ctx context.Context, id string) error {
+	return s.write("DeleteCustomer", id, func(b Service) error { return b.DeleteCustomer(ctx, id) })
+}
+
+func (s *migrationService) GetAddresses(ctx context.Context, customerID string) ([]Address, error) {
+	v, err := s.read("GetAddresses", func(b Service) (interface{}, error) { return b.GetAddresses(ctx, customerID) })
+	return v.([]Address), err
+}
+
+func (s *migrationService) GetAddress(ctx context.Context, customerID string, addressID string) (Address, error) {
+	v, err := s.read("GetAddress", func(b Service) (interface{}, error) { return b.GetAddress(ctx, customerID, addressID) })
+	return v.(Address), err
+}
+
+func (s *migrationService) PostAddress(ctx context.Context, customerID string, a Address) (Address, error) {
+	defer s.lock(customerID)()
+	if a.ID == "" {
+		s.mtx.Lock()
+		id, err := s.ids.next()
+		s.mtx.Unlock()
+		if err != nil {
+			return Address{}, err
+		}
+		a.ID = id
+	}
+	created, err := s.old.PostAddress(ctx, customerID, a)
+	if err != nil {
+		return created, err
+	}
+	// Under DedupMerge, the old backend may have merged a into an existing
+	// address rather than added it, which the new one should do too: it's
+	// given a as is, and agrees if it stores it under the same ID.
+	stored, err := s.new.PostAddress(ctx, customerID, a)
+	if err == nil && stored.ID != created.ID {
+		err = fmt.Errorf("address stored as %s rather than %s", stored.ID, created.ID)
+	}
+	if err != nil {
+		s.diverged("PostAddress", err)
+	}
+	return created, nil
+}
+
+func (s *migrationService) DeleteAddress(ctx context.Context, customerID string, addressID string) error {
+	return s.write("DeleteAddress", customerID, func(b Service) error { return b.DeleteAddress(ctx, customerID, addressID) })
+}
+
+func (s *migrationService) GetCustomersByRegion(ctx context.Context) ([]RegionCount, error) {
+	v, err := s.read("GetCustomersByRegion", func(b Service) (interface{}, error) { return b.GetCustomersByRegion(ctx) })
+	return v.([]RegionCount), err
+}
+
+func (s *migrationService) PostAddresses(ctx context.Context, customerID string, as []Address) ([]AddressResult, error) {
+	defer s.lock(customerID)()
+	results, err := s.old.PostAddresses(ctx, customerID, as)
+	if err != nil {
+		return results, err
+	}
+	// The new backend gets the old one's IDs, in case they were generated.
+	as = append([]Address(nil), as...)
+	for i := range as {
+		if i < len(results) && results[i].Error == "" && results[i].MergedInto == "" {
+			as[i].ID = results[i].ID
+		}
+	}
+	if _, err := s.new.PostAddresses(ctx, customerID, as); err != nil {
+		s.diverged("PostAddresses", err)
+	}
+	return results, nil
+}
+
+func (s *migrationService) ReorderAddresses(ctx context.Context, customerID string, addressIDs []string) error {
+	return s.write("ReorderAddresses", customerID, func(b Service) error { return b.ReorderAddresses(ctx, customerID, addressIDs) })
+}
+
+func (s *migrationService) ValidateCustomer(ctx context.Context, p Customer) ([]FieldError, error) {
+	v, err := s.read("ValidateCustomer", func(b Service) (interface{}, error) { return b.ValidateCustomer(ctx, p) })
+	return v.([]FieldError), err
+}
+
+func (s *migrationService) ValidateAddress(ctx context.Context, customerID string, a Address) ([]FieldError, error) {
+	v, err := s.read("ValidateAddress", func(b Service) (interface{}, error) { return b.ValidateAddress(ctx, customerID, a) })
+	return v.([]FieldError), err
+}
+
+func (s *migrationService) ArchiveCustomer(ctx context.Context, id string) error {
+	return s.write("ArchiveCustomer", id, func(b Service) error { return b.ArchiveCustomer(ctx, id) })
+}
+
+func (s *migrationService) UnarchiveCustomer(ctx context.Context, id string) error {
+	return s.write("UnarchiveCustomer", id, func(b Service) error { return b.UnarchiveCustomer(ctx, id) })
+}
+
+func (s *migrationService) GetCustomers(ctx context.Context, f CustomerFilter) ([]Customer, error) {
+	v, err := s.read("GetCustomers", func(b Service) (interface{}, error) { return b.GetCustomers(ctx, f) })
+	return v.([]Customer), err
+}
+
+func (s *migrationService) GetCustomerStats(ctx context.Context, id string) (CustomerStats, error) {
+	v, err := s.read("GetCustomerStats", func(b Service) (interface{}, error) { return b.GetCustomerStats(ctx, id) })
+	return v.(CustomerStats), err
+}
+
+func (s *migrationService) PrepareCustomer(ctx context.Context, p Customer, ttl time.Duration) (PendingCustomer, error) {
+	p, err := s.withAddressIDs(p)
+	if err != nil {
+		return PendingCustomer{}, err
+	}
+	defer s.lock(p.ID)()
+	pending, err := s.old.PrepareCustomer(ctx, p, ttl)
+	if err != nil {
+		return pending, err
+	}
+	if _, err := s.new.PrepareCustomer(ctx, p, ttl); err != nil {
+		s.diverged("PrepareCustomer", err)
+	}
+	return pending, nil
+}
+
+func (s *migrationService) CommitCustomer(ctx context.Context, id string) error {
+	return s.write("CommitCustomer", id, func(b Service) error { return b.CommitCustomer(ctx, id) })
+}
+
+func (s *migrationService) AbortCustomer(ctx context.Context, id string) error {
+	return s.write("AbortCustomer", id, func(b Service) error { return b.AbortCustomer(ctx, id) })
+}
+
+func (s *migrationService) GetCustomerAsOf(ctx context.Context, id string, t time.Time) (Customer, error) {
+	v, err := s.read("GetCustomerAsOf", func(b Service) (interface{}, error) { return b.GetCustomerAsOf(ctx, id, t) })
+	return v.(Customer), err
+}
+
+func (s *migrationService) GetCustomerByExternalID(ctx context.Context, system string, externalID string) (Customer, error) {
+	v, err := s.read("GetCustomerByExternalID", func(b Service) (interface{}, error) { return b.GetCustomerByExternalID(ctx, system, externalID) })
+	return v.(Customer), err
+}
+
+func (s *migrationService) GrantConsent(ctx context.Context, customerID string, c Consent) (Consent, error) {
+	defer s.lock(customerID)()
+	granted, err := s.old.GrantConsent(ctx, customerID, c)
+	if err != nil {
+		return granted, err
+	}
+	if _, err := s.new.GrantConsent(ctx, customerID, granted); err != nil { // same timestamp
+		s.diverged("GrantConsent", err)
+	}
+	return granted, nil
+}
+
+func (s *migrationService) WithdrawConsent(ctx context.Context, customerID string, consentType string) error {
+	return s.write("WithdrawConsent", customerID, func(b Service) error { return b.WithdrawConsent(ctx, customerID, consentType) })
+}
+
+func (s *migrationService) GetConsents(ctx context.Context, customerID string) ([]Consent, error) {
+	v, err := s.read("GetConsents", func(b Service) (interface{}, error) { return b.GetConsents(ctx, customerID) })
+	return v.([]Consent), err
+}
+
+func (s *migrationService) GetDuplicateAddresses(ctx context.Context) ([]DuplicateAddresses, error) {
+	v, err := s.read("GetDuplicateAddresses", func(b Service) (interface{}, error) { return b.GetDuplicateAddresses(ctx) })
+	return v.([]DuplicateAddresses), err
+}
+
+func (s *migrationService) RepairAddresses(ctx context.Context, dryRun bool) ([]AddressRepair, error) {
+	repairs, err := s.old.RepairAddresses(ctx, dryRun)
+	if err != nil {
+		return repairs, err
+	}
+	if _, err := s.new.RepairAddresses(ctx, dryRun); err != nil {
+		s.diverged("RepairAddresses", err)
+	}
+	return repairs, nil
+}
+
+// RebuildIndex rebuilds index in both backends, reporting the rebuild of the
+// old one.
+func (s *migrationService) RebuildIndex(ctx context.Context, index string) (IndexRebuild, error) {
+	r, err := s.old.RebuildIndex(ctx, index)
+	if err != nil {
+		return r, err
+	}
+	if _, err := s.new.RebuildIndex(ctx, index); err != nil {
+		s.diverged("RebuildIndex", err)
+	}
+	return r, nil
+}
+
+// GetIndexRebuild reports the rebuild of the primary backend. It isn't
+// shadowed: the two progress independently, so they would always diverge.
+func (s *migrationService) GetIndexRebuild(ctx context.Context, index string) (IndexRebuild, error) {
+	return s.primary.GetIndexRebuild(ctx, index)
+}
+
+// CheckConsistency checks both backends, repairing them if asked to, and
+// reports the anomalies of the old one.
+func (s *migrationService) CheckConsistency(ctx context.Context, repair bool) (ConsistencyReport, error) {
+	r, err := s.old.CheckConsistency(ctx, repair)
+	if err != nil {
+		return r, err
+	}
+	if _, err := s.new.CheckConsistency(ctx, repair); err != nil {
+		s.diverged("CheckConsistency", err)
+	}
+	return r, nil
+}
+
+// ErrNotMigrating is returned by Backfill when not given a MigrationService
+// whose old backend is a Lister.
+var ErrNotMigrating = errors.New("backfill needs a MigrationService whose old backend lists its customers")
+
+// Backfill copies every customer held by the old backend of migration, a
+// Service returned by NewMigrationService, into its new one, overwriting
+// whatever the new one already has under the same ID. Each customer is read
+// again from the old backend as it's copied, with writes to it held back
+// meanwhile, so that one changed since the backfill started is copied as it
+// is then, and one deleted since is skipped rather than brought back. It's
+// safe to run more than once. Customers that fail to copy are reported
+// rather than stopping the backfill, so run it again until the report shows
+// none.
+func Backfill(ctx context.Context, migration Service, opts BulkOptions, logger Logger) (BulkReport, error) {
+	m, ok := migration.(*migrationService)
+	if !ok {
+		return BulkReport{}, ErrNotMigrating
+	}
+	src, ok := m.old.(Lister)
+	if !ok {
+		return BulkReport{}, ErrNotMigrating
+	}
+	opts = opts.withDefaults()
+	customers, err := src.ListCustomers(WithoutAddresses(ctx)) // only their IDs are needed
+	if err != nil {
+		return BulkReport{}, err
+	}
+	items := make(chan bulkItem)
+	go func() {
+		defer close(items)
+		for i, p := range customers {
+			id := p.ID
+			item := bulkItem{index: i, id: id, apply: func(ctx context.Context) error {
+				return m.backfill(ctx, id)
+			}}
+			select {
+			case items <- item:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	report := runBulk(ctx, opts, items)
+	for _, f := range report.Failures {
+		logger.Log("backfill", f.ID, "err", f.Error)
+	}
+	logger.Log("backfill", "done", "customers", len(customers), "succeeded", report.Succeeded, "failed", report.Failed)
+	return report, ctx.Err()
+}
+
+// backfill copies customer id from the old backend to the new one, as it is
+// now, unless it's been deleted.
+func (s *migrationService) backfill(ctx context.Context, id string) error {
+	defer s.lock(id)()
+	p, err := s.old.GetCustomer(ctx, id)
+	if err == ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return s.new.PutCustomer(ctx, id, p)
+}
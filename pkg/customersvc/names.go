@@ -0,0 +1,284 @@
+package customersvc
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+var (
+	// ErrInvalidLocale is returned for a locale that isn't a BCP 47 tag.
+	ErrInvalidLocale = errors.New("locale must be a BCP 47 language tag, e.g. en-GB or ja-JP")
+	// ErrInvalidNameVariant is returned for a name variant without an ISO
+	// 15924 script or a name, or for two variants in the same script.
+	ErrInvalidNameVariant = errors.New("name variants need a distinct ISO 15924 script, e.g. Latn or Kana, and a name")
+)
+
+// NameVariant is a customer's name written in a script other than that of
+// their Name, so that it can be shown, searched and sorted by those who
+// can't read the original.
+type NameVariant struct {
+	// Script is the ISO 15924 code of the script, e.g. Latn or Kana.
+	Script      string `json:"script" xml:"script,attr"`
+	GivenName   string `json:"given_name,omitempty" xml:"given_name,omitempty"`
+	FamilyName  string `json:"family_name,omitempty" xml:"family_name,omitempty"`
+	DisplayName string `json:"display_name,omitempty" xml:"display_name,omitempty"`
+}
+
+// familyFirst lists the languages writing the family name before the given
+// name.
+var familyFirst = map[string]bool{"ja": true, "zh": true, "ko": true, "hu": true, "vi": true}
+
+// language returns the primary language subtag of locale, lower-cased, e.g.
+// "pt" for pt-BR.
+func language(locale string) string {
+	if i := strings.IndexAny(locale, "-_"); i >= 0 {
+		locale = locale[:i]
+	}
+	return strings.ToLower(locale)
+}
+
+// validLocale reports whether locale looks like a BCP 47 tag: a language of
+// two or three letters, then subtags of letters and digits.
+func validLocale(locale string) bool {
+	subtags := strings.FieldsFunc(locale, func(r rune) bool { return r == '-' || r == '_' })
+	if len(subtags) == 0 || len(subtags[0]) < 2 || len(subtags[0]) > 3 {
+		return false
+	}
+	for i, tag := range subtags {
+		if len(tag) > 8 {
+			return false
+		}
+		for _, r := range tag {
+			if r > unicode.MaxASCII || !(unicode.IsLetter(r) || (i > 0 && unicode.IsDigit(r))) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// ideographic reports whether s is written without spaces between names,
+// as Chinese, Japanese and Korean are.
+func ideographic(s string) bool {
+	for _, r := range s {
+		if unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul) {
+			return true
+		}
+	}
+	return false
+}
+
+// DisplayName joins given and family names the way locale writes them:
+// family name first in Chinese, Japanese, Korean, Hungarian and Vietnamese,
+// given name first otherwise, and without a space between names written in
+// ideographs or syllabaries.
+func DisplayName(given, family, locale string) string {
+	given, family = strings.TrimSpace(given), strings.TrimSpace(family)
+	if given == "" || family == "" {
+		return given + family
+	}
+	first, second := given, family
+	if familyFirst[language(locale)] {
+		first, second = family, given
+	}
+	if ideographic(first) && ideographic(second) {
+		return first + second
+	}
+	return first + " " + second
+}
+
+// familyParticles are the lower-case words that belong to the family name
+// following them, e.g. "van der" in "Anna van der Berg".
+var familyParticles = map[string]bool{
+	"da": true, "de": true, "del": true, "della": true, "der": true, "di": true,
+	"dos": true, "du": true, "la": true, "le": true, "van": true, "von": true,
+}
+
+// SplitName splits a single name into given and family names, for customers
+// stored before names were structured. It's a heuristic: names written with
+// spaces are split at the last one, or the first in languages writing the
+// family name first, keeping particles such as "van" with the family name;
+// a single word is taken to be a given name. Chinese and Korean names
+// written in ideographs take the first character to be the family name.
+// Japanese ones, whose family names vary in length, aren't split: both
+// names are empty.
+func SplitName(name, locale string) (given, family string) {
+	words := strings.Fields(name)
+	lang := language(locale)
+	switch {
+	case len(words) == 0:
+		return "", ""
+	case len(words) == 1 && ideographic(name):
+		runes := []rune(words[0])
+		if (lang != "zh" && lang != "ko") || len(runes) < 2 {
+			return "", ""
+		}
+		return string(runes[1:]), string(runes[:1])
+	case len(words) == 1:
+		return words[0], ""
+	case familyFirst[lang]:
+		return strings.Join(words[1:], " "), words[0]
+	}
+	i := len(words) - 1
+	for i > 1 && familyParticles[words[i-1]] {
+		i--
+	}
+	return strings.Join(words[:i], " "), strings.Join(words[i:], " ")
+}
+
+// normalizeName trims p's name parts, and derives its Name from them if it
+// has none.
+func normalizeName(p Customer) Customer {
+	p.GivenName, p.FamilyName = strings.TrimSpace(p.GivenName), strings.TrimSpace(p.FamilyName)
+	if p.Name == "" {
+		p.Name = DisplayName(p.GivenName, p.FamilyName, p.Locale)
+	}
+	return p
+}
+
+// patchName applies the name parts set in patch to existing. A Name that
+// was derived from the parts patched is derived again, unless patch sets it
+// too.
+func patchName(existing, patch Customer) Customer {
+	derived := existing.Name != "" && existing.Name == DisplayName(existing.GivenName, existing.FamilyName, existing.Locale)
+	if patch.GivenName != "" {
+		existing.GivenName = strings.TrimSpace(patch.GivenName)
+	}
+	if patch.FamilyName != "" {
+		existing.FamilyName = strings.TrimSpace(patch.FamilyName)
+	}
+	if patch.Locale != "" {
+		existing.Locale = patch.Locale
+	}
+	if len(patch.NameVariants) > 0 {
+		existing.NameVariants = patch.NameVariants
+	}
+	if patch.Name != "" {
+		existing.Name = patch.Name
+	} else if derived {
+		existing.Name = DisplayName(existing.GivenName, existing.FamilyName, existing.Locale)
+	}
+	return existing
+}
+
+// validateNames returns the problems of p's locale and name variants.
+func validateNames(p Customer) []FieldError {
+	var errs []FieldError
+	if p.Locale != "" && !validLocale(p.Locale) {
+		errs = append(errs, fieldError("locale", ErrInvalidLocale))
+	}
+	scripts := map[string]bool{}
+	for _, v := range p.NameVariants {
+		if !validScript(v.Script) || scripts[v.Script] || v.GivenName+v.FamilyName+v.DisplayName == "" {
+			errs = append(errs, fieldError("name_variants", ErrInvalidNameVariant))
+			break
+		}
+		scripts[v.Script] = true
+	}
+	return errs
+}
+
+// validScript reports whether script is written as an ISO 15924 code is: a
+// capital and three small letters, e.g. Latn.
+func validScript(script string) bool {
+	if len(script) != 4 {
+		return false
+	}
+	for i, r := range script {
+		if r > unicode.MaxASCII || !unicode.IsLetter(r) || unicode.IsUpper(r) != (i == 0) {
+			return false
+		}
+	}
+	return true
+}
+
+// collationFolds maps letters to those they sort with, in locales without
+// an entry in collationTailorings: accented letters with the base letter,
+// ligatures as the letters they join.
+var collationFolds = map[rune]string{
+	'à': "a", 'á': "a", 'â': "a", 'ã': "a", 'ä': "a", 'å': "a", 'ā': "a", 'ą': "a",
+	'æ': "ae", 'ç': "c", 'ć': "c", 'č': "c", 'ď': "d", 'đ': "d",
+	'è': "e", 'é': "e", 'ê': "e", 'ë': "e", 'ē': "e", 'ę': "e", 'ě': "e",
+	'ì': "i", 'í': "i", 'î': "i", 'ï': "i", 'ī': "i", 'ł': "l", 'ľ': "l",
+	'ñ': "n", 'ń': "n", 'ň': "n",
+	'ò': "o", 'ó': "o", 'ô': "o", 'õ': "o", 'ö': "o", 'ø': "o", 'ō': "o", 'ő': "o",
+	'œ': "oe", 'ř': "r", 'ś': "s", 'š': "s", 'ß': "ss", 'ť': "t",
+	'ù': "u", 'ú': "u", 'û': "u", 'ü': "u", 'ū': "u", 'ů': "u", 'ű': "u",
+	'ý': "y", 'ÿ': "y", 'ź': "z", 'ż': "z", 'ž': "z",
+}
+
+// collationTailorings are the letters languages sort as letters of their
+// own rather than with a base letter: after the base letter, or after z,
+// in their alphabet's order.
+var collationTailorings = map[string]map[rune]string{
+	"sv": {'å': "z\uffffa", 'ä': "z\uffffb", 'æ': "z\uffffb", 'ö': "z\uffffc", 'ø': "z\uffffc"},
+	"fi": {'å': "z\uffffa", 'ä': "z\uffffb", 'ö': "z\uffffc"},
+	"da": {'æ': "z\uffffa", 'ø': "z\uffffb", 'å': "z\uffffc"},
+	"nb": {'æ': "z\uffffa", 'ø': "z\uffffb", 'å': "z\uffffc"},
+	"nn": {'æ': "z\uffffa", 'ø': "z\uffffb", 'å': "z\uffffc"},
+	"no": {'æ': "z\uffffa", 'ø': "z\uffffb", 'å': "z\uffffc"},
+	"es": {'ñ': "n\uffff"},
+	"pl": {'ą': "a\uffff", 'ć': "c\uffff", 'ę': "e\uffff", 'ł': "l\uffff", 'ń': "n\uffff", 'ó': "o\uffff", 'ś': "s\uffff", 'ź': "z\uffff", 'ż': "z\uffff\uffff"},
+	"cs": {'č': "c\uffff", 'ř': "r\uffff", 'š': "s\uffff", 'ž': "z\uffff"},
+	"tr": {'ç': "c\uffff", 'ğ': "g\uffff", 'ı': "h\uffff", 'ö': "o\uffff", 'ş': "s\uffff", 'ü': "u\uffff"},
+}
+
+// collationKey returns s as compared in locale's order, case-insensitively,
+// and byte-wise comparable: letters sorting with a base letter are folded
+// to it, and those sorting apart moved to their place. Scripts other than
+// Latin are compared by code point.
+func collationKey(s, locale string) string {
+	tailoring := collationTailorings[language(locale)]
+	var b strings.Builder
+	for _, r := range strings.ToLower(s) {
+		if t, ok := tailoring[r]; ok {
+			b.WriteString(t)
+		} else if f, ok := collationFolds[r]; ok {
+			b.WriteString(f)
+		} else {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// MigrateNames splits the Name of every customer in src that has neither a
+// given nor a family name into both, see SplitName, and patches them into
+// dst, leaving Name as it is. Customers whose name can't be split are left
+// alone. Like Backfill, it may be run again, and failures are reported
+// without stopping it.
+func MigrateNames(ctx context.Context, src Lister, dst Service, opts BulkOptions, logger Logger) (BulkReport, error) {
+	opts = opts.withDefaults()
+	customers, err := src.ListCustomers(ctx)
+	if err != nil {
+		return BulkReport{}, err
+	}
+	sort.Slice(customers, func(i, j int) bool { return customers[i].ID < customers[j].ID })
+	items := make(chan bulkItem)
+	go func() {
+		defer close(items)
+		for i, p := range customers {
+			if p.GivenName != "" || p.FamilyName != "" {
+				continue
+			}
+			given, family := SplitName(p.Name, p.Locale)
+			if given == "" && family == "" {
+				continue
+			}
+			id, patch := p.ID, Customer{GivenName: given, FamilyName: family}
+			select {
+			case items <- bulkItem{index: i, id: id, apply: func(ctx context.Context) error {
+				return dst.PatchCustomer(ctx, id, patch)
+			}}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	report := runBulk(ctx, opts, items)
+	logger.Log("migrate-names", "done", "succeeded", report.Succeeded, "failed", report.Failed)
+	return report, ctx.Err()
+}
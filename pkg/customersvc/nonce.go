@@ -0,0 +1,97 @@
+package customersvc
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/metrics"
+)
+
+// ErrReplayed is returned when a single-use signed URL is used again.
+var ErrReplayed = errors.New("signed URL already used")
+
+// NonceStore remembers which nonces have been used, so that a URLSigner can
+// reject replays. Implementations must be safe for concurrent use.
+type NonceStore interface {
+	// Use marks nonce as used until expires, after which it may be
+	// forgotten. It reports false if nonce was already used.
+	Use(ctx context.Context, nonce string, expires time.Time) (bool, error)
+}
+
+// WithNonceStore makes every URL minted by a URLSigner single-use: each
+// carries a random nonce, and using it a second time before it expires fails
+// with ErrReplayed. Rejected replays are counted in replays.
+func WithNonceStore(store NonceStore, replays metrics.Counter) Option {
+	return func(o *options) {
+		o.nonces = store
+		o.replays = replays
+	}
+}
+
+// NewLRUNonceStore returns an in-memory NonceStore holding at most size
+// nonces. When full, the nonce closest to expiry is forgotten early, so size
+// should comfortably exceed the number of URLs used within their TTL. It
+// doesn't share state between replicas; see package redisnonce for that.
+func NewLRUNonceStore(size int, clock Clock) NonceStore {
+	if clock == nil {
+		clock = SystemClock
+	}
+	return &lruNonceStore{
+		size:  size,
+		clock: clock,
+		byKey: map[string]*list.Element{},
+		order: list.New(),
+	}
+}
+
+type lruNonceStore struct {
+	size  int
+	clock Clock
+
+	mtx   sync.Mutex
+	byKey map[string]*list.Element
+	order *list.List // of *nonceEntry, by expiry, soonest first
+}
+
+type nonceEntry struct {
+	nonce   string
+	expires time.Time
+}
+
+func (s *lruNonceStore) Use(ctx context.Context, nonce string, expires time.Time) (bool, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	now := s.clock.Now()
+	for e := s.order.Front(); e != nil && !now.Before(e.Value.(*nonceEntry).expires); e = s.order.Front() {
+		s.remove(e)
+	}
+	if _, ok := s.byKey[nonce]; ok {
+		return false, nil
+	}
+	for s.order.Len() >= s.size && s.order.Len() > 0 {
+		s.remove(s.order.Front())
+	}
+
+	entry := &nonceEntry{nonce: nonce, expires: expires}
+	// Signed URLs mostly share a TTL, so the right place is almost always at
+	// or near the back.
+	at := s.order.Back()
+	for at != nil && at.Value.(*nonceEntry).expires.After(expires) {
+		at = at.Prev()
+	}
+	if at == nil {
+		s.byKey[nonce] = s.order.PushFront(entry)
+	} else {
+		s.byKey[nonce] = s.order.InsertAfter(entry, at)
+	}
+	return true, nil
+}
+
+func (s *lruNonceStore) remove(e *list.Element) {
+	delete(s.byKey, e.Value.(*nonceEntry).nonce)
+	s.order.Remove(e)
+}
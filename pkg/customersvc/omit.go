@@ -0,0 +1,64 @@
+package customersvc
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"strings"
+)
+
+// OmitAddresses is the part of a customer reads can omit, given ?omit=.
+const OmitAddresses = "addresses"
+
+// ErrInvalidOmit is returned for an omit parameter listing parts reads can't
+// omit.
+var ErrInvalidOmit = errors.New("omit must list addresses")
+
+type omitAddressesKey struct{}
+
+// WithoutAddresses returns a copy of ctx making the GetCustomer,
+// GetCustomers and QueryCustomers calls made with it return customers
+// without their addresses, for views listing many customers that don't show
+// them. Stores then needn't fetch them at all. Over HTTP, it's
+// ?omit=addresses on GET /customers/ and GET /customers/:id.
+func WithoutAddresses(ctx context.Context) context.Context {
+	return context.WithValue(ctx, omitAddressesKey{}, true)
+}
+
+// AddressesOmitted reports whether ctx was given by WithoutAddresses.
+func AddressesOmitted(ctx context.Context) bool {
+	omit, _ := ctx.Value(omitAddressesKey{}).(bool)
+	return omit
+}
+
+// omitAddressesFrom returns whether the omit parameter in q lists
+// addresses.
+func omitAddressesFrom(q url.Values) (bool, error) {
+	list := q.Get("omit")
+	if list == "" {
+		return false, nil
+	}
+	for _, part := range strings.Split(list, ",") {
+		if part != OmitAddresses {
+			return false, ErrInvalidOmit
+		}
+	}
+	return true, nil
+}
+
+// setOmitAddresses sets the omit parameter in q if omit is set.
+func setOmitAddresses(q url.Values, omit bool) {
+	if omit {
+		q.Set("omit", OmitAddresses)
+	}
+}
+
+// withoutAddresses returns customers with their addresses dropped, for
+// stores and middlewares that don't honor WithoutAddresses themselves. It
+// modifies customers in place.
+func withoutAddresses(customers []Customer) []Customer {
+	for i := range customers {
+		customers[i].Addresses = nil
+	}
+	return customers
+}
@@ -0,0 +1,278 @@
+package customersvc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/go-kit/kit/endpoint"
+	httptransport "github.com/go-kit/kit/transport/http"
+	"github.com/gorilla/mux"
+)
+
+var (
+	// ErrNotOwner is returned when a request's API key may not change the
+	// customer it's about, see Ownership.
+	ErrNotOwner = errors.New("only the customer's owner or an admin may change it")
+	// ErrUnknownOwner is returned when transferring a customer to an API key
+	// that's unknown, expired or revoked.
+	ErrUnknownOwner = errors.New("owner must be the ID of a valid API key")
+)
+
+// OwnershipPolicy says who may change a customer that has an owner.
+type OwnershipPolicy int
+
+const (
+	// OwnershipRecord records owners, but lets any key with the write scope
+	// change any customer. It's the default.
+	OwnershipRecord OwnershipPolicy = iota
+	// OwnershipEnforce lets only the owner and admin keys change a customer.
+	OwnershipEnforce
+)
+
+// ParseOwnershipPolicy parses "record" or "owner-only".
+func ParseOwnershipPolicy(s string) (OwnershipPolicy, error) {
+	switch s {
+	case "record":
+		return OwnershipRecord, nil
+	case "owner-only":
+		return OwnershipEnforce, nil
+	}
+	return OwnershipRecord, fmt.Errorf("unknown ownership policy %q", s)
+}
+
+// Ownership records which API key created each customer, its owner, so that
+// integrations sharing a deployment can be kept from changing each other's
+// customers. Customers created without a key, or before ownership was turned
+// on, have no owner, and under OwnershipEnforce may still be changed by any
+// key with the write scope. Owners are held in memory. It's safe for
+// concurrent use.
+type Ownership struct {
+	keys   *APIKeys
+	policy OwnershipPolicy
+
+	mtx    sync.RWMutex
+	owners map[string]string // customer ID to API key ID
+}
+
+// NewOwnership returns an Ownership of customers by keys from keys.
+func NewOwnership(keys *APIKeys, policy OwnershipPolicy) *Ownership {
+	return &Ownership{keys: keys, policy: policy, owners: map[string]string{}}
+}
+
+// Owner returns the ID of the API key owning customerID, if it has an owner.
+func (o *Ownership) Owner(customerID string) (string, bool) {
+	o.mtx.RLock()
+	defer o.mtx.RUnlock()
+	owner, ok := o.owners[customerID]
+	return owner, ok
+}
+
+// Transfer makes the API key owner the owner of customerID.
+func (o *Ownership) Transfer(customerID, owner string) error {
+	if _, ok := o.keys.lookup(owner); !ok {
+		return ErrUnknownOwner
+	}
+	o.set(customerID, owner)
+	return nil
+}
+
+func (o *Ownership) set(customerID, owner string) {
+	o.mtx.Lock()
+	defer o.mtx.Unlock()
+	o.owners[customerID] = owner
+}
+
+func (o *Ownership) forget(customerID string) {
+	o.mtx.Lock()
+	defer o.mtx.Unlock()
+	delete(o.owners, customerID)
+}
+
+// allows reports whether key may make a change to customerID by method.
+// Transferring an unowned customer takes an admin, so that it can't be
+// claimed by whoever asks first.
+func (o *Ownership) allows(key APIKey, method, customerID string) bool {
+	if key.allows(ScopeAdmin) {
+		return true
+	}
+	owner, owned := o.Owner(customerID)
+	if method == "TransferOwnership" {
+		return owned && owner == key.ID
+	}
+	return !owned || owner == key.ID || o.policy == OwnershipRecord
+}
+
+// middleware records the key creating a customer as its owner, and rejects
+// changes to a customer by other keys under OwnershipEnforce with
+// ErrNotOwner. It relies on APIKeyMiddleware having set the key: requests
+// authorized otherwise, by a portal token or a signed URL, pass through.
+func (o *Ownership) middleware(method string) endpoint.Middleware {
+	return func(next endpoint.Endpoint) endpoint.Endpoint {
+		return func(ctx context.Context, request interface{}) (interface{}, error) {
+			key, ok := APIKeyFrom(ctx)
+			if !ok {
+				return next(ctx, request)
+			}
+			if id, ok := changedCustomerID(request); ok && !o.allows(key, method, id) {
+				return nil, ErrNotOwner
+			}
+			response, err := next(ctx, request)
+			if err != nil {
+				return response, err
+			}
+			if e, ok := response.(errorer); ok && e.error() != nil {
+				return response, err
+			}
+			switch req := request.(type) {
+			case postCustomerRequest:
+				o.set(req.Customer.ID, key.ID)
+			case commitCustomerRequest:
+				o.set(req.ID, key.ID)
+			case deleteCustomerRequest:
+				o.forget(req.ID)
+			}
+			return response, err
+		}
+	}
+}
+
+// changedCustomerID returns the customer request changes, or grants access
+// to, if it's one that ownership restricts.
+func changedCustomerID(request interface{}) (string, bool) {
+	switch r := request.(type) {
+	case putCustomerRequest:
+		return r.ID, true
+	case patchCustomerRequest:
+		return r.ID, true
+	case deleteCustomerRequest:
+		return r.ID, true
+	case archiveCustomerRequest:
+		return r.ID, true
+	case unarchiveCustomerRequest:
+		return r.ID, true
+	case postAddressRequest:
+		return r.CustomerID, true
+	case postAddressesRequest:
+		return r.CustomerID, true
+	case deleteAddressRequest:
+		return r.CustomerID, true
+	case reorderAddressesRequest:
+		return r.CustomerID, true
+	case grantConsentRequest:
+		return r.CustomerID, true
+	case withdrawConsentRequest:
+		return r.CustomerID, true
+	case issuePortalTokenRequest:
+		return r.ID, true
+	case transferOwnershipRequest:
+		return r.ID, true
+	case setCredentialRequest:
+		return r.ID, true
+	case deleteCredentialRequest:
+		return r.ID, true
+	case setAddressReferenceRequest:
+		return r.CustomerID, true
+	case clearAddressReferenceRequest:
+		return r.CustomerID, true
+	case clearAddressReferencesRequest:
+		return r.CustomerID, true
+	}
+	return "", false
+}
+
+// WithOwnership records the owners of customers in o, and restricts changes
+// to them according to its policy, see Ownership. It takes WithAPIKeys, as
+// owners are API keys. It mounts:
+//
+//	GET     /customers/:id/owner  the ID of the API key owning the customer
+//	PUT     /customers/:id/owner  transfer the customer: {"owner": "<API key ID>"}
+//
+// Transfers are made by the owner or an admin.
+func WithOwnership(o *Ownership) HandlerOption {
+	return func(c *handlerConfig) { c.ownership = o }
+}
+
+func mountOwnership(r *mux.Router, s Service, o *Ownership, wrap func(string, endpoint.Endpoint) endpoint.Endpoint, options []httptransport.ServerOption) {
+	r.Methods("GET").Path("/customers/{id}/owner").Handler(httptransport.NewServer(
+		wrap("GetOwner", makeGetOwnerEndpoint(s, o)),
+		decodeGetOwnerRequest,
+		encodeResponse,
+		options...,
+	))
+	r.Methods("PUT").Path("/customers/{id}/owner").Handler(httptransport.NewServer(
+		wrap("TransferOwnership", makeTransferOwnershipEndpoint(s, o)),
+		decodeTransferOwnershipRequest,
+		encodeResponse,
+		options...,
+	))
+}
+
+func makeGetOwnerEndpoint(s Service, o *Ownership) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(getOwnerRequest)
+		if _, e := s.GetCustomer(ctx, req.ID); e != nil {
+			return ownerResponse{Err: e}, nil
+		}
+		owner, _ := o.Owner(req.ID)
+		return ownerResponse{Owner: owner}, nil
+	}
+}
+
+func makeTransferOwnershipEndpoint(s Service, o *Ownership) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(transferOwnershipRequest)
+		if _, e := s.GetCustomer(ctx, req.ID); e != nil {
+			return ownerResponse{Err: e}, nil
+		}
+		if e := o.Transfer(req.ID, req.Owner); e != nil {
+			return ownerResponse{Err: e}, nil
+		}
+		return ownerResponse{Owner: req.Owner}, nil
+	}
+}
+
+type getOwnerRequest struct {
+	ID string
+}
+
+type transferOwnershipRequest struct {
+	ID    string
+	Owner string
+}
+
+type ownerResponse struct {
+	Owner string `json:"owner,omitempty" xml:"owner,omitempty"` // empty if the customer has none
+	Err   error  `json:"err,omitempty" xml:"-"`
+}
+
+func (r ownerResponse) error() error { return r.Err }
+
+func decodeGetOwnerRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	vars := mux.Vars(r)
+	id, ok := vars["id"]
+	if !ok {
+		return nil, ErrBadRouting
+	}
+	return getOwnerRequest{ID: id}, nil
+}
+
+func decodeTransferOwnershipRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	vars := mux.Vars(r)
+	id, ok := vars["id"]
+	if !ok {
+		return nil, ErrBadRouting
+	}
+	var body struct {
+		Owner string `json:"owner" xml:"owner"`
+	}
+	if err := decodeBody(r, &body); err != nil {
+		return nil, err
+	}
+	if body.Owner == "" {
+		return nil, ErrUnknownOwner
+	}
+	return transferOwnershipRequest{ID: id, Owner: body.Owner}, nil
+}
@@ -0,0 +1,289 @@
+package customersvc
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/go-kit/kit/endpoint"
+	"github.com/gorilla/mux"
+)
+
+// Bounds on the number of items in a page.
+const (
+	DefaultPageLimit = 50
+	MaxPageLimit     = 500
+)
+
+// ErrInvalidCursor is returned for a page cursor that wasn't issued by this
+// service, or a limit that isn't a positive number.
+var ErrInvalidCursor = errors.New("invalid page cursor or limit")
+
+// PageRequest asks for one page of a list. The zero value asks for the first
+// page of DefaultPageLimit items. Cursor is the NextCursor of the previous
+// page, and is opaque.
+type PageRequest struct {
+	Cursor string
+	Limit  int
+}
+
+// Every paged list responds with the same envelope: the items of the page,
+// the cursor of the next page if there's one, the total number of items if
+// known, and the limit applied. Lists are paged when the request has a limit
+// or cursor query parameter, and are returned whole otherwise.
+
+// CustomerPage is a page of GET /customers/.
+type CustomerPage struct {
+	Items      []Customer `json:"items" xml:"items>customer"`
+	NextCursor string     `json:"next_cursor,omitempty" xml:"next_cursor,omitempty"`
+	Total      *int       `json:"total,omitempty" xml:"total,omitempty"`
+	Limit      int        `json:"limit" xml:"limit"`
+}
+
+// AddressPage is a page of GET /customers/:id/addresses/.
+type AddressPage struct {
+	Items      []Address `json:"items" xml:"items>address"`
+	NextCursor string    `json:"next_cursor,omitempty" xml:"next_cursor,omitempty"`
+	Total      *int      `json:"total,omitempty" xml:"total,omitempty"`
+	Limit      int       `json:"limit" xml:"limit"`
+}
+
+// paginate returns the bounds of the page req asks for among n items, whose
+// keys, as returned by key, are in ascending order. Cursors are the key of
+// the last item of a page, so pages stay consistent as items are added or
+// removed between requests.
+func paginate(n int, key func(i int) string, req PageRequest) (from, to, limit int, next string, err error) {
+	limit = req.Limit
+	if limit == 0 {
+		limit = DefaultPageLimit
+	}
+	if limit < 0 {
+		return 0, 0, 0, "", ErrInvalidCursor
+	}
+	if limit > MaxPageLimit {
+		limit = MaxPageLimit
+	}
+	if req.Cursor != "" {
+		after, err := base64.RawURLEncoding.DecodeString(req.Cursor)
+		if err != nil {
+			return 0, 0, 0, "", ErrInvalidCursor
+		}
+		from = sort.Search(n, func(i int) bool { return key(i) > string(after) })
+	}
+	to = from + limit
+	if to >= n {
+		return from, n, limit, "", nil
+	}
+	return from, to, limit, base64.RawURLEncoding.EncodeToString([]byte(key(to - 1))), nil
+}
+
+// MakeGetCustomersPageEndpoint returns an endpoint serving pages of
+// GetCustomers via the passed service, pushing the query down to it if it's a
+// QueryableService. Primarily useful in a server.
+func MakeGetCustomersPageEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(getCustomersPageRequest)
+		if req.OmitAddresses {
+			ctx = WithoutAddresses(ctx)
+		}
+		page, e := QueryCustomers(ctx, s, req.Query)
+		if req.OmitAddresses {
+			page.Items = withoutAddresses(page.Items)
+		}
+		return customerPageResponse{CustomerPage: page, Err: e}, nil
+	}
+}
+
+// MakeGetAddressesPageEndpoint returns an endpoint serving pages of
+// GetAddresses via the passed service. Primarily useful in a server.
+func MakeGetAddressesPageEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(getAddressesPageRequest)
+		addresses, e := s.GetAddresses(ctx, req.CustomerID)
+		if e != nil {
+			return addressPageResponse{Err: e}, nil
+		}
+		if req.At != nil {
+			addresses = AddressesAt(addresses, *req.At)
+		}
+		// GetAddresses orders addresses by position; pad them so that they
+		// sort as strings too.
+		key := func(i int) string { return fmt.Sprintf("%010d", addresses[i].Position) }
+		from, to, limit, next, e := paginate(len(addresses), key, req.Page)
+		if e != nil {
+			return addressPageResponse{Err: e}, nil
+		}
+		total := len(addresses)
+		return addressPageResponse{AddressPage: AddressPage{
+			Items:      addresses[from:to],
+			NextCursor: next,
+			Total:      &total,
+			Limit:      limit,
+		}}, nil
+	}
+}
+
+// GetCustomersPage returns one page of the customers matching f. Primarily
+// useful in a client.
+func (e Endpoints) GetCustomersPage(ctx context.Context, f CustomerFilter, page PageRequest) (CustomerPage, error) {
+	request := getCustomersPageRequest{Query: CustomerQuery{Filter: f, Page: page}, OmitAddresses: AddressesOmitted(ctx)}
+	response, err := e.GetCustomersPageEndpoint(ctx, request)
+	if err != nil {
+		return CustomerPage{}, err
+	}
+	resp := response.(customerPageResponse)
+	return resp.CustomerPage, resp.Err
+}
+
+// GetAddressesPage returns one page of a customer's addresses. Primarily
+// useful in a client.
+func (e Endpoints) GetAddressesPage(ctx context.Context, customerID string, page PageRequest) (AddressPage, error) {
+	request := getAddressesPageRequest{CustomerID: customerID, Page: page}
+	response, err := e.GetAddressesPageEndpoint(ctx, request)
+	if err != nil {
+		return AddressPage{}, err
+	}
+	resp := response.(addressPageResponse)
+	return resp.AddressPage, resp.Err
+}
+
+type getCustomersPageRequest struct {
+	Query         CustomerQuery
+	OmitAddresses bool
+}
+
+type customerPageResponse struct {
+	CustomerPage
+	Err error `json:"err,omitempty" xml:"-"`
+}
+
+func (r customerPageResponse) error() error { return r.Err }
+
+type getAddressesPageRequest struct {
+	CustomerID string
+	Page       PageRequest
+	At         *time.Time // ?at=, only the addresses effective then
+}
+
+type addressPageResponse struct {
+	AddressPage
+	Err error `json:"err,omitempty" xml:"-"`
+}
+
+func (r addressPageResponse) error() error { return r.Err }
+
+// paged matches requests for a page of a list rather than all of it.
+func paged(r *http.Request, _ *mux.RouteMatch) bool {
+	q := r.URL.Query()
+	_, limit := q["limit"]
+	_, cursor := q["cursor"]
+	return limit || cursor
+}
+
+func pageRequestFrom(q url.Values) (PageRequest, error) {
+	page := PageRequest{Cursor: q.Get("cursor")}
+	if v := q.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit <= 0 {
+			return PageRequest{}, ErrInvalidCursor
+		}
+		page.Limit = limit
+	}
+	return page, nil
+}
+
+func setPageRequest(q url.Values, page PageRequest) {
+	if page.Limit > 0 {
+		q.Set("limit", strconv.Itoa(page.Limit))
+	} else {
+		q.Set("limit", strconv.Itoa(DefaultPageLimit))
+	}
+	if page.Cursor != "" {
+		q.Set("cursor", page.Cursor)
+	}
+}
+
+func decodeGetCustomersPageRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	page, err := pageRequestFrom(r.URL.Query())
+	if err != nil {
+		return nil, err
+	}
+	omit, err := omitAddressesFrom(r.URL.Query())
+	if err != nil {
+		return nil, err
+	}
+	return getCustomersPageRequest{Query: CustomerQuery{
+		Filter: CustomerFilter{Archived: r.URL.Query().Get("archived")},
+		Sort:   r.URL.Query().Get("sort"),
+		Locale: r.URL.Query().Get("locale"),
+		Page:   page,
+	}, OmitAddresses: omit}, nil
+}
+
+func decodeGetAddressesPageRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	vars := mux.Vars(r)
+	id, ok := vars["id"]
+	if !ok {
+		return nil, ErrBadRouting
+	}
+	page, err := pageRequestFrom(r.URL.Query())
+	if err != nil {
+		return nil, err
+	}
+	at, err := effectiveAtFrom(r.URL.Query())
+	if err != nil {
+		return nil, err
+	}
+	return getAddressesPageRequest{CustomerID: id, Page: page, At: at}, nil
+}
+
+func encodeGetCustomersPageRequest(ctx context.Context, req *http.Request, request interface{}) error {
+	// r.Methods("GET").Path("/customers/").MatcherFunc(paged)
+	r := request.(getCustomersPageRequest)
+	req.URL.Path = "/customers/"
+	q := url.Values{}
+	if r.Query.Filter.Archived != "" {
+		q.Set("archived", r.Query.Filter.Archived)
+	}
+	if r.Query.Sort != "" {
+		q.Set("sort", r.Query.Sort)
+	}
+	if r.Query.Locale != "" {
+		q.Set("locale", r.Query.Locale)
+	}
+	setOmitAddresses(q, r.OmitAddresses)
+	setPageRequest(q, r.Query.Page)
+	req.URL.RawQuery = q.Encode()
+	return encodeRequest(ctx, req, request)
+}
+
+func encodeGetAddressesPageRequest(ctx context.Context, req *http.Request, request interface{}) error {
+	// r.Methods("GET").Path("/customers/{id}/addresses/").MatcherFunc(paged)
+	r := request.(getAddressesPageRequest)
+	customerID := url.QueryEscape(r.CustomerID)
+	req.URL.Path = "/customers/" + customerID + "/addresses/"
+	q := url.Values{}
+	setPageRequest(q, r.Page)
+	setEffectiveAt(q, r.At)
+	req.URL.RawQuery = q.Encode()
+	return encodeRequest(ctx, req, request)
+}
+
+func decodeCustomerPageResponse(_ context.Context, resp *http.Response) (interface{}, error) {
+	var response customerPageResponse
+	err := json.NewDecoder(resp.Body).Decode(&response)
+	return response, err
+}
+
+func decodeAddressPageResponse(_ context.Context, resp *http.Response) (interface{}, error) {
+	var response addressPageResponse
+	err := json.NewDecoder(resp.Body).Decode(&response)
+	return response, err
+}
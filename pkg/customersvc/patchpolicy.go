@@ -0,0 +1,127 @@
+package customersvc
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Fields of a customer a PatchPolicy can name, by their JSON names.
+var patchableFields = map[string]bool{
+	"name":          true,
+	"given_name":    true,
+	"family_name":   true,
+	"locale":        true,
+	"name_variants": true,
+	"email":         true,
+	"phone":         true,
+	"addresses":     true,
+	"metadata":      true,
+	"external_ids":  true,
+}
+
+// PatchPolicy restricts the fields PatchCustomer may change, e.g. so that
+// email changes go through a verification flow rather than a plain PATCH.
+// PutCustomer is unaffected. The zero value allows every field.
+type PatchPolicy struct {
+	allow map[string]bool // every field if nil
+	deny  map[string]bool
+}
+
+// NewPatchPolicy returns a PatchPolicy letting PATCH change only the fields
+// in allow, or any field if allow is empty, except those in deny. Fields are
+// named as in JSON: name, given_name, family_name, locale, name_variants,
+// email, phone, addresses, metadata and external_ids.
+func NewPatchPolicy(allow, deny []string) (PatchPolicy, error) {
+	var p PatchPolicy
+	for _, f := range allow {
+		if !patchableFields[f] {
+			return PatchPolicy{}, fmt.Errorf("unknown customer field %q", f)
+		}
+		if p.allow == nil {
+			p.allow = map[string]bool{}
+		}
+		p.allow[f] = true
+	}
+	for _, f := range deny {
+		if !patchableFields[f] {
+			return PatchPolicy{}, fmt.Errorf("unknown customer field %q", f)
+		}
+		if p.deny == nil {
+			p.deny = map[string]bool{}
+		}
+		p.deny[f] = true
+	}
+	return p, nil
+}
+
+// WithPatchPolicy makes the inmem store reject patches to fields p forbids,
+// with an ImmutableFieldsError.
+func WithPatchPolicy(p PatchPolicy) Option {
+	return func(o *options) { o.patch = p }
+}
+
+// ImmutableFieldsError is returned by PatchCustomer when the patch sets
+// fields its PatchPolicy forbids changing that way. It's served as 422.
+type ImmutableFieldsError struct {
+	Fields []string
+}
+
+func (e ImmutableFieldsError) Error() string {
+	return "fields can't be changed by PATCH: " + strings.Join(e.Fields, ", ")
+}
+
+// StatusCode implements the Go kit httptransport StatusCoder interface.
+func (e ImmutableFieldsError) StatusCode() int { return http.StatusUnprocessableEntity }
+
+// check returns an ImmutableFieldsError naming the fields set in patch that
+// p forbids, if any.
+func (p PatchPolicy) check(patch Customer) error {
+	var forbidden []string
+	for _, f := range patchedFields(patch) {
+		if p.deny[f] || (p.allow != nil && !p.allow[f]) {
+			forbidden = append(forbidden, f)
+		}
+	}
+	if len(forbidden) > 0 {
+		return ImmutableFieldsError{Fields: forbidden}
+	}
+	return nil
+}
+
+// patchedFields returns the fields patch sets, zero values meaning unset as
+// PatchCustomer takes them.
+func patchedFields(patch Customer) []string {
+	var fields []string
+	if patch.Name != "" {
+		fields = append(fields, "name")
+	}
+	if patch.GivenName != "" {
+		fields = append(fields, "given_name")
+	}
+	if patch.FamilyName != "" {
+		fields = append(fields, "family_name")
+	}
+	if patch.Locale != "" {
+		fields = append(fields, "locale")
+	}
+	if len(patch.NameVariants) > 0 {
+		fields = append(fields, "name_variants")
+	}
+	if patch.Email != "" {
+		fields = append(fields, "email")
+	}
+	if patch.Phone != "" {
+		fields = append(fields, "phone")
+	}
+	if len(patch.Addresses) > 0 {
+		fields = append(fields, "addresses")
+	}
+	if len(patch.Metadata) > 0 {
+		fields = append(fields, "metadata")
+	}
+	if len(patch.ExternalIDs) > 0 {
+		fields = append(fields, "external_ids")
+	}
+	return fields
+}
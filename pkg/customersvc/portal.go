@@ -0,0 +1,223 @@
+package customersvc
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/endpoint"
+	httptransport "github.com/go-kit/kit/transport/http"
+	"github.com/gorilla/mux"
+)
+
+// PortalTokenPrefix starts every portal token, telling them apart from API
+// keys in the same headers.
+const PortalTokenPrefix = "pt."
+
+// Endpoints a portal token grants access to, for its own customer only.
+var portalMethods = map[string]bool{
+	"GetCustomer":      true,
+	"GetCustomerFull":  true,
+	"PutCustomer":      true,
+	"PatchCustomer":    true,
+	"GetAddresses":     true,
+	"GetAddressesPage": true,
+	"GetAddress":       true,
+}
+
+// PortalTokens mints and verifies portal tokens: short-lived bearer tokens
+// that let a customer read and update their own record, and nothing else,
+// so that a self-service portal can call the service on behalf of its
+// signed-in user without an auth service of its own. Tokens are signed
+// rather than stored, so they can't be revoked before they expire.
+type PortalTokens struct {
+	key    []byte
+	maxTTL time.Duration
+	clock  Clock
+}
+
+// NewPortalTokens returns PortalTokens using the given HMAC key, which should
+// differ from that of a URLSigner. Requested TTLs are capped at maxTTL.
+func NewPortalTokens(key []byte, maxTTL time.Duration, opts ...Option) *PortalTokens {
+	o := makeOptions(opts)
+	return &PortalTokens{key: key, maxTTL: maxTTL, clock: o.clock}
+}
+
+// Mint returns a token for customerID of tenant, and the time at which it
+// stops being valid.
+func (t *PortalTokens) Mint(tenant, customerID string, ttl time.Duration) (string, time.Time) {
+	if ttl <= 0 || ttl > t.maxTTL {
+		ttl = t.maxTTL
+	}
+	expires := t.clock.Now().Add(ttl).Truncate(time.Second)
+	tn := base64.RawURLEncoding.EncodeToString([]byte(tenant))
+	id := base64.RawURLEncoding.EncodeToString([]byte(customerID))
+	exp := strconv.FormatInt(expires.Unix(), 10)
+	return PortalTokenPrefix + tn + "." + id + "." + exp + "." + t.mac(tn, id, exp), expires
+}
+
+// Verify returns the tenant and customer token was minted for, failing with
+// ErrUnauthenticated if it's malformed, forged or expired. Tokens minted
+// before they named a tenant are malformed.
+func (t *PortalTokens) Verify(token string) (tenant, customerID string, err error) {
+	parts := strings.Split(strings.TrimPrefix(token, PortalTokenPrefix), ".")
+	if !strings.HasPrefix(token, PortalTokenPrefix) || len(parts) != 4 {
+		return "", "", ErrUnauthenticated
+	}
+	tn, id, exp, sig := parts[0], parts[1], parts[2], parts[3]
+	if !hmac.Equal([]byte(sig), []byte(t.mac(tn, id, exp))) {
+		return "", "", ErrUnauthenticated
+	}
+	unix, err := strconv.ParseInt(exp, 10, 64)
+	if err != nil || t.clock.Now().After(time.Unix(unix, 0)) {
+		return "", "", ErrUnauthenticated
+	}
+	tenantBytes, err := base64.RawURLEncoding.DecodeString(tn)
+	if err != nil {
+		return "", "", ErrUnauthenticated
+	}
+	customerBytes, err := base64.RawURLEncoding.DecodeString(id)
+	if err != nil {
+		return "", "", ErrUnauthenticated
+	}
+	return string(tenantBytes), string(customerBytes), nil
+}
+
+func (t *PortalTokens) mac(tn, id, exp string) string {
+	h := hmac.New(sha256.New, t.key)
+	h.Write([]byte("portal\n" + tn + "\n" + id + "\n" + exp))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+type portalAccessKey struct{}
+
+// PortalAccess returns the customer whose portal token authorized the
+// request carrying ctx, if one did.
+func PortalAccess(ctx context.Context) (string, bool) {
+	id, ok := ctx.Value(portalAccessKey{}).(string)
+	return id, ok
+}
+
+// PortalTokenMiddleware returns an endpoint middleware that verifies portal
+// tokens, carried like API keys. Requests with a valid one are let through
+// to the endpoints in portalMethods, for the token's customer only, with
+// PortalAccess set, which APIKeyMiddleware accepts in place of a key, and
+// the token's tenant, see TenantFrom. Requests without one pass through
+// untouched.
+func PortalTokenMiddleware(tokens *PortalTokens) func(method string) endpoint.Middleware {
+	return func(method string) endpoint.Middleware {
+		return func(next endpoint.Endpoint) endpoint.Endpoint {
+			return func(ctx context.Context, request interface{}) (interface{}, error) {
+				token := apiKeyFromMetadata(RequestMetadataFrom(ctx))
+				if !strings.HasPrefix(token, PortalTokenPrefix) {
+					return next(ctx, request)
+				}
+				tenant, customerID, err := tokens.Verify(token)
+				if err != nil {
+					return nil, err
+				}
+				if !portalMethods[method] || requestCustomerID(request) != customerID {
+					return nil, ErrInsufficientScope
+				}
+				if asked := RequestMetadataFrom(ctx).Get(MetadataTenant); asked != "" && asked != tenant {
+					return nil, ErrTenantMismatch
+				}
+				return next(context.WithValue(withTenant(ctx, tenant), portalAccessKey{}, customerID), request)
+			}
+		}
+	}
+}
+
+// requestCustomerID returns the customer the request of a portal method is
+// about.
+func requestCustomerID(request interface{}) string {
+	switch r := request.(type) {
+	case getCustomerRequest:
+		return r.ID
+	case getCustomerFullRequest:
+		return r.ID
+	case putCustomerRequest:
+		return r.ID
+	case patchCustomerRequest:
+		return r.ID
+	case getAddressesRequest:
+		return r.CustomerID
+	case getAddressesPageRequest:
+		return r.CustomerID
+	case getAddressRequest:
+		return r.CustomerID
+	}
+	return ""
+}
+
+// WithPortalTokens accepts portal tokens from tokens, see
+// PortalTokenMiddleware, and mounts POST /customers/:id/portal-token to mint
+// them.
+func WithPortalTokens(tokens *PortalTokens) HandlerOption {
+	return func(c *handlerConfig) { c.portal = tokens }
+}
+
+func mountPortalTokens(r *mux.Router, s Service, tokens *PortalTokens, wrap func(string, endpoint.Endpoint) endpoint.Endpoint, options []httptransport.ServerOption) {
+	r.Methods("POST").Path("/customers/{id}/portal-token").Handler(httptransport.NewServer(
+		wrap("IssuePortalToken", MakeIssuePortalTokenEndpoint(s, tokens)),
+		decodeIssuePortalTokenRequest,
+		encodeResponse,
+		options...,
+	))
+}
+
+// MakeIssuePortalTokenEndpoint returns an endpoint that mints a portal token
+// for a single customer, of the calling tenant. It checks that the customer
+// exists, so tokens aren't handed out for customers that would 404.
+func MakeIssuePortalTokenEndpoint(s Service, tokens *PortalTokens) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(issuePortalTokenRequest)
+		if _, e := s.GetCustomer(ctx, req.ID); e != nil {
+			return issuePortalTokenResponse{Err: e}, nil
+		}
+		token, expires := tokens.Mint(TenantFrom(ctx), req.ID, req.TTL)
+		return issuePortalTokenResponse{Token: token, Expires: expires}, nil
+	}
+}
+
+type issuePortalTokenRequest struct {
+	ID  string
+	TTL time.Duration
+}
+
+type issuePortalTokenResponse struct {
+	Token   string    `json:"token,omitempty" xml:"token,omitempty"`
+	Expires time.Time `json:"expires,omitempty" xml:"expires,omitempty"`
+	Err     error     `json:"err,omitempty" xml:"-"`
+}
+
+func (r issuePortalTokenResponse) error() error { return r.Err }
+
+func decodeIssuePortalTokenRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	vars := mux.Vars(r)
+	id, ok := vars["id"]
+	if !ok {
+		return nil, ErrBadRouting
+	}
+	var body struct {
+		TTL string `json:"ttl" xml:"ttl"`
+	}
+	if r.ContentLength != 0 {
+		if err := decodeBody(r, &body); err != nil {
+			return nil, err
+		}
+	}
+	var ttl time.Duration
+	if body.TTL != "" {
+		if ttl, err = time.ParseDuration(body.TTL); err != nil {
+			return nil, err
+		}
+	}
+	return issuePortalTokenRequest{ID: id, TTL: ttl}, nil
+}
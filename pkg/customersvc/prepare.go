@@ -0,0 +1,130 @@
+package customersvc
+
+import (
+	"context"
+	"time"
+)
+
+// Limits on how long a prepared customer waits for CommitCustomer.
+const (
+	DefaultPrepareTTL = 5 * time.Minute
+	MaxPrepareTTL     = time.Hour
+)
+
+// PendingCustomer is the receipt of PrepareCustomer.
+type PendingCustomer struct {
+	ID      string    `json:"id" xml:"id"`
+	Expires time.Time `json:"expires" xml:"expires"`
+}
+
+type pendingCustomer struct {
+	customer Customer
+	expires  time.Time
+}
+
+// PrepareCustomer is the first phase of a two-phase create, for orchestrators
+// that create a customer together with records in other services. It
+// validates p and reserves its ID, as PostCustomer would, but the customer
+// stays invisible until CommitCustomer. If neither CommitCustomer nor
+// AbortCustomer is called within ttl (DefaultPrepareTTL if zero, at most
+// MaxPrepareTTL), the reservation lapses.
+func (s *inmemService) PrepareCustomer(ctx context.Context, p Customer, ttl time.Duration) (PendingCustomer, error) {
+	p = normalizeName(p)
+	p.Addresses = normalizeRegions(p.Addresses, s.regions)
+	if errs := validateCustomer(p, s.regions, s.schema); len(errs) > 0 {
+		return PendingCustomer{}, errs[0].err
+	}
+	if err := validateExternalIDs(p.ExternalIDs); err != nil {
+		return PendingCustomer{}, err
+	}
+	if ttl <= 0 {
+		ttl = DefaultPrepareTTL
+	}
+	if ttl > MaxPrepareTTL {
+		ttl = MaxPrepareTTL
+	}
+
+	if err := s.lock(ctx); err != nil {
+		return PendingCustomer{}, err
+	}
+	defer s.mtx.Unlock()
+	s.expirePending()
+	if s.reserved(p.ID) {
+		return PendingCustomer{}, ErrAlreadyExists
+	}
+	if err := s.checkExternalIDs(p.ID, p.ExternalIDs); err != nil {
+		return PendingCustomer{}, err // fail early; claimed on commit
+	}
+	addresses, err := s.embedAddresses(p.Addresses)
+	if err != nil {
+		return PendingCustomer{}, err
+	}
+	p.Addresses = addresses
+	expires := s.clock.Now().Add(ttl)
+	s.pending[p.ID] = pendingCustomer{customer: p, expires: expires}
+	return PendingCustomer{ID: p.ID, Expires: expires}, nil
+}
+
+// CommitCustomer makes a prepared customer visible. It fails with
+// ErrNotFound if there's no such reservation, or it has lapsed.
+func (s *inmemService) CommitCustomer(ctx context.Context, id string) error {
+	if err := s.lock(ctx); err != nil {
+		return err
+	}
+	defer s.mtx.Unlock()
+	s.expirePending()
+	pc, ok := s.pending[id]
+	if !ok {
+		return ErrNotFound
+	}
+	if _, ok := s.customers[id]; ok {
+		delete(s.pending, id)
+		return ErrAlreadyExists // PUT in the meantime
+	}
+	if err := s.indexExternalIDs(id, nil, pc.customer.ExternalIDs); err != nil {
+		delete(s.pending, id)
+		return err
+	}
+	if err := s.record(id, EventCreated, 1, pc.customer); err != nil {
+		return err // still prepared, so the commit can be retried
+	}
+	delete(s.pending, id)
+	return nil
+}
+
+// AbortCustomer drops a prepared customer, freeing its ID. It fails with
+// ErrNotFound if there's no such reservation, so that orchestrators can tell
+// an abort from a lapse.
+func (s *inmemService) AbortCustomer(ctx context.Context, id string) error {
+	if err := s.lock(ctx); err != nil {
+		return err
+	}
+	defer s.mtx.Unlock()
+	s.expirePending()
+	if _, ok := s.pending[id]; !ok {
+		return ErrNotFound
+	}
+	delete(s.pending, id)
+	return nil
+}
+
+// reserved reports whether id is taken by a customer or a pending one. The
+// caller must hold the lock.
+func (s *inmemService) reserved(id string) bool {
+	if _, ok := s.customers[id]; ok {
+		return true
+	}
+	_, ok := s.pending[id]
+	return ok
+}
+
+// expirePending drops lapsed reservations. The caller must hold the write
+// lock.
+func (s *inmemService) expirePending() {
+	now := s.clock.Now()
+	for id, pc := range s.pending {
+		if !now.Before(pc.expires) {
+			delete(s.pending, id)
+		}
+	}
+}
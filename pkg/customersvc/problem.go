@@ -0,0 +1,130 @@
+package customersvc
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"net/http"
+	"strings"
+)
+
+// RequestIDHeader carries the request ID. A request ID given by the client
+// or a proxy is kept; otherwise one is generated. Either way it's echoed
+// back on the response.
+const RequestIDHeader = "X-Request-ID"
+
+// WithProblemDetails makes error responses RFC 7807 problem documents
+// (application/problem+json, or application/problem+xml for clients that
+// prefer XML) instead of the default {"error": "..."} body. Problem types are
+// typeBase followed by a slug of the status text, e.g. typeBase + "not-found",
+// or "about:blank" if typeBase is empty.
+func WithProblemDetails(typeBase string) HandlerOption {
+	return func(c *handlerConfig) {
+		c.problems = true
+		c.problemTypeBase = typeBase
+	}
+}
+
+type requestInfo struct {
+	id      string
+	traceID string
+	// problems is set when errors are rendered as problem details.
+	problems        bool
+	problemTypeBase string
+}
+
+type requestInfoKey struct{}
+
+// RequestID returns the ID of the request carrying ctx, or "" if ctx didn't
+// come from the HTTP handler.
+func RequestID(ctx context.Context) string {
+	info, _ := ctx.Value(requestInfoKey{}).(requestInfo)
+	return info.id
+}
+
+// TraceID returns the W3C trace ID of the request carrying ctx, taken from its
+// traceparent header, or "" if there was none.
+func TraceID(ctx context.Context) string {
+	info, _ := ctx.Value(requestInfoKey{}).(requestInfo)
+	return info.traceID
+}
+
+// requestInfoMiddleware identifies each request, and records what encodeError
+// needs to know about it in the request context.
+func requestInfoMiddleware(problems bool, problemTypeBase string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			info := requestInfo{
+				id:              r.Header.Get(RequestIDHeader),
+				traceID:         traceIDFrom(r.Header.Get("traceparent")),
+				problems:        problems,
+				problemTypeBase: problemTypeBase,
+			}
+			if info.id == "" || len(info.id) > 128 {
+				info.id = newRequestID()
+			}
+			w.Header().Set(RequestIDHeader, info.id)
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestInfoKey{}, info)))
+		})
+	}
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	if _, err := SystemRand.Read(b); err != nil {
+		return "" // leave it unidentified rather than fail the request
+	}
+	return hex.EncodeToString(b)
+}
+
+// traceIDFrom extracts the trace ID from a traceparent header of the form
+// version-traceid-parentid-flags.
+func traceIDFrom(traceparent string) string {
+	parts := strings.Split(traceparent, "-")
+	if len(parts) < 4 || len(parts[1]) != 32 || parts[1] == strings.Repeat("0", 32) {
+		return ""
+	}
+	if _, err := hex.DecodeString(parts[1]); err != nil {
+		return ""
+	}
+	return parts[1]
+}
+
+// problem is an RFC 7807 problem details document, with the request and trace
+// IDs as extension members.
+type problem struct {
+	XMLName   xml.Name `json:"-" xml:"urn:ietf:rfc:7807 problem"`
+	Type      string   `json:"type" xml:"type"`
+	Title     string   `json:"title" xml:"title"`
+	Status    int      `json:"status" xml:"status"`
+	Detail    string   `json:"detail,omitempty" xml:"detail,omitempty"`
+	RequestID string   `json:"request_id,omitempty" xml:"request_id,omitempty"`
+	TraceID   string   `json:"trace_id,omitempty" xml:"trace_id,omitempty"`
+}
+
+func writeProblem(ctx context.Context, w http.ResponseWriter, info requestInfo, code int, err error) {
+	title := http.StatusText(code)
+	typ := "about:blank"
+	if info.problemTypeBase != "" {
+		typ = info.problemTypeBase + strings.ToLower(strings.Replace(title, " ", "-", -1))
+	}
+	p := problem{
+		Type:      typ,
+		Title:     title,
+		Status:    code,
+		Detail:    err.Error(),
+		RequestID: info.id,
+		TraceID:   info.traceID,
+	}
+	if acceptsXML(ctx) {
+		w.Header().Set("Content-Type", "application/problem+xml; charset=utf-8")
+		w.WriteHeader(code)
+		w.Write([]byte(xml.Header))
+		xml.NewEncoder(w).Encode(p)
+		return
+	}
+	w.Header().Set("Content-Type", "application/problem+json; charset=utf-8")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(p)
+}
@@ -0,0 +1,100 @@
+package customersvc
+
+import (
+	"context"
+	"net/http"
+	"strings"
+)
+
+// PropagatedHeaders are the headers of an incoming request copied onto the
+// outbound calls made on its behalf, to enrichment webhooks, the tokenization
+// service and captcha verifiers, so that a service mesh such as Istio or
+// Linkerd can connect them to its trace: the request ID, B3 and W3C trace
+// context, baggage, and OpenTracing span context.
+var PropagatedHeaders = []string{
+	RequestIDHeader,
+	"X-B3-TraceId",
+	"X-B3-SpanId",
+	"X-B3-ParentSpanId",
+	"X-B3-Sampled",
+	"X-B3-Flags",
+	"B3",
+	"Traceparent",
+	"Tracestate",
+	"Baggage",
+	"X-Ot-Span-Context",
+}
+
+type propagationKey struct{}
+
+// propagatedHeaders returns the PropagatedHeaders of the request carrying
+// ctx. The request ID is the one the request was identified by, generated if
+// it came without one.
+func propagatedHeaders(ctx context.Context) http.Header {
+	if h, ok := ctx.Value(propagationKey{}).(http.Header); ok {
+		return h
+	}
+	md := RequestMetadataFrom(ctx)
+	h := http.Header{}
+	for _, name := range PropagatedHeaders {
+		if values := md[strings.ToLower(name)]; len(values) > 0 {
+			h[http.CanonicalHeaderKey(name)] = values
+		}
+	}
+	if id := RequestID(ctx); id != "" {
+		h.Set(RequestIDHeader, id)
+	}
+	return h
+}
+
+// PropagateHeaders sets the PropagatedHeaders of the request carrying ctx on
+// h, the headers of an outbound call made on its behalf.
+func PropagateHeaders(ctx context.Context, h http.Header) {
+	for name, values := range propagatedHeaders(ctx) {
+		h[name] = append([]string(nil), values...)
+	}
+}
+
+// detachPropagation returns a context for work outliving the request
+// carrying ctx, such as enrichment or a job, not cancelled with it but
+// still propagating its headers, and made on behalf of its tenant, so that
+// a RoutingService routes it alike.
+func detachPropagation(ctx context.Context) context.Context {
+	detached := context.WithValue(context.Background(), propagationKey{}, propagatedHeaders(ctx))
+	if tenant := RequestMetadataFrom(ctx).Get(MetadataTenant); tenant != "" {
+		detached = WithRequestMetadata(detached, RequestMetadata{MetadataTenant: {tenant}})
+	}
+	return detached
+}
+
+// PropagatingTransport is an http.RoundTripper setting the PropagatedHeaders
+// of the request each outbound request's context comes from, for the HTTP
+// clients of code embedding customersvc, such as enrichers or validators of
+// its own. Headers the outbound request sets already are kept. A nil Base
+// means http.DefaultTransport.
+type PropagatingTransport struct {
+	Base http.RoundTripper
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t PropagatingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	propagated := propagatedHeaders(req.Context())
+	if len(propagated) == 0 {
+		return base.RoundTrip(req)
+	}
+	r := req.WithContext(req.Context()) // a RoundTripper mustn't modify req
+	r.Header = make(http.Header, len(req.Header)+len(propagated))
+	for name, values := range req.Header {
+		r.Header[name] = values
+	}
+	for name, values := range propagated {
+		if _, ok := r.Header[name]; !ok {
+			r.Header[name] = values
+		}
+	}
+	return base.RoundTrip(r)
+}
@@ -0,0 +1,269 @@
+package customersvc
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/go-kit/kit/endpoint"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/metrics"
+	"github.com/go-kit/kit/metrics/discard"
+	"github.com/praveensastry/customersvc/pkg/config"
+)
+
+// The Provide functions assemble customersvc the way cmd/customersvc does,
+// from explicit config structs rather than flags, for applications that
+// embed it and wire their components with a dependency injection framework
+// such as wire or fx. Each takes its dependencies as arguments and returns
+// what it builds, so they can be registered as providers as they are.
+
+// ServiceConfig configures ProvideService. The zero value is an in-memory
+// service with lenient region checks, duplicate addresses allowed, and none
+// of the optional middlewares.
+type ServiceConfig struct {
+	RegionCheck  RegionCheck
+	AddressDedup DedupPolicy
+	PatchPolicy  PatchPolicy
+	Addresses    AddressAuthority
+	// AddressSchema defines the custom fields addresses may have. Nil is
+	// none.
+	AddressSchema *AddressSchema
+	// ReportStaleness is how long a cached report may be served before it's
+	// recomputed. Zero disables the cache.
+	ReportStaleness time.Duration
+	// CoalesceReads makes concurrent reads of the same customer share one
+	// fetch, see CoalescingMiddleware. CoalescedReads counts the reads
+	// answered by another's fetch.
+	CoalesceReads  bool
+	CoalescedReads metrics.Counter
+	// Cache, if set, serves reads of customers from memory.
+	Cache *CustomerCache
+	// Blocklist, if set, rejects customers whose email or phone is on it.
+	Blocklist *Blocklist
+	// Enricher, if set, computes customer metadata after writes.
+	Enricher           Enricher
+	Enrichment         EnrichmentOptions
+	EnrichmentFailures metrics.Counter
+	// AccessSink, if set, records reads of personal data.
+	AccessSink AccessSink
+	AccessLog  AccessLogOptions
+	// Meter, if set, meters calls for billing.
+	Meter *Meter
+	// Panics counts panics recovered, by method.
+	Panics metrics.Counter
+	// Journal, if set, makes the in-memory service durable.
+	Journal *Journal
+	// Store, if set, is the store the middlewares wrap instead of the
+	// in-memory one, e.g. a RoutingService of stores opened with
+	// StoreOptions.
+	Store Service
+	// SelfAccess keeps customers acting on their own behalf to their own
+	// record, see SelfAccessMiddleware.
+	SelfAccess bool
+	// Tiering, if set, moves inactive customers of Store to its cold
+	// store. It must be given Store by NewTiering.
+	Tiering *Tiering
+	// Tokenizer, if set, stores emails and phone numbers as its tokens.
+	Tokenizer    Tokenizer
+	Tokenization TokenizationOptions
+}
+
+// StoreOptions returns the Options of the in-memory store ProvideService
+// wraps, for stores built in its place, such as those of a RoutingService.
+func (cfg ServiceConfig) StoreOptions() []Option {
+	opts := []Option{WithRegionCheck(cfg.RegionCheck), WithAddressDedup(cfg.AddressDedup), WithPatchPolicy(cfg.PatchPolicy), WithAddressAuthority(cfg.Addresses)}
+	if cfg.AddressSchema != nil {
+		opts = append(opts, WithAddressSchema(cfg.AddressSchema))
+	}
+	if cfg.Journal != nil {
+		opts = append(opts, WithJournal(cfg.Journal))
+	}
+	return opts
+}
+
+// ProvideService returns the in-memory Service, or cfg.Store, wrapped in
+// the middlewares cfg enables, and in recovery and logging.
+func ProvideService(cfg ServiceConfig, logger Logger) Service {
+	if cfg.EnrichmentFailures == nil {
+		cfg.EnrichmentFailures = discard.NewCounter()
+	}
+	if cfg.Panics == nil {
+		cfg.Panics = discard.NewCounter()
+	}
+	if cfg.CoalescedReads == nil {
+		cfg.CoalescedReads = discard.NewCounter()
+	}
+	s := cfg.Store
+	if s == nil {
+		s = NewInmemService(cfg.StoreOptions()...)
+	}
+	if cfg.Tiering != nil {
+		s = cfg.Tiering.Middleware()(s)
+	}
+	if cfg.CoalesceReads {
+		// Right around the store, where fetches are shared, and inside
+		// tokenization, so that detokenized customers aren't.
+		s = CoalescingMiddleware(cfg.CoalescedReads)(s)
+	}
+	if cfg.Cache != nil {
+		// Outside coalescing, so that misses share fetches, and inside
+		// tokenization, so that tokens are kept rather than personal
+		// data.
+		s = cfg.Cache.Middleware()(s)
+		if cfg.Tiering != nil {
+			// Customers read from the cache are in use too.
+			cfg.Cache.onHit = cfg.Tiering.touch
+		}
+	}
+	if cfg.Tokenizer != nil {
+		// Inside the blocklist and enrichment, which need the values.
+		s = TokenizationMiddleware(cfg.Tokenizer, cfg.Tokenization)(s)
+	}
+	if cfg.Blocklist != nil {
+		s = BlocklistMiddleware(cfg.Blocklist)(s)
+	}
+	if cfg.Enricher != nil {
+		s = EnrichmentMiddleware(cfg.Enricher, cfg.Enrichment, log.With(logger, "component", "enrich"), cfg.EnrichmentFailures)(s)
+	}
+	if cfg.ReportStaleness > 0 {
+		s = ReportCacheMiddleware(cfg.ReportStaleness)(s)
+	}
+	if cfg.Meter != nil {
+		s = UsageMiddleware(cfg.Meter)(s)
+	}
+	if cfg.AccessSink != nil {
+		s = AccessLogMiddleware(cfg.AccessSink, cfg.AccessLog, log.With(logger, "component", "access-log"))(s)
+	}
+	if cfg.SelfAccess {
+		s = SelfAccessMiddleware()(s)
+	}
+	s = RecoveryMiddleware(logger, cfg.Panics)(s)
+	s = LoggingMiddleware(logger)(s)
+	return s
+}
+
+// HTTPConfig configures ProvideHTTPHandler. Nil fields leave the feature
+// they configure off.
+type HTTPConfig struct {
+	Slashes SlashPolicy
+	Headers *ResponseHeaders
+	// Config holds the reloadable rate limit and request timeout. Nil is
+	// neither.
+	Config      config.Config
+	Concurrency ConcurrencyLimits
+	Adaptive    *AdaptiveLimits
+	// Panics counts panics recovered in endpoints, by method.
+	Panics            metrics.Counter
+	ProblemDetails    bool
+	ProblemTypeBase   string
+	Hardening         *HardeningOptions
+	Blocklist         *Blocklist
+	APIKeys           *APIKeys
+	Meter             *Meter
+	Recorder          *Recorder
+	Tap               *Tap
+	URLSigner         *URLSigner
+	Deprecations      *Deprecations
+	PortalTokens      *PortalTokens
+	Ownership         *Ownership
+	Credentials       *Credentials
+	AddressReferences *AddressReferences
+	Jobs              *Jobs
+	Idempotency       *IdempotencyKeys
+	WriteThrottle     *WriteThrottle
+	StatusPage        *StatusPage
+	// Captcha, if set, verifies captchas on endpoints exposed to end users.
+	// Holders of keys in CaptchaTrustedKeys skip them.
+	Captcha            CaptchaVerifier
+	CaptchaTrustedKeys *APIKeys
+	// Seeding mounts POST /admin/seed, for development and tests only.
+	Seeding bool
+	// Options are applied after those above.
+	Options []HandlerOption
+}
+
+// ProvideHTTPHandler returns the HTTP handler of s configured by cfg, see
+// MakeHTTPHandler. Endpoints are wrapped, outermost first, in recovery, rate
+// limiting, concurrency limiting and timeouts.
+func ProvideHTTPHandler(s Service, logger Logger, cfg HTTPConfig) http.Handler {
+	if cfg.Config == nil {
+		cfg.Config = config.Static{}
+	}
+	if cfg.Panics == nil {
+		cfg.Panics = discard.NewCounter()
+	}
+	opts := []HandlerOption{
+		WithSlashPolicy(cfg.Slashes),
+		WithEndpointMiddleware(func(method string) endpoint.Middleware {
+			return EndpointRecoveryMiddleware(method, logger, cfg.Panics)
+		}),
+		WithEndpointMiddleware(RateLimitMiddleware(cfg.Config)),
+		WithEndpointMiddleware(ConcurrencyLimitMiddleware(cfg.Concurrency)),
+	}
+	if cfg.Adaptive != nil {
+		opts = append(opts, WithEndpointMiddleware(AdaptiveLimitMiddleware(*cfg.Adaptive)))
+	}
+	opts = append(opts, WithEndpointMiddleware(TimeoutMiddleware(cfg.Config)))
+	if cfg.Headers != nil {
+		opts = append(opts, WithResponseHeaders(*cfg.Headers))
+	}
+	if cfg.ProblemDetails {
+		opts = append(opts, WithProblemDetails(cfg.ProblemTypeBase))
+	}
+	if cfg.Hardening != nil {
+		opts = append(opts, WithHardening(*cfg.Hardening))
+	}
+	if cfg.Blocklist != nil {
+		opts = append(opts, WithBlocklist(cfg.Blocklist))
+	}
+	if cfg.APIKeys != nil {
+		opts = append(opts, WithAPIKeys(cfg.APIKeys))
+	}
+	if cfg.Meter != nil {
+		opts = append(opts, WithMeter(cfg.Meter))
+	}
+	if cfg.Recorder != nil {
+		opts = append(opts, WithRecorder(cfg.Recorder))
+	}
+	if cfg.Tap != nil {
+		opts = append(opts, WithTap(cfg.Tap))
+	}
+	if cfg.URLSigner != nil {
+		opts = append(opts, WithURLSigner(cfg.URLSigner))
+	}
+	if cfg.Deprecations != nil {
+		opts = append(opts, WithDeprecations(cfg.Deprecations))
+	}
+	if cfg.PortalTokens != nil {
+		opts = append(opts, WithPortalTokens(cfg.PortalTokens))
+	}
+	if cfg.Ownership != nil {
+		opts = append(opts, WithOwnership(cfg.Ownership))
+	}
+	if cfg.Credentials != nil {
+		opts = append(opts, WithCredentials(cfg.Credentials))
+	}
+	if cfg.AddressReferences != nil {
+		opts = append(opts, WithAddressReferences(cfg.AddressReferences))
+	}
+	if cfg.Jobs != nil {
+		opts = append(opts, WithJobs(cfg.Jobs))
+	}
+	if cfg.Seeding {
+		opts = append(opts, WithSeeding())
+	}
+	if cfg.Idempotency != nil {
+		opts = append(opts, WithIdempotencyKeys(cfg.Idempotency))
+	}
+	if cfg.WriteThrottle != nil {
+		opts = append(opts, WithWriteThrottle(cfg.WriteThrottle))
+	}
+	if cfg.StatusPage != nil {
+		opts = append(opts, WithStatusPage(cfg.StatusPage))
+	}
+	if cfg.Captcha != nil {
+		opts = append(opts, WithCaptcha(cfg.Captcha, cfg.CaptchaTrustedKeys))
+	}
+	opts = append(opts, cfg.Options...)
+	return MakeHTTPHandler(s, logger, opts...)
+}
@@ -0,0 +1,244 @@
+package customersvc
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ErrInvalidSort is returned for a CustomerQuery.Sort that isn't one of the
+// Sort constants.
+var ErrInvalidSort = errors.New("unknown sort order")
+
+// Values of CustomerQuery.Sort.
+const (
+	SortByID    = "id" // the default
+	SortByName  = "name"
+	SortByEmail = "email"
+	// SortByFamilyName orders customers by family name, then given name,
+	// those without a family name by their Name.
+	SortByFamilyName = "family_name"
+)
+
+// CustomerQuery asks for one page of the customers matching Filter, in Sort
+// order. Names and emails are compared case-insensitively, and ties broken
+// by ID, so that page cursors stay stable.
+type CustomerQuery struct {
+	Filter CustomerFilter
+	Sort   string
+	// Locale is the BCP 47 tag of the language whose alphabetical order
+	// names are sorted in, e.g. sv sorting Ö after Z. Empty sorts accented
+	// letters with their base letter.
+	Locale string
+	Page   PageRequest
+}
+
+// QueryableService is implemented by backends that can filter, sort and page
+// customers themselves, e.g. a SQL store with a WHERE, ORDER BY and LIMIT,
+// rather than having every matching customer read to return one page. It's
+// optional: QueryCustomers falls back to GetCustomers for backends without
+// it. Middlewares forward it with QueryCustomers too, so that it isn't lost
+// by wrapping a backend.
+type QueryableService interface {
+	QueryCustomers(ctx context.Context, q CustomerQuery) (CustomerPage, error)
+}
+
+// QueryCustomers runs q against s, pushing it down when s is a
+// QueryableService, and otherwise filtering, sorting and paging the result
+// of GetCustomers.
+func QueryCustomers(ctx context.Context, s Service, q CustomerQuery) (CustomerPage, error) {
+	if qs, ok := s.(QueryableService); ok {
+		return qs.QueryCustomers(ctx, q)
+	}
+	if _, err := sortKey(q.Sort, q.Locale); err != nil {
+		return CustomerPage{}, err
+	}
+	customers, err := s.GetCustomers(ctx, q.Filter)
+	if err != nil {
+		return CustomerPage{}, err
+	}
+	matching := customers[:0:0]
+	for _, p := range customers {
+		if q.Filter.matches(p) { // in case the backend filters loosely
+			matching = append(matching, p)
+		}
+	}
+	return pageOf(matching, q)
+}
+
+// sortKey returns the function ordering customers for sort, with names
+// collated for locale.
+func sortKey(sort, locale string) (func(Customer) string, error) {
+	if locale != "" && !validLocale(locale) {
+		return nil, ErrInvalidLocale
+	}
+	switch sort {
+	case "", SortByID:
+		return func(p Customer) string { return p.ID }, nil
+	case SortByName:
+		return func(p Customer) string { return collationKey(p.Name, locale) + "\x00" + p.ID }, nil
+	case SortByFamilyName:
+		return func(p Customer) string {
+			if p.FamilyName == "" {
+				return collationKey(p.Name, locale) + "\x00\x00" + p.ID
+			}
+			return collationKey(p.FamilyName, locale) + "\x00" + collationKey(p.GivenName, locale) + "\x00" + p.ID
+		}, nil
+	case SortByEmail:
+		return func(p Customer) string { return strings.ToLower(p.Email) + "\x00" + p.ID }, nil
+	}
+	return nil, ErrInvalidSort
+}
+
+// pageOf sorts customers, which all match q.Filter, and returns the page q
+// asks for.
+func pageOf(customers []Customer, q CustomerQuery) (CustomerPage, error) {
+	key, err := sortKey(q.Sort, q.Locale)
+	if err != nil {
+		return CustomerPage{}, err
+	}
+	keys := make([]string, len(customers))
+	for i, p := range customers {
+		keys[i] = key(p)
+	}
+	sort.Sort(byKey{customers, keys})
+	from, to, limit, next, err := paginate(len(customers), func(i int) string { return keys[i] }, q.Page)
+	if err != nil {
+		return CustomerPage{}, err
+	}
+	total := len(customers)
+	return CustomerPage{
+		Items:      customers[from:to],
+		NextCursor: next,
+		Total:      &total,
+		Limit:      limit,
+	}, nil
+}
+
+// byKey sorts customers by their precomputed keys.
+type byKey struct {
+	customers []Customer
+	keys      []string
+}
+
+func (b byKey) Len() int           { return len(b.customers) }
+func (b byKey) Less(i, j int) bool { return b.keys[i] < b.keys[j] }
+func (b byKey) Swap(i, j int) {
+	b.customers[i], b.customers[j] = b.customers[j], b.customers[i]
+	b.keys[i], b.keys[j] = b.keys[j], b.keys[i]
+}
+
+// QueryCustomers implements QueryableService, copying out only the matching
+// customers rather than building the full list GetCustomers would.
+func (s *inmemService) QueryCustomers(ctx context.Context, q CustomerQuery) (CustomerPage, error) {
+	switch q.Filter.Archived {
+	case "", ArchivedExclude, ArchivedInclude, ArchivedOnly:
+	default:
+		return CustomerPage{}, ErrInvalidFilter
+	}
+	if err := s.rlock(ctx); err != nil {
+		return CustomerPage{}, err
+	}
+	var customers []Customer
+	sc := scan{ctx: ctx}
+	for _, p := range s.customers {
+		if err := sc.next(); err != nil {
+			s.mtx.RUnlock()
+			return CustomerPage{}, err
+		}
+		if q.Filter.matches(p) {
+			customers = append(customers, p)
+		}
+	}
+	s.mtx.RUnlock()
+	if AddressesOmitted(ctx) {
+		customers = withoutAddresses(customers)
+	}
+	return pageOf(customers, q)
+}
+
+// QueryCustomers implements QueryableService. Primarily useful in a client,
+// where it pushes the query down to the server.
+func (e Endpoints) QueryCustomers(ctx context.Context, q CustomerQuery) (CustomerPage, error) {
+	request := getCustomersPageRequest{Query: q}
+	response, err := e.GetCustomersPageEndpoint(ctx, request)
+	if err != nil {
+		return CustomerPage{}, err
+	}
+	resp := response.(customerPageResponse)
+	return resp.CustomerPage, resp.Err
+}
+
+func (mw loggingMiddleware) QueryCustomers(ctx context.Context, q CustomerQuery) (page CustomerPage, err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log("method", "QueryCustomers", "sort", q.Sort, "took", time.Since(begin), "err", err)
+	}(time.Now())
+	return QueryCustomers(ctx, mw.next, q)
+}
+
+func (mw recoveryMiddleware) QueryCustomers(ctx context.Context, q CustomerQuery) (page CustomerPage, err error) {
+	defer mw.r.recover("QueryCustomers", &err)
+	return QueryCustomers(ctx, mw.next, q)
+}
+
+func (mw selfAccessMiddleware) QueryCustomers(ctx context.Context, q CustomerQuery) (CustomerPage, error) {
+	if err := mw.operator(ctx); err != nil {
+		return CustomerPage{}, err
+	}
+	return QueryCustomers(ctx, mw.next, q)
+}
+
+func (mw *accessLogMiddleware) QueryCustomers(ctx context.Context, q CustomerQuery) (CustomerPage, error) {
+	page, err := QueryCustomers(ctx, mw.Service, q)
+	if err == nil && len(page.Items) > 0 {
+		mw.record(ctx, AccessRecord{Method: "QueryCustomers", Customers: len(page.Items), Fields: customerFields(page.Items)})
+	}
+	return page, err
+}
+
+// QueryCustomers implements QueryableService, detokenizing the page like
+// GetCustomers.
+func (mw *tokenizationMiddleware) QueryCustomers(ctx context.Context, q CustomerQuery) (CustomerPage, error) {
+	page, err := QueryCustomers(ctx, mw.Service, q)
+	if err != nil {
+		return page, err
+	}
+	page.Items = append([]Customer(nil), page.Items...)
+	if err := mw.detokenize(ctx, page.Items); err != nil {
+		return CustomerPage{}, err
+	}
+	return page, nil
+}
+
+// The middlewares below don't touch reads of customer lists, so queries go
+// straight through.
+
+func (mw *reportCacheMiddleware) QueryCustomers(ctx context.Context, q CustomerQuery) (CustomerPage, error) {
+	return QueryCustomers(ctx, mw.Service, q)
+}
+
+func (mw *cachingMiddleware) QueryCustomers(ctx context.Context, q CustomerQuery) (CustomerPage, error) {
+	return QueryCustomers(ctx, mw.Service, q)
+}
+
+func (mw *coalescingMiddleware) QueryCustomers(ctx context.Context, q CustomerQuery) (CustomerPage, error) {
+	return QueryCustomers(ctx, mw.Service, q)
+}
+
+func (mw *blocklistMiddleware) QueryCustomers(ctx context.Context, q CustomerQuery) (CustomerPage, error) {
+	return QueryCustomers(ctx, mw.Service, q)
+}
+
+func (mw *enrichmentMiddleware) QueryCustomers(ctx context.Context, q CustomerQuery) (CustomerPage, error) {
+	return QueryCustomers(ctx, mw.Service, q)
+}
+
+func (mw *tieringMiddleware) QueryCustomers(ctx context.Context, q CustomerQuery) (CustomerPage, error) {
+	return QueryCustomers(ctx, mw.Service, q)
+}
+
+func (mw usageMiddleware) QueryCustomers(ctx context.Context, q CustomerQuery) (CustomerPage, error) {
+	return QueryCustomers(ctx, mw.Service, q)
+}
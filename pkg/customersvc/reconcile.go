@@ -0,0 +1,185 @@
+package customersvc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// ErrDuplicateAddressID is returned when a customer is written with two
+// addresses under the same ID.
+var ErrDuplicateAddressID = errors.New("addresses must have distinct IDs")
+
+// AddressAuthority says which writes decide a customer's addresses: the
+// embedded list of PUT and PATCH /customers/:id, or the address endpoints
+// under /customers/:id/addresses/. Whichever it is, embedded addresses are
+// given IDs when they have none, so that the address endpoints can reach
+// them, and must not share one.
+type AddressAuthority int
+
+const (
+	// AddressesEmbedded lets PUT and PATCH replace the addresses like any
+	// other field. A PUT from a client that read the customer before an
+	// address was added drops that address. It's the default.
+	AddressesEmbedded AddressAuthority = iota
+	// AddressesSubresource leaves addresses to the address endpoints: PUT
+	// keeps the addresses of an existing customer whatever its body holds,
+	// and PATCH with addresses fails with an ImmutableFieldsError. Addresses
+	// may still be given when a customer is created.
+	AddressesSubresource
+)
+
+// ParseAddressAuthority parses "embedded" or "subresource".
+func ParseAddressAuthority(s string) (AddressAuthority, error) {
+	switch s {
+	case "embedded":
+		return AddressesEmbedded, nil
+	case "subresource":
+		return AddressesSubresource, nil
+	}
+	return AddressesEmbedded, fmt.Errorf("unknown address authority %q", s)
+}
+
+// WithAddressAuthority makes the inmem store treat addresses according to a.
+func WithAddressAuthority(a AddressAuthority) Option {
+	return func(o *options) { o.addresses = a }
+}
+
+// embedAddresses prepares addresses written as part of a customer for
+// storage: it rejects duplicate IDs, assigns IDs to addresses without one,
+// and orders them. It must be called with s.mtx held.
+func (s *inmemService) embedAddresses(addresses []Address) ([]Address, error) {
+	seen := make(map[string]bool, len(addresses))
+	for _, a := range addresses {
+		if a.ID == "" {
+			continue
+		}
+		if seen[a.ID] {
+			return nil, ErrDuplicateAddressID
+		}
+		seen[a.ID] = true
+	}
+	addresses = orderAddresses(addresses)
+	for i := range addresses {
+		if addresses[i].ID != "" {
+			continue
+		}
+		id, err := s.ids.next()
+		if err != nil {
+			return nil, err
+		}
+		addresses[i].ID = id
+	}
+	return addresses, nil
+}
+
+// Problems RepairAddresses finds in embedded address lists.
+const (
+	AddressMissingID   = "missing-id"   // the address is given a new ID
+	AddressDuplicateID = "duplicate-id" // every address after the first with the ID is given a new one
+	AddressMisnumbered = "misnumbered"  // the addresses are renumbered from 1
+)
+
+// AddressRepair is an inconsistency RepairAddresses found in the addresses of
+// a customer, and what it did about it.
+type AddressRepair struct {
+	CustomerID string `json:"customer_id" xml:"customer_id"`
+	Problem    string `json:"problem" xml:"problem"`
+	// Position is that of the address concerned, before any renumbering.
+	// It's zero for AddressMisnumbered.
+	Position int `json:"position,omitempty" xml:"position,omitempty"`
+	// AddressID is the ID the address was given, or for a dry run, the ID
+	// it has.
+	AddressID string `json:"address_id,omitempty" xml:"address_id,omitempty"`
+}
+
+// RepairAddresses finds the addresses stored without an ID, or under the ID
+// of another address of the same customer, and customers whose addresses
+// aren't numbered 1 to n, as data written before IDs were assigned or
+// checked may be. Unless dryRun is set, it fixes them. Addresses that can't
+// be reached through the address endpoints become reachable; none are
+// dropped.
+func (s *inmemService) RepairAddresses(ctx context.Context, dryRun bool) ([]AddressRepair, error) {
+	if err := s.lock(ctx); err != nil {
+		return nil, err
+	}
+	defer s.mtx.Unlock()
+	return s.repairAddresses(dryRun)
+}
+
+// repairAddresses does the work of RepairAddresses. The caller must hold the
+// lock, the write lock unless dryRun is set.
+func (s *inmemService) repairAddresses(dryRun bool) ([]AddressRepair, error) {
+	var repairs []AddressRepair
+	for id, p := range s.customers {
+		addresses := append([]Address(nil), p.Addresses...) // revisions share the old slice
+		var found []AddressRepair
+		seen := make(map[string]bool, len(addresses))
+		for i := range addresses {
+			a := &addresses[i]
+			problem := ""
+			switch {
+			case a.ID == "":
+				problem = AddressMissingID
+			case seen[a.ID]:
+				problem = AddressDuplicateID
+			default:
+				seen[a.ID] = true
+				continue
+			}
+			if !dryRun {
+				newID, err := s.ids.next()
+				if err != nil {
+					return nil, err
+				}
+				a.ID = newID
+			}
+			found = append(found, AddressRepair{CustomerID: id, Problem: problem, Position: a.Position, AddressID: a.ID})
+		}
+		for i, a := range addresses {
+			if a.Position != i+1 {
+				found = append(found, AddressRepair{CustomerID: id, Problem: AddressMisnumbered})
+				if !dryRun {
+					addresses = orderAddresses(addresses)
+				}
+				break
+			}
+		}
+		if len(found) == 0 {
+			continue
+		}
+		repairs = append(repairs, found...)
+		if !dryRun {
+			p.Addresses = addresses
+			if err := s.record(id, EventUpdated, 1, p); err != nil {
+				return nil, err
+			}
+		}
+	}
+	sort.SliceStable(repairs, func(i, j int) bool { return repairs[i].CustomerID < repairs[j].CustomerID })
+	return repairs, nil
+}
+
+// RunAddressRepair calls RepairAddresses on s every interval until done is
+// closed, logging each repair made.
+func RunAddressRepair(s Service, interval time.Duration, logger Logger, done <-chan struct{}) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			repairs, err := s.RepairAddresses(context.Background(), false)
+			if err != nil {
+				logger.Log("job", "RepairAddresses", "err", err)
+				continue
+			}
+			for _, r := range repairs {
+				logger.Log("job", "RepairAddresses", "customerID", r.CustomerID, "problem", r.Problem, "position", r.Position, "addressID", r.AddressID)
+			}
+		case <-done:
+			return
+		}
+	}
+}
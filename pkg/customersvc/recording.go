@@ -0,0 +1,308 @@
+package customersvc
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/endpoint"
+	httptransport "github.com/go-kit/kit/transport/http"
+	"github.com/gorilla/mux"
+)
+
+// RedactedValue replaces sensitive values in recordings.
+const RedactedValue = "[redacted]"
+
+// DefaultRedactedFields are the body fields whose values are redacted from
+// recordings unless RecorderOptions.Redact says otherwise: personal data,
+// the tokens minted by the API key endpoints, and the secrets given to the
+// credential endpoints.
+var DefaultRedactedFields = []string{"email", "phone", "location", "token", "secret"}
+
+// Headers and query parameters that are always redacted from recordings, as
+// they grant access.
+var (
+	redactedHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie", APIKeyHeader}
+	redactedParams  = []string{"sig", "nonce"}
+)
+
+// RecorderOptions tunes a Recorder.
+type RecorderOptions struct {
+	// Size is the number of recordings kept; older ones are dropped.
+	// Default 100.
+	Size int
+	// SampleRate is the fraction of requests recorded, between 0 and 1.
+	// Zero means 1: record everything.
+	SampleRate float64
+	// MaxBody is the number of bytes kept of each body. Default 64 KiB.
+	MaxBody int
+	// Redact lists the JSON and XML fields whose values are redacted from
+	// bodies. Nil means DefaultRedactedFields.
+	Redact []string
+}
+
+// Recording is a request and the response it got, sanitized.
+type Recording struct {
+	Time           time.Time `json:"time" xml:"time"`
+	Duration       string    `json:"duration" xml:"duration"`
+	RequestID      string    `json:"request_id,omitempty" xml:"request_id,omitempty"`
+	Method         string    `json:"method" xml:"method"`
+	URL            string    `json:"url" xml:"url"`
+	RequestHeader  Metadata  `json:"request_header,omitempty" xml:"request_header,omitempty"`
+	RequestBody    string    `json:"request_body,omitempty" xml:"request_body,omitempty"`
+	Status         int       `json:"status" xml:"status"`
+	ResponseHeader Metadata  `json:"response_header,omitempty" xml:"response_header,omitempty"`
+	ResponseBody   string    `json:"response_body,omitempty" xml:"response_body,omitempty"`
+	Truncated      bool      `json:"truncated,omitempty" xml:"truncated,omitempty"` // a body exceeded MaxBody
+}
+
+// Recorder keeps full request/response pairs for a sample of traffic in a
+// ring buffer, to debug client integrations without packet captures.
+// Credentials and the fields in RecorderOptions.Redact are redacted before
+// anything is kept.
+type Recorder struct {
+	opts   RecorderOptions
+	clock  Clock
+	rand   Rand
+	fields map[string]bool
+	xmlRE  []*regexp.Regexp
+
+	mtx  sync.Mutex
+	ring []Recording
+	next int // index of the oldest recording once ring is full
+}
+
+// NewRecorder returns an empty Recorder. Mount it with WithRecorder.
+func NewRecorder(opts RecorderOptions, options ...Option) *Recorder {
+	o := makeOptions(options)
+	if opts.Size <= 0 {
+		opts.Size = 100
+	}
+	if opts.SampleRate <= 0 || opts.SampleRate > 1 {
+		opts.SampleRate = 1
+	}
+	if opts.MaxBody <= 0 {
+		opts.MaxBody = 64 << 10
+	}
+	if opts.Redact == nil {
+		opts.Redact = DefaultRedactedFields
+	}
+	rec := &Recorder{
+		opts:   opts,
+		clock:  o.clock,
+		rand:   o.rand,
+		fields: map[string]bool{},
+	}
+	for _, f := range opts.Redact {
+		rec.fields[f] = true
+		q := regexp.QuoteMeta(f)
+		rec.xmlRE = append(rec.xmlRE, regexp.MustCompile(`(<`+q+`(?:\s[^>]*)?>)[^<]*(</`+q+`>)`))
+	}
+	return rec
+}
+
+// Recordings returns the recordings kept, oldest first.
+func (rec *Recorder) Recordings() []Recording {
+	rec.mtx.Lock()
+	defer rec.mtx.Unlock()
+	out := make([]Recording, 0, len(rec.ring))
+	out = append(out, rec.ring[rec.next:]...)
+	return append(out, rec.ring[:rec.next]...)
+}
+
+// Reset drops every recording.
+func (rec *Recorder) Reset() {
+	rec.mtx.Lock()
+	defer rec.mtx.Unlock()
+	rec.ring, rec.next = nil, 0
+}
+
+func (rec *Recorder) add(r Recording) {
+	rec.mtx.Lock()
+	defer rec.mtx.Unlock()
+	if len(rec.ring) < rec.opts.Size {
+		rec.ring = append(rec.ring, r)
+		return
+	}
+	rec.ring[rec.next] = r
+	rec.next = (rec.next + 1) % len(rec.ring)
+}
+
+// middleware records a sample of the requests to next. It must run inside
+// requestInfoMiddleware, for request IDs. The recordings endpoints aren't
+// recorded, as their responses hold other recordings, and nor is the tap,
+// as its response is a stream.
+func (rec *Recorder) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/admin/recordings") || r.URL.Path == "/admin/tap" || (rec.opts.SampleRate < 1 && !sampled(rec.rand, rec.opts.SampleRate)) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		begin := rec.clock.Now()
+		var reqBody []byte
+		if r.Body != nil {
+			reqBody, _ = ioutil.ReadAll(r.Body)
+			r.Body.Close()
+			r.Body = ioutil.NopCloser(bytes.NewReader(reqBody))
+		}
+		cw := &capturingWriter{ResponseWriter: w, status: http.StatusOK, max: rec.opts.MaxBody}
+		next.ServeHTTP(cw, r)
+
+		recording := Recording{
+			Time:           begin,
+			Duration:       rec.clock.Now().Sub(begin).String(),
+			RequestID:      RequestID(r.Context()),
+			Method:         r.Method,
+			URL:            rec.sanitizeURL(r),
+			RequestHeader:  rec.sanitizeHeader(r.Header),
+			Status:         cw.status,
+			ResponseHeader: rec.sanitizeHeader(w.Header()),
+			Truncated:      cw.truncated || len(reqBody) > rec.opts.MaxBody,
+		}
+		if len(reqBody) > rec.opts.MaxBody {
+			reqBody = reqBody[:rec.opts.MaxBody]
+		}
+		recording.RequestBody = rec.sanitizeBody(reqBody)
+		recording.ResponseBody = rec.sanitizeBody(cw.body.Bytes())
+		rec.add(recording)
+	})
+}
+
+func (rec *Recorder) sanitizeURL(r *http.Request) string {
+	u := *r.URL
+	q := u.Query()
+	for _, p := range redactedParams {
+		if _, ok := q[p]; ok {
+			q.Set(p, RedactedValue)
+		}
+	}
+	u.RawQuery = q.Encode()
+	return u.RequestURI()
+}
+
+func (rec *Recorder) sanitizeHeader(h http.Header) Metadata {
+	m := make(Metadata, len(h))
+	for k, values := range h {
+		m[k] = strings.Join(values, ", ")
+	}
+	for _, k := range redactedHeaders {
+		if _, ok := m[http.CanonicalHeaderKey(k)]; ok {
+			m[http.CanonicalHeaderKey(k)] = RedactedValue
+		}
+	}
+	return m
+}
+
+// sanitizeBody redacts fields from a JSON or XML body. Truncated or otherwise
+// unparseable JSON is dropped entirely rather than risk leaking a field.
+func (rec *Recorder) sanitizeBody(body []byte) string {
+	body = bytes.TrimSpace(body)
+	if len(body) == 0 {
+		return ""
+	}
+	if body[0] == '<' {
+		for _, re := range rec.xmlRE {
+			body = re.ReplaceAll(body, []byte("${1}"+RedactedValue+"${2}"))
+		}
+		return string(body)
+	}
+	var v interface{}
+	if err := json.Unmarshal(body, &v); err != nil {
+		return RedactedValue
+	}
+	b, err := json.Marshal(rec.redact(v))
+	if err != nil {
+		return RedactedValue
+	}
+	return string(b)
+}
+
+func (rec *Recorder) redact(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, child := range v {
+			if rec.fields[k] {
+				v[k] = RedactedValue
+			} else {
+				v[k] = rec.redact(child)
+			}
+		}
+	case []interface{}:
+		for i, child := range v {
+			v[i] = rec.redact(child)
+		}
+	}
+	return v
+}
+
+// capturingWriter copies up to max bytes of the response body, and its
+// status.
+type capturingWriter struct {
+	http.ResponseWriter
+	status    int
+	max       int
+	body      bytes.Buffer
+	truncated bool
+}
+
+func (w *capturingWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *capturingWriter) Write(p []byte) (int, error) {
+	if room := w.max - w.body.Len(); room < len(p) {
+		w.body.Write(p[:room])
+		w.truncated = true
+	} else {
+		w.body.Write(p)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// WithRecorder records a sample of requests and their responses into rec,
+// and mounts endpoints to read them:
+//
+//	GET     /admin/recordings    list recordings, oldest first
+//	DELETE  /admin/recordings    drop every recording
+func WithRecorder(rec *Recorder) HandlerOption {
+	return func(c *handlerConfig) { c.recorder = rec }
+}
+
+func mountRecorder(r *mux.Router, rec *Recorder, wrap func(string, endpoint.Endpoint) endpoint.Endpoint, options []httptransport.ServerOption) {
+	r.Methods("GET").Path("/admin/recordings").Handler(httptransport.NewServer(
+		wrap("GetRecordings", makeGetRecordingsEndpoint(rec)),
+		func(context.Context, *http.Request) (interface{}, error) { return nil, nil },
+		encodeResponse,
+		options...,
+	))
+	r.Methods("DELETE").Path("/admin/recordings").Handler(httptransport.NewServer(
+		wrap("ResetRecordings", makeResetRecordingsEndpoint(rec)),
+		func(context.Context, *http.Request) (interface{}, error) { return nil, nil },
+		encodeResponse,
+		options...,
+	))
+}
+
+func makeGetRecordingsEndpoint(rec *Recorder) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		return getRecordingsResponse{Recordings: rec.Recordings()}, nil
+	}
+}
+
+func makeResetRecordingsEndpoint(rec *Recorder) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		rec.Reset()
+		return struct{}{}, nil
+	}
+}
+
+type getRecordingsResponse struct {
+	Recordings []Recording `json:"recordings" xml:"recordings>recording"`
+}
@@ -0,0 +1,217 @@
+package customersvc
+
+import (
+	"context"
+	"errors"
+	"runtime/debug"
+	"time"
+
+	"github.com/go-kit/kit/endpoint"
+	"github.com/go-kit/kit/metrics"
+)
+
+// ErrInternal is returned in place of a recovered panic. The panic value
+// itself is logged, never sent to the client.
+var ErrInternal = errors.New("internal server error")
+
+// RecoveryMiddleware converts a panic in any Service method into ErrInternal.
+// The panic value and stack trace are logged, and panics is incremented with
+// a method label.
+func RecoveryMiddleware(logger Logger, panics metrics.Counter) Middleware {
+	return func(next Service) Service {
+		return &recoveryMiddleware{
+			next: next,
+			r:    recoverer{logger: logger, panics: panics},
+		}
+	}
+}
+
+// EndpointRecoveryMiddleware is the endpoint flavor of RecoveryMiddleware. It
+// also catches panics in code between the transport and the service, such as
+// a bad type assertion on a request.
+func EndpointRecoveryMiddleware(method string, logger Logger, panics metrics.Counter) endpoint.Middleware {
+	r := recoverer{logger: logger, panics: panics}
+	return func(next endpoint.Endpoint) endpoint.Endpoint {
+		return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+			defer r.recover(method, &err)
+			return next(ctx, request)
+		}
+	}
+}
+
+type recoverer struct {
+	logger Logger
+	panics metrics.Counter
+}
+
+// recover must be deferred directly. It overwrites *err with ErrInternal if
+// the deferring function is panicking.
+func (r recoverer) recover(method string, err *error) {
+	v := recover()
+	if v == nil {
+		return
+	}
+	r.panics.With("method", method).Add(1)
+	r.logger.Log("method", method, "panic", v, "stack", string(debug.Stack()))
+	*err = ErrInternal
+}
+
+type recoveryMiddleware struct {
+	next Service
+	r    recoverer
+}
+
+func (mw recoveryMiddleware) PostCustomer(ctx context.Context, p Customer) (err error) {
+	defer mw.r.recover("PostCustomer", &err)
+	return mw.next.PostCustomer(ctx, p)
+}
+
+func (mw recoveryMiddleware) GetCustomer(ctx context.Context, id string) (p Customer, err error) {
+	defer mw.r.recover("GetCustomer", &err)
+	return mw.next.GetCustomer(ctx, id)
+}
+
+func (mw recoveryMiddleware) PutCustomer(ctx context.Context, id string, p Customer) (err error) {
+	defer mw.r.recover("PutCustomer", &err)
+	return mw.next.PutCustomer(ctx, id, p)
+}
+
+func (mw recoveryMiddleware) PatchCustomer(ctx context.Context, id string, p Customer) (err error) {
+	defer mw.r.recover("PatchCustomer", &err)
+	return mw.next.PatchCustomer(ctx, id, p)
+}
+
+func (mw recoveryMiddleware) DeleteCustomer(ctx context.Context, id string) (err error) {
+	defer mw.r.recover("DeleteCustomer", &err)
+	return mw.next.DeleteCustomer(ctx, id)
+}
+
+func (mw recoveryMiddleware) GetAddresses(ctx context.Context, customerID string) (addresses []Address, err error) {
+	defer mw.r.recover("GetAddresses", &err)
+	return mw.next.GetAddresses(ctx, customerID)
+}
+
+func (mw recoveryMiddleware) GetAddress(ctx context.Context, customerID string, addressID string) (a Address, err error) {
+	defer mw.r.recover("GetAddress", &err)
+	return mw.next.GetAddress(ctx, customerID, addressID)
+}
+
+func (mw recoveryMiddleware) PostAddress(ctx context.Context, customerID string, a Address) (created Address, err error) {
+	defer mw.r.recover("PostAddress", &err)
+	return mw.next.PostAddress(ctx, customerID, a)
+}
+
+func (mw recoveryMiddleware) DeleteAddress(ctx context.Context, customerID string, addressID string) (err error) {
+	defer mw.r.recover("DeleteAddress", &err)
+	return mw.next.DeleteAddress(ctx, customerID, addressID)
+}
+
+func (mw recoveryMiddleware) GetCustomersByRegion(ctx context.Context) (regions []RegionCount, err error) {
+	defer mw.r.recover("GetCustomersByRegion", &err)
+	return mw.next.GetCustomersByRegion(ctx)
+}
+
+func (mw recoveryMiddleware) PostAddresses(ctx context.Context, customerID string, as []Address) (results []AddressResult, err error) {
+	defer mw.r.recover("PostAddresses", &err)
+	return mw.next.PostAddresses(ctx, customerID, as)
+}
+
+func (mw recoveryMiddleware) ReorderAddresses(ctx context.Context, customerID string, addressIDs []string) (err error) {
+	defer mw.r.recover("ReorderAddresses", &err)
+	return mw.next.ReorderAddresses(ctx, customerID, addressIDs)
+}
+
+func (mw recoveryMiddleware) ValidateCustomer(ctx context.Context, p Customer) (errs []FieldError, err error) {
+	defer mw.r.recover("ValidateCustomer", &err)
+	return mw.next.ValidateCustomer(ctx, p)
+}
+
+func (mw recoveryMiddleware) ValidateAddress(ctx context.Context, customerID string, a Address) (errs []FieldError, err error) {
+	defer mw.r.recover("ValidateAddress", &err)
+	return mw.next.ValidateAddress(ctx, customerID, a)
+}
+
+func (mw recoveryMiddleware) ArchiveCustomer(ctx context.Context, id string) (err error) {
+	defer mw.r.recover("ArchiveCustomer", &err)
+	return mw.next.ArchiveCustomer(ctx, id)
+}
+
+func (mw recoveryMiddleware) UnarchiveCustomer(ctx context.Context, id string) (err error) {
+	defer mw.r.recover("UnarchiveCustomer", &err)
+	return mw.next.UnarchiveCustomer(ctx, id)
+}
+
+func (mw recoveryMiddleware) GetCustomers(ctx context.Context, f CustomerFilter) (customers []Customer, err error) {
+	defer mw.r.recover("GetCustomers", &err)
+	return mw.next.GetCustomers(ctx, f)
+}
+
+func (mw recoveryMiddleware) GetCustomerStats(ctx context.Context, id string) (stats CustomerStats, err error) {
+	defer mw.r.recover("GetCustomerStats", &err)
+	return mw.next.GetCustomerStats(ctx, id)
+}
+
+func (mw recoveryMiddleware) PrepareCustomer(ctx context.Context, p Customer, ttl time.Duration) (pending PendingCustomer, err error) {
+	defer mw.r.recover("PrepareCustomer", &err)
+	return mw.next.PrepareCustomer(ctx, p, ttl)
+}
+
+func (mw recoveryMiddleware) CommitCustomer(ctx context.Context, id string) (err error) {
+	defer mw.r.recover("CommitCustomer", &err)
+	return mw.next.CommitCustomer(ctx, id)
+}
+
+func (mw recoveryMiddleware) AbortCustomer(ctx context.Context, id string) (err error) {
+	defer mw.r.recover("AbortCustomer", &err)
+	return mw.next.AbortCustomer(ctx, id)
+}
+
+func (mw recoveryMiddleware) GetCustomerAsOf(ctx context.Context, id string, t time.Time) (p Customer, err error) {
+	defer mw.r.recover("GetCustomerAsOf", &err)
+	return mw.next.GetCustomerAsOf(ctx, id, t)
+}
+
+func (mw recoveryMiddleware) GetCustomerByExternalID(ctx context.Context, system string, externalID string) (p Customer, err error) {
+	defer mw.r.recover("GetCustomerByExternalID", &err)
+	return mw.next.GetCustomerByExternalID(ctx, system, externalID)
+}
+
+func (mw recoveryMiddleware) GrantConsent(ctx context.Context, customerID string, c Consent) (granted Consent, err error) {
+	defer mw.r.recover("GrantConsent", &err)
+	return mw.next.GrantConsent(ctx, customerID, c)
+}
+
+func (mw recoveryMiddleware) WithdrawConsent(ctx context.Context, customerID string, consentType string) (err error) {
+	defer mw.r.recover("WithdrawConsent", &err)
+	return mw.next.WithdrawConsent(ctx, customerID, consentType)
+}
+
+func (mw recoveryMiddleware) GetConsents(ctx context.Context, customerID string) (consents []Consent, err error) {
+	defer mw.r.recover("GetConsents", &err)
+	return mw.next.GetConsents(ctx, customerID)
+}
+
+func (mw recoveryMiddleware) GetDuplicateAddresses(ctx context.Context) (duplicates []DuplicateAddresses, err error) {
+	defer mw.r.recover("GetDuplicateAddresses", &err)
+	return mw.next.GetDuplicateAddresses(ctx)
+}
+
+func (mw recoveryMiddleware) RepairAddresses(ctx context.Context, dryRun bool) (repairs []AddressRepair, err error) {
+	defer mw.r.recover("RepairAddresses", &err)
+	return mw.next.RepairAddresses(ctx, dryRun)
+}
+
+func (mw recoveryMiddleware) RebuildIndex(ctx context.Context, index string) (r IndexRebuild, err error) {
+	defer mw.r.recover("RebuildIndex", &err)
+	return mw.next.RebuildIndex(ctx, index)
+}
+
+func (mw recoveryMiddleware) GetIndexRebuild(ctx context.Context, index string) (r IndexRebuild, err error) {
+	defer mw.r.recover("GetIndexRebuild", &err)
+	return mw.next.GetIndexRebuild(ctx, index)
+}
+
+func (mw recoveryMiddleware) CheckConsistency(ctx context.Context, repair bool) (r ConsistencyReport, err error) {
+	defer mw.r.recover("CheckConsistency", &err)
+	return mw.next.CheckConsistency(ctx, repair)
+}
@@ -0,0 +1,36 @@
+// Package redisnonce provides a customersvc.NonceStore backed by Redis, so
+// that replicas behind a load balancer reject each other's replays.
+package redisnonce
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-redis/redis"
+
+	"github.com/praveensastry/customersvc/pkg/customersvc"
+)
+
+// Store is a customersvc.NonceStore. Each used nonce is a Redis key that
+// expires along with the URL it came from.
+type Store struct {
+	client *redis.Client
+	prefix string
+}
+
+// New returns a Store keeping nonces in client, under keys starting with
+// prefix.
+func New(client *redis.Client, prefix string) *Store {
+	return &Store{client: client, prefix: prefix}
+}
+
+var _ customersvc.NonceStore = (*Store)(nil)
+
+// Use implements customersvc.NonceStore.
+func (s *Store) Use(ctx context.Context, nonce string, expires time.Time) (bool, error) {
+	ttl := time.Until(expires)
+	if ttl < time.Second {
+		ttl = time.Second // SET rejects a zero expiry, and the URL is about to expire anyway
+	}
+	return s.client.WithContext(ctx).SetNX(s.prefix+nonce, 1, ttl).Result()
+}
@@ -0,0 +1,59 @@
+package customersvc
+
+import (
+	"context"
+	"net/http"
+	"strings"
+)
+
+// RequestMetadata holds the key/values a request arrived with, independent of
+// the transport: HTTP headers, gRPC metadata or message headers. Keys are
+// lower case, as in gRPC metadata, so middlewares read auth, tenant, locale
+// and the like the same way whichever transport a request came through.
+type RequestMetadata map[string][]string
+
+// Well-known RequestMetadata keys.
+const (
+	MetadataAuthorization = "authorization"
+	MetadataTenant        = "x-tenant-id"
+	MetadataLocale        = "accept-language"
+	MetadataActor         = "x-actor"          // see ActorHeader
+	MetadataPurpose       = "x-access-purpose" // see PurposeHeader
+)
+
+// Get returns the first value for key, or "" if there is none.
+func (md RequestMetadata) Get(key string) string {
+	if values := md[strings.ToLower(key)]; len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+type requestMetadataKey struct{}
+
+// WithRequestMetadata returns a copy of ctx carrying md. Transports call it
+// once per request, before any endpoint runs.
+func WithRequestMetadata(ctx context.Context, md RequestMetadata) context.Context {
+	return context.WithValue(ctx, requestMetadataKey{}, md)
+}
+
+// RequestMetadataFrom returns the metadata of the request carrying ctx, which
+// is empty if ctx didn't come from a transport.
+func RequestMetadataFrom(ctx context.Context) RequestMetadata {
+	md, _ := ctx.Value(requestMetadataKey{}).(RequestMetadata)
+	return md
+}
+
+// populateRequestMetadata is a ServerBefore function making the request
+// headers available as RequestMetadata. Requests authorized by a signed URL
+// are made by its tenant, whatever their headers say.
+func populateRequestMetadata(ctx context.Context, r *http.Request) context.Context {
+	md := make(RequestMetadata, len(r.Header))
+	for k, values := range r.Header {
+		md[strings.ToLower(k)] = values
+	}
+	if tenant, ok := signedTenant(ctx); ok {
+		md[MetadataTenant] = []string{tenant}
+	}
+	return WithRequestMetadata(ctx, md)
+}
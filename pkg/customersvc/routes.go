@@ -0,0 +1,328 @@
+package customersvc
+
+import (
+	"github.com/go-kit/kit/endpoint"
+	httptransport "github.com/go-kit/kit/transport/http"
+	"github.com/gorilla/mux"
+)
+
+// RouteSpec describes a route MakeHTTPHandler mounts: the requests it
+// matches and the endpoint serving them.
+type RouteSpec struct {
+	// Name is the method name the endpoint middlewares, such as API keys'
+	// scopes, rate limits and metering, know the endpoint by. Names of
+	// built-in routes are those of the Service methods they call.
+	Name   string
+	Method string
+	// Path is a gorilla/mux path template, e.g. "/customers/{id}".
+	Path string
+	// Queries, if given, are pairs of query keys and value templates the
+	// request must carry, e.g. "as_of", "{as_of}".
+	Queries []string
+	// Matcher, if given, must match the request too.
+	Matcher mux.MatcherFunc
+
+	Endpoint endpoint.Endpoint
+	Decoder  httptransport.DecodeRequestFunc
+	// Encoder is nil to encode the response as the built-in routes do: as
+	// JSON, or XML or CSV if the request asks for it, and errors from
+	// responses implementing error() as problems.
+	Encoder httptransport.EncodeResponseFunc
+	// Options are appended to the server options MakeHTTPHandler gives every
+	// route.
+	Options []httptransport.ServerOption
+}
+
+// Routes returns the routes MakeHTTPHandler mounts for e, in the order they
+// are matched. Routes added by optional features, such as WithAPIKeys, aren't
+// listed.
+func Routes(e Endpoints) []RouteSpec {
+	return []RouteSpec{
+		{
+			Name:     "PostCustomer",
+			Method:   "POST",
+			Path:     "/customers/",
+			Endpoint: e.PostCustomerEndpoint,
+			Decoder:  decodePostCustomerRequest,
+		},
+		{
+			Name:     "GetCustomerAsOf",
+			Method:   "GET",
+			Path:     "/customers/{id}",
+			Queries:  []string{"as_of", "{as_of}"},
+			Endpoint: e.GetCustomerAsOfEndpoint,
+			Decoder:  decodeGetCustomerAsOfRequest,
+		},
+		{
+			Name:     "GetCustomerFull",
+			Method:   "GET",
+			Path:     "/customers/{id}",
+			Queries:  []string{"expand", "{expand}"},
+			Endpoint: e.GetCustomerFullEndpoint,
+			Decoder:  decodeGetCustomerFullRequest,
+		},
+		{
+			Name:     "GetCustomer",
+			Method:   "GET",
+			Path:     "/customers/{id}",
+			Endpoint: e.GetCustomerEndpoint,
+			Decoder:  decodeGetCustomerRequest,
+		},
+		{
+			Name:     "PutCustomer",
+			Method:   "PUT",
+			Path:     "/customers/{id}",
+			Endpoint: e.PutCustomerEndpoint,
+			Decoder:  decodePutCustomerRequest,
+		},
+		{
+			Name:     "PatchCustomer",
+			Method:   "PATCH",
+			Path:     "/customers/{id}",
+			Endpoint: e.PatchCustomerEndpoint,
+			Decoder:  decodePatchCustomerRequest,
+		},
+		{
+			Name:     "DeleteCustomer",
+			Method:   "DELETE",
+			Path:     "/customers/{id}",
+			Endpoint: e.DeleteCustomerEndpoint,
+			Decoder:  decodeDeleteCustomerRequest,
+		},
+		{
+			Name:     "GetAddressesPage",
+			Method:   "GET",
+			Path:     "/customers/{id}/addresses/",
+			Matcher:  paged,
+			Endpoint: e.GetAddressesPageEndpoint,
+			Decoder:  decodeGetAddressesPageRequest,
+		},
+		{
+			Name:     "GetAddresses",
+			Method:   "GET",
+			Path:     "/customers/{id}/addresses/",
+			Endpoint: e.GetAddressesEndpoint,
+			Decoder:  decodeGetAddressesRequest,
+		},
+		{
+			Name:     "GetAddress",
+			Method:   "GET",
+			Path:     "/customers/{id}/addresses/{addressID}",
+			Endpoint: e.GetAddressEndpoint,
+			Decoder:  decodeGetAddressRequest,
+		},
+		{
+			Name:     "PostAddress",
+			Method:   "POST",
+			Path:     "/customers/{id}/addresses/",
+			Endpoint: e.PostAddressEndpoint,
+			Decoder:  decodePostAddressRequest,
+		},
+		{
+			Name:     "DeleteAddress",
+			Method:   "DELETE",
+			Path:     "/customers/{id}/addresses/{addressID}",
+			Endpoint: e.DeleteAddressEndpoint,
+			Decoder:  decodeDeleteAddressRequest,
+		},
+		{
+			Name:     "PostAddresses",
+			Method:   "POST",
+			Path:     "/customers/{id}/addresses/batch",
+			Endpoint: e.PostAddressesEndpoint,
+			Decoder:  decodePostAddressesRequest,
+		},
+		{
+			Name:     "GetCustomersByRegion",
+			Method:   "GET",
+			Path:     "/reports/customers-by-region",
+			Endpoint: e.GetCustomersByRegionEndpoint,
+			Decoder:  decodeGetCustomersByRegionRequest,
+		},
+		{
+			Name:     "GetDuplicateAddresses",
+			Method:   "GET",
+			Path:     "/reports/duplicate-addresses",
+			Endpoint: e.GetDuplicateAddressesEndpoint,
+			Decoder:  decodeGetDuplicateAddressesRequest,
+		},
+		{
+			Name:     "RepairAddresses",
+			Method:   "POST",
+			Path:     "/admin/address-repairs",
+			Endpoint: e.RepairAddressesEndpoint,
+			Decoder:  decodeRepairAddressesRequest,
+		},
+		{
+			Name:     "RebuildIndex",
+			Method:   "POST",
+			Path:     "/admin/indexes/{index}/rebuild",
+			Endpoint: e.RebuildIndexEndpoint,
+			Decoder:  decodeRebuildIndexRequest,
+		},
+		{
+			Name:     "GetIndexRebuild",
+			Method:   "GET",
+			Path:     "/admin/indexes/{index}/rebuild",
+			Endpoint: e.GetIndexRebuildEndpoint,
+			Decoder:  decodeGetIndexRebuildRequest,
+		},
+		{
+			Name:     "CheckConsistency",
+			Method:   "POST",
+			Path:     "/admin/consistency-checks",
+			Endpoint: e.CheckConsistencyEndpoint,
+			Decoder:  decodeCheckConsistencyRequest,
+		},
+		{
+			Name:     "ReorderAddresses",
+			Method:   "PUT",
+			Path:     "/customers/{id}/addresses/order",
+			Endpoint: e.ReorderAddressesEndpoint,
+			Decoder:  decodeReorderAddressesRequest,
+		},
+		{
+			Name:     "ValidateCustomer",
+			Method:   "POST",
+			Path:     "/customers/validate",
+			Endpoint: e.ValidateCustomerEndpoint,
+			Decoder:  decodeValidateCustomerRequest,
+		},
+		{
+			Name:     "ValidateAddress",
+			Method:   "POST",
+			Path:     "/customers/{id}/addresses/validate",
+			Endpoint: e.ValidateAddressEndpoint,
+			Decoder:  decodeValidateAddressRequest,
+		},
+		{
+			Name:     "ArchiveCustomer",
+			Method:   "POST",
+			Path:     "/customers/{id}/archive",
+			Endpoint: e.ArchiveCustomerEndpoint,
+			Decoder:  decodeArchiveCustomerRequest,
+		},
+		{
+			Name:     "UnarchiveCustomer",
+			Method:   "POST",
+			Path:     "/customers/{id}/unarchive",
+			Endpoint: e.UnarchiveCustomerEndpoint,
+			Decoder:  decodeUnarchiveCustomerRequest,
+		},
+		{
+			Name:     "GetCustomersPage",
+			Method:   "GET",
+			Path:     "/customers/",
+			Matcher:  paged,
+			Endpoint: e.GetCustomersPageEndpoint,
+			Decoder:  decodeGetCustomersPageRequest,
+		},
+		{
+			Name:     "GetCustomers",
+			Method:   "GET",
+			Path:     "/customers/",
+			Endpoint: e.GetCustomersEndpoint,
+			Decoder:  decodeGetCustomersRequest,
+		},
+		{
+			Name:     "GetCustomerStats",
+			Method:   "GET",
+			Path:     "/customers/{id}/stats",
+			Endpoint: e.GetCustomerStatsEndpoint,
+			Decoder:  decodeGetCustomerStatsRequest,
+		},
+		{
+			Name:     "PrepareCustomer",
+			Method:   "POST",
+			Path:     "/customers:prepare",
+			Endpoint: e.PrepareCustomerEndpoint,
+			Decoder:  decodePrepareCustomerRequest,
+		},
+		{
+			Name:     "CommitCustomer",
+			Method:   "POST",
+			Path:     "/customers/{id:[^/:]+}:commit",
+			Endpoint: e.CommitCustomerEndpoint,
+			Decoder:  decodeCommitCustomerRequest,
+		},
+		{
+			Name:     "AbortCustomer",
+			Method:   "POST",
+			Path:     "/customers/{id:[^/:]+}:abort",
+			Endpoint: e.AbortCustomerEndpoint,
+			Decoder:  decodeAbortCustomerRequest,
+		},
+		{
+			Name:     "GetCustomerByExternalID",
+			Method:   "GET",
+			Path:     "/customers/by-external-id/{system}/{id}",
+			Endpoint: e.GetCustomerByExternalIDEndpoint,
+			Decoder:  decodeGetCustomerByExternalIDRequest,
+		},
+		{
+			Name:     "GetConsents",
+			Method:   "GET",
+			Path:     "/customers/{id}/consents/",
+			Endpoint: e.GetConsentsEndpoint,
+			Decoder:  decodeGetConsentsRequest,
+		},
+		{
+			Name:     "GrantConsent",
+			Method:   "POST",
+			Path:     "/customers/{id}/consents/",
+			Endpoint: e.GrantConsentEndpoint,
+			Decoder:  decodeGrantConsentRequest,
+		},
+		{
+			Name:     "WithdrawConsent",
+			Method:   "DELETE",
+			Path:     "/customers/{id}/consents/{type}",
+			Endpoint: e.WithdrawConsentEndpoint,
+			Decoder:  decodeWithdrawConsentRequest,
+		},
+	}
+}
+
+// WithRoutes mounts more routes, e.g. one for a custom action on
+// /customers/{id}/custom-action. Their endpoints are wrapped in the same
+// middlewares as the built-in ones, under their Name; names without a scope
+// of their own need a write-scoped API key. They're matched before the
+// built-in routes, so one may also take over a built-in route's requests.
+func WithRoutes(routes ...RouteSpec) HandlerOption {
+	return func(c *handlerConfig) { c.routes = append(c.routes, routes...) }
+}
+
+// WithoutRoutes drops the built-in routes with the given names, as listed
+// by Routes, e.g. "DeleteCustomer" for a server that mustn't delete, so
+// that they aren't served at all.
+func WithoutRoutes(names ...string) HandlerOption {
+	return func(c *handlerConfig) {
+		if c.withoutRoutes == nil {
+			c.withoutRoutes = map[string]bool{}
+		}
+		for _, name := range names {
+			c.withoutRoutes[name] = true
+		}
+	}
+}
+
+// mountRoute mounts rt on r, served with options and rt's own.
+func mountRoute(r *mux.Router, rt RouteSpec, options []httptransport.ServerOption) {
+	route := r.Methods(rt.Method).Path(rt.Path)
+	if len(rt.Queries) > 0 {
+		route = route.Queries(rt.Queries...)
+	}
+	if rt.Matcher != nil {
+		route = route.MatcherFunc(rt.Matcher)
+	}
+	encoder := rt.Encoder
+	if encoder == nil {
+		encoder = encodeResponse
+	}
+	route.Handler(httptransport.NewServer(
+		rt.Endpoint,
+		rt.Decoder,
+		encoder,
+		append(options[:len(options):len(options)], rt.Options...)...,
+	))
+}
@@ -0,0 +1,469 @@
+package customersvc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// ErrInvalidRoutingTable is returned for a routing table without a default
+// backend, listing two backends with the same DSN, or routing a tenant to a
+// backend it doesn't list.
+var ErrInvalidRoutingTable = errors.New("routing table must name a default backend, give each backend a DSN of its own, and route tenants to the backends it lists")
+
+// RoutingTable says which storage backend serves each tenant, e.g. so that
+// big tenants get a store of their own. In JSON:
+//
+//	{
+//	  "backends": {"shared": "journal:/var/lib/customersvc/shared", "acme": "journal:/var/lib/customersvc/acme"},
+//	  "tenants": {"acme": "acme"},
+//	  "default": "shared"
+//	}
+type RoutingTable struct {
+	// Backends are the DSNs of the backends, by name, as their
+	// BackendOpener reads them. No two backends may share a DSN, which
+	// would have one store opened twice.
+	Backends map[string]string `json:"backends"`
+	// Tenants are the names of the backends serving tenants, by tenant.
+	Tenants map[string]string `json:"tenants,omitempty"`
+	// Default is the name of the backend serving the tenants not in
+	// Tenants, DefaultTenant among them.
+	Default string `json:"default"`
+}
+
+func (t RoutingTable) validate() error {
+	if _, ok := t.Backends[t.Default]; !ok {
+		return ErrInvalidRoutingTable
+	}
+	dsns := make(map[string]bool, len(t.Backends))
+	for _, dsn := range t.Backends {
+		if dsns[dsn] {
+			return ErrInvalidRoutingTable
+		}
+		dsns[dsn] = true
+	}
+	for _, name := range t.Tenants {
+		if _, ok := t.Backends[name]; !ok {
+			return ErrInvalidRoutingTable
+		}
+	}
+	return nil
+}
+
+// LoadRoutingTable reads a RoutingTable from the JSON file at path.
+func LoadRoutingTable(path string) (RoutingTable, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return RoutingTable{}, err
+	}
+	var t RoutingTable
+	if err := json.Unmarshal(buf, &t); err != nil {
+		return RoutingTable{}, err
+	}
+	return t, t.validate()
+}
+
+// BackendOpener opens the store a DSN names. close, if not nil, is called
+// once the store is no longer routed to and its calls have returned.
+type BackendOpener func(dsn string) (s Service, close func() error, err error)
+
+// InmemBackends returns a BackendOpener of in-memory stores with options,
+// which are durable if journaled. Its DSNs are "memory", or "journal:" and
+// the directory of the store's snapshot and write-ahead log, as for
+// OpenJournal.
+func InmemBackends(journal JournalOptions, logger Logger, options ...Option) BackendOpener {
+	return func(dsn string) (Service, func() error, error) {
+		switch {
+		case dsn == "memory":
+			return NewInmemService(options...), nil, nil
+		case strings.HasPrefix(dsn, "journal:"):
+			dir := strings.TrimPrefix(dsn, "journal:")
+			j, err := OpenJournal(dir, journal, logger)
+			if err != nil {
+				return nil, nil, err
+			}
+			return NewInmemService(append(options[:len(options):len(options)], WithJournal(j))...), j.Close, nil
+		}
+		return nil, nil, fmt.Errorf("unknown backend DSN %q: want memory or journal:/path", dsn)
+	}
+}
+
+// RoutingService is a Service storing each tenant's customers in the
+// backend its RoutingTable routes it to, by the tenant of each call's
+// context, see TenantFrom. It's transparent to endpoints and transports:
+// every call about a customer goes to one backend, so customer IDs need
+// only be unique within one. Reports, repairs and index rebuilds only cover
+// the calling tenant's backend.
+//
+// Backends only keep tenants apart if callers can't choose their tenant:
+// serve it behind API keys bound to tenants, see APIKey.Tenant. Tenants
+// sharing a backend, such as those left on the default, share its
+// customers.
+//
+// The table may be replaced while serving with Reload. Moving a tenant to
+// another backend doesn't move its customers: migrate them first, e.g. with
+// a MigrationService and Backfill.
+type RoutingService struct {
+	open BackendOpener
+
+	reloading sync.Mutex // serializes Reload
+	mtx       sync.RWMutex
+	table     RoutingTable
+	backends  map[string]*routedBackend // by name
+}
+
+type routedBackend struct {
+	Service
+	dsn      string
+	close    func() error
+	inflight sync.WaitGroup
+}
+
+// NewRoutingService returns a RoutingService routing by table, opening
+// every backend it lists with open.
+func NewRoutingService(table RoutingTable, open BackendOpener) (*RoutingService, error) {
+	r := &RoutingService{open: open, backends: map[string]*routedBackend{}}
+	if err := r.Reload(table); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Table returns the routing table in use.
+func (r *RoutingService) Table() RoutingTable {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	return r.table
+}
+
+// Reload routes by table from now on. Backends are told apart by DSN, not
+// name, so that renaming one keeps it open. Backends with DSNs it adds are
+// opened first: if any fails, the table in use is kept. Backends with DSNs
+// it drops are closed once the calls they're serving return.
+func (r *RoutingService) Reload(table RoutingTable) error {
+	if err := table.validate(); err != nil {
+		return err
+	}
+	r.reloading.Lock()
+	defer r.reloading.Unlock()
+	r.mtx.RLock()
+	current := make(map[string]*routedBackend, len(r.backends)) // by DSN
+	for _, b := range r.backends {
+		current[b.dsn] = b
+	}
+	r.mtx.RUnlock()
+
+	backends := make(map[string]*routedBackend, len(table.Backends))
+	var opened []*routedBackend
+	for name, dsn := range table.Backends {
+		if b, ok := current[dsn]; ok {
+			backends[name] = b
+			continue
+		}
+		s, closeFn, err := r.open(dsn)
+		if err != nil {
+			for _, b := range opened {
+				b.release()
+			}
+			return fmt.Errorf("backend %s: %v", name, err)
+		}
+		b := &routedBackend{Service: s, dsn: dsn, close: closeFn}
+		backends[name], opened = b, append(opened, b)
+	}
+
+	r.mtx.Lock()
+	r.table, r.backends = table, backends
+	r.mtx.Unlock()
+	kept := make(map[string]bool, len(table.Backends))
+	for _, dsn := range table.Backends {
+		kept[dsn] = true
+	}
+	for dsn, b := range current {
+		if !kept[dsn] {
+			go b.release()
+		}
+	}
+	return nil
+}
+
+// Close closes every backend, once the calls they're serving return. It
+// mustn't be called before the last call is made.
+func (r *RoutingService) Close() error {
+	r.mtx.RLock()
+	backends := r.backends
+	r.mtx.RUnlock()
+	var first error
+	for _, b := range backends {
+		if err := b.release(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// release closes b once its calls have returned.
+func (b *routedBackend) release() error {
+	b.inflight.Wait()
+	if b.close == nil {
+		return nil
+	}
+	return b.close()
+}
+
+// backend returns the backend of the tenant calling with ctx. The caller
+// must call its inflight.Done once the call returns.
+func (r *RoutingService) backend(ctx context.Context) *routedBackend {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	name, ok := r.table.Tenants[TenantFrom(ctx)]
+	if !ok {
+		name = r.table.Default
+	}
+	b := r.backends[name]
+	b.inflight.Add(1)
+	return b
+}
+
+// WatchRoutingTable reloads r from the file at path on SIGHUP and, if
+// interval isn't zero, whenever the file's modification time changes,
+// checking that often, until done is closed. A table that fails to load or
+// open is logged, and the one in use kept.
+func WatchRoutingTable(r *RoutingService, path string, interval time.Duration, logger Logger, done <-chan struct{}) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	defer signal.Stop(c)
+	var tick <-chan time.Time
+	if interval > 0 {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		tick = t.C
+	}
+	var modTime time.Time
+	if fi, err := os.Stat(path); err == nil {
+		modTime = fi.ModTime()
+	}
+	reload := func(trigger string) {
+		table, err := LoadRoutingTable(path)
+		if err == nil {
+			err = r.Reload(table)
+		}
+		logger.Log("routing", "reload", "trigger", trigger, "backends", len(table.Backends), "tenants", len(table.Tenants), "err", err)
+	}
+	for {
+		select {
+		case <-c:
+			reload("SIGHUP")
+		case <-tick:
+			fi, err := os.Stat(path)
+			if err != nil || fi.ModTime().Equal(modTime) {
+				continue
+			}
+			modTime = fi.ModTime()
+			reload("file")
+		case <-done:
+			return
+		}
+	}
+}
+
+func (r *RoutingService) PostCustomer(ctx context.Context, p Customer) error {
+	b := r.backend(ctx)
+	defer b.inflight.Done()
+	return b.PostCustomer(ctx, p)
+}
+
+func (r *RoutingService) GetCustomer(ctx context.Context, id string) (Customer, error) {
+	b := r.backend(ctx)
+	defer b.inflight.Done()
+	return b.GetCustomer(ctx, id)
+}
+
+func (r *RoutingService) PutCustomer(ctx context.Context, id string, p Customer) error {
+	b := r.backend(ctx)
+	defer b.inflight.Done()
+	return b.PutCustomer(ctx, id, p)
+}
+
+func (r *RoutingService) PatchCustomer(ctx context.Context, id string, p Customer) error {
+	b := r.backend(ctx)
+	defer b.inflight.Done()
+	return b.PatchCustomer(ctx, id, p)
+}
+
+func (r *RoutingService) DeleteCustomer(ctx context.Context, id string) error {
+	b := r.backend(ctx)
+	defer b.inflight.Done()
+	return b.DeleteCustomer(ctx, id)
+}
+
+func (r *RoutingService) GetAddresses(ctx context.Context, customerID string) ([]Address, error) {
+	b := r.backend(ctx)
+	defer b.inflight.Done()
+	return b.GetAddresses(ctx, customerID)
+}
+
+func (r *RoutingService) GetAddress(ctx context.Context, customerID string, addressID string) (Address, error) {
+	b := r.backend(ctx)
+	defer b.inflight.Done()
+	return b.GetAddress(ctx, customerID, addressID)
+}
+
+func (r *RoutingService) PostAddress(ctx context.Context, customerID string, a Address) (Address, error) {
+	b := r.backend(ctx)
+	defer b.inflight.Done()
+	return b.PostAddress(ctx, customerID, a)
+}
+
+func (r *RoutingService) DeleteAddress(ctx context.Context, customerID string, addressID string) error {
+	b := r.backend(ctx)
+	defer b.inflight.Done()
+	return b.DeleteAddress(ctx, customerID, addressID)
+}
+
+func (r *RoutingService) GetCustomersByRegion(ctx context.Context) ([]RegionCount, error) {
+	b := r.backend(ctx)
+	defer b.inflight.Done()
+	return b.GetCustomersByRegion(ctx)
+}
+
+func (r *RoutingService) PostAddresses(ctx context.Context, customerID string, as []Address) ([]AddressResult, error) {
+	b := r.backend(ctx)
+	defer b.inflight.Done()
+	return b.PostAddresses(ctx, customerID, as)
+}
+
+func (r *RoutingService) ReorderAddresses(ctx context.Context, customerID string, addressIDs []string) error {
+	b := r.backend(ctx)
+	defer b.inflight.Done()
+	return b.ReorderAddresses(ctx, customerID, addressIDs)
+}
+
+func (r *RoutingService) ValidateCustomer(ctx context.Context, p Customer) ([]FieldError, error) {
+	b := r.backend(ctx)
+	defer b.inflight.Done()
+	return b.ValidateCustomer(ctx, p)
+}
+
+func (r *RoutingService) ValidateAddress(ctx context.Context, customerID string, a Address) ([]FieldError, error) {
+	b := r.backend(ctx)
+	defer b.inflight.Done()
+	return b.ValidateAddress(ctx, customerID, a)
+}
+
+func (r *RoutingService) ArchiveCustomer(ctx context.Context, id string) error {
+	b := r.backend(ctx)
+	defer b.inflight.Done()
+	return b.ArchiveCustomer(ctx, id)
+}
+
+func (r *RoutingService) UnarchiveCustomer(ctx context.Context, id string) error {
+	b := r.backend(ctx)
+	defer b.inflight.Done()
+	return b.UnarchiveCustomer(ctx, id)
+}
+
+func (r *RoutingService) GetCustomers(ctx context.Context, f CustomerFilter) ([]Customer, error) {
+	b := r.backend(ctx)
+	defer b.inflight.Done()
+	return b.GetCustomers(ctx, f)
+}
+
+// QueryCustomers implements QueryableService, pushing the query down to
+// the tenant's backend.
+func (r *RoutingService) QueryCustomers(ctx context.Context, q CustomerQuery) (CustomerPage, error) {
+	b := r.backend(ctx)
+	defer b.inflight.Done()
+	return QueryCustomers(ctx, b.Service, q)
+}
+
+func (r *RoutingService) GetCustomerStats(ctx context.Context, id string) (CustomerStats, error) {
+	b := r.backend(ctx)
+	defer b.inflight.Done()
+	return b.GetCustomerStats(ctx, id)
+}
+
+func (r *RoutingService) PrepareCustomer(ctx context.Context, p Customer, ttl time.Duration) (PendingCustomer, error) {
+	b := r.backend(ctx)
+	defer b.inflight.Done()
+	return b.PrepareCustomer(ctx, p, ttl)
+}
+
+func (r *RoutingService) CommitCustomer(ctx context.Context, id string) error {
+	b := r.backend(ctx)
+	defer b.inflight.Done()
+	return b.CommitCustomer(ctx, id)
+}
+
+func (r *RoutingService) AbortCustomer(ctx context.Context, id string) error {
+	b := r.backend(ctx)
+	defer b.inflight.Done()
+	return b.AbortCustomer(ctx, id)
+}
+
+func (r *RoutingService) GetCustomerAsOf(ctx context.Context, id string, t time.Time) (Customer, error) {
+	b := r.backend(ctx)
+	defer b.inflight.Done()
+	return b.GetCustomerAsOf(ctx, id, t)
+}
+
+func (r *RoutingService) GetCustomerByExternalID(ctx context.Context, system string, externalID string) (Customer, error) {
+	b := r.backend(ctx)
+	defer b.inflight.Done()
+	return b.GetCustomerByExternalID(ctx, system, externalID)
+}
+
+func (r *RoutingService) GrantConsent(ctx context.Context, customerID string, c Consent) (Consent, error) {
+	b := r.backend(ctx)
+	defer b.inflight.Done()
+	return b.GrantConsent(ctx, customerID, c)
+}
+
+func (r *RoutingService) WithdrawConsent(ctx context.Context, customerID string, consentType string) error {
+	b := r.backend(ctx)
+	defer b.inflight.Done()
+	return b.WithdrawConsent(ctx, customerID, consentType)
+}
+
+func (r *RoutingService) GetConsents(ctx context.Context, customerID string) ([]Consent, error) {
+	b := r.backend(ctx)
+	defer b.inflight.Done()
+	return b.GetConsents(ctx, customerID)
+}
+
+func (r *RoutingService) GetDuplicateAddresses(ctx context.Context) ([]DuplicateAddresses, error) {
+	b := r.backend(ctx)
+	defer b.inflight.Done()
+	return b.GetDuplicateAddresses(ctx)
+}
+
+func (r *RoutingService) RepairAddresses(ctx context.Context, dryRun bool) ([]AddressRepair, error) {
+	b := r.backend(ctx)
+	defer b.inflight.Done()
+	return b.RepairAddresses(ctx, dryRun)
+}
+
+func (r *RoutingService) RebuildIndex(ctx context.Context, index string) (IndexRebuild, error) {
+	b := r.backend(ctx)
+	defer b.inflight.Done()
+	return b.RebuildIndex(ctx, index)
+}
+
+func (r *RoutingService) GetIndexRebuild(ctx context.Context, index string) (IndexRebuild, error) {
+	b := r.backend(ctx)
+	defer b.inflight.Done()
+	return b.GetIndexRebuild(ctx, index)
+}
+
+func (r *RoutingService) CheckConsistency(ctx context.Context, repair bool) (ConsistencyReport, error) {
+	b := r.backend(ctx)
+	defer b.inflight.Done()
+	return b.CheckConsistency(ctx, repair)
+}
@@ -0,0 +1,195 @@
+package customersvc
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strings"
+
+	"github.com/go-kit/kit/endpoint"
+	httptransport "github.com/go-kit/kit/transport/http"
+	"github.com/gorilla/mux"
+
+	"github.com/praveensastry/customersvc/pkg/config"
+)
+
+// MaxGenerated is the most customers fixtures may have generated.
+const MaxGenerated = 10000
+
+// FixturesError is returned by ParseFixtures for fixtures that can't be
+// parsed, or ask for too many customers to be generated. It's served as 400.
+type FixturesError struct {
+	Reason string
+}
+
+func (e FixturesError) Error() string { return "invalid fixtures: " + e.Reason }
+
+// StatusCode implements the Go kit httptransport StatusCoder interface.
+func (e FixturesError) StatusCode() int { return http.StatusBadRequest }
+
+// Fixtures are test data to seed a store with, for demo environments and
+// end-to-end tests. In JSON, or YAML, they're:
+//
+//	seed: 42        # of the generator, so that generated customers are the same every time
+//	generate: 100   # customers to generate, seed-0001 to seed-0100
+//	customers:      # given in full, in the version 1 format
+//	  - id: alice
+//	    name: Alice Example
+//	    email: alice@example.com
+//	    addresses:
+//	      - id: home
+//	        location: 1 Main St, Springfield
+//	        country: US
+//	        state: IL
+type Fixtures struct {
+	Seed      int64      `json:"seed"`
+	Generate  int        `json:"generate"`
+	Customers []Customer `json:"customers"`
+}
+
+// ParseFixtures parses fixtures written in JSON, or in YAML, of the subset
+// config.ParseYAML reads.
+func ParseFixtures(data []byte) (Fixtures, error) {
+	data = bytes.TrimSpace(data)
+	if !bytes.HasPrefix(data, []byte("{")) {
+		tree, err := config.ParseYAML(data)
+		if err != nil {
+			return Fixtures{}, FixturesError{Reason: err.Error()}
+		}
+		if data, err = json.Marshal(tree); err != nil {
+			return Fixtures{}, err
+		}
+	}
+	var f Fixtures
+	if err := json.Unmarshal(data, &f); err != nil {
+		return Fixtures{}, FixturesError{Reason: err.Error()}
+	}
+	if f.Generate < 0 || f.Generate > MaxGenerated {
+		return Fixtures{}, FixturesError{Reason: fmt.Sprintf("generate must be between 0 and %d", MaxGenerated)}
+	}
+	return f, nil
+}
+
+// Seed PUTs the customers of f into dst, then those it generates, so that
+// seeding again resets them rather than adding more. Generated customers
+// depend only on f.Seed and their number: seed-0001 is the same customer in
+// every environment seeded alike. Rejected customers are reported as
+// failures without stopping it.
+func Seed(ctx context.Context, dst Service, f Fixtures, opts BulkOptions, logger Logger) (BulkReport, error) {
+	opts = opts.withDefaults()
+	customers := append(append([]Customer(nil), f.Customers...), generateCustomers(f.Seed, f.Generate)...)
+	items := make(chan bulkItem)
+	go func() {
+		defer close(items)
+		for i, p := range customers {
+			p := p
+			select {
+			case items <- bulkItem{index: i, id: p.ID, apply: func(ctx context.Context) error {
+				return dst.PutCustomer(ctx, p.ID, p)
+			}}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	report := runBulk(ctx, opts, items)
+	logger.Log("seed", "done", "succeeded", report.Succeeded, "failed", report.Failed)
+	return report, ctx.Err()
+}
+
+// Made-up data generated customers are drawn from. Emails are at
+// example.com and phone numbers in the 555-01xx range, which are reserved
+// for fiction.
+var (
+	seedGivenNames  = []string{"Ada", "Ben", "Chloe", "Dev", "Elena", "Farah", "Gus", "Hana", "Ivan", "Jo", "Kofi", "Lena", "Mateo", "Nia", "Omar", "Priya", "Quinn", "Rosa", "Sam", "Tariq", "Uma", "Victor", "Wen", "Yusuf", "Zoe"}
+	seedFamilyNames = []string{"Abbott", "Baker", "Costa", "Diaz", "Evans", "Fischer", "Garcia", "Hughes", "Ito", "Jensen", "Khan", "Lopez", "Moreau", "Novak", "Okafor", "Patel", "Rossi", "Silva", "Tanaka", "Weber"}
+	seedStreets     = []string{"Main St", "Oak Ave", "Maple Dr", "Cedar Ln", "Park Rd", "Elm St", "Lake View", "Hill St", "River Rd", "Station Sq"}
+	seedCities      = []struct{ city, state string }{
+		{"Springfield", "IL"}, {"Portland", "OR"}, {"Austin", "TX"}, {"Denver", "CO"}, {"Madison", "WI"},
+		{"Burlington", "VT"}, {"Asheville", "NC"}, {"Boise", "ID"}, {"Tucson", "AZ"}, {"Albany", "NY"},
+	}
+)
+
+// generateCustomers returns n customers made up from seed, numbered from 1.
+func generateCustomers(seed int64, n int) []Customer {
+	r := rand.New(rand.NewSource(seed))
+	customers := make([]Customer, n)
+	for i := range customers {
+		id := fmt.Sprintf("seed-%04d", i+1)
+		given := seedGivenNames[r.Intn(len(seedGivenNames))]
+		family := seedFamilyNames[r.Intn(len(seedFamilyNames))]
+		p := Customer{
+			ID:         id,
+			Name:       DisplayName(given, family, "en-US"),
+			GivenName:  given,
+			FamilyName: family,
+			Locale:     "en-US",
+			Email:      fmt.Sprintf("%s.%s.%d@example.com", strings.ToLower(given), strings.ToLower(family), i+1),
+			Phone:      fmt.Sprintf("+1%03d55501%02d", 200+r.Intn(800), r.Intn(100)),
+			Metadata:   Metadata{"seeded": "true"},
+		}
+		for k := r.Intn(3); k >= 0; k-- {
+			place := seedCities[r.Intn(len(seedCities))]
+			p.Addresses = append(p.Addresses, Address{
+				ID:       fmt.Sprintf("%s-%d", id, len(p.Addresses)+1),
+				Location: fmt.Sprintf("%d %s, %s", 1+r.Intn(999), seedStreets[r.Intn(len(seedStreets))], place.city),
+				Country:  "US",
+				State:    place.state,
+			})
+		}
+		customers[i] = p
+	}
+	return customers
+}
+
+// WithSeeding mounts, for development and test environments only, as it
+// overwrites customers at will:
+//
+//	POST    /admin/seed    load the Fixtures in the body, JSON or YAML, see Seed
+func WithSeeding() HandlerOption {
+	return func(c *handlerConfig) { c.seeding = true }
+}
+
+func mountSeeding(r *mux.Router, s Service, logger Logger, wrap func(string, endpoint.Endpoint) endpoint.Endpoint, options []httptransport.ServerOption) {
+	r.Methods("POST").Path("/admin/seed").Handler(httptransport.NewServer(
+		wrap("Seed", makeSeedEndpoint(s, logger)),
+		decodeSeedRequest,
+		encodeResponse,
+		options...,
+	))
+}
+
+func makeSeedEndpoint(s Service, logger Logger) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(seedRequest)
+		report, e := Seed(ctx, s, req.Fixtures, BulkOptions{}, logger)
+		return seedResponse{Report: report, Err: e}, nil
+	}
+}
+
+type seedRequest struct {
+	Fixtures Fixtures
+}
+
+type seedResponse struct {
+	Report BulkReport `json:"report" xml:"report"`
+	Err    error      `json:"err,omitempty" xml:"-"`
+}
+
+func (r seedResponse) error() error { return r.Err }
+
+func decodeSeedRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	f, err := ParseFixtures(body)
+	if err != nil {
+		return nil, err
+	}
+	return seedRequest{Fixtures: f}, nil
+}
@@ -0,0 +1,265 @@
+package customersvc
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// ErrNotSelf is returned when a customer acting on their own behalf, see
+// SelfAccessMiddleware, asks for another customer's data, or for anything
+// but their own record and addresses.
+var ErrNotSelf = errors.New("customers may only access their own record")
+
+// SelfAccessMiddleware restricts what a customer acting on their own behalf,
+// as a request carrying a portal token does (see PortalAccess), may do with
+// the Service: read, update and validate their own record and addresses.
+// Every other call they make fails with ErrNotSelf, including calls about
+// their own record outside that set, such as DeleteCustomer. Calls made by
+// operators, with an API key or from within the process, are untouched.
+//
+// PortalTokenMiddleware already keeps portal tokens to their customer at
+// the transport. This holds whatever transport or endpoint a call comes
+// through, so that new endpoints don't need to think about customers.
+func SelfAccessMiddleware() Middleware {
+	return func(next Service) Service {
+		return selfAccessMiddleware{next: next}
+	}
+}
+
+type selfAccessMiddleware struct {
+	next Service
+}
+
+// self fails unless ctx is an operator's or that of the customer id.
+func (mw selfAccessMiddleware) self(ctx context.Context, id string) error {
+	if self, ok := PortalAccess(ctx); ok && self != id {
+		return ErrNotSelf
+	}
+	return nil
+}
+
+// operator fails if ctx is a customer's.
+func (mw selfAccessMiddleware) operator(ctx context.Context) error {
+	if _, ok := PortalAccess(ctx); ok {
+		return ErrNotSelf
+	}
+	return nil
+}
+
+func (mw selfAccessMiddleware) PostCustomer(ctx context.Context, p Customer) error {
+	if err := mw.operator(ctx); err != nil {
+		return err
+	}
+	return mw.next.PostCustomer(ctx, p)
+}
+
+func (mw selfAccessMiddleware) GetCustomer(ctx context.Context, id string) (Customer, error) {
+	if err := mw.self(ctx, id); err != nil {
+		return Customer{}, err
+	}
+	return mw.next.GetCustomer(ctx, id)
+}
+
+func (mw selfAccessMiddleware) PutCustomer(ctx context.Context, id string, p Customer) error {
+	if err := mw.self(ctx, id); err != nil {
+		return err
+	}
+	return mw.next.PutCustomer(ctx, id, p)
+}
+
+func (mw selfAccessMiddleware) PatchCustomer(ctx context.Context, id string, p Customer) error {
+	if err := mw.self(ctx, id); err != nil {
+		return err
+	}
+	return mw.next.PatchCustomer(ctx, id, p)
+}
+
+func (mw selfAccessMiddleware) DeleteCustomer(ctx context.Context, id string) error {
+	if err := mw.operator(ctx); err != nil {
+		return err
+	}
+	return mw.next.DeleteCustomer(ctx, id)
+}
+
+func (mw selfAccessMiddleware) GetAddresses(ctx context.Context, customerID string) ([]Address, error) {
+	if err := mw.self(ctx, customerID); err != nil {
+		return nil, err
+	}
+	return mw.next.GetAddresses(ctx, customerID)
+}
+
+func (mw selfAccessMiddleware) GetAddress(ctx context.Context, customerID string, addressID string) (Address, error) {
+	if err := mw.self(ctx, customerID); err != nil {
+		return Address{}, err
+	}
+	return mw.next.GetAddress(ctx, customerID, addressID)
+}
+
+func (mw selfAccessMiddleware) PostAddress(ctx context.Context, customerID string, a Address) (Address, error) {
+	if err := mw.self(ctx, customerID); err != nil {
+		return Address{}, err
+	}
+	return mw.next.PostAddress(ctx, customerID, a)
+}
+
+func (mw selfAccessMiddleware) DeleteAddress(ctx context.Context, customerID string, addressID string) error {
+	if err := mw.self(ctx, customerID); err != nil {
+		return err
+	}
+	return mw.next.DeleteAddress(ctx, customerID, addressID)
+}
+
+func (mw selfAccessMiddleware) GetCustomersByRegion(ctx context.Context) ([]RegionCount, error) {
+	if err := mw.operator(ctx); err != nil {
+		return nil, err
+	}
+	return mw.next.GetCustomersByRegion(ctx)
+}
+
+func (mw selfAccessMiddleware) PostAddresses(ctx context.Context, customerID string, as []Address) ([]AddressResult, error) {
+	if err := mw.self(ctx, customerID); err != nil {
+		return nil, err
+	}
+	return mw.next.PostAddresses(ctx, customerID, as)
+}
+
+func (mw selfAccessMiddleware) ReorderAddresses(ctx context.Context, customerID string, addressIDs []string) error {
+	if err := mw.self(ctx, customerID); err != nil {
+		return err
+	}
+	return mw.next.ReorderAddresses(ctx, customerID, addressIDs)
+}
+
+func (mw selfAccessMiddleware) ValidateCustomer(ctx context.Context, p Customer) ([]FieldError, error) {
+	if err := mw.operator(ctx); err != nil {
+		return nil, err
+	}
+	return mw.next.ValidateCustomer(ctx, p)
+}
+
+func (mw selfAccessMiddleware) ValidateAddress(ctx context.Context, customerID string, a Address) ([]FieldError, error) {
+	if err := mw.self(ctx, customerID); err != nil {
+		return nil, err
+	}
+	return mw.next.ValidateAddress(ctx, customerID, a)
+}
+
+func (mw selfAccessMiddleware) ArchiveCustomer(ctx context.Context, id string) error {
+	if err := mw.operator(ctx); err != nil {
+		return err
+	}
+	return mw.next.ArchiveCustomer(ctx, id)
+}
+
+func (mw selfAccessMiddleware) UnarchiveCustomer(ctx context.Context, id string) error {
+	if err := mw.operator(ctx); err != nil {
+		return err
+	}
+	return mw.next.UnarchiveCustomer(ctx, id)
+}
+
+func (mw selfAccessMiddleware) GetCustomers(ctx context.Context, f CustomerFilter) ([]Customer, error) {
+	if err := mw.operator(ctx); err != nil {
+		return nil, err
+	}
+	return mw.next.GetCustomers(ctx, f)
+}
+
+func (mw selfAccessMiddleware) GetCustomerStats(ctx context.Context, id string) (CustomerStats, error) {
+	if err := mw.operator(ctx); err != nil {
+		return CustomerStats{}, err
+	}
+	return mw.next.GetCustomerStats(ctx, id)
+}
+
+func (mw selfAccessMiddleware) PrepareCustomer(ctx context.Context, p Customer, ttl time.Duration) (PendingCustomer, error) {
+	if err := mw.operator(ctx); err != nil {
+		return PendingCustomer{}, err
+	}
+	return mw.next.PrepareCustomer(ctx, p, ttl)
+}
+
+func (mw selfAccessMiddleware) CommitCustomer(ctx context.Context, id string) error {
+	if err := mw.operator(ctx); err != nil {
+		return err
+	}
+	return mw.next.CommitCustomer(ctx, id)
+}
+
+func (mw selfAccessMiddleware) AbortCustomer(ctx context.Context, id string) error {
+	if err := mw.operator(ctx); err != nil {
+		return err
+	}
+	return mw.next.AbortCustomer(ctx, id)
+}
+
+func (mw selfAccessMiddleware) GetCustomerAsOf(ctx context.Context, id string, t time.Time) (Customer, error) {
+	if err := mw.operator(ctx); err != nil {
+		return Customer{}, err
+	}
+	return mw.next.GetCustomerAsOf(ctx, id, t)
+}
+
+func (mw selfAccessMiddleware) GetCustomerByExternalID(ctx context.Context, system string, externalID string) (Customer, error) {
+	if err := mw.operator(ctx); err != nil {
+		return Customer{}, err
+	}
+	return mw.next.GetCustomerByExternalID(ctx, system, externalID)
+}
+
+func (mw selfAccessMiddleware) GrantConsent(ctx context.Context, customerID string, c Consent) (Consent, error) {
+	if err := mw.operator(ctx); err != nil {
+		return Consent{}, err
+	}
+	return mw.next.GrantConsent(ctx, customerID, c)
+}
+
+func (mw selfAccessMiddleware) WithdrawConsent(ctx context.Context, customerID string, consentType string) error {
+	if err := mw.operator(ctx); err != nil {
+		return err
+	}
+	return mw.next.WithdrawConsent(ctx, customerID, consentType)
+}
+
+func (mw selfAccessMiddleware) GetConsents(ctx context.Context, customerID string) ([]Consent, error) {
+	if err := mw.operator(ctx); err != nil {
+		return nil, err
+	}
+	return mw.next.GetConsents(ctx, customerID)
+}
+
+func (mw selfAccessMiddleware) GetDuplicateAddresses(ctx context.Context) ([]DuplicateAddresses, error) {
+	if err := mw.operator(ctx); err != nil {
+		return nil, err
+	}
+	return mw.next.GetDuplicateAddresses(ctx)
+}
+
+func (mw selfAccessMiddleware) RepairAddresses(ctx context.Context, dryRun bool) ([]AddressRepair, error) {
+	if err := mw.operator(ctx); err != nil {
+		return nil, err
+	}
+	return mw.next.RepairAddresses(ctx, dryRun)
+}
+
+func (mw selfAccessMiddleware) RebuildIndex(ctx context.Context, index string) (IndexRebuild, error) {
+	if err := mw.operator(ctx); err != nil {
+		return IndexRebuild{}, err
+	}
+	return mw.next.RebuildIndex(ctx, index)
+}
+
+func (mw selfAccessMiddleware) GetIndexRebuild(ctx context.Context, index string) (IndexRebuild, error) {
+	if err := mw.operator(ctx); err != nil {
+		return IndexRebuild{}, err
+	}
+	return mw.next.GetIndexRebuild(ctx, index)
+}
+
+func (mw selfAccessMiddleware) CheckConsistency(ctx context.Context, repair bool) (ConsistencyReport, error) {
+	if err := mw.operator(ctx); err != nil {
+		return ConsistencyReport{}, err
+	}
+	return mw.next.CheckConsistency(ctx, repair)
+}
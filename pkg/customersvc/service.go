@@ -2,8 +2,12 @@ package customersvc
 
 import (
 	"context"
+	"encoding/xml"
 	"errors"
+	"reflect"
+	"sort"
 	"sync"
+	"time"
 )
 
 // Service is a simple CRUD interface for user customers.
@@ -15,25 +19,164 @@ type Service interface {
 	DeleteCustomer(ctx context.Context, id string) error
 	GetAddresses(ctx context.Context, customerID string) ([]Address, error)
 	GetAddress(ctx context.Context, customerID string, addressID string) (Address, error)
-	PostAddress(ctx context.Context, customerID string, a Address) error
+	PostAddress(ctx context.Context, customerID string, a Address) (Address, error)
 	DeleteAddress(ctx context.Context, customerID string, addressID string) error
+	GetCustomersByRegion(ctx context.Context) ([]RegionCount, error)
+	PostAddresses(ctx context.Context, customerID string, as []Address) ([]AddressResult, error)
+	ReorderAddresses(ctx context.Context, customerID string, addressIDs []string) error
+	ValidateCustomer(ctx context.Context, p Customer) ([]FieldError, error)
+	ValidateAddress(ctx context.Context, customerID string, a Address) ([]FieldError, error)
+	ArchiveCustomer(ctx context.Context, id string) error
+	UnarchiveCustomer(ctx context.Context, id string) error
+	GetCustomers(ctx context.Context, f CustomerFilter) ([]Customer, error)
+	StatsProvider
+	PrepareCustomer(ctx context.Context, p Customer, ttl time.Duration) (PendingCustomer, error)
+	CommitCustomer(ctx context.Context, id string) error
+	AbortCustomer(ctx context.Context, id string) error
+	GetCustomerAsOf(ctx context.Context, id string, t time.Time) (Customer, error)
+	GetCustomerByExternalID(ctx context.Context, system string, externalID string) (Customer, error)
+	GrantConsent(ctx context.Context, customerID string, c Consent) (Consent, error)
+	WithdrawConsent(ctx context.Context, customerID string, consentType string) error
+	GetConsents(ctx context.Context, customerID string) ([]Consent, error)
+	GetDuplicateAddresses(ctx context.Context) ([]DuplicateAddresses, error)
+	RepairAddresses(ctx context.Context, dryRun bool) ([]AddressRepair, error)
+	RebuildIndex(ctx context.Context, index string) (IndexRebuild, error)
+	GetIndexRebuild(ctx context.Context, index string) (IndexRebuild, error)
+	CheckConsistency(ctx context.Context, repair bool) (ConsistencyReport, error)
 }
 
 // Customer represents a single user customer.
 // ID should be globally unique.
 type Customer struct {
-	ID        string    `json:"id"` // Ideally we genrate this, instead of asking client to submit it
-	Name      string    `json:"name"`
-	Email     string    `json:"email"`
-	Phone     string    `json:"phone,omitempty"`
-	Addresses []Address `json:"addresses,omitempty"`
+	ID string `xml:"id"` // Ideally we genrate this, instead of asking client to submit it
+	// Name is the name the customer is displayed by. It's derived from
+	// GivenName and FamilyName, in the order Locale writes them, if not
+	// given, see DisplayName.
+	Name       string `xml:"name"`
+	GivenName  string `xml:"given_name,omitempty"`
+	FamilyName string `xml:"family_name,omitempty"`
+	// Locale is the BCP 47 tag of the customer's language, e.g. ja-JP,
+	// which says how their name is written and split.
+	Locale string `xml:"locale,omitempty"`
+	// NameVariants are the customer's name in other scripts, e.g. the
+	// katakana reading or the Latin transliteration of a name in kanji.
+	NameVariants []NameVariant `xml:"name_variants>variant,omitempty"`
+	Email        string        `xml:"email"`
+	Phone        string        `xml:"phone,omitempty"`
+	Addresses    []Address     `xml:"addresses>address,omitempty"`
+	Metadata     Metadata      `xml:"metadata,omitempty"`
+	Archived     bool          `xml:"archived,omitempty"` // set by ArchiveCustomer; PATCH leaves it alone
+	// ExternalIDs are the customer's IDs in other systems, by system name,
+	// e.g. {"stripe": "cus_123"}. Each belongs to at most one customer.
+	ExternalIDs Metadata `xml:"external_ids,omitempty"`
+}
+
+// Values of CustomerFilter.Archived.
+const (
+	ArchivedExclude = "exclude" // the default: active customers only
+	ArchivedInclude = "include" // active and archived customers
+	ArchivedOnly    = "only"    // archived customers only
+)
+
+// CustomerFilter selects the customers returned by GetCustomers.
+type CustomerFilter struct {
+	// Archived says what to do with archived customers. Empty means
+	// ArchivedExclude.
+	Archived string
+}
+
+func (f CustomerFilter) matches(p Customer) bool {
+	switch f.Archived {
+	case ArchivedInclude:
+		return true
+	case ArchivedOnly:
+		return p.Archived
+	}
+	return !p.Archived
+}
+
+// Metadata holds free-form attributes of a customer, such as those computed
+// by an Enricher. PATCH merges metadata keys rather than replacing the map.
+type Metadata map[string]string
+
+// MarshalXML implements xml.Marshaler, which encoding/xml can't do for maps.
+// Entries are written as <entry key="...">value</entry>, sorted by key.
+func (m Metadata) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	if err := e.EncodeToken(start); err != nil {
+		return err
+	}
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		entry := xml.StartElement{Name: xml.Name{Local: "entry"}, Attr: []xml.Attr{{Name: xml.Name{Local: "key"}, Value: k}}}
+		if err := e.EncodeElement(m[k], entry); err != nil {
+			return err
+		}
+	}
+	return e.EncodeToken(start.End())
+}
+
+// UnmarshalXML implements xml.Unmarshaler, reading the format written by
+// MarshalXML.
+func (m *Metadata) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	var body struct {
+		Entries []struct {
+			Key   string `xml:"key,attr"`
+			Value string `xml:",chardata"`
+		} `xml:"entry"`
+	}
+	if err := d.DecodeElement(&body, &start); err != nil {
+		return err
+	}
+	*m = make(Metadata, len(body.Entries))
+	for _, entry := range body.Entries {
+		(*m)[entry.Key] = entry.Value
+	}
+	return nil
 }
 
 // Address is a field of a user customer.
 // ID should be unique within the customer (at a minimum).
 type Address struct {
-	ID       string `json:"id"`
-	Location string `json:"location,omitempty"`
+	ID       string `xml:"id"`
+	Location string `xml:"location,omitempty"`
+	Country  string `xml:"country,omitempty"`
+	State    string `xml:"state,omitempty"`
+	Position int    `xml:"position,omitempty"` // 1-based, maintained by the service
+	// CustomFields are those the deployment's AddressSchema defines.
+	CustomFields CustomFields `xml:"custom_fields,omitempty"`
+	// EffectiveFrom and EffectiveTo bound when the address applies, e.g.
+	// for billing and tax, see EffectiveAt. Nil bounds are open.
+	EffectiveFrom *time.Time `xml:"effective_from,omitempty"`
+	EffectiveTo   *time.Time `xml:"effective_to,omitempty"`
+	// Supersedes is the ID of the address this one replaces from its
+	// EffectiveFrom on. The replaced address is kept, effective until
+	// then, rather than overwritten.
+	Supersedes string `xml:"supersedes,omitempty"`
+}
+
+// AddressResult reports the outcome of one item of a batch address insert.
+type AddressResult struct {
+	ID    string `json:"id" xml:"id"`
+	Error string `json:"error,omitempty" xml:"error,omitempty"`
+	// MergedInto is the ID of the existing address this one was merged
+	// into under DedupMerge, instead of being added.
+	MergedInto string `json:"merged_into,omitempty" xml:"merged_into,omitempty"`
+}
+
+// MaxAddressBatch is the largest number of addresses accepted by a single
+// PostAddresses call.
+const MaxAddressBatch = 100
+
+// RegionCount is a single row of the customers-by-region report. A customer
+// is counted once per distinct country/state found among its addresses.
+type RegionCount struct {
+	Country   string `json:"country" xml:"country"`
+	State     string `json:"state,omitempty" xml:"state,omitempty"`
+	Customers int    `json:"customers" xml:"customers"`
 }
 
 var (
@@ -41,41 +184,215 @@ var (
 	ErrAlreadyExists         = errors.New("already exists")
 	ErrNotFound              = errors.New("not found")
 	ErrMissingRequiredInputs = errors.New("Missing required fields. Name and Email are required to create a Customer")
+	ErrBatchTooLarge         = errors.New("too many items in batch")
+	ErrBatchRejected         = errors.New("batch rejected, see per-item results")
+	ErrMissingAddressID      = errors.New("address ID is required")
+	ErrInvalidOrder          = errors.New("order must list every address of the customer exactly once")
+	ErrInvalidFilter         = errors.New("invalid filter")
+	ErrUnknownCountry        = errors.New("not an ISO 3166-1 country")
+	ErrUnknownState          = errors.New("not an ISO 3166-2 subdivision of the country")
+	ErrInvalidTTL            = errors.New("ttl must be a positive duration such as 30s")
 )
 
 type inmemService struct {
-	mtx       sync.RWMutex
+	mtx       rwMutex
 	customers map[string]Customer
+	history   map[string]*customerHistory
+	pending   map[string]pendingCustomer
+	revisions map[string]*revisions
+	external  map[externalKey]string // customer IDs by external ID
+	rebuild   indexRebuild           // of external
+	consents  map[string][]Consent
+	clock     Clock
+	rand      Rand
+	regions   RegionCheck
+	dedup     DedupPolicy
+	patch     PatchPolicy
+	addresses AddressAuthority
+	ids       ulidSource // of addresses; guarded by mtx
+	journal   *Journal   // nil unless durable
+	schema    *AddressSchema
 }
 
-func NewInmemService() Service {
-	return &inmemService{
+// NewInmemService returns a Service that keeps customers in memory. The
+// Clock and Rand given as options are used for anything time- or
+// randomness-dependent the store does, and addresses are checked according
+// to WithRegionCheck, and deduplicated according to WithAddressDedup.
+// Patches are restricted by WithPatchPolicy, and addresses by
+// WithAddressAuthority. Addresses may have the custom fields defined by
+// WithAddressSchema. WithJournal makes it durable. Calls whose context is
+// done, before or while they wait for the store, fail with its error, and
+// lists and reports going through every customer stop early.
+func NewInmemService(opts ...Option) Service {
+	o := makeOptions(opts)
+	s := &inmemService{
 		customers: map[string]Customer{},
+		history:   map[string]*customerHistory{},
+		pending:   map[string]pendingCustomer{},
+		revisions: map[string]*revisions{},
+		external:  map[externalKey]string{},
+		consents:  map[string][]Consent{},
+		clock:     o.clock,
+		rand:      o.rand,
+		regions:   o.regions,
+		dedup:     o.dedup,
+		patch:     o.patch,
+		addresses: o.addresses,
+		ids:       ulidSource{clock: o.clock, rand: o.rand},
+		journal:   o.journal,
+		schema:    o.schema,
+	}
+	if o.journal != nil {
+		if state := o.journal.take(); state != nil {
+			s.restore(state)
+		}
+	}
+	return s
+}
+
+// lock takes the write lock for a call made with ctx, unless ctx is done,
+// before or while waiting for it, in which case it returns why.
+func (s *inmemService) lock(ctx context.Context) error {
+	return s.mtx.lockContext(ctx, false)
+}
+
+// rlock is lock for the read lock.
+func (s *inmemService) rlock(ctx context.Context) error {
+	return s.mtx.lockContext(ctx, true)
+}
+
+// rwMutex is a reader/writer lock like sync.RWMutex, whose waiters can give
+// up on it. As with sync.RWMutex, a writer waiting for the lock keeps new
+// readers from taking it, so that writers aren't starved.
+type rwMutex struct {
+	mtx     sync.Mutex
+	readers int
+	writer  bool
+	waiting int           // writers
+	changed chan struct{} // closed, and replaced, whenever waiters may proceed
+}
+
+func (m *rwMutex) Lock()    { m.lockContext(context.Background(), false) }
+func (m *rwMutex) RLock()   { m.lockContext(context.Background(), true) }
+func (m *rwMutex) Unlock()  { m.release(func() { m.writer = false }) }
+func (m *rwMutex) RUnlock() { m.release(func() { m.readers-- }) }
+
+// lockContext takes the read lock if read, or else the write lock, unless
+// ctx is done before or while waiting for it, in which case it returns why.
+func (m *rwMutex) lockContext(ctx context.Context, read bool) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	if !read {
+		m.waiting++
+		defer func() { m.waiting-- }()
+	}
+	for {
+		switch {
+		case read && !m.writer && m.waiting == 0:
+			m.readers++
+			return nil
+		case !read && !m.writer && m.readers == 0:
+			m.writer = true
+			return nil
+		}
+		if m.changed == nil {
+			m.changed = make(chan struct{})
+		}
+		changed := m.changed
+		m.mtx.Unlock()
+		select {
+		case <-changed:
+			m.mtx.Lock()
+		case <-ctx.Done():
+			m.mtx.Lock()
+			if !read {
+				// Readers held back for this writer may go ahead.
+				m.broadcast()
+			}
+			return ctx.Err()
+		}
+	}
+}
+
+func (m *rwMutex) release(f func()) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	f()
+	m.broadcast()
+}
+
+// broadcast wakes every waiter up to try again. m.mtx must be held.
+func (m *rwMutex) broadcast() {
+	if m.changed != nil {
+		close(m.changed)
+		m.changed = nil
 	}
 }
 
+// scanCheckEvery is the number of customers scans go through between checks
+// of their context, so that a cancelled list or report of many customers
+// stops early, without a check for each.
+const scanCheckEvery = 256
+
+// scan checks the context of a scan going through customers.
+type scan struct {
+	ctx context.Context
+	n   int
+}
+
+// next returns ctx.Err() every scanCheckEvery customers.
+func (sc *scan) next() error {
+	sc.n++
+	if sc.n%scanCheckEvery != 0 {
+		return nil
+	}
+	return sc.ctx.Err()
+}
+
 func (s *inmemService) PostCustomer(ctx context.Context, p Customer) error {
-	if p.Name == "" || p.Email == "" {
-		return ErrMissingRequiredInputs // Validate before acquiring a lock
+	p = normalizeName(p)
+	p.Addresses = normalizeRegions(p.Addresses, s.regions)
+	if errs := validateCustomer(p, s.regions, s.schema); len(errs) > 0 {
+		return errs[0].err // Validate before acquiring a lock
+	}
+	if err := validateExternalIDs(p.ExternalIDs); err != nil {
+		return err
 	}
 
-	s.mtx.Lock()
+	if err := s.lock(ctx); err != nil {
+		return err
+	}
 	defer s.mtx.Unlock()
 
-	if _, ok := s.customers[p.ID]; ok {
+	if s.reserved(p.ID) {
 		return ErrAlreadyExists // POST = create, don't overwrite
 	}
-	s.customers[p.ID] = p
-	return nil
+	addresses, err := s.embedAddresses(p.Addresses)
+	if err != nil {
+		return err
+	}
+	if err := s.indexExternalIDs(p.ID, nil, p.ExternalIDs); err != nil {
+		return err
+	}
+	p.Addresses = addresses
+	return s.record(p.ID, EventCreated, 1, p)
 }
 
 func (s *inmemService) GetCustomer(ctx context.Context, id string) (Customer, error) {
-	s.mtx.RLock()
+	if err := s.rlock(ctx); err != nil {
+		return Customer{}, err
+	}
 	defer s.mtx.RUnlock()
 	p, ok := s.customers[id]
 	if !ok {
 		return Customer{}, ErrNotFound
 	}
+	if AddressesOmitted(ctx) {
+		p.Addresses = nil
+	}
 	return p, nil
 }
 
@@ -83,18 +400,55 @@ func (s *inmemService) PutCustomer(ctx context.Context, id string, p Customer) e
 	if id != p.ID {
 		return ErrInconsistentIDs
 	}
-	s.mtx.Lock()
+	p = normalizeName(p)
+	p.Addresses = normalizeRegions(p.Addresses, s.regions)
+	if errs := append(validateNames(p), validateAddresses(p.Addresses, s.regions, s.schema)...); len(errs) > 0 {
+		return errs[0].err
+	}
+	if err := validateExternalIDs(p.ExternalIDs); err != nil {
+		return err
+	}
+	if err := s.lock(ctx); err != nil {
+		return err
+	}
 	defer s.mtx.Unlock()
-	s.customers[id] = p // PUT = create or update
-	return nil
+	existing, exists := s.customers[id]
+	addresses, err := s.putAddresses(AddressWriteFrom(ctx), existing, exists, p.Addresses)
+	if err != nil {
+		return err
+	}
+	p.Addresses = addresses
+	if err := s.indexExternalIDs(id, existing.ExternalIDs, p.ExternalIDs); err != nil {
+		return err
+	}
+	event := EventUpdated
+	if !exists {
+		event = EventCreated
+	}
+	return s.record(id, event, 1, p) // PUT = create or update
 }
 
 func (s *inmemService) PatchCustomer(ctx context.Context, id string, p Customer) error {
 	if p.ID != "" && id != p.ID {
 		return ErrInconsistentIDs
 	}
+	if err := s.patch.check(p); err != nil {
+		return err
+	}
+	if len(p.Addresses) > 0 && s.addresses == AddressesSubresource {
+		return ImmutableFieldsError{Fields: []string{"addresses"}}
+	}
+	p.Addresses = normalizeRegions(p.Addresses, s.regions)
+	if errs := append(validateNames(p), validateAddresses(p.Addresses, s.regions, s.schema)...); len(errs) > 0 {
+		return errs[0].err
+	}
+	if err := validateExternalIDs(p.ExternalIDs); err != nil {
+		return err
+	}
 
-	s.mtx.Lock()
+	if err := s.lock(ctx); err != nil {
+		return err
+	}
 	defer s.mtx.Unlock()
 
 	existing, ok := s.customers[id]
@@ -108,28 +462,66 @@ func (s *inmemService) PatchCustomer(ctx context.Context, id string, p Customer)
 	// the Customer definition. But since this is just a demonstrative example,
 	// I'customers leaving that out.
 
-	if p.Name != "" {
-		existing.Name = p.Name
-	}
+	existing = patchName(existing, p)
 	if len(p.Addresses) > 0 {
-		existing.Addresses = p.Addresses
+		addresses, err := s.embedAddresses(p.Addresses)
+		if err != nil {
+			return err
+		}
+		existing.Addresses = addresses
 	}
-	s.customers[id] = existing
-	return nil
+	if len(p.Metadata) > 0 {
+		merged := make(Metadata, len(existing.Metadata)+len(p.Metadata))
+		for k, v := range existing.Metadata {
+			merged[k] = v
+		}
+		for k, v := range p.Metadata {
+			merged[k] = v
+		}
+		existing.Metadata = merged
+	}
+	if len(p.ExternalIDs) > 0 {
+		merged := make(Metadata, len(existing.ExternalIDs)+len(p.ExternalIDs))
+		for system, ext := range existing.ExternalIDs {
+			merged[system] = ext
+		}
+		for system, ext := range p.ExternalIDs {
+			merged[system] = ext
+		}
+		if err := s.indexExternalIDs(id, existing.ExternalIDs, merged); err != nil {
+			return err
+		}
+		existing.ExternalIDs = merged
+	}
+	return s.record(id, EventUpdated, 1, existing)
 }
 
 func (s *inmemService) DeleteCustomer(ctx context.Context, id string) error {
-	s.mtx.Lock()
+	if err := s.lock(ctx); err != nil {
+		return err
+	}
 	defer s.mtx.Unlock()
 	if _, ok := s.customers[id]; !ok {
 		return ErrNotFound
 	}
+	now := s.clock.Now()
+	return s.persist(journalRecord{At: now, Op: opDelete, ID: id}, func() { s.forget(id, now) })
+}
+
+// forget deletes customer id, which must exist, at the given time. The
+// caller must hold the write lock.
+func (s *inmemService) forget(id string, now time.Time) {
+	s.indexExternalIDs(id, s.customers[id].ExternalIDs, nil)
 	delete(s.customers, id)
-	return nil
+	delete(s.history, id)
+	delete(s.consents, id) // erasure covers them too
+	s.snapshot(id, now)    // the deletion, for GetCustomerAsOf
 }
 
 func (s *inmemService) GetAddresses(ctx context.Context, customerID string) ([]Address, error) {
-	s.mtx.RLock()
+	if err := s.rlock(ctx); err != nil {
+		return nil, err
+	}
 	defer s.mtx.RUnlock()
 	p, ok := s.customers[customerID]
 	if !ok {
@@ -139,7 +531,9 @@ func (s *inmemService) GetAddresses(ctx context.Context, customerID string) ([]A
 }
 
 func (s *inmemService) GetAddress(ctx context.Context, customerID string, addressID string) (Address, error) {
-	s.mtx.RLock()
+	if err := s.rlock(ctx); err != nil {
+		return Address{}, err
+	}
 	defer s.mtx.RUnlock()
 	p, ok := s.customers[customerID]
 	if !ok {
@@ -153,25 +547,69 @@ func (s *inmemService) GetAddress(ctx context.Context, customerID string, addres
 	return Address{}, ErrNotFound
 }
 
-func (s *inmemService) PostAddress(ctx context.Context, customerID string, a Address) error {
-	s.mtx.Lock()
+// PostAddress adds a, generating its ID if it has none, and returns it as
+// stored: or, under DedupMerge, the address it was merged into.
+func (s *inmemService) PostAddress(ctx context.Context, customerID string, a Address) (Address, error) {
+	a = normalizeRegion(a, s.regions)
+	if errs := validateAddress(a, s.regions, s.schema); len(errs) > 0 {
+		return Address{}, errs[0].err
+	}
+	if err := s.lock(ctx); err != nil {
+		return Address{}, err
+	}
 	defer s.mtx.Unlock()
 	p, ok := s.customers[customerID]
 	if !ok {
-		return ErrNotFound
+		return Address{}, ErrNotFound
 	}
 	for _, address := range p.Addresses {
 		if address.ID == a.ID {
-			return ErrAlreadyExists
+			return Address{}, ErrAlreadyExists
+		}
+	}
+	if a.Supersedes != "" {
+		// A new version of an address, which may well be at the same
+		// location, isn't a duplicate of it.
+		addresses := append([]Address(nil), p.Addresses...) // revisions share the old slice
+		if err := supersede(addresses, &a, s.clock.Now()); err != nil {
+			return Address{}, err
+		}
+		p.Addresses = addresses
+	} else if i := findDuplicate(p.Addresses, a); i >= 0 {
+		switch s.dedup {
+		case DedupReject:
+			return Address{}, ErrDuplicateAddress
+		case DedupMerge:
+			merged := mergeAddress(p.Addresses[i], a)
+			if !reflect.DeepEqual(merged, p.Addresses[i]) {
+				p.Addresses = append([]Address(nil), p.Addresses...) // revisions share the old slice
+				p.Addresses[i] = merged
+				if err := s.record(customerID, EventUpdated, 1, p); err != nil {
+					return Address{}, err
+				}
+			}
+			return merged, nil
 		}
 	}
+	if a.ID == "" {
+		id, err := s.ids.next()
+		if err != nil {
+			return Address{}, err
+		}
+		a.ID = id
+	}
+	a.Position = len(p.Addresses) + 1 // new addresses go last
 	p.Addresses = append(p.Addresses, a)
-	s.customers[customerID] = p
-	return nil
+	if err := s.record(customerID, EventAddressAdded, 1, p); err != nil {
+		return Address{}, err
+	}
+	return a, nil
 }
 
 func (s *inmemService) DeleteAddress(ctx context.Context, customerID string, addressID string) error {
-	s.mtx.Lock()
+	if err := s.lock(ctx); err != nil {
+		return err
+	}
 	defer s.mtx.Unlock()
 	p, ok := s.customers[customerID]
 	if !ok {
@@ -187,7 +625,288 @@ func (s *inmemService) DeleteAddress(ctx context.Context, customerID string, add
 	if len(newAddresses) == len(p.Addresses) {
 		return ErrNotFound
 	}
-	p.Addresses = newAddresses
-	s.customers[customerID] = p
-	return nil
+	p.Addresses = orderAddresses(newAddresses)
+	return s.record(customerID, EventAddressRemoved, 1, p)
+}
+
+// GetCustomersByRegion aggregates in place, under the read lock, rather than
+// copying every customer out of the store first.
+func (s *inmemService) GetCustomersByRegion(ctx context.Context) ([]RegionCount, error) {
+	type region struct{ country, state string }
+
+	if err := s.rlock(ctx); err != nil {
+		return nil, err
+	}
+	counts := map[region]int{}
+	sc := scan{ctx: ctx}
+	for _, p := range s.customers {
+		if err := sc.next(); err != nil {
+			s.mtx.RUnlock()
+			return nil, err
+		}
+		seen := map[region]bool{}
+		for _, address := range p.Addresses {
+			if address.Country == "" {
+				continue // can't place it on the map
+			}
+			r := region{address.Country, address.State}
+			if seen[r] {
+				continue
+			}
+			seen[r] = true
+			counts[r]++
+		}
+	}
+	s.mtx.RUnlock()
+
+	report := make([]RegionCount, 0, len(counts))
+	for r, n := range counts {
+		report = append(report, RegionCount{Country: r.country, State: r.state, Customers: n})
+	}
+	sort.Slice(report, func(i, j int) bool {
+		if report[i].Country != report[j].Country {
+			return report[i].Country < report[j].Country
+		}
+		return report[i].State < report[j].State
+	})
+	return report, nil
+}
+
+// ListCustomers implements Lister, so the inmem store can be the source of a
+// Backfill.
+func (s *inmemService) ListCustomers(ctx context.Context) ([]Customer, error) {
+	if err := s.rlock(ctx); err != nil {
+		return nil, err
+	}
+	defer s.mtx.RUnlock()
+	customers := make([]Customer, 0, len(s.customers))
+	sc := scan{ctx: ctx}
+	for _, p := range s.customers {
+		if err := sc.next(); err != nil {
+			return nil, err
+		}
+		customers = append(customers, p)
+	}
+	sort.Slice(customers, func(i, j int) bool { return customers[i].ID < customers[j].ID })
+	if AddressesOmitted(ctx) {
+		customers = withoutAddresses(customers)
+	}
+	return customers, nil
+}
+
+// PostAddresses adds all of the addresses or none of them. Each item gets a
+// result; if any item fails, ErrBatchRejected is returned and the customer is
+// left unchanged.
+func (s *inmemService) PostAddresses(ctx context.Context, customerID string, as []Address) ([]AddressResult, error) {
+	if len(as) > MaxAddressBatch {
+		return nil, ErrBatchTooLarge
+	}
+
+	if err := s.lock(ctx); err != nil {
+		return nil, err
+	}
+	defer s.mtx.Unlock()
+	p, ok := s.customers[customerID]
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	seen := make(map[string]bool, len(p.Addresses)+len(as))
+	for _, address := range p.Addresses {
+		seen[address.ID] = true
+	}
+	results := make([]AddressResult, len(as))
+	failed := false
+	as = normalizeRegions(as, s.regions)
+	addresses := make([]Address, 0, len(p.Addresses)+len(as))
+	addresses = append(addresses, p.Addresses...)
+	added := 0
+	for i, a := range as {
+		if a.ID == "" {
+			id, err := s.ids.next()
+			if err != nil {
+				return nil, err
+			}
+			a.ID = id
+		}
+		results[i].ID = a.ID
+		if errs := validateAddress(a, s.regions, s.schema); len(errs) > 0 {
+			results[i].Error = errs[0].Message
+		} else if seen[a.ID] {
+			results[i].Error = ErrAlreadyExists.Error()
+		} else if a.Supersedes != "" {
+			if err := supersede(addresses, &a, s.clock.Now()); err != nil {
+				results[i].Error = err.Error()
+			}
+		} else if j := findDuplicate(addresses, a); j >= 0 && s.dedup == DedupReject {
+			results[i].Error = ErrDuplicateAddress.Error()
+		} else if j >= 0 && s.dedup == DedupMerge {
+			addresses[j] = mergeAddress(addresses[j], a)
+			results[i].MergedInto = addresses[j].ID
+			seen[a.ID] = true
+			continue
+		}
+		if results[i].Error != "" {
+			failed = true
+		} else {
+			a.Position = len(addresses) + 1 // in the order given, after existing ones
+			addresses = append(addresses, a)
+			added++
+		}
+		seen[a.ID] = true
+	}
+	if failed {
+		return results, ErrBatchRejected
+	}
+
+	p.Addresses = addresses
+	if err := s.record(customerID, EventAddressAdded, added, p); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// ReorderAddresses assigns positions to the customer's addresses following
+// the order of addressIDs, which must name each of them exactly once.
+func (s *inmemService) ReorderAddresses(ctx context.Context, customerID string, addressIDs []string) error {
+	if err := s.lock(ctx); err != nil {
+		return err
+	}
+	defer s.mtx.Unlock()
+	p, ok := s.customers[customerID]
+	if !ok {
+		return ErrNotFound
+	}
+	if len(addressIDs) != len(p.Addresses) {
+		return ErrInvalidOrder
+	}
+	byID := make(map[string]Address, len(p.Addresses))
+	for _, address := range p.Addresses {
+		byID[address.ID] = address
+	}
+	addresses := make([]Address, 0, len(addressIDs))
+	for _, id := range addressIDs {
+		address, ok := byID[id]
+		if !ok {
+			return ErrInvalidOrder // unknown or repeated ID
+		}
+		delete(byID, id)
+		address.Position = len(addresses) + 1
+		addresses = append(addresses, address)
+	}
+	p.Addresses = addresses
+	return s.record(customerID, EventAddressesReordered, 1, p)
+}
+
+// orderAddresses returns a copy of addresses sorted by Position and
+// renumbered from 1. Addresses without a position keep their relative order
+// and go after those with one.
+func orderAddresses(addresses []Address) []Address {
+	if len(addresses) == 0 {
+		return addresses
+	}
+	ordered := make([]Address, len(addresses))
+	copy(ordered, addresses)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		pi, pj := ordered[i].Position, ordered[j].Position
+		if pi == 0 || pj == 0 {
+			return pj == 0 && pi != 0
+		}
+		return pi < pj
+	})
+	for i := range ordered {
+		ordered[i].Position = i + 1
+	}
+	return ordered
+}
+
+// ValidateCustomer reports every problem PostCustomer would find with p,
+// including a clash with an existing customer, without writing anything.
+func (s *inmemService) ValidateCustomer(ctx context.Context, p Customer) ([]FieldError, error) {
+	p = normalizeName(p)
+	p.Addresses = normalizeRegions(p.Addresses, s.regions)
+	errs := validateCustomer(p, s.regions, s.schema)
+	if err := s.rlock(ctx); err != nil {
+		return nil, err
+	}
+	defer s.mtx.RUnlock()
+	if _, ok := s.customers[p.ID]; ok {
+		errs = append(errs, fieldError("id", ErrAlreadyExists))
+	}
+	return errs, nil
+}
+
+// ValidateAddress reports every problem PostAddress would find with a,
+// without writing anything.
+func (s *inmemService) ValidateAddress(ctx context.Context, customerID string, a Address) ([]FieldError, error) {
+	errs := validateAddress(normalizeRegion(a, s.regions), s.regions, s.schema)
+	if err := s.rlock(ctx); err != nil {
+		return nil, err
+	}
+	defer s.mtx.RUnlock()
+	p, ok := s.customers[customerID]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	for _, address := range p.Addresses {
+		if address.ID == a.ID && a.ID != "" {
+			errs = append(errs, fieldError("id", ErrAlreadyExists))
+			break
+		}
+	}
+	return errs, nil
+}
+
+// ArchiveCustomer marks the customer inactive. Unlike DeleteCustomer, the
+// customer is kept, and can still be read by ID; it's only left out of
+// GetCustomers by default. Archiving an archived customer is a no-op.
+func (s *inmemService) ArchiveCustomer(ctx context.Context, id string) error {
+	return s.setArchived(ctx, id, true)
+}
+
+// UnarchiveCustomer reverses ArchiveCustomer.
+func (s *inmemService) UnarchiveCustomer(ctx context.Context, id string) error {
+	return s.setArchived(ctx, id, false)
+}
+
+func (s *inmemService) setArchived(ctx context.Context, id string, archived bool) error {
+	if err := s.lock(ctx); err != nil {
+		return err
+	}
+	defer s.mtx.Unlock()
+	p, ok := s.customers[id]
+	if !ok {
+		return ErrNotFound
+	}
+	p.Archived = archived
+	event := EventUnarchived
+	if archived {
+		event = EventArchived
+	}
+	return s.record(id, event, 1, p)
+}
+
+// GetCustomers returns the customers matching f, sorted by ID.
+func (s *inmemService) GetCustomers(ctx context.Context, f CustomerFilter) ([]Customer, error) {
+	switch f.Archived {
+	case "", ArchivedExclude, ArchivedInclude, ArchivedOnly:
+	default:
+		return nil, ErrInvalidFilter
+	}
+	if err := s.rlock(ctx); err != nil {
+		return nil, err
+	}
+	defer s.mtx.RUnlock()
+	customers := make([]Customer, 0, len(s.customers))
+	sc := scan{ctx: ctx}
+	for _, p := range s.customers {
+		if err := sc.next(); err != nil {
+			return nil, err
+		}
+		if f.matches(p) {
+			customers = append(customers, p)
+		}
+	}
+	sort.Slice(customers, func(i, j int) bool { return customers[i].ID < customers[j].ID })
+	return customers, nil
 }
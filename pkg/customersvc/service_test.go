@@ -0,0 +1,165 @@
+package customersvc
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// cancelledAfter is a context that's cancelled once its Err has been asked
+// for more than checks times, so that a scan can be cancelled at a known
+// point, without racing it.
+type cancelledAfter struct {
+	context.Context
+	checks int
+
+	mtx   sync.Mutex
+	calls int
+}
+
+func (c *cancelledAfter) Err() error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.calls++
+	if c.calls > c.checks {
+		return context.Canceled
+	}
+	return nil
+}
+
+func newTestStore(t *testing.T, n int) *inmemService {
+	t.Helper()
+	s := NewInmemService().(*inmemService)
+	for i := 0; i < n; i++ {
+		p := Customer{ID: fmt.Sprintf("c%05d", i), Name: "Test", Email: fmt.Sprintf("c%d@example.com", i),
+			Addresses: []Address{{Location: "1 Main St", Country: "US", State: "IL"}}}
+		if err := s.PostCustomer(context.Background(), p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return s
+}
+
+func TestInmemServiceCancelledMidScan(t *testing.T) {
+	const customers = 20 * scanCheckEvery
+	s := newTestStore(t, customers)
+	for name, scan := range map[string]func(context.Context) error{
+		"GetCustomers": func(ctx context.Context) error {
+			_, err := s.GetCustomers(ctx, CustomerFilter{})
+			return err
+		},
+		"GetCustomersByRegion": func(ctx context.Context) error {
+			_, err := s.GetCustomersByRegion(ctx)
+			return err
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			// Good for taking the lock and the first few checks of the
+			// scan, cancelled from then on.
+			ctx := &cancelledAfter{Context: context.Background(), checks: 3}
+			if err := scan(ctx); err != context.Canceled {
+				t.Fatalf("want %v, have %v", context.Canceled, err)
+			}
+			if ctx.calls != ctx.checks+1 {
+				t.Errorf("scan went on for %d checks after being cancelled", ctx.calls-ctx.checks-1)
+			}
+			if err := scan(context.Background()); err != nil {
+				t.Errorf("store left unusable: %v", err)
+			}
+		})
+	}
+}
+
+func TestInmemServiceCancelledBeforeCall(t *testing.T) {
+	s := newTestStore(t, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := s.GetCustomer(ctx, "c00000"); err != context.Canceled {
+		t.Errorf("GetCustomer: want %v, have %v", context.Canceled, err)
+	}
+	if err := s.DeleteCustomer(ctx, "c00000"); err != context.Canceled {
+		t.Errorf("DeleteCustomer: want %v, have %v", context.Canceled, err)
+	}
+	if _, err := s.GetCustomer(context.Background(), "c00000"); err != nil {
+		t.Errorf("cancelled delete went through: %v", err)
+	}
+}
+
+func TestInmemServiceCancelledWaitingForLock(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		hold func(s *inmemService) (release func())
+		call func(ctx context.Context, s *inmemService) error
+	}{
+		{
+			name: "read behind writer",
+			hold: func(s *inmemService) func() { s.mtx.Lock(); return s.mtx.Unlock },
+			call: func(ctx context.Context, s *inmemService) error {
+				_, err := s.GetCustomers(ctx, CustomerFilter{})
+				return err
+			},
+		},
+		{
+			name: "write behind reader",
+			hold: func(s *inmemService) func() { s.mtx.RLock(); return s.mtx.RUnlock },
+			call: func(ctx context.Context, s *inmemService) error {
+				return s.PutCustomer(ctx, "c00000", Customer{ID: "c00000", Name: "Changed", Email: "c0@example.com"})
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newTestStore(t, 1)
+			release := tc.hold(s)
+			ctx, cancel := context.WithCancel(context.Background())
+			errc := make(chan error, 1)
+			go func() { errc <- tc.call(ctx, s) }()
+			select {
+			case err := <-errc:
+				t.Fatalf("call didn't wait for the lock: %v", err)
+			case <-time.After(50 * time.Millisecond):
+			}
+			cancel()
+			select {
+			case err := <-errc:
+				if err != context.Canceled {
+					t.Errorf("want %v, have %v", context.Canceled, err)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("call kept waiting for the lock after being cancelled")
+			}
+			release()
+			if err := tc.call(context.Background(), s); err != nil {
+				t.Errorf("store left unusable: %v", err)
+			}
+		})
+	}
+}
+
+func TestInmemServiceCancelledWriterLetsReadersIn(t *testing.T) {
+	s := newTestStore(t, 1)
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	ctx, cancel := context.WithCancel(context.Background())
+	writer := make(chan error, 1)
+	go func() { writer <- s.DeleteCustomer(ctx, "c00000") }()
+	time.Sleep(50 * time.Millisecond) // the writer is waiting, holding new readers back
+	reader := make(chan error, 1)
+	go func() {
+		_, err := s.GetCustomer(context.Background(), "c00000")
+		reader <- err
+	}()
+	cancel()
+	if err := <-writer; err != context.Canceled {
+		t.Fatalf("writer: want %v, have %v", context.Canceled, err)
+	}
+	select {
+	case err := <-reader:
+		if err != nil {
+			t.Errorf("reader: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("reader still held back by the cancelled writer")
+	}
+}
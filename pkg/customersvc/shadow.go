@@ -0,0 +1,313 @@
+package customersvc
+
+import (
+	"context"
+	"reflect"
+	"time"
+
+	"github.com/go-kit/kit/metrics"
+)
+
+// ShadowOptions tunes ShadowingMiddleware.
+type ShadowOptions struct {
+	// Rate is the fraction of calls mirrored to the shadow, between 0 and
+	// 1. Zero means 1: mirror everything.
+	Rate float64
+	// Writes mirrors writes too, with a context marked by WithDryRun. Only
+	// reads are mirrored without it.
+	Writes bool
+	// Timeout bounds a single call to the shadow. Zero means 5 seconds.
+	Timeout time.Duration
+	// MaxInFlight is the number of shadow calls running at once. When
+	// it's reached, calls aren't mirrored rather than queued. Zero means
+	// 100.
+	MaxInFlight int
+}
+
+// Outcomes of a mirrored call, the values of the "result" label of the
+// counter given to ShadowingMiddleware.
+const (
+	ShadowMatch    = "match"
+	ShadowDiverged = "diverged"
+	ShadowDropped  = "dropped"
+)
+
+type dryRunKey struct{}
+
+// WithDryRun returns a copy of ctx marking the writes made with it as dry
+// runs: they should be checked as usual, and fail as they would, but have no
+// effect. ShadowingMiddleware marks the writes it mirrors, so a backend under
+// evaluation should honor it.
+func WithDryRun(ctx context.Context) context.Context {
+	return context.WithValue(ctx, dryRunKey{}, true)
+}
+
+// IsDryRun reports whether ctx was marked by WithDryRun.
+func IsDryRun(ctx context.Context) bool {
+	dryRun, _ := ctx.Value(dryRunKey{}).(bool)
+	return dryRun
+}
+
+// ShadowingMiddleware mirrors a sample of the calls to the wrapped Service to
+// shadow, typically a new backend being validated, and compares results.
+// Callers only ever see the wrapped Service's results: shadow calls run in
+// the background, after it has answered, and their outcome is only counted
+// in comparisons, labeled by method and result, and logged when it diverges.
+//
+// Unlike a MigrationService, the shadow isn't kept in sync: mirrored writes
+// are dry runs, and may reach it out of order.
+func ShadowingMiddleware(shadow Service, opts ShadowOptions, comparisons metrics.Counter, logger Logger, options ...Option) Middleware {
+	o := makeOptions(options)
+	if opts.Rate <= 0 || opts.Rate > 1 {
+		opts.Rate = 1
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = 5 * time.Second
+	}
+	if opts.MaxInFlight <= 0 {
+		opts.MaxInFlight = 100
+	}
+	return func(next Service) Service {
+		return &shadowingMiddleware{
+			Service:     next,
+			shadow:      shadow,
+			opts:        opts,
+			comparisons: comparisons,
+			logger:      logger,
+			rand:        o.rand,
+			inFlight:    make(chan struct{}, opts.MaxInFlight),
+		}
+	}
+}
+
+type shadowingMiddleware struct {
+	Service
+	shadow      Service
+	opts        ShadowOptions
+	comparisons metrics.Counter
+	logger      Logger
+	rand        Rand
+	inFlight    chan struct{}
+}
+
+// mirror runs op against the shadow in the background, if the call is
+// sampled and there's room, and reports whether it diverged from the
+// primary's v and err.
+func (mw *shadowingMiddleware) mirror(ctx context.Context, method string, v interface{}, err error, op func(context.Context) (interface{}, error)) {
+	if mw.opts.Rate < 1 && !sampled(mw.rand, mw.opts.Rate) {
+		return
+	}
+	select {
+	case mw.inFlight <- struct{}{}:
+	default:
+		mw.comparisons.With("method", method, "result", ShadowDropped).Add(1)
+		return
+	}
+	// The shadow call outlives the request, but keeps its values.
+	ctx, cancel := context.WithTimeout(detached{ctx}, mw.opts.Timeout)
+	go func() {
+		defer func() { <-mw.inFlight }()
+		defer cancel()
+		shadow, shadowErr := op(ctx)
+		if err != shadowErr || !reflect.DeepEqual(v, shadow) {
+			mw.comparisons.With("method", method, "result", ShadowDiverged).Add(1)
+			mw.logger.Log("method", method, "divergence", true, "err", err, "shadow_err", shadowErr)
+			return
+		}
+		mw.comparisons.With("method", method, "result", ShadowMatch).Add(1)
+	}()
+}
+
+// mirrorWrite mirrors a write as a dry run, if ShadowOptions.Writes is set.
+// Only errors are compared.
+func (mw *shadowingMiddleware) mirrorWrite(ctx context.Context, method string, err error, op func(context.Context) error) {
+	if !mw.opts.Writes {
+		return
+	}
+	mw.mirror(WithDryRun(ctx), method, nil, err, func(ctx context.Context) (interface{}, error) { return nil, op(ctx) })
+}
+
+// detached is a context with the values of another one, but none of its
+// cancellation.
+type detached struct{ parent context.Context }
+
+func (detached) Deadline() (time.Time, bool)         { return time.Time{}, false }
+func (detached) Done() <-chan struct{}               { return nil }
+func (detached) Err() error                          { return nil }
+func (d detached) Value(key interface{}) interface{} { return d.parent.Value(key) }
+
+func (mw *shadowingMiddleware) GetCustomer(ctx context.Context, id string) (Customer, error) {
+	p, err := mw.Service.GetCustomer(ctx, id)
+	mw.mirror(ctx, "GetCustomer", p, err, func(ctx context.Context) (interface{}, error) { return mw.shadow.GetCustomer(ctx, id) })
+	return p, err
+}
+
+func (mw *shadowingMiddleware) GetCustomerAsOf(ctx context.Context, id string, t time.Time) (Customer, error) {
+	p, err := mw.Service.GetCustomerAsOf(ctx, id, t)
+	mw.mirror(ctx, "GetCustomerAsOf", p, err, func(ctx context.Context) (interface{}, error) { return mw.shadow.GetCustomerAsOf(ctx, id, t) })
+	return p, err
+}
+
+func (mw *shadowingMiddleware) GetCustomerByExternalID(ctx context.Context, system, externalID string) (Customer, error) {
+	p, err := mw.Service.GetCustomerByExternalID(ctx, system, externalID)
+	mw.mirror(ctx, "GetCustomerByExternalID", p, err, func(ctx context.Context) (interface{}, error) {
+		return mw.shadow.GetCustomerByExternalID(ctx, system, externalID)
+	})
+	return p, err
+}
+
+func (mw *shadowingMiddleware) GetCustomers(ctx context.Context, f CustomerFilter) ([]Customer, error) {
+	customers, err := mw.Service.GetCustomers(ctx, f)
+	mw.mirror(ctx, "GetCustomers", customers, err, func(ctx context.Context) (interface{}, error) { return mw.shadow.GetCustomers(ctx, f) })
+	return customers, err
+}
+
+func (mw *shadowingMiddleware) QueryCustomers(ctx context.Context, q CustomerQuery) (CustomerPage, error) {
+	page, err := QueryCustomers(ctx, mw.Service, q)
+	mw.mirror(ctx, "QueryCustomers", page, err, func(ctx context.Context) (interface{}, error) { return QueryCustomers(ctx, mw.shadow, q) })
+	return page, err
+}
+
+func (mw *shadowingMiddleware) GetAddresses(ctx context.Context, customerID string) ([]Address, error) {
+	addresses, err := mw.Service.GetAddresses(ctx, customerID)
+	mw.mirror(ctx, "GetAddresses", addresses, err, func(ctx context.Context) (interface{}, error) { return mw.shadow.GetAddresses(ctx, customerID) })
+	return addresses, err
+}
+
+func (mw *shadowingMiddleware) GetAddress(ctx context.Context, customerID string, addressID string) (Address, error) {
+	a, err := mw.Service.GetAddress(ctx, customerID, addressID)
+	mw.mirror(ctx, "GetAddress", a, err, func(ctx context.Context) (interface{}, error) {
+		return mw.shadow.GetAddress(ctx, customerID, addressID)
+	})
+	return a, err
+}
+
+func (mw *shadowingMiddleware) GetCustomersByRegion(ctx context.Context) ([]RegionCount, error) {
+	regions, err := mw.Service.GetCustomersByRegion(ctx)
+	mw.mirror(ctx, "GetCustomersByRegion", regions, err, func(ctx context.Context) (interface{}, error) { return mw.shadow.GetCustomersByRegion(ctx) })
+	return regions, err
+}
+
+func (mw *shadowingMiddleware) ValidateCustomer(ctx context.Context, p Customer) ([]FieldError, error) {
+	errs, err := mw.Service.ValidateCustomer(ctx, p)
+	mw.mirror(ctx, "ValidateCustomer", errs, err, func(ctx context.Context) (interface{}, error) { return mw.shadow.ValidateCustomer(ctx, p) })
+	return errs, err
+}
+
+func (mw *shadowingMiddleware) ValidateAddress(ctx context.Context, customerID string, a Address) ([]FieldError, error) {
+	errs, err := mw.Service.ValidateAddress(ctx, customerID, a)
+	mw.mirror(ctx, "ValidateAddress", errs, err, func(ctx context.Context) (interface{}, error) { return mw.shadow.ValidateAddress(ctx, customerID, a) })
+	return errs, err
+}
+
+func (mw *shadowingMiddleware) GetConsents(ctx context.Context, customerID string) ([]Consent, error) {
+	consents, err := mw.Service.GetConsents(ctx, customerID)
+	mw.mirror(ctx, "GetConsents", consents, err, func(ctx context.Context) (interface{}, error) { return mw.shadow.GetConsents(ctx, customerID) })
+	return consents, err
+}
+
+func (mw *shadowingMiddleware) GetDuplicateAddresses(ctx context.Context) ([]DuplicateAddresses, error) {
+	duplicates, err := mw.Service.GetDuplicateAddresses(ctx)
+	mw.mirror(ctx, "GetDuplicateAddresses", duplicates, err, func(ctx context.Context) (interface{}, error) { return mw.shadow.GetDuplicateAddresses(ctx) })
+	return duplicates, err
+}
+
+func (mw *shadowingMiddleware) RepairAddresses(ctx context.Context, dryRun bool) ([]AddressRepair, error) {
+	repairs, err := mw.Service.RepairAddresses(ctx, dryRun)
+	if mw.opts.Writes {
+		mw.mirror(WithDryRun(ctx), "RepairAddresses", repairs, err, func(ctx context.Context) (interface{}, error) {
+			return mw.shadow.RepairAddresses(ctx, dryRun)
+		})
+	}
+	return repairs, err
+}
+
+// GetCustomerStats isn't mirrored: the figures depend on when each backend
+// saw the writes, so they would always diverge. Neither are RebuildIndex,
+// GetIndexRebuild and CheckConsistency, which are maintenance of the primary
+// alone.
+
+func (mw *shadowingMiddleware) PostCustomer(ctx context.Context, p Customer) error {
+	err := mw.Service.PostCustomer(ctx, p)
+	mw.mirrorWrite(ctx, "PostCustomer", err, func(ctx context.Context) error { return mw.shadow.PostCustomer(ctx, p) })
+	return err
+}
+
+func (mw *shadowingMiddleware) PutCustomer(ctx context.Context, id string, p Customer) error {
+	err := mw.Service.PutCustomer(ctx, id, p)
+	mw.mirrorWrite(ctx, "PutCustomer", err, func(ctx context.Context) error { return mw.shadow.PutCustomer(ctx, id, p) })
+	return err
+}
+
+func (mw *shadowingMiddleware) PatchCustomer(ctx context.Context, id string, p Customer) error {
+	err := mw.Service.PatchCustomer(ctx, id, p)
+	mw.mirrorWrite(ctx, "PatchCustomer", err, func(ctx context.Context) error { return mw.shadow.PatchCustomer(ctx, id, p) })
+	return err
+}
+
+func (mw *shadowingMiddleware) DeleteCustomer(ctx context.Context, id string) error {
+	err := mw.Service.DeleteCustomer(ctx, id)
+	mw.mirrorWrite(ctx, "DeleteCustomer", err, func(ctx context.Context) error { return mw.shadow.DeleteCustomer(ctx, id) })
+	return err
+}
+
+func (mw *shadowingMiddleware) PostAddress(ctx context.Context, customerID string, a Address) (Address, error) {
+	created, err := mw.Service.PostAddress(ctx, customerID, a)
+	mw.mirrorWrite(ctx, "PostAddress", err, func(ctx context.Context) error {
+		_, err := mw.shadow.PostAddress(ctx, customerID, a)
+		return err
+	})
+	return created, err
+}
+
+func (mw *shadowingMiddleware) DeleteAddress(ctx context.Context, customerID string, addressID string) error {
+	err := mw.Service.DeleteAddress(ctx, customerID, addressID)
+	mw.mirrorWrite(ctx, "DeleteAddress", err, func(ctx context.Context) error { return mw.shadow.DeleteAddress(ctx, customerID, addressID) })
+	return err
+}
+
+func (mw *shadowingMiddleware) PostAddresses(ctx context.Context, customerID string, as []Address) ([]AddressResult, error) {
+	results, err := mw.Service.PostAddresses(ctx, customerID, as)
+	if mw.opts.Writes {
+		mw.mirror(WithDryRun(ctx), "PostAddresses", results, err, func(ctx context.Context) (interface{}, error) {
+			return mw.shadow.PostAddresses(ctx, customerID, as)
+		})
+	}
+	return results, err
+}
+
+func (mw *shadowingMiddleware) ReorderAddresses(ctx context.Context, customerID string, addressIDs []string) error {
+	err := mw.Service.ReorderAddresses(ctx, customerID, addressIDs)
+	mw.mirrorWrite(ctx, "ReorderAddresses", err, func(ctx context.Context) error { return mw.shadow.ReorderAddresses(ctx, customerID, addressIDs) })
+	return err
+}
+
+func (mw *shadowingMiddleware) ArchiveCustomer(ctx context.Context, id string) error {
+	err := mw.Service.ArchiveCustomer(ctx, id)
+	mw.mirrorWrite(ctx, "ArchiveCustomer", err, func(ctx context.Context) error { return mw.shadow.ArchiveCustomer(ctx, id) })
+	return err
+}
+
+func (mw *shadowingMiddleware) UnarchiveCustomer(ctx context.Context, id string) error {
+	err := mw.Service.UnarchiveCustomer(ctx, id)
+	mw.mirrorWrite(ctx, "UnarchiveCustomer", err, func(ctx context.Context) error { return mw.shadow.UnarchiveCustomer(ctx, id) })
+	return err
+}
+
+func (mw *shadowingMiddleware) WithdrawConsent(ctx context.Context, customerID string, consentType string) error {
+	err := mw.Service.WithdrawConsent(ctx, customerID, consentType)
+	mw.mirrorWrite(ctx, "WithdrawConsent", err, func(ctx context.Context) error { return mw.shadow.WithdrawConsent(ctx, customerID, consentType) })
+	return err
+}
+
+func (mw *shadowingMiddleware) GrantConsent(ctx context.Context, customerID string, c Consent) (Consent, error) {
+	granted, err := mw.Service.GrantConsent(ctx, customerID, c)
+	mw.mirrorWrite(ctx, "GrantConsent", err, func(ctx context.Context) error {
+		_, err := mw.shadow.GrantConsent(ctx, customerID, c)
+		return err
+	})
+	return granted, err
+}
+
+// PrepareCustomer, CommitCustomer and AbortCustomer aren't mirrored: the
+// shadow would never have the prepared customer a commit refers to.
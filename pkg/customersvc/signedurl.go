@@ -0,0 +1,226 @@
+package customersvc
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/go-kit/kit/endpoint"
+	"github.com/go-kit/kit/metrics"
+	"github.com/gorilla/mux"
+)
+
+var (
+	// ErrInvalidSignature is returned when a signed URL has been tampered
+	// with, or was minted with a different key.
+	ErrInvalidSignature = errors.New("invalid signature")
+	// ErrSignatureExpired is returned when a signed URL is used after its
+	// expiry time.
+	ErrSignatureExpired = errors.New("signature expired")
+)
+
+// URLSigner mints and verifies short-lived signed URLs. A signed URL grants
+// GET access to exactly one path until it expires, without any other
+// credentials, which makes it suitable for support links and email
+// deep-links.
+type URLSigner struct {
+	key     []byte
+	maxTTL  time.Duration
+	clock   Clock
+	rand    Rand
+	nonces  NonceStore // nil unless URLs are single-use
+	replays metrics.Counter
+}
+
+// NewURLSigner returns a URLSigner using the given HMAC key. Requested TTLs
+// are capped at maxTTL. URLs are reusable until they expire, unless the
+// WithNonceStore option is given.
+func NewURLSigner(key []byte, maxTTL time.Duration, opts ...Option) *URLSigner {
+	o := makeOptions(opts)
+	return &URLSigner{
+		key:     key,
+		maxTTL:  maxTTL,
+		clock:   o.clock,
+		rand:    o.rand,
+		nonces:  o.nonces,
+		replays: o.replays,
+	}
+}
+
+// Sign returns path with exp and sig query parameters appended, and the time
+// at which it stops being valid, for requests made by tenant. Single-use URLs
+// also get a nonce parameter, and those of tenants other than DefaultTenant
+// a tenant parameter.
+func (s *URLSigner) Sign(tenant, path string, ttl time.Duration) (string, time.Time, error) {
+	if ttl <= 0 || ttl > s.maxTTL {
+		ttl = s.maxTTL
+	}
+	expires := s.clock.Now().Add(ttl).Truncate(time.Second)
+	exp := strconv.FormatInt(expires.Unix(), 10)
+	q := url.Values{}
+	q.Set("exp", exp)
+	var nonce string
+	if s.nonces != nil {
+		b := make([]byte, 16)
+		if _, err := s.rand.Read(b); err != nil {
+			return "", time.Time{}, err
+		}
+		nonce = hex.EncodeToString(b)
+		q.Set("nonce", nonce)
+	}
+	if tenant != DefaultTenant {
+		q.Set("tenant", tenant)
+	}
+	q.Set("sig", s.mac(path, exp, nonce, tenant))
+	return path + "?" + q.Encode(), expires, nil
+}
+
+// Verify checks the exp, nonce, tenant and sig query parameters of r against
+// its path, and returns the tenant the URL was signed for. For single-use
+// URLs, it also marks the nonce as used.
+func (s *URLSigner) Verify(r *http.Request) (tenant string, err error) {
+	q := r.URL.Query()
+	exp, nonce, sig := q.Get("exp"), q.Get("nonce"), q.Get("sig")
+	tenant = q.Get("tenant")
+	if tenant == "" {
+		tenant = DefaultTenant
+	}
+	if !hmac.Equal([]byte(sig), []byte(s.mac(r.URL.EscapedPath(), exp, nonce, tenant))) {
+		return "", ErrInvalidSignature
+	}
+	unix, err := strconv.ParseInt(exp, 10, 64)
+	if err != nil {
+		return "", ErrInvalidSignature
+	}
+	expires := time.Unix(unix, 0)
+	if s.clock.Now().After(expires) {
+		return "", ErrSignatureExpired
+	}
+	if s.nonces == nil {
+		return tenant, nil
+	}
+	if nonce == "" {
+		return "", ErrInvalidSignature // minted before URLs became single-use
+	}
+	fresh, err := s.nonces.Use(r.Context(), nonce, expires)
+	if err != nil {
+		return "", err
+	}
+	if !fresh {
+		s.replays.Add(1)
+		return "", ErrReplayed
+	}
+	return tenant, nil
+}
+
+// mac signs the method, path, expiry, nonce and tenant. Reusable URLs have
+// no nonce, and those of DefaultTenant no tenant, and sign the same string as
+// before nonces and tenants existed.
+func (s *URLSigner) mac(path, exp, nonce, tenant string) string {
+	h := hmac.New(sha256.New, s.key)
+	h.Write([]byte("GET\n" + path + "\n" + exp))
+	if nonce != "" {
+		h.Write([]byte("\n" + nonce))
+	}
+	if tenant != DefaultTenant {
+		h.Write([]byte("\ntenant:" + tenant))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+type signedAccessKey struct{}
+
+// SignedAccess reports whether the request carrying ctx was authorized by a
+// valid signed URL.
+func SignedAccess(ctx context.Context) bool {
+	_, ok := signedTenant(ctx)
+	return ok
+}
+
+// signedTenant returns the tenant of the signed URL that authorized the
+// request carrying ctx, if one did.
+func signedTenant(ctx context.Context) (string, bool) {
+	tenant, ok := ctx.Value(signedAccessKey{}).(string)
+	return tenant, ok
+}
+
+// SignedURLMiddleware verifies requests that carry a sig query parameter.
+// Valid ones are marked via SignedAccess, and made by the URL's tenant, see
+// TenantFrom; invalid or expired ones are rejected with 403. Requests
+// without a signature pass through untouched.
+func SignedURLMiddleware(s *URLSigner) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Query().Get("sig") == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if r.Method != "GET" {
+				encodeError(r.Context(), ErrInvalidSignature, w)
+				return
+			}
+			tenant, err := s.Verify(r)
+			if err != nil {
+				encodeError(r.Context(), err, w)
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), signedAccessKey{}, tenant)))
+		})
+	}
+}
+
+// MakeSignURLEndpoint returns an endpoint that mints a signed URL for a single
+// customer, of the calling tenant. It checks that the customer exists, so links aren't handed out
+// for resources that would 404.
+func MakeSignURLEndpoint(s Service, signer *URLSigner) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(signURLRequest)
+		if _, e := s.GetCustomer(ctx, req.ID); e != nil {
+			return signURLResponse{Err: e}, nil
+		}
+		u, expires, e := signer.Sign(TenantFrom(ctx), "/customers/"+url.PathEscape(req.ID), req.TTL)
+		return signURLResponse{URL: u, Expires: expires, Err: e}, nil
+	}
+}
+
+type signURLRequest struct {
+	ID  string
+	TTL time.Duration
+}
+
+type signURLResponse struct {
+	URL     string    `json:"url,omitempty" xml:"url,omitempty"`
+	Expires time.Time `json:"expires,omitempty" xml:"expires,omitempty"`
+	Err     error     `json:"err,omitempty" xml:"-"`
+}
+
+func (r signURLResponse) error() error { return r.Err }
+
+func decodeSignURLRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	vars := mux.Vars(r)
+	id, ok := vars["id"]
+	if !ok {
+		return nil, ErrBadRouting
+	}
+	var body struct {
+		TTL string `json:"ttl" xml:"ttl"`
+	}
+	if r.ContentLength != 0 {
+		if err := decodeBody(r, &body); err != nil {
+			return nil, err
+		}
+	}
+	var ttl time.Duration
+	if body.TTL != "" {
+		if ttl, err = time.ParseDuration(body.TTL); err != nil {
+			return nil, err
+		}
+	}
+	return signURLRequest{ID: id, TTL: ttl}, nil
+}
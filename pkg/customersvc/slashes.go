@@ -0,0 +1,112 @@
+package customersvc
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// SlashPolicy is how MakeHTTPHandler treats request paths that only match a
+// route once duplicate slashes are collapsed, or a trailing slash is added or
+// removed, e.g. /customers or //customers/ for /customers/.
+type SlashPolicy int
+
+const (
+	// SlashStrict answers such paths with 404, as routes are declared. It's
+	// the default.
+	SlashStrict SlashPolicy = iota
+	// SlashRedirect redirects them to the route's path: 301 for GET and
+	// HEAD, and 308 for other methods, so that the method and body are
+	// kept.
+	SlashRedirect
+	// SlashRewrite serves them as if the route's path had been requested.
+	SlashRewrite
+)
+
+// ParseSlashPolicy parses "strict", "redirect" or "rewrite".
+func ParseSlashPolicy(s string) (SlashPolicy, error) {
+	switch s {
+	case "strict":
+		return SlashStrict, nil
+	case "redirect":
+		return SlashRedirect, nil
+	case "rewrite":
+		return SlashRewrite, nil
+	}
+	return SlashStrict, fmt.Errorf("unknown slash policy %q", s)
+}
+
+// WithSlashPolicy sets how paths with missing, extra or duplicate slashes are
+// treated.
+func WithSlashPolicy(p SlashPolicy) HandlerOption {
+	return func(c *handlerConfig) { c.slashes = p }
+}
+
+// slashMiddleware applies policy to requests that don't match a route of r as
+// they are, but do once their path is normalized.
+func slashMiddleware(r *mux.Router, policy SlashPolicy) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if policy == SlashStrict {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			path, ok := routablePath(r, req)
+			if !ok || path == req.URL.Path {
+				next.ServeHTTP(w, req)
+				return
+			}
+			if policy == SlashRedirect {
+				u := *req.URL
+				u.Path, u.RawPath = path, ""
+				code := http.StatusPermanentRedirect
+				if req.Method == "GET" || req.Method == "HEAD" {
+					code = http.StatusMovedPermanently
+				}
+				http.Redirect(w, req, u.RequestURI(), code)
+				return
+			}
+			next.ServeHTTP(w, withPath(req, path))
+		})
+	}
+}
+
+// routablePath returns the path, among req's own and its normalized
+// variants, that matches a route of r.
+func routablePath(r *mux.Router, req *http.Request) (string, bool) {
+	path := req.URL.Path
+	if matches(r, req, path) {
+		return path, true
+	}
+	for strings.Contains(path, "//") {
+		path = strings.Replace(path, "//", "/", -1)
+	}
+	candidates := []string{path}
+	if strings.HasSuffix(path, "/") && path != "/" {
+		candidates = append(candidates, strings.TrimSuffix(path, "/"))
+	} else {
+		candidates = append(candidates, path+"/")
+	}
+	for _, candidate := range candidates {
+		if matches(r, req, candidate) {
+			return candidate, true
+		}
+	}
+	return "", false
+}
+
+func matches(r *mux.Router, req *http.Request, path string) bool {
+	var m mux.RouteMatch
+	return r.Match(withPath(req, path), &m) && m.MatchErr == nil
+}
+
+// withPath returns a shallow copy of req for path.
+func withPath(req *http.Request, path string) *http.Request {
+	u := *req.URL
+	u.Path, u.RawPath = path, ""
+	req2 := new(http.Request)
+	*req2 = *req
+	req2.URL = &u
+	return req2
+}
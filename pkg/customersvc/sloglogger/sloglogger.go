@@ -0,0 +1,57 @@
+//go:build go1.21
+
+// Package sloglogger adapts a log/slog logger to a customersvc.Logger.
+package sloglogger
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/praveensastry/customersvc/pkg/customersvc"
+)
+
+// New returns a customersvc.Logger writing each event to logger. The values
+// of the "level" and "msg" keys, if any, become the slog level and message;
+// events without a level are logged at info. Every other pair becomes an
+// attribute.
+func New(logger *slog.Logger) customersvc.Logger {
+	return slogLogger{logger}
+}
+
+type slogLogger struct{ logger *slog.Logger }
+
+var levels = map[string]slog.Level{
+	"debug": slog.LevelDebug,
+	"info":  slog.LevelInfo,
+	"warn":  slog.LevelWarn,
+	"error": slog.LevelError,
+}
+
+func (l slogLogger) Log(keyvals ...interface{}) error {
+	var (
+		lvl   = slog.LevelInfo
+		msg   string
+		attrs = make([]slog.Attr, 0, (len(keyvals)+1)/2)
+	)
+	for i := 0; i < len(keyvals); i += 2 {
+		key := fmt.Sprint(keyvals[i])
+		var value interface{} = "(MISSING)"
+		if i+1 < len(keyvals) {
+			value = keyvals[i+1]
+		}
+		switch key {
+		case "level":
+			if v, ok := levels[strings.ToLower(fmt.Sprint(value))]; ok {
+				lvl = v
+			}
+		case "msg":
+			msg = fmt.Sprint(value)
+		default:
+			attrs = append(attrs, slog.Any(key, value))
+		}
+	}
+	l.logger.LogAttrs(context.Background(), lvl, msg, attrs...)
+	return nil
+}
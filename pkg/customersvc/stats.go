@@ -0,0 +1,97 @@
+package customersvc
+
+import (
+	"context"
+	"time"
+)
+
+// StatsProvider computes CustomerStats. It's part of Service, so that each
+// backend can answer from whatever it already tracks, e.g. a SQL store from
+// its timestamp columns and audit table, rather than the figures being
+// derived from full reads of the customer.
+type StatsProvider interface {
+	GetCustomerStats(ctx context.Context, id string) (CustomerStats, error)
+}
+
+// CustomerStats are derived figures about a single customer, for support
+// dashboards.
+type CustomerStats struct {
+	Addresses         int       `json:"addresses" xml:"addresses"`
+	Created           time.Time `json:"created" xml:"created"`
+	DaysSinceCreation int       `json:"days_since_creation" xml:"days_since_creation"`
+	LastUpdated       time.Time `json:"last_updated" xml:"last_updated"`
+	// Events counts the changes made to the customer by kind, e.g.
+	// "updated" or "address_added".
+	Events map[string]int `json:"events,omitempty" xml:"-"`
+}
+
+// Event kinds counted in CustomerStats.Events.
+const (
+	EventCreated            = "created"
+	EventUpdated            = "updated"
+	EventAddressAdded       = "address_added"
+	EventAddressRemoved     = "address_removed"
+	EventAddressesReordered = "addresses_reordered"
+	EventArchived           = "archived"
+	EventUnarchived         = "unarchived"
+)
+
+// customerHistory is what the inmem store tracks about each customer, beyond
+// the customer itself, to provide CustomerStats.
+type customerHistory struct {
+	created, updated time.Time
+	events           map[string]int
+}
+
+// record journals p as the new state of customer id, then stores it, notes
+// n events of the given kind for it, and keeps it as a revision. The caller
+// must have indexed the external IDs of p, which are unindexed again if the
+// journal fails, and must hold the write lock.
+func (s *inmemService) record(id, event string, n int, p Customer) error {
+	now := s.clock.Now()
+	err := s.persist(journalRecord{At: now, Op: opWrite, ID: id, Event: event, N: n, Customer: p}, func() {
+		s.customers[id] = p
+		s.track(id, event, n, now)
+	})
+	if err != nil {
+		// Back to the external IDs of the customer as it still is.
+		s.indexExternalIDs(id, p.ExternalIDs, s.customers[id].ExternalIDs)
+	}
+	return err
+}
+
+// track is record without the journal, for replaying it.
+func (s *inmemService) track(id, event string, n int, now time.Time) {
+	h, ok := s.history[id]
+	if !ok || event == EventCreated {
+		h = &customerHistory{created: now, events: map[string]int{}}
+		s.history[id] = h
+	}
+	h.updated = now
+	h.events[event] += n
+	s.snapshot(id, now)
+}
+
+// GetCustomerStats implements StatsProvider from the history the store
+// keeps as customers are written.
+func (s *inmemService) GetCustomerStats(ctx context.Context, id string) (CustomerStats, error) {
+	if err := s.rlock(ctx); err != nil {
+		return CustomerStats{}, err
+	}
+	defer s.mtx.RUnlock()
+	p, ok := s.customers[id]
+	if !ok {
+		return CustomerStats{}, ErrNotFound
+	}
+	stats := CustomerStats{Addresses: len(p.Addresses)}
+	if h, ok := s.history[id]; ok {
+		stats.Created = h.created
+		stats.DaysSinceCreation = int(s.clock.Now().Sub(h.created) / (24 * time.Hour))
+		stats.LastUpdated = h.updated
+		stats.Events = make(map[string]int, len(h.events))
+		for event, n := range h.events {
+			stats.Events[event] = n
+		}
+	}
+	return stats, nil
+}
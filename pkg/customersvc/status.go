@@ -0,0 +1,296 @@
+package customersvc
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+
+	httptransport "github.com/go-kit/kit/transport/http"
+	"github.com/gorilla/mux"
+
+	"github.com/praveensastry/customersvc/pkg/config"
+	"github.com/praveensastry/customersvc/pkg/version"
+)
+
+// Values of Status.Status and DependencyStatus.Status.
+const (
+	StatusOK       = "ok"
+	StatusDegraded = "degraded" // a dependency is failing
+	StatusFailing  = "failing"
+	StatusUnknown  = "unknown" // not probed yet
+)
+
+const (
+	// statusSamples is the number of round trips per dependency the
+	// latencies reported are computed from.
+	statusSamples = 20
+	// statusBucket and statusBuckets make up the window over which the
+	// error rate is computed.
+	statusBucket  = time.Minute
+	statusBuckets = 5
+	// statusProbeID is the customer store probes read. It doesn't exist, so
+	// that the probe is a round trip touching nothing.
+	statusProbeID = "status-probe"
+)
+
+// StatusProbe times a round trip to a dependency of the server.
+type StatusProbe struct {
+	Name  string
+	Probe func(ctx context.Context) error
+}
+
+// StoreProbe returns a StatusProbe named "store" reading a customer that
+// doesn't exist from s.
+func StoreProbe(s Service) StatusProbe {
+	return StatusProbe{Name: "store", Probe: func(ctx context.Context) error {
+		if _, err := s.GetCustomer(ctx, statusProbeID); err != nil && err != ErrNotFound {
+			return err
+		}
+		return nil
+	}}
+}
+
+// Status is the response of GET /status.
+type Status struct {
+	// Status is StatusOK, or StatusDegraded if a dependency is failing.
+	Status        string             `json:"status"`
+	Started       time.Time          `json:"started"`
+	UptimeSeconds int64              `json:"uptime_seconds"`
+	Build         BuildInfo          `json:"build"`
+	Dependencies  []DependencyStatus `json:"dependencies"`
+	Requests      RequestRate        `json:"requests"`
+	// Features are the states of the feature flags in the reloadable
+	// config.
+	Features map[string]bool `json:"features"`
+}
+
+// BuildInfo identifies the server binary.
+type BuildInfo struct {
+	Version   string `json:"version"`
+	Revision  string `json:"revision"`
+	GoVersion string `json:"go_version"`
+}
+
+// DependencyStatus is how the last round trips to a dependency went.
+// Latencies are in milliseconds, over up to the last 20 round trips.
+type DependencyStatus struct {
+	Name     string     `json:"name"`
+	Status   string     `json:"status"`
+	Error    string     `json:"error,omitempty"`
+	Checked  *time.Time `json:"checked,omitempty"`
+	Samples  int        `json:"samples"`
+	LastMS   float64    `json:"last_ms"`
+	MedianMS float64    `json:"median_ms"`
+	MaxMS    float64    `json:"max_ms"`
+}
+
+// RequestRate counts the requests served over the last few minutes, and
+// those that failed with a 5xx status.
+type RequestRate struct {
+	WindowSeconds int     `json:"window_seconds"`
+	Total         int     `json:"total"`
+	Errors        int     `json:"errors"`
+	ErrorRate     float64 `json:"error_rate"`
+}
+
+// StatusPage gathers what GET /status reports: how long the server has been
+// up, what it was built from, how its dependencies are responding, how many
+// requests it's failing, and which feature flags are on. It's meant to be
+// embedded in a public status page, and unlike GET /version, it says how
+// the server is doing, not merely that it's up. Dependencies are probed by
+// RunStatusProbes; requests are counted by the handler it's mounted in.
+type StatusPage struct {
+	started time.Time
+	clock   Clock
+	cfg     config.Config
+	probes  []StatusProbe
+
+	mtx     sync.Mutex
+	deps    map[string]*dependencySamples
+	buckets [statusBuckets]requestBucket
+}
+
+type dependencySamples struct {
+	latencies []time.Duration // the last statusSamples, oldest first
+	checked   time.Time
+	err       error
+}
+
+type requestBucket struct {
+	start         time.Time
+	total, errors int
+}
+
+// NewStatusPage returns a StatusPage probing probes, reporting the feature
+// flags of cfg, which may be nil. Mount it with WithStatusPage.
+func NewStatusPage(cfg config.Config, probes []StatusProbe, options ...Option) *StatusPage {
+	o := makeOptions(options)
+	if cfg == nil {
+		cfg = config.Static{}
+	}
+	deps := make(map[string]*dependencySamples, len(probes))
+	for _, p := range probes {
+		deps[p.Name] = &dependencySamples{}
+	}
+	return &StatusPage{
+		started: o.clock.Now(),
+		clock:   o.clock,
+		cfg:     cfg,
+		probes:  probes,
+		deps:    deps,
+	}
+}
+
+// WithStatusPage serves GET /status from p, and counts the requests served
+// for it. Like GET /version, it needs no API key and isn't rate limited.
+func WithStatusPage(p *StatusPage) HandlerOption {
+	return func(c *handlerConfig) { c.status = p }
+}
+
+// RunStatusProbes probes the dependencies of p every interval, each round
+// trip bounded by interval, until done is closed. The first probes are sent
+// at once.
+func RunStatusProbes(p *StatusPage, interval time.Duration, done <-chan struct{}) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		p.probe(interval)
+		select {
+		case <-t.C:
+		case <-done:
+			return
+		}
+	}
+}
+
+// probe times a round trip to each dependency.
+func (p *StatusPage) probe(timeout time.Duration) {
+	for _, probe := range p.probes {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		begin := p.clock.Now()
+		err := probe.Probe(ctx)
+		end := p.clock.Now()
+		cancel()
+
+		p.mtx.Lock()
+		d := p.deps[probe.Name]
+		d.checked, d.err = end, err
+		if err == nil {
+			d.latencies = append(d.latencies, end.Sub(begin))
+			if len(d.latencies) > statusSamples {
+				d.latencies = d.latencies[len(d.latencies)-statusSamples:]
+			}
+		}
+		p.mtx.Unlock()
+	}
+}
+
+// count adds a response with status to the current bucket.
+func (p *StatusPage) count(status int) {
+	now := p.clock.Now()
+	start := now.Truncate(statusBucket)
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	b := &p.buckets[start.Unix()/int64(statusBucket/time.Second)%statusBuckets]
+	if !b.start.Equal(start) {
+		*b = requestBucket{start: start} // last used a full window ago
+	}
+	b.total++
+	if status >= 500 {
+		b.errors++
+	}
+}
+
+// Status returns the current status.
+func (p *StatusPage) Status() Status {
+	now := p.clock.Now()
+	st := Status{
+		Status:        StatusOK,
+		Started:       p.started,
+		UptimeSeconds: int64(now.Sub(p.started) / time.Second),
+		Build:         BuildInfo{Version: version.VERSION, Revision: version.REVISION, GoVersion: runtime.Version()},
+		Dependencies:  []DependencyStatus{},
+		Requests:      RequestRate{WindowSeconds: int(statusBuckets * statusBucket / time.Second)},
+		Features:      map[string]bool{},
+	}
+	for name, on := range p.cfg.Get().Features {
+		st.Features[name] = on
+	}
+
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	for _, probe := range p.probes {
+		d := p.deps[probe.Name]
+		ds := DependencyStatus{Name: probe.Name, Status: StatusUnknown, Samples: len(d.latencies)}
+		if !d.checked.IsZero() {
+			checked := d.checked
+			ds.Checked = &checked
+			ds.Status = StatusOK
+		}
+		if d.err != nil {
+			ds.Status, ds.Error = StatusFailing, d.err.Error()
+			st.Status = StatusDegraded
+		}
+		if n := len(d.latencies); n > 0 {
+			sorted := append([]time.Duration(nil), d.latencies...)
+			sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+			ds.LastMS, ds.MedianMS, ds.MaxMS = milliseconds(d.latencies[n-1]), milliseconds(sorted[n/2]), milliseconds(sorted[n-1])
+		}
+		st.Dependencies = append(st.Dependencies, ds)
+	}
+	oldest := now.Truncate(statusBucket).Add(-(statusBuckets - 1) * statusBucket)
+	for _, b := range p.buckets {
+		if b.start.Before(oldest) {
+			continue
+		}
+		st.Requests.Total += b.total
+		st.Requests.Errors += b.errors
+	}
+	if st.Requests.Total > 0 {
+		st.Requests.ErrorRate = float64(st.Requests.Errors) / float64(st.Requests.Total)
+	}
+	return st
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// middleware counts the responses of next, but those of GET /status, which
+// status pages poll.
+func (p *StatusPage) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/status" {
+			next.ServeHTTP(w, req)
+			return
+		}
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(sw, req)
+		p.count(sw.status)
+	})
+}
+
+// mountStatus serves GET /status from p, outside of the endpoint
+// middlewares, as mountVersion does. It's always JSON, and may be fetched
+// by status pages on other origins.
+func mountStatus(r *mux.Router, p *StatusPage, options []httptransport.ServerOption) {
+	r.Methods("GET").Path("/status").Handler(httptransport.NewServer(
+		func(ctx context.Context, request interface{}) (interface{}, error) {
+			return p.Status(), nil
+		},
+		func(context.Context, *http.Request) (interface{}, error) { return nil, nil },
+		encodeStatusResponse,
+		options...,
+	))
+}
+
+func encodeStatusResponse(_ context.Context, w http.ResponseWriter, response interface{}) error {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	return json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,65 @@
+package customersvc
+
+import (
+	"fmt"
+
+	"github.com/go-kit/kit/metrics"
+	"github.com/go-kit/kit/metrics/discard"
+)
+
+// SlowConsumerPolicy says what a stream does for a consumer that has
+// fallen so far behind that its buffer is full, so that one slow consumer
+// can't make the server buffer without bound, or hold up what it streams.
+type SlowConsumerPolicy int
+
+const (
+	// DropOldest drops the oldest event buffered to make room for the new
+	// one, so that the consumer skips ahead. It's the default.
+	DropOldest SlowConsumerPolicy = iota
+	// Disconnect ends the consumer's stream, for consumers that would
+	// rather reconnect than miss events unawares.
+	Disconnect
+)
+
+// ParseSlowConsumerPolicy parses "drop-oldest" or "disconnect".
+func ParseSlowConsumerPolicy(s string) (SlowConsumerPolicy, error) {
+	switch s {
+	case "drop-oldest":
+		return DropOldest, nil
+	case "disconnect":
+		return Disconnect, nil
+	}
+	return DropOldest, fmt.Errorf("unknown slow consumer policy %q", s)
+}
+
+// StreamLimits bound what streams, such as that of a Tap, buffer for each
+// consumer.
+type StreamLimits struct {
+	// Buffer is the number of events buffered for each consumer. Zero
+	// means 256.
+	Buffer int
+	Policy SlowConsumerPolicy
+	// Dropped counts the events dropped for slow consumers, and
+	// Disconnects the consumers disconnected, by stream, e.g. "tap". Nil
+	// counts nothing.
+	Dropped     metrics.Counter
+	Disconnects metrics.Counter
+}
+
+func (l StreamLimits) withDefaults() StreamLimits {
+	if l.Buffer <= 0 {
+		l.Buffer = 256
+	}
+	if l.Dropped == nil {
+		l.Dropped = discard.NewCounter()
+	}
+	if l.Disconnects == nil {
+		l.Disconnects = discard.NewCounter()
+	}
+	return l
+}
+
+// WithStreamLimits bounds the buffering of the streams of a Tap.
+func WithStreamLimits(l StreamLimits) Option {
+	return func(o *options) { o.streams = l }
+}
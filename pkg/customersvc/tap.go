@@ -0,0 +1,305 @@
+package customersvc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/endpoint"
+	httptransport "github.com/go-kit/kit/transport/http"
+	"github.com/gorilla/mux"
+)
+
+var (
+	// ErrInvalidTap is returned for a tap duration that isn't a positive
+	// duration within the limit, or a sample rate outside (0, 1].
+	ErrInvalidTap = errors.New("tap duration must be a positive duration such as 30s, within the limit, and sample a rate in (0, 1]")
+	// ErrTapBusy is returned when as many taps as allowed are already
+	// streaming.
+	ErrTapBusy = errors.New("too many taps streaming")
+)
+
+// maxTaps is the number of taps that may stream at once.
+const maxTaps = 8
+
+// tapKeepAlive is how often an idle tap sends a comment, so that proxies
+// don't close it.
+const tapKeepAlive = 15 * time.Second
+
+// TapEvent summarizes a request seen by a Tap. Bodies, headers and query
+// strings are left out, so that no personal data or credentials are
+// streamed.
+type TapEvent struct {
+	Time      time.Time `json:"time"`
+	RequestID string    `json:"request_id,omitempty"`
+	Method    string    `json:"method"`
+	Path      string    `json:"path"`
+	// Route is the template of the route matched, e.g.
+	// "/customers/{id}/addresses/".
+	Route      string `json:"route,omitempty"`
+	Status     int    `json:"status"`
+	Latency    string `json:"latency"`
+	CustomerID string `json:"customer_id,omitempty"`
+}
+
+// Tap streams a live, sampled feed of request summaries to the admins
+// watching it, to diagnose incidents without access to the logs. Requests
+// are only summarized while someone is watching. Each watcher gets a buffer
+// of its own, bounded by StreamLimits.
+type Tap struct {
+	maxDuration time.Duration
+	clock       Clock
+	rand        Rand
+	limits      StreamLimits
+
+	mtx  sync.Mutex
+	subs map[*tapSubscription]bool
+}
+
+type tapSubscription struct {
+	rate   float64
+	events chan TapEvent
+	slow   chan struct{} // closed when disconnected for falling behind
+	// Guarded by the Tap's mtx:
+	dropped      int
+	disconnected bool
+}
+
+// NewTap returns a Tap whose streams last at most maxDuration, or five
+// minutes if it's zero. Mount it with WithTap. WithStreamLimits bounds
+// what it buffers for each watcher.
+func NewTap(maxDuration time.Duration, options ...Option) *Tap {
+	o := makeOptions(options)
+	if maxDuration <= 0 {
+		maxDuration = 5 * time.Minute
+	}
+	return &Tap{maxDuration: maxDuration, clock: o.clock, rand: o.rand, limits: o.streams.withDefaults(), subs: map[*tapSubscription]bool{}}
+}
+
+func (t *Tap) subscribe(rate float64) (*tapSubscription, error) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	if len(t.subs) >= maxTaps {
+		return nil, ErrTapBusy
+	}
+	sub := &tapSubscription{rate: rate, events: make(chan TapEvent, t.limits.Buffer), slow: make(chan struct{})}
+	t.subs[sub] = true
+	return sub, nil
+}
+
+// unsubscribe ends sub, returning the number of events it dropped because
+// its stream couldn't keep up.
+func (t *Tap) unsubscribe(sub *tapSubscription) int {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	delete(t.subs, sub)
+	return sub.dropped
+}
+
+func (t *Tap) watched() bool {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	return len(t.subs) > 0
+}
+
+func (t *Tap) publish(e TapEvent) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	for sub := range t.subs {
+		if sub.disconnected || (sub.rate < 1 && !sampled(t.rand, sub.rate)) {
+			continue
+		}
+		select {
+		case sub.events <- e:
+			continue
+		default:
+		}
+		// The watcher has fallen behind: never hold up the request for it.
+		sub.dropped++
+		t.limits.Dropped.With("stream", "tap").Add(1)
+		switch t.limits.Policy {
+		case Disconnect:
+			sub.disconnected = true
+			close(sub.slow)
+			t.limits.Disconnects.With("stream", "tap").Add(1)
+		default:
+			select {
+			case <-sub.events:
+			default: // taken by the watcher meanwhile
+			}
+			select {
+			case sub.events <- e:
+			default:
+			}
+		}
+	}
+}
+
+// middleware summarizes the requests to next for the watchers of the tap.
+// Routes are matched in r. It must run inside requestInfoMiddleware, for
+// request IDs. The tap endpoint itself isn't tapped.
+func (t *Tap) middleware(r *mux.Router) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if !t.watched() || req.URL.Path == "/admin/tap" {
+				next.ServeHTTP(w, req)
+				return
+			}
+			begin := t.clock.Now()
+			sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+			next.ServeHTTP(sw, req)
+			e := TapEvent{
+				Time:      begin,
+				RequestID: RequestID(req.Context()),
+				Method:    req.Method,
+				Path:      req.URL.Path,
+				Status:    sw.status,
+				Latency:   t.clock.Now().Sub(begin).String(),
+			}
+			var match mux.RouteMatch
+			if r.Match(req, &match) && match.Route != nil {
+				e.Route, _ = match.Route.GetPathTemplate()
+				if strings.HasPrefix(e.Route, "/customers/{id}") {
+					e.CustomerID = match.Vars["id"]
+				}
+			}
+			t.publish(e)
+		})
+	}
+}
+
+// statusWriter notes the status of a response.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// WithTap mounts an endpoint streaming the request summaries of t, as
+// server-sent events:
+//
+//	GET     /admin/tap?duration=30s&sample=0.1   stream a sample of requests for a while
+//
+// Each summary is a "request" event holding a TapEvent. When the duration
+// is up, an "end" event holds the number of summaries dropped because the
+// stream couldn't keep up, and the stream ends. Under the Disconnect policy,
+// it ends as soon as one is dropped, with "disconnected": true. The duration defaults to
+// 30s, or the longest the Tap allows if that's shorter, and sample to 1.
+func WithTap(t *Tap) HandlerOption {
+	return func(c *handlerConfig) { c.tap = t }
+}
+
+func mountTap(r *mux.Router, t *Tap, wrap func(string, endpoint.Endpoint) endpoint.Endpoint, options []httptransport.ServerOption) {
+	r.Methods("GET").Path("/admin/tap").Handler(httptransport.NewServer(
+		wrap("Tap", makeTapEndpoint(t)),
+		decodeTapRequest(t),
+		encodeTapResponse(t),
+		options...,
+	))
+}
+
+type tapRequest struct {
+	Duration time.Duration
+	Sample   float64
+}
+
+type tapResponse struct {
+	sub      *tapSubscription
+	duration time.Duration
+}
+
+func makeTapEndpoint(t *Tap) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(tapRequest)
+		sub, err := t.subscribe(req.Sample)
+		if err != nil {
+			return nil, err
+		}
+		return tapResponse{sub: sub, duration: req.Duration}, nil
+	}
+}
+
+func decodeTapRequest(t *Tap) httptransport.DecodeRequestFunc {
+	return func(_ context.Context, r *http.Request) (interface{}, error) {
+		req := tapRequest{Duration: 30 * time.Second, Sample: 1}
+		q := r.URL.Query()
+		if s := q.Get("duration"); s != "" {
+			d, err := time.ParseDuration(s)
+			if err != nil || d <= 0 || d > t.maxDuration {
+				return nil, ErrInvalidTap
+			}
+			req.Duration = d
+		}
+		if req.Duration > t.maxDuration {
+			req.Duration = t.maxDuration
+		}
+		if s := q.Get("sample"); s != "" {
+			rate, err := strconv.ParseFloat(s, 64)
+			if err != nil || rate <= 0 || rate > 1 {
+				return nil, ErrInvalidTap
+			}
+			req.Sample = rate
+		}
+		return req, nil
+	}
+}
+
+// encodeTapResponse streams the events of the subscription until its
+// duration is up or the client goes away, then ends it.
+func encodeTapResponse(t *Tap) httptransport.EncodeResponseFunc {
+	return func(ctx context.Context, w http.ResponseWriter, response interface{}) error {
+		resp := response.(tapResponse)
+		defer t.unsubscribe(resp.sub)
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			return errors.New("streaming unsupported by the response writer")
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("X-Accel-Buffering", "no") // for nginx
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+
+		end := time.NewTimer(resp.duration)
+		defer end.Stop()
+		keepAlive := time.NewTicker(tapKeepAlive)
+		defer keepAlive.Stop()
+		for {
+			select {
+			case e := <-resp.sub.events:
+				data, err := json.Marshal(e)
+				if err != nil {
+					return err
+				}
+				if _, err := fmt.Fprintf(w, "event: request\ndata: %s\n\n", data); err != nil {
+					return err
+				}
+			case <-keepAlive.C:
+				if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+					return err
+				}
+			case <-end.C:
+				dropped := t.unsubscribe(resp.sub)
+				_, err := fmt.Fprintf(w, "event: end\ndata: {\"dropped\": %d}\n\n", dropped)
+				return err
+			case <-resp.sub.slow:
+				dropped := t.unsubscribe(resp.sub)
+				_, err := fmt.Fprintf(w, "event: end\ndata: {\"dropped\": %d, \"disconnected\": true}\n\n", dropped)
+				return err
+			case <-ctx.Done():
+				return nil
+			}
+			flusher.Flush()
+		}
+	}
+}
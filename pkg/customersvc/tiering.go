@@ -0,0 +1,677 @@
+package customersvc
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/metrics"
+)
+
+var (
+	// ErrColdConflict is returned when a customer can't be brought back
+	// from the cold tier because another was given its ID or one of its
+	// external IDs meanwhile.
+	ErrColdConflict = errors.New("customer can't be restored from the cold tier")
+	// ErrNotTierable is returned by NewTiering for a store that isn't
+	// Tierable.
+	ErrNotTierable = errors.New("store can't be tiered")
+)
+
+// ColdCustomer is everything a store keeps about a customer, as moved to the
+// cold tier and back.
+type ColdCustomer struct {
+	Customer  Customer       `json:"customer"`
+	Consents  []Consent      `json:"consents,omitempty"`
+	Created   time.Time      `json:"created"`
+	Updated   time.Time      `json:"updated"`
+	Events    map[string]int `json:"events,omitempty"`
+	Revisions []ColdRevision `json:"revisions,omitempty"` // for GetCustomerAsOf
+	Truncated bool           `json:"truncated,omitempty"` // older revisions were dropped
+	Demoted   time.Time      `json:"demoted"`
+}
+
+// ColdRevision is a past state of a ColdCustomer.
+type ColdRevision struct {
+	At       time.Time `json:"at"`
+	Customer Customer  `json:"customer"`
+	Deleted  bool      `json:"deleted,omitempty"`
+}
+
+// ColdStore keeps the customers demoted by a Tiering, somewhere cheaper than
+// the primary store, e.g. as JSON blobs in an object store. Get returns
+// ErrNotFound for a customer it doesn't have.
+type ColdStore interface {
+	Put(ctx context.Context, c ColdCustomer) error
+	Get(ctx context.Context, id string) (ColdCustomer, error)
+	Delete(ctx context.Context, id string) error
+	// List returns the IDs of every customer in the store.
+	List(ctx context.Context) ([]string, error)
+}
+
+// Tierable is implemented by primary stores whose customers a Tiering can
+// move to a ColdStore and back, with all they keep about them.
+type Tierable interface {
+	// ExportCustomer returns customer id as it would be moved to the cold
+	// tier.
+	ExportCustomer(ctx context.Context, id string) (ColdCustomer, error)
+	// EvictCustomer drops customer id, once exported, leaving no trace.
+	EvictCustomer(ctx context.Context, id string) error
+	// ImportCustomer restores a customer exported earlier.
+	ImportCustomer(ctx context.Context, c ColdCustomer) error
+}
+
+// TieringOptions configures a Tiering.
+type TieringOptions struct {
+	// InactiveFor is how long a customer goes without being read or
+	// written before Demote moves it to the cold tier.
+	InactiveFor time.Duration
+}
+
+// Tiering moves customers inactive for a while from the primary store to a
+// cheaper ColdStore, and back when they're next asked for, so that the
+// primary store only holds those in use. Rehydration is transparent: any
+// call about a cold customer brings it back first. Lists, queries and
+// reports only cover the hot tier, however.
+//
+// Tiering keeps an index of the cold tier in memory, loaded from the
+// ColdStore by NewTiering, so it must be the only user of its ColdStore.
+//
+// A customer changing tier only holds back calls about itself while the
+// ColdStore is read or written.
+type Tiering struct {
+	cold  ColdStore
+	opts  TieringOptions
+	hits  metrics.Counter
+	clock Clock
+	next  Service
+	store Tierable
+
+	// moving is held for reading by calls about a customer, and for
+	// writing while it changes tier, by stripe of its ID.
+	moving [256]sync.RWMutex
+	// mtx guards the index of the cold tier. It's held for reading by
+	// calls about customers, and for writing while a customer is evicted
+	// from or restored to the index, never while the ColdStore is in use.
+	mtx         sync.RWMutex
+	coldIDs     map[string]bool
+	coldExt     map[externalKey]string // cold customer IDs by external ID
+	accessedMtx sync.Mutex
+	accessed    map[string]time.Time // last call about each hot customer
+}
+
+// NewTiering returns a Tiering moving customers of store, which must be
+// Tierable, to cold, counting calls about customers in hits, labeled by the
+// tier, hot or cold, they were found in. Mount it with its Middleware, and
+// demote customers with Demote, e.g. every hour with RunTiering.
+func NewTiering(ctx context.Context, store Service, cold ColdStore, opts TieringOptions, hits metrics.Counter, options ...Option) (*Tiering, error) {
+	tierable, ok := store.(Tierable)
+	if !ok {
+		return nil, ErrNotTierable
+	}
+	o := makeOptions(options)
+	t := &Tiering{
+		cold:     cold,
+		opts:     opts,
+		hits:     hits,
+		clock:    o.clock,
+		next:     store,
+		store:    tierable,
+		coldIDs:  map[string]bool{},
+		coldExt:  map[externalKey]string{},
+		accessed: map[string]time.Time{},
+	}
+	ids, err := cold.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range ids {
+		c, err := cold.Get(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		t.index(c.Customer)
+	}
+	return t, nil
+}
+
+// Middleware returns the Middleware rehydrating cold customers. It must wrap
+// the store given to NewTiering directly, and only once.
+func (t *Tiering) Middleware() Middleware {
+	return func(next Service) Service {
+		return &tieringMiddleware{Service: next, t: t}
+	}
+}
+
+// index notes p as cold. The caller must hold the write lock.
+func (t *Tiering) index(p Customer) {
+	t.coldIDs[p.ID] = true
+	for system, ext := range p.ExternalIDs {
+		t.coldExt[externalKey{system, ext}] = p.ID
+	}
+}
+
+// unindex notes p as hot. The caller must hold the write lock.
+func (t *Tiering) unindex(p Customer) {
+	delete(t.coldIDs, p.ID)
+	for system, ext := range p.ExternalIDs {
+		delete(t.coldExt, externalKey{system, ext})
+	}
+}
+
+// movingLock returns the lock held while customer id changes tier.
+func (t *Tiering) movingLock(id string) *sync.RWMutex {
+	return &t.moving[stripe(id, len(t.moving))]
+}
+
+// isCold reports whether customer id is in the cold tier.
+func (t *Tiering) isCold(id string) bool {
+	t.mtx.RLock()
+	defer t.mtx.RUnlock()
+	return t.coldIDs[id]
+}
+
+// acquire returns with customer id in the primary store, if it exists, and
+// the read locks held, rehydrating the customer if it's cold. It returns
+// the tier the customer was found in, for release.
+func (t *Tiering) acquire(ctx context.Context, id string) (string, error) {
+	moving := t.movingLock(id)
+	moving.RLock()
+	t.mtx.RLock()
+	if !t.coldIDs[id] {
+		return "hot", nil
+	}
+	t.mtx.RUnlock()
+	moving.RUnlock()
+
+	moving.Lock()
+	if t.isCold(id) { // unless rehydrated meanwhile
+		if err := t.rehydrate(ctx, id); err != nil {
+			moving.Unlock()
+			return "", err
+		}
+		t.hits.With("tier", "cold").Add(1)
+	}
+	// Noted as used before the lock is given up, so that Demote doesn't
+	// take it straight back before the call is made.
+	t.touch(id)
+	moving.Unlock()
+	moving.RLock()
+	t.mtx.RLock()
+	return "", nil // already counted
+}
+
+// release releases the read locks taken by acquire once the call about
+// customer id is done, noting its use and counting a hit in tier if it
+// succeeded.
+func (t *Tiering) release(id, tier string, err error) {
+	t.mtx.RUnlock()
+	t.movingLock(id).RUnlock()
+	if err != nil {
+		return
+	}
+	t.touch(id)
+	if tier != "" {
+		t.hits.With("tier", tier).Add(1)
+	}
+}
+
+// touch notes a call about hot customer id, including those served without
+// reaching the Tiering, e.g. by a CustomerCache.
+func (t *Tiering) touch(id string) {
+	t.accessedMtx.Lock()
+	t.accessed[id] = t.clock.Now()
+	t.accessedMtx.Unlock()
+}
+
+// coldConflict reports whether one of ids belongs to a cold customer other
+// than id. The caller must hold the lock.
+func (t *Tiering) coldConflict(id string, ids Metadata) bool {
+	for system, ext := range ids {
+		if owner, ok := t.coldExt[externalKey{system, ext}]; ok && owner != id {
+			return true
+		}
+	}
+	return false
+}
+
+// rehydrate moves customer id from the cold tier back to the primary store.
+// The caller must hold its moving lock for writing, and not mtx.
+func (t *Tiering) rehydrate(ctx context.Context, id string) error {
+	c, err := t.cold.Get(ctx, id)
+	if err != nil {
+		return err
+	}
+	// A customer both hot and cold was left behind by a rehydration that
+	// failed to delete it from the cold tier. The primary store's copy is
+	// current, since no other customer can be given the ID of a cold one.
+	if _, err := t.store.ExportCustomer(ctx, id); err == ErrNotFound {
+		if err := t.store.ImportCustomer(ctx, c); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+	if err := t.cold.Delete(ctx, id); err != nil {
+		return err
+	}
+	t.mtx.Lock()
+	t.unindex(c.Customer)
+	t.mtx.Unlock()
+	return nil
+}
+
+// Demote moves the customers that haven't been read or written for
+// InactiveFor to the cold tier, returning how many it moved. Customers whose
+// last call predates the process count as last used when last written.
+func (t *Tiering) Demote(ctx context.Context) (int, error) {
+	customers, err := t.next.GetCustomers(ctx, CustomerFilter{Archived: ArchivedInclude})
+	if err != nil {
+		return 0, err
+	}
+	var demoted int
+	for _, p := range customers {
+		last, err := t.lastUsed(ctx, p.ID)
+		if err == ErrNotFound {
+			continue // deleted meanwhile
+		}
+		if err != nil {
+			return demoted, err
+		}
+		if t.clock.Now().Sub(last) < t.opts.InactiveFor {
+			continue
+		}
+		ok, err := t.demote(ctx, p.ID, last)
+		if err != nil {
+			return demoted, err
+		}
+		if ok {
+			demoted++
+		}
+	}
+	return demoted, nil
+}
+
+// lastUsed returns when customer id was last called about, or written.
+func (t *Tiering) lastUsed(ctx context.Context, id string) (time.Time, error) {
+	t.accessedMtx.Lock()
+	last, ok := t.accessed[id]
+	t.accessedMtx.Unlock()
+	if ok {
+		return last, nil
+	}
+	stats, err := t.next.GetCustomerStats(ctx, id)
+	return stats.LastUpdated, err
+}
+
+// demote moves customer id to the cold tier, unless it was used after last.
+func (t *Tiering) demote(ctx context.Context, id string, last time.Time) (bool, error) {
+	moving := t.movingLock(id)
+	moving.Lock()
+	defer moving.Unlock()
+	t.accessedMtx.Lock()
+	used := t.accessed[id].After(last)
+	t.accessedMtx.Unlock()
+	if used {
+		return false, nil
+	}
+	c, err := t.store.ExportCustomer(ctx, id)
+	if err == ErrNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	c.Demoted = t.clock.Now()
+	// Stored cold before it's dropped, so that it's never in neither tier.
+	if err := t.cold.Put(ctx, c); err != nil {
+		return false, err
+	}
+	// Evicted and indexed at once, so that no other customer is given its
+	// external IDs meanwhile.
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	if err := t.store.EvictCustomer(ctx, id); err != nil {
+		return false, err
+	}
+	t.index(c.Customer)
+	t.accessedMtx.Lock()
+	delete(t.accessed, id)
+	t.accessedMtx.Unlock()
+	return true, nil
+}
+
+// RunTiering calls Demote on t every interval until done is closed, logging
+// the customers demoted.
+func RunTiering(t *Tiering, interval time.Duration, logger Logger, done <-chan struct{}) {
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-tick.C:
+			n, err := t.Demote(context.Background())
+			logger.Log("job", "Demote", "demoted", n, "err", err)
+		case <-done:
+			return
+		}
+	}
+}
+
+// tieringMiddleware brings cold customers back before any call about them.
+// Calls that aren't about a single customer go straight through.
+type tieringMiddleware struct {
+	Service
+	t *Tiering
+}
+
+func (mw *tieringMiddleware) PostCustomer(ctx context.Context, p Customer) error {
+	mw.t.mtx.RLock()
+	defer mw.t.mtx.RUnlock()
+	if mw.t.coldIDs[p.ID] {
+		return ErrAlreadyExists
+	}
+	if mw.t.coldConflict(p.ID, p.ExternalIDs) {
+		return ErrExternalIDConflict
+	}
+	return mw.Service.PostCustomer(ctx, p)
+}
+
+func (mw *tieringMiddleware) PrepareCustomer(ctx context.Context, p Customer, ttl time.Duration) (PendingCustomer, error) {
+	mw.t.mtx.RLock()
+	defer mw.t.mtx.RUnlock()
+	if mw.t.coldIDs[p.ID] {
+		return PendingCustomer{}, ErrAlreadyExists
+	}
+	if mw.t.coldConflict(p.ID, p.ExternalIDs) {
+		return PendingCustomer{}, ErrExternalIDConflict
+	}
+	return mw.Service.PrepareCustomer(ctx, p, ttl)
+}
+
+func (mw *tieringMiddleware) GetCustomer(ctx context.Context, id string) (Customer, error) {
+	tier, err := mw.t.acquire(ctx, id)
+	if err != nil {
+		return Customer{}, err
+	}
+	v, err := mw.Service.GetCustomer(ctx, id)
+	mw.t.release(id, tier, err)
+	return v, err
+}
+
+func (mw *tieringMiddleware) PutCustomer(ctx context.Context, id string, p Customer) error {
+	tier, err := mw.t.acquire(ctx, id)
+	if err != nil {
+		return err
+	}
+	if mw.t.coldConflict(id, p.ExternalIDs) {
+		mw.t.release(id, tier, ErrExternalIDConflict)
+		return ErrExternalIDConflict
+	}
+	err = mw.Service.PutCustomer(ctx, id, p)
+	mw.t.release(id, tier, err)
+	return err
+}
+
+func (mw *tieringMiddleware) PatchCustomer(ctx context.Context, id string, p Customer) error {
+	tier, err := mw.t.acquire(ctx, id)
+	if err != nil {
+		return err
+	}
+	if mw.t.coldConflict(id, p.ExternalIDs) {
+		mw.t.release(id, tier, ErrExternalIDConflict)
+		return ErrExternalIDConflict
+	}
+	err = mw.Service.PatchCustomer(ctx, id, p)
+	mw.t.release(id, tier, err)
+	return err
+}
+
+func (mw *tieringMiddleware) DeleteCustomer(ctx context.Context, id string) error {
+	tier, err := mw.t.acquire(ctx, id)
+	if err != nil {
+		return err
+	}
+	err = mw.Service.DeleteCustomer(ctx, id)
+	mw.t.release(id, tier, err)
+	if err == nil {
+		mw.t.accessedMtx.Lock()
+		delete(mw.t.accessed, id)
+		mw.t.accessedMtx.Unlock()
+	}
+	return err
+}
+
+func (mw *tieringMiddleware) GetAddresses(ctx context.Context, customerID string) ([]Address, error) {
+	tier, err := mw.t.acquire(ctx, customerID)
+	if err != nil {
+		return nil, err
+	}
+	v, err := mw.Service.GetAddresses(ctx, customerID)
+	mw.t.release(customerID, tier, err)
+	return v, err
+}
+
+func (mw *tieringMiddleware) GetAddress(ctx context.Context, customerID string, addressID string) (Address, error) {
+	tier, err := mw.t.acquire(ctx, customerID)
+	if err != nil {
+		return Address{}, err
+	}
+	v, err := mw.Service.GetAddress(ctx, customerID, addressID)
+	mw.t.release(customerID, tier, err)
+	return v, err
+}
+
+func (mw *tieringMiddleware) PostAddress(ctx context.Context, customerID string, a Address) (Address, error) {
+	tier, err := mw.t.acquire(ctx, customerID)
+	if err != nil {
+		return Address{}, err
+	}
+	v, err := mw.Service.PostAddress(ctx, customerID, a)
+	mw.t.release(customerID, tier, err)
+	return v, err
+}
+
+func (mw *tieringMiddleware) DeleteAddress(ctx context.Context, customerID string, addressID string) error {
+	tier, err := mw.t.acquire(ctx, customerID)
+	if err != nil {
+		return err
+	}
+	err = mw.Service.DeleteAddress(ctx, customerID, addressID)
+	mw.t.release(customerID, tier, err)
+	return err
+}
+
+func (mw *tieringMiddleware) PostAddresses(ctx context.Context, customerID string, as []Address) ([]AddressResult, error) {
+	tier, err := mw.t.acquire(ctx, customerID)
+	if err != nil {
+		return nil, err
+	}
+	v, err := mw.Service.PostAddresses(ctx, customerID, as)
+	mw.t.release(customerID, tier, err)
+	return v, err
+}
+
+func (mw *tieringMiddleware) ReorderAddresses(ctx context.Context, customerID string, addressIDs []string) error {
+	tier, err := mw.t.acquire(ctx, customerID)
+	if err != nil {
+		return err
+	}
+	err = mw.Service.ReorderAddresses(ctx, customerID, addressIDs)
+	mw.t.release(customerID, tier, err)
+	return err
+}
+
+func (mw *tieringMiddleware) ValidateAddress(ctx context.Context, customerID string, a Address) ([]FieldError, error) {
+	tier, err := mw.t.acquire(ctx, customerID)
+	if err != nil {
+		return nil, err
+	}
+	v, err := mw.Service.ValidateAddress(ctx, customerID, a)
+	mw.t.release(customerID, tier, err)
+	return v, err
+}
+
+func (mw *tieringMiddleware) ArchiveCustomer(ctx context.Context, id string) error {
+	tier, err := mw.t.acquire(ctx, id)
+	if err != nil {
+		return err
+	}
+	err = mw.Service.ArchiveCustomer(ctx, id)
+	mw.t.release(id, tier, err)
+	return err
+}
+
+func (mw *tieringMiddleware) UnarchiveCustomer(ctx context.Context, id string) error {
+	tier, err := mw.t.acquire(ctx, id)
+	if err != nil {
+		return err
+	}
+	err = mw.Service.UnarchiveCustomer(ctx, id)
+	mw.t.release(id, tier, err)
+	return err
+}
+
+func (mw *tieringMiddleware) GetCustomerStats(ctx context.Context, id string) (CustomerStats, error) {
+	tier, err := mw.t.acquire(ctx, id)
+	if err != nil {
+		return CustomerStats{}, err
+	}
+	v, err := mw.Service.GetCustomerStats(ctx, id)
+	mw.t.release(id, tier, err)
+	return v, err
+}
+
+func (mw *tieringMiddleware) GetCustomerAsOf(ctx context.Context, id string, at time.Time) (Customer, error) {
+	tier, err := mw.t.acquire(ctx, id)
+	if err != nil {
+		return Customer{}, err
+	}
+	v, err := mw.Service.GetCustomerAsOf(ctx, id, at)
+	mw.t.release(id, tier, err)
+	return v, err
+}
+
+func (mw *tieringMiddleware) GetCustomerByExternalID(ctx context.Context, system string, externalID string) (Customer, error) {
+	mw.t.mtx.RLock()
+	if id, ok := mw.t.coldExt[externalKey{system, externalID}]; ok {
+		mw.t.mtx.RUnlock()
+		return mw.GetCustomer(ctx, id)
+	}
+	p, err := mw.Service.GetCustomerByExternalID(ctx, system, externalID)
+	mw.t.mtx.RUnlock()
+	if err == nil {
+		mw.t.touch(p.ID)
+		mw.t.hits.With("tier", "hot").Add(1)
+	}
+	return p, err
+}
+
+func (mw *tieringMiddleware) GrantConsent(ctx context.Context, customerID string, c Consent) (Consent, error) {
+	tier, err := mw.t.acquire(ctx, customerID)
+	if err != nil {
+		return Consent{}, err
+	}
+	v, err := mw.Service.GrantConsent(ctx, customerID, c)
+	mw.t.release(customerID, tier, err)
+	return v, err
+}
+
+func (mw *tieringMiddleware) WithdrawConsent(ctx context.Context, customerID string, consentType string) error {
+	tier, err := mw.t.acquire(ctx, customerID)
+	if err != nil {
+		return err
+	}
+	err = mw.Service.WithdrawConsent(ctx, customerID, consentType)
+	mw.t.release(customerID, tier, err)
+	return err
+}
+
+func (mw *tieringMiddleware) GetConsents(ctx context.Context, customerID string) ([]Consent, error) {
+	tier, err := mw.t.acquire(ctx, customerID)
+	if err != nil {
+		return nil, err
+	}
+	v, err := mw.Service.GetConsents(ctx, customerID)
+	mw.t.release(customerID, tier, err)
+	return v, err
+}
+
+// ExportCustomer implements Tierable.
+func (s *inmemService) ExportCustomer(ctx context.Context, id string) (ColdCustomer, error) {
+	if err := s.rlock(ctx); err != nil {
+		return ColdCustomer{}, err
+	}
+	defer s.mtx.RUnlock()
+	p, ok := s.customers[id]
+	if !ok {
+		return ColdCustomer{}, ErrNotFound
+	}
+	c := ColdCustomer{Customer: p, Consents: s.consents[id]}
+	if h, ok := s.history[id]; ok {
+		c.Created, c.Updated, c.Events = h.created, h.updated, h.events
+	}
+	if r, ok := s.revisions[id]; ok {
+		c.Truncated = r.truncated
+		for _, rev := range r.list {
+			c.Revisions = append(c.Revisions, ColdRevision{At: rev.at, Customer: rev.customer, Deleted: rev.deleted})
+		}
+	}
+	return c, nil
+}
+
+// EvictCustomer implements Tierable.
+func (s *inmemService) EvictCustomer(ctx context.Context, id string) error {
+	if err := s.lock(ctx); err != nil {
+		return err
+	}
+	defer s.mtx.Unlock()
+	if _, ok := s.customers[id]; !ok {
+		return ErrNotFound
+	}
+	return s.persist(journalRecord{At: s.clock.Now(), Op: opEvict, ID: id}, func() { s.evict(id) })
+}
+
+// evict drops everything about customer id. The caller must hold the write
+// lock.
+func (s *inmemService) evict(id string) {
+	s.indexExternalIDs(id, s.customers[id].ExternalIDs, nil)
+	delete(s.customers, id)
+	delete(s.history, id)
+	delete(s.revisions, id)
+	delete(s.consents, id)
+}
+
+// ImportCustomer implements Tierable.
+func (s *inmemService) ImportCustomer(ctx context.Context, c ColdCustomer) error {
+	if err := s.lock(ctx); err != nil {
+		return err
+	}
+	defer s.mtx.Unlock()
+	if s.reserved(c.Customer.ID) || s.checkExternalIDs(c.Customer.ID, c.Customer.ExternalIDs) != nil {
+		return ErrColdConflict
+	}
+	return s.persist(journalRecord{At: s.clock.Now(), Op: opImport, ID: c.Customer.ID, Cold: &c}, func() { s.install(c) })
+}
+
+// install adds customer c, which must not conflict with another. The caller
+// must hold the write lock.
+func (s *inmemService) install(c ColdCustomer) {
+	id := c.Customer.ID
+	s.indexExternalIDs(id, nil, c.Customer.ExternalIDs)
+	s.customers[id] = c.Customer
+	if c.Events == nil {
+		c.Events = map[string]int{}
+	}
+	s.history[id] = &customerHistory{created: c.Created, updated: c.Updated, events: c.Events}
+	if len(c.Revisions) > 0 {
+		r := &revisions{truncated: c.Truncated}
+		for _, rev := range c.Revisions {
+			r.list = append(r.list, revision{at: rev.At, customer: rev.Customer, deleted: rev.Deleted})
+		}
+		s.revisions[id] = r
+	}
+	if len(c.Consents) > 0 {
+		s.consents[id] = c.Consents
+	}
+}
@@ -0,0 +1,263 @@
+package customersvc
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Fields of a customer a Tokenizer is given.
+const (
+	TokenizedEmail = "email"
+	TokenizedPhone = "phone"
+)
+
+// tokenPrefix marks a stored value as a token, telling it apart from values
+// written before tokenization was turned on, which are returned as they are.
+const tokenPrefix = "pii:"
+
+// Tokenizer swaps personal data for tokens standing for it, and back, e.g.
+// by calling a vault service. Tokens must be stable strings; the store
+// sorts, filters and dedupes customers by them as it would by the values.
+type Tokenizer interface {
+	// Tokenize returns the token standing for value of field, one of the
+	// Tokenized constants.
+	Tokenize(ctx context.Context, field, value string) (string, error)
+	// Detokenize returns the values of field the tokens stand for, in
+	// order.
+	Detokenize(ctx context.Context, field string, tokens []string) ([]string, error)
+}
+
+// TokenizationOptions tunes TokenizationMiddleware.
+type TokenizationOptions struct {
+	// Authorized reports whether the caller making a read may see personal
+	// data, rather than tokens. Nil means DetokenizeAuthorized.
+	Authorized func(ctx context.Context) bool
+}
+
+// DetokenizeAuthorized is the default TokenizationOptions.Authorized. It lets
+// customers using a portal token see their own record, which is the only one
+// they can read, and callers with an admin API key see any. Calls carrying
+// neither, such as those of the server's own background jobs, or every call
+// when API keys aren't required, are trusted.
+func DetokenizeAuthorized(ctx context.Context) bool {
+	if _, ok := PortalAccess(ctx); ok {
+		return true
+	}
+	if key, ok := APIKeyFrom(ctx); ok {
+		return key.allows(ScopeAdmin)
+	}
+	return true
+}
+
+// TokenizationMiddleware stores customers' emails and phone numbers as
+// tokens from tokenizer, as an alternative to keeping them in the store,
+// its journal or its cold tier at all. Reads swap them back for callers
+// opts.Authorized allows, and return the tokens, prefixed with "pii:",
+// to the others. A failure to tokenize fails the write, and one to
+// detokenize fails the read. It belongs right around the store, so that
+// middlewares matching on the values, such as the blocklist, still see
+// them.
+func TokenizationMiddleware(tokenizer Tokenizer, opts TokenizationOptions) Middleware {
+	if opts.Authorized == nil {
+		opts.Authorized = DetokenizeAuthorized
+	}
+	return func(next Service) Service {
+		return &tokenizationMiddleware{Service: next, tokenizer: tokenizer, opts: opts}
+	}
+}
+
+type tokenizationMiddleware struct {
+	Service
+	tokenizer Tokenizer
+	opts      TokenizationOptions
+}
+
+// tokenize swaps the email and phone of p for tokens. Empty ones, which
+// PATCH leaves alone, stay empty.
+func (mw *tokenizationMiddleware) tokenize(ctx context.Context, p Customer) (Customer, error) {
+	for _, f := range []struct {
+		name  string
+		value *string
+	}{{TokenizedEmail, &p.Email}, {TokenizedPhone, &p.Phone}} {
+		if *f.value == "" || strings.HasPrefix(*f.value, tokenPrefix) {
+			continue
+		}
+		token, err := mw.tokenizer.Tokenize(ctx, f.name, *f.value)
+		if err != nil {
+			return Customer{}, err
+		}
+		*f.value = tokenPrefix + token
+	}
+	return p, nil
+}
+
+// detokenize swaps the tokens in customers back in place, if the caller is
+// authorized, with a call to the tokenizer per field.
+func (mw *tokenizationMiddleware) detokenize(ctx context.Context, customers []Customer) error {
+	if !mw.opts.Authorized(ctx) {
+		return nil
+	}
+	for _, field := range []string{TokenizedEmail, TokenizedPhone} {
+		value := func(p *Customer) *string {
+			if field == TokenizedEmail {
+				return &p.Email
+			}
+			return &p.Phone
+		}
+		var tokens []string
+		var at []int
+		for i := range customers {
+			if v := *value(&customers[i]); strings.HasPrefix(v, tokenPrefix) {
+				tokens = append(tokens, strings.TrimPrefix(v, tokenPrefix))
+				at = append(at, i)
+			}
+		}
+		if len(tokens) == 0 {
+			continue
+		}
+		values, err := mw.tokenizer.Detokenize(ctx, field, tokens)
+		if err != nil {
+			return err
+		}
+		if len(values) != len(tokens) {
+			return fmt.Errorf("tokenizer returned %d values for %d tokens", len(values), len(tokens))
+		}
+		for j, i := range at {
+			*value(&customers[i]) = values[j]
+		}
+	}
+	return nil
+}
+
+// detokenizeOne is detokenize for a single customer.
+func (mw *tokenizationMiddleware) detokenizeOne(ctx context.Context, p Customer, err error) (Customer, error) {
+	if err != nil {
+		return p, err
+	}
+	customers := []Customer{p}
+	if err := mw.detokenize(ctx, customers); err != nil {
+		return Customer{}, err
+	}
+	return customers[0], nil
+}
+
+func (mw *tokenizationMiddleware) PostCustomer(ctx context.Context, p Customer) error {
+	p, err := mw.tokenize(ctx, p)
+	if err != nil {
+		return err
+	}
+	return mw.Service.PostCustomer(ctx, p)
+}
+
+func (mw *tokenizationMiddleware) PutCustomer(ctx context.Context, id string, p Customer) error {
+	p, err := mw.tokenize(ctx, p)
+	if err != nil {
+		return err
+	}
+	return mw.Service.PutCustomer(ctx, id, p)
+}
+
+func (mw *tokenizationMiddleware) PatchCustomer(ctx context.Context, id string, p Customer) error {
+	p, err := mw.tokenize(ctx, p)
+	if err != nil {
+		return err
+	}
+	return mw.Service.PatchCustomer(ctx, id, p)
+}
+
+func (mw *tokenizationMiddleware) PrepareCustomer(ctx context.Context, p Customer, ttl time.Duration) (PendingCustomer, error) {
+	p, err := mw.tokenize(ctx, p)
+	if err != nil {
+		return PendingCustomer{}, err
+	}
+	return mw.Service.PrepareCustomer(ctx, p, ttl)
+}
+
+func (mw *tokenizationMiddleware) GetCustomer(ctx context.Context, id string) (Customer, error) {
+	p, err := mw.Service.GetCustomer(ctx, id)
+	return mw.detokenizeOne(ctx, p, err)
+}
+
+func (mw *tokenizationMiddleware) GetCustomerAsOf(ctx context.Context, id string, t time.Time) (Customer, error) {
+	p, err := mw.Service.GetCustomerAsOf(ctx, id, t)
+	return mw.detokenizeOne(ctx, p, err)
+}
+
+func (mw *tokenizationMiddleware) GetCustomerByExternalID(ctx context.Context, system, externalID string) (Customer, error) {
+	p, err := mw.Service.GetCustomerByExternalID(ctx, system, externalID)
+	return mw.detokenizeOne(ctx, p, err)
+}
+
+func (mw *tokenizationMiddleware) GetCustomers(ctx context.Context, f CustomerFilter) ([]Customer, error) {
+	customers, err := mw.Service.GetCustomers(ctx, f)
+	if err != nil {
+		return nil, err
+	}
+	customers = append([]Customer(nil), customers...) // don't write through to the store's
+	if err := mw.detokenize(ctx, customers); err != nil {
+		return nil, err
+	}
+	return customers, nil
+}
+
+// NewHTTPTokenizer returns a Tokenizer calling a tokenization service at
+// baseURL, which must serve:
+//
+//	POST /tokenize     {"field": "email", "value": "..."}     -> {"token": "..."}
+//	POST /detokenize   {"field": "email", "tokens": ["..."]}  -> {"values": ["..."]}
+//
+// A nil client means http.DefaultClient.
+func NewHTTPTokenizer(baseURL string, client *http.Client) Tokenizer {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &httpTokenizer{url: strings.TrimSuffix(baseURL, "/"), client: client}
+}
+
+type httpTokenizer struct {
+	url    string
+	client *http.Client
+}
+
+func (t *httpTokenizer) Tokenize(ctx context.Context, field, value string) (string, error) {
+	var resp struct {
+		Token string `json:"token"`
+	}
+	err := t.call(ctx, "/tokenize", map[string]string{"field": field, "value": value}, &resp)
+	return resp.Token, err
+}
+
+func (t *httpTokenizer) Detokenize(ctx context.Context, field string, tokens []string) ([]string, error) {
+	var resp struct {
+		Values []string `json:"values"`
+	}
+	err := t.call(ctx, "/detokenize", map[string]interface{}{"field": field, "tokens": tokens}, &resp)
+	return resp.Values, err
+}
+
+func (t *httpTokenizer) call(ctx context.Context, path string, request, response interface{}) error {
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(request); err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", t.url+path, &buf)
+	if err != nil {
+		return err
+	}
+	PropagateHeaders(ctx, req.Header)
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	resp, err := t.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("tokenization service: %s", resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(response)
+}
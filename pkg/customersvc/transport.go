@@ -6,14 +6,18 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"encoding/xml"
 	"errors"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
 
-	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/endpoint"
 	"github.com/go-kit/kit/transport"
 	httptransport "github.com/go-kit/kit/transport/http"
 )
@@ -24,86 +28,283 @@ var (
 	ErrBadRouting = errors.New("inconsistent mapping between route and handler (programmer error)")
 )
 
+// HandlerOption configures optional behavior of MakeHTTPHandler.
+type HandlerOption func(*handlerConfig)
+
+type handlerConfig struct {
+	signer          *URLSigner
+	endpointMWs     []func(method string) endpoint.Middleware
+	problems        bool
+	problemTypeBase string
+	blocklist       *Blocklist
+	slashes         SlashPolicy
+	apiKeys         *APIKeys
+	recorder        *Recorder
+	meter           *Meter
+	hardening       *HardeningOptions
+	headers         *ResponseHeaders
+	portal          *PortalTokens
+	deprecations    *Deprecations
+	ownership       *Ownership
+	captcha         func(method string) endpoint.Middleware
+	tap             *Tap
+	credentials     *Credentials
+	idempotency     *IdempotencyKeys
+	writes          *WriteThrottle
+	status          *StatusPage
+	addressRefs     *AddressReferences
+	jobs            *Jobs
+	seeding         bool
+	routes          []RouteSpec
+	withoutRoutes   map[string]bool
+}
+
+// wrap wraps an endpoint mounted outside of Endpoints in the same
+// middlewares as those in it.
+func (c *handlerConfig) wrap(method string, e endpoint.Endpoint) endpoint.Endpoint {
+	for i := len(c.endpointMWs) - 1; i >= 0; i-- {
+		e = c.endpointMWs[i](method)(e)
+	}
+	return budgetMiddleware(method)(e)
+}
+
+// WithURLSigner enables signed URLs: POST /customers/:id/signed-url mints
+// them, and every request carrying a signature is verified with signer.
+func WithURLSigner(signer *URLSigner) HandlerOption {
+	return func(c *handlerConfig) { c.signer = signer }
+}
+
+// WithEndpointMiddleware wraps every server endpoint in the middleware
+// returned by mw for its method name. When given more than once, the first
+// middleware is the outermost.
+func WithEndpointMiddleware(mw func(method string) endpoint.Middleware) HandlerOption {
+	return func(c *handlerConfig) { c.endpointMWs = append(c.endpointMWs, mw) }
+}
+
 // MakeHTTPHandler mounts all of the service endpoints into an http.Handler.
 // Useful in a customersvc server.
-func MakeHTTPHandler(s Service, logger log.Logger) http.Handler {
+func MakeHTTPHandler(s Service, logger Logger, opts ...HandlerOption) http.Handler {
+	var cfg handlerConfig
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+
+	if cfg.apiKeys != nil {
+		// Outermost, so that unauthenticated requests cost nothing more.
+		cfg.endpointMWs = append([]func(string) endpoint.Middleware{APIKeyMiddleware(cfg.apiKeys)}, cfg.endpointMWs...)
+	}
+	if cfg.portal != nil {
+		// Outside API keys, which accept what it lets through.
+		cfg.endpointMWs = append([]func(string) endpoint.Middleware{PortalTokenMiddleware(cfg.portal)}, cfg.endpointMWs...)
+	}
+	if cfg.ownership != nil {
+		// Inside API keys, whose key it checks.
+		cfg.endpointMWs = append(cfg.endpointMWs, cfg.ownership.middleware)
+	}
+	if cfg.captcha != nil {
+		// Inside API keys, whose holders skip it.
+		cfg.endpointMWs = append(cfg.endpointMWs, cfg.captcha)
+	}
+	if cfg.credentials != nil {
+		cfg.endpointMWs = append(cfg.endpointMWs, cfg.credentials.middleware)
+	}
+	if cfg.addressRefs != nil {
+		cfg.endpointMWs = append(cfg.endpointMWs, cfg.addressRefs.middleware)
+	}
+	if cfg.idempotency != nil {
+		// Inside API keys and portal tokens, which scope keys, and
+		// outside metering, so that repeats aren't billed.
+		cfg.endpointMWs = append(cfg.endpointMWs, cfg.idempotency.middleware)
+	}
+	if cfg.writes != nil {
+		// Inside API keys and portal tokens, whose holders it throttles,
+		// and idempotency keys, so that repeats answered from memory
+		// don't count.
+		cfg.endpointMWs = append(cfg.endpointMWs, cfg.writes.middleware)
+	}
+	if cfg.meter != nil {
+		// Innermost, so that only calls let through are billed.
+		cfg.endpointMWs = append(cfg.endpointMWs, cfg.meter.endpointMiddleware)
+	}
+
 	r := mux.NewRouter()
 	e := MakeServerEndpoints(s)
+	for i := len(cfg.endpointMWs) - 1; i >= 0; i-- {
+		e = e.Wrap(cfg.endpointMWs[i])
+	}
+	e = e.Wrap(budgetMiddleware)
 	options := []httptransport.ServerOption{
 		httptransport.ServerErrorHandler(transport.NewLogErrorHandler(logger)),
 		httptransport.ServerErrorEncoder(encodeError),
+		httptransport.ServerBefore(httptransport.PopulateRequestContext, populateRequestMetadata),
+	}
+	if cfg.writes != nil {
+		options = append(options, httptransport.ServerBefore(cfg.writes.before), httptransport.ServerAfter(cfg.writes.after))
 	}
 
 	// POST    /customers/                          adds another customer
-	// GET     /customers/:id                       retrieves the given customer by id
+	// GET     /customers/:id                       retrieves the given customer by id; ?omit=addresses without its addresses
+	// GET     /customers/:id?as_of=<RFC 3339 time> retrieves the customer as it was at that time
+	// GET     /customers/:id?expand=addresses,stats
+	//                                              retrieves the customer along with those parts, fetched concurrently;
+	//                                              ?partial=true returns it even if some parts fail
 	// PUT     /customers/:id                       post updated customer information about the customer
+	//                                              (?addresses=replace, merge or ignore says what it does with the addresses)
 	// PATCH   /customers/:id                       partial updated customer information
+	//                                              (PUT and PATCH return the result given Prefer: return=representation)
 	// DELETE  /customers/:id                       remove the given customer
 	// GET     /customers/:id/addresses/            retrieve addresses associated with the customer
+	//                                              (?at=2023-01-01 only those effective then)
 	// GET     /customers/:id/addresses/:addressID  retrieve a particular customer address
 	// POST    /customers/:id/addresses/            add a new address
-	// DELETE  /customers/:id/addresses/:addressID  remove an address
-
-	r.Methods("POST").Path("/customers/").Handler(httptransport.NewServer(
-		e.PostCustomerEndpoint,
-		decodePostCustomerRequest,
-		encodeResponse,
-		options...,
-	))
-	r.Methods("GET").Path("/customers/{id}").Handler(httptransport.NewServer(
-		e.GetCustomerEndpoint,
-		decodeGetCustomerRequest,
-		encodeResponse,
-		options...,
-	))
-	r.Methods("PUT").Path("/customers/{id}").Handler(httptransport.NewServer(
-		e.PutCustomerEndpoint,
-		decodePutCustomerRequest,
-		encodeResponse,
-		options...,
-	))
-	r.Methods("PATCH").Path("/customers/{id}").Handler(httptransport.NewServer(
-		e.PatchCustomerEndpoint,
-		decodePatchCustomerRequest,
-		encodeResponse,
-		options...,
-	))
-	r.Methods("DELETE").Path("/customers/{id}").Handler(httptransport.NewServer(
-		e.DeleteCustomerEndpoint,
-		decodeDeleteCustomerRequest,
-		encodeResponse,
-		options...,
-	))
-	r.Methods("GET").Path("/customers/{id}/addresses/").Handler(httptransport.NewServer(
-		e.GetAddressesEndpoint,
-		decodeGetAddressesRequest,
-		encodeResponse,
-		options...,
-	))
-	r.Methods("GET").Path("/customers/{id}/addresses/{addressID}").Handler(httptransport.NewServer(
-		e.GetAddressEndpoint,
-		decodeGetAddressRequest,
-		encodeResponse,
-		options...,
-	))
-	r.Methods("POST").Path("/customers/{id}/addresses/").Handler(httptransport.NewServer(
-		e.PostAddressEndpoint,
-		decodePostAddressRequest,
-		encodeResponse,
-		options...,
-	))
-	r.Methods("DELETE").Path("/customers/{id}/addresses/{addressID}").Handler(httptransport.NewServer(
-		e.DeleteAddressEndpoint,
-		decodeDeleteAddressRequest,
-		encodeResponse,
-		options...,
-	))
-	return r
+	// DELETE  /customers/:id/addresses/:addressID  remove an address; ?force=true even if referenced
+	// POST    /customers/:id/addresses/batch       add up to MaxAddressBatch addresses at once
+	// GET     /reports/customers-by-region         count customers per address country/state
+	// GET     /reports/duplicate-addresses         list addresses of a customer at the same location
+	// POST    /admin/address-repairs               give addresses without an ID, or sharing one, a new ID; ?dry_run=true
+	// POST    /admin/indexes/:index/rebuild        rebuild an index, e.g. external_ids, from the customers in batches
+	// GET     /admin/indexes/:index/rebuild        the progress of the last rebuild of the index
+	// POST    /admin/consistency-checks            report anomalies in storage; ?repair=true fixes those it can
+	// PUT     /customers/:id/addresses/order       reorder addresses by listing their IDs
+	// POST    /customers/validate                  check a customer as POST would, without saving
+	// POST    /customers/:id/addresses/validate    check an address as POST would, without saving
+	// POST    /customers/:id/archive               hide a customer from lists without deleting it
+	// POST    /customers/:id/unarchive             undo archive
+	// GET     /customers/                          list customers; ?archived=include|only to see archived ones
+	//                                              (?omit=addresses lists them without their addresses)
+	//                                              (this and the addresses list are paged given ?limit= or ?cursor=)
+	//                                              (pages of customers are sorted given ?sort=id|name|family_name|email,
+	//                                              names collated for ?locale=, e.g. sv)
+	//                                              (Accept: text/csv streams it as CSV; ?columns=id,name,metadata.<key>,...)
+	// GET     /customers/:id/stats                 derived figures about a customer, for support dashboards
+	// POST    /customers:prepare                   reserve a customer, invisible until committed; ?ttl=30s
+	// POST    /customers/:id:commit                make a prepared customer visible
+	// POST    /customers/:id:abort                 drop a prepared customer
+	// GET     /customers/by-external-id/:system/:id
+	//                                              find a customer by its ID in another system, e.g. stripe
+	// GET     /customers/:id/consents/             list the customer's consents, withdrawn ones included
+	// POST    /customers/:id/consents/             record a consent: {"type": "marketing_email", "version": "2024-01"}
+	// DELETE  /customers/:id/consents/:type        withdraw the consent of that type
+	// POST    /customers/:id/signed-url            mint a short-lived signed URL (WithURLSigner only)
+	// POST    /customers/:id/portal-token          mint a token for the customer's own portal (WithPortalTokens only)
+	// GET     /customers/:id/owner                 the API key owning the customer (WithOwnership only)
+	// PUT     /customers/:id/owner                 transfer the customer to another API key (WithOwnership only)
+	// PUT     /customers/:id/credentials/:kind     set the customer's password or PIN (WithCredentials only)
+	// POST    /customers/:id/credentials/:kind/verify
+	//                                              check the customer's password or PIN (WithCredentials only)
+	// DELETE  /customers/:id/credentials/:kind     remove the customer's password or PIN (WithCredentials only)
+	// GET     /customers/:id/addresses/:addressID/references/
+	//                                              list references other services hold to the address (WithAddressReferences only)
+	// PUT     /customers/:id/addresses/:addressID/references/:ref
+	//                                              register a reference, e.g. an active shipment (WithAddressReferences only)
+	// DELETE  /customers/:id/addresses/:addressID/references/:ref
+	//                                              clear a reference (WithAddressReferences only)
+	// DELETE  /customers/:id/addresses/:addressID/references/
+	//                                              clear every reference to the address (WithAddressReferences only)
+	// POST    /customers/bulk-patch                patch every customer matching a filter, in a job (WithJobs only)
+	// GET     /jobs/                               list background jobs (WithJobs only)
+	// GET     /jobs/:id                            a job's progress and per-record results (WithJobs only)
+	// GET     /blocklist/                          list blocklist entries (WithBlocklist only)
+	// POST    /blocklist/                          add a blocklist entry (WithBlocklist only)
+	// DELETE  /blocklist/:kind/:value              remove a blocklist entry (WithBlocklist only)
+	// GET     /admin/apikeys                       list API keys (WithAPIKeys only)
+	// POST    /admin/apikeys                       issue an API key (WithAPIKeys only)
+	// DELETE  /admin/apikeys/:id                   revoke an API key (WithAPIKeys only)
+	// GET     /admin/recordings                    list recorded requests and responses (WithRecorder only)
+	// DELETE  /admin/recordings                    drop recordings (WithRecorder only)
+	// GET     /admin/tap                           stream a sample of request summaries (WithTap only)
+	// GET     /admin/tenants/:id/usage             usage of a tenant so far today (WithMeter only)
+	// POST    /admin/seed                          load test fixtures, in development only (WithSeeding only)
+	// GET     /version                             the version and revision of the server
+	// GET     /status                              uptime, build, dependency latencies, error rate and feature flags
+	//
+	// Those not marked otherwise are listed by Routes; WithRoutes adds more
+	// and WithoutRoutes drops some.
+
+	for _, rt := range cfg.routes {
+		rt.Endpoint = cfg.wrap(rt.Name, rt.Endpoint)
+		mountRoute(r, rt, options)
+	}
+	for _, rt := range Routes(e) {
+		if !cfg.withoutRoutes[rt.Name] {
+			mountRoute(r, rt, options)
+		}
+	}
+
+	if cfg.blocklist != nil {
+		mountBlocklist(r, cfg.blocklist, cfg.wrap, options)
+	}
+	if cfg.apiKeys != nil {
+		mountAPIKeys(r, cfg.apiKeys, cfg.wrap, options)
+	}
+	if cfg.recorder != nil {
+		mountRecorder(r, cfg.recorder, cfg.wrap, options)
+	}
+	if cfg.tap != nil {
+		mountTap(r, cfg.tap, cfg.wrap, options)
+	}
+	if cfg.meter != nil {
+		mountMeter(r, cfg.meter, cfg.wrap, options)
+	}
+	if cfg.portal != nil {
+		mountPortalTokens(r, s, cfg.portal, cfg.wrap, options)
+	}
+	if cfg.ownership != nil {
+		mountOwnership(r, s, cfg.ownership, cfg.wrap, options)
+	}
+	if cfg.credentials != nil {
+		mountCredentials(r, s, cfg.credentials, cfg.wrap, options)
+	}
+	if cfg.addressRefs != nil {
+		mountAddressReferences(r, s, cfg.addressRefs, cfg.wrap, options)
+	}
+	if cfg.jobs != nil {
+		mountJobs(r, s, cfg.jobs, cfg.wrap, options)
+	}
+	if cfg.seeding {
+		mountSeeding(r, s, logger, cfg.wrap, options)
+	}
+	mountVersion(r, options)
+	if cfg.status != nil {
+		mountStatus(r, cfg.status, options)
+	}
+
+	var h http.Handler = r
+	if cfg.signer != nil {
+		r.Methods("POST").Path("/customers/{id}/signed-url").Handler(httptransport.NewServer(
+			cfg.wrap("SignURL", MakeSignURLEndpoint(s, cfg.signer)),
+			decodeSignURLRequest,
+			encodeResponse,
+			options...,
+		))
+		h = SignedURLMiddleware(cfg.signer)(h)
+	}
+	if cfg.deprecations != nil {
+		h = cfg.deprecations.middleware(r)(h)
+	}
+	if cfg.headers != nil {
+		h = responseHeadersMiddleware(*cfg.headers)(h)
+	}
+	h = slashMiddleware(r, cfg.slashes)(h)
+	h = deadlineMiddleware(h)
+	if cfg.recorder != nil {
+		h = cfg.recorder.middleware(h)
+	}
+	if cfg.tap != nil {
+		h = cfg.tap.middleware(r)(h)
+	}
+	if cfg.status != nil {
+		h = cfg.status.middleware(h)
+	}
+	if cfg.hardening != nil {
+		h = hardeningMiddleware(*cfg.hardening)(h)
+	}
+	return requestInfoMiddleware(cfg.problems, cfg.problemTypeBase)(h)
 }
 
 func decodePostCustomerRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
 	var req postCustomerRequest
-	if e := json.NewDecoder(r.Body).Decode(&req.Customer); e != nil {
+	if e := decodeCustomerBody(r, &req.Customer); e != nil {
 		return nil, e
 	}
 	return req, nil
@@ -115,7 +316,24 @@ func decodeGetCustomerRequest(_ context.Context, r *http.Request) (request inter
 	if !ok {
 		return nil, ErrBadRouting
 	}
-	return getCustomerRequest{ID: id}, nil
+	omit, err := omitAddressesFrom(r.URL.Query())
+	if err != nil {
+		return nil, err
+	}
+	return getCustomerRequest{ID: id, OmitAddresses: omit}, nil
+}
+
+func decodeGetCustomerAsOfRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	vars := mux.Vars(r)
+	id, ok := vars["id"]
+	if !ok {
+		return nil, ErrBadRouting
+	}
+	asOf, err := time.Parse(time.RFC3339Nano, vars["as_of"])
+	if err != nil {
+		return nil, ErrInvalidAsOf
+	}
+	return getCustomerAsOfRequest{ID: id, AsOf: asOf}, nil
 }
 
 func decodePutCustomerRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
@@ -124,13 +342,19 @@ func decodePutCustomerRequest(_ context.Context, r *http.Request) (request inter
 	if !ok {
 		return nil, ErrBadRouting
 	}
+	addresses, err := ParseAddressWrite(r.URL.Query().Get("addresses"))
+	if err != nil {
+		return nil, err
+	}
 	var customer Customer
-	if err := json.NewDecoder(r.Body).Decode(&customer); err != nil {
+	if err := decodeCustomerBody(r, &customer); err != nil {
 		return nil, err
 	}
 	return putCustomerRequest{
-		ID:       id,
-		Customer: customer,
+		ID:        id,
+		Customer:  customer,
+		Return:    prefersRepresentation(r),
+		Addresses: addresses,
 	}, nil
 }
 
@@ -141,12 +365,13 @@ func decodePatchCustomerRequest(_ context.Context, r *http.Request) (request int
 		return nil, ErrBadRouting
 	}
 	var customer Customer
-	if err := json.NewDecoder(r.Body).Decode(&customer); err != nil {
+	if err := decodeCustomerBody(r, &customer); err != nil {
 		return nil, err
 	}
 	return patchCustomerRequest{
 		ID:       id,
 		Customer: customer,
+		Return:   prefersRepresentation(r),
 	}, nil
 }
 
@@ -165,7 +390,11 @@ func decodeGetAddressesRequest(_ context.Context, r *http.Request) (request inte
 	if !ok {
 		return nil, ErrBadRouting
 	}
-	return getAddressesRequest{CustomerID: id}, nil
+	at, err := effectiveAtFrom(r.URL.Query())
+	if err != nil {
+		return nil, err
+	}
+	return getAddressesRequest{CustomerID: id, At: at}, nil
 }
 
 func decodeGetAddressRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
@@ -191,7 +420,7 @@ func decodePostAddressRequest(_ context.Context, r *http.Request) (request inter
 		return nil, ErrBadRouting
 	}
 	var address Address
-	if err := json.NewDecoder(r.Body).Decode(&address); err != nil {
+	if err := decodeAddressBody(r, &address); err != nil {
 		return nil, err
 	}
 	return postAddressRequest{
@@ -213,9 +442,239 @@ func decodeDeleteAddressRequest(_ context.Context, r *http.Request) (request int
 	return deleteAddressRequest{
 		CustomerID: id,
 		AddressID:  addressID,
+		Force:      r.URL.Query().Get("force") == "true",
+	}, nil
+}
+
+func decodeGetCustomersByRegionRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	return getCustomersByRegionRequest{}, nil
+}
+
+func decodeGetDuplicateAddressesRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	return getDuplicateAddressesRequest{}, nil
+}
+
+func decodeRepairAddressesRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	return repairAddressesRequest{DryRun: r.URL.Query().Get("dry_run") == "true"}, nil
+}
+
+func decodeRebuildIndexRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	vars := mux.Vars(r)
+	index, ok := vars["index"]
+	if !ok {
+		return nil, ErrBadRouting
+	}
+	return rebuildIndexRequest{Index: index}, nil
+}
+
+func decodeGetIndexRebuildRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	vars := mux.Vars(r)
+	index, ok := vars["index"]
+	if !ok {
+		return nil, ErrBadRouting
+	}
+	return getIndexRebuildRequest{Index: index}, nil
+}
+
+func decodeCheckConsistencyRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	return checkConsistencyRequest{Repair: r.URL.Query().Get("repair") == "true"}, nil
+}
+
+func decodePostAddressesRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	vars := mux.Vars(r)
+	id, ok := vars["id"]
+	if !ok {
+		return nil, ErrBadRouting
+	}
+	var addresses []Address
+	if isXML(r.Header.Get("Content-Type")) {
+		// XML has no bare arrays: <addresses><address>...</address></addresses>
+		var body struct {
+			Addresses []Address `xml:"address"`
+		}
+		if err := xml.NewDecoder(r.Body).Decode(&body); err != nil {
+			return nil, err
+		}
+		addresses = body.Addresses
+	} else if requestsV2(r) {
+		var v2 []AddressV2
+		if err := json.NewDecoder(r.Body).Decode(&v2); err != nil {
+			return nil, err
+		}
+		for _, a := range v2 {
+			addresses = append(addresses, a.Address())
+		}
+	} else if err := decodeBody(r, &addresses); err != nil {
+		return nil, err
+	}
+	return postAddressesRequest{
+		CustomerID: id,
+		Addresses:  addresses,
 	}, nil
 }
 
+func decodeReorderAddressesRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	vars := mux.Vars(r)
+	id, ok := vars["id"]
+	if !ok {
+		return nil, ErrBadRouting
+	}
+	var body addressOrder
+	if err := decodeBody(r, &body); err != nil {
+		return nil, err
+	}
+	return reorderAddressesRequest{
+		CustomerID: id,
+		AddressIDs: body.AddressIDs,
+	}, nil
+}
+
+// addressOrder is the body of PUT /customers/:id/addresses/order.
+type addressOrder struct {
+	AddressIDs []string `json:"address_ids" xml:"address_id"`
+}
+
+func decodeValidateCustomerRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	var req validateCustomerRequest
+	if e := decodeCustomerBody(r, &req.Customer); e != nil {
+		return nil, e
+	}
+	return req, nil
+}
+
+func decodeValidateAddressRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	vars := mux.Vars(r)
+	id, ok := vars["id"]
+	if !ok {
+		return nil, ErrBadRouting
+	}
+	var address Address
+	if err := decodeAddressBody(r, &address); err != nil {
+		return nil, err
+	}
+	return validateAddressRequest{
+		CustomerID: id,
+		Address:    address,
+	}, nil
+}
+
+func decodeArchiveCustomerRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	vars := mux.Vars(r)
+	id, ok := vars["id"]
+	if !ok {
+		return nil, ErrBadRouting
+	}
+	return archiveCustomerRequest{ID: id}, nil
+}
+
+func decodeUnarchiveCustomerRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	vars := mux.Vars(r)
+	id, ok := vars["id"]
+	if !ok {
+		return nil, ErrBadRouting
+	}
+	return unarchiveCustomerRequest{ID: id}, nil
+}
+
+func decodeGetCustomersRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	omit, err := omitAddressesFrom(r.URL.Query())
+	if err != nil {
+		return nil, err
+	}
+	return getCustomersRequest{
+		Filter:        CustomerFilter{Archived: r.URL.Query().Get("archived")},
+		OmitAddresses: omit,
+	}, nil
+}
+
+func decodeGetCustomerStatsRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	vars := mux.Vars(r)
+	id, ok := vars["id"]
+	if !ok {
+		return nil, ErrBadRouting
+	}
+	return getCustomerStatsRequest{ID: id}, nil
+}
+
+func decodePrepareCustomerRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	var req prepareCustomerRequest
+	if ttl := r.URL.Query().Get("ttl"); ttl != "" {
+		if req.TTL, err = time.ParseDuration(ttl); err != nil || req.TTL <= 0 {
+			return nil, ErrInvalidTTL
+		}
+	}
+	if e := decodeCustomerBody(r, &req.Customer); e != nil {
+		return nil, e
+	}
+	return req, nil
+}
+
+func decodeCommitCustomerRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	vars := mux.Vars(r)
+	id, ok := vars["id"]
+	if !ok {
+		return nil, ErrBadRouting
+	}
+	return commitCustomerRequest{ID: id}, nil
+}
+
+func decodeAbortCustomerRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	vars := mux.Vars(r)
+	id, ok := vars["id"]
+	if !ok {
+		return nil, ErrBadRouting
+	}
+	return abortCustomerRequest{ID: id}, nil
+}
+
+func decodeGetCustomerByExternalIDRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	vars := mux.Vars(r)
+	system, ok := vars["system"]
+	if !ok {
+		return nil, ErrBadRouting
+	}
+	id, ok := vars["id"]
+	if !ok {
+		return nil, ErrBadRouting
+	}
+	return getCustomerByExternalIDRequest{System: system, ExternalID: id}, nil
+}
+
+func decodeGetConsentsRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	vars := mux.Vars(r)
+	id, ok := vars["id"]
+	if !ok {
+		return nil, ErrBadRouting
+	}
+	return getConsentsRequest{CustomerID: id}, nil
+}
+
+func decodeGrantConsentRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	vars := mux.Vars(r)
+	id, ok := vars["id"]
+	if !ok {
+		return nil, ErrBadRouting
+	}
+	var c Consent
+	if err := decodeBody(r, &c); err != nil {
+		return nil, err
+	}
+	return grantConsentRequest{CustomerID: id, Consent: c}, nil
+}
+
+func decodeWithdrawConsentRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	vars := mux.Vars(r)
+	id, ok := vars["id"]
+	if !ok {
+		return nil, ErrBadRouting
+	}
+	consentType, ok := vars["type"]
+	if !ok {
+		return nil, ErrBadRouting
+	}
+	return withdrawConsentRequest{CustomerID: id, Type: consentType}, nil
+}
+
 func encodePostCustomerRequest(ctx context.Context, req *http.Request, request interface{}) error {
 	// r.Methods("POST").Path("/customers/")
 	req.URL.Path = "/customers/"
@@ -227,6 +686,18 @@ func encodeGetCustomerRequest(ctx context.Context, req *http.Request, request in
 	r := request.(getCustomerRequest)
 	customerID := url.QueryEscape(r.ID)
 	req.URL.Path = "/customers/" + customerID
+	q := url.Values{}
+	setOmitAddresses(q, r.OmitAddresses)
+	req.URL.RawQuery = q.Encode()
+	return encodeRequest(ctx, req, request)
+}
+
+func encodeGetCustomerAsOfRequest(ctx context.Context, req *http.Request, request interface{}) error {
+	// r.Methods("GET").Path("/customers/{id}").Queries("as_of", "{as_of}")
+	r := request.(getCustomerAsOfRequest)
+	customerID := url.QueryEscape(r.ID)
+	req.URL.Path = "/customers/" + customerID
+	req.URL.RawQuery = url.Values{"as_of": {r.AsOf.Format(time.RFC3339Nano)}}.Encode()
 	return encodeRequest(ctx, req, request)
 }
 
@@ -235,7 +706,13 @@ func encodePutCustomerRequest(ctx context.Context, req *http.Request, request in
 	r := request.(putCustomerRequest)
 	customerID := url.QueryEscape(r.ID)
 	req.URL.Path = "/customers/" + customerID
-	return encodeRequest(ctx, req, request)
+	if r.Addresses != AddressesByAuthority {
+		req.URL.RawQuery = url.Values{"addresses": {r.Addresses.String()}}.Encode()
+	}
+	if r.Return {
+		req.Header.Set(PreferHeader, preferRepresentation)
+	}
+	return encodeRequest(ctx, req, r.Customer)
 }
 
 func encodePatchCustomerRequest(ctx context.Context, req *http.Request, request interface{}) error {
@@ -243,7 +720,10 @@ func encodePatchCustomerRequest(ctx context.Context, req *http.Request, request
 	r := request.(patchCustomerRequest)
 	customerID := url.QueryEscape(r.ID)
 	req.URL.Path = "/customers/" + customerID
-	return encodeRequest(ctx, req, request)
+	if r.Return {
+		req.Header.Set(PreferHeader, preferRepresentation)
+	}
+	return encodeRequest(ctx, req, r.Customer)
 }
 
 func encodeDeleteCustomerRequest(ctx context.Context, req *http.Request, request interface{}) error {
@@ -259,6 +739,9 @@ func encodeGetAddressesRequest(ctx context.Context, req *http.Request, request i
 	r := request.(getAddressesRequest)
 	customerID := url.QueryEscape(r.CustomerID)
 	req.URL.Path = "/customers/" + customerID + "/addresses/"
+	q := url.Values{}
+	setEffectiveAt(q, r.At)
+	req.URL.RawQuery = q.Encode()
 	return encodeRequest(ctx, req, request)
 }
 
@@ -288,6 +771,177 @@ func encodeDeleteAddressRequest(ctx context.Context, req *http.Request, request
 	return encodeRequest(ctx, req, request)
 }
 
+func encodeGetCustomersByRegionRequest(ctx context.Context, req *http.Request, request interface{}) error {
+	// r.Methods("GET").Path("/reports/customers-by-region")
+	req.URL.Path = "/reports/customers-by-region"
+	return encodeRequest(ctx, req, request)
+}
+
+func encodeGetDuplicateAddressesRequest(ctx context.Context, req *http.Request, request interface{}) error {
+	// r.Methods("GET").Path("/reports/duplicate-addresses")
+	req.URL.Path = "/reports/duplicate-addresses"
+	return encodeRequest(ctx, req, request)
+}
+
+func encodeRepairAddressesRequest(ctx context.Context, req *http.Request, request interface{}) error {
+	// r.Methods("POST").Path("/admin/address-repairs")
+	r := request.(repairAddressesRequest)
+	req.URL.Path = "/admin/address-repairs"
+	if r.DryRun {
+		req.URL.RawQuery = "dry_run=true"
+	}
+	return encodeRequest(ctx, req, request)
+}
+
+func encodeRebuildIndexRequest(ctx context.Context, req *http.Request, request interface{}) error {
+	// r.Methods("POST").Path("/admin/indexes/{index}/rebuild")
+	r := request.(rebuildIndexRequest)
+	req.URL.Path = "/admin/indexes/" + url.QueryEscape(r.Index) + "/rebuild"
+	return encodeRequest(ctx, req, request)
+}
+
+func encodeGetIndexRebuildRequest(ctx context.Context, req *http.Request, request interface{}) error {
+	// r.Methods("GET").Path("/admin/indexes/{index}/rebuild")
+	r := request.(getIndexRebuildRequest)
+	req.URL.Path = "/admin/indexes/" + url.QueryEscape(r.Index) + "/rebuild"
+	return encodeRequest(ctx, req, request)
+}
+
+func encodeCheckConsistencyRequest(ctx context.Context, req *http.Request, request interface{}) error {
+	// r.Methods("POST").Path("/admin/consistency-checks")
+	r := request.(checkConsistencyRequest)
+	req.URL.Path = "/admin/consistency-checks"
+	if r.Repair {
+		req.URL.RawQuery = "repair=true"
+	}
+	return encodeRequest(ctx, req, request)
+}
+
+func encodePostAddressesRequest(ctx context.Context, req *http.Request, request interface{}) error {
+	// r.Methods("POST").Path("/customers/{id}/addresses/batch")
+	r := request.(postAddressesRequest)
+	customerID := url.QueryEscape(r.CustomerID)
+	req.URL.Path = "/customers/" + customerID + "/addresses/batch"
+	return encodeRequest(ctx, req, r.Addresses)
+}
+
+func encodeReorderAddressesRequest(ctx context.Context, req *http.Request, request interface{}) error {
+	// r.Methods("PUT").Path("/customers/{id}/addresses/order")
+	r := request.(reorderAddressesRequest)
+	customerID := url.QueryEscape(r.CustomerID)
+	req.URL.Path = "/customers/" + customerID + "/addresses/order"
+	return encodeRequest(ctx, req, addressOrder{AddressIDs: r.AddressIDs})
+}
+
+func encodeValidateCustomerRequest(ctx context.Context, req *http.Request, request interface{}) error {
+	// r.Methods("POST").Path("/customers/validate")
+	req.URL.Path = "/customers/validate"
+	return encodeRequest(ctx, req, request.(validateCustomerRequest).Customer)
+}
+
+func encodeValidateAddressRequest(ctx context.Context, req *http.Request, request interface{}) error {
+	// r.Methods("POST").Path("/customers/{id}/addresses/validate")
+	r := request.(validateAddressRequest)
+	customerID := url.QueryEscape(r.CustomerID)
+	req.URL.Path = "/customers/" + customerID + "/addresses/validate"
+	return encodeRequest(ctx, req, r.Address)
+}
+
+func encodeArchiveCustomerRequest(ctx context.Context, req *http.Request, request interface{}) error {
+	// r.Methods("POST").Path("/customers/{id}/archive")
+	r := request.(archiveCustomerRequest)
+	customerID := url.QueryEscape(r.ID)
+	req.URL.Path = "/customers/" + customerID + "/archive"
+	return encodeRequest(ctx, req, request)
+}
+
+func encodeUnarchiveCustomerRequest(ctx context.Context, req *http.Request, request interface{}) error {
+	// r.Methods("POST").Path("/customers/{id}/unarchive")
+	r := request.(unarchiveCustomerRequest)
+	customerID := url.QueryEscape(r.ID)
+	req.URL.Path = "/customers/" + customerID + "/unarchive"
+	return encodeRequest(ctx, req, request)
+}
+
+func encodeGetCustomersRequest(ctx context.Context, req *http.Request, request interface{}) error {
+	// r.Methods("GET").Path("/customers/")
+	r := request.(getCustomersRequest)
+	req.URL.Path = "/customers/"
+	q := url.Values{}
+	if r.Filter.Archived != "" {
+		q.Set("archived", r.Filter.Archived)
+	}
+	setOmitAddresses(q, r.OmitAddresses)
+	req.URL.RawQuery = q.Encode()
+	return encodeRequest(ctx, req, request)
+}
+
+func encodeGetCustomerStatsRequest(ctx context.Context, req *http.Request, request interface{}) error {
+	// r.Methods("GET").Path("/customers/{id}/stats")
+	r := request.(getCustomerStatsRequest)
+	customerID := url.QueryEscape(r.ID)
+	req.URL.Path = "/customers/" + customerID + "/stats"
+	return encodeRequest(ctx, req, request)
+}
+
+func encodePrepareCustomerRequest(ctx context.Context, req *http.Request, request interface{}) error {
+	// r.Methods("POST").Path("/customers:prepare")
+	r := request.(prepareCustomerRequest)
+	req.URL.Path = "/customers:prepare"
+	if r.TTL > 0 {
+		req.URL.RawQuery = url.Values{"ttl": {r.TTL.String()}}.Encode()
+	}
+	return encodeRequest(ctx, req, r.Customer)
+}
+
+func encodeCommitCustomerRequest(ctx context.Context, req *http.Request, request interface{}) error {
+	// r.Methods("POST").Path("/customers/{id}:commit")
+	r := request.(commitCustomerRequest)
+	customerID := url.QueryEscape(r.ID)
+	req.URL.Path = "/customers/" + customerID + ":commit"
+	return encodeRequest(ctx, req, request)
+}
+
+func encodeAbortCustomerRequest(ctx context.Context, req *http.Request, request interface{}) error {
+	// r.Methods("POST").Path("/customers/{id}:abort")
+	r := request.(abortCustomerRequest)
+	customerID := url.QueryEscape(r.ID)
+	req.URL.Path = "/customers/" + customerID + ":abort"
+	return encodeRequest(ctx, req, request)
+}
+
+func encodeGetCustomerByExternalIDRequest(ctx context.Context, req *http.Request, request interface{}) error {
+	// r.Methods("GET").Path("/customers/by-external-id/{system}/{id}")
+	r := request.(getCustomerByExternalIDRequest)
+	req.URL.Path = "/customers/by-external-id/" + url.QueryEscape(r.System) + "/" + url.QueryEscape(r.ExternalID)
+	return encodeRequest(ctx, req, request)
+}
+
+func encodeGetConsentsRequest(ctx context.Context, req *http.Request, request interface{}) error {
+	// r.Methods("GET").Path("/customers/{id}/consents/")
+	r := request.(getConsentsRequest)
+	customerID := url.QueryEscape(r.CustomerID)
+	req.URL.Path = "/customers/" + customerID + "/consents/"
+	return encodeRequest(ctx, req, request)
+}
+
+func encodeGrantConsentRequest(ctx context.Context, req *http.Request, request interface{}) error {
+	// r.Methods("POST").Path("/customers/{id}/consents/")
+	r := request.(grantConsentRequest)
+	customerID := url.QueryEscape(r.CustomerID)
+	req.URL.Path = "/customers/" + customerID + "/consents/"
+	return encodeRequest(ctx, req, r.Consent)
+}
+
+func encodeWithdrawConsentRequest(ctx context.Context, req *http.Request, request interface{}) error {
+	// r.Methods("DELETE").Path("/customers/{id}/consents/{type}")
+	r := request.(withdrawConsentRequest)
+	customerID := url.QueryEscape(r.CustomerID)
+	consentType := url.QueryEscape(r.Type)
+	req.URL.Path = "/customers/" + customerID + "/consents/" + consentType
+	return encodeRequest(ctx, req, request)
+}
+
 func decodePostCustomerResponse(_ context.Context, resp *http.Response) (interface{}, error) {
 	var response postCustomerResponse
 	err := json.NewDecoder(resp.Body).Decode(&response)
@@ -300,6 +954,12 @@ func decodeGetCustomerResponse(_ context.Context, resp *http.Response) (interfac
 	return response, err
 }
 
+func decodeGetCustomerAsOfResponse(_ context.Context, resp *http.Response) (interface{}, error) {
+	var response getCustomerAsOfResponse
+	err := json.NewDecoder(resp.Body).Decode(&response)
+	return response, err
+}
+
 func decodePutCustomerResponse(_ context.Context, resp *http.Response) (interface{}, error) {
 	var response putCustomerResponse
 	err := json.NewDecoder(resp.Body).Decode(&response)
@@ -342,6 +1002,126 @@ func decodeDeleteAddressResponse(_ context.Context, resp *http.Response) (interf
 	return response, err
 }
 
+func decodeGetCustomersByRegionResponse(_ context.Context, resp *http.Response) (interface{}, error) {
+	var response getCustomersByRegionResponse
+	err := json.NewDecoder(resp.Body).Decode(&response)
+	return response, err
+}
+
+func decodeGetDuplicateAddressesResponse(_ context.Context, resp *http.Response) (interface{}, error) {
+	var response getDuplicateAddressesResponse
+	err := json.NewDecoder(resp.Body).Decode(&response)
+	return response, err
+}
+
+func decodeRepairAddressesResponse(_ context.Context, resp *http.Response) (interface{}, error) {
+	var response repairAddressesResponse
+	err := json.NewDecoder(resp.Body).Decode(&response)
+	return response, err
+}
+
+func decodeRebuildIndexResponse(_ context.Context, resp *http.Response) (interface{}, error) {
+	var response rebuildIndexResponse
+	err := json.NewDecoder(resp.Body).Decode(&response)
+	return response, err
+}
+
+func decodeCheckConsistencyResponse(_ context.Context, resp *http.Response) (interface{}, error) {
+	var response checkConsistencyResponse
+	err := json.NewDecoder(resp.Body).Decode(&response)
+	return response, err
+}
+
+func decodePostAddressesResponse(_ context.Context, resp *http.Response) (interface{}, error) {
+	var response postAddressesResponse
+	err := json.NewDecoder(resp.Body).Decode(&response)
+	return response, err
+}
+
+func decodeReorderAddressesResponse(_ context.Context, resp *http.Response) (interface{}, error) {
+	var response reorderAddressesResponse
+	err := json.NewDecoder(resp.Body).Decode(&response)
+	return response, err
+}
+
+func decodeValidateCustomerResponse(_ context.Context, resp *http.Response) (interface{}, error) {
+	var response validateCustomerResponse
+	err := json.NewDecoder(resp.Body).Decode(&response)
+	return response, err
+}
+
+func decodeValidateAddressResponse(_ context.Context, resp *http.Response) (interface{}, error) {
+	var response validateAddressResponse
+	err := json.NewDecoder(resp.Body).Decode(&response)
+	return response, err
+}
+
+func decodeArchiveCustomerResponse(_ context.Context, resp *http.Response) (interface{}, error) {
+	var response archiveCustomerResponse
+	err := json.NewDecoder(resp.Body).Decode(&response)
+	return response, err
+}
+
+func decodeUnarchiveCustomerResponse(_ context.Context, resp *http.Response) (interface{}, error) {
+	var response unarchiveCustomerResponse
+	err := json.NewDecoder(resp.Body).Decode(&response)
+	return response, err
+}
+
+func decodeGetCustomersResponse(_ context.Context, resp *http.Response) (interface{}, error) {
+	var response getCustomersResponse
+	err := json.NewDecoder(resp.Body).Decode(&response)
+	return response, err
+}
+
+func decodeGetCustomerStatsResponse(_ context.Context, resp *http.Response) (interface{}, error) {
+	var response getCustomerStatsResponse
+	err := json.NewDecoder(resp.Body).Decode(&response)
+	return response, err
+}
+
+func decodePrepareCustomerResponse(_ context.Context, resp *http.Response) (interface{}, error) {
+	var response prepareCustomerResponse
+	err := json.NewDecoder(resp.Body).Decode(&response)
+	return response, err
+}
+
+func decodeCommitCustomerResponse(_ context.Context, resp *http.Response) (interface{}, error) {
+	var response commitCustomerResponse
+	err := json.NewDecoder(resp.Body).Decode(&response)
+	return response, err
+}
+
+func decodeAbortCustomerResponse(_ context.Context, resp *http.Response) (interface{}, error) {
+	var response abortCustomerResponse
+	err := json.NewDecoder(resp.Body).Decode(&response)
+	return response, err
+}
+
+func decodeGetCustomerByExternalIDResponse(_ context.Context, resp *http.Response) (interface{}, error) {
+	var response getCustomerByExternalIDResponse
+	err := json.NewDecoder(resp.Body).Decode(&response)
+	return response, err
+}
+
+func decodeGetConsentsResponse(_ context.Context, resp *http.Response) (interface{}, error) {
+	var response getConsentsResponse
+	err := json.NewDecoder(resp.Body).Decode(&response)
+	return response, err
+}
+
+func decodeGrantConsentResponse(_ context.Context, resp *http.Response) (interface{}, error) {
+	var response grantConsentResponse
+	err := json.NewDecoder(resp.Body).Decode(&response)
+	return response, err
+}
+
+func decodeWithdrawConsentResponse(_ context.Context, resp *http.Response) (interface{}, error) {
+	var response withdrawConsentResponse
+	err := json.NewDecoder(resp.Body).Decode(&response)
+	return response, err
+}
+
 // errorer is implemented by all concrete response types that may contain
 // errors. It allows us to change the HTTP response code without needing to
 // trigger an endpoint (transport-level) error. For more information, read the
@@ -351,8 +1131,9 @@ type errorer interface {
 }
 
 // encodeResponse is the common method to encode all response types to the
-// client. I chose to do it this way because, since we're using JSON, there's no
-// reason to provide anything more specific. It's certainly possible to
+// client. Responses are JSON unless the client asked for XML in its Accept
+// header; the same struct tags serve both. Customer lists may also be asked
+// for as CSV, see encodeCSV. It's certainly possible to
 // specialize on a per-response (per-method) basis.
 func encodeResponse(ctx context.Context, w http.ResponseWriter, response interface{}) error {
 	if e, ok := response.(errorer); ok && e.error() != nil {
@@ -361,14 +1142,122 @@ func encodeResponse(ctx context.Context, w http.ResponseWriter, response interfa
 		encodeError(ctx, e.error(), w)
 		return nil
 	}
+	if h, ok := response.(httptransport.Headerer); ok {
+		for k, values := range h.Headers() {
+			for _, v := range values {
+				w.Header().Add(k, v)
+			}
+		}
+	}
+	if l, ok := response.(csvLister); ok && acceptsCSV(ctx) {
+		customers, nextCursor := l.csvCustomers()
+		return encodeCSV(ctx, w, customers, nextCursor)
+	}
+	var buf bytes.Buffer
+	if acceptsXML(ctx) {
+		w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+		if err := encodeXML(&buf, response); err != nil {
+			return err
+		}
+		return writeBody(ctx, w, buf.Bytes())
+	}
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
-	return json.NewEncoder(w).Encode(response)
+	if respondsV2(ctx) {
+		w.Header().Set(APIVersionHeader, "2")
+		if v, ok := response.(versioned); ok {
+			response = v.v2()
+		}
+	} else {
+		w.Header().Set(APIVersionHeader, "1")
+	}
+	if err := json.NewEncoder(&buf).Encode(response); err != nil {
+		return err
+	}
+	return writeBody(ctx, w, buf.Bytes())
+}
+
+// PreferHeader is the RFC 7240 request header with which PUT and PATCH clients
+// ask for the resulting customer in the response, by sending
+// "return=representation". Otherwise those respond with an empty object.
+const PreferHeader = "Prefer"
+
+const preferRepresentation = "return=representation"
+
+// ErrNoRepresentation is returned by Endpoints.PutCustomerAndGet and
+// PatchCustomerAndGet when the response carries no customer: the mutation
+// failed, or the server predates PreferHeader.
+var ErrNoRepresentation = errors.New("response carried no customer")
+
+// prefersRepresentation reports whether r carries Prefer:
+// return=representation, among possibly other preferences.
+func prefersRepresentation(r *http.Request) bool {
+	for _, header := range r.Header[PreferHeader] {
+		for _, pref := range strings.Split(header, ",") {
+			if i := strings.IndexByte(pref, ';'); i >= 0 {
+				pref = pref[:i] // drop preference parameters
+			}
+			pref = strings.ToLower(strings.Join(strings.Fields(pref), ""))
+			if pref == preferRepresentation {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// representationApplied returns the Preference-Applied header acknowledging
+// return=representation, if applied.
+func representationApplied(applied bool) http.Header {
+	if !applied {
+		return nil
+	}
+	return http.Header{"Preference-Applied": {preferRepresentation}}
+}
+
+// encodeXML writes v as an XML document with a <response> root element,
+// regardless of the Go type name of v.
+func encodeXML(w io.Writer, v interface{}) error {
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	return xml.NewEncoder(w).EncodeElement(v, xml.StartElement{Name: xml.Name{Local: "response"}})
+}
+
+// decodeBody decodes the request body as XML if the Content-Type says so, and
+// as JSON otherwise.
+func decodeBody(r *http.Request, v interface{}) error {
+	if isXML(r.Header.Get("Content-Type")) {
+		return xml.NewDecoder(r.Body).Decode(v)
+	}
+	return json.NewDecoder(r.Body).Decode(v)
+}
+
+// acceptsXML reports whether the Accept header, as populated in ctx by
+// httptransport.PopulateRequestContext, prefers XML over JSON. Media ranges
+// are taken in the order given; q-values are not considered.
+func acceptsXML(ctx context.Context) bool {
+	accept, _ := ctx.Value(httptransport.ContextKeyRequestAccept).(string)
+	for _, mediaRange := range strings.Split(accept, ",") {
+		switch {
+		case isXML(mediaRange):
+			return true
+		case strings.Contains(mediaRange, "json"):
+			return false
+		}
+	}
+	return false
+}
+
+func isXML(mediaType string) bool {
+	mediaType = strings.TrimSpace(strings.SplitN(mediaType, ";", 2)[0])
+	return mediaType == "application/xml" || mediaType == "text/xml"
 }
 
 // encodeRequest likewise JSON-encodes the request to the HTTP request body.
 // Don't use it directly as a transport/http.Client EncodeRequestFunc:
 // customersvc endpoints require mutating the HTTP method and request path.
-func encodeRequest(_ context.Context, req *http.Request, request interface{}) error {
+func encodeRequest(ctx context.Context, req *http.Request, request interface{}) error {
+	setRequestTimeout(ctx, req)
 	var buf bytes.Buffer
 	err := json.NewEncoder(&buf).Encode(request)
 	if err != nil {
@@ -378,24 +1267,71 @@ func encodeRequest(_ context.Context, req *http.Request, request interface{}) er
 	return nil
 }
 
-func encodeError(_ context.Context, err error, w http.ResponseWriter) {
+func encodeError(ctx context.Context, err error, w http.ResponseWriter) {
 	if err == nil {
 		panic("encodeError with nil error")
 	}
+	if h, ok := err.(httptransport.Headerer); ok {
+		for k, values := range h.Headers() {
+			for _, v := range values {
+				w.Header().Add(k, v)
+			}
+		}
+	}
+	info, _ := ctx.Value(requestInfoKey{}).(requestInfo)
+	if info.problems {
+		writeProblem(ctx, w, info, codeFrom(err), err)
+		return
+	}
+	body := struct {
+		Error     string `json:"error" xml:"error"`
+		RequestID string `json:"request_id,omitempty" xml:"request_id,omitempty"`
+		TraceID   string `json:"trace_id,omitempty" xml:"trace_id,omitempty"`
+	}{err.Error(), info.id, info.traceID}
+	if acceptsXML(ctx) {
+		w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+		w.WriteHeader(codeFrom(err))
+		encodeXML(w, body)
+		return
+	}
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	w.WriteHeader(codeFrom(err))
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"error": err.Error(),
-	})
+	json.NewEncoder(w).Encode(body)
 }
 
 func codeFrom(err error) int {
 	switch err {
-	case ErrNotFound:
+	case ErrNotFound, ErrUnknownIndex:
 		return http.StatusNotFound
-	case ErrAlreadyExists, ErrInconsistentIDs:
+	case ErrAlreadyExists, ErrInconsistentIDs, ErrMissingRequiredInputs, ErrBatchTooLarge, ErrBatchRejected, ErrMissingAddressID, ErrInvalidOrder, ErrInvalidFilter, ErrUnknownCountry, ErrUnknownState, ErrInvalidTTL, ErrInvalidBlockEntry, ErrInvalidAsOf, ErrHistoryTruncated, ErrInvalidCursor, ErrInvalidScope, ErrInvalidExternalID, ErrInvalidConsent, ErrInvalidSort, ErrUnknownOwner, ErrDuplicateAddressID, ErrUnknownCustomField, ErrCustomFieldType, ErrCustomFieldValue, ErrMissingCustomField, ErrInvalidTap, ErrInvalidCredentialKind, ErrWeakSecret, ErrInvalidAddressWrite, ErrInvalidExpand, ErrInvalidColumns, ErrInvalidEffectiveDate, ErrInvalidEffectivePeriod, ErrInvalidSupersedes, ErrInvalidBulkPatch, ErrInvalidLocale, ErrInvalidNameVariant, ErrInvalidOmit:
+		return http.StatusBadRequest
+	case ErrExternalIDConflict, ErrDuplicateAddress, ErrRebuildInProgress, ErrColdConflict, ErrAddressInUse:
+		return http.StatusConflict
+	case ErrGone:
+		return http.StatusGone
+	case ErrAddressesSubresource, ErrIdempotencyKeyReused:
+		return http.StatusUnprocessableEntity
+	case ErrAmbiguousFraming:
 		return http.StatusBadRequest
-	default:
-		return http.StatusInternalServerError
+	case ErrHeadersTooLarge:
+		return http.StatusRequestHeaderFieldsTooLarge
+	case ErrMisdirected:
+		return http.StatusMisdirectedRequest
+	case ErrUnauthenticated:
+		return http.StatusUnauthorized
+	case ErrInvalidSignature, ErrSignatureExpired, ErrReplayed, ErrBlocked, ErrInsufficientScope, ErrConsentRequired, ErrNotOwner, ErrCaptchaRequired, ErrNotSelf, ErrTenantMismatch:
+		return http.StatusForbidden
+	case ErrRateLimited:
+		return http.StatusTooManyRequests
+	case ErrCredentialLocked:
+		return http.StatusLocked
+	case ErrTimeout:
+		return http.StatusGatewayTimeout
+	case ErrCaptchaUnavailable, ErrTapBusy:
+		return http.StatusServiceUnavailable
+	}
+	if sc, ok := err.(httptransport.StatusCoder); ok {
+		return sc.StatusCode()
 	}
+	return http.StatusInternalServerError
 }
@@ -0,0 +1,62 @@
+package customersvc
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+// crockford is the Crockford base32 alphabet ULIDs are written in. It sorts
+// in the same order as the values it encodes.
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// ulidSource generates ULIDs (https://github.com/ulid/spec): 48 bits of
+// millisecond timestamp followed by 80 random bits, as 26 characters. IDs
+// from the same source sort in the order they were generated, even within a
+// millisecond or if the clock steps back, so that address pages ordered by ID
+// are stable. It isn't safe for concurrent use.
+type ulidSource struct {
+	clock Clock
+	rand  Rand
+	last  [16]byte
+}
+
+// next returns a new ULID.
+func (u *ulidSource) next() (string, error) {
+	var id [16]byte
+	ms := uint64(u.clock.Now().UnixNano() / 1e6)
+	lastMs := binary.BigEndian.Uint64(append([]byte{0, 0}, u.last[:6]...))
+	if ms <= lastMs {
+		// Same millisecond, or the clock went back: increment the last ID
+		// instead, so that it still sorts after it.
+		id = u.last
+		for i := 15; i >= 0; i-- {
+			id[i]++
+			if id[i] != 0 {
+				break
+			}
+		}
+	} else {
+		var t [8]byte
+		binary.BigEndian.PutUint64(t[:], ms)
+		copy(id[:6], t[2:])
+		if _, err := io.ReadFull(u.rand, id[6:]); err != nil {
+			return "", err
+		}
+	}
+	u.last = id
+	return encodeULID(id), nil
+}
+
+// encodeULID writes the 128 bits of id as 26 base32 characters, the first
+// of which only carries 3 bits.
+func encodeULID(id [16]byte) string {
+	hi := binary.BigEndian.Uint64(id[:8])
+	lo := binary.BigEndian.Uint64(id[8:])
+	var s [26]byte
+	for i := 25; i >= 0; i-- {
+		s[i] = crockford[lo&31]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+	return string(s[:])
+}
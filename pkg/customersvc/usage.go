@@ -0,0 +1,301 @@
+package customersvc
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/endpoint"
+	httptransport "github.com/go-kit/kit/transport/http"
+	"github.com/gorilla/mux"
+)
+
+// DefaultTenant is the tenant of requests without an X-Tenant-ID header.
+const DefaultTenant = "default"
+
+// TenantFrom returns the tenant making the request carrying ctx, as given by
+// its X-Tenant-ID metadata. With API keys, that's the tenant of the key,
+// portal token or signed URL authorizing the request, which may only name
+// its own; without, any caller may name any tenant.
+//
+// Tenants attribute usage, and select a RoutingService backend. They don't
+// isolate data otherwise: tenants sharing a backend, such as every one left
+// on its default, share its customers and their IDs.
+func TenantFrom(ctx context.Context) string {
+	if t := RequestMetadataFrom(ctx).Get(MetadataTenant); t != "" {
+		return t
+	}
+	return DefaultTenant
+}
+
+// withTenant returns a copy of ctx whose request is made by tenant, see
+// TenantFrom, once its credentials have established it.
+func withTenant(ctx context.Context, tenant string) context.Context {
+	md := RequestMetadataFrom(ctx)
+	bound := make(RequestMetadata, len(md)+1)
+	for k, values := range md {
+		bound[k] = values
+	}
+	bound[MetadataTenant] = []string{tenant}
+	return WithRequestMetadata(ctx, bound)
+}
+
+// UsageRecord is the usage of one tenant over one UTC day.
+type UsageRecord struct {
+	Tenant string `json:"tenant" xml:"tenant"`
+	Day    string `json:"day" xml:"day"` // 2006-01-02
+	// Calls counts API calls by endpoint, e.g. "GetCustomer".
+	Calls      map[string]int `json:"calls,omitempty" xml:"-"`
+	TotalCalls int            `json:"total_calls" xml:"total_calls"`
+	// Customers is the number of customers stored on behalf of the
+	// tenant, i.e. created by it and not deleted since, at the end of the
+	// day, or now for the current day.
+	Customers int `json:"customers" xml:"customers"`
+}
+
+// UsageSink receives a UsageRecord per tenant at the end of each day, for
+// billing.
+type UsageSink interface {
+	RecordUsage(ctx context.Context, r UsageRecord) error
+}
+
+// NewLogUsageSink returns a UsageSink writing each record as a single log
+// event to logger.
+func NewLogUsageSink(logger Logger) UsageSink {
+	return logUsageSink{logger}
+}
+
+type logUsageSink struct{ logger Logger }
+
+func (s logUsageSink) RecordUsage(_ context.Context, r UsageRecord) error {
+	return s.logger.Log(
+		"tenant", r.Tenant,
+		"day", r.Day,
+		"total_calls", r.TotalCalls,
+		"customers", r.Customers,
+	)
+}
+
+// Meter tracks API calls and stored customers per tenant. Calls are counted
+// by mounting it with WithMeter, and customers by UsageMiddleware. Both are
+// kept in memory: customers stored before the process started aren't
+// attributed to anyone.
+type Meter struct {
+	sink   UsageSink
+	logger Logger
+	clock  Clock
+
+	mtx       sync.Mutex
+	day       string
+	calls     map[string]map[string]int // by tenant, then method
+	owners    map[string]string         // tenant by customer ID
+	customers map[string]int            // by tenant
+}
+
+// NewMeter returns a Meter emitting daily records to sink. Failures to emit
+// are logged to logger.
+func NewMeter(sink UsageSink, logger Logger, options ...Option) *Meter {
+	o := makeOptions(options)
+	return &Meter{
+		sink:      sink,
+		logger:    logger,
+		clock:     o.clock,
+		day:       usageDay(o.clock.Now()),
+		calls:     map[string]map[string]int{},
+		owners:    map[string]string{},
+		customers: map[string]int{},
+	}
+}
+
+func usageDay(t time.Time) string { return t.UTC().Format("2006-01-02") }
+
+// Usage returns the usage of tenant so far today.
+func (m *Meter) Usage(tenant string) UsageRecord {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	return m.usage(tenant)
+}
+
+// usage builds tenant's record for the current day. The caller must hold the
+// lock.
+func (m *Meter) usage(tenant string) UsageRecord {
+	r := UsageRecord{Tenant: tenant, Day: m.day, Calls: map[string]int{}, Customers: m.customers[tenant]}
+	for method, n := range m.calls[tenant] {
+		r.Calls[method] = n
+		r.TotalCalls += n
+	}
+	return r
+}
+
+// Run emits the records of each day to the sink once it's over, checking
+// every interval until done is closed.
+func (m *Meter) Run(interval time.Duration, done <-chan struct{}) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			m.rollover()
+		case <-done:
+			return
+		}
+	}
+}
+
+// rollover emits and resets the day's records if it's over.
+func (m *Meter) rollover() {
+	m.mtx.Lock()
+	today := usageDay(m.clock.Now())
+	if today == m.day {
+		m.mtx.Unlock()
+		return
+	}
+	tenants := make(map[string]bool, len(m.calls)+len(m.customers))
+	for t := range m.calls {
+		tenants[t] = true
+	}
+	for t := range m.customers {
+		tenants[t] = true
+	}
+	records := make([]UsageRecord, 0, len(tenants))
+	for t := range tenants {
+		records = append(records, m.usage(t))
+	}
+	m.day = today
+	m.calls = map[string]map[string]int{}
+	m.mtx.Unlock()
+
+	sort.Slice(records, func(i, j int) bool { return records[i].Tenant < records[j].Tenant })
+	for _, r := range records {
+		if err := m.sink.RecordUsage(context.Background(), r); err != nil {
+			m.logger.Log("usage", r.Day, "tenant", r.Tenant, "err", err)
+		}
+	}
+}
+
+func (m *Meter) count(tenant, method string) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	calls, ok := m.calls[tenant]
+	if !ok {
+		calls = map[string]int{}
+		m.calls[tenant] = calls
+	}
+	calls[method]++
+}
+
+// own attributes customer id to tenant, unless it's attributed already.
+func (m *Meter) own(tenant, id string) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	if _, ok := m.owners[id]; ok {
+		return
+	}
+	m.owners[id] = tenant
+	m.customers[tenant]++
+}
+
+func (m *Meter) disown(id string) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	tenant, ok := m.owners[id]
+	if !ok {
+		return
+	}
+	delete(m.owners, id)
+	if m.customers[tenant]--; m.customers[tenant] == 0 {
+		delete(m.customers, tenant)
+	}
+}
+
+// endpointMiddleware counts calls to the endpoint by tenant.
+func (m *Meter) endpointMiddleware(method string) endpoint.Middleware {
+	return func(next endpoint.Endpoint) endpoint.Endpoint {
+		return func(ctx context.Context, request interface{}) (interface{}, error) {
+			m.count(TenantFrom(ctx), method)
+			return next(ctx, request)
+		}
+	}
+}
+
+// UsageMiddleware attributes the customers created through it to the tenant
+// creating them, until they're deleted.
+func UsageMiddleware(m *Meter) Middleware {
+	return func(next Service) Service {
+		return usageMiddleware{next, m}
+	}
+}
+
+type usageMiddleware struct {
+	Service
+	meter *Meter
+}
+
+func (mw usageMiddleware) PostCustomer(ctx context.Context, p Customer) error {
+	err := mw.Service.PostCustomer(ctx, p)
+	if err == nil {
+		mw.meter.own(TenantFrom(ctx), p.ID)
+	}
+	return err
+}
+
+func (mw usageMiddleware) PutCustomer(ctx context.Context, id string, p Customer) error {
+	err := mw.Service.PutCustomer(ctx, id, p)
+	if err == nil {
+		mw.meter.own(TenantFrom(ctx), id) // no-op when replacing a customer
+	}
+	return err
+}
+
+func (mw usageMiddleware) CommitCustomer(ctx context.Context, id string) error {
+	err := mw.Service.CommitCustomer(ctx, id)
+	if err == nil {
+		mw.meter.own(TenantFrom(ctx), id)
+	}
+	return err
+}
+
+func (mw usageMiddleware) DeleteCustomer(ctx context.Context, id string) error {
+	err := mw.Service.DeleteCustomer(ctx, id)
+	if err == nil {
+		mw.meter.disown(id)
+	}
+	return err
+}
+
+// WithMeter counts every API call against the tenant making it, and mounts
+// an endpoint reporting usage:
+//
+//	GET     /admin/tenants/:id/usage   usage of the tenant so far today
+func WithMeter(m *Meter) HandlerOption {
+	return func(c *handlerConfig) { c.meter = m }
+}
+
+func mountMeter(r *mux.Router, m *Meter, wrap func(string, endpoint.Endpoint) endpoint.Endpoint, options []httptransport.ServerOption) {
+	r.Methods("GET").Path("/admin/tenants/{id}/usage").Handler(httptransport.NewServer(
+		wrap("GetTenantUsage", makeGetTenantUsageEndpoint(m)),
+		decodeGetTenantUsageRequest,
+		encodeResponse,
+		options...,
+	))
+}
+
+func makeGetTenantUsageEndpoint(m *Meter) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		return getTenantUsageResponse{Usage: m.Usage(request.(string))}, nil
+	}
+}
+
+type getTenantUsageResponse struct {
+	Usage UsageRecord `json:"usage" xml:"usage"`
+}
+
+func decodeGetTenantUsageRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	id, ok := mux.Vars(r)["id"]
+	if !ok {
+		return nil, ErrBadRouting
+	}
+	return id, nil
+}
@@ -0,0 +1,138 @@
+package customersvc
+
+import (
+	"fmt"
+
+	"github.com/praveensastry/customersvc/pkg/iso3166"
+)
+
+// FieldError is a single problem found while validating a customer or an
+// address. Field names use the JSON names, with indexes for list items, e.g.
+// "addresses[2].id".
+type FieldError struct {
+	Field   string `json:"field" xml:"field"`
+	Message string `json:"message" xml:"message"`
+
+	err error // returned by write paths that fail on this rule
+}
+
+func fieldError(field string, err error) FieldError {
+	return FieldError{Field: field, Message: err.Error(), err: err}
+}
+
+func requiredField(field string, err error) FieldError {
+	return FieldError{Field: field, Message: "is required", err: err}
+}
+
+// RegionCheck says how the country and state of addresses are checked
+// against ISO 3166.
+type RegionCheck int
+
+const (
+	// RegionLenient rewrites known countries and states to their ISO codes,
+	// e.g. "USA" to "US" and "California" to "CA", and accepts unknown ones
+	// as they are. It's the default.
+	RegionLenient RegionCheck = iota
+	// RegionStrict rewrites like RegionLenient, and also rejects countries
+	// that aren't in ISO 3166-1, and states that aren't ISO 3166-2
+	// subdivisions of their country.
+	RegionStrict
+	// RegionUnchecked leaves countries and states alone.
+	RegionUnchecked
+)
+
+// ParseRegionCheck parses "lenient", "strict" or "off".
+func ParseRegionCheck(s string) (RegionCheck, error) {
+	switch s {
+	case "lenient":
+		return RegionLenient, nil
+	case "strict":
+		return RegionStrict, nil
+	case "off":
+		return RegionUnchecked, nil
+	}
+	return 0, fmt.Errorf("unknown region check %q", s)
+}
+
+// validateCustomer applies every stateless rule to p. Write paths fail with
+// the error of the first problem found; the validate endpoints report all of
+// them. Addresses should have gone through normalizeRegions first.
+func validateCustomer(p Customer, check RegionCheck, schema *AddressSchema) []FieldError {
+	var errs []FieldError
+	if p.Name == "" {
+		errs = append(errs, requiredField("name", ErrMissingRequiredInputs))
+	}
+	if p.Email == "" {
+		errs = append(errs, requiredField("email", ErrMissingRequiredInputs))
+	}
+	errs = append(errs, validateNames(p)...)
+	return append(errs, validateAddresses(p.Addresses, check, schema)...)
+}
+
+// validateAddress applies every stateless rule to a, which should have gone
+// through normalizeRegion first.
+// Addresses without an ID get a generated one.
+func validateAddress(a Address, check RegionCheck, schema *AddressSchema) []FieldError {
+	errs := append(validateRegion("", a, check), schema.validate("", a)...)
+	return append(errs, validatePeriod("", a)...)
+}
+
+// validateAddresses returns the problems of every address, for the write
+// paths that don't otherwise validate addresses.
+func validateAddresses(addresses []Address, check RegionCheck, schema *AddressSchema) []FieldError {
+	var errs []FieldError
+	for i, a := range addresses {
+		prefix := fmt.Sprintf("addresses[%d].", i)
+		errs = append(errs, validateRegion(prefix, a, check)...)
+		errs = append(errs, schema.validate(prefix, a)...)
+		errs = append(errs, validatePeriod(prefix, a)...)
+	}
+	return errs
+}
+
+func validateRegion(prefix string, a Address, check RegionCheck) []FieldError {
+	if check != RegionStrict {
+		return nil
+	}
+	var errs []FieldError
+	if a.Country != "" {
+		alpha2, ok := iso3166.Country(a.Country)
+		if !ok {
+			errs = append(errs, fieldError(prefix+"country", ErrUnknownCountry))
+		} else if a.State != "" && iso3166.HasSubdivisions(alpha2) {
+			if _, ok := iso3166.Subdivision(alpha2, a.State); !ok {
+				errs = append(errs, fieldError(prefix+"state", ErrUnknownState))
+			}
+		}
+	}
+	return errs
+}
+
+// normalizeRegion rewrites the country and state of a to their ISO codes,
+// when it recognizes them.
+func normalizeRegion(a Address, check RegionCheck) Address {
+	if check == RegionUnchecked || a.Country == "" {
+		return a
+	}
+	alpha2, ok := iso3166.Country(a.Country)
+	if !ok {
+		return a
+	}
+	a.Country = alpha2
+	if code, ok := iso3166.Subdivision(alpha2, a.State); ok {
+		a.State = code
+	}
+	return a
+}
+
+// normalizeRegions is normalizeRegion for a list, which it copies.
+func normalizeRegions(addresses []Address, check RegionCheck) []Address {
+	if len(addresses) == 0 || check == RegionUnchecked {
+		return addresses
+	}
+	normalized := make([]Address, len(addresses))
+	for i, a := range addresses {
+		normalized[i] = normalizeRegion(a, check)
+	}
+	return normalized
+}
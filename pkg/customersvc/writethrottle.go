@@ -0,0 +1,163 @@
+package customersvc
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/endpoint"
+)
+
+// ErrWriteThrottled is the message of errors returned for a write beyond the
+// budget of the API key or tenant making it. Those errors carry Retry-After
+// and X-RateLimit-* headers.
+var ErrWriteThrottled = errors.New("write budget exceeded")
+
+// WriteThrottle gives every API key, or for requests without one every
+// tenant, a budget of writes, so that one noisy integrator can't monopolize
+// the store. Reads aren't counted, and neither are admin operations: the
+// endpoints throttled are those needing ScopeWrite. It's separate from, and
+// applies on top of, the global rate limit. Budgets refill continuously,
+// like a token bucket, and are kept in memory, per replica.
+type WriteThrottle struct {
+	writes int
+	per    time.Duration
+	clock  Clock
+
+	mtx     sync.Mutex
+	budgets map[string]*writeBudget
+	swept   time.Time
+}
+
+type writeBudget struct {
+	tokens float64
+	at     time.Time // when tokens was last brought up to date
+}
+
+// NewWriteThrottle returns a WriteThrottle allowing writes per period, e.g.
+// 100 per minute, to each API key or tenant, in bursts of up to writes.
+// Mount it with WithWriteThrottle.
+func NewWriteThrottle(writes int, per time.Duration, options ...Option) *WriteThrottle {
+	o := makeOptions(options)
+	return &WriteThrottle{
+		writes:  writes,
+		per:     per,
+		clock:   o.clock,
+		budgets: map[string]*writeBudget{},
+	}
+}
+
+// WithWriteThrottle throttles writes with t, see WriteThrottle. Responses to
+// writes carry X-RateLimit-* headers reporting what's left of the budget.
+func WithWriteThrottle(t *WriteThrottle) HandlerOption {
+	return func(c *handlerConfig) { c.writes = t }
+}
+
+// writeUsage is what's left of the budget of the write being handled, for
+// the response headers. Requests carry a pointer to it in their context from
+// before, so that the endpoint middleware can fill it in for after.
+type writeUsage struct {
+	limit, remaining int
+	reset            time.Duration
+}
+
+type writeUsageKey struct{}
+
+// before gives the request a writeUsage for the middleware to fill in.
+func (t *WriteThrottle) before(ctx context.Context, _ *http.Request) context.Context {
+	return context.WithValue(ctx, writeUsageKey{}, &writeUsage{})
+}
+
+// after reports the budget left to writes let through.
+func (t *WriteThrottle) after(ctx context.Context, w http.ResponseWriter) context.Context {
+	if u, _ := ctx.Value(writeUsageKey{}).(*writeUsage); u != nil && u.limit > 0 {
+		w.Header().Set(RateLimitLimitHeader, strconv.Itoa(u.limit))
+		w.Header().Set(RateLimitRemainingHeader, strconv.Itoa(u.remaining))
+		w.Header().Set(RateLimitResetHeader, strconv.Itoa(ceilSeconds(u.reset)))
+	}
+	return ctx
+}
+
+// middleware takes a write from the budget of the caller, or rejects the
+// request with ErrWriteThrottled. It must run inside the API key and portal
+// token middlewares, whose identities it throttles.
+func (t *WriteThrottle) middleware(method string) endpoint.Middleware {
+	if scope, ok := methodScopes[method]; ok && scope != ScopeWrite {
+		return func(next endpoint.Endpoint) endpoint.Endpoint { return next }
+	}
+	return func(next endpoint.Endpoint) endpoint.Endpoint {
+		return func(ctx context.Context, request interface{}) (interface{}, error) {
+			usage, err := t.take(writeThrottleScope(ctx))
+			if err != nil {
+				return nil, err
+			}
+			if u, _ := ctx.Value(writeUsageKey{}).(*writeUsage); u != nil {
+				*u = usage
+			}
+			return next(ctx, request)
+		}
+	}
+}
+
+// writeThrottleScope returns whose budget a write comes out of.
+func writeThrottleScope(ctx context.Context) string {
+	if key, ok := APIKeyFrom(ctx); ok {
+		return "apikey:" + key.ID
+	}
+	if customerID, ok := PortalAccess(ctx); ok {
+		return "portal:" + customerID
+	}
+	return "tenant:" + TenantFrom(ctx)
+}
+
+// take takes a write from the budget of scope, returning what's left, or
+// the writeThrottledError to reject the write with if there's nothing left.
+func (t *WriteThrottle) take(scope string) (writeUsage, error) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	now := t.clock.Now()
+	refill := float64(t.writes) / float64(t.per) // tokens per nanosecond
+	if now.Sub(t.swept) >= t.per {
+		// Budgets refilled by now are as good as new: drop them.
+		for s, b := range t.budgets {
+			if b.tokens+float64(now.Sub(b.at))*refill >= float64(t.writes) {
+				delete(t.budgets, s)
+			}
+		}
+		t.swept = now
+	}
+	b, ok := t.budgets[scope]
+	if !ok {
+		b = &writeBudget{tokens: float64(t.writes), at: now}
+		t.budgets[scope] = b
+	}
+	b.tokens = math.Min(float64(t.writes), b.tokens+float64(now.Sub(b.at))*refill)
+	b.at = now
+	if b.tokens < 1 {
+		return writeUsage{}, writeThrottledError{rateLimitedError{
+			limit:      t.writes,
+			retryAfter: time.Duration((1 - b.tokens) / refill),
+			reset:      time.Duration((float64(t.writes) - b.tokens) / refill),
+		}}
+	}
+	b.tokens--
+	return writeUsage{
+		limit:     t.writes,
+		remaining: int(b.tokens),
+		reset:     time.Duration((float64(t.writes) - b.tokens) / refill),
+	}, nil
+}
+
+// writeThrottledError is ErrWriteThrottled with the backoff hints of a
+// rateLimitedError.
+type writeThrottledError struct {
+	rateLimitedError
+}
+
+func (e writeThrottledError) Error() string { return ErrWriteThrottled.Error() }
+
+func (e writeThrottledError) Unwrap() error { return ErrWriteThrottled }
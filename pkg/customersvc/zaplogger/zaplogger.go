@@ -0,0 +1,50 @@
+// Package zaplogger adapts a zap logger to a customersvc.Logger.
+package zaplogger
+
+import (
+	"fmt"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+
+	"github.com/praveensastry/customersvc/pkg/customersvc"
+)
+
+// New returns a customersvc.Logger writing each event to logger. The values
+// of the "level" and "msg" keys, if any, become the zap level and message;
+// events without a level are logged at info. Every other pair becomes a
+// field.
+func New(logger *zap.Logger) customersvc.Logger {
+	return zapLogger{logger}
+}
+
+type zapLogger struct{ logger *zap.Logger }
+
+func (l zapLogger) Log(keyvals ...interface{}) error {
+	var (
+		lvl    = zapcore.InfoLevel
+		msg    string
+		fields = make([]zap.Field, 0, (len(keyvals)+1)/2)
+	)
+	for i := 0; i < len(keyvals); i += 2 {
+		key := fmt.Sprint(keyvals[i])
+		var value interface{} = "(MISSING)"
+		if i+1 < len(keyvals) {
+			value = keyvals[i+1]
+		}
+		switch key {
+		case "level":
+			if err := lvl.UnmarshalText([]byte(fmt.Sprint(value))); err != nil {
+				lvl = zapcore.InfoLevel
+			}
+		case "msg":
+			msg = fmt.Sprint(value)
+		default:
+			fields = append(fields, zap.Any(key, value))
+		}
+	}
+	if ce := l.logger.Check(lvl, msg); ce != nil {
+		ce.Write(fields...)
+	}
+	return nil
+}
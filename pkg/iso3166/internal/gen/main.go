@@ -0,0 +1,79 @@
+// Command gen writes data.go of package iso3166 from the JSON files of the
+// Debian iso-codes project (https://salsa.debian.org/iso-codes-team/iso-codes).
+//
+// Usage: go run ./internal/gen /usr/share/iso-codes/json > data.go
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+func main() {
+	if len(os.Args) != 2 {
+		fmt.Fprintln(os.Stderr, "usage: gen <iso-codes json dir>")
+		os.Exit(2)
+	}
+	dir := os.Args[1]
+
+	var part1 struct {
+		Countries []struct {
+			Alpha2       string `json:"alpha_2"`
+			Alpha3       string `json:"alpha_3"`
+			Name         string `json:"name"`
+			CommonName   string `json:"common_name"`
+			OfficialName string `json:"official_name"`
+		} `json:"3166-1"`
+	}
+	var part2 struct {
+		Subdivisions []struct {
+			Code string `json:"code"`
+			Name string `json:"name"`
+		} `json:"3166-2"`
+	}
+	load(filepath.Join(dir, "iso_3166-1.json"), &part1)
+	load(filepath.Join(dir, "iso_3166-2.json"), &part2)
+	sort.Slice(part1.Countries, func(i, j int) bool { return part1.Countries[i].Alpha2 < part1.Countries[j].Alpha2 })
+	sort.Slice(part2.Subdivisions, func(i, j int) bool { return part2.Subdivisions[i].Code < part2.Subdivisions[j].Code })
+
+	w := bufio.NewWriter(os.Stdout)
+	defer w.Flush()
+	fmt.Fprintln(w, "// Code generated by internal/gen from iso-codes; DO NOT EDIT.")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "package iso3166")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "var countries = []country{")
+	for _, c := range part1.Countries {
+		names := []string{c.Name}
+		for _, n := range []string{c.CommonName, c.OfficialName} {
+			if n != "" && n != c.Name {
+				names = append(names, n)
+			}
+		}
+		fmt.Fprintf(w, "\t{%q, %q, %#v},\n", c.Alpha2, c.Alpha3, names)
+	}
+	fmt.Fprintln(w, "}")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "var subdivisions = []subdivision{")
+	for _, s := range part2.Subdivisions {
+		fmt.Fprintf(w, "\t{%q, %q},\n", s.Code, s.Name)
+	}
+	fmt.Fprintln(w, "}")
+}
+
+func load(path string, v interface{}) {
+	f, err := os.Open(path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	defer f.Close()
+	if err := json.NewDecoder(f).Decode(v); err != nil {
+		fmt.Fprintln(os.Stderr, path, err)
+		os.Exit(1)
+	}
+}
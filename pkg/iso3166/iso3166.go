@@ -0,0 +1,92 @@
+// Package iso3166 recognizes ISO 3166-1 country codes and ISO 3166-2
+// subdivision codes, along with their English names and a few common
+// aliases, and normalizes them to the ISO codes.
+//
+// The data is embedded, generated from the Debian iso-codes project.
+package iso3166
+
+//go:generate sh -c "go run ./internal/gen /usr/share/iso-codes/json | gofmt > data.go"
+
+import "strings"
+
+type country struct {
+	alpha2, alpha3 string
+	names          []string
+}
+
+type subdivision struct {
+	code, name string // code is "XX-YYY"
+}
+
+// aliases are names in common use that iso-codes doesn't list.
+var aliases = map[string]string{
+	"u.s.":          "US",
+	"u.s.a.":        "US",
+	"america":       "US",
+	"uk":            "GB",
+	"u.k.":          "GB",
+	"britain":       "GB",
+	"great britain": "GB",
+	"holland":       "NL",
+	"russia":        "RU",
+	"south korea":   "KR",
+	"north korea":   "KP",
+}
+
+var (
+	countryIndex     = map[string]string{}            // key -> alpha-2
+	subdivisionIndex = map[string]map[string]string{} // alpha-2 -> key -> subdivision code
+)
+
+func init() {
+	for _, c := range countries {
+		countryIndex[key(c.alpha2)] = c.alpha2
+		countryIndex[key(c.alpha3)] = c.alpha2
+		for _, name := range c.names {
+			countryIndex[key(name)] = c.alpha2
+		}
+	}
+	for alias, alpha2 := range aliases {
+		countryIndex[alias] = alpha2
+	}
+	for _, s := range subdivisions {
+		alpha2, code := s.code[:2], s.code[3:]
+		index, ok := subdivisionIndex[alpha2]
+		if !ok {
+			index = map[string]string{}
+			subdivisionIndex[alpha2] = index
+		}
+		index[key(s.code)] = code
+		index[key(code)] = code
+		if _, taken := index[key(s.name)]; !taken {
+			index[key(s.name)] = code
+		}
+	}
+}
+
+func key(s string) string {
+	return strings.ToLower(strings.TrimSpace(s))
+}
+
+// Country returns the alpha-2 code of the country s, which may be an alpha-2
+// or alpha-3 code, or an English name, in any case. For example "USA",
+// "us" and "United States" all give "US".
+func Country(s string) (alpha2 string, ok bool) {
+	alpha2, ok = countryIndex[key(s)]
+	return alpha2, ok
+}
+
+// Subdivision returns the code of the subdivision s of the country with the
+// given alpha-2 code, without the country prefix. s may be a code, with or
+// without the prefix, or an English name, in any case. For example
+// Subdivision("US", "california") gives "CA".
+func Subdivision(alpha2, s string) (code string, ok bool) {
+	code, ok = subdivisionIndex[alpha2][key(s)]
+	return code, ok
+}
+
+// HasSubdivisions reports whether any subdivisions of the country with the
+// given alpha-2 code are known.
+func HasSubdivisions(alpha2 string) bool {
+	return len(subdivisionIndex[alpha2]) > 0
+}